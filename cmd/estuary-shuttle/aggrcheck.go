@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+)
+
+// aggregationCodecs are the codecs that can be allowed for aggregate members
+var aggregationCodecs = map[string]uint64{
+	"dag-pb":   cid.DagProtobuf,
+	"raw":      cid.Raw,
+	"dag-cbor": cid.DagCBOR,
+	"dag-json": cid.DagJSON,
+}
+
+func aggregationMemberCodecs(names []string) (map[uint64]bool, error) {
+	codecs := make(map[uint64]bool, len(names))
+	for _, n := range names {
+		c, ok := aggregationCodecs[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown aggregation member codec %q", n)
+		}
+		codecs[c] = true
+	}
+	return codecs, nil
+}
+
+// checkAggregateMembers makes sure the aggregate box is a dag-pb node linking
+// to the root of every member, and that the member roots can be resolved
+// through it. Codec and cid version mismatches are only logged when the
+// shuttle is configured to warn on them.
+func (s *Shuttle) checkAggregateMembers(cmd *drpc.AggregateContent) error {
+	cfg := s.config().Aggregation
+
+	if cmd.Root.Type() != cid.DagProtobuf {
+		return fmt.Errorf("aggregate %d root %s is not a dag-pb node", cmd.DBID, cmd.Root)
+	}
+
+	box, err := merkledag.DecodeProtobuf(cmd.ObjData)
+	if err != nil {
+		return fmt.Errorf("failed to decode aggregate %d: %w", cmd.DBID, err)
+	}
+
+	linked := cid.NewSet()
+	for _, l := range box.Links() {
+		linked.Add(l.Cid)
+	}
+
+	var pins []Pin
+	if err := s.DB.Find(&pins, "content in ?", cmd.Contents).Error; err != nil {
+		return err
+	}
+
+	allowed, err := aggregationMemberCodecs(cfg.MemberCodecs)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for _, p := range pins {
+		root := p.Cid.CID
+		if !linked.Has(root) {
+			return fmt.Errorf("aggregate %d does not link to the root %s of content %d", cmd.DBID, root, p.Content)
+		}
+
+		if !allowed[root.Type()] {
+			mismatches = append(mismatches, fmt.Sprintf("content %d root %s has codec 0x%x", p.Content, root, root.Type()))
+		} else if cfg.MatchCidVersion && root.Version() != cmd.Root.Version() {
+			mismatches = append(mismatches, fmt.Sprintf("content %d root %s is a v%d cid", p.Content, root, root.Version()))
+		}
+	}
+
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	msg := strings.Join(mismatches, ", ")
+	if cfg.WarnOnMismatch {
+		log.Warnf("aggregate %d has members it may not resolve: %s", cmd.DBID, msg)
+		return nil
+	}
+	return fmt.Errorf("aggregate %d has members it cannot resolve: %s", cmd.DBID, msg)
+}
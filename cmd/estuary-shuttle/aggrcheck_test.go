@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-unixfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckAggregateMembers(t *testing.T) {
+	a := assert.New(t)
+	s := newAggrTestShuttle(t)
+
+	cmd := newAggrTestCmd(t, s)
+	a.NoError(s.checkAggregateMembers(cmd))
+
+	// raw members of a v0 aggregate are fine unless versions must match
+	s.config().Aggregation.MatchCidVersion = true
+	a.Error(s.checkAggregateMembers(cmd))
+
+	s.config().Aggregation.WarnOnMismatch = true
+	a.NoError(s.checkAggregateMembers(cmd))
+
+	s.config().Aggregation.MatchCidVersion = false
+	s.config().Aggregation.WarnOnMismatch = false
+	s.config().Aggregation.MemberCodecs = []string{"dag-pb"}
+	a.Error(s.checkAggregateMembers(cmd))
+
+	s.config().Aggregation.MemberCodecs = []string{"dag-pb", "raw"}
+
+	// a box that is not dag-pb cannot be resolved at all
+	blk := blocks.NewBlock(cmd.ObjData)
+	bad := *cmd
+	bad.Root = blk.Cid()
+	a.Error(s.checkAggregateMembers(&bad))
+
+	// neither can a box missing a member
+	other := blocks.NewBlock([]byte("not a member")).Cid()
+	box := unixfs.EmptyDirNode()
+	a.NoError(box.AddRawLink("other", &ipld.Link{Cid: other}))
+	bad = *cmd
+	bad.Root = box.Cid()
+	bad.ObjData = box.RawData()
+	a.Error(s.checkAggregateMembers(&bad))
+
+	_, err := aggregationMemberCodecs([]string{"git-raw"})
+	a.Error(err)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// estuary never gives out content id 0, the pin of the synthetic content of a
+// benchmark uses it so a pin left over by a crash is found on the next run
+const benchmarkContent uint = 0
+
+func (s *Shuttle) handleRpcBenchmark(ctx context.Context, req *drpc.Benchmark) error {
+	if req == nil {
+		return fmt.Errorf("benchmark command is missing its params")
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_BenchmarkResult,
+		Params: drpc.MsgParams{
+			BenchmarkResult: s.runBenchmark(ctx, req.Size, req.Provide),
+		},
+	})
+}
+
+// runBenchmark imports synthetic content, tracks it like a pin, optionally
+// provides it and reads it back, timing each stage. The blocks and database
+// rows of the content are removed whatever the outcome.
+func (s *Shuttle) runBenchmark(ctx context.Context, size int64, provide bool) *drpc.BenchmarkResult {
+	cfg := s.config().Benchmark
+	if size == 0 {
+		size = cfg.Size
+	}
+
+	res := &drpc.BenchmarkResult{Size: size}
+	if size < 1 || size > cfg.MaxSize {
+		res.Error = fmt.Sprintf("benchmark size must be between 1 and %d bytes", cfg.MaxSize)
+		return res
+	}
+
+	if !s.benchmarkLk.TryLock() {
+		res.Error = "a benchmark is already running"
+		return res
+	}
+	defer s.benchmarkLk.Unlock()
+
+	bs := &benchBlockstore{Blockstore: s.Node.Blockstore}
+	defer func() {
+		if err := s.cleanupBenchmark(context.Background(), bs.added()); err != nil {
+			log.Errorf("failed to clean up benchmark content: %s", err)
+		}
+	}()
+
+	if err := s.cleanupBenchmark(ctx, nil); err != nil {
+		res.Error = fmt.Sprintf("failed to clean up the content of a previous benchmark: %s", err)
+		return res
+	}
+
+	if err := s.benchmarkStages(ctx, bs, size, provide, res); err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func (s *Shuttle) benchmarkStages(ctx context.Context, bs *benchBlockstore, size int64, provide bool, res *drpc.BenchmarkResult) error {
+	stage := func(name string, n int64, nblocks int, start time.Time) {
+		took := time.Since(start)
+		res.Stages = append(res.Stages, drpc.BenchmarkStage{
+			Name:        name,
+			Bytes:       n,
+			Blocks:      nblocks,
+			Duration:    took,
+			BytesPerSec: float64(n) / took.Seconds(),
+		})
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	start := time.Now()
+	//#nosec G404 - the content only has to be unique, not unpredictable
+	data := io.LimitReader(rand.New(rand.NewSource(start.UnixNano())), size)
+	nd, err := util.ImportFile(dserv, data)
+	if err != nil {
+		return fmt.Errorf("failed to import benchmark content: %w", err)
+	}
+	stage("import", size, len(bs.added()), start)
+
+	root := nd.Cid()
+	if err := s.DB.Create(&Pin{
+		Content:     benchmarkContent,
+		Cid:         util.DbCID{CID: root},
+		Pinning:     true,
+		Unannounced: true,
+	}).Error; err != nil {
+		return err
+	}
+
+	start = time.Now()
+	total, objects, err := s.addDatabaseTrackingToContent(ctx, benchmarkContent, dserv, bs, root, func(int64) {})
+	if err != nil {
+		return fmt.Errorf("failed to track benchmark content: %w", err)
+	}
+	stage("track", total, len(objects), start)
+
+	if provide {
+		cids := bs.added()
+		start = time.Now()
+		s.provideBatch(cids)
+		stage("provide", total, len(cids), start)
+	}
+
+	start = time.Now()
+	rdserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	rnd, err := rdserv.Get(ctx, root)
+	if err != nil {
+		return fmt.Errorf("failed to read back benchmark content: %w", err)
+	}
+
+	r, err := uio.NewDagReader(ctx, rnd, rdserv)
+	if err != nil {
+		return fmt.Errorf("failed to read back benchmark content: %w", err)
+	}
+
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return fmt.Errorf("failed to read back benchmark content: %w", err)
+	}
+	stage("retrieve", n, 0, start)
+	return nil
+}
+
+// cleanupBenchmark removes the pin of the benchmark content along with its
+// objects, and the blocks of the pin and the ones the benchmark added that no
+// other pin uses. The blocks of a pin left over by a crash are only known from
+// its objects.
+func (s *Shuttle) cleanupBenchmark(ctx context.Context, added []cid.Cid) error {
+	var pin Pin
+	err := s.DB.First(&pin, "content = ?", benchmarkContent).Error
+	switch {
+	case err == nil:
+		objs, err := s.objectsForPin(ctx, pin.ID)
+		if err != nil {
+			return err
+		}
+
+		if err := s.DB.Where("pin = ?", pin.ID).Delete(ObjRef{}).Error; err != nil {
+			return err
+		}
+
+		if err := s.DB.Where("pin = ?", pin.ID).Delete(PinPeer{}).Error; err != nil {
+			return err
+		}
+
+		if err := s.DB.Delete(Pin{}, pin.ID).Error; err != nil {
+			return err
+		}
+
+		if err := s.clearUnreferencedObjects(ctx, objs); err != nil {
+			return err
+		}
+
+		for _, o := range objs {
+			if _, err := s.deleteIfNotPinned(ctx, o); err != nil {
+				return err
+			}
+		}
+	case !xerrors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+
+	for _, c := range added {
+		if _, err := s.deleteIfNotPinned(ctx, &Object{Cid: util.DbCID{CID: c}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchBlockstore records the blocks a benchmark adds to the blockstore, the
+// blocks that were already there are left alone by the cleanup
+type benchBlockstore struct {
+	blockstore.Blockstore
+
+	lk   sync.Mutex
+	cids []cid.Cid
+}
+
+func (bs *benchBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	return bs.PutMany(ctx, []blocks.Block{blk})
+}
+
+func (bs *benchBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	var added []cid.Cid
+	for _, blk := range blks {
+		has, err := bs.Blockstore.Has(ctx, blk.Cid())
+		if err != nil {
+			return err
+		}
+
+		if !has {
+			added = append(added, blk.Cid())
+		}
+	}
+
+	// recorded first, a failed write may still have stored some of them
+	bs.lk.Lock()
+	bs.cids = append(bs.cids, added...)
+	bs.lk.Unlock()
+
+	return bs.Blockstore.PutMany(ctx, blks)
+}
+
+func (bs *benchBlockstore) added() []cid.Cid {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	return append([]cid.Cid(nil), bs.cids...)
+}
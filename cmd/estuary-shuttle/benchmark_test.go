@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBenchmark(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.inflightCids = make(map[cid.Cid]uint)
+
+	res := s.runBenchmark(ctx, s.config().Benchmark.MaxSize+1, false)
+	a.NotEmpty(res.Error)
+	a.Empty(res.Stages)
+
+	// a pin left over by a previous run is cleaned up first, blocks included
+	leftover := blocks.NewBlock([]byte("leftover"))
+	a.NoError(s.Node.Blockstore.Put(ctx, leftover))
+	pin := &Pin{Content: benchmarkContent, Cid: util.DbCID{CID: leftover.Cid()}, Pinning: true}
+	a.NoError(s.DB.Create(pin).Error)
+	obj := &Object{Cid: util.DbCID{CID: leftover.Cid()}, Size: len(leftover.RawData())}
+	a.NoError(s.DB.Create(obj).Error)
+	a.NoError(s.DB.Create(&ObjRef{Pin: pin.ID, Object: obj.ID}).Error)
+
+	other := blocks.NewBlock([]byte("other"))
+	a.NoError(s.Node.Blockstore.Put(ctx, other))
+
+	// small enough to be a single block
+	res = s.runBenchmark(ctx, 1000, false)
+	a.Empty(res.Error)
+	a.Equal(int64(1000), res.Size)
+	if a.Len(res.Stages, 3) {
+		a.Equal("import", res.Stages[0].Name)
+		a.Equal(1, res.Stages[0].Blocks)
+		a.Equal("track", res.Stages[1].Name)
+		a.Equal("retrieve", res.Stages[2].Name)
+		a.Equal(int64(1000), res.Stages[2].Bytes)
+	}
+
+	var pins, objects int64
+	a.NoError(s.DB.Model(&Pin{}).Count(&pins).Error)
+	a.NoError(s.DB.Model(&Object{}).Count(&objects).Error)
+	a.Zero(pins)
+	a.Zero(objects)
+
+	keys, err := s.Node.Blockstore.AllKeysChan(ctx)
+	a.NoError(err)
+	var left []cid.Cid
+	for k := range keys {
+		left = append(left, k)
+	}
+	// only the block that neither benchmark added remains
+	a.Equal([]cid.Cid{other.Cid()}, left)
+}
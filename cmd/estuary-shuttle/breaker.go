@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/ipfs/go-metrics-interface"
+)
+
+// errCircuitOpen is returned when sending messages to estuary while the
+// circuit breaker is open, durable messages are still kept in the outbox
+var errCircuitOpen = errors.New("rpc circuit breaker is open, estuary is failing")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (cs circuitState) String() string {
+	switch cs {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker stops sending messages to estuary after too many send
+// failures in a row. Once the cooldown is over a single message is let
+// through to test whether estuary recovered. Messages that are not durable
+// are dropped while it is open, they are logged and counted. A nil breaker
+// never opens.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	droppedMetric metrics.Counter
+
+	lk       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+
+	// durable messages kept in the outbox but not sent while the circuit
+	// was open, they are sent once it closes again
+	skipped map[uint64]bool
+	// messages lost while the circuit was open since startup
+	dropped int
+}
+
+func newCircuitBreaker(ctx context.Context, threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold:     threshold,
+		cooldown:      cooldown,
+		droppedMetric: metrics.NewCtx(ctx, "rpc_circuit_dropped", "number of messages to estuary dropped while the rpc circuit breaker was open").Counter(),
+		skipped:       make(map[uint64]bool),
+	}
+}
+
+// isOpen reports whether the circuit is open and still cooling down, messages
+// are not even queued then
+func (cb *circuitBreaker) isOpen(now time.Time) bool {
+	if cb == nil {
+		return false
+	}
+
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+	return cb.state == circuitOpen && now.Sub(cb.openedAt) < cb.cooldown
+}
+
+// allow reports whether a message can be sent now, the first one after the
+// cooldown moves the circuit to half-open
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if now.Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		log.Infof("rpc circuit breaker is half-open, testing estuary again")
+		return true
+	case circuitHalfOpen:
+		// the test message is not sent yet
+		return false
+	default:
+		return true
+	}
+}
+
+// success records a sent message, it returns the messages skipped while the
+// circuit was open if it just closed
+func (cb *circuitBreaker) success() map[uint64]bool {
+	if cb == nil {
+		return nil
+	}
+
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	cb.failures = 0
+	if cb.state == circuitClosed {
+		return nil
+	}
+
+	log.Infof("rpc circuit breaker closed, estuary recovered")
+	cb.state = circuitClosed
+
+	skipped := cb.skipped
+	cb.skipped = make(map[uint64]bool)
+	return skipped
+}
+
+func (cb *circuitBreaker) failure(now time.Time) {
+	if cb == nil {
+		return
+	}
+
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || (cb.state == circuitClosed && cb.failures >= cb.threshold) {
+		log.Warnf("rpc circuit breaker opened after %d failed sends, not sending to estuary for %s", cb.failures, cb.cooldown)
+		cb.state = circuitOpen
+		cb.openedAt = now
+	}
+}
+
+// skip records a message that was not sent because the circuit is open,
+// durable ones are sent later and the others are lost
+func (cb *circuitBreaker) skip(msg *drpc.Message) {
+	if cb == nil {
+		return
+	}
+
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	if msg.ID != 0 {
+		cb.skipped[msg.ID] = true
+		return
+	}
+
+	cb.dropped++
+	cb.droppedMetric.Inc()
+	log.Warnf("rpc circuit breaker is open, dropped %s message to estuary", msg.Op)
+}
+
+// reset closes the circuit, the outbox is replayed on a new connection so
+// the skipped messages are dropped
+func (cb *circuitBreaker) reset() {
+	if cb == nil {
+		return
+	}
+
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	cb.state = circuitClosed
+	cb.failures = 0
+	cb.skipped = make(map[uint64]bool)
+}
+
+type circuitStatus struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Skipped  int    `json:"skipped"`
+	Dropped  int    `json:"dropped"`
+}
+
+func (cb *circuitBreaker) status() circuitStatus {
+	if cb == nil {
+		return circuitStatus{State: "disabled"}
+	}
+
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	return circuitStatus{
+		State:    cb.state.String(),
+		Failures: cb.failures,
+		Skipped:  len(cb.skipped),
+		Dropped:  cb.dropped,
+	}
+}
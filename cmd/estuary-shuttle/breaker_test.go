@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+
+	cb := newCircuitBreaker(context.Background(), 3, time.Minute)
+	a.True(cb.allow(now))
+
+	cb.failure(now)
+	cb.failure(now)
+	a.False(cb.isOpen(now))
+
+	// a success resets the count
+	a.Empty(cb.success())
+	cb.failure(now)
+	cb.failure(now)
+	a.Equal("closed", cb.status().State)
+
+	cb.failure(now)
+	a.True(cb.isOpen(now))
+	a.False(cb.allow(now.Add(time.Second)))
+	cb.skip(&drpc.Message{ID: 7, Op: drpc.OP_PinComplete})
+	a.Equal(1, cb.status().Skipped)
+
+	// messages that are not durable are lost, and counted
+	cb.skip(&drpc.Message{Op: drpc.OP_UpdatePinStatus})
+	a.Equal(1, cb.status().Skipped)
+	a.Equal(1, cb.status().Dropped)
+
+	// half-open after the cooldown, a failed test opens it again
+	later := now.Add(time.Minute)
+	a.False(cb.isOpen(later))
+	a.True(cb.allow(later))
+	a.Equal("half-open", cb.status().State)
+	cb.failure(later)
+	a.True(cb.isOpen(later))
+
+	// a successful test closes it and hands back the skipped messages
+	latest := later.Add(time.Minute)
+	a.True(cb.allow(latest))
+	a.Equal(map[uint64]bool{7: true}, cb.success())
+	a.Equal(circuitStatus{State: "closed", Dropped: 1}, cb.status())
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	a := assert.New(t)
+
+	cb := newCircuitBreaker(context.Background(), 0, time.Minute)
+	a.Nil(cb)
+
+	for i := 0; i < 10; i++ {
+		cb.failure(time.Now())
+	}
+	a.True(cb.allow(time.Now()))
+	a.False(cb.isOpen(time.Now()))
+	a.Equal("disabled", cb.status().State)
+}
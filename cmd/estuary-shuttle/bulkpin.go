@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"gorm.io/gorm"
+)
+
+// how many pins are looked up and inserted per database query by a bulk add
+const bulkAddPinBatchSize = 500
+
+func (d *Shuttle) handleRpcBulkAddPin(ctx context.Context, req *drpc.BulkAddPin) error {
+	if req == nil {
+		return fmt.Errorf("bulk add pin command is missing its params")
+	}
+
+	d.addPinLk.Lock()
+	res, err := d.bulkAddPin(ctx, req.Pins)
+	d.addPinLk.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("bulk add pin accepted %d pins and rejected %d", res.Accepted, len(res.Rejected))
+	return d.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_BulkAddPinResult,
+		Params: drpc.MsgParams{
+			BulkAddPinResult: res,
+		},
+	})
+}
+
+// pinQueueSpace returns how many more pins the pin queue takes, -1 when its
+// size is not limited
+func (d *Shuttle) pinQueueSpace() int {
+	max := d.config().MaxPinQueueSize
+	if max <= 0 {
+		return -1
+	}
+
+	space := max - d.PinMgr.PinQueueSize()
+	if space < 0 {
+		return 0
+	}
+	return space
+}
+
+// bulkAddPin creates the pins that do not exist yet in batched inserts and
+// queues them. Pins that already exist go through addPin one by one, so they
+// get the same handling as when they are added on their own.
+func (d *Shuttle) bulkAddPin(ctx context.Context, specs []drpc.AddPin) (*drpc.BulkAddPinResult, error) {
+	res := &drpc.BulkAddPinResult{}
+	reject := func(cont uint, reason string) {
+		res.Rejected = append(res.Rejected, drpc.PinRejected{DBID: cont, Reason: reason})
+	}
+
+	seen := make(map[uint]bool, len(specs))
+	var uniq []drpc.AddPin
+	for _, spec := range specs {
+		if seen[spec.DBID] {
+			continue
+		}
+		seen[spec.DBID] = true
+		uniq = append(uniq, spec)
+	}
+
+	space := d.pinQueueSpace()
+	storageFull := d.PinMgr.StorageFull()
+	// the usage of a user grows with each of their pins accepted, so that a
+	// single bulk add can't go over their quota
+	quotaUsages := make(map[uint]*quotaUsage)
+
+	for i := 0; i < len(uniq); i += bulkAddPinBatchSize {
+		end := i + bulkAddPinBatchSize
+		if end > len(uniq) {
+			end = len(uniq)
+		}
+		batch := uniq[i:end]
+
+		conts := make([]uint, len(batch))
+		for j, spec := range batch {
+			conts[j] = spec.DBID
+		}
+
+		var existing []uint
+		if err := d.DB.Model(Pin{}).Where("content in ?", conts).Pluck("content", &existing).Error; err != nil {
+			return nil, err
+		}
+
+		exists := make(map[uint]bool, len(existing))
+		for _, cont := range existing {
+			exists[cont] = true
+		}
+
+		var pins []*Pin
+		var accepted []drpc.AddPin
+		for _, spec := range batch {
+			if exists[spec.DBID] {
+				if err := d.addPin(ctx, spec.DBID, spec.Cid, spec.UserId, addPinOptsOf(&spec)); err != nil {
+					reject(spec.DBID, err.Error())
+					continue
+				}
+				res.Accepted++
+				continue
+			}
+
+			if d.retrievalOnly() {
+				reject(spec.DBID, errRetrievalOnly.Error())
+				continue
+			}
+
+			if !shuttleContentFormats.Supports(spec.Cid) {
+				reject(spec.DBID, fmt.Sprintf("content format of %s is not supported by the shuttle", spec.Cid))
+				continue
+			}
+
+			if spec.Unannounced && d.bitswapProvides() {
+				reject(spec.DBID, errBitswapProvides.Error())
+				continue
+			}
+
+			if storageFull {
+				reject(spec.DBID, "shuttle storage is full")
+				continue
+			}
+
+			if space == 0 {
+				reject(spec.DBID, "shuttle pin queue is full")
+				continue
+			}
+
+			usage, ok := quotaUsages[spec.UserId]
+			if !ok {
+				u, err := d.userQuotaUsage(spec.UserId)
+				if err != nil {
+					return nil, err
+				}
+				usage = &u
+				quotaUsages[spec.UserId] = usage
+			}
+
+			if usage.exceededBy(spec.Size) {
+				reject(spec.DBID, "user storage quota exceeded")
+				continue
+			}
+			usage.used += spec.Size
+
+			pins = append(pins, &Pin{
+				Content:     spec.DBID,
+				Cid:         util.DbCID{CID: spec.Cid},
+				UserID:      spec.UserId,
+				Active:      false,
+				Pinning:     true,
+				ProvideTTL:  spec.ProvideTTL,
+				Unannounced: spec.Unannounced,
+			})
+			accepted = append(accepted, spec)
+			if space > 0 {
+				space--
+			}
+		}
+
+		if len(pins) == 0 {
+			continue
+		}
+
+		if err := d.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.CreateInBatches(pins, bulkAddPinBatchSize).Error; err != nil {
+				return err
+			}
+
+			for j, pin := range pins {
+				if len(accepted[j].Labels) == 0 {
+					continue
+				}
+				if err := setPinLabels(tx, pin.ID, accepted[j].Labels); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, spec := range accepted {
+			d.PinMgr.Add(&pinner.PinningOperation{
+				Obj:         spec.Cid,
+				ContId:      spec.DBID,
+				UserId:      spec.UserId,
+				Status:      types.PinningStatusQueued,
+				Peers:       spec.Peers,
+				Timeout:     spec.Timeout,
+				Unannounced: spec.Unannounced,
+			})
+		}
+		res.Accepted += len(accepted)
+	}
+
+	return res, nil
+}
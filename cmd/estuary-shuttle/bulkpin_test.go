@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkAddPin(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.PinMgr = pinner.NewPinManager(nil, nil, &pinner.PinManagerOpts{
+		MaxActivePerUser: 1,
+		QueueDataDir:     t.TempDir(),
+	})
+	s.config().MaxPinQueueSize = 1
+
+	failed := &Pin{Content: 1, UserID: 1, Failed: true}
+	a.NoError(s.DB.Create(failed).Error)
+
+	c := blocks.NewBlock([]byte("bulk pin")).Cid()
+	jose := cid.NewCidV1(0x85, c.Hash())
+	dagcbor := cid.NewCidV1(cid.DagCBOR, c.Hash())
+	res, err := s.bulkAddPin(ctx, []drpc.AddPin{
+		{DBID: 1, UserId: 1, Cid: c},
+		{DBID: 2, UserId: 1, Cid: c, Labels: []string{"tenant:foo"}},
+		{DBID: 2, UserId: 1, Cid: c},
+		{DBID: 3, UserId: 1, Cid: c},
+		{DBID: 4, UserId: 1, Cid: jose},
+		{DBID: 5, UserId: 1, Cid: dagcbor},
+	})
+	a.NoError(err)
+
+	// the existing failed pin has its failure reported again
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_UpdatePinStatus, msg.Op)
+
+	a.Equal(2, res.Accepted)
+	a.Equal([]drpc.PinRejected{
+		{DBID: 3, Reason: "shuttle pin queue is full"},
+		{DBID: 4, Reason: "content format of " + jose.String() + " is not supported by the shuttle"},
+		{DBID: 5, Reason: "content format of " + dagcbor.String() + " is not supported by the shuttle"},
+	}, res.Rejected)
+
+	var pin Pin
+	a.NoError(s.DB.First(&pin, "content = ?", 2).Error)
+	a.True(pin.Pinning)
+
+	var labels []PinLabel
+	a.NoError(s.DB.Find(&labels, "pin = ?", pin.ID).Error)
+	a.Len(labels, 1)
+
+	var count int64
+	a.NoError(s.DB.Model(Pin{}).Where("content = ?", 3).Count(&count).Error)
+	a.Equal(int64(0), count)
+}
+
+func TestBulkAddPinQuota(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.PinMgr = pinner.NewPinManager(nil, nil, &pinner.PinManagerOpts{
+		MaxActivePerUser: 1,
+		QueueDataDir:     t.TempDir(),
+	})
+	a.NoError(s.handleRpcSetUserQuota(ctx, &drpc.SetUserQuota{UserID: 1, Quota: 1000}))
+
+	// the pins of a single bulk add count against the quota together
+	c := blocks.NewBlock([]byte("bulk pin quota")).Cid()
+	res, err := s.bulkAddPin(ctx, []drpc.AddPin{
+		{DBID: 1, UserId: 1, Cid: c, Size: 400},
+		{DBID: 2, UserId: 1, Cid: c, Size: 400},
+		{DBID: 3, UserId: 1, Cid: c, Size: 400},
+		{DBID: 4, UserId: 2, Cid: c, Size: 400},
+	})
+	a.NoError(err)
+
+	a.Equal(3, res.Accepted)
+	a.Equal([]drpc.PinRejected{{DBID: 3, Reason: "user storage quota exceeded"}}, res.Rejected)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+func (s *Shuttle) acquireCarImport(ctx context.Context) (func(), error) {
+	select {
+	case s.carImportSem <- struct{}{}:
+		return func() { <-s.carImportSem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// inflightBlocks tracks the blocks being written to the blockstore, so two
+// imports with blocks in common only write them once
+type inflightBlocks struct {
+	lk      sync.Mutex
+	writing map[cid.Cid]chan struct{}
+}
+
+// claim marks a block as being written by the caller, ok is false if another
+// writer already has it and done is closed once that writer is finished
+func (ib *inflightBlocks) claim(c cid.Cid) (done <-chan struct{}, ok bool) {
+	ib.lk.Lock()
+	defer ib.lk.Unlock()
+
+	if ch, found := ib.writing[c]; found {
+		return ch, false
+	}
+
+	if ib.writing == nil {
+		ib.writing = make(map[cid.Cid]chan struct{})
+	}
+	ib.writing[c] = make(chan struct{})
+	return nil, true
+}
+
+func (ib *inflightBlocks) release(cids []cid.Cid) {
+	ib.lk.Lock()
+	defer ib.lk.Unlock()
+
+	for _, c := range cids {
+		if ch, ok := ib.writing[c]; ok {
+			close(ch)
+			delete(ib.writing, c)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflightBlocks(t *testing.T) {
+	a := assert.New(t)
+	var ib inflightBlocks
+
+	c1 := merkledag.NewRawNode([]byte("one")).Cid()
+	c2 := merkledag.NewRawNode([]byte("two")).Cid()
+
+	_, ok := ib.claim(c1)
+	a.True(ok)
+
+	done, ok := ib.claim(c1)
+	a.False(ok)
+
+	_, ok = ib.claim(c2)
+	a.True(ok)
+
+	select {
+	case <-done:
+		t.Fatal("block released before its writer finished")
+	default:
+	}
+
+	ib.release([]cid.Cid{c1})
+	<-done
+
+	// written blocks can be claimed again
+	_, ok = ib.claim(c1)
+	a.True(ok)
+}
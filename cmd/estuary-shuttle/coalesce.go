@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/application-research/estuary/util"
+)
+
+// addCoalescer lets concurrent adds of the same bytes, by the same user and
+// with the same options, share the work of the first one instead of each
+// importing the file again
+type addCoalescer struct {
+	lk       sync.Mutex
+	inflight map[string]*inflightAdd
+}
+
+type inflightAdd struct {
+	done    chan struct{}
+	res     *util.ContentAddResponse
+	err     error
+	waiters int
+}
+
+func newAddCoalescer() *addCoalescer {
+	return &addCoalescer{
+		inflight: make(map[string]*inflightAdd),
+	}
+}
+
+// addCoalesceKey identifies an add by everything its result depends on
+func addCoalesceKey(user uint, digest []byte, filename string, cic util.ContentInCollection, labels []string, metadata map[string]string) string {
+	h := sha256.New()
+	// maps are printed sorted by key
+	fmt.Fprintf(h, "%d\x00%x\x00%s\x00%s\x00%s\x00%q\x00%q", user, digest, filename, cic.CollectionID, cic.CollectionDir, labels, metadata)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// do runs add unless an identical add is in progress, in which case it waits
+// for that one and returns its result. If the add waited on failed, which
+// may only mean its client went away, the work is done again.
+func (ac *addCoalescer) do(ctx context.Context, key string, add func() (*util.ContentAddResponse, error)) (*util.ContentAddResponse, error) {
+	for {
+		ac.lk.Lock()
+		ia, ok := ac.inflight[key]
+		if !ok {
+			ia = &inflightAdd{done: make(chan struct{})}
+			ac.inflight[key] = ia
+			ac.lk.Unlock()
+
+			return ac.run(key, ia, add)
+		}
+		ia.waiters++
+		ac.lk.Unlock()
+
+		select {
+		case <-ia.done:
+			if ia.err == nil {
+				return ia.res, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (ac *addCoalescer) run(key string, ia *inflightAdd, add func() (*util.ContentAddResponse, error)) (*util.ContentAddResponse, error) {
+	defer func() {
+		ac.lk.Lock()
+		delete(ac.inflight, key)
+		waiters := ia.waiters
+		ac.lk.Unlock()
+
+		if ia.err == nil && waiters > 0 {
+			log.Infof("%d identical uploads shared the add of %s", waiters, ia.res.Cid)
+		}
+		close(ia.done)
+	}()
+
+	// waiters retry if add panics
+	ia.err = fmt.Errorf("add did not complete")
+	ia.res, ia.err = add()
+	return ia.res, ia.err
+}
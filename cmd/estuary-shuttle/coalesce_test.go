@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddCoalescer(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	ac := newAddCoalescer()
+
+	key := addCoalesceKey(1, []byte("digest"), "file", util.ContentInCollection{}, nil, nil)
+	a.NotEqual(key, addCoalesceKey(2, []byte("digest"), "file", util.ContentInCollection{}, nil, nil))
+	a.NotEqual(key, addCoalesceKey(1, []byte("digest"), "file", util.ContentInCollection{}, []string{"label"}, nil))
+	a.NotEqual(key, addCoalesceKey(1, []byte("digest"), "file", util.ContentInCollection{}, nil, map[string]string{"mime": "text/plain"}))
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	var runs int
+
+	first := make(chan *util.ContentAddResponse)
+	go func() {
+		res, _ := ac.do(ctx, key, func() (*util.ContentAddResponse, error) {
+			runs++
+			close(started)
+			<-finish
+			return &util.ContentAddResponse{EstuaryId: 7}, nil
+		})
+		first <- res
+	}()
+	<-started
+
+	second := make(chan *util.ContentAddResponse)
+	go func() {
+		res, _ := ac.do(ctx, key, func() (*util.ContentAddResponse, error) {
+			runs++
+			return &util.ContentAddResponse{EstuaryId: 8}, nil
+		})
+		second <- res
+	}()
+
+	// wait for the second add to find the first one in progress
+	for {
+		ac.lk.Lock()
+		waiters := ac.inflight[key].waiters
+		ac.lk.Unlock()
+		if waiters == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(finish)
+	a.Equal(uint(7), (<-first).EstuaryId)
+	a.Equal(uint(7), (<-second).EstuaryId)
+	a.Equal(1, runs)
+
+	// a failed add is not shared, the next one does the work again
+	_, err := ac.do(ctx, key, func() (*util.ContentAddResponse, error) {
+		return nil, fmt.Errorf("client went away")
+	})
+	a.Error(err)
+
+	res, err := ac.do(ctx, key, func() (*util.ContentAddResponse, error) {
+		return &util.ContentAddResponse{EstuaryId: 9}, nil
+	})
+	a.NoError(err)
+	a.Equal(uint(9), res.EstuaryId)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-metrics-interface"
+)
+
+// commpLimiter bounds the piece commitments computed at once, computing them
+// is CPU bound and a burst of them would starve pinning and serving content
+type commpLimiter struct {
+	sem    chan struct{}
+	queued metrics.Gauge
+}
+
+func newCommpLimiter(ctx context.Context, limit int) *commpLimiter {
+	return &commpLimiter{
+		sem:    make(chan struct{}, limit),
+		queued: metrics.NewCtx(ctx, "commp_queued", "number of piece commitment calculations waiting for their turn").Gauge(),
+	}
+}
+
+// acquire waits until a piece commitment can be computed, the returned func
+// ends the computation
+func (cl *commpLimiter) acquire(ctx context.Context) (func(), error) {
+	cl.queued.Inc()
+	defer cl.queued.Dec()
+
+	select {
+	case cl.sem <- struct{}{}:
+		return func() { <-cl.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// commpRuns keeps track of the piece commitments being computed so the
+// computation for content that got unpinned meanwhile can be stopped
+type commpRuns struct {
+	lk      sync.Mutex
+	next    uint64
+	cancels map[cid.Cid]map[uint64]context.CancelFunc
+}
+
+func newCommpRuns() *commpRuns {
+	return &commpRuns{
+		cancels: make(map[cid.Cid]map[uint64]context.CancelFunc),
+	}
+}
+
+// track returns a context that is canceled when the computation for the given
+// data is, the returned func must be called once the computation ends
+func (cr *commpRuns) track(ctx context.Context, data cid.Cid) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+
+	id := cr.next
+	cr.next++
+	if cr.cancels[data] == nil {
+		cr.cancels[data] = make(map[uint64]context.CancelFunc)
+	}
+	cr.cancels[data][id] = cancel
+
+	return ctx, func() {
+		cancel()
+
+		cr.lk.Lock()
+		defer cr.lk.Unlock()
+		delete(cr.cancels[data], id)
+		if len(cr.cancels[data]) == 0 {
+			delete(cr.cancels, data)
+		}
+	}
+}
+
+// cancel stops the computations for the given data, including the ones still
+// waiting for their turn, and returns how many there were
+func (cr *commpRuns) cancel(data cid.Cid) int {
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+
+	for _, cancel := range cr.cancels[data] {
+		cancel()
+	}
+	return len(cr.cancels[data])
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommpLimiter(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	cl := newCommpLimiter(ctx, 1)
+
+	release, err := cl.acquire(ctx)
+	a.NoError(err)
+
+	// a second computation waits for the first one
+	tctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	_, err = cl.acquire(tctx)
+	a.ErrorIs(err, context.DeadlineExceeded)
+
+	release()
+	release, err = cl.acquire(ctx)
+	a.NoError(err)
+	release()
+}
+
+func TestCommpCanceledByUnpin(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.unpinInProgress = make(map[uint]bool)
+	s.inflightCids = make(map[cid.Cid]uint)
+
+	shared := blocks.NewBlock([]byte("shared")).Cid()
+	other := blocks.NewBlock([]byte("other")).Cid()
+	for i, c := range []cid.Cid{shared, shared, other} {
+		a.NoError(s.DB.Create(&Pin{Content: uint(i + 1), Cid: util.DbCID{CID: c}, Active: true}).Error)
+	}
+
+	sharedCtx, sharedDone := s.commpRuns.track(ctx, shared)
+	defer sharedDone()
+	otherCtx, otherDone := s.commpRuns.track(ctx, other)
+
+	// another pin still has the same root
+	a.NoError(s.Unpin(ctx, 1))
+	a.NoError(sharedCtx.Err())
+
+	a.NoError(s.Unpin(ctx, 2))
+	a.ErrorIs(sharedCtx.Err(), context.Canceled)
+	a.NoError(otherCtx.Err())
+
+	// a finished computation is no longer tracked
+	otherDone()
+	a.Zero(s.commpRuns.cancel(other))
+}
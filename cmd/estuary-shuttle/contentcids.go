@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/ipfs/go-cid"
+)
+
+// contents looked up at once when mapping content ids to cids
+const contentCIDBatchSize = 500
+
+func (s *Shuttle) handleRpcGetContentCID(ctx context.Context, req *drpc.GetContentCID) error {
+	if req == nil {
+		return fmt.Errorf("get content cid command is missing its params")
+	}
+
+	res, err := s.contentCIDs(ctx, req.Contents)
+	if err != nil {
+		return err
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ContentCIDs,
+		Params: drpc.MsgParams{
+			ContentCIDs: res,
+		},
+	})
+}
+
+// contentCIDs looks up the root cids of the pins of the contents
+func (s *Shuttle) contentCIDs(ctx context.Context, contents []uint) (*drpc.ContentCIDs, error) {
+	res := &drpc.ContentCIDs{
+		CIDs: make(map[uint]cid.Cid, len(contents)),
+	}
+
+	for start := 0; start < len(contents); start += contentCIDBatchSize {
+		end := start + contentCIDBatchSize
+		if end > len(contents) {
+			end = len(contents)
+		}
+
+		var pins []Pin
+		if err := s.DB.WithContext(ctx).Select("content", "cid").Where("content in ?", contents[start:end]).Find(&pins).Error; err != nil {
+			return nil, err
+		}
+
+		for _, p := range pins {
+			res.CIDs[p.Content] = p.Cid.CID
+		}
+	}
+
+	for _, c := range contents {
+		if _, ok := res.CIDs[c]; !ok {
+			res.Missing = append(res.Missing, c)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentCIDs(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+
+	root := blocks.NewBlock([]byte("content root")).Cid()
+	a.NoError(s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: root}, Active: true}).Error)
+
+	res, err := s.contentCIDs(context.Background(), []uint{1, 2})
+	a.NoError(err)
+	a.Len(res.CIDs, 1)
+	a.Equal(root, res.CIDs[1])
+	a.Equal([]uint{2}, res.Missing)
+}
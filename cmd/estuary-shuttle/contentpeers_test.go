@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentPeers(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.inflightCids = make(map[cid.Cid]uint)
+
+	_, pub, err := crypto.GenerateEd25519Key(crand.Reader)
+	a.NoError(err)
+	p, err := peer.IDFromPublicKey(pub)
+	a.NoError(err)
+
+	// the block got to us over bitswap from p
+	blk := blocks.NewBlock([]byte("served block"))
+	a.NoError(s.Node.Blockstore.Put(ctx, blk))
+	msg := bsmsg.New(true)
+	msg.AddBlock(blk)
+	s.Node.BlockSources.MessageReceived(p, msg)
+
+	a.NoError(s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: blk.Cid()}, Pinning: true}).Error)
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	_, _, err = s.addDatabaseTrackingToContent(ctx, 1, dserv, s.Node.Blockstore, blk.Cid(), func(int64) {})
+	a.NoError(err)
+
+	a.NoError(s.handleRpcGetContentPeers(ctx, &drpc.GetContentPeers{DBID: 1}))
+	res := <-s.outgoing
+	a.Equal(drpc.OP_ContentPeers, res.Op)
+	if a.NotNil(res.Params.ContentPeers) {
+		a.Equal(uint(1), res.Params.ContentPeers.DBID)
+		if a.Len(res.Params.ContentPeers.Peers, 1) {
+			a.Equal(p, res.Params.ContentPeers.Peers[0].ID)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/application-research/estuary/util"
@@ -32,6 +33,32 @@ type Pin struct {
 
 	DagSplit  bool `json:"dagSplit"`
 	SplitFrom uint `json:"splitFrom"`
+
+	// raw leaves too small to get their own object rows, they are kept by
+	// walking the pin instead
+	UntrackedLeaves     int64 `json:"untrackedLeaves"`
+	UntrackedLeavesSize int64 `json:"untrackedLeavesSize"`
+
+	// ReadOnly content is never pinned again, split, aggregated or rechunked
+	ReadOnly bool `json:"readOnly"`
+
+	// ProvideTTL is the ttl hint of the provider records of the content, 0
+	// uses the default of the shuttle. ReprovideAt is when they are announced
+	// again, pins without it are reprovided along with all the content.
+	ProvideTTL  time.Duration `json:"provideTtl"`
+	ReprovideAt *time.Time    `json:"reprovideAt" gorm:"index"`
+
+	// Unannounced content is never provided, only peers that already know
+	// about it can fetch it
+	Unannounced bool `json:"unannounced"`
+
+	// VerifyDag pins have their whole dag checked in the blockstore before
+	// they are reported complete, e.g. content taken from another shuttle
+	VerifyDag bool `json:"verifyDag"`
+
+	// LastRetrieved is when the content was last served by the gateway, the
+	// least recently retrieved content is offloaded first
+	LastRetrieved *time.Time `json:"lastRetrieved"`
 }
 
 type Object struct {
@@ -42,13 +69,26 @@ type Object struct {
 	LastAccess time.Time
 }
 
+// ObjRef links a pin to its objects, the lookups by pin and by object are
+// backed by the objRefIndexes built outside of the schema migration
 type ObjRef struct {
 	ID     uint `gorm:"primarykey"`
-	Pin    uint `gorm:"index"`
-	Object uint `gorm:"index"`
+	Pin    uint
+	Object uint
 	//Offloaded bool
 }
 
+// maximum number of peers recorded as having served blocks of a pin
+const maxPinPeers = 32
+
+// PinPeer records a peer that served blocks of a pin over bitswap
+type PinPeer struct {
+	ID     uint `gorm:"primarykey"`
+	Pin    uint `gorm:"index"`
+	Peer   string
+	Origin bool
+}
+
 func setupDatabase(dbval string) (*gorm.DB, error) {
 	db, err := util.SetupDatabase(dbval)
 	if err != nil {
@@ -65,8 +105,82 @@ func migrateSchemas(db *gorm.DB) error {
 	if err := db.AutoMigrate(
 		&Pin{},
 		&Object{},
-		&ObjRef{}); err != nil {
+		&ObjRef{},
+		&PinPeer{},
+		&PinLabel{},
+		&ContentMetadata{},
+		&OutgoingMessage{},
+		&UserQuota{},
+		&PausedUser{},
+		&ReplicationPolicy{},
+		&TrackedDeal{}); err != nil {
 		return err
 	}
+
+	if db.Dialector.Name() != "postgres" {
+		return migrateObjRefIndexes(db, false)
+	}
+
+	// building over a large obj_refs table takes long, it must neither block
+	// writes nor the startup
+	go func() {
+		log.Infof("building the obj_refs indexes in the background")
+		if err := migrateObjRefIndexes(db, true); err != nil {
+			log.Errorf("failed to migrate the obj_refs indexes: %s", err)
+			return
+		}
+		log.Infof("obj_refs indexes are up to date")
+	}()
+	return nil
+}
+
+// objRefIndexes back the lookups of refs by pin and by object
+var objRefIndexes = []struct {
+	name    string
+	columns string
+}{
+	{name: "idx_obj_refs_pin_object", columns: "pin, object"},
+	{name: "idx_obj_refs_object_pin", columns: "object, pin"},
+}
+
+// the single column indexes obj_refs used to have, prefixes of the composite
+// ones
+var oldObjRefIndexes = []string{"idx_obj_refs_pin", "idx_obj_refs_object"}
+
+// migrateObjRefIndexes builds the composite obj_refs indexes, and only then
+// drops the indexes they replace. Concurrently builds and drops them without
+// locking out writes, an index left invalid by an interrupted build is built
+// again.
+func migrateObjRefIndexes(db *gorm.DB, concurrently bool) error {
+	var conc string
+	if concurrently {
+		conc = "CONCURRENTLY "
+	}
+
+	for _, idx := range objRefIndexes {
+		if concurrently {
+			var invalid int64
+			if err := db.Raw("SELECT count(*) FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid WHERE c.relname = ? AND NOT i.indisvalid", idx.name).
+				Scan(&invalid).Error; err != nil {
+				return err
+			}
+
+			if invalid > 0 {
+				if err := db.Exec(fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", idx.name)).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := db.Exec(fmt.Sprintf("CREATE INDEX %sIF NOT EXISTS %s ON obj_refs (%s)", conc, idx.name, idx.columns)).Error; err != nil {
+			return fmt.Errorf("failed to create index %s: %w", idx.name, err)
+		}
+	}
+
+	for _, idx := range oldObjRefIndexes {
+		if err := db.Exec(fmt.Sprintf("DROP INDEX %sIF EXISTS %s", conc, idx)).Error; err != nil {
+			return fmt.Errorf("failed to drop index %s: %w", idx, err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// sqlRecorder keeps the statements gorm runs
+type sqlRecorder struct {
+	logger.Interface
+
+	lk    sync.Mutex
+	stmts []string
+}
+
+func (r *sqlRecorder) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, _ := fc()
+	r.lk.Lock()
+	r.stmts = append(r.stmts, sql)
+	r.lk.Unlock()
+}
+
+// a full scan of a table, or of one of its indexes
+var fullScan = regexp.MustCompile(`^SCAN (TABLE )?(obj_refs|objects)\b`)
+
+func TestObjectQueriesUseIndexes(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.inflightCids = make(map[cid.Cid]uint)
+
+	blk := blocks.NewBlock([]byte("indexed"))
+	a.NoError(s.Node.Blockstore.Put(ctx, blk))
+	pin := &Pin{Content: 1, Cid: util.DbCID{CID: blk.Cid()}, Active: true}
+	a.NoError(s.DB.Create(pin).Error)
+	obj := &Object{Cid: util.DbCID{CID: blk.Cid()}, Size: len(blk.RawData())}
+	a.NoError(s.DB.Create(obj).Error)
+	a.NoError(s.DB.Create(&ObjRef{Pin: pin.ID, Object: obj.ID}).Error)
+
+	for _, idx := range []string{"idx_obj_refs_pin_object", "idx_obj_refs_object_pin"} {
+		a.True(s.DB.Migrator().HasIndex(&ObjRef{}, idx), idx)
+	}
+	for _, idx := range []string{"idx_obj_refs_pin", "idx_obj_refs_object"} {
+		a.False(s.DB.Migrator().HasIndex(&ObjRef{}, idx), idx)
+	}
+
+	// the indexes of an older schema are dropped once the new ones are built
+	a.NoError(s.DB.Exec("CREATE INDEX idx_obj_refs_pin ON obj_refs (pin)").Error)
+	a.NoError(migrateObjRefIndexes(s.DB, false))
+	a.False(s.DB.Migrator().HasIndex(&ObjRef{}, "idx_obj_refs_pin"))
+
+	db := s.DB
+	rec := &sqlRecorder{Interface: logger.Default}
+	s.DB = s.DB.Session(&gorm.Session{Logger: rec})
+
+	pinned, err := s.isPinnedLocally(ctx, blk.Cid())
+	a.NoError(err)
+	a.True(pinned)
+
+	objs, err := s.objectsForPin(ctx, pin.ID)
+	a.NoError(err)
+	a.Len(objs, 1)
+
+	_, err = s.deleteIfNotPinned(ctx, obj)
+	a.NoError(err)
+
+	a.NoError(s.clearUnreferencedObjects(ctx, objs))
+	_, err = s.clearOrphanedObjects(ctx)
+	a.NoError(err)
+	a.NoError(s.DB.Where("pin = ?", pin.ID).Delete(ObjRef{}).Error)
+
+	var checked int
+	for _, stmt := range rec.stmts {
+		if !strings.Contains(stmt, "obj_refs") && !strings.Contains(stmt, "objects") {
+			continue
+		}
+
+		rows, err := db.Raw("EXPLAIN QUERY PLAN " + stmt).Rows()
+		if !a.NoError(err, stmt) {
+			continue
+		}
+
+		for rows.Next() {
+			var id, parent, notused int
+			var detail string
+			a.NoError(rows.Scan(&id, &parent, &notused, &detail))
+			a.False(fullScan.MatchString(detail), "%s: %s", stmt, detail)
+		}
+		a.NoError(rows.Close())
+		checked++
+	}
+	a.GreaterOrEqual(checked, 6)
+}
@@ -0,0 +1,46 @@
+package main
+
+// size of the queue of database writes waiting for a writer
+const dbWriteQueueSize = 128
+
+type dbWriteJob struct {
+	write func() error
+	done  chan error
+}
+
+// dbWriter funnels the database writes of finished pins to a fixed number of
+// writers. Blocks are still fetched concurrently, but many pins completing at
+// once no longer contend on the database, which sqlite answers with
+// "database is locked" errors.
+type dbWriter struct {
+	jobs chan *dbWriteJob
+}
+
+func newDBWriter(writers int) *dbWriter {
+	w := &dbWriter{
+		jobs: make(chan *dbWriteJob, dbWriteQueueSize),
+	}
+
+	for i := 0; i < writers; i++ {
+		go w.run()
+	}
+	return w
+}
+
+func (w *dbWriter) run() {
+	for job := range w.jobs {
+		job.done <- job.write()
+	}
+}
+
+// do queues the write and waits for a writer to run it. Once queued the
+// write always runs, so the caller is not released before it is done.
+func (w *dbWriter) do(write func() error) error {
+	job := &dbWriteJob{
+		write: write,
+		done:  make(chan error, 1),
+	}
+
+	w.jobs <- job
+	return <-job.done
+}
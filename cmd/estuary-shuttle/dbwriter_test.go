@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBWriterBoundsConcurrentWrites(t *testing.T) {
+	w := newDBWriter(2)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, w.do(func() error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, maxRunning, int32(2))
+
+	errWrite := errors.New("write failed")
+	assert.Equal(t, errWrite, w.do(func() error { return errWrite }))
+}
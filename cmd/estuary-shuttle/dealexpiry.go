@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin"
+)
+
+// dealExpiryEpochs returns the deal expiry window in epochs, 0 if it is
+// disabled
+func (s *Shuttle) dealExpiryEpochs() abi.ChainEpoch {
+	return abi.ChainEpoch(s.config().DealExpiryWindow / (builtin.EpochDurationSeconds * time.Second))
+}
+
+// checkDealExpiry records the end epoch of a tracked deal and tells estuary,
+// once, when the deal ends within the expiry window so it can be renewed
+// before retrievals start failing. The message stays in the outbox until
+// estuary acks it, it is only sent again if the outbox dropped it.
+func (s *Shuttle) checkDealExpiry(ctx context.Context, d TrackedDeal, end, height abi.ChainEpoch) error {
+	if int64(end) != d.EndEpoch {
+		if err := s.DB.Model(&TrackedDeal{}).Where("id = ?", d.ID).UpdateColumn("end_epoch", int64(end)).Error; err != nil {
+			return err
+		}
+	}
+
+	window := s.dealExpiryEpochs()
+	if window <= 0 || d.ExpiryNotified || end-height >= window {
+		return nil
+	}
+
+	if d.ExpiryMsg != 0 {
+		pending, err := s.outbox.has(d.ExpiryMsg)
+		if err != nil || pending {
+			return err
+		}
+	}
+
+	// estuary finds the deal by its id, the miner is only logged
+	maddr, err := address.NewFromString(d.Miner)
+	if err != nil {
+		log.Warnf("tracked deal %d of content %d has an invalid miner %q: %s", d.DealID, d.Content, d.Miner, err)
+		maddr = address.Undef
+	}
+
+	msg := &drpc.Message{
+		Op: drpc.OP_DealExpiring,
+		Params: drpc.MsgParams{
+			DealExpiring: &drpc.DealExpiring{
+				Content:  d.Content,
+				Miner:    maddr,
+				DealID:   d.DealID,
+				EndEpoch: end,
+				Head:     height,
+			},
+		},
+	}
+	sendErr := s.sendRpcMessage(ctx, msg)
+
+	// a message that made it to the outbox is replayed until acked
+	if msg.ID != 0 {
+		if err := s.DB.Model(&TrackedDeal{}).Where("id = ?", d.ID).UpdateColumn("expiry_msg", msg.ID).Error; err != nil {
+			return err
+		}
+	}
+	return sendErr
+}
+
+// dealExpiryAcked marks the deals whose expiry estuary acked as notified
+func (s *Shuttle) dealExpiryAcked(ids []uint64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.DB.Model(&TrackedDeal{}).Where("expiry_msg in ?", ids).UpdateColumn("expiry_notified", true).Error
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDealExpiry(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	d := TrackedDeal{Content: 1, Miner: "f01000", DealID: 5}
+	a.NoError(s.DB.Create(&d).Error)
+
+	window := s.dealExpiryEpochs()
+	a.Equal(abi.ChainEpoch(2880*14), window)
+
+	// far from its end the deal is only recorded
+	a.NoError(s.checkDealExpiry(ctx, d, 100+window, 100))
+	a.NoError(s.DB.First(&d, d.ID).Error)
+	a.Equal(int64(100+window), d.EndEpoch)
+	a.Len(s.outgoing, 0)
+
+	a.NoError(s.checkDealExpiry(ctx, d, 100+window, 101))
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_DealExpiring, msg.Op)
+	a.Equal(int64(5), msg.Params.DealExpiring.DealID)
+	a.Equal(uint(1), msg.Params.DealExpiring.Content)
+	a.Equal(100+window, msg.Params.DealExpiring.EndEpoch)
+
+	// the outbox resends it until estuary acks it
+	a.NoError(s.DB.First(&d, d.ID).Error)
+	a.False(d.ExpiryNotified)
+	a.Equal(msg.ID, d.ExpiryMsg)
+	a.NoError(s.checkDealExpiry(ctx, d, 100+window, 102))
+	a.Len(s.outgoing, 0)
+
+	// sent again if the outbox dropped it
+	a.NoError(s.DB.Delete(&OutgoingMessage{}, msg.ID).Error)
+	a.NoError(s.checkDealExpiry(ctx, d, 100+window, 103))
+	msg = <-s.outgoing
+	a.Equal(drpc.OP_DealExpiring, msg.Op)
+
+	// estuary is told only once
+	a.NoError(s.outbox.ack([]uint64{msg.ID}))
+	a.NoError(s.dealExpiryAcked([]uint64{msg.ID}))
+	a.NoError(s.DB.First(&d, d.ID).Error)
+	a.True(d.ExpiryNotified)
+	a.NoError(s.checkDealExpiry(ctx, d, 100+window, 104))
+	a.Len(s.outgoing, 0)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+)
+
+// disk usage is summed over every object of every pin, it is only computed
+// again once this old
+const diskUsageCacheTTL = time.Minute * 5
+
+func (s *Shuttle) handleRpcGetDiskUsage(ctx context.Context, req *drpc.GetDiskUsage) error {
+	if req == nil {
+		return fmt.Errorf("get disk usage command is missing its params")
+	}
+
+	du, err := s.getDiskUsage(ctx, req.Refresh)
+	if err != nil {
+		log.Errorf("failed to compute disk usage: %s", err)
+		du = &drpc.DiskUsage{Error: err.Error()}
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_DiskUsage,
+		Params: drpc.MsgParams{
+			DiskUsage: du,
+		},
+	})
+}
+
+// getDiskUsage returns the cached disk usage while it is fresh, concurrent
+// callers wait for a single computation
+func (s *Shuttle) getDiskUsage(ctx context.Context, refresh bool) (*drpc.DiskUsage, error) {
+	s.diskUsageLk.Lock()
+	defer s.diskUsageLk.Unlock()
+
+	if !refresh && s.diskUsage != nil && time.Since(s.diskUsage.ComputedAt) < diskUsageCacheTTL {
+		return s.diskUsage, nil
+	}
+
+	du, err := s.computeDiskUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.diskUsage = du
+	return du, nil
+}
+
+type userSize struct {
+	UserID uint
+	Size   float64
+}
+
+func (s *Shuttle) computeDiskUsage(ctx context.Context) (*drpc.DiskUsage, error) {
+	_, span := s.Tracer.Start(ctx, "computeDiskUsage")
+	defer span.End()
+
+	db := s.DB.WithContext(ctx)
+
+	var logical []userSize
+	if err := db.Raw(`SELECT pins.user_id AS user_id, SUM(objects.size) AS size
+		FROM obj_refs
+		JOIN pins ON pins.id = obj_refs.pin
+		JOIN objects ON objects.id = obj_refs.object
+		GROUP BY pins.user_id`).Scan(&logical).Error; err != nil {
+		return nil, err
+	}
+
+	// every pin tracks its own object rows, a block is told apart by its
+	// cid. A block referenced by the pins of n users counts for 1/n of its
+	// size in the physical usage of each of them.
+	var physical []userSize
+	if err := db.Raw(`WITH owners AS (
+			SELECT DISTINCT objects.cid AS cid, pins.user_id AS user_id
+			FROM obj_refs
+			JOIN pins ON pins.id = obj_refs.pin
+			JOIN objects ON objects.id = obj_refs.object
+		), shares AS (
+			SELECT cid, COUNT(*) AS users FROM owners GROUP BY cid
+		), sizes AS (
+			SELECT objects.cid AS cid, MAX(objects.size) AS size
+			FROM objects JOIN owners ON owners.cid = objects.cid
+			GROUP BY objects.cid
+		)
+		SELECT owners.user_id AS user_id, SUM(sizes.size * 1.0 / shares.users) AS size
+		FROM owners
+		JOIN shares ON shares.cid = owners.cid
+		JOIN sizes ON sizes.cid = owners.cid
+		GROUP BY owners.user_id`).Scan(&physical).Error; err != nil {
+		return nil, err
+	}
+
+	var totalPhysical int64
+	if err := db.Raw(`SELECT COALESCE(SUM(size), 0) FROM (
+			SELECT MAX(objects.size) AS size FROM objects
+			WHERE EXISTS (SELECT 1 FROM obj_refs WHERE obj_refs.object = objects.id)
+			GROUP BY objects.cid
+		) AS blocks`).Scan(&totalPhysical).Error; err != nil {
+		return nil, err
+	}
+
+	// untracked leaves have no object rows to be shared through, they count
+	// fully for the user of the pin
+	var leaves []userSize
+	if err := db.Raw(`SELECT user_id, SUM(untracked_leaves_size) AS size
+		FROM pins WHERE untracked_leaves_size > 0
+		GROUP BY user_id`).Scan(&leaves).Error; err != nil {
+		return nil, err
+	}
+
+	users := make(map[uint]*drpc.UserDiskUsage)
+	user := func(id uint) *drpc.UserDiskUsage {
+		u, ok := users[id]
+		if !ok {
+			u = &drpc.UserDiskUsage{UserID: id}
+			users[id] = u
+		}
+		return u
+	}
+
+	for _, us := range logical {
+		user(us.UserID).Logical += int64(us.Size)
+	}
+
+	for _, us := range physical {
+		user(us.UserID).Physical += int64(us.Size)
+	}
+
+	for _, us := range leaves {
+		u := user(us.UserID)
+		u.Logical += int64(us.Size)
+		u.Physical += int64(us.Size)
+		totalPhysical += int64(us.Size)
+	}
+
+	du := &drpc.DiskUsage{
+		Users:         make([]drpc.UserDiskUsage, 0, len(users)),
+		TotalPhysical: totalPhysical,
+		ComputedAt:    time.Now(),
+	}
+	for _, u := range users {
+		du.Users = append(du.Users, *u)
+		du.TotalLogical += u.Logical
+	}
+
+	sort.Slice(du.Users, func(i, j int) bool {
+		return du.Users[i].Physical > du.Users[j].Physical
+	})
+	return du, nil
+}
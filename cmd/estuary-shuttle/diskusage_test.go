@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskUsage(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.inflightCids = make(map[cid.Cid]uint)
+
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+
+	shared := merkledag.NewRawNode(bytes.Repeat([]byte("s"), 100))
+	own := merkledag.NewRawNode(bytes.Repeat([]byte("o"), 300))
+	root1 := merkledag.NodeWithData(nil)
+	a.NoError(root1.AddNodeLink("shared", shared))
+	a.NoError(root1.AddNodeLink("own", own))
+	root2 := merkledag.NodeWithData(nil)
+	a.NoError(root2.AddNodeLink("shared", shared))
+	a.NoError(dserv.AddMany(ctx, []ipld.Node{shared, own, root1, root2}))
+
+	size := func(n ipld.Node) int64 {
+		return int64(len(n.RawData()))
+	}
+
+	// user 1 pins both roots, user 2 pins the second one, every pin tracks
+	// its own objects
+	for _, p := range []struct {
+		content uint
+		user    uint
+		root    ipld.Node
+	}{
+		{content: 1, user: 1, root: root1},
+		{content: 2, user: 2, root: root2},
+		{content: 3, user: 1, root: root2},
+	} {
+		a.NoError(s.DB.Create(&Pin{Content: p.content, UserID: p.user, Pinning: true}).Error)
+		_, _, err := s.addDatabaseTrackingToContent(ctx, p.content, dserv, s.Node.Blockstore, p.root.Cid(), func(int64) {})
+		a.NoError(err)
+	}
+	a.NoError(s.DB.Model(Pin{}).Where("content = ?", 3).UpdateColumn("untracked_leaves_size", 50).Error)
+
+	du, err := s.getDiskUsage(ctx, false)
+	a.NoError(err)
+	a.Len(du.Users, 2)
+
+	// each block counts once however many pins hold it
+	a.Equal(size(shared)+size(own)+size(root1)+size(root2)+50, du.TotalPhysical)
+
+	a.Equal(uint(1), du.Users[0].UserID)
+	a.Equal(size(root1)+size(shared)+size(own)+size(root2)+size(shared)+50, du.Users[0].Logical)
+	a.InDelta(float64(size(root1)+size(own)+50)+float64(size(shared)+size(root2))/2, du.Users[0].Physical, 1)
+
+	a.Equal(uint(2), du.Users[1].UserID)
+	a.Equal(size(root2)+size(shared), du.Users[1].Logical)
+	a.InDelta(float64(size(shared)+size(root2))/2, du.Users[1].Physical, 1)
+	a.Equal(du.Users[0].Logical+du.Users[1].Logical, du.TotalLogical)
+
+	// served from the cache until refreshed
+	a.NoError(s.DB.Create(&Pin{Content: 4, UserID: 2, Pinning: true}).Error)
+	_, _, err = s.addDatabaseTrackingToContent(ctx, 4, dserv, s.Node.Blockstore, root1.Cid(), func(int64) {})
+	a.NoError(err)
+
+	cached, err := s.getDiskUsage(ctx, false)
+	a.NoError(err)
+	a.Equal(du, cached)
+
+	fresh, err := s.getDiskUsage(ctx, true)
+	a.NoError(err)
+	a.Equal(du.TotalPhysical, fresh.TotalPhysical)
+	a.Equal(du.TotalLogical+size(root1)+size(shared)+size(own), fresh.TotalLogical)
+}
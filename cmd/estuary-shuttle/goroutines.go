@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/application-research/estuary/drpc"
+)
+
+// how much of a goroutine dump goes in a single message
+const goroutineDumpChunkSize = 256 << 10
+
+func (s *Shuttle) handleRpcDumpGoroutines(ctx context.Context, req *drpc.DumpGoroutines) error {
+	if req == nil {
+		return fmt.Errorf("dump goroutines command is missing its params")
+	}
+
+	for _, part := range dumpGoroutines(req.DumpID, goroutineDumpChunkSize) {
+		if err := s.sendRpcMessage(ctx, &drpc.Message{
+			Op: drpc.OP_GoroutineDump,
+			Params: drpc.MsgParams{
+				GoroutineDump: part,
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to send part %d of goroutine dump %s: %w", part.Index, req.DumpID, err)
+		}
+	}
+	return nil
+}
+
+// dumpGoroutines writes the stack traces of all goroutines, in the same
+// format as an unrecovered panic, and cuts them into parts of at most
+// chunkSize bytes
+func dumpGoroutines(id string, chunkSize int) []*drpc.GoroutineDump {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+		return []*drpc.GoroutineDump{{DumpID: id, Last: true, Error: err.Error()}}
+	}
+
+	data := buf.String()
+	var parts []*drpc.GoroutineDump
+	for i := 0; ; i++ {
+		n := len(data)
+		if n > chunkSize {
+			// cut between lines so no part ends in the middle of a character
+			n = chunkSize
+			if j := strings.LastIndexByte(data[:n], '\n'); j > 0 {
+				n = j + 1
+			}
+		}
+
+		parts = append(parts, &drpc.GoroutineDump{
+			DumpID: id,
+			Index:  i,
+			Data:   data[:n],
+			Last:   n == len(data),
+		})
+
+		data = data[n:]
+		if len(data) == 0 {
+			return parts
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpGoroutines(t *testing.T) {
+	a := assert.New(t)
+
+	parts := dumpGoroutines("dump", 1024)
+	a.Greater(len(parts), 1)
+
+	var dump strings.Builder
+	for i, p := range parts {
+		a.Equal("dump", p.DumpID)
+		a.Equal(i, p.Index)
+		a.LessOrEqual(len(p.Data), 1024)
+		a.Equal(i == len(parts)-1, p.Last)
+		dump.WriteString(p.Data)
+	}
+	a.Contains(dump.String(), "TestDumpGoroutines")
+}
@@ -29,7 +29,9 @@ func (init Initializer) KeyProviderFunc(ctx context.Context) (<-chan cid.Cid, er
 		defer close(out)
 
 		var pins []Pin
-		if err := init.db.Find(&pins, "active").Error; err != nil {
+		// pins with a provide ttl are announced again when it runs out, and
+		// unannounced pins never are
+		if err := init.db.Find(&pins, "active and reprovide_at is null and not unannounced").Error; err != nil {
 			log.Errorf("failed to load pins for reproviding: %s", err)
 			return
 		}
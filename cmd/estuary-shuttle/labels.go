@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const maxPinLabelLength = 128
+
+// PinLabel is an operator defined label of a pin, e.g. tenant:foo
+type PinLabel struct {
+	ID    uint   `gorm:"primarykey"`
+	Pin   uint   `gorm:"index"`
+	Label string `gorm:"index"`
+}
+
+// dedupeLabels drops the empty and repeated labels, keeping their order
+func dedupeLabels(labels []string) []string {
+	seen := make(map[string]bool, len(labels))
+	out := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if l == "" || seen[l] {
+			continue
+		}
+		seen[l] = true
+		out = append(out, l)
+	}
+	return out
+}
+
+// labelsFromQuery reads the labels of an add request from its repeated label
+// query params
+func labelsFromQuery(c echo.Context) ([]string, error) {
+	labels := dedupeLabels(c.QueryParams()["label"])
+	for _, l := range labels {
+		if len(l) > maxPinLabelLength {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: fmt.Sprintf("label %q is longer than %d characters", l, maxPinLabelLength),
+			}
+		}
+	}
+	return labels, nil
+}
+
+// setPinLabels replaces the labels of a pin
+func setPinLabels(db *gorm.DB, pin uint, labels []string) error {
+	if err := db.Where("pin = ?", pin).Delete(PinLabel{}).Error; err != nil {
+		return err
+	}
+
+	labels = dedupeLabels(labels)
+	if len(labels) == 0 {
+		return nil
+	}
+
+	pinLabels := make([]PinLabel, 0, len(labels))
+	for _, l := range labels {
+		pinLabels = append(pinLabels, PinLabel{
+			Pin:   pin,
+			Label: l,
+		})
+	}
+	return db.Create(&pinLabels).Error
+}
+
+func (s *Shuttle) contentsByLabel(label string) ([]uint, error) {
+	var contents []uint
+	if err := s.DB.Model(Pin{}).
+		Joins("join pin_labels on pin_labels.pin = pins.id").
+		Where("pin_labels.label = ?", label).
+		Order("pins.content asc").
+		Pluck("pins.content", &contents).Error; err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+func (s *Shuttle) handleRpcFindPinsByLabel(ctx context.Context, req *drpc.FindPinsByLabel) error {
+	ctx, span := s.Tracer.Start(ctx, "handleFindPinsByLabel", trace.WithAttributes(
+		attribute.String("label", req.Label),
+	))
+	defer span.End()
+
+	contents, err := s.contentsByLabel(req.Label)
+	if err != nil {
+		return err
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_PinsByLabel,
+		Params: drpc.MsgParams{
+			PinsByLabel: &drpc.PinsByLabel{
+				Label:    req.Label,
+				Contents: contents,
+			},
+		},
+	})
+}
+
+// handleGetPinsByLabel lists the ids of the contents pinned with a label
+func (s *Shuttle) handleGetPinsByLabel(c echo.Context) error {
+	contents, err := s.contentsByLabel(c.Param("label"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, contents)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinLabels(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+
+	pins := []*Pin{{Content: 3}, {Content: 1}, {Content: 2}}
+	for _, p := range pins {
+		a.NoError(s.DB.Create(p).Error)
+	}
+
+	a.NoError(setPinLabels(s.DB, pins[0].ID, []string{"tenant:foo", "tier:hot", "tenant:foo", ""}))
+	a.NoError(setPinLabels(s.DB, pins[1].ID, []string{"tenant:foo"}))
+	a.NoError(setPinLabels(s.DB, pins[2].ID, []string{"tenant:bar"}))
+
+	contents, err := s.contentsByLabel("tenant:foo")
+	a.NoError(err)
+	a.Equal([]uint{1, 3}, contents)
+
+	// setting the labels again replaces them
+	a.NoError(setPinLabels(s.DB, pins[0].ID, []string{"tier:cold"}))
+	contents, err = s.contentsByLabel("tenant:foo")
+	a.NoError(err)
+	a.Equal([]uint{1}, contents)
+
+	contents, err = s.contentsByLabel("tier:hot")
+	a.NoError(err)
+	a.Empty(contents)
+}
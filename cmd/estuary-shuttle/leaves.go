@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/pkg/errors"
+)
+
+// isUntrackedLeaf returns true if the block gets no object row of its own,
+// only raw leaves under the configured size are untracked, never the root
+func (d *Shuttle) isUntrackedLeaf(c cid.Cid, root cid.Cid, size int) bool {
+	threshold := d.config().UntrackedLeafSize
+	return threshold > 0 && c.Type() == cid.Raw && !c.Equals(root) && size < threshold
+}
+
+// pinUntrackedLeaves walks the dag of a pin from the local blockstore and
+// returns its raw leaves. The leaves are not fetched, so the ones with
+// object rows are included too, which is harmless for their callers.
+func (s *Shuttle) pinUntrackedLeaves(ctx context.Context, root cid.Cid) (*cid.Set, error) {
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore)))
+
+	leaves := cid.NewSet()
+	if err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		if c.Type() == cid.Raw {
+			if !c.Equals(root) {
+				leaves.Add(c)
+			}
+			return nil, nil
+		}
+
+		node, err := dserv.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return util.FilterUnwalkableLinks(node.Links()), nil
+	}, root, cid.NewSet().Visit); err != nil {
+		return nil, errors.Wrapf(err, "failed to walk dag of %s", root)
+	}
+	return leaves, nil
+}
+
+// untrackedLeavesInUse returns the raw leaves of all the pins that have
+// untracked leaves, they have no object rows keeping them from being
+// garbage collected
+func (s *Shuttle) untrackedLeavesInUse(ctx context.Context) (*cid.Set, error) {
+	var pins []Pin
+	if err := s.DB.Where("untracked_leaves > 0").Find(&pins).Error; err != nil {
+		return nil, err
+	}
+
+	keep := cid.NewSet()
+	for _, p := range pins {
+		leaves, err := s.pinUntrackedLeaves(ctx, p.Cid.CID)
+		if err != nil {
+			return nil, err
+		}
+
+		_ = leaves.ForEach(func(c cid.Cid) error {
+			keep.Add(c)
+			return nil
+		})
+	}
+	return keep, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUntrackedLeaf(t *testing.T) {
+	s := &Shuttle{shuttleConfig: &config.Shuttle{}}
+
+	root := merkledag.NodeWithData([]byte("root")).Cid()
+	leaf := merkledag.NewRawNode([]byte("leaf")).Cid()
+
+	// off by default
+	assert.False(t, s.isUntrackedLeaf(leaf, root, 4))
+
+	s.config().UntrackedLeafSize = 1024
+	assert.True(t, s.isUntrackedLeaf(leaf, root, 4))
+	assert.False(t, s.isUntrackedLeaf(leaf, root, 1024))
+
+	// only raw leaves, and never the root
+	assert.False(t, s.isUntrackedLeaf(root, leaf, 4))
+	assert.False(t, s.isUntrackedLeaf(leaf, leaf, 4))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/application-research/estuary/util"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/labstack/echo/v4"
+)
+
+type logLine struct {
+	level  logging.LogLevel
+	logger string
+	data   []byte
+}
+
+// logRing keeps the most recent log lines in memory so they can be read
+// remotely, and forwards new lines to the subscribed readers
+type logRing struct {
+	lk    sync.Mutex
+	lines []*logLine
+	next  int
+	full  bool
+	subs  map[chan *logLine]struct{}
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{
+		lines: make([]*logLine, size),
+		subs:  make(map[chan *logLine]struct{}),
+	}
+}
+
+// log lines longer than this are not kept, they are still read off the pipe
+const maxLogLineSize = 1 << 20
+
+// run reads json formatted log lines until r is closed. The log pipe blocks
+// the loggers while it is not read, so this must not be held up by readers,
+// and r is drained to the end whatever it holds.
+func (lr *logRing) run(r io.Reader) {
+	defer func() {
+		_, _ = io.Copy(io.Discard, r)
+	}()
+
+	br := bufio.NewReaderSize(r, 64<<10)
+	var line []byte
+	var tooLong bool
+	for {
+		frag, more, err := br.ReadLine()
+		if err != nil {
+			return
+		}
+
+		if !tooLong {
+			line = append(line, frag...)
+			if len(line) > maxLogLineSize {
+				tooLong = true
+			}
+		}
+		if more {
+			continue
+		}
+
+		if !tooLong {
+			lr.addJSON(line)
+		}
+		line = line[:0]
+		tooLong = false
+	}
+}
+
+func (lr *logRing) addJSON(line []byte) {
+	var entry struct {
+		Level  string `json:"level"`
+		Logger string `json:"logger"`
+	}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return
+	}
+
+	level, err := logging.LevelFromString(entry.Level)
+	if err != nil {
+		return
+	}
+
+	data := make([]byte, len(line))
+	copy(data, line)
+	lr.add(&logLine{
+		level:  level,
+		logger: entry.Logger,
+		data:   data,
+	})
+}
+
+func (lr *logRing) add(l *logLine) {
+	lr.lk.Lock()
+	defer lr.lk.Unlock()
+
+	lr.lines[lr.next] = l
+	lr.next = (lr.next + 1) % len(lr.lines)
+	if lr.next == 0 {
+		lr.full = true
+	}
+
+	for sub := range lr.subs {
+		select {
+		case sub <- l:
+		default:
+			// slow reader, it misses this line
+		}
+	}
+}
+
+// subscribe returns the buffered lines, oldest first, and a channel getting
+// every line logged from now on until cancel is called
+func (lr *logRing) subscribe() ([]*logLine, chan *logLine, func()) {
+	lr.lk.Lock()
+	defer lr.lk.Unlock()
+
+	var recent []*logLine
+	if lr.full {
+		recent = append(recent, lr.lines[lr.next:]...)
+	}
+	recent = append(recent, lr.lines[:lr.next]...)
+
+	sub := make(chan *logLine, 256)
+	lr.subs[sub] = struct{}{}
+
+	return recent, sub, func() {
+		lr.lk.Lock()
+		defer lr.lk.Unlock()
+		delete(lr.subs, sub)
+	}
+}
+
+// setupLogRing starts buffering the log output of all loggers
+func setupLogRing(size int) *logRing {
+	lr := newLogRing(size)
+	go lr.run(logging.NewPipeReader(logging.PipeFormat(logging.JSONOutput)))
+	return lr
+}
+
+// handleGetLogs streams the buffered log lines followed by the live ones as
+// server sent events. The level query param sets the minimum level of the
+// lines, the logger query param only keeps the lines of that logger.
+func (s *Shuttle) handleGetLogs(c echo.Context) error {
+	if s.logs == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "log buffering is disabled on this shuttle",
+		}
+	}
+
+	minLevel := logging.LevelDebug
+	if lvl := c.QueryParam("level"); lvl != "" {
+		ll, err := logging.LevelFromString(lvl)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: fmt.Sprintf("invalid log level: %s", lvl),
+			}
+		}
+		minLevel = ll
+	}
+	logger := c.QueryParam("logger")
+
+	match := func(l *logLine) bool {
+		return l.level >= minLevel && (logger == "" || l.logger == logger)
+	}
+
+	recent, sub, cancel := s.logs.subscribe()
+	defer cancel()
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+
+	write := func(l *logLine) error {
+		if !match(l) {
+			return nil
+		}
+		_, err := fmt.Fprintf(resp, "data: %s\n\n", l.data)
+		return err
+	}
+
+	for _, l := range recent {
+		if err := write(l); err != nil {
+			return err
+		}
+	}
+	resp.Flush()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case l := <-sub:
+			if err := write(l); err != nil {
+				return err
+			}
+			resp.Flush()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
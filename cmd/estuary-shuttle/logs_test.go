@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogRing(t *testing.T) {
+	a := assert.New(t)
+	lr := newLogRing(3)
+
+	var input strings.Builder
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&input, `{"level":"info","logger":"shuttle","msg":"line %d"}`+"\n", i)
+	}
+	input.WriteString("not json\n")
+	lr.run(strings.NewReader(input.String()))
+
+	recent, sub, cancel := lr.subscribe()
+	if a.Len(recent, 3) {
+		for i, l := range recent {
+			a.Contains(string(l.data), fmt.Sprintf("line %d", i+2))
+			a.Equal(logging.LevelInfo, l.level)
+			a.Equal("shuttle", l.logger)
+		}
+	}
+
+	lr.run(strings.NewReader(`{"level":"warn","logger":"rpc","msg":"live"}` + "\n"))
+	select {
+	case l := <-sub:
+		a.Equal(logging.LevelWarn, l.level)
+		a.Equal("rpc", l.logger)
+	default:
+		t.Fatal("expected the subscriber to get the new line")
+	}
+
+	cancel()
+	lr.run(strings.NewReader(`{"level":"error","logger":"rpc","msg":"unseen"}` + "\n"))
+	a.Len(sub, 0)
+}
+
+func TestLogRingLongLines(t *testing.T) {
+	a := assert.New(t)
+	lr := newLogRing(3)
+
+	var input strings.Builder
+	fmt.Fprintf(&input, `{"level":"info","logger":"shuttle","msg":"%s"}`+"\n", strings.Repeat("x", maxLogLineSize))
+	input.WriteString(`{"level":"info","logger":"shuttle","msg":"after"}` + "\n")
+	lr.run(strings.NewReader(input.String()))
+
+	recent, _, cancel := lr.subscribe()
+	defer cancel()
+	if a.Len(recent, 1) {
+		a.Contains(string(recent[0].data), "after")
+	}
+}
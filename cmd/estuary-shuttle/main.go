@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,10 +12,14 @@ import (
 	//#nosec G108 - exposing the profiling endpoint is expected
 	httpprof "net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/application-research/estuary/constants"
@@ -29,6 +32,7 @@ import (
 	"github.com/application-research/filclient/retrievehelper"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/mitchellh/go-homedir"
+	"github.com/multiformats/go-multihash"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel/codes"
 	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
@@ -55,7 +59,6 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lotus/api"
 	lotusTypes "github.com/filecoin-project/lotus/chain/types"
-	lcli "github.com/filecoin-project/lotus/cli"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
@@ -106,6 +109,35 @@ func before(cctx *cli.Context) error {
 	return nil
 }
 
+// loadConfig fills cfg from the config file and the command line flags, the
+// same way at startup and on every reload
+func loadConfig(cctx *cli.Context, flags []cli.Flag, cfg *config.Shuttle) error {
+	if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized { // still want to report parsing errors
+		return err
+	}
+
+	if err := overrideSetOptions(flags, cctx, cfg); err != nil {
+		return err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := aggregationMemberCodecs(cfg.Aggregation.MemberCodecs); err != nil {
+		return err
+	}
+
+	if err := checkLogLevels(cfg.Logging.Levels); err != nil {
+		return err
+	}
+
+	if cfg.Node.EnableWebsocketListenAddr {
+		cfg.Node.ListenAddrs = append(cfg.Node.ListenAddrs, config.DefaultWebsocketAddr)
+	}
+	return nil
+}
+
 func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle) error {
 	for _, flag := range flags {
 		name := flag.Names()[0]
@@ -118,16 +150,32 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 		switch name {
 		case "node-api-url":
 			cfg.Node.ApiURL = cctx.String("node-api-url")
+		case "node-api-fallback-url":
+			cfg.Node.FallbackApiURLs = cctx.StringSlice("node-api-fallback-url")
 		case "datadir":
 			cfg.DataDir = cctx.String("datadir")
 		case "blockstore":
 			cfg.Node.Blockstore = cctx.String("blockstore")
+		case "blockstore-type":
+			cfg.Node.BlockstoreType = cctx.String("blockstore-type")
+		case "secondary-blockstore":
+			cfg.Node.SecondaryBlockstore = cctx.String("secondary-blockstore")
 		case "no-blockstore-cache":
 			cfg.Node.NoBlockstoreCache = cctx.Bool("no-blockstore-cache")
+		case "blockstore-read-cache-size":
+			cfg.Node.BlockstoreCache.ReadCacheSize = cctx.Int("blockstore-read-cache-size")
+		case "blockstore-read-cache-policy":
+			cfg.Node.BlockstoreCache.ReadCachePolicy = cctx.String("blockstore-read-cache-policy")
 		case "write-log-truncate":
 			cfg.Node.WriteLogTruncate = cctx.Bool("write-log-truncate")
 		case "write-log-flush":
 			cfg.Node.HardFlushWriteLog = cctx.Bool("write-log-flush")
+		case "write-log-max-size":
+			cfg.Node.WriteLogMaxSize = cctx.Int64("write-log-max-size")
+		case "write-log-check-interval":
+			cfg.Node.WriteLogCheckInterval = cctx.Duration("write-log-check-interval")
+		case "ephemeral-identity":
+			cfg.Node.EphemeralIdentity = cctx.Bool("ephemeral-identity")
 		case "write-log":
 			wlog := cctx.String("write-log")
 			cfg.Node.WriteLogDir = wlog
@@ -138,6 +186,30 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.DatabaseConnString = cctx.String("database")
 		case "apilisten":
 			cfg.ApiListen = cctx.String("apilisten")
+		case "internal-listen":
+			cfg.InternalListen = cctx.String("internal-listen")
+		case "min-free-space":
+			cfg.MinFreeSpace = cctx.Uint64("min-free-space")
+		case "min-free-memory":
+			cfg.MinFreeMemory = cctx.Uint64("min-free-memory")
+		case "upload-temp-dir":
+			cfg.UploadTempDir = cctx.String("upload-temp-dir")
+		case "max-upload-temp-space":
+			cfg.MaxUploadTempSpace = cctx.Uint64("max-upload-temp-space")
+		case "db-writers":
+			cfg.DBWriters = cctx.Int("db-writers")
+		case "max-car-imports":
+			cfg.MaxCarImports = cctx.Int("max-car-imports")
+		case "commp-concurrency":
+			cfg.CommpConcurrency = cctx.Int("commp-concurrency")
+		case "take-content-concurrency":
+			cfg.TakeContentConcurrency = cctx.Int("take-content-concurrency")
+		case "verify-taken-content":
+			cfg.VerifyTakenContent = cctx.Bool("verify-taken-content")
+		case "dag-walk-concurrency":
+			cfg.DagWalkConcurrency = cctx.Int("dag-walk-concurrency")
+		case "max-dag-walks":
+			cfg.MaxDagWalks = cctx.Int("max-dag-walks")
 		case "libp2p-websockets":
 			cfg.Node.EnableWebsocketListenAddr = cctx.Bool("libp2p-websockets")
 		case "announce-addr":
@@ -166,26 +238,126 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.Jaeger.SamplerRatio = cctx.Float64("jaeger-sampler-ratio")
 		case "logging":
 			cfg.Logging.ApiEndpointLogging = cctx.Bool("logging")
+		case "log-buffer-size":
+			cfg.Logging.BufferSize = cctx.Int("log-buffer-size")
 		case "bitswap-max-work-per-peer":
 			cfg.Node.Bitswap.MaxOutstandingBytesPerPeer = cctx.Int64("bitswap-max-work-per-peer")
+		case "libp2p-max-conns":
+			cfg.Node.ResourceLimits.MaxConns = cctx.Int("libp2p-max-conns")
+		case "libp2p-max-streams":
+			cfg.Node.ResourceLimits.MaxStreams = cctx.Int("libp2p-max-streams")
+		case "libp2p-max-memory":
+			cfg.Node.ResourceLimits.MaxMemory = cctx.Int64("libp2p-max-memory")
+		case "libp2p-max-fd":
+			cfg.Node.ResourceLimits.MaxFD = cctx.Int("libp2p-max-fd")
 		case "bitswap-target-message-size":
 			cfg.Node.Bitswap.TargetMessageSize = cctx.Int("bitswap-target-message-size")
+		case "bitswap-no-provide":
+			cfg.Node.Bitswap.NoProvide = cctx.Bool("bitswap-no-provide")
 		case "estuary-api":
 			cfg.EstuaryRemote.Api = cctx.String("estuary-api")
 		case "handle":
 			cfg.EstuaryRemote.Handle = cctx.String("handle")
 		case "auth-token":
 			cfg.EstuaryRemote.AuthToken = cctx.String("auth-token")
+		case "auth-retries":
+			cfg.EstuaryRemote.AuthRetries = cctx.Int("auth-retries")
+		case "auth-retry-backoff":
+			cfg.EstuaryRemote.AuthRetryBackoff = cctx.Duration("auth-retry-backoff")
 		case "private":
 			cfg.Private = cctx.Bool("private")
 		case "dev":
 			cfg.Dev = cctx.Bool("dev")
 		case "no-reload-pin-queue":
 			cfg.NoReloadPinQueue = cctx.Bool("no-reload-pin-queue")
+		case "no-unpin-cleanup":
+			cfg.NoUnpinCleanup = cctx.Bool("no-unpin-cleanup")
+		case "reconcile-on-startup":
+			cfg.ReconcileOnStartup = cctx.Bool("reconcile-on-startup")
+		case "max-pin-queue-size":
+			cfg.MaxPinQueueSize = cctx.Int("max-pin-queue-size")
+		case "retrieval-only":
+			cfg.RetrievalOnly = cctx.Bool("retrieval-only")
+		case "pin-timeout":
+			cfg.Content.PinTimeout = cctx.Duration("pin-timeout")
+		case "pin-queue-dir":
+			cfg.Content.PinQueueDir = cctx.String("pin-queue-dir")
+		case "transfer-failure-grace-period":
+			cfg.TransferFailureGracePeriod = cctx.Duration("transfer-failure-grace-period")
+		case "deal-expiry-window":
+			cfg.DealExpiryWindow = cctx.Duration("deal-expiry-window")
+		case "untracked-leaf-size":
+			cfg.UntrackedLeafSize = cctx.Int("untracked-leaf-size")
+		case "origin-connect-retries":
+			cfg.OriginConnect.Retries = cctx.Int("origin-connect-retries")
+		case "origin-connect-backoff":
+			cfg.OriginConnect.Backoff = cctx.Duration("origin-connect-backoff")
+		case "fail-pins-on-unreachable-origins":
+			cfg.OriginConnect.FailFast = cctx.Bool("fail-pins-on-unreachable-origins")
+		case "provide-batch-size":
+			cfg.Provide.BatchSize = cctx.Int("provide-batch-size")
+		case "provide-flush-interval":
+			cfg.Provide.FlushInterval = cctx.Duration("provide-flush-interval")
+		case "provide-concurrency":
+			cfg.Provide.Concurrency = cctx.Int("provide-concurrency")
+		case "provide-default-ttl":
+			cfg.Provide.DefaultTTL = cctx.Duration("provide-default-ttl")
+		case "scrub-interval":
+			cfg.Scrub.Interval = cctx.Duration("scrub-interval")
+		case "scrub-pins-per-run":
+			cfg.Scrub.PinsPerRun = cctx.Int("scrub-pins-per-run")
+		case "scrub-sample-fraction":
+			cfg.Scrub.SampleFraction = cctx.Float64("scrub-sample-fraction")
+		case "split-checkpoint-dir":
+			cfg.Split.CheckpointDir = cctx.String("split-checkpoint-dir")
+		case "split-retries":
+			cfg.Split.Retries = cctx.Int("split-retries")
+		case "retrieval-concurrency":
+			cfg.Retrieval.Concurrency = cctx.Int("retrieval-concurrency")
+		case "retrieval-fair-per-user":
+			cfg.Retrieval.FairPerUser = cctx.Bool("retrieval-fair-per-user")
+		case "aggregation-member-codecs":
+			cfg.Aggregation.MemberCodecs = cctx.StringSlice("aggregation-member-codecs")
+		case "aggregation-match-cid-version":
+			cfg.Aggregation.MatchCidVersion = cctx.Bool("aggregation-match-cid-version")
+		case "aggregation-warn-on-mismatch":
+			cfg.Aggregation.WarnOnMismatch = cctx.Bool("aggregation-warn-on-mismatch")
+		case "offload-high-watermark":
+			cfg.Offload.HighWatermark = cctx.Float64("offload-high-watermark")
+		case "offload-size":
+			cfg.Offload.Size = cctx.Int64("offload-size")
+		case "benchmark-size":
+			cfg.Benchmark.Size = cctx.Int64("benchmark-size")
+		case "max-benchmark-size":
+			cfg.Benchmark.MaxSize = cctx.Int64("max-benchmark-size")
 		case "rpc-incoming-queue-size":
 			cfg.RPCMessage.IncomingQueueSize = cctx.Int("rpc-incoming-queue-size")
 		case "rpc-outgoing-queue-size":
 			cfg.RPCMessage.OutgoingQueueSize = cctx.Int("rpc-outgoing-queue-size")
+		case "rpc-graceful-close":
+			cfg.RPCMessage.GracefulClose = cctx.Bool("rpc-graceful-close")
+		case "rpc-pin-complete-chunk-size":
+			cfg.RPCMessage.PinCompleteChunkSize = cctx.Int("rpc-pin-complete-chunk-size")
+		case "rpc-breaker-threshold":
+			cfg.Resilience.BreakerThreshold = cctx.Int("rpc-breaker-threshold")
+		case "rpc-breaker-cooldown":
+			cfg.Resilience.BreakerCooldown = cctx.Duration("rpc-breaker-cooldown")
+		case "rpc-reconnect-initial-backoff":
+			cfg.Resilience.ReconnectInitialBackoff = cctx.Duration("rpc-reconnect-initial-backoff")
+		case "rpc-reconnect-max-backoff":
+			cfg.Resilience.ReconnectMaxBackoff = cctx.Duration("rpc-reconnect-max-backoff")
+		case "rpc-reconnect-alert-after":
+			cfg.Resilience.ReconnectAlertAfter = cctx.Int("rpc-reconnect-alert-after")
+		case "rpc-heartbeat-interval":
+			cfg.Resilience.HeartbeatInterval = cctx.Duration("rpc-heartbeat-interval")
+		case "rpc-heartbeat-timeout":
+			cfg.Resilience.HeartbeatTimeout = cctx.Duration("rpc-heartbeat-timeout")
+		case "rpc-write-timeout":
+			cfg.Resilience.WriteTimeout = cctx.Duration("rpc-write-timeout")
+		case "rpc-max-resends":
+			cfg.Resilience.MaxResends = cctx.Int("rpc-max-resends")
+		case "rpc-disconnected-send":
+			cfg.RPCMessage.DisconnectedSend = cctx.String("rpc-disconnected-send")
 		default:
 		}
 	}
@@ -221,6 +393,11 @@ func main() {
 			Value:   cfg.Node.ApiURL,
 			EnvVars: []string{"FULLNODE_API_INFO"},
 		},
+		&cli.StringSliceFlag{
+			Name:  "node-api-fallback-url",
+			Usage: "lotus api gateway urls tried in order when node-api-url is unreachable",
+			Value: cli.NewStringSlice(cfg.Node.FallbackApiURLs...),
+		},
 		&cli.StringFlag{
 			Name:  "config",
 			Usage: "specify configuration file location",
@@ -237,6 +414,16 @@ func main() {
 			Usage: "specify blockstore parameters",
 			Value: cfg.Node.Blockstore,
 		},
+		&cli.StringFlag{
+			Name:  "blockstore-type",
+			Usage: "blockstore backend, one of lmdb, flatfs or badger, the blockstore is then a plain path",
+			Value: cfg.Node.BlockstoreType,
+		},
+		&cli.StringFlag{
+			Name:  "secondary-blockstore",
+			Usage: "specify secondary blockstore parameters, pins can be relocated to it with the relocate pin command",
+			Value: cfg.Node.SecondaryBlockstore,
+		},
 		&cli.StringFlag{
 			Name:  "write-log",
 			Usage: "enable write log blockstore in specified directory",
@@ -248,6 +435,67 @@ func main() {
 			Value:   cfg.ApiListen,
 			EnvVars: []string{"ESTUARY_SHUTTLE_API_LISTEN"},
 		},
+		&cli.StringFlag{
+			Name:    "internal-listen",
+			Usage:   "address for the internal metrics/pprof server to listen on, keep it off the public network (empty disables it)",
+			Value:   cfg.InternalListen,
+			EnvVars: []string{"ESTUARY_SHUTTLE_INTERNAL_LISTEN"},
+		},
+		&cli.Uint64Flag{
+			Name:  "min-free-space",
+			Usage: "stop accepting new pins and content when the blockstore has less free space than this many bytes (0 disables the check)",
+			Value: cfg.MinFreeSpace,
+		},
+		&cli.Uint64Flag{
+			Name:  "min-free-memory",
+			Usage: "piece commitments and pins are deferred while less memory than this is available, 0 disables it",
+			Value: cfg.MinFreeMemory,
+		},
+		&cli.StringFlag{
+			Name:  "upload-temp-dir",
+			Usage: "directory uploads are staged in while being added, relative paths are under the datadir (defaults to uploads in the datadir)",
+			Value: cfg.UploadTempDir,
+		},
+		&cli.Uint64Flag{
+			Name:  "max-upload-temp-space",
+			Usage: "reject new uploads when the uploads in progress would take more than this many bytes in the upload temp dir (0 disables the check)",
+			Value: cfg.MaxUploadTempSpace,
+		},
+		&cli.IntFlag{
+			Name:  "db-writers",
+			Usage: "number of writers the database writes of finished pins are funneled to",
+			Value: cfg.DBWriters,
+		},
+		&cli.IntFlag{
+			Name:  "max-car-imports",
+			Usage: "max number of car uploads imported at once, the others wait for their turn",
+			Value: cfg.MaxCarImports,
+		},
+		&cli.IntFlag{
+			Name:  "commp-concurrency",
+			Usage: "max number of piece commitments computed at once, the others wait for their turn",
+			Value: cfg.CommpConcurrency,
+		},
+		&cli.IntFlag{
+			Name:  "take-content-concurrency",
+			Usage: "max number of pins of a content consolidation in progress at once",
+			Value: cfg.TakeContentConcurrency,
+		},
+		&cli.BoolFlag{
+			Name:  "verify-taken-content",
+			Usage: "check that the whole dag of content taken from another shuttle is in the blockstore before reporting it pinned",
+			Value: cfg.VerifyTakenContent,
+		},
+		&cli.IntFlag{
+			Name:  "dag-walk-concurrency",
+			Usage: "max number of blocks fetched at once by a single dag walk",
+			Value: cfg.DagWalkConcurrency,
+		},
+		&cli.IntFlag{
+			Name:  "max-dag-walks",
+			Usage: "max number of dag walks in progress at once, further walks wait for one to finish",
+			Value: cfg.MaxDagWalks,
+		},
 		&cli.StringFlag{
 			Name:    "datadir",
 			Usage:   "directory to store data in",
@@ -264,6 +512,16 @@ func main() {
 			Usage: "auth token for connecting to estuary",
 			Value: cfg.EstuaryRemote.AuthToken,
 		},
+		&cli.IntFlag{
+			Name:  "auth-retries",
+			Usage: "number of times a user auth check is retried on estuary server or network errors",
+			Value: cfg.EstuaryRemote.AuthRetries,
+		},
+		&cli.DurationFlag{
+			Name:  "auth-retry-backoff",
+			Usage: "wait before the first auth check retry, doubled on every retry",
+			Value: cfg.EstuaryRemote.AuthRetryBackoff,
+		},
 		&cli.StringFlag{
 			Name:  "handle",
 			Usage: "estuary shuttle handle to use",
@@ -279,6 +537,11 @@ func main() {
 			Usage: "enable api endpoint logging",
 			Value: cfg.Logging.ApiEndpointLogging,
 		},
+		&cli.IntFlag{
+			Name:  "log-buffer-size",
+			Usage: "number of recent log lines kept in memory for the admin logs endpoint (0 disables it)",
+			Value: cfg.Logging.BufferSize,
+		},
 		&cli.BoolFlag{
 			Name:  "write-log-flush",
 			Usage: "enable hard flushing blockstore",
@@ -289,11 +552,36 @@ func main() {
 			Usage: "truncates old logs with new ones",
 			Value: cfg.Node.WriteLogTruncate,
 		},
+		&cli.Int64Flag{
+			Name:  "write-log-max-size",
+			Usage: "flush and compact the write log into the blockstore once it grows over this many bytes (0 disables it)",
+			Value: cfg.Node.WriteLogMaxSize,
+		},
+		&cli.DurationFlag{
+			Name:  "write-log-check-interval",
+			Usage: "how often the size of the write log is checked",
+			Value: cfg.Node.WriteLogCheckInterval,
+		},
+		&cli.BoolFlag{
+			Name:  "ephemeral-identity",
+			Usage: "run with a new libp2p identity that is not persisted, for test deployments",
+			Value: cfg.Node.EphemeralIdentity,
+		},
 		&cli.BoolFlag{
 			Name:  "no-blockstore-cache",
 			Usage: "disable blockstore caching",
 			Value: cfg.Node.NoBlockstoreCache,
 		},
+		&cli.IntFlag{
+			Name:  "blockstore-read-cache-size",
+			Usage: "number of blocks to keep in the blockstore read cache, 0 disables it",
+			Value: cfg.Node.BlockstoreCache.ReadCacheSize,
+		},
+		&cli.StringFlag{
+			Name:  "blockstore-read-cache-policy",
+			Usage: "eviction policy for the blockstore read cache (lru, 2q or arc)",
+			Value: cfg.Node.BlockstoreCache.ReadCachePolicy,
+		},
 		&cli.BoolFlag{
 			Name:  "private",
 			Usage: "sets shuttle as private",
@@ -309,6 +597,156 @@ func main() {
 			Usage: "disable reloading pin queue on shuttle start",
 			Value: cfg.NoReloadPinQueue,
 		},
+		&cli.BoolFlag{
+			Name:  "no-unpin-cleanup",
+			Usage: "leave the objects and blocks no other pin references to garbage collection instead of deleting them on unpin",
+			Value: cfg.NoUnpinCleanup,
+		},
+		&cli.BoolFlag{
+			Name:  "reconcile-on-startup",
+			Usage: "once connected, compare the pins of the shuttle with the contents estuary expects it to have and report the ones that diverged, expensive on large shuttles",
+			Value: cfg.ReconcileOnStartup,
+		},
+		&cli.IntFlag{
+			Name:  "max-pin-queue-size",
+			Usage: "reject new pins while this many pins are queued (0 disables the limit)",
+			Value: cfg.MaxPinQueueSize,
+		},
+		&cli.BoolFlag{
+			Name:  "retrieval-only",
+			Usage: "only serve the content already on the shuttle, rejecting new pins, uploads, splits and aggregates",
+			Value: cfg.RetrievalOnly,
+		},
+		&cli.DurationFlag{
+			Name:  "pin-timeout",
+			Usage: "how long a pin may take in total before it fails, whatever progress it makes",
+			Value: cfg.Content.PinTimeout,
+		},
+		&cli.StringFlag{
+			Name:  "pin-queue-dir",
+			Usage: "directory the pin queue and its duplicate guard are kept in, relative to the data dir unless absolute (defaults to the data dir)",
+			Value: cfg.Content.PinQueueDir,
+		},
+		&cli.DurationFlag{
+			Name:  "transfer-failure-grace-period",
+			Usage: "how long a transfer must stay failed before it is reported failed to estuary",
+			Value: cfg.TransferFailureGracePeriod,
+		},
+		&cli.DurationFlag{
+			Name:  "deal-expiry-window",
+			Usage: "estuary is warned about tracked deals ending within this long, so they can be renewed in time (0 disables it)",
+			Value: cfg.DealExpiryWindow,
+		},
+		&cli.IntFlag{
+			Name:  "untracked-leaf-size",
+			Usage: "raw leaves smaller than this many bytes get no object rows in the database, 0 tracks all of them",
+			Value: cfg.UntrackedLeafSize,
+		},
+		&cli.IntFlag{
+			Name:  "origin-connect-retries",
+			Usage: "number of times connecting to the origin peer of a pin is retried",
+			Value: cfg.OriginConnect.Retries,
+		},
+		&cli.DurationFlag{
+			Name:  "origin-connect-backoff",
+			Usage: "wait before the first origin connect retry, doubled on every retry",
+			Value: cfg.OriginConnect.Backoff,
+		},
+		&cli.BoolFlag{
+			Name:  "fail-pins-on-unreachable-origins",
+			Usage: "fail a pin right away when none of its origin peers can be connected to",
+			Value: cfg.OriginConnect.FailFast,
+		},
+		&cli.IntFlag{
+			Name:  "provide-batch-size",
+			Usage: "max number of cids announced to the dht in a single batch",
+			Value: cfg.Provide.BatchSize,
+		},
+		&cli.DurationFlag{
+			Name:  "provide-flush-interval",
+			Usage: "max time a cid waits for its batch to fill up before it is announced",
+			Value: cfg.Provide.FlushInterval,
+		},
+		&cli.IntFlag{
+			Name:  "provide-concurrency",
+			Usage: "max number of batches of cids announced to the dht at once",
+			Value: cfg.Provide.Concurrency,
+		},
+		&cli.DurationFlag{
+			Name:  "provide-default-ttl",
+			Usage: "how long the provider records of pins without a ttl hint last before they are announced again, 0 reprovides them with all the other content",
+			Value: cfg.Provide.DefaultTTL,
+		},
+		&cli.DurationFlag{
+			Name:  "scrub-interval",
+			Usage: "how often the blocks of a sample of the active pins are checked for corruption, 0 disables it",
+			Value: cfg.Scrub.Interval,
+		},
+		&cli.IntFlag{
+			Name:  "scrub-pins-per-run",
+			Usage: "number of active pins checked on every scrub run",
+			Value: cfg.Scrub.PinsPerRun,
+		},
+		&cli.Float64Flag{
+			Name:  "scrub-sample-fraction",
+			Usage: "fraction of the blocks of a pin checked when scrubbing it",
+			Value: cfg.Scrub.SampleFraction,
+		},
+		&cli.StringFlag{
+			Name:  "split-checkpoint-dir",
+			Usage: "directory the packing state of splits in progress is saved to, relative to the data dir unless absolute",
+			Value: cfg.Split.CheckpointDir,
+		},
+		&cli.IntFlag{
+			Name:  "split-retries",
+			Usage: "how many more times packing content for a split is tried after it failed, resuming from the last completed box",
+			Value: cfg.Split.Retries,
+		},
+		&cli.IntFlag{
+			Name:  "retrieval-concurrency",
+			Usage: "how many retrievals from miners run at once, the others are queued",
+			Value: cfg.Retrieval.Concurrency,
+		},
+		&cli.BoolFlag{
+			Name:  "retrieval-fair-per-user",
+			Usage: "serve the queued retrievals of each user in turn instead of in arrival order",
+			Value: cfg.Retrieval.FairPerUser,
+		},
+		&cli.StringSliceFlag{
+			Name:  "aggregation-member-codecs",
+			Usage: "codecs the root of a content may have to be aggregated (dag-pb, raw, dag-cbor or dag-json)",
+			Value: cli.NewStringSlice(cfg.Aggregation.MemberCodecs...),
+		},
+		&cli.BoolFlag{
+			Name:  "aggregation-match-cid-version",
+			Usage: "only aggregate contents whose root has the cid version of the aggregate root",
+			Value: cfg.Aggregation.MatchCidVersion,
+		},
+		&cli.BoolFlag{
+			Name:  "aggregation-warn-on-mismatch",
+			Usage: "log aggregate members with a mismatched codec or cid version instead of refusing the aggregate",
+			Value: cfg.Aggregation.WarnOnMismatch,
+		},
+		&cli.Float64Flag{
+			Name:  "offload-high-watermark",
+			Usage: "fraction of the blockstore disk in use over which estuary is asked to move content away (0 disables it)",
+			Value: cfg.Offload.HighWatermark,
+		},
+		&cli.Int64Flag{
+			Name:  "offload-size",
+			Usage: "bytes of content, least recently retrieved first, an offload request asks estuary to move",
+			Value: cfg.Offload.Size,
+		},
+		&cli.Int64Flag{
+			Name:  "benchmark-size",
+			Usage: "bytes of synthetic content a benchmark runs on when it does not ask for a size",
+			Value: cfg.Benchmark.Size,
+		},
+		&cli.Int64Flag{
+			Name:  "max-benchmark-size",
+			Usage: "largest synthetic content, in bytes, a benchmark may ask for",
+			Value: cfg.Benchmark.MaxSize,
+		},
 		&cli.BoolFlag{
 			Name:  "dev",
 			Usage: "use http:// and ws:// when connecting to estuary in a development environment",
@@ -348,11 +786,36 @@ func main() {
 			Usage: "sets the bitswap max work per peer",
 			Value: cfg.Node.Bitswap.MaxOutstandingBytesPerPeer,
 		},
+		&cli.IntFlag{
+			Name:  "libp2p-max-conns",
+			Usage: "caps the libp2p connections, starting the resource manager even with no limiter (0 keeps the configured limits)",
+			Value: cfg.Node.ResourceLimits.MaxConns,
+		},
+		&cli.IntFlag{
+			Name:  "libp2p-max-streams",
+			Usage: "caps the libp2p streams, starting the resource manager even with no limiter (0 keeps the configured limits)",
+			Value: cfg.Node.ResourceLimits.MaxStreams,
+		},
+		&cli.Int64Flag{
+			Name:  "libp2p-max-memory",
+			Usage: "caps the memory libp2p may reserve in bytes, starting the resource manager even with no limiter (0 keeps the configured limits)",
+			Value: cfg.Node.ResourceLimits.MaxMemory,
+		},
+		&cli.IntFlag{
+			Name:  "libp2p-max-fd",
+			Usage: "caps the file descriptors libp2p may use, starting the resource manager even with no limiter (0 keeps the configured limits)",
+			Value: cfg.Node.ResourceLimits.MaxFD,
+		},
 		&cli.IntFlag{
 			Name:  "bitswap-target-message-size",
 			Usage: "sets the bitswap target message size",
 			Value: cfg.Node.Bitswap.TargetMessageSize,
 		},
+		&cli.BoolFlag{
+			Name:  "bitswap-no-provide",
+			Usage: "do not announce the blocks fetched over bitswap, only the roots of pins, required for unannounced pins",
+			Value: cfg.Node.Bitswap.NoProvide,
+		},
 		&cli.IntFlag{
 			Name:  "rpc-incoming-queue-size",
 			Usage: "sets incoming rpc message queue size",
@@ -363,6 +826,66 @@ func main() {
 			Usage: "sets outgoing rpc message queue size",
 			Value: cfg.RPCMessage.OutgoingQueueSize,
 		},
+		&cli.BoolFlag{
+			Name:  "rpc-graceful-close",
+			Usage: "send a goodbye message to estuary before closing the rpc connection on shutdown",
+			Value: cfg.RPCMessage.GracefulClose,
+		},
+		&cli.IntFlag{
+			Name:  "rpc-pin-complete-chunk-size",
+			Usage: "sets the maximum number of objects sent in a single pin complete message, 0 disables chunking",
+			Value: cfg.RPCMessage.PinCompleteChunkSize,
+		},
+		&cli.IntFlag{
+			Name:  "rpc-breaker-threshold",
+			Usage: "number of failed sends in a row after which messages to estuary are held back, 0 disables it",
+			Value: cfg.Resilience.BreakerThreshold,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-breaker-cooldown",
+			Usage: "how long messages to estuary are held back before sending is tried again",
+			Value: cfg.Resilience.BreakerCooldown,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-reconnect-initial-backoff",
+			Usage: "how long to wait before the first retry of a failed reconnect to estuary",
+			Value: cfg.Resilience.ReconnectInitialBackoff,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-reconnect-max-backoff",
+			Usage: "the longest wait between retries of a failed reconnect to estuary",
+			Value: cfg.Resilience.ReconnectMaxBackoff,
+		},
+		&cli.IntFlag{
+			Name:  "rpc-reconnect-alert-after",
+			Usage: "number of failed reconnects to estuary in a row after which an error is raised, 0 never raises one",
+			Value: cfg.Resilience.ReconnectAlertAfter,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-heartbeat-interval",
+			Usage: "send a heartbeat to estuary when nothing was sent for this long, 0 disables heartbeats",
+			Value: cfg.Resilience.HeartbeatInterval,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-heartbeat-timeout",
+			Usage: "drop the connection to estuary when nothing could be sent for this long, must be longer than the heartbeat interval",
+			Value: cfg.Resilience.HeartbeatTimeout,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-write-timeout",
+			Usage: "how long writing a single message to estuary may take",
+			Value: cfg.Resilience.WriteTimeout,
+		},
+		&cli.IntFlag{
+			Name:  "rpc-max-resends",
+			Usage: "number of times a message estuary did not acknowledge is sent again before it is dropped, 0 resends it until it expires",
+			Value: cfg.Resilience.MaxResends,
+		},
+		&cli.StringFlag{
+			Name:  "rpc-disconnected-send",
+			Usage: "what to do with messages sent while disconnected from estuary: block until reconnected, fail them, or buffer them, the durable ones in the outbox and the others on the outgoing queue until it is full",
+			Value: cfg.RPCMessage.DisconnectedSend,
+		},
 	}
 
 	app.Commands = []*cli.Command{
@@ -381,53 +904,74 @@ func main() {
 				return cfg.Save(configFile)
 			},
 		},
+		{
+			Name:  "rotate-key",
+			Usage: "Replaces the libp2p identity of the node with a new one, content is reprovided under it on the next start",
+			Action: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized { // still want to report parsing errors
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				if cfg.Node.EphemeralIdentity {
+					return errors.New("the node runs with an ephemeral identity, there is no key to rotate")
+				}
+
+				oldID, newID, err := node.RotatePeerKey(cfg.Node.Libp2pKeyFile)
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("rotated peer identity from %s to %s, restart the node to use it\n", oldID, newID)
+				return nil
+			},
+		},
 	}
 
 	app.Action = func(cctx *cli.Context) error {
 		log.Infof("shuttle version: %s", appVersion)
 
-		if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized { // still want to report parsing errors
-			return err
-		}
-
-		if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+		if err := loadConfig(cctx, app.Flags, cfg); err != nil {
 			return err
 		}
+		applyLogLevels(cfg.Logging.Levels)
 
-		if err := cfg.Validate(); err != nil {
-			return err
+		var logs *logRing
+		if cfg.Logging.BufferSize > 0 {
+			logs = setupLogRing(cfg.Logging.BufferSize)
 		}
 
 		db, err := setupDatabase(cfg.DatabaseConnString)
 		if err != nil {
 			return err
 		}
-
-		if cfg.Node.EnableWebsocketListenAddr {
-			cfg.Node.ListenAddrs = append(cfg.Node.ListenAddrs, config.DefaultWebsocketAddr)
-		}
+		defer func() {
+			if sqldb, err := db.DB(); err == nil {
+				if err := sqldb.Close(); err != nil {
+					log.Errorf("failed to close the database: %s", err)
+				}
+			}
+		}()
 
 		init := Initializer{&cfg.Node, db}
 		nd, err := node.Setup(context.TODO(), init)
 		if err != nil {
 			return err
 		}
+		defer func() {
+			if err := nd.Datastore.Close(); err != nil {
+				log.Errorf("failed to close the datastore: %s", err)
+			}
+		}()
 
-		// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
-		// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
-		flset := flag.NewFlagSet("lotus", flag.ExitOnError)
-		flset.String("api-url", "", "node api url")
-		err = flset.Set("api-url", cfg.Node.ApiURL)
-		if err != nil {
-			return err
-		}
-
-		ncctx := cli.NewContext(cli.NewApp(), flset, nil)
-		api, closer, err := lcli.GetGatewayAPI(ncctx)
+		api, err := util.NewChainAPI(cfg.Node.ChainEndpoints())
 		if err != nil {
 			return err
 		}
-		defer closer()
+		defer api.Close()
 
 		defaddr, err := nd.Wallet.GetDefault()
 		if err != nil {
@@ -442,16 +986,28 @@ func main() {
 
 		metCtx := metrics.CtxScope(context.Background(), "shuttle")
 		activeCommp := metrics.NewCtx(metCtx, "active_commp", "number of active piece commitment calculations ongoing").Gauge()
+		commpLimit := newCommpLimiter(metCtx, cfg.CommpConcurrency)
+		commpRuns := newCommpRuns()
 		commpMemo := memo.NewMemoizer(func(ctx context.Context, k string, v interface{}) (interface{}, error) {
-			activeCommp.Inc()
-			defer activeCommp.Dec()
+			c, err := cid.Decode(k)
+			if err != nil {
+				return nil, err
+			}
 
-			start := time.Now()
+			// unpinning the content cancels its computation
+			ctx, done := commpRuns.track(ctx, c)
+			defer done()
 
-			c, err := cid.Decode(k)
+			release, err := commpLimit.acquire(ctx)
 			if err != nil {
 				return nil, err
 			}
+			defer release()
+
+			activeCommp.Inc()
+			defer activeCommp.Dec()
+
+			start := time.Now()
 
 			commpcid, carSize, size, err := filclient.GeneratePieceCommitmentFFI(ctx, c, nd.Blockstore)
 			if err != nil {
@@ -468,13 +1024,17 @@ func main() {
 
 			return res, nil
 		})
-		commpMemo.SetConcurrencyLimit(4)
 
 		sbm, err := stagingbs.NewStagingBSMgr(cfg.StagingDataDir)
 		if err != nil {
 			return err
 		}
 
+		uploads, err := newUploadStager(cfg.UploadTempDir, cfg.DataDir, cfg.MaxUploadTempSpace)
+		if err != nil {
+			return err
+		}
+
 		// TODO: Paramify this? also make a proper constructor for the shuttle
 		cache, err := lru.New2Q(1000)
 		if err != nil {
@@ -491,26 +1051,49 @@ func main() {
 		}
 
 		s := &Shuttle{
-			Node:        nd,
-			Api:         api,
-			DB:          db,
-			Filc:        filc,
-			StagingMgr:  sbm,
-			Private:     cfg.Private,
-			gwayHandler: gateway.NewGatewayHandler(nd.Blockstore),
+			Node:         nd,
+			Api:          api,
+			DB:           db,
+			Filc:         filc,
+			StagingMgr:   sbm,
+			uploads:      uploads,
+			addCoalescer: newAddCoalescer(),
+			Private:      cfg.Private,
+			gwayHandler:  gateway.NewGatewayHandler(nd.Blockstore),
 
 			Tracer: otel.Tracer(fmt.Sprintf("shuttle_%s", cfg.Hostname)),
 
 			commpMemo: commpMemo,
-
-			trackingChannels: make(map[string]*util.ChanTrack),
-			inflightCids:     make(map[cid.Cid]uint),
-			splitsInProgress: make(map[uint]bool),
-			aggrInProgress:   make(map[uint]bool),
-			unpinInProgress:  make(map[uint]bool),
+			commpRuns: commpRuns,
+
+			retrievalsInProgress: make(map[uint]*retrievalProgress),
+			retrievalLimit:       newRetrievalLimiter(metCtx, cfg.Retrieval.Concurrency, cfg.Retrieval.FairPerUser),
+
+			trackingChannels:   make(map[string]*util.ChanTrack),
+			transferSamples:    make(map[string][]transferSample),
+			inflightCids:       make(map[cid.Cid]uint),
+			retrieved:          make(map[cid.Cid]struct{}),
+			splitsInProgress:   make(map[uint]bool),
+			aggrInProgress:     make(map[uint]bool),
+			unpinInProgress:    make(map[uint]bool),
+			rechunksInProgress: make(map[uint]bool),
+			throttledTransfers: make(map[datatransfer.ChannelID]*transferThrottle),
+			transferFailures:   make(map[string]*transferFailure),
+			takeContentSem:     make(chan struct{}, cfg.TakeContentConcurrency),
+			dagWalkSem:         make(chan struct{}, cfg.MaxDagWalks),
+			carImportSem:       make(chan struct{}, cfg.MaxCarImports),
+			memGuard:           newMemoryGuard(metCtx, cfg.MinFreeMemory),
+			provideQueue:       make(chan cid.Cid, cfg.Provide.BatchSize),
+			provideSem:         make(chan struct{}, cfg.Provide.Concurrency),
+			dbWriter:           newDBWriter(cfg.DBWriters),
 
 			outgoing:  make(chan *drpc.Message, cfg.RPCMessage.OutgoingQueueSize),
+			goodbye:   make(chan *goodbyeReq),
+			outbox:    &rpcOutbox{db: db, maxResends: cfg.Resilience.MaxResends},
+			breaker:   newCircuitBreaker(metCtx, cfg.Resilience.BreakerThreshold, cfg.Resilience.BreakerCooldown),
+			rpcConn:   newRPCConnState(cfg.RPCMessage.DisconnectedSend),
 			authCache: cache,
+			logs:      logs,
 
 			hostname:           cfg.Hostname,
 			estuaryHost:        cfg.EstuaryRemote.Api,
@@ -519,6 +1102,18 @@ func main() {
 			disableLocalAdding: cfg.Content.DisableLocalAdding,
 			dev:                cfg.Dev,
 			shuttleConfig:      cfg,
+
+			readConfig: func() (*config.Shuttle, error) {
+				next := config.NewShuttle(appVersion)
+				if err := loadConfig(cctx, app.Flags, next); err != nil {
+					return nil, err
+				}
+				return next, nil
+			},
+		}
+
+		if cfg.ReconcileOnStartup {
+			s.reconcilePending = 1
 		}
 
 		// Subscribe to legacy markets data transfer events (go-data-transfer)
@@ -576,7 +1171,7 @@ func main() {
 					}
 				default:
 					// send transfer update for every other events
-					trsFailed, msg := util.TransferFailed(fst)
+					trsFailed, msg := s.transferFailed(fst.TransferID, fst)
 					s.sendTransferStatusUpdate(context.TODO(), &drpc.TransferStatus{
 						Chanid:   fst.TransferID,
 						DealDBID: trk.Dbid,
@@ -588,6 +1183,9 @@ func main() {
 			}()
 		})
 
+		// Throttle the legacy transfers operators set a bandwidth limit on
+		s.Filc.SubscribeToDataTransferEvents(s.throttleTransfer)
+
 		// Subscribe to data transfer events from Boost
 		_, err = s.Filc.Libp2pTransferMgr.Subscribe(func(dbid uint, fst filclient.ChannelState) {
 			go func() {
@@ -635,7 +1233,7 @@ func main() {
 					}
 				default:
 					// send transfer update for every other events
-					trsFailed, msg := util.TransferFailed(&fst)
+					trsFailed, msg := s.transferFailed(fst.TransferID, &fst)
 					s.sendTransferStatusUpdate(context.TODO(), &drpc.TransferStatus{
 						Chanid:   fst.TransferID,
 						DealDBID: dbid,
@@ -652,12 +1250,18 @@ func main() {
 
 		s.PinMgr = pinner.NewPinManager(s.doPinning, s.onPinStatusUpdate, &pinner.PinManagerOpts{
 			MaxActivePerUser: 30,
-			QueueDataDir:     cfg.DataDir,
+			QueueDataDir:     cfg.Content.PinQueueDir,
+			PinTimeout:       cfg.Content.PinTimeout,
 		})
+
+		if err := s.loadPausedUsers(); err != nil {
+			return fmt.Errorf("failed to load paused users: %w", err)
+		}
 		go s.PinMgr.Run(100)
 
-		// only refresh pin queue if pin queue refresh and local adding are enabled
-		if !cfg.NoReloadPinQueue && !cfg.Content.DisableLocalAdding {
+		// only refresh pin queue if pin queue refresh and local adding are enabled,
+		// a queue rebuilt from corruption is always refilled from the database
+		if (!cfg.NoReloadPinQueue || s.PinMgr.QueueRebuilt()) && !cfg.Content.DisableLocalAdding {
 			if err := s.refreshPinQueue(); err != nil {
 				log.Errorf("failed to refresh pin queue: %s", err)
 			}
@@ -669,6 +1273,32 @@ func main() {
 			}
 		}()
 
+		// cancelled to shut down, the api stops serving and the deferred
+		// cleanups run as this returns
+		runCtx, shutdown := context.WithCancel(cctx.Context)
+		defer shutdown()
+
+		if cfg.RPCMessage.GracefulClose {
+			go func() {
+				sigCh := make(chan os.Signal, 1)
+				signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+				sig := <-sigCh
+
+				s.sayGoodbye(fmt.Sprintf("shuttle shutting down (%s)", sig), time.Second*5)
+				shutdown()
+			}()
+		}
+
+		go func() {
+			hupCh := make(chan os.Signal, 1)
+			signal.Notify(hupCh, syscall.SIGHUP)
+			for range hupCh {
+				if _, err := s.reloadConfig(); err != nil {
+					log.Errorf("failed to reload config: %s", err)
+				}
+			}
+		}()
+
 		blockstoreSize := metrics.NewCtx(metCtx, "blockstore_size", "total size of blockstore filesystem directory").Gauge()
 		blockstoreFree := metrics.NewCtx(metCtx, "blockstore_free", "free space in blockstore filesystem directory").Gauge()
 
@@ -785,7 +1415,35 @@ func main() {
 			}
 		}()
 
-		return s.ServeAPI()
+		go s.watchReplication()
+		go s.watchPieceCids()
+		go s.watchRetrievals()
+		go s.watchTransferRates()
+		go s.watchTransferFailures()
+		go s.runProvideBatches(cfg.Provide)
+		go s.runReprovideDue()
+
+		if cfg.Scrub.Interval > 0 {
+			go s.watchIntegrity(cfg.Scrub)
+		}
+
+		if cfg.MinFreeSpace > 0 {
+			go s.watchStorageSpace(cfg.MinFreeSpace)
+		}
+
+		if cfg.Offload.HighWatermark > 0 {
+			go s.watchOffloadWatermark(cfg.Offload)
+		}
+
+		if cfg.InternalListen != "" {
+			go func() {
+				if err := s.ServeInternal(); err != nil {
+					log.Errorf("internal server failed: %s", err)
+				}
+			}()
+		}
+
+		return s.ServeAPI(runCtx)
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -793,21 +1451,30 @@ func main() {
 	}
 }
 
-var backoffTimer = backoff.ExponentialBackOff{
-	InitialInterval: time.Second * 5,
-	Multiplier:      1.5,
-	MaxInterval:     time.Second * 10,
-	Stop:            backoff.Stop,
-	Clock:           backoff.SystemClock,
+// reconnectBackoff is the backoff between failed reconnects to estuary, it
+// starts over from the current config
+func (d *Shuttle) reconnectBackoff() *backoff.ExponentialBackOff {
+	cfg := d.config().Resilience
+	b := &backoff.ExponentialBackOff{
+		InitialInterval: cfg.ReconnectInitialBackoff,
+		Multiplier:      cfg.ReconnectMultiplier,
+		MaxInterval:     cfg.ReconnectMaxBackoff,
+		Stop:            backoff.Stop,
+		Clock:           backoff.SystemClock,
+	}
+	b.Reset()
+	return b
 }
 
 type Shuttle struct {
-	Node       *node.Node
-	Api        api.Gateway
-	DB         *gorm.DB
-	PinMgr     *pinner.PinManager
-	Filc       *filclient.FilClient
-	StagingMgr *stagingbs.StagingBSMgr
+	Node         *node.Node
+	Api          api.Gateway
+	DB           *gorm.DB
+	PinMgr       *pinner.PinManager
+	Filc         *filclient.FilClient
+	StagingMgr   *stagingbs.StagingBSMgr
+	uploads      *uploadStager
+	addCoalescer *addCoalescer
 
 	gwayHandler *gateway.GatewayHandler
 
@@ -816,6 +1483,10 @@ type Shuttle struct {
 	tcLk             sync.Mutex
 	trackingChannels map[string]*util.ChanTrack
 
+	// bytes sent by a transfer when its byte counts were last asked for
+	transferSamplesLk sync.Mutex
+	transferSamples   map[string][]transferSample
+
 	splitLk          sync.Mutex
 	splitsInProgress map[uint]bool
 
@@ -825,9 +1496,44 @@ type Shuttle struct {
 	unpinLk         sync.Mutex
 	unpinInProgress map[uint]bool
 
+	rechunkLk          sync.Mutex
+	rechunksInProgress map[uint]bool
+
+	throttleLk         sync.Mutex
+	throttledTransfers map[datatransfer.ChannelID]*transferThrottle
+
+	// when the transfers in a failed state were first seen failed
+	tfLk             sync.Mutex
+	transferFailures map[string]*transferFailure
+
 	addPinLk sync.Mutex
 
+	// serializes the database writes of finished pins
+	dbWriter *dbWriter
+
+	// bounds the pins of content consolidations in progress at once
+	takeContentSem chan struct{}
+
+	// bounds the dag walks in progress at once
+	dagWalkSem chan struct{}
+
+	// bounds the car imports in progress at once, and tracks the blocks
+	// they are writing to the blockstore
+	carImportSem chan struct{}
+	blockWrites  inflightBlocks
+
+	memGuard *memoryGuard
+
+	// cids waiting to be announced, and the bound of the batches of them
+	// announced at once
+	provideQueue chan cid.Cid
+	provideSem   chan struct{}
+
 	outgoing chan *drpc.Message
+	goodbye  chan *goodbyeReq
+	outbox   *rpcOutbox
+	breaker  *circuitBreaker
+	rpcConn  *rpcConnState
 
 	Private            bool
 	disableLocalAdding bool
@@ -839,16 +1545,45 @@ type Shuttle struct {
 	shuttleToken  string
 
 	commpMemo *memo.Memoizer
+	commpRuns *commpRuns
+
+	logs *logRing
 
 	authCache *lru.TwoQueueCache
 
 	retrLk               sync.Mutex
 	retrievalsInProgress map[uint]*retrievalProgress
+	retrievalLimit       *retrievalLimiter
 
 	inflightCids   map[cid.Cid]uint
 	inflightCidsLk sync.Mutex
 
-	shuttleConfig *config.Shuttle
+	// roots served since the retrievals were last recorded
+	retrieved   map[cid.Cid]struct{}
+	retrievedLk sync.Mutex
+
+	// held by garbage collection so pins with untracked leaves are not
+	// recorded while it decides which blocks are still needed
+	leafGcLk sync.RWMutex
+
+	diskUsageLk sync.Mutex
+	diskUsage   *drpc.DiskUsage
+
+	// shuttleConfig is swapped by config reloads, read it through config()
+	shuttleConfig   *config.Shuttle
+	shuttleConfigLk sync.RWMutex
+
+	// readConfig reads the config the shuttle was started with again,
+	// reloads are serialized by reloadLk
+	readConfig func() (*config.Shuttle, error)
+	reloadLk   sync.Mutex
+
+	// only one benchmark runs at a time
+	benchmarkLk sync.Mutex
+
+	// set until estuary went through the contents it expects us to have,
+	// hello messages ask it to until then (accessed atomically)
+	reconcilePending int32
 }
 
 func (d *Shuttle) isInflight(c cid.Cid) bool {
@@ -856,25 +1591,86 @@ func (d *Shuttle) isInflight(c cid.Cid) bool {
 	return ok && v > 0
 }
 
+// errSaidGoodbye is returned by runRpc after we closed the connection
+// ourselves with a goodbye message
+var errSaidGoodbye = fmt.Errorf("rpc connection closed after sending goodbye")
+
+type goodbyeReq struct {
+	msg  *drpc.Message
+	sent chan struct{}
+
+	// reconnect dials estuary again after reconnectDelay instead of
+	// leaving the connection closed
+	reconnect      bool
+	reconnectDelay time.Duration
+}
+
+// reconnectError is returned by runRpc after we closed the connection to
+// reconnect, e.g. when estuary asked for it
+type reconnectError struct {
+	delay time.Duration
+}
+
+func (e *reconnectError) Error() string {
+	return fmt.Sprintf("rpc connection closed to reconnect in %s", e.delay)
+}
+
 func (d *Shuttle) RunRpcConnection() error {
+	backoffTimer := d.reconnectBackoff()
+
+	var failedDials int
 	for {
 		conn, err := d.dialConn()
 		if err != nil {
-			log.Errorf("failed to dial estuary rpc endpoint: %s", err)
+			failedDials++
+			alertAfter := d.config().Resilience.ReconnectAlertAfter
+			if alertAfter > 0 && failedDials%alertAfter == 0 {
+				log.Errorw("still unable to reconnect to estuary", "attempts", failedDials, "error", err)
+			} else {
+				log.Errorf("failed to dial estuary rpc endpoint: %s", err)
+			}
 			time.Sleep(backoffTimer.NextBackOff())
 			continue
 		}
 
-		if err := d.runRpc(conn); err != nil {
-			log.Errorf("rpc routine exited with an error: %s", err)
-			backoffTimer.Reset()
-			time.Sleep(backoffTimer.NextBackOff())
-			continue
+		if failedDials > 0 {
+			log.Infof("reconnected to estuary after %d failed attempts", failedDials)
+			failedDials = 0
 		}
 
-		log.Warnf("rpc routine exited with no error, reconnecting...")
-		time.Sleep(time.Second)
-	}
+		if err := d.runRpc(conn); err != nil {
+			if err == errSaidGoodbye {
+				return nil
+			}
+
+			var re *reconnectError
+			if errors.As(err, &re) {
+				log.Infof("closed the rpc connection to reconnect, reconnecting in %s...", re.delay)
+				time.Sleep(re.delay)
+				backoffTimer = d.reconnectBackoff()
+				continue
+			}
+
+			var gb *drpc.GoodbyeError
+			if errors.As(err, &gb) {
+				if gb.StayDown {
+					log.Warnf("estuary closed the rpc connection and asked us to stay down: %s", gb.Reason)
+					return nil
+				}
+				log.Infof("estuary closed the rpc connection (%s), reconnecting...", gb.Reason)
+				backoffTimer = d.reconnectBackoff()
+				continue
+			}
+
+			log.Errorf("rpc routine exited with an error: %s", err)
+			backoffTimer = d.reconnectBackoff()
+			time.Sleep(backoffTimer.NextBackOff())
+			continue
+		}
+
+		log.Warnf("rpc routine exited with no error, reconnecting...")
+		time.Sleep(time.Second)
+	}
 }
 
 func (d *Shuttle) runRpc(conn *websocket.Conn) (err error) {
@@ -898,6 +1694,28 @@ func (d *Shuttle) runRpc(conn *websocket.Conn) (err error) {
 		return err
 	}
 
+	replayed, err := d.replayOutbox(conn)
+	if err != nil {
+		return err
+	}
+	d.breaker.reset()
+
+	d.rpcConn.setConnected(true)
+	defer d.rpcConn.setConnected(false)
+
+	// a connection nothing can be written to anymore is dropped, heartbeats
+	// keep an idle one from looking dead. The heartbeat interval is set for
+	// the whole connection, a reload changes it from the next one.
+	var heartbeat <-chan time.Time
+	interval := d.config().Resilience.HeartbeatInterval
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	lastWrite := time.Now()
+
+	var goodbye *drpc.Goodbye
 	go func() {
 		defer close(readDone)
 
@@ -908,6 +1726,14 @@ func (d *Shuttle) runRpc(conn *websocket.Conn) (err error) {
 				return
 			}
 
+			if cmd.Op == drpc.CMD_Goodbye {
+				goodbye = cmd.Params.Goodbye
+				if goodbye == nil {
+					goodbye = &drpc.Goodbye{}
+				}
+				return
+			}
+
 			go func(cmd *drpc.Command) {
 				if err := d.handleRpcCmd(cmd); err != nil {
 					log.Errorf("failed to handle rpc command: %s", err)
@@ -919,22 +1745,186 @@ func (d *Shuttle) runRpc(conn *websocket.Conn) (err error) {
 	for {
 		select {
 		case <-readDone:
+			if goodbye != nil {
+				return &drpc.GoodbyeError{Goodbye: *goodbye}
+			}
 			return fmt.Errorf("read routine exited, assuming socket is closed")
-		case msg := <-d.outgoing:
-			if err := conn.SetWriteDeadline(time.Now().Add(time.Second * 30)); err != nil {
+		case gb := <-d.goodbye:
+			if err := conn.SetWriteDeadline(time.Now().Add(d.config().Resilience.WriteTimeout)); err != nil {
 				log.Errorf("failed to set the connection's network write deadline: %s", err)
+			}
+			if err := websocket.JSON.Send(conn, gb.msg); err != nil {
+				log.Errorf("failed to send goodbye message: %s", err)
+			}
+			close(gb.sent)
+			if gb.reconnect {
+				return &reconnectError{delay: gb.reconnectDelay}
+			}
+			return errSaidGoodbye
+		case now := <-heartbeat:
+			if now.Sub(lastWrite) >= d.config().Resilience.HeartbeatTimeout {
+				return fmt.Errorf("nothing could be written to estuary for %s, assuming the connection is dead", now.Sub(lastWrite))
+			}
+
+			if now.Sub(lastWrite) < interval {
+				continue
+			}
+
+			if err := d.writeHeartbeat(conn); err != nil {
+				log.Warnf("failed to send heartbeat: %s", err)
+				continue
+			}
+			lastWrite = time.Now()
+		case msg := <-d.outgoing:
+			if msg.ID != 0 && replayed[msg.ID] {
+				// queued before we reconnected, already resent from the outbox
+				continue
+			}
 
+			if !d.breaker.allow(time.Now()) {
+				d.breaker.skip(msg)
+				continue
 			}
-			if err := websocket.JSON.Send(conn, msg); err != nil {
+
+			if err := d.writeMessage(conn, msg); err != nil {
 				log.Errorf("failed to send message: %s", err)
+				d.breaker.failure(time.Now())
+				continue
 			}
-			if err := conn.SetWriteDeadline(time.Time{}); err != nil {
-				log.Errorf("failed to set the connection's network write deadline: %s", err)
+			lastWrite = time.Now()
+
+			if skipped := d.breaker.success(); len(skipped) > 0 {
+				d.resendSkipped(conn, skipped)
 			}
 		}
 	}
 }
 
+func (d *Shuttle) writeMessage(conn *websocket.Conn, msg *drpc.Message) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(d.config().Resilience.WriteTimeout)); err != nil {
+		log.Errorf("failed to set the connection's network write deadline: %s", err)
+	}
+	defer func() {
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			log.Errorf("failed to set the connection's network write deadline: %s", err)
+		}
+	}()
+	return websocket.JSON.Send(conn, msg)
+}
+
+// writeHeartbeat sends a websocket ping, estuary answers it without it ever
+// reaching the rpc handlers
+func (d *Shuttle) writeHeartbeat(conn *websocket.Conn) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(d.config().Resilience.WriteTimeout)); err != nil {
+		log.Errorf("failed to set the connection's network write deadline: %s", err)
+	}
+	defer func() {
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			log.Errorf("failed to set the connection's network write deadline: %s", err)
+		}
+	}()
+
+	conn.PayloadType = websocket.PingFrame
+	defer func() {
+		conn.PayloadType = websocket.TextFrame
+	}()
+
+	_, err := conn.Write(nil)
+	return err
+}
+
+// resendSkipped sends the durable messages that were kept in the outbox
+// while the circuit breaker was open
+func (d *Shuttle) resendSkipped(conn *websocket.Conn, skipped map[uint64]bool) {
+	msgs, err := d.outbox.pending()
+	if err != nil {
+		log.Errorf("failed to load pending outgoing messages: %s", err)
+		return
+	}
+
+	for _, msg := range msgs {
+		if !skipped[msg.ID] {
+			continue
+		}
+
+		if err := d.outbox.resending(msg.ID); err != nil {
+			log.Errorf("failed to count resend of %s message: %s", msg.Op, err)
+		}
+
+		if err := d.writeMessage(conn, msg); err != nil {
+			// still in the outbox, replayed with the next connection
+			log.Errorf("failed to resend %s message: %s", msg.Op, err)
+			d.breaker.failure(time.Now())
+			return
+		}
+	}
+}
+
+// replayOutbox resends the durable messages estuary did not ack yet, e.g.
+// because they were lost with the previous connection
+func (d *Shuttle) replayOutbox(conn *websocket.Conn) (map[uint64]bool, error) {
+	msgs, err := d.outbox.pending()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pending outgoing messages: %w", err)
+	}
+
+	if len(msgs) > 0 {
+		log.Infof("replaying %d unacknowledged messages to estuary", len(msgs))
+	}
+
+	replayed := make(map[uint64]bool, len(msgs))
+	for _, msg := range msgs {
+		if err := d.outbox.resending(msg.ID); err != nil {
+			log.Errorf("failed to count resend of %s message: %s", msg.Op, err)
+		}
+
+		if err := conn.SetWriteDeadline(time.Now().Add(d.config().Resilience.WriteTimeout)); err != nil {
+			log.Errorf("failed to set the connection's network write deadline: %s", err)
+		}
+		if err := websocket.JSON.Send(conn, msg); err != nil {
+			return nil, fmt.Errorf("failed to replay %s message: %w", msg.Op, err)
+		}
+		replayed[msg.ID] = true
+	}
+
+	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+		log.Errorf("failed to set the connection's network write deadline: %s", err)
+	}
+	return replayed, nil
+}
+
+// sayGoodbye tells estuary that we are closing the rpc connection on purpose,
+// waiting at most `timeout` for the message to be written out.
+func (d *Shuttle) sayGoodbye(reason string, timeout time.Duration) {
+	req := &goodbyeReq{
+		msg: &drpc.Message{
+			Op: drpc.OP_Goodbye,
+			Params: drpc.MsgParams{
+				Goodbye: &drpc.Goodbye{
+					Reason: reason,
+				},
+			},
+		},
+		sent: make(chan struct{}),
+	}
+
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+
+	select {
+	case d.goodbye <- req:
+	case <-tm.C:
+		log.Warnf("timed out waiting to send goodbye to estuary")
+		return
+	}
+
+	select {
+	case <-req.sent:
+	case <-tm.C:
+		log.Warnf("timed out waiting to send goodbye to estuary")
+	}
+}
+
 func (d *Shuttle) getHelloMessage() (*drpc.Hello, error) {
 	addr, err := d.Node.Wallet.GetDefault()
 	if err != nil {
@@ -956,10 +1946,21 @@ func (d *Shuttle) getHelloMessage() (*drpc.Hello, error) {
 			ID:    d.Node.Host.ID(),
 			Addrs: d.Node.Host.Addrs(),
 		},
-		ContentAddingDisabled: d.disableLocalAdding,
+		ContentAddingDisabled:  d.disableLocalAdding,
+		RetrievalOnly:          d.config().RetrievalOnly,
+		Formats:                shuttleContentFormats,
+		Reconcile:              atomic.LoadInt32(&d.reconcilePending) == 1,
+		FetchesAggregateBlocks: true,
 	}, nil
 }
 
+// shuttleContentFormats are reported to estuary so that it only sends us
+// content we can walk
+var shuttleContentFormats = &drpc.ContentFormats{
+	Codecs:         util.SupportedCodecs,
+	MultihashFuncs: util.SupportedMultihashes,
+}
+
 func (d *Shuttle) dialConn() (*websocket.Conn, error) {
 	scheme := "wss"
 	if d.dev {
@@ -1013,6 +2014,45 @@ func (d *Shuttle) checkTokenAuth(token string) (*User, error) {
 		}
 	}
 
+	out, err := d.getViewer(token)
+	if err != nil {
+		return nil, err
+	}
+
+	usr := &User{
+		ID:              out.ID,
+		Username:        out.Username,
+		Perms:           out.Perms,
+		AuthToken:       token,
+		AuthExpiry:      out.AuthExpiry,
+		StorageDisabled: out.Settings.ContentAddingDisabled,
+		Flags:           out.Settings.Flags,
+	}
+
+	d.authCache.Add(token, usr)
+
+	return usr, nil
+}
+
+// getViewer asks estuary who the token belongs to, retrying when estuary
+// could not answer. A rejected token fails right away.
+func (d *Shuttle) getViewer(token string) (*util.ViewerResponse, error) {
+	backoff := d.config().EstuaryRemote.AuthRetryBackoff
+	for attempt := 0; ; attempt++ {
+		out, retry, err := d.requestViewer(token)
+		if err == nil || !retry || attempt >= d.config().EstuaryRemote.AuthRetries {
+			return out, err
+		}
+
+		log.Warnf("auth check against estuary failed (attempt %d), retrying: %s", attempt+1, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// requestViewer makes a single viewer request, retry is set if the request
+// failed for reasons other than the token
+func (d *Shuttle) requestViewer(token string) (*util.ViewerResponse, bool, error) {
 	scheme := "https"
 	if d.dev {
 		scheme = "http"
@@ -1020,43 +2060,34 @@ func (d *Shuttle) checkTokenAuth(token string) (*User, error) {
 
 	req, err := http.NewRequest("GET", scheme+"://"+d.estuaryHost+"/viewer", nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, true, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, true, fmt.Errorf("estuary auth check failed with status %d", resp.StatusCode)
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		var out util.HttpErrorResponse
 		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return nil, &out.Error
+		return nil, false, &out.Error
 	}
 
 	var out util.ViewerResponse
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return nil, err
+		return nil, false, err
 	}
-
-	usr := &User{
-		ID:              out.ID,
-		Username:        out.Username,
-		Perms:           out.Perms,
-		AuthToken:       token,
-		AuthExpiry:      out.AuthExpiry,
-		StorageDisabled: out.Settings.ContentAddingDisabled,
-		Flags:           out.Settings.Flags,
-	}
-
-	d.authCache.Add(token, usr)
-
-	return usr, nil
+	return &out, false, nil
 }
 
 func (d *Shuttle) AuthRequired(level int) echo.MiddlewareFunc {
@@ -1098,31 +2129,23 @@ func withUser(f func(echo.Context, *User) error) func(echo.Context) error {
 	}
 }
 
-func (s *Shuttle) ServeAPI() error {
+func (s *Shuttle) ServeAPI(ctx context.Context) error {
 	e := echo.New()
 	e.Binder = new(util.Binder)
 	e.Pre(middleware.RemoveTrailingSlash())
 
-	if s.shuttleConfig.Logging.ApiEndpointLogging {
+	if s.config().Logging.ApiEndpointLogging {
 		e.Use(middleware.Logger())
 	}
 
 	e.Use(s.tracingMiddleware)
-	e.Use(util.AppVersionMiddleware(s.shuttleConfig.AppVersion))
+	e.Use(util.AppVersionMiddleware(s.config().AppVersion))
 	e.HTTPErrorHandler = util.ErrorHandler
 
-	e.GET("/debug/metrics", func(e echo.Context) error {
-		estumetrics.Exporter().ServeHTTP(e.Response().Writer, e.Request())
-		return nil
-	})
-	e.GET("/debug/stack", func(e echo.Context) error {
-		err := writeAllGoroutineStacks(e.Response().Writer)
-		if err != nil {
-			log.Error(err)
-		}
-		return err
-	})
-	e.GET("/debug/pprof/:prof", serveProfile)
+	// when the internal server is enabled the debug endpoints are only served there
+	if s.config().InternalListen == "" {
+		s.addDebugRoutes(e)
+	}
 
 	e.Use(middleware.CORS())
 
@@ -1140,6 +2163,11 @@ func (s *Shuttle) ServeAPI() error {
 		return nil
 	})
 
+	e.GET("/ipfs/:cid", s.handleGateway)
+	e.GET("/ipfs/:cid/*", s.handleGateway)
+	e.HEAD("/ipfs/:cid", s.handleGateway)
+	e.HEAD("/ipfs/:cid/*", s.handleGateway)
+
 	content := e.Group("/content")
 	content.Use(s.AuthRequired(util.PermLevelUpload))
 	content.POST("/add", withUser(s.handleAdd))
@@ -1153,6 +2181,9 @@ func (s *Shuttle) ServeAPI() error {
 	admin.GET("/health/:cid", s.handleContentHealthCheck)
 	admin.POST("/resend/pincomplete/:content", s.handleResendPinComplete)
 	admin.POST("/loglevel", s.handleLogLevel)
+	admin.GET("/logs", s.handleGetLogs)
+	admin.GET("/pins", s.handleListPins)
+	admin.GET("/pins/label/:label", s.handleGetPinsByLabel)
 	admin.POST("/transfers/restartall", s.handleRestartAllTransfers)
 	admin.GET("/transfers/list", s.handleListAllTransfers)
 	admin.GET("/transfers/:miner", s.handleMinerTransferDiagnostics)
@@ -1161,8 +2192,108 @@ func (s *Shuttle) ServeAPI() error {
 	admin.POST("/garbage/collect", s.handleGarbageCollect)
 	admin.GET("/net/rcmgr/stats", s.handleRcmgrStats)
 	admin.GET("/system/config", s.handleGetSystemConfig)
+	admin.GET("/snapshot", s.handleExportSnapshot)
+	admin.POST("/snapshot/restore", s.handleRestoreSnapshot)
+
+	return util.StartUntilDone(ctx, e, s.config().ApiListen)
+}
+
+// handleGateway serves pinned content with ipfs http gateway semantics. Only
+// content pinned on this shuttle is served, it is never fetched from the
+// network.
+func (s *Shuttle) handleGateway(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	cc, err := cid.Decode(c.Param("cid"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid cid: %s", err),
+		}
+	}
+
+	pinned, err := s.isPinnedLocally(ctx, cc)
+	if err != nil {
+		return err
+	}
+
+	if !pinned {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("cid: %s is not pinned on this shuttle", cc),
+		}
+	}
+
+	p := "/ipfs/" + cc.String()
+	if sub := strings.Trim(c.Param("*"), "/"); sub != "" {
+		p += "/" + sub
+	}
 
-	return e.Start(s.shuttleConfig.ApiListen)
+	req := c.Request().Clone(ctx)
+	req.URL.Path = p
+
+	resp := c.Response()
+	s.gwayHandler.ServeHTTP(resp, req)
+
+	// only content actually sent counts as retrieved
+	if req.Method != http.MethodHead && resp.Status >= 200 && resp.Status < 300 {
+		s.markRetrieved(cc)
+	}
+	return nil
+}
+
+// isPinnedLocally returns true if the given cid is part of an active pin on
+// this shuttle
+func (s *Shuttle) isPinnedLocally(ctx context.Context, c cid.Cid) (bool, error) {
+	_, span := s.Tracer.Start(ctx, "isPinnedLocally")
+	defer span.End()
+
+	var count int64
+	if err := s.DB.Model(ObjRef{}).
+		Joins("left join objects on obj_refs.object = objects.id").
+		Joins("left join pins on obj_refs.pin = pins.id").
+		Where("objects.cid = ? and pins.active", c.Bytes()).
+		Limit(1).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// ServeInternal serves metrics, profiling and health endpoints on the internal
+// listen address, away from the public api
+func (s *Shuttle) ServeInternal() error {
+	e := echo.New()
+	e.HideBanner = true
+	e.HTTPErrorHandler = util.ErrorHandler
+
+	s.addDebugRoutes(e)
+
+	exporter := estumetrics.Exporter()
+	e.GET("/metrics", func(e echo.Context) error {
+		exporter.ServeHTTP(e.Response().Writer, e.Request())
+		return nil
+	})
+	e.GET("/health", s.handleHealth)
+
+	return e.Start(s.config().InternalListen)
+}
+
+func (s *Shuttle) addDebugRoutes(e *echo.Echo) {
+	e.GET("/debug/metrics", func(e echo.Context) error {
+		estumetrics.Exporter().ServeHTTP(e.Response().Writer, e.Request())
+		return nil
+	})
+	e.GET("/debug/stack", func(e echo.Context) error {
+		err := writeAllGoroutineStacks(e.Response().Writer)
+		if err != nil {
+			log.Error(err)
+		}
+		return err
+	})
+	e.GET("/debug/pprof/:prof", serveProfile)
 }
 
 func serveProfile(c echo.Context) error {
@@ -1247,21 +2378,53 @@ func (s *Shuttle) handleLogLevel(c echo.Context) error {
 func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
 
+	if err := s.errorIfRetrievalOnly(); err != nil {
+		return err
+	}
+
 	if err := util.ErrorIfContentAddingDisabled(s.isContentAddingDisabled(u)); err != nil {
 		return err
 	}
 
-	form, err := c.MultipartForm()
+	if err := util.ErrorIfUserPaused(s.PinMgr.UserPaused(u.ID)); err != nil {
+		return err
+	}
+
+	if err := util.ErrorIfStorageFull(s.PinMgr.StorageFull()); err != nil {
+		return err
+	}
+
+	labels, err := labelsFromQuery(c)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := metadataFromQuery(c)
+	if err != nil {
+		return err
+	}
+
+	reserved := c.Request().ContentLength
+	if err := s.uploads.reserve(reserved); err != nil {
+		return err
+	}
+	defer s.uploads.release(reserved)
+
+	mpf, err := s.uploads.stageFormFile(c.Request(), "data")
 	if err != nil {
 		return err
 	}
-	defer form.RemoveAll()
+	defer mpf.Close()
 
-	mpf, err := c.FormFile("data")
+	exceeded, err := s.userQuotaExceeded(u.ID, mpf.Size)
 	if err != nil {
 		return err
 	}
 
+	if err := util.ErrorIfUserQuotaExceeded(exceeded); err != nil {
+		return err
+	}
+
 	// if splitting is disabled and uploaded content size is greater than content size limit
 	// reject the upload, as it will only get stuck and deals will never be made for it
 	if !u.FlagSplitContent() && mpf.Size > constants.DefaultContentSizeLimit {
@@ -1272,22 +2435,30 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 		}
 	}
 
-	filename := mpf.Filename
-	fi, err := mpf.Open()
-	if err != nil {
-		return err
-	}
-	defer fi.Close()
-
 	cic := util.ContentInCollection{
 		CollectionID:  c.QueryParam(ColUuid),
 		CollectionDir: c.QueryParam(ColDir),
 	}
 
-	bsid, bs, err := s.StagingMgr.AllocNew()
+	key := addCoalesceKey(u.ID, mpf.SHA256, mpf.Filename, cic, labels, metadata)
+	res, err := s.addCoalescer.do(ctx, key, func() (*util.ContentAddResponse, error) {
+		return s.addFile(ctx, u, mpf, cic, labels, metadata)
+	})
 	if err != nil {
 		return err
 	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// addFile imports an uploaded file into the blockstore and pins it
+func (s *Shuttle) addFile(ctx context.Context, u *User, mpf *stagedFile, cic util.ContentInCollection, labels []string, metadata map[string]string) (*util.ContentAddResponse, error) {
+	filename := mpf.Filename
+	fi := mpf.File
+
+	bsid, bs, err := s.StagingMgr.AllocNew()
+	if err != nil {
+		return nil, err
+	}
 
 	defer func() {
 		go func() {
@@ -1302,12 +2473,12 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 
 	nd, err := s.importFile(ctx, dserv, fi)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	contid, err := s.createContent(ctx, u, nd.Cid(), filename, cic)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	pin := &Pin{
@@ -1319,56 +2490,38 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	}
 
 	if err := s.DB.Create(pin).Error; err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := setPinLabels(s.DB, pin.ID, labels); err != nil {
+		return nil, err
+	}
+
+	if err := setPinMetadata(s.DB, pin.ID, metadata, false); err != nil {
+		return nil, err
 	}
 
 	totalSize, objects, err := s.addDatabaseTrackingToContent(ctx, contid, dserv, bs, nd.Cid(), func(int64) {})
 	if err != nil {
-		return xerrors.Errorf("encountered problem computing object references: %w", err)
+		return nil, xerrors.Errorf("encountered problem computing object references: %w", err)
 	}
 
 	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
-		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
+		return nil, xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
 	}
 
 	s.sendPinCompleteMessage(ctx, contid, totalSize, objects)
 
-	if err := s.Provide(ctx, nd.Cid()); err != nil {
+	if err := s.provideContent(ctx, contid, nd.Cid()); err != nil {
 		log.Warnf("failed to provide: %+v", err)
-	}
-
-	return c.JSON(http.StatusOK, &util.ContentAddResponse{
-		Cid:          nd.Cid().String(),
-		RetrievalURL: util.CreateRetrievalURL(nd.Cid().String()),
-		EstuaryId:    contid,
-		Providers:    s.addrsForShuttle(),
-	})
-}
-
-func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
-	subCtx, cancel := context.WithTimeout(ctx, time.Second*15)
-	defer cancel()
-
-	if s.Node.FullRT.Ready() {
-		if err := s.Node.FullRT.Provide(subCtx, c, true); err != nil {
-			return errors.Wrap(err, "failed to provide newly added content")
-		}
-	} else {
-		log.Warnf("fullrt not in ready state, falling back to standard dht provide")
-		if err := s.Node.Dht.Provide(subCtx, c, true); err != nil {
-			return errors.Wrap(err, "fallback provide failed")
-		}
-	}
-
-	go func() {
-		if err := s.Node.Provider.Provide(c); err != nil {
-			log.Warnf("providing failed: %s", err)
-			return
-		}
-		log.Debugf("providing complete")
-	}()
+	}
 
-	return nil
+	return &util.ContentAddResponse{
+		Cid:          nd.Cid().String(),
+		RetrievalURL: util.CreateRetrievalURL(nd.Cid().String()),
+		EstuaryId:    contid,
+		Providers:    s.addrsForShuttle(),
+	}, nil
 }
 
 // handleAddCar godoc
@@ -1383,10 +2536,48 @@ func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
 func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
 
+	if err := s.errorIfRetrievalOnly(); err != nil {
+		return err
+	}
+
 	if err := util.ErrorIfContentAddingDisabled(s.isContentAddingDisabled(u)); err != nil {
 		return err
 	}
 
+	if err := util.ErrorIfUserPaused(s.PinMgr.UserPaused(u.ID)); err != nil {
+		return err
+	}
+
+	if err := util.ErrorIfStorageFull(s.PinMgr.StorageFull()); err != nil {
+		return err
+	}
+
+	labels, err := labelsFromQuery(c)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := metadataFromQuery(c)
+	if err != nil {
+		return err
+	}
+
+	// without a content length the size of the car is unknown, only users
+	// at their quota already are refused
+	size := c.Request().ContentLength
+	if size < 0 {
+		size = 0
+	}
+
+	exceeded, err := s.userQuotaExceeded(u.ID, size)
+	if err != nil {
+		return err
+	}
+
+	if err := util.ErrorIfUserQuotaExceeded(exceeded); err != nil {
+		return err
+	}
+
 	// if splitting is disabled and uploaded content size is greater than content size limit
 	// reject the upload, as it will only get stuck and deals will never be made for it
 	// if !u.FlagSplitContent() {
@@ -1409,6 +2600,13 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	// 	c.Request().Body = ioutil.NopCloser(bdWriter)
 	// }
 
+	// imports past the limit wait here for their turn
+	release, err := s.acquireCarImport(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	bsid, bs, err := s.StagingMgr.AllocNew()
 	if err != nil {
 		return err
@@ -1423,7 +2621,17 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	}()
 
 	defer c.Request().Body.Close()
-	header, err := s.loadCar(ctx, bs, c.Request().Body)
+	checksum, err := newBodyChecksum(c.Request())
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader = c.Request().Body
+	if checksum != nil {
+		body = checksum
+	}
+
+	header, err := s.loadCar(ctx, bs, body)
 	if err != nil {
 		return err
 	}
@@ -1433,6 +2641,13 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 		return c.JSON(400, map[string]string{"error": "cannot handle uploading car files with multiple roots"})
 	}
 
+	// the staged blocks are dropped with the staging blockstore on mismatch
+	if checksum != nil {
+		if err := checksum.verify(); err != nil {
+			return err
+		}
+	}
+
 	// TODO: how to specify filename?
 	filename := header.Roots[0].String()
 	if qpname := c.QueryParam("filename"); qpname != "" {
@@ -1464,6 +2679,14 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 		return err
 	}
 
+	if err := setPinLabels(s.DB, pin.ID, labels); err != nil {
+		return err
+	}
+
+	if err := setPinMetadata(s.DB, pin.ID, metadata, false); err != nil {
+		return err
+	}
+
 	totalSize, objects, err := s.addDatabaseTrackingToContent(ctx, contid, dserv, bs, root, func(int64) {})
 	if err != nil {
 		return xerrors.Errorf("encountered problem computing object references: %w", err)
@@ -1475,7 +2698,7 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 
 	s.sendPinCompleteMessage(ctx, contid, totalSize, objects)
 
-	if err := s.Provide(ctx, root); err != nil {
+	if err := s.provideContent(ctx, contid, root); err != nil {
 		log.Warn(err)
 	}
 
@@ -1608,10 +2831,12 @@ func (d *Shuttle) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 	ctx, span := d.Tracer.Start(ctx, "doPinning")
 	defer span.End()
 
-	for _, pi := range op.Peers {
-		if err := d.Node.Host.Connect(ctx, *pi); err != nil {
-			log.Warnf("failed to connect to origin node for pinning operation: %s", err)
-		}
+	if err := d.memGuard.checkPin(); err != nil {
+		return err
+	}
+
+	if connected := d.connectToOrigins(ctx, op.Peers); connected == 0 && len(op.Peers) > 0 && d.config().OriginConnect.FailFast {
+		return fmt.Errorf("could not reach any provider of content %d: failed to connect to all %d origin peers", op.ContId, len(op.Peers))
 	}
 
 	bserv := blockservice.New(d.Node.Blockstore, d.Node.Bitswap)
@@ -1623,16 +2848,78 @@ func (d *Shuttle) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 		return errors.Wrapf(err, "failed to addDatabaseTrackingToContent - contID(%d), cid(%s)", op.ContId, op.Obj.String())
 	}
 
+	// the source of taken content drops it once told it is pinned here
+	if err := d.verifyPinDag(ctx, op.ContId, op.Obj); err != nil {
+		return errors.Wrapf(err, "failed to verify pin - contID(%d), cid(%s)", op.ContId, op.Obj.String())
+	}
+
+	if err := d.markOriginPinPeers(op.ContId, op.Peers); err != nil {
+		log.Warnf("failed to mark origin peers of content %d: %s", op.ContId, err)
+	}
+
 	d.sendPinCompleteMessage(ctx, op.ContId, totalSize, objects)
 
-	if err := d.Provide(ctx, op.Obj); err != nil {
+	// anyone holding an inline cid has its data already
+	if util.IsInlineCid(op.Obj) {
+		return nil
+	}
+
+	if err := d.provideContent(ctx, op.ContId, op.Obj); err != nil {
 		return errors.Wrapf(err, "failed to provide - contID(%d), cid(%s)", op.ContId, op.Obj.String())
 	}
 	return nil
 }
 
+// connectToOrigins connects to the origin peers of a pin, retrying each
+// failed connect with backoff, and returns how many of them it connected to
+func (d *Shuttle) connectToOrigins(ctx context.Context, peers []*peer.AddrInfo) int {
+	var connected int32
+	var wg sync.WaitGroup
+	for _, pi := range peers {
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+
+			backoff := d.config().OriginConnect.Backoff
+			for attempt := 0; ; attempt++ {
+				err := d.Node.Host.Connect(ctx, pi)
+				if err == nil {
+					atomic.AddInt32(&connected, 1)
+					return
+				}
+
+				if attempt >= d.config().OriginConnect.Retries {
+					log.Warnf("failed to connect to origin node %s for pinning operation: %s", pi.ID, err)
+					return
+				}
+
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				backoff *= 2
+			}
+		}(*pi)
+	}
+	wg.Wait()
+
+	return int(connected)
+}
+
 const noDataTimeout = time.Minute * 10
 
+// acquireDagWalk waits until fewer than the configured number of dag walks
+// are in progress, the returned func ends the walk
+func (d *Shuttle) acquireDagWalk(ctx context.Context) (func(), error) {
+	select {
+	case d.dagWalkSem <- struct{}{}:
+		return func() { <-d.dagWalkSem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // TODO: mostly copy paste from estuary, dedup code
 func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint, dserv ipld.NodeGetter, bs blockstore.Blockstore, root cid.Cid, cb func(int64)) (int64, []*Object, error) {
 	ctx, span := d.Tracer.Start(ctx, "computeObjRefsUpdate")
@@ -1643,6 +2930,42 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		return 0, nil, errors.Wrap(err, "failed to retrieve content")
 	}
 
+	// a pin tracked again, e.g. to fetch back blocks found corrupted, gets
+	// new objects in place of its previous ones. The previous refs are
+	// replaced in the same transaction that records the new ones, so they
+	// keep the blocks of the pin until then.
+	oldObjs, err := d.objectsForPin(ctx, dbpin.ID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(oldObjs) > 0 {
+		defer func() {
+			if err := d.clearUnreferencedObjects(ctx, oldObjs); err != nil {
+				log.Errorf("failed to clear previous objects of pin %d: %s", dbpin.ID, err)
+			}
+		}()
+	}
+
+	// tiny content made of a single block does not need the whole walk
+	if root.Type() == cid.Raw || util.IsInlineCid(root) {
+		totalSize, objects, ok, err := d.trackSingleBlockContent(ctx, dbpin, dserv, root, cb)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if ok {
+			return totalSize, objects, nil
+		}
+	}
+
+	// wait for a walk slot before the no data timeout starts ticking
+	release, err := d.acquireDagWalk(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer release()
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -1666,7 +2989,9 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 	var objlk sync.Mutex
 	var objects []*Object
 	var totalSize int64
+	var untrackedLeaves, untrackedLeavesSize int64
 	cset := cid.NewSet()
+	sources := make(map[peer.ID]struct{})
 
 	defer func() {
 		d.inflightCidsLk.Lock()
@@ -1685,7 +3010,7 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		d.inflightCidsLk.Unlock()
 	}()
 
-	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
 		d.inflightCidsLk.Lock()
 		d.inflightCids[c]++
 		d.inflightCidsLk.Unlock()
@@ -1703,12 +3028,23 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		}
 
 		objlk.Lock()
-		objects = append(objects, &Object{
-			Cid:  util.DbCID{CID: c},
-			Size: len(node.RawData()),
-		})
+		if d.isUntrackedLeaf(c, root, len(node.RawData())) {
+			untrackedLeaves++
+			untrackedLeavesSize += int64(len(node.RawData()))
+		} else {
+			objects = append(objects, &Object{
+				Cid:  util.DbCID{CID: c},
+				Size: len(node.RawData()),
+			})
+		}
 
 		totalSize += int64(len(node.RawData()))
+
+		if d.Node.BlockSources != nil && len(sources) < maxPinPeers {
+			if p, ok := d.Node.BlockSources.SourceOf(c); ok {
+				sources[p] = struct{}{}
+			}
+		}
 		objlk.Unlock()
 
 		if c.Type() == cid.Raw {
@@ -1716,7 +3052,7 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		}
 
 		return util.FilterUnwalkableLinks(node.Links()), nil
-	}, root, cset.Visit, merkledag.Concurrent())
+	}, root, cset.Visit, merkledag.Concurrency(d.config().DagWalkConcurrency))
 	if err != nil {
 		return 0, nil, errors.Wrap(err, "failed to walk DAG")
 	}
@@ -1724,30 +3060,159 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 	span.SetAttributes(
 		attribute.Int64("totalSize", totalSize),
 		attribute.Int("numObjects", len(objects)),
+		attribute.Int64("untrackedLeaves", untrackedLeaves),
 	)
 
-	if err := d.DB.CreateInBatches(objects, 300).Error; err != nil {
-		return 0, nil, errors.Wrap(err, "failed to create objects in db")
+	if untrackedLeaves > 0 {
+		// the untracked leaves are only kept by the inflight cids until the
+		// pin is recorded
+		d.leafGcLk.RLock()
+		defer d.leafGcLk.RUnlock()
+	}
+
+	if err := d.dbWriter.do(func() error {
+		return d.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("pin = ?", dbpin.ID).Delete(ObjRef{}).Error; err != nil {
+				return errors.Wrap(err, "failed to remove previous refs")
+			}
+
+			if err := tx.CreateInBatches(objects, 300).Error; err != nil {
+				return errors.Wrap(err, "failed to create objects in db")
+			}
+
+			if err := tx.Model(Pin{}).Where("content = ?", contid).UpdateColumns(map[string]interface{}{
+				"active":                true,
+				"size":                  totalSize,
+				"pinning":               false,
+				"untracked_leaves":      untrackedLeaves,
+				"untracked_leaves_size": untrackedLeavesSize,
+			}).Error; err != nil {
+				return errors.Wrap(err, "failed to update content in database")
+			}
+
+			refs := make([]ObjRef, len(objects))
+			for i := range refs {
+				refs[i].Pin = dbpin.ID
+				refs[i].Object = objects[i].ID
+			}
+
+			if err := tx.CreateInBatches(refs, 500).Error; err != nil {
+				return errors.Wrap(err, "failed to create refs")
+			}
+
+			if len(sources) > 0 {
+				pinPeers := make([]PinPeer, 0, len(sources))
+				for p := range sources {
+					pinPeers = append(pinPeers, PinPeer{
+						Pin:  dbpin.ID,
+						Peer: p.String(),
+					})
+				}
+
+				if err := tx.Create(&pinPeers).Error; err != nil {
+					return errors.Wrap(err, "failed to record pin peers")
+				}
+			}
+			return nil
+		})
+	}); err != nil {
+		return 0, nil, err
+	}
+	return totalSize, objects, nil
+}
+
+// trackSingleBlockContent records content that is a single block, ok is false
+// if the block turns out to have links and needs to be walked instead
+func (d *Shuttle) trackSingleBlockContent(ctx context.Context, dbpin Pin, dserv ipld.NodeGetter, root cid.Cid, cb func(int64)) (int64, []*Object, bool, error) {
+	var size int
+	if util.IsInlineCid(root) && root.Type() == cid.Raw {
+		// the data is right there in the cid, nothing to fetch
+		dmh, err := multihash.Decode(root.Hash())
+		if err != nil {
+			return 0, nil, false, errors.Wrap(err, "failed to decode inline cid")
+		}
+		size = len(dmh.Digest)
+	} else {
+		d.inflightCidsLk.Lock()
+		d.inflightCids[root]++
+		d.inflightCidsLk.Unlock()
+
+		defer func() {
+			d.inflightCidsLk.Lock()
+			d.inflightCids[root]--
+			if d.inflightCids[root] == 0 {
+				delete(d.inflightCids, root)
+			}
+			d.inflightCidsLk.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(ctx, noDataTimeout)
+		defer cancel()
+
+		node, err := dserv.Get(ctx, root)
+		if err != nil {
+			return 0, nil, false, errors.Wrap(err, "failed to Get CID node")
+		}
+
+		if root.Type() != cid.Raw && len(util.FilterUnwalkableLinks(node.Links())) > 0 {
+			return 0, nil, false, nil
+		}
+		size = len(node.RawData())
+	}
+
+	if cb != nil {
+		cb(int64(size))
+	}
+
+	obj := &Object{
+		Cid:  util.DbCID{CID: root},
+		Size: size,
 	}
 
-	if err := d.DB.Model(Pin{}).Where("content = ?", contid).UpdateColumns(map[string]interface{}{
-		"active":  true,
-		"size":    totalSize,
-		"pinning": false,
-	}).Error; err != nil {
-		return 0, nil, errors.Wrap(err, "failed to update content in database")
+	if err := d.dbWriter.do(func() error {
+		return d.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("pin = ?", dbpin.ID).Delete(ObjRef{}).Error; err != nil {
+				return errors.Wrap(err, "failed to remove previous refs")
+			}
+
+			if err := tx.Create(obj).Error; err != nil {
+				return errors.Wrap(err, "failed to create object in db")
+			}
+
+			if err := tx.Create(&ObjRef{Pin: dbpin.ID, Object: obj.ID}).Error; err != nil {
+				return errors.Wrap(err, "failed to create ref")
+			}
+
+			return tx.Model(Pin{}).Where("id = ?", dbpin.ID).UpdateColumns(map[string]interface{}{
+				"active":  true,
+				"size":    size,
+				"pinning": false,
+			}).Error
+		})
+	}); err != nil {
+		return 0, nil, false, err
+	}
+	return int64(size), []*Object{obj}, true, nil
+}
+
+// markOriginPinPeers flags the recorded peers of a pin that were handed to us
+// as origins, so we can tell them apart from providers found on the network
+func (d *Shuttle) markOriginPinPeers(contid uint, origins []*peer.AddrInfo) error {
+	if len(origins) == 0 {
+		return nil
 	}
 
-	refs := make([]ObjRef, len(objects))
-	for i := range refs {
-		refs[i].Pin = dbpin.ID
-		refs[i].Object = objects[i].ID
+	var dbpin Pin
+	if err := d.DB.First(&dbpin, "content = ?", contid).Error; err != nil {
+		return err
 	}
 
-	if err := d.DB.CreateInBatches(refs, 500).Error; err != nil {
-		return 0, nil, errors.Wrap(err, "failed to create refs")
+	ids := make([]string, 0, len(origins))
+	for _, o := range origins {
+		ids = append(ids, o.ID.String())
 	}
-	return totalSize, objects, nil
+
+	return d.DB.Model(PinPeer{}).Where("pin = ? and peer in ?", dbpin.ID, ids).Update("origin", true).Error
 }
 
 func (d *Shuttle) onPinStatusUpdate(cont uint, location string, status types.PinningStatus) error {
@@ -1802,13 +3267,14 @@ func (s *Shuttle) refreshPinQueue() error {
 
 func (s *Shuttle) addPinToQueue(p Pin, peers []*peer.AddrInfo, replace uint) {
 	op := &pinner.PinningOperation{
-		ContId:  p.Content,
-		UserId:  p.UserID,
-		Obj:     p.Cid.CID,
-		Peers:   peers,
-		Started: p.CreatedAt,
-		Status:  types.PinningStatusQueued,
-		Replace: replace,
+		ContId:      p.Content,
+		UserId:      p.UserID,
+		Obj:         p.Cid.CID,
+		Peers:       peers,
+		Started:     p.CreatedAt,
+		Status:      types.PinningStatusQueued,
+		Replace:     replace,
+		Unannounced: p.Unannounced,
 	}
 
 	/*
@@ -1829,20 +3295,50 @@ func (s *Shuttle) importFile(ctx context.Context, dserv ipld.DAGService, fi io.R
 	return util.ImportFile(dserv, fi)
 }
 
+// dumpBlockstoreTo moves the blocks of a staging blockstore to the main one.
+// Blocks the main blockstore already has are skipped, and so are the ones
+// another import is writing at the same time, which are waited for instead.
 func (s *Shuttle) dumpBlockstoreTo(ctx context.Context, from, to blockstore.Blockstore) error {
 	ctx, span := s.Tracer.Start(ctx, "blockstoreCopy")
 	defer span.End()
 
-	// TODO: smarter batching... im sure ive written this logic before, just gotta go find it
 	keys, err := from.AllKeysChan(ctx)
 	if err != nil {
 		return err
 	}
 
-	var batches [][]blocks.Block
 	var batch []blocks.Block
+	var claimed []cid.Cid
+	defer func() {
+		// claims left after a failure
+		s.blockWrites.release(claimed)
+	}()
+
+	flush := func() error {
+		err := putManyWithRetries(ctx, to, batch)
+		s.blockWrites.release(claimed)
+		batch, claimed = nil, nil
+		return err
+	}
 
+	waiting := make(map[cid.Cid]<-chan struct{})
 	for k := range keys {
+		done, ok := s.blockWrites.claim(k)
+		if !ok {
+			waiting[k] = done
+			continue
+		}
+		claimed = append(claimed, k)
+
+		has, err := to.Has(ctx, k)
+		if err != nil {
+			return err
+		}
+
+		if has {
+			continue
+		}
+
 		blk, err := from.Get(ctx, k)
 		if err != nil {
 			return err
@@ -1850,35 +3346,61 @@ func (s *Shuttle) dumpBlockstoreTo(ctx context.Context, from, to blockstore.Bloc
 		batch = append(batch, blk)
 
 		if len(batch) > 500 {
-			batches = append(batches, batch)
-			batch = batch[:0]
+			if err := flush(); err != nil {
+				return err
+			}
 		}
 	}
 
-	if len(batch) > 0 {
-		batches = append(batches, batch)
+	if err := flush(); err != nil {
+		return err
 	}
 
-	for _, batch := range batches {
-		var retryCount int
-	retry:
+	// the imports we left blocks to may have failed to write them
+	for k, done := range waiting {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		has, err := to.Has(ctx, k)
+		if err != nil {
+			return err
+		}
 
-		if err := to.PutMany(ctx, batch); err != nil {
-			if retryCount <= 2 {
-				retryCount = retryCount + 1
-				time.Sleep(2 * time.Second)
-				goto retry
+		if !has {
+			blk, err := from.Get(ctx, k)
+			if err != nil {
+				return err
 			}
+			batch = append(batch, blk)
+		}
+	}
+	return putManyWithRetries(ctx, to, batch)
+}
+
+func putManyWithRetries(ctx context.Context, bs blockstore.Blockstore, batch []blocks.Block) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var retryCount int
+	for {
+		err := bs.PutMany(ctx, batch)
+		if err == nil || retryCount > 2 {
 			return err
 		}
+		retryCount++
+		time.Sleep(2 * time.Second)
 	}
-	return nil
 }
 
 func (s *Shuttle) getUpdatePacket() (*drpc.ShuttleUpdate, error) {
 	var upd drpc.ShuttleUpdate
 
 	upd.PinQueueSize = s.PinMgr.PinQueueSize()
+	upd.ActivePins = s.PinMgr.ActivePinCount()
 
 	var st unix.Statfs_t
 	if err := unix.Statfs(s.Node.StorageDir, &st); err != nil {
@@ -1887,6 +3409,7 @@ func (s *Shuttle) getUpdatePacket() (*drpc.ShuttleUpdate, error) {
 
 	upd.BlockstoreSize = st.Blocks * uint64(st.Bsize)
 	upd.BlockstoreFree = st.Bavail * uint64(st.Bsize)
+	upd.StorageFull = s.PinMgr.StorageFull()
 
 	if err := s.DB.Model(Pin{}).Where("active").Count(&upd.NumPins).Error; err != nil {
 		return nil, err
@@ -1895,9 +3418,46 @@ func (s *Shuttle) getUpdatePacket() (*drpc.ShuttleUpdate, error) {
 	return &upd, nil
 }
 
+// watchStorageSpace pauses pinning and rejects new content while the free
+// blockstore space is below the configured minimum, estuary is told right
+// away so it can route new content to other shuttles
+func (s *Shuttle) watchStorageSpace(minFree uint64) {
+	for {
+		var st unix.Statfs_t
+		if err := unix.Statfs(s.Node.StorageDir, &st); err != nil {
+			log.Errorf("failed to get blockstore disk usage: %s", err)
+		} else {
+			full := st.Bavail*uint64(st.Bsize) < minFree
+			if full != s.PinMgr.StorageFull() {
+				if full {
+					log.Warnf("blockstore free space is below %d bytes, pausing pinning", minFree)
+				} else {
+					log.Infof("blockstore free space is back above %d bytes, resuming pinning", minFree)
+				}
+				s.PinMgr.SetStorageFull(full)
+
+				upd, err := s.getUpdatePacket()
+				if err != nil {
+					log.Errorf("failed to get update packet: %s", err)
+				} else if err := s.sendRpcMessage(context.TODO(), &drpc.Message{
+					Op: drpc.OP_ShuttleUpdate,
+					Params: drpc.MsgParams{
+						ShuttleUpdate: upd,
+					},
+				}); err != nil {
+					log.Errorf("failed to send shuttle update: %s", err)
+				}
+			}
+		}
+		time.Sleep(time.Second * 30)
+	}
+}
+
 func (s *Shuttle) handleHealth(c echo.Context) error {
-	return c.JSON(http.StatusOK, map[string]string{
-		"status": "ok",
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":        "ok",
+		"rpcCircuit":    s.breaker.status(),
+		"rpcConnection": s.rpcConn.status(),
 	})
 }
 
@@ -1946,10 +3506,39 @@ func (s *Shuttle) Unpin(ctx context.Context, contid uint) error {
 		return err
 	}
 
+	if err := s.DB.Where("pin = ?", pin.ID).Delete(PinPeer{}).Error; err != nil {
+		return err
+	}
+
+	if err := s.DB.Where("pin = ?", pin.ID).Delete(PinLabel{}).Error; err != nil {
+		return err
+	}
+
+	if err := s.DB.Where("pin = ?", pin.ID).Delete(ContentMetadata{}).Error; err != nil {
+		return err
+	}
+
 	if err := s.DB.Delete(Pin{}, pin.ID).Error; err != nil {
 		return err
 	}
 
+	// the commP of the content is no longer needed unless another pin has
+	// the same root
+	var others int64
+	if err := s.DB.Model(Pin{}).Where("cid = ?", pin.Cid).Count(&others).Error; err != nil {
+		return err
+	}
+	if others == 0 {
+		if n := s.commpRuns.cancel(pin.Cid.CID); n > 0 {
+			log.Infof("canceled the commP computation of unpinned content %d", contid)
+		}
+	}
+
+	if s.config().NoUnpinCleanup {
+		log.Infof("unpinned %d, its %d objects are left for garbage collection", contid, len(objs))
+		return nil
+	}
+
 	if err := s.clearUnreferencedObjects(ctx, objs); err != nil {
 		return err
 	}
@@ -1967,6 +3556,9 @@ func (s *Shuttle) Unpin(ctx context.Context, contid uint) error {
 	}
 
 	log.Infof("unpinned %d and deleted %d out of %d blocks", contid, totalDeleted, len(objs))
+	if pin.UntrackedLeaves > 0 {
+		log.Infof("%d untracked leaves of %d are left for garbage collection", pin.UntrackedLeaves, contid)
+	}
 
 	return nil
 }
@@ -2030,6 +3622,20 @@ func (s *Shuttle) clearUnreferencedObjects(ctx context.Context, objs []*Object)
 }
 
 func (s *Shuttle) GarbageCollect(ctx context.Context) error {
+	s.leafGcLk.Lock()
+	defer s.leafGcLk.Unlock()
+
+	orphans, err := s.clearOrphanedObjects(ctx)
+	if err != nil {
+		return err
+	}
+	log.Infof("garbage collect cleared %d orphaned objects", orphans)
+
+	keep, err := s.untrackedLeavesInUse(ctx)
+	if err != nil {
+		return err
+	}
+
 	keys, err := s.Node.Blockstore.AllKeysChan(ctx)
 	if err != nil {
 		return err
@@ -2037,6 +3643,10 @@ func (s *Shuttle) GarbageCollect(ctx context.Context) error {
 
 	count := 0
 	for c := range keys {
+		if keep.Has(c) {
+			continue
+		}
+
 		del, err := s.deleteIfNotPinned(ctx, &Object{Cid: util.DbCID{CID: c}})
 		if err != nil {
 			return err
@@ -2137,6 +3747,12 @@ func (s *Shuttle) handleContentHealthCheck(c echo.Context) error {
 	bserv := blockservice.New(s.Node.Blockstore, exch)
 	dserv := merkledag.NewDAGService(bserv)
 
+	release, err := s.acquireDagWalk(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	cset := cid.NewSet()
 	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
 		node, err := dserv.Get(ctx, c)
@@ -2149,7 +3765,7 @@ func (s *Shuttle) handleContentHealthCheck(c echo.Context) error {
 		}
 
 		return util.FilterUnwalkableLinks(node.Links()), nil
-	}, cc, cset.Visit, merkledag.Concurrent())
+	}, cc, cset.Visit, merkledag.Concurrency(s.config().DagWalkConcurrency))
 
 	errstr := ""
 	if err != nil {
@@ -2330,6 +3946,10 @@ func (s *Shuttle) handleImportDeal(c echo.Context, u *User) error {
 	ctx, span := s.Tracer.Start(c.Request().Context(), "importDeal")
 	defer span.End()
 
+	if err := s.errorIfRetrievalOnly(); err != nil {
+		return err
+	}
+
 	var body importDealBody
 	if err := c.Bind(&body); err != nil {
 		return err
@@ -2428,7 +4048,7 @@ func (s *Shuttle) handleRcmgrStats(e echo.Context) error {
 
 func (s *Shuttle) handleGetSystemConfig(e echo.Context) error {
 	resp := map[string]interface{}{
-		"data": s.shuttleConfig,
+		"data": s.config(),
 	}
 	return e.JSON(http.StatusOK, resp)
 }
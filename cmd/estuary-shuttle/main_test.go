@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	lru "github.com/hashicorp/golang-lru"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackSingleBlockContent(t *testing.T) {
+	inline, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   multihash.IDENTITY,
+		MhLength: -1,
+	}.Sum([]byte("tiny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := blocks.NewBlock([]byte("a single raw block"))
+
+	cases := map[string]struct {
+		root cid.Cid
+		size int64
+	}{
+		"inline":    {root: inline, size: 4},
+		"raw block": {root: raw.Cid(), size: int64(len(raw.RawData()))},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			a := assert.New(t)
+			ctx := context.Background()
+
+			s := newTestShuttle(t)
+			s.inflightCids = make(map[cid.Cid]uint)
+			a.NoError(s.Node.Blockstore.Put(ctx, raw))
+			a.NoError(s.DB.Create(&Pin{Content: 1, UserID: 1, Pinning: true}).Error)
+
+			dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+			totalSize, objects, err := s.addDatabaseTrackingToContent(ctx, 1, dserv, s.Node.Blockstore, tc.root, func(int64) {})
+			a.NoError(err)
+			a.Equal(tc.size, totalSize)
+			if a.Len(objects, 1) {
+				a.Equal(tc.root, objects[0].Cid.CID)
+			}
+
+			var pin Pin
+			a.NoError(s.DB.First(&pin, "content = ?", 1).Error)
+			a.True(pin.Active)
+			a.False(pin.Pinning)
+			a.Equal(tc.size, pin.Size)
+
+			stored, err := s.objectsForPin(ctx, pin.ID)
+			a.NoError(err)
+			a.Len(stored, 1)
+			a.Len(s.inflightCids, 0)
+		})
+	}
+}
+
+func newAuthTestShuttle(t *testing.T, statuses ...int) (*Shuttle, *int) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[requests]
+		requests++
+
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_ = json.NewEncoder(w).Encode(&util.ViewerResponse{ID: 1, Username: "test"})
+		} else if status < http.StatusInternalServerError {
+			_ = json.NewEncoder(w).Encode(&util.HttpErrorResponse{Error: util.HttpError{Code: status, Reason: util.ERR_INVALID_AUTH}})
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	cache, err := lru.New2Q(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestShuttle(t)
+	s.dev = true
+	s.estuaryHost = strings.TrimPrefix(srv.URL, "http://")
+	s.authCache = cache
+	s.config().EstuaryRemote.AuthRetries = 2
+	s.config().EstuaryRemote.AuthRetryBackoff = time.Millisecond
+	return s, &requests
+}
+
+func TestCheckTokenAuthRetries(t *testing.T) {
+	s, requests := newAuthTestShuttle(t, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK)
+
+	u, err := s.checkTokenAuth("token")
+	assert.NoError(t, err)
+	if assert.NotNil(t, u) {
+		assert.Equal(t, uint(1), u.ID)
+	}
+	assert.Equal(t, 3, *requests)
+}
+
+func TestCheckTokenAuthGivesUp(t *testing.T) {
+	s, requests := newAuthTestShuttle(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+
+	_, err := s.checkTokenAuth("token")
+	assert.Error(t, err)
+	assert.Equal(t, 3, *requests)
+}
+
+func TestCheckTokenAuthRejectedFailsFast(t *testing.T) {
+	s, requests := newAuthTestShuttle(t, http.StatusUnauthorized)
+
+	_, err := s.checkTokenAuth("token")
+	assert.Error(t, err)
+	assert.Equal(t, 1, *requests)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/application-research/estuary/pinner"
+	"github.com/ipfs/go-metrics-interface"
+)
+
+// memoryGuard defers the operations that use a lot of memory, piece
+// commitments and pin walks, while the available memory is under a minimum.
+// A nil guard never defers anything.
+type memoryGuard struct {
+	minFree   uint64
+	available func() (uint64, error)
+
+	commpDeferrals metrics.Counter
+	pinDeferrals   metrics.Counter
+}
+
+func newMemoryGuard(ctx context.Context, minFree uint64) *memoryGuard {
+	if minFree == 0 {
+		return nil
+	}
+
+	return &memoryGuard{
+		minFree:        minFree,
+		available:      availableMemory,
+		commpDeferrals: metrics.NewCtx(ctx, "commp_memory_deferrals", "number of piece commitment computations deferred for lack of free memory").Counter(),
+		pinDeferrals:   metrics.NewCtx(ctx, "pin_memory_deferrals", "number of pins deferred for lack of free memory").Counter(),
+	}
+}
+
+// lowMemory returns an error if the available memory is under the minimum,
+// the memory is assumed fine when it cannot be read
+func (mg *memoryGuard) lowMemory() error {
+	if mg == nil {
+		return nil
+	}
+
+	avail, err := mg.available()
+	if err != nil {
+		log.Warnf("failed to read the available memory: %s", err)
+		return nil
+	}
+
+	if avail < mg.minFree {
+		return fmt.Errorf("%d bytes of memory available, under the minimum of %d", avail, mg.minFree)
+	}
+	return nil
+}
+
+// checkPin defers a pin while memory is low, the pin manager queues it again
+func (mg *memoryGuard) checkPin() error {
+	if err := mg.lowMemory(); err != nil {
+		mg.pinDeferrals.Inc()
+		return fmt.Errorf("%s: %w", err, pinner.ErrDeferred)
+	}
+	return nil
+}
+
+// checkCommp refuses a piece commitment computation while memory is low.
+// Nothing waits for memory to free up, estuary asks for the piece commitment
+// again the next time it checks the deals of the content.
+func (mg *memoryGuard) checkCommp() error {
+	if err := mg.lowMemory(); err != nil {
+		mg.commpDeferrals.Inc()
+		log.Warnf("deferring piece commitment computation: %s", err)
+		return fmt.Errorf("deferred piece commitment computation: %w", err)
+	}
+	return nil
+}
+
+// availableMemory reads the memory available to new allocations without
+// swapping from /proc/meminfo
+func availableMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb << 10, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemAvailable in /proc/meminfo")
+}
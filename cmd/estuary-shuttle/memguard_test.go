@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/application-research/estuary/pinner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryGuard(t *testing.T) {
+	a := assert.New(t)
+
+	// disabled
+	var none *memoryGuard
+	a.NoError(none.checkPin())
+	a.NoError(none.checkCommp())
+	a.Nil(newMemoryGuard(context.Background(), 0))
+
+	var avail uint64 = 2 << 30
+	mg := newMemoryGuard(context.Background(), 1<<30)
+	mg.available = func() (uint64, error) { return avail, nil }
+	a.NoError(mg.checkPin())
+
+	avail = 512 << 20
+	err := mg.checkPin()
+	a.Error(err)
+	a.True(errors.Is(err, pinner.ErrDeferred))
+
+	// piece commitments fail right away rather than hold the command
+	a.Error(mg.checkCommp())
+
+	// unreadable memory does not block anything
+	mg.available = func() (uint64, error) { return 0, errors.New("no meminfo") }
+	a.NoError(mg.checkPin())
+	a.NoError(mg.checkCommp())
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ContentMetadata is a key-value pair describing a pin, e.g. the original
+// filename or mime type of its content
+type ContentMetadata struct {
+	ID    uint   `gorm:"primarykey"`
+	Pin   uint   `gorm:"uniqueIndex:idx_content_metadata_pin_key"`
+	Key   string `gorm:"uniqueIndex:idx_content_metadata_pin_key"`
+	Value string
+}
+
+// metadataFromQuery reads the metadata of an add request from its repeated
+// metadata query params, each of them a key:value pair
+func metadataFromQuery(c echo.Context) (map[string]string, error) {
+	params := c.QueryParams()["metadata"]
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	md := make(map[string]string, len(params))
+	for _, p := range params {
+		k, v, ok := strings.Cut(p, ":")
+		if !ok || v == "" {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: fmt.Sprintf("metadata %q is not a key:value pair", p),
+			}
+		}
+		md[k] = v
+	}
+
+	if err := util.ValidateContentMetadata(md); err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+			Details: err.Error(),
+		}
+	}
+	return md, nil
+}
+
+// setPinMetadata sets the metadata of a pin, an empty value removes its key
+// and replace removes the keys missing from md
+func setPinMetadata(db *gorm.DB, pin uint, md map[string]string, replace bool) error {
+	if err := util.ValidateContentMetadata(md); err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if replace {
+			if err := tx.Where("pin = ?", pin).Delete(ContentMetadata{}).Error; err != nil {
+				return err
+			}
+		}
+
+		for k, v := range md {
+			if v == "" {
+				if err := tx.Where("pin = ? and key = ?", pin, k).Delete(ContentMetadata{}).Error; err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "pin"}, {Name: "key"}},
+				DoUpdates: clause.AssignmentColumns([]string{"value"}),
+			}).Create(&ContentMetadata{
+				Pin:   pin,
+				Key:   k,
+				Value: v,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		var keys int64
+		if err := tx.Model(ContentMetadata{}).Where("pin = ?", pin).Count(&keys).Error; err != nil {
+			return err
+		}
+
+		if keys > util.MaxContentMetadataKeys {
+			return fmt.Errorf("pin would have %d metadata keys, at most %d are allowed", keys, util.MaxContentMetadataKeys)
+		}
+		return nil
+	})
+}
+
+func pinMetadata(db *gorm.DB, pin uint) (map[string]string, error) {
+	var rows []ContentMetadata
+	if err := db.Find(&rows, "pin = ?", pin).Error; err != nil {
+		return nil, err
+	}
+
+	md := make(map[string]string, len(rows))
+	for _, r := range rows {
+		md[r.Key] = r.Value
+	}
+	return md, nil
+}
+
+func (s *Shuttle) handleRpcSetContentMetadata(ctx context.Context, req *drpc.SetContentMetadata) error {
+	if req == nil {
+		return fmt.Errorf("set content metadata command is missing its params")
+	}
+
+	return s.sendContentMetadata(ctx, req.DBID, func(pin Pin) error {
+		if err := checkWritable(pin); err != nil {
+			return err
+		}
+		return setPinMetadata(s.DB, pin.ID, req.Metadata, req.Replace)
+	})
+}
+
+func (s *Shuttle) handleRpcGetContentMetadata(ctx context.Context, req *drpc.GetContentMetadata) error {
+	if req == nil {
+		return fmt.Errorf("get content metadata command is missing its params")
+	}
+
+	return s.sendContentMetadata(ctx, req.DBID, nil)
+}
+
+// sendContentMetadata answers with the metadata of the pin of a content once
+// update, if any, has run
+func (s *Shuttle) sendContentMetadata(ctx context.Context, contid uint, update func(Pin) error) error {
+	res := &drpc.ContentMetadata{
+		DBID: contid,
+	}
+
+	err := func() error {
+		var pin Pin
+		if err := s.DB.First(&pin, "content = ?", contid).Error; err != nil {
+			return err
+		}
+
+		if update != nil {
+			if err := update(pin); err != nil {
+				return err
+			}
+		}
+
+		md, err := pinMetadata(s.DB, pin.ID)
+		if err != nil {
+			return err
+		}
+		res.Metadata = md
+		return nil
+	}()
+	if err != nil {
+		log.Errorf("failed to handle metadata of content %d: %s", contid, err)
+		res.Error = err.Error()
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ContentMetadata,
+		Params: drpc.MsgParams{
+			ContentMetadata: res,
+		},
+	})
+}
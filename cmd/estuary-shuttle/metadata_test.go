@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetPinMetadata(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+
+	a.NoError(setPinMetadata(s.DB, 1, map[string]string{"filename": "a.txt", "mime": "text/plain"}, false))
+	a.NoError(setPinMetadata(s.DB, 1, map[string]string{"mime": "text/markdown", "filename": ""}, false))
+
+	md, err := pinMetadata(s.DB, 1)
+	a.NoError(err)
+	a.Equal(map[string]string{"mime": "text/markdown"}, md)
+
+	a.NoError(setPinMetadata(s.DB, 1, map[string]string{"tag": "x"}, true))
+	md, err = pinMetadata(s.DB, 1)
+	a.NoError(err)
+	a.Equal(map[string]string{"tag": "x"}, md)
+
+	a.Error(setPinMetadata(s.DB, 1, map[string]string{"bad key": "x"}, false))
+	a.Error(setPinMetadata(s.DB, 1, map[string]string{"big": strings.Repeat("x", util.MaxContentMetadataValueLength+1)}, false))
+
+	// the key limit holds across updates
+	for i := 1; i < util.MaxContentMetadataKeys; i++ {
+		a.NoError(setPinMetadata(s.DB, 1, map[string]string{fmt.Sprintf("k%d", i): "v"}, false))
+	}
+	a.Error(setPinMetadata(s.DB, 1, map[string]string{"one-too-many": "v"}, false))
+}
+
+func TestHandleRpcContentMetadata(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	a.NoError(s.DB.Create(&Pin{Content: 5, UserID: 1, Active: true}).Error)
+
+	a.NoError(s.handleRpcSetContentMetadata(ctx, &drpc.SetContentMetadata{DBID: 5, Metadata: map[string]string{"mime": "image/png"}}))
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_ContentMetadata, msg.Op)
+	a.Empty(msg.Params.ContentMetadata.Error)
+	a.Equal(map[string]string{"mime": "image/png"}, msg.Params.ContentMetadata.Metadata)
+
+	a.NoError(s.handleRpcGetContentMetadata(ctx, &drpc.GetContentMetadata{DBID: 6}))
+	msg = <-s.outgoing
+	a.NotEmpty(msg.Params.ContentMetadata.Error)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/sys/unix"
+)
+
+// offloadCandidateBatch is how many pins are looked at per query while
+// picking the content of an offload request
+const offloadCandidateBatch = 500
+
+// how often the retrievals of content served since the last time are
+// recorded, and how many roots are updated per query
+const (
+	retrievalFlushInterval = time.Minute
+	retrievalFlushBatch    = 500
+)
+
+// watchOffloadWatermark asks estuary to move content to other shuttles while
+// the blockstore disk is used over the high watermark, at most once per
+// cooldown
+func (s *Shuttle) watchOffloadWatermark(cfg config.Offload) {
+	var lastRequest time.Time
+	for {
+		usage, err := s.blockstoreDiskUsage()
+		if err != nil {
+			log.Errorf("failed to get blockstore disk usage: %s", err)
+		} else if usage >= cfg.HighWatermark && time.Since(lastRequest) >= cfg.Cooldown {
+			log.Warnf("blockstore disk usage of %.2f is over the high watermark of %.2f, requesting an offload", usage, cfg.HighWatermark)
+			if err := s.requestOffload(context.TODO(), usage, cfg.Size); err != nil {
+				log.Errorf("failed to request offload: %s", err)
+			} else {
+				lastRequest = time.Now()
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// blockstoreDiskUsage returns the fraction of the blockstore disk in use
+func (s *Shuttle) blockstoreDiskUsage() (float64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(s.Node.StorageDir, &st); err != nil {
+		return 0, err
+	}
+
+	if st.Blocks == 0 {
+		return 0, nil
+	}
+	return float64(st.Blocks-st.Bavail) / float64(st.Blocks), nil
+}
+
+func (s *Shuttle) requestOffload(ctx context.Context, usage float64, size int64) error {
+	pins, total, err := s.offloadCandidates(size)
+	if err != nil {
+		return err
+	}
+
+	if len(pins) == 0 {
+		return fmt.Errorf("no content can be offloaded")
+	}
+
+	req := &drpc.OffloadRequest{
+		DiskUsage: usage,
+		Size:      total,
+	}
+	for _, p := range pins {
+		req.Contents = append(req.Contents, p.Content)
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_OffloadRequest,
+		Params: drpc.MsgParams{
+			OffloadRequest: req,
+		},
+	})
+}
+
+// offloadCandidates picks the least recently retrieved pins adding up to at
+// least size bytes. Pins in use by an aggregate or a dag split are left out,
+// they cannot be moved on their own, as are read only pins which are never
+// pinned again.
+func (s *Shuttle) offloadCandidates(size int64) ([]Pin, int64, error) {
+	var picked []Pin
+	var total int64
+	for offset := 0; total < size; offset += offloadCandidateBatch {
+		var pins []Pin
+		if err := s.DB.Where("active and not pinning and not failed and not read_only and not aggregate and aggregated_in = 0 and not dag_split and split_from = 0").
+			Order("coalesce(last_retrieved, created_at) asc, id asc").
+			Offset(offset).
+			Limit(offloadCandidateBatch).
+			Find(&pins).Error; err != nil {
+			return nil, 0, err
+		}
+
+		for _, p := range pins {
+			if total >= size {
+				break
+			}
+			picked = append(picked, p)
+			total += p.Size
+		}
+
+		if len(pins) < offloadCandidateBatch {
+			break
+		}
+	}
+	return picked, total, nil
+}
+
+// markRetrieved notes that the content pinned with the given root was just
+// served, it is recorded with the next flush of the retrievals
+func (s *Shuttle) markRetrieved(root cid.Cid) {
+	s.retrievedLk.Lock()
+	defer s.retrievedLk.Unlock()
+	s.retrieved[root] = struct{}{}
+}
+
+// watchRetrievals records the retrievals of served content once per
+// interval, so a root is written at most once per interval however often it
+// is served
+func (s *Shuttle) watchRetrievals() {
+	for range time.Tick(retrievalFlushInterval) {
+		if err := s.flushRetrievals(); err != nil {
+			log.Errorf("failed to record retrievals: %s", err)
+		}
+	}
+}
+
+func (s *Shuttle) flushRetrievals() error {
+	s.retrievedLk.Lock()
+	retrieved := s.retrieved
+	s.retrieved = make(map[cid.Cid]struct{})
+	s.retrievedLk.Unlock()
+
+	if len(retrieved) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	roots := make([]util.DbCID, 0, len(retrieved))
+	for root := range retrieved {
+		roots = append(roots, util.DbCID{CID: root})
+	}
+
+	for len(roots) > 0 {
+		n := retrievalFlushBatch
+		if n > len(roots) {
+			n = len(roots)
+		}
+
+		if err := s.DB.Model(Pin{}).Where("cid in ? and active", roots[:n]).UpdateColumn("last_retrieved", now).Error; err != nil {
+			return fmt.Errorf("failed to record the retrieval of %d roots: %w", len(roots), err)
+		}
+		roots = roots[n:]
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffloadCandidates(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+	s.retrieved = make(map[cid.Cid]struct{})
+
+	now := time.Now()
+	root := blocks.NewBlock([]byte("retrieved")).Cid()
+	pins := []*Pin{
+		{Content: 1, Size: 100, Active: true, CreatedAt: now.Add(-3 * time.Hour)},
+		{Content: 2, Size: 100, Active: true, CreatedAt: now.Add(-4 * time.Hour), Cid: util.DbCID{CID: root}},
+		{Content: 3, Size: 100, Active: true, CreatedAt: now.Add(-2 * time.Hour)},
+		{Content: 4, Size: 100, Active: true, CreatedAt: now.Add(-5 * time.Hour), AggregatedIn: 9},
+		{Content: 5, Size: 100, Active: true, CreatedAt: now.Add(-5 * time.Hour), ReadOnly: true},
+		{Content: 6, Size: 100, Pinning: true, CreatedAt: now.Add(-5 * time.Hour)},
+	}
+	for _, p := range pins {
+		a.NoError(s.DB.Create(p).Error)
+	}
+
+	// the oldest pin was just served, it goes last once recorded
+	s.markRetrieved(root)
+	s.markRetrieved(root)
+	a.Len(s.retrieved, 1)
+	a.NoError(s.flushRetrievals())
+	a.Empty(s.retrieved)
+
+	picked, total, err := s.offloadCandidates(150)
+	a.NoError(err)
+	a.Equal(int64(200), total)
+	if a.Len(picked, 2) {
+		a.Equal(uint(1), picked[0].Content)
+		a.Equal(uint(3), picked[1].Content)
+	}
+
+	picked, total, err = s.offloadCandidates(1000)
+	a.NoError(err)
+	a.Equal(int64(300), total)
+	if a.Len(picked, 3) {
+		a.Equal(uint(2), picked[2].Content)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+)
+
+// how many orphaned objects are loaded at once by garbage collection
+const orphanedObjectsBatchSize = 1000
+
+// clearOrphanedObjects deletes the objects no pin references anymore. Unpin
+// leaves them behind when its cleanup is disabled, or when they were in
+// flight at the time.
+func (s *Shuttle) clearOrphanedObjects(ctx context.Context) (int, error) {
+	unreferenced := s.DB.Model(ObjRef{}).Select("1").Where("obj_refs.object = objects.id")
+
+	var lastID uint
+	var total int
+	for {
+		var objs []*Object
+		if err := s.DB.Where("id > ? and not exists (?)", lastID, unreferenced).
+			Order("id").
+			Limit(orphanedObjectsBatchSize).
+			Find(&objs).Error; err != nil {
+			return total, err
+		}
+
+		if len(objs) == 0 {
+			return total, nil
+		}
+		lastID = objs[len(objs)-1].ID
+
+		if err := s.clearUnreferencedObjects(ctx, objs); err != nil {
+			return total, err
+		}
+		total += len(objs)
+	}
+}
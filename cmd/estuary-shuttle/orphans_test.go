@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnpinWithoutCleanup(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.unpinInProgress = make(map[uint]bool)
+	s.inflightCids = make(map[cid.Cid]uint)
+	s.config().NoUnpinCleanup = true
+
+	shared := blocks.NewBlock([]byte("shared block"))
+	only := blocks.NewBlock([]byte("unpinned block"))
+	a.NoError(s.Node.Blockstore.PutMany(ctx, []blocks.Block{shared, only}))
+
+	sharedObj := &Object{Cid: util.DbCID{CID: shared.Cid()}}
+	onlyObj := &Object{Cid: util.DbCID{CID: only.Cid()}}
+	a.NoError(s.DB.Create(sharedObj).Error)
+	a.NoError(s.DB.Create(onlyObj).Error)
+
+	unpinned := &Pin{Content: 1, Cid: util.DbCID{CID: only.Cid()}, Active: true}
+	kept := &Pin{Content: 2, Cid: util.DbCID{CID: shared.Cid()}, Active: true}
+	a.NoError(s.DB.Create(unpinned).Error)
+	a.NoError(s.DB.Create(kept).Error)
+	a.NoError(s.DB.Create(&[]ObjRef{
+		{Pin: unpinned.ID, Object: sharedObj.ID},
+		{Pin: unpinned.ID, Object: onlyObj.ID},
+		{Pin: kept.ID, Object: sharedObj.ID},
+	}).Error)
+
+	a.NoError(s.Unpin(ctx, 1))
+
+	// the orphaned object and its block are left behind
+	var objects int64
+	a.NoError(s.DB.Model(Object{}).Count(&objects).Error)
+	a.Equal(int64(2), objects)
+
+	cleared, err := s.clearOrphanedObjects(ctx)
+	a.NoError(err)
+	a.Equal(1, cleared)
+
+	var left []Object
+	a.NoError(s.DB.Find(&left).Error)
+	a.Len(left, 1)
+	a.Equal(shared.Cid(), left[0].Cid.CID)
+}
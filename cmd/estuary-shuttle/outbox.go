@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"gorm.io/gorm"
+)
+
+// messages estuary must not miss, they are kept in the outbox until acked
+var durableOps = map[string]bool{
+	drpc.OP_PinComplete:       true,
+	drpc.OP_PinCompleteChunk:  true,
+	drpc.OP_CommPComplete:     true,
+	drpc.OP_TransferStatus:    true,
+	drpc.OP_TransferStarted:   true,
+	drpc.OP_TransferFinished:  true,
+	drpc.OP_SplitComplete:     true,
+	drpc.OP_AggregateComplete: true,
+	drpc.OP_DealExpiring:      true,
+}
+
+// unacked messages older than this are dropped instead of being replayed,
+// e.g. when talking to an estuary that does not send acks
+const outboxMaxAge = time.Hour * 24
+
+// messages larger than this are sent without being kept in the outbox, pin
+// completes are chunked to stay under it
+const outboxMaxMessageSize = 16 << 20
+
+// OutgoingMessage is a durable message waiting to be acked by estuary
+type OutgoingMessage struct {
+	ID        uint64 `gorm:"primarykey"`
+	CreatedAt time.Time
+	Op        string
+	Data      []byte
+
+	// Resends is the number of times the message was sent again
+	Resends int
+}
+
+// rpcOutbox persists outgoing messages before they are sent so that the ones
+// lost with a dropped connection can be replayed once we reconnect
+type rpcOutbox struct {
+	db *gorm.DB
+
+	// messages resent this many times are dropped, 0 keeps them until they
+	// expire
+	maxResends int
+}
+
+// add stores the message and sets its ID, estuary acks that ID once the
+// message is processed
+func (ob *rpcOutbox) add(msg *drpc.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > outboxMaxMessageSize {
+		return fmt.Errorf("message of %d bytes is over the outbox limit of %d", len(data), outboxMaxMessageSize)
+	}
+
+	om := &OutgoingMessage{
+		Op:   msg.Op,
+		Data: data,
+	}
+	if err := ob.db.Create(om).Error; err != nil {
+		return err
+	}
+
+	msg.ID = om.ID
+	return nil
+}
+
+func (ob *rpcOutbox) ack(ids []uint64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return ob.db.Where("id in ?", ids).Delete(&OutgoingMessage{}).Error
+}
+
+// has reports whether a message is still waiting to be acked
+func (ob *rpcOutbox) has(id uint64) (bool, error) {
+	var n int64
+	if err := ob.db.Model(&OutgoingMessage{}).Where("id = ?", id).Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// resending records that a message is being sent again
+func (ob *rpcOutbox) resending(id uint64) error {
+	return ob.db.Model(&OutgoingMessage{}).Where("id = ?", id).UpdateColumn("resends", gorm.Expr("resends + 1")).Error
+}
+
+// pending returns the messages not acked yet, oldest first
+func (ob *rpcOutbox) pending() ([]*drpc.Message, error) {
+	if err := ob.db.Where("created_at < ?", time.Now().Add(-outboxMaxAge)).Delete(&OutgoingMessage{}).Error; err != nil {
+		return nil, err
+	}
+
+	if ob.maxResends > 0 {
+		res := ob.db.Where("resends >= ?", ob.maxResends).Delete(&OutgoingMessage{})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+
+		if res.RowsAffected > 0 {
+			log.Errorf("dropped %d outgoing messages estuary did not acknowledge after %d resends", res.RowsAffected, ob.maxResends)
+		}
+	}
+
+	var oms []OutgoingMessage
+	if err := ob.db.Order("id asc").Find(&oms).Error; err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*drpc.Message, 0, len(oms))
+	for _, om := range oms {
+		var msg drpc.Message
+		if err := json.Unmarshal(om.Data, &msg); err != nil {
+			log.Errorf("dropping unreadable outgoing message %d (%s): %s", om.ID, om.Op, err)
+			if err := ob.ack([]uint64{om.ID}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		msg.ID = om.ID
+		msgs = append(msgs, &msg)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// newTestEstuaryConn returns a websocket connected to a fake estuary that
+// forwards every message it receives on the returned channel
+func newTestEstuaryConn(t *testing.T) (*websocket.Conn, chan *drpc.Message) {
+	received := make(chan *drpc.Message, 16)
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		for {
+			var msg drpc.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			received <- &msg
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, received
+}
+
+func sendTestPinComplete(t *testing.T, s *Shuttle, cont uint) {
+	if err := s.sendRpcMessage(context.Background(), &drpc.Message{
+		Op: drpc.OP_PinComplete,
+		Params: drpc.MsgParams{
+			PinComplete: &drpc.PinComplete{DBID: cont},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxReplayAfterReconnect(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+
+	for cont := uint(1); cont <= 3; cont++ {
+		sendTestPinComplete(t, s, cont)
+	}
+	a.NoError(s.sendRpcMessage(context.Background(), &drpc.Message{
+		Op: drpc.OP_QueueStats,
+		Params: drpc.MsgParams{
+			QueueStats: &drpc.QueueStats{},
+		},
+	}))
+
+	// the first connection drops right after sending the first message,
+	// before estuary got to ack anything
+	first := <-s.outgoing
+	a.Equal(uint(1), first.Params.PinComplete.DBID)
+	a.NotZero(first.ID)
+
+	conn, received := newTestEstuaryConn(t)
+	replayed, err := s.replayOutbox(conn)
+	a.NoError(err)
+	a.Len(replayed, 3)
+
+	for cont := uint(1); cont <= 3; cont++ {
+		select {
+		case msg := <-received:
+			a.Equal(drpc.OP_PinComplete, msg.Op)
+			a.Equal(cont, msg.Params.PinComplete.DBID)
+			a.True(replayed[msg.ID])
+		case <-time.After(time.Second * 5):
+			t.Fatalf("pin complete for content %d was not replayed", cont)
+		}
+	}
+
+	// messages still queued from before the reconnect were replayed already,
+	// the non durable one was never persisted
+	for len(s.outgoing) > 0 {
+		msg := <-s.outgoing
+		if msg.Op == drpc.OP_QueueStats {
+			a.Zero(msg.ID)
+		} else {
+			a.True(replayed[msg.ID])
+		}
+	}
+
+	// estuary acks the first two, only the last one is left to replay
+	a.NoError(s.handleRpcCmd(&drpc.Command{
+		Op: drpc.CMD_Ack,
+		Params: drpc.CmdParams{
+			Ack: &drpc.Ack{IDs: []uint64{first.ID, first.ID + 1}},
+		},
+	}))
+
+	pending, err := s.outbox.pending()
+	a.NoError(err)
+	if a.Len(pending, 1) {
+		a.Equal(uint(3), pending[0].Params.PinComplete.DBID)
+	}
+}
+
+func TestOutboxDropsExpiredMessages(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+
+	sendTestPinComplete(t, s, 1)
+	a.NoError(s.DB.Model(&OutgoingMessage{}).Where("1 = 1").Update("created_at", time.Now().Add(-outboxMaxAge*2)).Error)
+
+	pending, err := s.outbox.pending()
+	a.NoError(err)
+	a.Len(pending, 0)
+}
+
+func TestOutboxDropsMessagesAfterMaxResends(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+	s.outbox.maxResends = 2
+
+	sendTestPinComplete(t, s, 1)
+	msg := <-s.outgoing
+
+	a.NoError(s.outbox.resending(msg.ID))
+	pending, err := s.outbox.pending()
+	a.NoError(err)
+	a.Len(pending, 1)
+
+	a.NoError(s.outbox.resending(msg.ID))
+	pending, err = s.outbox.pending()
+	a.NoError(err)
+	a.Len(pending, 0)
+}
+
+func TestOutboxSkipsOversizedMessages(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+
+	msg := &drpc.Message{
+		Op: drpc.OP_SplitComplete,
+		Params: drpc.MsgParams{
+			SplitComplete: &drpc.SplitComplete{ID: 1},
+		},
+	}
+	a.NoError(s.outbox.add(msg))
+	a.NotZero(msg.ID)
+
+	// too large to keep, it is still sent
+	big := &drpc.Message{
+		Op: drpc.OP_GoroutineDump,
+		Params: drpc.MsgParams{
+			GoroutineDump: &drpc.GoroutineDump{Data: strings.Repeat("x", outboxMaxMessageSize)},
+		},
+	}
+	a.Error(s.outbox.add(big))
+	a.Zero(big.ID)
+
+	pending, err := s.outbox.pending()
+	a.NoError(err)
+	a.Len(pending, 1)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"gorm.io/gorm/clause"
+)
+
+// PausedUser is a user whose queued pins are held and uploads refused, kept
+// so the pause outlives a restart of the shuttle
+type PausedUser struct {
+	UserID   uint `gorm:"primarykey"`
+	Reason   string
+	PausedAt time.Time
+}
+
+func (s *Shuttle) handleRpcPauseUser(ctx context.Context, req *drpc.PauseUser) error {
+	if req == nil {
+		return fmt.Errorf("pause user command is missing its params")
+	}
+
+	if req.UserID == 0 {
+		// the queue of user 0 also holds the pins skipping the per user limit
+		return fmt.Errorf("user 0 cannot be paused")
+	}
+
+	if err := s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason"}),
+	}).Create(&PausedUser{
+		UserID:   req.UserID,
+		Reason:   req.Reason,
+		PausedAt: time.Now(),
+	}).Error; err != nil {
+		return fmt.Errorf("failed to save pause of user %d: %w", req.UserID, err)
+	}
+
+	log.Infof("pausing user %d: %s", req.UserID, req.Reason)
+	s.PinMgr.PauseUser(req.UserID)
+
+	return s.handleRpcQueueStats(ctx, nil)
+}
+
+func (s *Shuttle) handleRpcResumeUser(ctx context.Context, req *drpc.ResumeUser) error {
+	if req == nil {
+		return fmt.Errorf("resume user command is missing its params")
+	}
+
+	if err := s.DB.Delete(&PausedUser{}, "user_id = ?", req.UserID).Error; err != nil {
+		return fmt.Errorf("failed to remove pause of user %d: %w", req.UserID, err)
+	}
+
+	log.Infof("resuming user %d", req.UserID)
+	s.PinMgr.ResumeUser(req.UserID)
+
+	return s.handleRpcQueueStats(ctx, nil)
+}
+
+// loadPausedUsers pauses again the users paused before the shuttle restarted
+func (s *Shuttle) loadPausedUsers() error {
+	var paused []PausedUser
+	if err := s.DB.Find(&paused).Error; err != nil {
+		return err
+	}
+
+	for _, p := range paused {
+		s.PinMgr.PauseUser(p.UserID)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPauseUser(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.PinMgr = pinner.NewPinManager(nil, nil, &pinner.PinManagerOpts{
+		MaxActivePerUser: 1,
+		QueueDataDir:     t.TempDir(),
+	})
+	s.retrievalLimit = newRetrievalLimiter(ctx, 1, false)
+
+	a.Error(s.handleRpcPauseUser(ctx, &drpc.PauseUser{UserID: 0}))
+
+	a.NoError(s.handleRpcPauseUser(ctx, &drpc.PauseUser{UserID: 2, Reason: "abuse"}))
+	a.True(s.PinMgr.UserPaused(2))
+	a.False(s.PinMgr.UserPaused(1))
+
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_QueueStats, msg.Op)
+	a.Equal([]uint{2}, msg.Params.QueueStats.PausedUsers)
+	a.Equal([]uint{2}, s.healthReport(ctx).PausedUsers)
+
+	// the pause outlives a restart
+	s.PinMgr = pinner.NewPinManager(nil, nil, &pinner.PinManagerOpts{
+		MaxActivePerUser: 1,
+		QueueDataDir:     t.TempDir(),
+	})
+	a.NoError(s.loadPausedUsers())
+	a.True(s.PinMgr.UserPaused(2))
+
+	a.NoError(s.handleRpcResumeUser(ctx, &drpc.ResumeUser{UserID: 2}))
+	a.False(s.PinMgr.UserPaused(2))
+
+	msg = <-s.outgoing
+	a.Empty(msg.Params.QueueStats.PausedUsers)
+
+	var paused int64
+	a.NoError(s.DB.Model(PausedUser{}).Count(&paused).Error)
+	a.Zero(paused)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// pieceQueryTimeout bounds the retrieval query of each miner of a piece
+const pieceQueryTimeout = 15 * time.Second
+
+// pieceLookupConcurrency bounds the deals of a piece read from chain and
+// queried at once
+const pieceLookupConcurrency = 8
+
+// pieceBackfillInterval is how often the pieces of the tracked deals not read
+// from chain yet are looked up
+const pieceBackfillInterval = 10 * time.Minute
+
+func (s *Shuttle) handleRpcGetPieceInfo(ctx context.Context, req *drpc.GetPieceInfo) error {
+	if req == nil {
+		return fmt.Errorf("get piece info command is missing its params")
+	}
+
+	info, err := s.pieceInfo(ctx, req.PieceCid, req.Query)
+	if err != nil {
+		info = &drpc.PieceInfo{
+			PieceCid: req.PieceCid,
+			Error:    err.Error(),
+		}
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_PieceInfo,
+		Params: drpc.MsgParams{
+			PieceInfo: info,
+		},
+	})
+}
+
+// pieceInfo looks up the active deals of a piece among the tracked deals of
+// that piece and the ones whose piece is not backfilled yet
+func (s *Shuttle) pieceInfo(ctx context.Context, piece cid.Cid, query bool) (*drpc.PieceInfo, error) {
+	if !piece.Defined() {
+		return nil, fmt.Errorf("no piece cid given")
+	}
+
+	tracked, err := s.trackedDealsOfPiece(piece)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := s.Api.ChainHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain head: %w", err)
+	}
+
+	var (
+		lk      sync.Mutex
+		wg      sync.WaitGroup
+		lookErr error
+	)
+	info := &drpc.PieceInfo{PieceCid: piece}
+	sem := make(chan struct{}, pieceLookupConcurrency)
+	for _, d := range tracked {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(d TrackedDeal) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			pd, ok, err := s.lookupPieceDeal(ctx, d, piece, head, query)
+
+			lk.Lock()
+			defer lk.Unlock()
+			if err != nil {
+				if lookErr == nil {
+					lookErr = err
+				}
+				return
+			}
+
+			if ok {
+				info.Content = d.Content
+				info.Deals = append(info.Deals, pd)
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	if lookErr != nil {
+		return nil, lookErr
+	}
+
+	sort.SliceStable(info.Deals, func(i, j int) bool {
+		return betterPieceDeal(info.Deals[i], info.Deals[j])
+	})
+
+	if info.Content == 0 {
+		return info, nil
+	}
+
+	var pin Pin
+	err = s.DB.First(&pin, "content = ?", info.Content).Error
+	switch {
+	case err == nil:
+		info.HotCopy = pin.Active
+	case !xerrors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	}
+	return info, nil
+}
+
+// trackedDealsOfPiece lists the tracked deals of a piece along with the ones
+// whose piece is not read from chain yet, stored empty or from before the
+// column existed
+func (s *Shuttle) trackedDealsOfPiece(piece cid.Cid) ([]TrackedDeal, error) {
+	var tracked []TrackedDeal
+	if err := s.DB.Where("piece_cid = ? or piece_cid = ? or piece_cid is null", util.DbCID{CID: piece}, util.DbCID{}).Find(&tracked).Error; err != nil {
+		return nil, err
+	}
+	return tracked, nil
+}
+
+// lookupPieceDeal reads a tracked deal from chain, ok is false unless it is
+// an active deal of the piece. With query the miner is asked for a retrieval
+// of the piece.
+func (s *Shuttle) lookupPieceDeal(ctx context.Context, d TrackedDeal, piece cid.Cid, head *types.TipSet, query bool) (drpc.PieceDeal, bool, error) {
+	md, err := s.Api.StateMarketStorageDeal(ctx, abi.DealID(d.DealID), head.Key())
+	if err != nil {
+		log.Warnf("failed to get deal %d of content %d from chain: %s", d.DealID, d.Content, err)
+		return drpc.PieceDeal{}, false, nil
+	}
+
+	if err := s.setTrackedPieceCid(&d, md.Proposal.PieceCID); err != nil {
+		return drpc.PieceDeal{}, false, err
+	}
+
+	if md.Proposal.PieceCID != piece || !isActiveDeal(md, head.Height()) {
+		return drpc.PieceDeal{}, false, nil
+	}
+
+	maddr, err := address.NewFromString(d.Miner)
+	if err != nil {
+		log.Warnf("tracked deal %d has an invalid miner %q: %s", d.DealID, d.Miner, err)
+		return drpc.PieceDeal{}, false, nil
+	}
+
+	if query {
+		label, err := md.Proposal.Label.ToString()
+		if err != nil {
+			return drpc.PieceDeal{}, false, fmt.Errorf("getting label of deal %d: %w", d.DealID, err)
+		}
+
+		root, err := util.ParseDealLabel(label)
+		if err != nil {
+			return drpc.PieceDeal{}, false, fmt.Errorf("failed to parse label of deal %d: %w", d.DealID, err)
+		}
+
+		qctx, cancel := context.WithTimeout(ctx, pieceQueryTimeout)
+		ask, err := s.Filc.RetrievalQuery(qctx, maddr, root)
+		cancel()
+		if err != nil {
+			log.Warnw("failed to query retrieval of piece", "miner", maddr, "piece", piece, "err", err)
+		}
+
+		if err := s.recordRetrievalAsk(d.Content, maddr, ask, err); err != nil {
+			return drpc.PieceDeal{}, false, err
+		}
+
+		if err := s.DB.First(&d, "id = ?", d.ID).Error; err != nil {
+			return drpc.PieceDeal{}, false, err
+		}
+	}
+
+	return drpc.PieceDeal{
+		Miner:    maddr,
+		DealID:   d.DealID,
+		EndEpoch: md.Proposal.EndEpoch,
+		Ask:      d.retrievalAsk(),
+	}, true, nil
+}
+
+// watchPieceCids reads the pieces of the tracked deals from chain in the
+// background, so looking up a piece only reads its own deals
+func (s *Shuttle) watchPieceCids() {
+	ticker := time.NewTicker(pieceBackfillInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.backfillPieceCids(context.TODO()); err != nil {
+			log.Errorf("failed to backfill the pieces of tracked deals: %s", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (s *Shuttle) backfillPieceCids(ctx context.Context) error {
+	var after uint
+	for {
+		var tracked []TrackedDeal
+		if err := s.DB.Where("id > ? and (piece_cid = ? or piece_cid is null)", after, util.DbCID{}).
+			Order("id asc").
+			Limit(replicationCheckBatchSize).
+			Find(&tracked).Error; err != nil {
+			return err
+		}
+
+		if len(tracked) == 0 {
+			return nil
+		}
+		after = tracked[len(tracked)-1].ID
+
+		head, err := s.Api.ChainHead(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get chain head: %w", err)
+		}
+
+		for _, d := range tracked {
+			md, err := s.Api.StateMarketStorageDeal(ctx, abi.DealID(d.DealID), head.Key())
+			if err != nil {
+				// not published yet or gone, tried again on the next run
+				log.Debugf("failed to get deal %d of content %d from chain: %s", d.DealID, d.Content, err)
+				continue
+			}
+
+			if err := s.setTrackedPieceCid(&d, md.Proposal.PieceCID); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// setTrackedPieceCid records the piece of a tracked deal the first time it is
+// read from chain
+func (s *Shuttle) setTrackedPieceCid(d *TrackedDeal, piece cid.Cid) error {
+	if d.PieceCid.CID.Defined() {
+		return nil
+	}
+
+	d.PieceCid = util.DbCID{CID: piece}
+	return s.DB.Model(&TrackedDeal{}).Where("id = ?", d.ID).UpdateColumn("piece_cid", d.PieceCid).Error
+}
+
+// recordRetrievalAsk keeps the outcome of a retrieval query on the tracked
+// deals of the content with the miner, a failed query is kept as an
+// unavailable ask
+func (s *Shuttle) recordRetrievalAsk(content uint, miner address.Address, ask *retrievalmarket.QueryResponse, qerr error) error {
+	cols := map[string]interface{}{
+		"ask_available":      false,
+		"ask_price_per_byte": "",
+		"ask_unseal_price":   "",
+		"ask_message":        "",
+		"asked_at":           time.Now(),
+	}
+
+	switch {
+	case qerr != nil:
+		cols["ask_message"] = qerr.Error()
+	case ask != nil:
+		cols["ask_available"] = ask.Status == retrievalmarket.QueryResponseAvailable
+		cols["ask_price_per_byte"] = ask.MinPricePerByte.String()
+		cols["ask_unseal_price"] = ask.UnsealPrice.String()
+		cols["ask_message"] = ask.Message
+	}
+
+	return s.DB.Model(&TrackedDeal{}).Where("content = ? and miner = ?", content, miner.String()).UpdateColumns(cols).Error
+}
+
+func (d TrackedDeal) retrievalAsk() *drpc.RetrievalAsk {
+	if d.AskedAt.IsZero() {
+		return nil
+	}
+
+	return &drpc.RetrievalAsk{
+		Available:    d.AskAvailable,
+		PricePerByte: parseTokenAmount(d.AskPricePerByte),
+		UnsealPrice:  parseTokenAmount(d.AskUnsealPrice),
+		Message:      d.AskMessage,
+		QueriedAt:    d.AskedAt,
+	}
+}
+
+func parseTokenAmount(s string) abi.TokenAmount {
+	amt, err := big.FromString(s)
+	if err != nil {
+		return big.Zero()
+	}
+	return amt
+}
+
+// betterPieceDeal orders the miners ready to serve a piece first, cheapest to
+// unseal and then cheapest per byte, then the ones never asked and then the
+// ones that could not serve it
+func betterPieceDeal(a, b drpc.PieceDeal) bool {
+	rank := func(d drpc.PieceDeal) int {
+		switch {
+		case d.Ask == nil:
+			return 1
+		case d.Ask.Available:
+			return 0
+		default:
+			return 2
+		}
+	}
+
+	ra, rb := rank(a), rank(b)
+	if ra != rb || ra != 0 {
+		return ra < rb
+	}
+
+	if !a.Ask.UnsealPrice.Equals(b.Ask.UnsealPrice) {
+		return a.Ask.UnsealPrice.LessThan(b.Ask.UnsealPrice)
+	}
+	return a.Ask.PricePerByte.LessThan(b.Ask.PricePerByte)
+}
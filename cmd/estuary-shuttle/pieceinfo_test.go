@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/big"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrievalAsks(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+
+	m1, _ := address.NewIDAddress(1000)
+	m2, _ := address.NewIDAddress(1001)
+	for _, d := range []TrackedDeal{
+		{Content: 1, Miner: m1.String(), DealID: 10},
+		{Content: 1, Miner: m2.String(), DealID: 11},
+	} {
+		a.NoError(s.DB.Create(&d).Error)
+	}
+
+	a.NoError(s.recordRetrievalAsk(1, m1, &retrievalmarket.QueryResponse{
+		Status:          retrievalmarket.QueryResponseAvailable,
+		MinPricePerByte: big.NewInt(2),
+		UnsealPrice:     big.NewInt(100),
+	}, nil))
+	a.NoError(s.recordRetrievalAsk(1, m2, nil, errors.New("no route")))
+
+	var deals []TrackedDeal
+	a.NoError(s.DB.Order("deal_id asc").Find(&deals).Error)
+	if !a.Len(deals, 2) {
+		return
+	}
+
+	ask := deals[0].retrievalAsk()
+	if a.NotNil(ask) {
+		a.True(ask.Available)
+		a.Equal(big.NewInt(2), ask.PricePerByte)
+		a.Equal(big.NewInt(100), ask.UnsealPrice)
+	}
+
+	ask = deals[1].retrievalAsk()
+	if a.NotNil(ask) {
+		a.False(ask.Available)
+		a.Equal("no route", ask.Message)
+	}
+
+	a.Nil(TrackedDeal{}.retrievalAsk())
+}
+
+func TestPieceDealOrder(t *testing.T) {
+	a := assert.New(t)
+
+	ready := func(id int64, unseal, price int64) drpc.PieceDeal {
+		return drpc.PieceDeal{DealID: id, Ask: &drpc.RetrievalAsk{
+			Available:    true,
+			UnsealPrice:  big.NewInt(unseal),
+			PricePerByte: big.NewInt(price),
+		}}
+	}
+
+	deals := []drpc.PieceDeal{
+		{DealID: 1, Ask: &drpc.RetrievalAsk{UnsealPrice: big.Zero(), PricePerByte: big.Zero()}},
+		{DealID: 2},
+		ready(3, 100, 1),
+		ready(4, 0, 5),
+		ready(5, 0, 1),
+	}
+	sort.SliceStable(deals, func(i, j int) bool {
+		return betterPieceDeal(deals[i], deals[j])
+	})
+
+	var order []int64
+	for _, d := range deals {
+		order = append(order, d.DealID)
+	}
+	a.Equal([]int64{5, 4, 3, 2, 1}, order)
+}
+
+func TestTrackedDealsOfPiece(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+
+	piece := blocks.NewBlock([]byte("piece")).Cid()
+	other := blocks.NewBlock([]byte("other piece")).Cid()
+	for _, d := range []TrackedDeal{
+		{Content: 1, DealID: 10, PieceCid: util.DbCID{CID: piece}},
+		{Content: 2, DealID: 11, PieceCid: util.DbCID{CID: other}},
+		{Content: 3, DealID: 12},
+	} {
+		a.NoError(s.DB.Create(&d).Error)
+	}
+	a.NoError(s.DB.Exec("update tracked_deals set piece_cid = null where deal_id = ?", 12).Error)
+	a.NoError(s.DB.Create(&TrackedDeal{Content: 4, DealID: 13}).Error)
+
+	tracked, err := s.trackedDealsOfPiece(piece)
+	a.NoError(err)
+
+	var ids []int64
+	for _, d := range tracked {
+		ids = append(ids, d.DealID)
+	}
+	a.ElementsMatch([]int64{10, 12, 13}, ids)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// pins read from the database at once when listing pins
+const pinListBatchSize = 500
+
+type pinListQuery struct {
+	user   uint
+	active *bool
+	failed *bool
+	// after is the id of the last pin of the previous page
+	after uint
+	// limit is the max number of pins listed, 0 lists them all
+	limit int
+}
+
+func parsePinListQuery(c echo.Context) (pinListQuery, error) {
+	var q pinListQuery
+
+	invalid := func(param string, err error) error {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+			Details: fmt.Sprintf("invalid %s: %s", param, err),
+		}
+	}
+
+	if v := c.QueryParam("user"); v != "" {
+		u, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return q, invalid("user", err)
+		}
+		q.user = uint(u)
+	}
+
+	for param, dst := range map[string]**bool{"active": &q.active, "failed": &q.failed} {
+		if v := c.QueryParam(param); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return q, invalid(param, err)
+			}
+			*dst = &b
+		}
+	}
+
+	if v := c.QueryParam("after"); v != "" {
+		after, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return q, invalid("after", err)
+		}
+		q.after = uint(after)
+	}
+
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return q, invalid("limit", fmt.Errorf("%q is not a positive number", v))
+		}
+		q.limit = limit
+	}
+	return q, nil
+}
+
+func (q pinListQuery) filter(db *gorm.DB) *gorm.DB {
+	if q.user != 0 {
+		db = db.Where("user_id = ?", q.user)
+	}
+
+	if q.active != nil {
+		db = db.Where("active = ?", *q.active)
+	}
+
+	if q.failed != nil {
+		db = db.Where("failed = ?", *q.failed)
+	}
+	return db
+}
+
+// pinListError ends a pin list that could not be read to the end, the
+// status is already sent by then
+type pinListError struct {
+	Error string `json:"error"`
+}
+
+// handleListPins streams the pins matching the user, active and failed query
+// params as NDJSON in id order. The next page starts after the id of the last
+// pin of the previous one, passed as the after query param. A list cut short
+// by an error ends with a pinListError line.
+func (s *Shuttle) handleListPins(c echo.Context) error {
+	q, err := parsePinListQuery(c)
+	if err != nil {
+		return err
+	}
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	resp.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(resp)
+	ctx := c.Request().Context()
+
+	cursor := q.after
+	listed := 0
+	for q.limit == 0 || listed < q.limit {
+		batch := pinListBatchSize
+		if q.limit > 0 && q.limit-listed < batch {
+			batch = q.limit - listed
+		}
+
+		var pins []Pin
+		if err := q.filter(s.DB.WithContext(ctx)).Where("id > ?", cursor).Order("id asc").Limit(batch).Find(&pins).Error; err != nil {
+			log.Errorf("failed to list pins after %d: %s", cursor, err)
+			return enc.Encode(pinListError{Error: fmt.Sprintf("failed to list pins after %d", cursor)})
+		}
+
+		for _, p := range pins {
+			if err := enc.Encode(p); err != nil {
+				return err
+			}
+		}
+		resp.Flush()
+
+		listed += len(pins)
+		if len(pins) < batch {
+			break
+		}
+		cursor = pins[len(pins)-1].ID
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listTestPins(t *testing.T, s *Shuttle, query string) []Pin {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/pins?"+query, nil)
+	require.NoError(t, s.handleListPins(echo.New().NewContext(req, rec)))
+
+	var pins []Pin
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		var p Pin
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &p))
+		pins = append(pins, p)
+	}
+	return pins
+}
+
+func TestListPins(t *testing.T) {
+	s := newTestShuttle(t)
+
+	for i := uint(1); i <= 5; i++ {
+		require.NoError(t, s.DB.Create(&Pin{Content: i, UserID: i % 2, Active: i != 3, Failed: i == 3}).Error)
+	}
+
+	assert.Len(t, listTestPins(t, s, ""), 5)
+	assert.Len(t, listTestPins(t, s, "user=1"), 3)
+	assert.Len(t, listTestPins(t, s, "active=true"), 4)
+
+	failed := listTestPins(t, s, "failed=true")
+	require.Len(t, failed, 1)
+	assert.Equal(t, uint(3), failed[0].Content)
+
+	// pages follow each other through the id of the last pin
+	page := listTestPins(t, s, "limit=2")
+	require.Len(t, page, 2)
+	next := listTestPins(t, s, "limit=2&after="+strconv.Itoa(int(page[1].ID)))
+	require.Len(t, next, 2)
+	assert.Equal(t, uint(3), next[0].Content)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/pins?active=maybe", nil)
+	assert.Error(t, s.handleListPins(echo.New().NewContext(req, rec)))
+}
+
+func TestListPinsError(t *testing.T) {
+	s := newTestShuttle(t)
+	require.NoError(t, s.DB.Create(&Pin{Content: 1}).Error)
+	require.NoError(t, s.DB.Migrator().DropTable(&Pin{}))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/pins", nil)
+	require.NoError(t, s.handleListPins(echo.New().NewContext(req, rec)))
+
+	// the status is sent before the pins are read, the last line tells the
+	// list is incomplete
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var perr pinListError
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &perr))
+	assert.Equal(t, "failed to list pins after 0", perr.Error)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+)
+
+func (s *Shuttle) handleRpcGetPinProgress(ctx context.Context, req *drpc.GetPinProgress) error {
+	if req == nil {
+		return fmt.Errorf("get pin progress command is missing its params")
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_PinProgress,
+		Params: drpc.MsgParams{
+			PinProgress: s.pinProgress(ctx, req.DBID),
+		},
+	})
+}
+
+func (s *Shuttle) pinProgress(ctx context.Context, contid uint) *drpc.PinProgress {
+	res := &drpc.PinProgress{
+		DBID: contid,
+	}
+
+	prog, ok := s.PinMgr.PinProgress(contid)
+	if !ok {
+		return res
+	}
+
+	res.Running = true
+	res.Started = prog.Started
+	res.BlocksFetched = prog.NumFetched
+	res.BytesFetched = prog.SizeFetched
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", contid).Error; err != nil {
+		log.Warnf("failed to get pin of content %d to estimate its size: %s", contid, err)
+		return res
+	}
+
+	res.EstimatedSize = util.EstimateDagSize(ctx, s.Node.Blockstore, pin.Cid.CID)
+	return res
+}
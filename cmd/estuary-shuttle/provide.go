@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// a batch of cids has this long per cid to be announced
+const provideTimeoutPerCid = time.Second
+
+// how often the pins whose provider records run out are looked for, and how
+// many of them are announced again at once
+const (
+	reprovideDueInterval  = time.Minute
+	reprovideDueBatchSize = 1000
+)
+
+// dht provider records expire after a day or two, content is announced again
+// at least this often whatever its ttl so it stays discoverable. It is the
+// republish interval of the dht.
+const maxReprovideInterval = time.Hour * 22
+
+// Provide queues a cid to be announced to the dht with the next batch, it
+// only blocks while all the batches allowed at once are being announced
+func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
+	select {
+	case s.provideQueue <- c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runProvideBatches collects the queued cids into batches, a batch is
+// announced once it is full or has waited for the flush interval
+func (s *Shuttle) runProvideBatches(cfg config.Provide) {
+	ticker := time.NewTicker(cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]cid.Cid, 0, cfg.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		s.provideSem <- struct{}{}
+		go func(cids []cid.Cid) {
+			defer func() {
+				<-s.provideSem
+			}()
+			s.provideBatch(cids)
+		}(batch)
+		batch = make([]cid.Cid, 0, cfg.BatchSize)
+	}
+
+	for {
+		select {
+		case c := <-s.provideQueue:
+			batch = append(batch, c)
+			if len(batch) >= cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// provideBatch announces a batch of cids right away, and hands them to the
+// reproviding system so they keep being announced
+func (s *Shuttle) provideBatch(cids []cid.Cid) {
+	ctx, cancel := context.WithTimeout(context.Background(), provideTimeoutPerCid*time.Duration(len(cids))+time.Second*15)
+	defer cancel()
+
+	if s.Node.FullRT.Ready() {
+		keys := make([]multihash.Multihash, 0, len(cids))
+		for _, c := range cids {
+			keys = append(keys, c.Hash())
+		}
+
+		if err := s.Node.FullRT.ProvideMany(ctx, keys); err != nil {
+			log.Warnf("failed to provide batch of %d cids: %s", len(cids), err)
+		}
+	} else {
+		log.Warnf("fullrt not in ready state, falling back to standard dht provide")
+		for _, c := range cids {
+			if err := s.Node.Dht.Provide(ctx, c, true); err != nil {
+				log.Warnf("fallback provide of %s failed: %s", c, err)
+			}
+		}
+	}
+
+	for _, c := range cids {
+		if err := s.Node.Provider.Provide(c); err != nil {
+			log.Warnf("providing failed: %s", err)
+		}
+	}
+	log.Debugf("provided batch of %d cids", len(cids))
+}
+
+// provideTTL returns how long the provider records of a pin last, 0 if they
+// are left to the periodic reprovide of all the content. A ttl only brings the
+// next announcement forward, it never lets the records expire.
+func (s *Shuttle) provideTTL(pin Pin) time.Duration {
+	ttl := pin.ProvideTTL
+	if ttl <= 0 {
+		ttl = s.config().Provide.DefaultTTL
+	}
+
+	if ttl > maxReprovideInterval {
+		ttl = maxReprovideInterval
+	}
+	return ttl
+}
+
+// unannounced pins are rejected while bitswap announces the blocks it fetches
+var errBitswapProvides = errors.New("shuttle announces the blocks it fetches, it cannot pin unannounced content")
+
+// bitswapProvides reports whether bitswap announces the blocks it fetches
+func (s *Shuttle) bitswapProvides() bool {
+	return s.Node.Config == nil || !s.Node.Config.Bitswap.NoProvide
+}
+
+// provideContent announces the root of a content and schedules announcing it
+// again once its provider records run out, unannounced content is left out
+func (s *Shuttle) provideContent(ctx context.Context, contid uint, root cid.Cid) error {
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", contid).Error; err != nil {
+		return err
+	}
+
+	if pin.Unannounced {
+		log.Debugf("not providing unannounced content %d", contid)
+		return nil
+	}
+
+	if err := s.Provide(ctx, root); err != nil {
+		return err
+	}
+	return s.scheduleReprovide(pin, time.Now())
+}
+
+func (s *Shuttle) scheduleReprovide(pin Pin, now time.Time) error {
+	var at *time.Time
+	if ttl := s.provideTTL(pin); ttl > 0 {
+		next := now.Add(ttl)
+		at = &next
+	}
+	return s.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumn("reprovide_at", at).Error
+}
+
+// runReprovideDue announces the pins whose provider records ran out again,
+// the pins without a ttl are reprovided by the reproviding system
+func (s *Shuttle) runReprovideDue() {
+	ticker := time.NewTicker(reprovideDueInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := s.reprovideDue(context.TODO(), time.Now())
+		if err != nil {
+			log.Errorf("failed to reprovide pins with expiring provider records: %s", err)
+			continue
+		}
+
+		if n > 0 {
+			log.Debugf("reprovided %d pins with expiring provider records", n)
+		}
+	}
+}
+
+func (s *Shuttle) reprovideDue(ctx context.Context, now time.Time) (int, error) {
+	var total int
+	for {
+		var pins []Pin
+		if err := s.DB.Where("active and reprovide_at <= ?", now).Limit(reprovideDueBatchSize).Find(&pins).Error; err != nil {
+			return total, err
+		}
+
+		for _, pin := range pins {
+			if err := s.Provide(ctx, pin.Cid.CID); err != nil {
+				return total, err
+			}
+
+			if err := s.scheduleReprovide(pin, now); err != nil {
+				return total, err
+			}
+		}
+		total += len(pins)
+
+		if len(pins) < reprovideDueBatchSize {
+			return total, nil
+		}
+	}
+}
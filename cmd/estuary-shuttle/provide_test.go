@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReprovideDue(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.provideQueue = make(chan cid.Cid, 10)
+	s.config().Provide.DefaultTTL = time.Hour * 6
+
+	archival := blocks.NewBlock([]byte("archival")).Cid()
+	staged := blocks.NewBlock([]byte("staged")).Cid()
+	a.NoError(s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: archival}, Active: true, ProvideTTL: time.Hour * 72}).Error)
+	a.NoError(s.DB.Create(&Pin{Content: 2, Cid: util.DbCID{CID: staged}, Active: true}).Error)
+
+	a.NoError(s.provideContent(ctx, 1, archival))
+	a.NoError(s.provideContent(ctx, 2, staged))
+	a.Equal(archival, <-s.provideQueue)
+	a.Equal(staged, <-s.provideQueue)
+
+	// only the pin on the default ttl is due after a few hours
+	n, err := s.reprovideDue(ctx, time.Now().Add(time.Hour*7))
+	a.NoError(err)
+	a.Equal(1, n)
+	a.Equal(staged, <-s.provideQueue)
+
+	// a ttl longer than the dht keeps provider records is capped
+	n, err = s.reprovideDue(ctx, time.Now().Add(maxReprovideInterval+time.Hour))
+	a.NoError(err)
+	a.Equal(2, n)
+
+	// without a default ttl, pins without a hint go back to the reproviding
+	// system
+	s.config().Provide.DefaultTTL = 0
+	a.NoError(s.provideContent(ctx, 2, staged))
+
+	var pin Pin
+	a.NoError(s.DB.First(&pin, "content = ?", 2).Error)
+	a.Nil(pin.ReprovideAt)
+}
+
+func TestUnannouncedPinNotProvided(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.provideQueue = make(chan cid.Cid, 10)
+	s.config().Provide.DefaultTTL = time.Hour
+
+	private := blocks.NewBlock([]byte("private")).Cid()
+	a.NoError(s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: private}, Active: true, Unannounced: true}).Error)
+
+	a.NoError(s.provideContent(ctx, 1, private))
+	a.Empty(s.provideQueue)
+
+	var pin Pin
+	a.NoError(s.DB.First(&pin, "content = ?", 1).Error)
+	a.Nil(pin.ReprovideAt)
+
+	n, err := s.reprovideDue(ctx, time.Now().Add(time.Hour*2))
+	a.NoError(err)
+	a.Zero(n)
+
+	// bitswap would announce the blocks fetched for a new one
+	a.NoError(s.handleRpcAddPin(ctx, &drpc.AddPin{DBID: 2, UserId: 1, Cid: private, Unannounced: true}))
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_PinRejected, msg.Op)
+	a.Equal(errBitswapProvides.Error(), msg.Params.PinRejected.Reason)
+}
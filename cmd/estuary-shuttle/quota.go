@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/drpc"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UserQuota caps the total size of the content a user can pin on this
+// shuttle, users without a quota are not limited
+type UserQuota struct {
+	UserID uint `gorm:"primarykey"`
+	Quota  int64
+}
+
+func (s *Shuttle) handleRpcSetUserQuota(ctx context.Context, req *drpc.SetUserQuota) error {
+	if req == nil {
+		return fmt.Errorf("set user quota command is missing its params")
+	}
+
+	if req.Quota <= 0 {
+		return s.DB.Delete(&UserQuota{}, "user_id = ?", req.UserID).Error
+	}
+
+	return s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"quota"}),
+	}).Create(&UserQuota{
+		UserID: req.UserID,
+		Quota:  req.Quota,
+	}).Error
+}
+
+func (s *Shuttle) handleRpcReassignPin(ctx context.Context, req *drpc.ReassignPin) error {
+	if req == nil {
+		return fmt.Errorf("reassign pin command is missing its params")
+	}
+
+	res := &drpc.PinReassigned{
+		DBID:   req.DBID,
+		UserID: req.UserID,
+	}
+
+	if err := s.reassignPin(req.DBID, req.UserID); err != nil {
+		log.Errorf("failed to reassign pin of content %d to user %d: %s", req.DBID, req.UserID, err)
+		res.Error = err.Error()
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_PinReassigned,
+		Params: drpc.MsgParams{
+			PinReassigned: res,
+		},
+	})
+}
+
+// reassignPin moves a pin and the pins split from it to another user, the
+// quota usage of users is summed from their pins so it moves along. Pins
+// still queued are refused as the pin queue is kept per user.
+func (s *Shuttle) reassignPin(contid uint, user uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var pin Pin
+		if err := tx.First(&pin, "content = ?", contid).Error; err != nil {
+			return err
+		}
+
+		var pinning int64
+		if err := tx.Model(Pin{}).Where("(id = ? or split_from = ?) and pinning", pin.ID, contid).Count(&pinning).Error; err != nil {
+			return err
+		}
+
+		if pinning > 0 {
+			return fmt.Errorf("content %d is still being pinned", contid)
+		}
+
+		return tx.Model(Pin{}).Where("id = ? or split_from = ?", pin.ID, contid).UpdateColumn("user_id", user).Error
+	})
+}
+
+// userQuotaExceeded checks whether pinning size more bytes would put the user
+// over their quota, users that reached their quota can't pin anything else
+func (s *Shuttle) userQuotaExceeded(user uint, size int64) (bool, error) {
+	u, err := s.userQuotaUsage(user)
+	if err != nil {
+		return false, err
+	}
+	return u.exceededBy(size), nil
+}
+
+// quotaUsage is how much of their quota a user uses, quota is 0 for users
+// without one
+type quotaUsage struct {
+	quota int64
+	used  int64
+}
+
+func (u quotaUsage) exceededBy(size int64) bool {
+	if u.quota == 0 {
+		return false
+	}
+	return u.used >= u.quota || u.used+size > u.quota
+}
+
+func (s *Shuttle) userQuotaUsage(user uint) (quotaUsage, error) {
+	var quotas []UserQuota
+	if err := s.DB.Find(&quotas, "user_id = ?", user).Error; err != nil {
+		return quotaUsage{}, err
+	}
+
+	if len(quotas) == 0 {
+		return quotaUsage{}, nil
+	}
+
+	var used int64
+	if err := s.DB.Model(Pin{}).
+		Where("user_id = ? and (active or pinning) and not failed", user).
+		Select("coalesce(sum(size), 0)").
+		Scan(&used).Error; err != nil {
+		return quotaUsage{}, err
+	}
+
+	return quotaUsage{quota: quotas[0].Quota, used: used}, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserQuota(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	a.NoError(s.DB.Create(&Pin{Content: 1, UserID: 1, Size: 600, Active: true}).Error)
+	a.NoError(s.DB.Create(&Pin{Content: 2, UserID: 1, Size: 5000, Failed: true}).Error)
+
+	// no quota set, nothing is limited
+	exceeded, err := s.userQuotaExceeded(1, 1<<40)
+	a.NoError(err)
+	a.False(exceeded)
+
+	a.NoError(s.handleRpcSetUserQuota(ctx, &drpc.SetUserQuota{UserID: 1, Quota: 1000}))
+
+	exceeded, err = s.userQuotaExceeded(1, 400)
+	a.NoError(err)
+	a.False(exceeded)
+
+	exceeded, err = s.userQuotaExceeded(1, 401)
+	a.NoError(err)
+	a.True(exceeded)
+
+	// other users are not affected
+	exceeded, err = s.userQuotaExceeded(2, 1<<40)
+	a.NoError(err)
+	a.False(exceeded)
+
+	// updating the quota replaces the previous one
+	a.NoError(s.handleRpcSetUserQuota(ctx, &drpc.SetUserQuota{UserID: 1, Quota: 600}))
+	exceeded, err = s.userQuotaExceeded(1, 0)
+	a.NoError(err)
+	a.True(exceeded)
+
+	a.NoError(s.handleRpcSetUserQuota(ctx, &drpc.SetUserQuota{UserID: 1}))
+	exceeded, err = s.userQuotaExceeded(1, 1<<40)
+	a.NoError(err)
+	a.False(exceeded)
+}
+
+func TestReassignPin(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	a.NoError(s.DB.Create(&Pin{Content: 1, UserID: 1, Size: 600, Active: true}).Error)
+	a.NoError(s.DB.Create(&Pin{Content: 2, UserID: 1, Size: 300, Active: true, SplitFrom: 1}).Error)
+	a.NoError(s.DB.Create(&Pin{Content: 3, UserID: 1, Size: 100, Pinning: true}).Error)
+	a.NoError(s.handleRpcSetUserQuota(ctx, &drpc.SetUserQuota{UserID: 2, Quota: 1000}))
+
+	a.NoError(s.handleRpcReassignPin(ctx, &drpc.ReassignPin{DBID: 1, UserID: 2}))
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_PinReassigned, msg.Op)
+	a.Empty(msg.Params.PinReassigned.Error)
+
+	var pins []Pin
+	a.NoError(s.DB.Order("content asc").Find(&pins).Error)
+	a.Equal(uint(2), pins[0].UserID)
+	a.Equal(uint(2), pins[1].UserID)
+	a.Equal(uint(1), pins[2].UserID)
+
+	// the usage moves along with the pins
+	exceeded, err := s.userQuotaExceeded(2, 100)
+	a.NoError(err)
+	a.False(exceeded)
+
+	exceeded, err = s.userQuotaExceeded(2, 101)
+	a.NoError(err)
+	a.True(exceeded)
+
+	// queued pins are refused
+	a.NoError(s.handleRpcReassignPin(ctx, &drpc.ReassignPin{DBID: 3, UserID: 2}))
+	msg = <-s.outgoing
+	a.NotEmpty(msg.Params.PinReassigned.Error)
+}
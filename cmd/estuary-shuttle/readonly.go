@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/application-research/estuary/drpc"
+)
+
+// errContentReadOnly is returned by the operations that would change a
+// read-only pin, verifying, exporting and retrieving it, or resending its
+// completion to estuary, are still allowed
+var errContentReadOnly = errors.New("content is read-only")
+
+func checkWritable(pin Pin) error {
+	if pin.ReadOnly {
+		return fmt.Errorf("content %d: %w", pin.Content, errContentReadOnly)
+	}
+	return nil
+}
+
+func (s *Shuttle) handleRpcSetReadOnly(ctx context.Context, req *drpc.SetReadOnly) error {
+	if req == nil {
+		return fmt.Errorf("set read only command is missing its params")
+	}
+
+	res := s.DB.Model(Pin{}).Where("content = ?", req.DBID).UpdateColumn("read_only", req.ReadOnly)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("no pin with content %d found to set read only", req.DBID)
+	}
+	return nil
+}
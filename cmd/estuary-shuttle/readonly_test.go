@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyPin(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.splitsInProgress = make(map[uint]bool)
+
+	root := blocks.NewBlock([]byte("read only")).Cid()
+	a.NoError(s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: root}, UserID: 1, Size: 100, Active: true}).Error)
+	a.Error(s.handleRpcSetReadOnly(ctx, &drpc.SetReadOnly{DBID: 2, ReadOnly: true}))
+	a.NoError(s.handleRpcSetReadOnly(ctx, &drpc.SetReadOnly{DBID: 1, ReadOnly: true}))
+
+	err := s.handleRpcSplitContent(ctx, &drpc.SplitContent{Content: 1, Size: 10})
+	a.True(errors.Is(err, errContentReadOnly))
+
+	// estuary can still have the pin complete of a finished pin sent again
+	a.NoError(s.addPin(ctx, 1, root, 1, addPinOpts{}))
+	select {
+	case msg := <-s.outgoing:
+		a.Equal(drpc.OP_PinComplete, msg.Op)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pin complete was not resent")
+	}
+
+	// and the completion of a split that is done already
+	a.NoError(s.DB.Create(&Pin{Content: 2, UserID: 1, Size: 100, Active: true, DagSplit: true, ReadOnly: true}).Error)
+	a.NoError(s.handleRpcSplitContent(ctx, &drpc.SplitContent{Content: 2, Size: 10}))
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_SplitComplete, msg.Op)
+
+	_, _, err = s.rechunkContent(ctx, &drpc.RechunkContent{DBID: 1})
+	a.True(errors.Is(err, errContentReadOnly))
+
+	_, err = s.aggregateMembers(&drpc.AggregateContent{DBID: 3, Contents: []uint{1}}, false)
+	a.True(errors.Is(err, errContentReadOnly))
+
+	a.NoError(s.handleRpcSetReadOnly(ctx, &drpc.SetReadOnly{DBID: 1}))
+	members, err := s.aggregateMembers(&drpc.AggregateContent{DBID: 3, Contents: []uint{1}}, false)
+	a.NoError(err)
+	a.Len(members, 1)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/xerrors"
+)
+
+func (s *Shuttle) markStartRechunk(cont uint) bool {
+	s.rechunkLk.Lock()
+	defer s.rechunkLk.Unlock()
+
+	if s.rechunksInProgress[cont] {
+		return false
+	}
+
+	s.rechunksInProgress[cont] = true
+	return true
+}
+
+func (s *Shuttle) finishRechunk(cont uint) {
+	s.rechunkLk.Lock()
+	defer s.rechunkLk.Unlock()
+	delete(s.rechunksInProgress, cont)
+}
+
+func (s *Shuttle) handleRpcRechunkContent(ctx context.Context, req *drpc.RechunkContent) error {
+	if req == nil {
+		return fmt.Errorf("rechunk content command is missing its params")
+	}
+
+	if !s.markStartRechunk(req.DBID) {
+		return nil
+	}
+
+	go func() {
+		defer s.finishRechunk(req.DBID)
+
+		ctx := context.TODO()
+		res := &drpc.RechunkComplete{
+			DBID: req.DBID,
+		}
+
+		newCont, newRoot, err := s.rechunkContent(ctx, req)
+		if err != nil {
+			log.Errorf("failed to rechunk content %d: %s", req.DBID, err)
+			res.Error = err.Error()
+		} else {
+			res.NewDBID = newCont
+			res.NewCid = newRoot
+
+			if req.UnpinOld {
+				if err := s.Unpin(ctx, req.DBID); err != nil {
+					log.Errorf("failed to unpin rechunked content %d: %s", req.DBID, err)
+				} else {
+					res.UnpinOld = true
+				}
+			}
+		}
+
+		if err := s.sendRpcMessage(ctx, &drpc.Message{
+			Op: drpc.OP_RechunkComplete,
+			Params: drpc.MsgParams{
+				RechunkComplete: res,
+			},
+		}); err != nil {
+			log.Errorf("failed to send rechunk complete message: %s", err)
+		}
+	}()
+	return nil
+}
+
+// rechunkContent reads the file data of a pinned content back out of its DAG
+// and imports it again with the requested chunker, the new DAG is pinned as a
+// new content
+func (s *Shuttle) rechunkContent(ctx context.Context, req *drpc.RechunkContent) (uint, cid.Cid, error) {
+	ctx, span := s.Tracer.Start(ctx, "rechunkContent", trace.WithAttributes(
+		attribute.Int64("contID", int64(req.DBID)),
+		attribute.String("chunker", req.Chunker),
+	))
+	defer span.End()
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", req.DBID).Error; err != nil {
+		return 0, cid.Undef, xerrors.Errorf("no pin with content %d found for rechunk request: %w", req.DBID, err)
+	}
+
+	if !pin.Active {
+		return 0, cid.Undef, fmt.Errorf("content %d is not pinned", req.DBID)
+	}
+
+	if err := checkWritable(pin); err != nil {
+		return 0, cid.Undef, err
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	nd, err := dserv.Get(ctx, pin.Cid.CID)
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+
+	fi, err := uio.NewDagReader(ctx, nd, dserv)
+	if err != nil {
+		return 0, cid.Undef, fmt.Errorf("only files can be rechunked: %w", err)
+	}
+	defer fi.Close()
+
+	bsid, bs, err := s.StagingMgr.AllocNew()
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+
+	defer func() {
+		go func() {
+			if err := s.StagingMgr.CleanUp(bsid); err != nil {
+				log.Errorf("failed to clean up staging blockstore: %s", err)
+			}
+		}()
+	}()
+
+	sdserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+	newNd, err := util.ImportFileWithChunker(sdserv, fi, req.Chunker, req.RawLeaves)
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+
+	if newNd.Cid() == pin.Cid.CID {
+		return 0, cid.Undef, fmt.Errorf("rechunking content %d resulted in the same root %s", req.DBID, newNd.Cid())
+	}
+
+	contid, err := s.shuttleCreateContent(ctx, pin.UserID, newNd.Cid(), req.Name, "", 0)
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+
+	npin := &Pin{
+		Content: contid,
+		Cid:     util.DbCID{CID: newNd.Cid()},
+		UserID:  pin.UserID,
+		Active:  false,
+		Pinning: true,
+	}
+
+	if err := s.DB.Create(npin).Error; err != nil {
+		return 0, cid.Undef, err
+	}
+
+	totalSize, objects, err := s.addDatabaseTrackingToContent(ctx, contid, sdserv, bs, newNd.Cid(), func(int64) {})
+	if err != nil {
+		return 0, cid.Undef, xerrors.Errorf("encountered problem computing object references: %w", err)
+	}
+
+	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
+		return 0, cid.Undef, xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
+	}
+
+	s.sendPinCompleteMessage(ctx, contid, totalSize, objects)
+
+	if err := s.provideContent(ctx, contid, newNd.Cid()); err != nil {
+		log.Warnf("failed to provide: %+v", err)
+	}
+	return contid, newNd.Cid(), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/stagingbs"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRechunkTestShuttle returns a test shuttle whose estuary creates the
+// rechunked contents with the next ids after last
+func newRechunkTestShuttle(t *testing.T, last uint) (*Shuttle, chan util.ShuttleCreateContentBody) {
+	created := make(chan util.ShuttleCreateContentBody, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body util.ShuttleCreateContentBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		created <- body
+		_ = json.NewEncoder(w).Encode(&util.ContentCreateResponse{ID: last + uint(len(created))})
+	}))
+	t.Cleanup(srv.Close)
+
+	sbm, err := stagingbs.NewStagingBSMgr(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestShuttle(t)
+	s.dev = true
+	s.estuaryHost = strings.TrimPrefix(srv.URL, "http://")
+	s.StagingMgr = sbm
+	s.inflightCids = make(map[cid.Cid]uint)
+	s.provideQueue = make(chan cid.Cid, 16)
+	s.rechunksInProgress = make(map[uint]bool)
+	s.unpinInProgress = make(map[uint]bool)
+	return s, created
+}
+
+func readRechunkedFile(ctx context.Context, t *testing.T, s *Shuttle, root cid.Cid) []byte {
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	nd, err := dserv.Get(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := uio.NewDagReader(ctx, nd, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fi.Close()
+
+	data, err := io.ReadAll(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRechunkContent(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s, created := newRechunkTestShuttle(t, 1)
+
+	// poorly chunked into a block per 16 bytes
+	data := bytes.Repeat([]byte("rechunk me "), 100)
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	nd, err := util.ImportFileWithChunker(dserv, bytes.NewReader(data), "size-16", true)
+	a.NoError(err)
+	a.NoError(s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: nd.Cid()}, UserID: 7, Active: true}).Error)
+
+	newCont, newRoot, err := s.rechunkContent(ctx, &drpc.RechunkContent{DBID: 1, Name: "rechunked", Chunker: util.DefaultChunker, RawLeaves: true})
+	a.NoError(err)
+	a.Equal(uint(2), newCont)
+	a.NotEqual(nd.Cid(), newRoot)
+
+	// the new content belongs to the owner of the old one
+	body := <-created
+	a.Equal(newRoot.String(), body.Root)
+	a.Equal("rechunked", body.Name)
+	a.Equal(uint(7), body.User)
+
+	var npin Pin
+	a.NoError(s.DB.First(&npin, "content = ?", 2).Error)
+	a.Equal(newRoot, npin.Cid.CID)
+	a.Equal(uint(7), npin.UserID)
+
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_PinComplete, msg.Op)
+	a.Equal(newRoot, <-s.provideQueue)
+
+	// the same file data ends up in the main blockstore
+	a.Equal(data, readRechunkedFile(ctx, t, s, newRoot))
+
+	// the old content is left alone
+	var old Pin
+	a.NoError(s.DB.First(&old, "content = ?", 1).Error)
+	a.True(old.Active)
+}
+
+func TestRechunkContentErrors(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s, created := newRechunkTestShuttle(t, 10)
+
+	data := bytes.Repeat([]byte("x"), 100)
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	file, err := util.ImportFileWithChunker(dserv, bytes.NewReader(data), "size-16", true)
+	a.NoError(err)
+	dir := unixfs.EmptyDirNode()
+	a.NoError(dserv.Add(ctx, dir))
+
+	for _, p := range []*Pin{
+		{Content: 1, Cid: util.DbCID{CID: file.Cid()}, Active: true},
+		{Content: 2, Cid: util.DbCID{CID: file.Cid()}, Pinning: true},
+		{Content: 3, Cid: util.DbCID{CID: dir.Cid()}, Active: true},
+	} {
+		a.NoError(s.DB.Create(p).Error)
+	}
+
+	for _, tc := range []struct {
+		name string
+		req  *drpc.RechunkContent
+	}{
+		{name: "missing", req: &drpc.RechunkContent{DBID: 4, Chunker: util.DefaultChunker}},
+		{name: "not pinned", req: &drpc.RechunkContent{DBID: 2, Chunker: util.DefaultChunker}},
+		{name: "directory", req: &drpc.RechunkContent{DBID: 3, Chunker: util.DefaultChunker}},
+		{name: "bad chunker", req: &drpc.RechunkContent{DBID: 1, Chunker: "bogus"}},
+		{name: "same layout", req: &drpc.RechunkContent{DBID: 1, Chunker: "size-16", RawLeaves: true}},
+	} {
+		_, _, err := s.rechunkContent(ctx, tc.req)
+		a.Error(err, tc.name)
+	}
+
+	// nothing got created on estuary
+	a.Empty(created)
+
+	var pins int64
+	a.NoError(s.DB.Model(Pin{}).Count(&pins).Error)
+	a.Equal(int64(3), pins)
+}
+
+func TestHandleRpcRechunkContentUnpinOld(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s, _ := newRechunkTestShuttle(t, 1)
+	s.config().NoUnpinCleanup = true
+
+	data := bytes.Repeat([]byte("unpin the old one "), 100)
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	nd, err := util.ImportFileWithChunker(dserv, bytes.NewReader(data), "size-16", true)
+	a.NoError(err)
+	a.NoError(s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: nd.Cid()}, Active: true}).Error)
+
+	a.NoError(s.handleRpcRechunkContent(ctx, &drpc.RechunkContent{DBID: 1, Chunker: util.DefaultChunker, RawLeaves: true, UnpinOld: true}))
+
+	var res *drpc.RechunkComplete
+	for res == nil {
+		msg := <-s.outgoing
+		res = msg.Params.RechunkComplete
+	}
+	a.Empty(res.Error)
+	a.Equal(uint(1), res.DBID)
+	a.Equal(uint(2), res.NewDBID)
+	a.True(res.UnpinOld)
+	a.Equal(data, readRechunkedFile(ctx, t, s, res.NewCid))
+
+	var pins []Pin
+	a.NoError(s.DB.Find(&pins).Error)
+	if a.Len(pins, 1) {
+		a.Equal(uint(2), pins[0].Content)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/application-research/estuary/drpc"
+)
+
+func (s *Shuttle) handleRpcReconcilePins(ctx context.Context, req *drpc.ReconcilePins) error {
+	if req == nil {
+		return fmt.Errorf("reconcile pins command is missing its params")
+	}
+
+	res := s.reconcilePins(req)
+	if req.Last && res.Error == "" {
+		// estuary went through all of its contents, the next connections don't
+		// need to ask for them again
+		atomic.StoreInt32(&s.reconcilePending, 0)
+	}
+
+	if len(res.Missing) > 0 || len(res.Orphans) > 0 {
+		log.Warnw("pins diverged from estuary", "after", req.After, "upto", req.Upto, "last", req.Last,
+			"missing", len(res.Missing), "orphans", len(res.Orphans))
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ReconcileReport,
+		Params: drpc.MsgParams{
+			ReconcileReport: res,
+		},
+	})
+}
+
+// reconcilePins compares the contents of a batch estuary expects us to have
+// with our pins in the id range of the batch. Pins in any state count, a
+// failed pin is still ours until estuary unpins it.
+func (s *Shuttle) reconcilePins(req *drpc.ReconcilePins) *drpc.ReconcileReport {
+	res := &drpc.ReconcileReport{
+		After: req.After,
+		Upto:  req.Upto,
+		Last:  req.Last,
+	}
+
+	q := s.DB.Model(&Pin{}).Where("content > ?", req.After)
+	if !req.Last {
+		q = q.Where("content <= ?", req.Upto)
+	}
+
+	var local []uint
+	if err := q.Pluck("content", &local).Error; err != nil {
+		res.Error = fmt.Sprintf("failed to list pins: %s", err)
+		return res
+	}
+
+	pinned := make(map[uint]bool, len(local))
+	for _, c := range local {
+		pinned[c] = true
+	}
+
+	expected := make(map[uint]bool, len(req.Contents))
+	for _, c := range req.Contents {
+		expected[c] = true
+		if !pinned[c] {
+			res.Missing = append(res.Missing, c)
+		}
+	}
+
+	for c := range pinned {
+		if !expected[c] {
+			res.Orphans = append(res.Orphans, c)
+		}
+	}
+
+	sort.Slice(res.Missing, func(i, j int) bool { return res.Missing[i] < res.Missing[j] })
+	sort.Slice(res.Orphans, func(i, j int) bool { return res.Orphans[i] < res.Orphans[j] })
+	return res
+}
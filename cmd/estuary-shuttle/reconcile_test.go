@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcilePins(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.reconcilePending = 1
+
+	for _, p := range []*Pin{
+		{Content: 1, Active: true},
+		{Content: 2, Failed: true},
+		{Content: 4, Pinning: true},
+		{Content: 12, Active: true},
+	} {
+		a.NoError(s.DB.Create(p).Error)
+	}
+
+	res := s.reconcilePins(&drpc.ReconcilePins{After: 0, Upto: 5, Contents: []uint{1, 2, 3}})
+	a.Empty(res.Error)
+	a.Equal([]uint{3}, res.Missing)
+	a.Equal([]uint{4}, res.Orphans)
+
+	// the last batch covers every id after the previous one
+	a.NoError(s.handleRpcReconcilePins(ctx, &drpc.ReconcilePins{After: 5, Last: true, Contents: []uint{7}}))
+	a.Zero(s.reconcilePending)
+
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_ReconcileReport, msg.Op)
+	if a.NotNil(msg.Params.ReconcileReport) {
+		a.True(msg.Params.ReconcileReport.Last)
+		a.Equal([]uint{7}, msg.Params.ReconcileReport.Missing)
+		a.Equal([]uint{12}, msg.Params.ReconcileReport.Orphans)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+)
+
+// how long a forced reconnect waits for the queued messages to be sent
+const reconnectDrainTimeout = time.Second * 30
+
+func (s *Shuttle) handleRpcForceReconnect(ctx context.Context, req *drpc.ForceReconnect) error {
+	if req == nil {
+		return fmt.Errorf("force reconnect command is missing its params")
+	}
+
+	if req.Delay < 0 {
+		return fmt.Errorf("force reconnect delay must not be negative")
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "estuary asked for a reconnect"
+	}
+	log.Infof("reconnecting to estuary in %s: %s", req.Delay, reason)
+
+	// durable messages are replayed from the outbox, the others are only
+	// in the queue
+	if !s.drainOutgoing(reconnectDrainTimeout) {
+		log.Warnf("reconnecting with %d messages still queued", len(s.outgoing))
+	}
+
+	gb := &goodbyeReq{
+		msg: &drpc.Message{
+			Op: drpc.OP_Goodbye,
+			Params: drpc.MsgParams{
+				Goodbye: &drpc.Goodbye{
+					Reason: "reconnecting: " + reason,
+				},
+			},
+		},
+		sent:           make(chan struct{}),
+		reconnect:      true,
+		reconnectDelay: req.Delay,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reconnectDrainTimeout)
+	defer cancel()
+
+	select {
+	case s.goodbye <- gb:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out closing the rpc connection to reconnect")
+	}
+}
+
+// drainOutgoing waits for the queue of messages to estuary to be empty
+func (s *Shuttle) drainOutgoing(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for len(s.outgoing) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return true
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForceReconnect(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+	s.goodbye = make(chan *goodbyeReq, 1)
+
+	a.Error(s.handleRpcForceReconnect(context.Background(), &drpc.ForceReconnect{Delay: -time.Second}))
+
+	// the queued message is sent before the connection is closed
+	s.outgoing <- &drpc.Message{Op: drpc.OP_ShuttleUpdate}
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		<-s.outgoing
+	}()
+
+	a.NoError(s.handleRpcForceReconnect(context.Background(), &drpc.ForceReconnect{Delay: time.Second, Reason: "maintenance"}))
+	a.Empty(s.outgoing)
+
+	gb := <-s.goodbye
+	a.True(gb.reconnect)
+	a.Equal(time.Second, gb.reconnectDelay)
+	a.Equal(drpc.OP_Goodbye, gb.msg.Op)
+	a.Contains(gb.msg.Params.Goodbye.Reason, "maintenance")
+	a.False(gb.msg.Params.Goodbye.StayDown)
+}
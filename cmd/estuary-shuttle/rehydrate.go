@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+func (s *Shuttle) handleRpcRehydrateContent(ctx context.Context, req *drpc.RehydrateContent) error {
+	if req == nil {
+		return fmt.Errorf("rehydrate content command is missing its params")
+	}
+
+	err := s.withRetrievalSlot(ctx, req.Content, func() error {
+		return s.rehydrateContent(ctx, req)
+	})
+	if err != nil {
+		s.sendRehydrateProgress(ctx, req.Content, drpc.RehydrateFailed, "", err.Error())
+		return err
+	}
+	return nil
+}
+
+// rehydrateContent retrieves the blocks of a content missing from the
+// blockstore from one of its deals, then tracks the pin again so it is active.
+// Offloaded content was unpinned, its pin is created again like a retrieval
+// does.
+func (s *Shuttle) rehydrateContent(ctx context.Context, req *drpc.RehydrateContent) error {
+	ctx, span := s.Tracer.Start(ctx, "rehydrateContent", trace.WithAttributes(
+		attribute.Int("content", int(req.Content)),
+	))
+	defer span.End()
+
+	var pin Pin
+	err := s.DB.First(&pin, "content = ?", req.Content).Error
+	switch {
+	case xerrors.Is(err, gorm.ErrRecordNotFound):
+		if !req.Cid.Defined() {
+			return fmt.Errorf("content %d has no pin and no cid to rehydrate it from", req.Content)
+		}
+
+		pin = Pin{
+			Content: req.Content,
+			Cid:     util.DbCID{CID: req.Cid},
+			UserID:  req.UserID,
+			Active:  false,
+			Pinning: true,
+		}
+		if err := s.DB.Create(&pin).Error; err != nil {
+			return err
+		}
+	case err != nil:
+		return fmt.Errorf("failed to get pin of content %d: %w", req.Content, err)
+	}
+
+	s.sendRehydrateProgress(ctx, pin.Content, drpc.RehydrateVerifying, "", "")
+
+	missing, err := s.missingPinBlocks(ctx, pin)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) == 0 && pin.Active {
+		// nothing to get back, estuary may have lost track of the pin though
+		objects, err := s.objectsForPin(ctx, pin.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get objects for pin: %w", err)
+		}
+
+		s.sendPinCompleteMessage(ctx, pin.Content, pin.Size, objects)
+		s.sendRehydrateProgress(ctx, pin.Content, drpc.RehydrateComplete, "", "")
+		return nil
+	}
+
+	root := pin.Cid.CID
+	if len(missing) > 0 {
+		if len(req.Deals) == 0 {
+			return fmt.Errorf("content %d has no deals to retrieve it from", pin.Content)
+		}
+
+		release, err := s.retrievalLimit.acquire(ctx, pin.UserID)
+		if err != nil {
+			return err
+		}
+
+		err = s.retrieveFromDeals(ctx, pin.Content, root, req.Deals, nil, func(maddr address.Address) {
+			s.sendRehydrateProgress(ctx, pin.Content, drpc.RehydrateRetrieving, maddr.String(), "")
+		})
+		release()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.sendRehydrateProgress(ctx, pin.Content, drpc.RehydrateImporting, "", "")
+
+	// everything must be local now, do not go looking for blocks over bitswap
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	totalSize, objects, err := s.addDatabaseTrackingToContent(ctx, pin.Content, dserv, s.Node.Blockstore, root, func(int64) {})
+	if err != nil {
+		return fmt.Errorf("failed to track content %d after retrieval: %w", pin.Content, err)
+	}
+
+	s.sendPinCompleteMessage(ctx, pin.Content, totalSize, objects)
+
+	if err := s.provideContent(ctx, pin.Content, root); err != nil {
+		log.Warnf("failed to provide rehydrated content %d: %s", pin.Content, err)
+	}
+
+	s.sendRehydrateProgress(ctx, pin.Content, drpc.RehydrateComplete, "", "")
+	return nil
+}
+
+// missingPinBlocks returns the blocks of a pin that are gone from the
+// blockstore or corrupted, the corrupted ones are dropped so a retrieval
+// fetches them again. A pin without objects is only checked for its root.
+func (s *Shuttle) missingPinBlocks(ctx context.Context, pin Pin) ([]cid.Cid, error) {
+	objs, err := s.objectsForPin(ctx, pin.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := []cid.Cid{pin.Cid.CID}
+	for _, o := range objs {
+		if o.Cid.CID != pin.Cid.CID {
+			cids = append(cids, o.Cid.CID)
+		}
+	}
+
+	var missing []cid.Cid
+	for _, c := range cids {
+		ok, found, err := s.checkBlock(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if found && !ok {
+			if err := s.Node.Blockstore.DeleteBlock(ctx, c); err != nil {
+				return nil, fmt.Errorf("failed to delete corrupted block %s: %w", c, err)
+			}
+		}
+
+		if !ok {
+			missing = append(missing, c)
+		}
+	}
+	return missing, nil
+}
+
+func (s *Shuttle) sendRehydrateProgress(ctx context.Context, content uint, phase, miner, errMsg string) {
+	if err := s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_RehydrateProgress,
+		Params: drpc.MsgParams{
+			RehydrateProgress: &drpc.RehydrateProgress{
+				Content: content,
+				Phase:   phase,
+				Miner:   miner,
+				Error:   errMsg,
+			},
+		},
+	}); err != nil {
+		log.Errorf("failed to send rehydrate progress of content %d: %s", content, err)
+	}
+}
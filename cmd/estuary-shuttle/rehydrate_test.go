@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRehydrateContent(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.retrievalsInProgress = make(map[uint]*retrievalProgress)
+
+	blk := blocks.NewBlock([]byte("rehydrate"))
+	a.NoError(s.Node.Blockstore.Put(ctx, blk))
+	a.NoError(s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: blk.Cid()}, UserID: 1, Active: true}).Error)
+
+	// all blocks are still here, nothing has to be retrieved
+	a.NoError(s.handleRpcRehydrateContent(ctx, &drpc.RehydrateContent{Content: 1, Cid: blk.Cid()}))
+
+	var phases []string
+	for len(s.outgoing) > 0 {
+		msg := <-s.outgoing
+		if msg.Op == drpc.OP_RehydrateProgress {
+			phases = append(phases, msg.Params.RehydrateProgress.Phase)
+		}
+	}
+	a.Equal([]string{drpc.RehydrateVerifying, drpc.RehydrateComplete}, phases)
+
+	// evicted blocks cannot come back without deals
+	a.NoError(s.Node.Blockstore.DeleteBlock(ctx, blk.Cid()))
+	a.Error(s.handleRpcRehydrateContent(ctx, &drpc.RehydrateContent{Content: 1, Cid: blk.Cid()}))
+
+	var last *drpc.RehydrateProgress
+	for len(s.outgoing) > 0 {
+		msg := <-s.outgoing
+		if msg.Op == drpc.OP_RehydrateProgress {
+			last = msg.Params.RehydrateProgress
+		}
+	}
+	if a.NotNil(last) {
+		a.Equal(drpc.RehydrateFailed, last.Phase)
+		a.NotEmpty(last.Error)
+	}
+}
+
+func TestRehydrateOffloadedContent(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.retrievalsInProgress = make(map[uint]*retrievalProgress)
+	s.inflightCids = make(map[cid.Cid]uint)
+	s.provideQueue = make(chan cid.Cid, 16)
+
+	// offloading unpinned the content, its blocks were left behind
+	blk := blocks.NewBlock([]byte("offloaded"))
+	a.NoError(s.Node.Blockstore.Put(ctx, blk))
+
+	a.NoError(s.handleRpcRehydrateContent(ctx, &drpc.RehydrateContent{UserID: 2, Content: 3, Cid: blk.Cid()}))
+
+	var pin Pin
+	a.NoError(s.DB.First(&pin, "content = ?", 3).Error)
+	a.Equal(blk.Cid(), pin.Cid.CID)
+	a.Equal(uint(2), pin.UserID)
+
+	var phases []string
+	for len(s.outgoing) > 0 {
+		msg := <-s.outgoing
+		if msg.Op == drpc.OP_RehydrateProgress {
+			phases = append(phases, msg.Params.RehydrateProgress.Phase)
+		}
+	}
+	a.Equal([]string{drpc.RehydrateVerifying, drpc.RehydrateImporting, drpc.RehydrateComplete}, phases)
+}
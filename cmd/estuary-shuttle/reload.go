@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// config is the current config of the shuttle. A reload replaces it with an
+// updated copy and never changes the one returned, settings read from it once
+// keep their value until they're read again.
+func (s *Shuttle) config() *config.Shuttle {
+	s.shuttleConfigLk.RLock()
+	defer s.shuttleConfigLk.RUnlock()
+	return s.shuttleConfig
+}
+
+// reloadConfig reads the config again and applies the settings that can
+// change while the shuttle runs, see config.ShuttleHotReloadable. The other
+// settings that changed are only reported, they apply after a restart.
+func (s *Shuttle) reloadConfig() (*drpc.ConfigReloaded, error) {
+	s.reloadLk.Lock()
+	defer s.reloadLk.Unlock()
+
+	next, err := s.readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cur := s.config()
+	updated, applied, restart := config.ReloadShuttle(cur, next)
+
+	// most settings are read from the config on every use, only these are
+	// held by running parts of the shuttle
+	if !reflect.DeepEqual(updated.Logging.Levels, cur.Logging.Levels) {
+		applyLogLevels(updated.Logging.Levels)
+	}
+
+	if updated.Retrieval.Concurrency != cur.Retrieval.Concurrency {
+		s.retrievalLimit.setLimit(updated.Retrieval.Concurrency)
+	}
+
+	s.shuttleConfigLk.Lock()
+	s.shuttleConfig = updated
+	s.shuttleConfigLk.Unlock()
+
+	log.Infow("reloaded config", "applied", applied, "restartRequired", restart)
+	return &drpc.ConfigReloaded{
+		Applied:         applied,
+		RestartRequired: restart,
+	}, nil
+}
+
+func (s *Shuttle) handleRpcConfigReload(ctx context.Context, req *drpc.ConfigReload) error {
+	res, err := s.reloadConfig()
+	if err != nil {
+		log.Errorf("failed to reload config: %s", err)
+		res = &drpc.ConfigReloaded{Error: err.Error()}
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ConfigReloaded,
+		Params: drpc.MsgParams{
+			ConfigReloaded: res,
+		},
+	})
+}
+
+func checkLogLevels(levels map[string]string) error {
+	for subsystem, level := range levels {
+		if _, err := logging.LevelFromString(level); err != nil {
+			return fmt.Errorf("invalid log level %q for %s: %w", level, subsystem, err)
+		}
+	}
+	return nil
+}
+
+// applyLogLevels sets the configured log levels over the defaults, a
+// subsystem removed from the config keeps its level until a restart
+//
+//#nosec G104 - it's not common to treat SetLogLevel error return
+func applyLogLevels(levels map[string]string) {
+	for subsystem, level := range levels {
+		_ = logging.SetLogLevel(subsystem, level)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigReload(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.retrievalLimit = newRetrievalLimiter(ctx, 1, false)
+
+	release, err := s.retrievalLimit.acquire(ctx, 1)
+	a.NoError(err)
+	defer release()
+
+	waiting := make(chan struct{})
+	go func() {
+		done, err := s.retrievalLimit.acquire(ctx, 2)
+		if err != nil {
+			return
+		}
+		defer done()
+		close(waiting)
+	}()
+	a.Eventually(func() bool {
+		q, _ := s.retrievalLimit.stats()
+		return q == 1
+	}, time.Second, time.Millisecond)
+
+	s.readConfig = func() (*config.Shuttle, error) {
+		next := config.NewShuttle("test")
+		next.Retrieval.Concurrency = 2
+		next.OriginConnect.Retries = 5
+		next.MaxDagWalks = 1
+		return next, nil
+	}
+
+	a.NoError(s.handleRpcConfigReload(ctx, &drpc.ConfigReload{}))
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_ConfigReloaded, msg.Op)
+	a.ElementsMatch([]string{"retrieval.concurrency", "origin_connect.retries"}, msg.Params.ConfigReloaded.Applied)
+	a.Equal([]string{"max_dag_walks"}, msg.Params.ConfigReloaded.RestartRequired)
+	a.Equal(5, s.config().OriginConnect.Retries)
+	a.Equal(16, s.config().MaxDagWalks)
+
+	// the waiting retrieval starts under the new limit
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		t.Fatal("waiting retrieval did not start after the limit grew")
+	}
+
+	// a config that cannot be read changes nothing
+	s.readConfig = func() (*config.Shuttle, error) {
+		return nil, errors.New("bad config")
+	}
+	a.NoError(s.handleRpcConfigReload(ctx, &drpc.ConfigReload{}))
+	msg = <-s.outgoing
+	a.Equal("bad config", msg.Params.ConfigReloaded.Error)
+	a.Equal(5, s.config().OriginConnect.Retries)
+}
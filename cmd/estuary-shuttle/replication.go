@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	replicationCheckInterval   = time.Hour
+	replicationFirstCheckDelay = time.Minute
+	// how many active pins are checked at once
+	replicationCheckBatchSize = 1000
+)
+
+// ReplicationPolicy tells when estuary wants to hear that a content needs
+// more deals. The policy of content 0 applies to every active pin without a
+// policy of its own.
+type ReplicationPolicy struct {
+	ID             uint `gorm:"primarykey"`
+	Content        uint `gorm:"uniqueIndex"`
+	MinActiveDeals int
+	ExpiryWindow   time.Duration
+}
+
+// TrackedDeal is a deal of a content checked against its replication policy
+// and the deal expiry window
+type TrackedDeal struct {
+	ID      uint `gorm:"primarykey"`
+	Content uint `gorm:"index"`
+	Miner   string
+	DealID  int64
+
+	// EndEpoch is the end of the deal last read from chain, 0 until then
+	EndEpoch int64
+	// ExpiryNotified is set once estuary acked that the deal is expiring,
+	// ExpiryMsg is the outbox message telling it until then
+	ExpiryNotified bool
+	ExpiryMsg      uint64
+
+	// PieceCid is the piece of the deal read from chain, undefined until then
+	PieceCid util.DbCID `gorm:"index"`
+
+	// the last retrieval quote of the miner for the content, AskedAt is zero
+	// until the miner was asked
+	AskAvailable    bool
+	AskPricePerByte string
+	AskUnsealPrice  string
+	AskMessage      string
+	AskedAt         time.Time
+}
+
+func (s *Shuttle) handleRpcSetReplicationPolicy(ctx context.Context, req *drpc.SetReplicationPolicy) error {
+	if req == nil {
+		return fmt.Errorf("set replication policy command is missing its params")
+	}
+
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if req.MinActiveDeals <= 0 && req.ExpiryWindow <= 0 {
+			if err := tx.Delete(&ReplicationPolicy{}, "content = ?", req.Content).Error; err != nil {
+				return err
+			}
+		} else {
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "content"}},
+				DoUpdates: clause.AssignmentColumns([]string{"min_active_deals", "expiry_window"}),
+			}).Create(&ReplicationPolicy{
+				Content:        req.Content,
+				MinActiveDeals: req.MinActiveDeals,
+				ExpiryWindow:   req.ExpiryWindow,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		if req.Content == 0 {
+			return nil
+		}
+
+		if err := tx.Delete(&TrackedDeal{}, "content = ?", req.Content).Error; err != nil {
+			return err
+		}
+
+		if len(req.Deals) == 0 {
+			return nil
+		}
+
+		deals := make([]TrackedDeal, 0, len(req.Deals))
+		for _, d := range req.Deals {
+			deals = append(deals, TrackedDeal{
+				Content: req.Content,
+				Miner:   d.Miner.String(),
+				DealID:  d.DealID,
+			})
+		}
+		return tx.Create(&deals).Error
+	})
+}
+
+func (s *Shuttle) watchReplication() {
+	// the first check waits for the connection to estuary to come up, the
+	// contents that lost deals while the shuttle was down are reported soon
+	time.Sleep(replicationFirstCheckDelay)
+
+	ticker := time.NewTicker(replicationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.checkReplication(context.TODO()); err != nil {
+			log.Errorf("failed to check replication of tracked contents: %s", err)
+		}
+		<-ticker.C
+	}
+}
+
+// checkReplication looks up the tracked deals on chain and tells estuary
+// about the deals that are expiring and the contents that do not satisfy
+// their replication policy. Every active pin is checked, a content whose
+// deals are all gone has no tracked deal left to find it by.
+func (s *Shuttle) checkReplication(ctx context.Context) error {
+	var policies []ReplicationPolicy
+	if err := s.DB.Find(&policies).Error; err != nil {
+		return err
+	}
+
+	byContent := make(map[uint]ReplicationPolicy, len(policies))
+	for _, p := range policies {
+		byContent[p.Content] = p
+	}
+
+	var trackedCount int64
+	if err := s.DB.Model(&TrackedDeal{}).Count(&trackedCount).Error; err != nil {
+		return err
+	}
+
+	if len(policies) == 0 && trackedCount == 0 {
+		return nil
+	}
+
+	head, err := s.Api.ChainHead(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chain head: %w", err)
+	}
+
+	var after uint
+	for {
+		var conts []uint
+		if err := s.DB.Model(&Pin{}).
+			Where("active and content > ?", after).
+			Order("content asc").
+			Limit(replicationCheckBatchSize).
+			Pluck("content", &conts).Error; err != nil {
+			return err
+		}
+
+		if len(conts) == 0 {
+			return nil
+		}
+		after = conts[len(conts)-1]
+
+		var tracked []TrackedDeal
+		if err := s.DB.Where("content in ?", conts).Find(&tracked).Error; err != nil {
+			return err
+		}
+
+		deals := make(map[uint][]TrackedDeal)
+		for _, d := range tracked {
+			deals[d.Content] = append(deals[d.Content], d)
+		}
+
+		for _, cont := range conts {
+			if err := s.checkContentReplication(ctx, cont, deals[cont], byContent, head); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Shuttle) checkContentReplication(ctx context.Context, cont uint, cdeals []TrackedDeal, byContent map[uint]ReplicationPolicy, head *types.TipSet) error {
+	policy, ok := byContent[cont]
+	if !ok {
+		policy, ok = byContent[0]
+	}
+
+	if !ok && len(cdeals) == 0 {
+		return nil
+	}
+
+	window := abi.ChainEpoch(policy.ExpiryWindow / (builtin.EpochDurationSeconds * time.Second))
+
+	var active, expiring int
+	for _, d := range cdeals {
+		md, err := s.Api.StateMarketStorageDeal(ctx, abi.DealID(d.DealID), head.Key())
+		if err != nil {
+			log.Warnf("failed to get deal %d of content %d from chain: %s", d.DealID, cont, err)
+			continue
+		}
+
+		if err := s.setTrackedPieceCid(&d, md.Proposal.PieceCID); err != nil {
+			return err
+		}
+
+		if !isActiveDeal(md, head.Height()) {
+			continue
+		}
+		active++
+
+		if err := s.checkDealExpiry(ctx, d, md.Proposal.EndEpoch, head.Height()); err != nil {
+			return err
+		}
+
+		if window > 0 && md.Proposal.EndEpoch-head.Height() < window {
+			expiring++
+		}
+	}
+
+	if !ok {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case active < policy.MinActiveDeals:
+		reason = fmt.Sprintf("%d active deals, policy requires %d", active, policy.MinActiveDeals)
+	case expiring > 0:
+		reason = fmt.Sprintf("%d of %d active deals expire within %s", expiring, active, policy.ExpiryWindow)
+	default:
+		return nil
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ReplicationNeeded,
+		Params: drpc.MsgParams{
+			ReplicationNeeded: &drpc.ReplicationNeeded{
+				Content:       cont,
+				ActiveDeals:   active,
+				ExpiringDeals: expiring,
+				Reason:        reason,
+			},
+		},
+	})
+}
+
+// isActiveDeal reports whether a deal is sealed and neither slashed nor ended
+// at height
+func isActiveDeal(md *api.MarketDeal, height abi.ChainEpoch) bool {
+	return md.State.SectorStartEpoch > 0 && md.State.SlashEpoch == -1 && md.Proposal.EndEpoch > height
+}
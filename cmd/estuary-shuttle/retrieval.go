@@ -32,13 +32,21 @@ func (s *Shuttle) retrieveContent(ctx context.Context, req *drpc.RetrieveContent
 	))
 	defer span.End()
 
+	return s.withRetrievalSlot(ctx, req.Content, func() error {
+		return s.runRetrieval(ctx, req, nil)
+	})
+}
+
+// withRetrievalSlot runs fn unless a retrieval of the content is already in
+// progress, in which case it waits for that one and returns its result
+func (s *Shuttle) withRetrievalSlot(ctx context.Context, content uint, fn func() error) error {
 	s.retrLk.Lock()
-	prog, ok := s.retrievalsInProgress[req.Content]
+	prog, ok := s.retrievalsInProgress[content]
 	if !ok {
 		prog = &retrievalProgress{
 			wait: make(chan struct{}),
 		}
-		s.retrievalsInProgress[req.Content] = prog
+		s.retrievalsInProgress[content] = prog
 	}
 	s.retrLk.Unlock()
 
@@ -53,13 +61,13 @@ func (s *Shuttle) retrieveContent(ctx context.Context, req *drpc.RetrieveContent
 
 	defer func() {
 		s.retrLk.Lock()
-		delete(s.retrievalsInProgress, req.Content)
+		delete(s.retrievalsInProgress, content)
 		s.retrLk.Unlock()
 
 		close(prog.wait)
 	}()
 
-	if err := s.runRetrieval(ctx, req, nil); err != nil {
+	if err := fn(); err != nil {
 		prog.endErr = err
 		return err
 	}
@@ -88,64 +96,85 @@ func (s *Shuttle) runRetrieval(ctx context.Context, req *drpc.RetrieveContent, s
 		return nil
 	}
 
-	var retrievedContent bool
-	for _, deal := range req.Deals {
-		log.Debugw("attempting retrieval deal", "content", req.Content, "miner", deal.Miner, "selector", sel != nil)
+	release, err := s.retrievalLimit.acquire(ctx, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.retrieveFromDeals(ctx, req.Content, req.Cid, req.Deals, sel, nil); err != nil {
+		release()
+		return err
+	}
+	release()
+
+	newPin := &Pin{
+		Content: req.Content,
+		Cid:     util.DbCID{CID: req.Cid},
+		UserID:  req.UserID,
+		Active:  false,
+		Pinning: true,
+	}
+
+	if err := s.DB.Create(newPin).Error; err != nil {
+		return err
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	totalSize, objects, err := s.addDatabaseTrackingToContent(ctx, req.Content, dserv, s.Node.Blockstore, req.Cid, func(int64) {})
+	if err != nil {
+		log.Errorw("failed adding content to database after successful retrieval", "cont", req.Content, "err", err.Error())
+		return err
+	}
+
+	s.sendPinCompleteMessage(ctx, req.Content, totalSize, objects)
+	return nil
+}
+
+// retrieveFromDeals retrieves c into the blockstore from the first miner of
+// the deals that serves it, onAttempt is called before each miner is tried
+func (s *Shuttle) retrieveFromDeals(ctx context.Context, content uint, c cid.Cid, deals []drpc.StorageDeal, sel ipld.Node, onAttempt func(address.Address)) error {
+	ctx, span := s.Tracer.Start(ctx, "retrieveFromDeals")
+	defer span.End()
+
+	for _, deal := range deals {
+		log.Debugw("attempting retrieval deal", "content", content, "miner", deal.Miner, "selector", sel != nil)
 
-		ask, err := s.Filc.RetrievalQuery(ctx, deal.Miner, req.Cid)
+		if onAttempt != nil {
+			onAttempt(deal.Miner)
+		}
+
+		ask, err := s.Filc.RetrievalQuery(ctx, deal.Miner, c)
+		if rerr := s.recordRetrievalAsk(content, deal.Miner, ask, err); rerr != nil {
+			log.Warnw("failed to record retrieval ask", "miner", deal.Miner, "content", content, "err", rerr)
+		}
 		if err != nil {
 			span.RecordError(err)
 
-			log.Errorw("failed to query retrieval", "miner", deal.Miner, "content", req.Cid, "err", err)
+			log.Errorw("failed to query retrieval", "miner", deal.Miner, "content", c, "err", err)
 			s.recordRetrievalFailure(&util.RetrievalFailureRecord{
 				Miner:   deal.Miner.String(),
 				Phase:   "query",
 				Message: err.Error(),
-				Content: req.Content,
-				Cid:     util.DbCID{CID: req.Cid},
+				Content: content,
+				Cid:     util.DbCID{CID: c},
 			})
 			continue
 		}
-		log.Debugw("got retrieval ask", "content", req.Content, "miner", deal.Miner, "ask", ask)
+		log.Debugw("got retrieval ask", "content", content, "miner", deal.Miner, "ask", ask)
 
-		if err := s.tryRetrieve(ctx, deal.Miner, req.Cid, ask, sel); err != nil {
+		if err := s.tryRetrieve(ctx, deal.Miner, c, ask, sel); err != nil {
 			span.RecordError(err)
-			log.Errorw("failed to retrieve content", "miner", deal.Miner, "content", req.Cid, "err", err)
+			log.Errorw("failed to retrieve content", "miner", deal.Miner, "content", c, "err", err)
 			s.recordRetrievalFailure(&util.RetrievalFailureRecord{
 				Miner:   deal.Miner.String(),
 				Phase:   "retrieval",
 				Message: err.Error(),
-				Content: req.Content,
-				Cid:     util.DbCID{CID: req.Cid},
+				Content: content,
+				Cid:     util.DbCID{CID: c},
 			})
 			continue
 		}
 
-		retrievedContent = true
-		break
-	}
-
-	if retrievedContent {
-		newPin := &Pin{
-			Content: req.Content,
-			Cid:     util.DbCID{CID: req.Cid},
-			UserID:  req.UserID,
-			Active:  false,
-			Pinning: true,
-		}
-
-		if err := s.DB.Create(newPin).Error; err != nil {
-			return err
-		}
-
-		dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
-		totalSize, objects, err := s.addDatabaseTrackingToContent(ctx, req.Content, dserv, s.Node.Blockstore, req.Cid, func(int64) {})
-		if err != nil {
-			log.Errorw("failed adding content to database after successful retrieval", "cont", req.Content, "err", err.Error())
-			return err
-		}
-
-		s.sendPinCompleteMessage(ctx, req.Content, totalSize, objects)
 		return nil
 	}
 	return fmt.Errorf("failed to retrieve with any miner we have deals with")
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-metrics-interface"
+)
+
+// retrievalLimiter bounds the retrievals from miners running at once, each of
+// them holds a graphsync request and blockstore writes for its whole length.
+// When fair, the waiting retrievals of each user are served in turn.
+type retrievalLimiter struct {
+	lk     sync.Mutex
+	limit  int
+	active int
+	fair   bool
+
+	// waiting retrievals by user, users holds the order they are served in
+	waiting map[uint][]chan struct{}
+	users   []uint
+
+	queued  metrics.Gauge
+	running metrics.Gauge
+}
+
+func newRetrievalLimiter(ctx context.Context, limit int, fair bool) *retrievalLimiter {
+	return &retrievalLimiter{
+		limit:   limit,
+		fair:    fair,
+		waiting: make(map[uint][]chan struct{}),
+		queued:  metrics.NewCtx(ctx, "retrievals_queued", "number of retrievals waiting for their turn").Gauge(),
+		running: metrics.NewCtx(ctx, "retrievals_active", "number of retrievals running").Gauge(),
+	}
+}
+
+// acquire waits until a retrieval for the user can run, the returned func
+// ends the retrieval
+func (rl *retrievalLimiter) acquire(ctx context.Context, user uint) (func(), error) {
+	if !rl.fair {
+		user = 0
+	}
+
+	rl.lk.Lock()
+	if rl.active < rl.limit && len(rl.users) == 0 {
+		rl.active++
+		rl.running.Inc()
+		rl.lk.Unlock()
+		return rl.release, nil
+	}
+
+	turn := make(chan struct{})
+	if len(rl.waiting[user]) == 0 {
+		rl.users = append(rl.users, user)
+	}
+	rl.waiting[user] = append(rl.waiting[user], turn)
+	rl.queued.Inc()
+	rl.lk.Unlock()
+
+	select {
+	case <-turn:
+		return rl.release, nil
+	case <-ctx.Done():
+		rl.lk.Lock()
+		defer rl.lk.Unlock()
+
+		select {
+		case <-turn:
+			// our turn came while giving up, pass it on
+			rl.releaseLocked()
+		default:
+			rl.dropWaiting(user, turn)
+			rl.queued.Dec()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (rl *retrievalLimiter) release() {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+
+	rl.releaseLocked()
+}
+
+// setLimit changes how many retrievals run at once. Waiting retrievals start
+// right away when it grows, running ones finish when it shrinks.
+func (rl *retrievalLimiter) setLimit(limit int) {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+
+	rl.limit = limit
+	for rl.active < rl.limit && len(rl.users) > 0 {
+		rl.startNextLocked()
+	}
+}
+
+// releaseLocked ends a retrieval and starts the next one waiting, if any
+func (rl *retrievalLimiter) releaseLocked() {
+	rl.active--
+	rl.running.Dec()
+
+	// the limit may have shrunk while it ran
+	if rl.active >= rl.limit || len(rl.users) == 0 {
+		return
+	}
+	rl.startNextLocked()
+}
+
+func (rl *retrievalLimiter) startNextLocked() {
+	user := rl.users[0]
+	rl.users = rl.users[1:]
+
+	queue := rl.waiting[user]
+	turn := queue[0]
+	if len(queue) > 1 {
+		rl.waiting[user] = queue[1:]
+		rl.users = append(rl.users, user)
+	} else {
+		delete(rl.waiting, user)
+	}
+
+	rl.active++
+	rl.running.Inc()
+	rl.queued.Dec()
+	close(turn)
+}
+
+func (rl *retrievalLimiter) dropWaiting(user uint, turn chan struct{}) {
+	queue := rl.waiting[user]
+	for i, t := range queue {
+		if t == turn {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+
+	if len(queue) > 0 {
+		rl.waiting[user] = queue
+		return
+	}
+
+	delete(rl.waiting, user)
+	for i, u := range rl.users {
+		if u == user {
+			rl.users = append(rl.users[:i], rl.users[i+1:]...)
+			break
+		}
+	}
+}
+
+// stats returns how many retrievals wait for their turn and how many run
+func (rl *retrievalLimiter) stats() (queued int, active int) {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+
+	for _, q := range rl.waiting {
+		queued += len(q)
+	}
+	return queued, rl.active
+}
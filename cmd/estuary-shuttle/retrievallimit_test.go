@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrievalLimiterFairness(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	rl := newRetrievalLimiter(ctx, 1, true)
+
+	release, err := rl.acquire(ctx, 1)
+	a.NoError(err)
+
+	// user 1 queues a burst before user 2 asks for a single retrieval
+	order := make(chan uint, 3)
+	for i, user := range []uint{1, 1, 2} {
+		go func(user uint) {
+			done, err := rl.acquire(ctx, user)
+			if err != nil {
+				return
+			}
+			order <- user
+			done()
+		}(user)
+
+		queued := i + 1
+		a.Eventually(func() bool {
+			q, _ := rl.stats()
+			return q == queued
+		}, time.Second, time.Millisecond)
+	}
+
+	_, active := rl.stats()
+	a.Equal(1, active)
+
+	release()
+	a.Equal(uint(1), <-order)
+	a.Equal(uint(2), <-order)
+	a.Equal(uint(1), <-order)
+}
+
+func TestRetrievalLimiterCancel(t *testing.T) {
+	a := assert.New(t)
+	rl := newRetrievalLimiter(context.Background(), 1, false)
+
+	release, err := rl.acquire(context.Background(), 1)
+	a.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	_, err = rl.acquire(ctx, 2)
+	a.ErrorIs(err, context.DeadlineExceeded)
+
+	queued, active := rl.stats()
+	a.Zero(queued)
+	a.Equal(1, active)
+
+	release()
+	_, active = rl.stats()
+	a.Zero(active)
+}
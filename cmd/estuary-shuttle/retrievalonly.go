@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/application-research/estuary/util"
+)
+
+// errRetrievalOnly is returned by everything that would bring new content
+// onto a retrieval-only shuttle, serving, transferring, verifying and
+// exporting the content it already has keep working
+var errRetrievalOnly = errors.New("node in retrieval-only mode")
+
+func (s *Shuttle) retrievalOnly() bool {
+	return s.config().RetrievalOnly
+}
+
+// errorIfRetrievalOnly is the http error for the add endpoints
+func (s *Shuttle) errorIfRetrievalOnly() error {
+	if s.retrievalOnly() {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_ADDING_DISABLED,
+			Details: errRetrievalOnly.Error(),
+		}
+	}
+	return nil
+}
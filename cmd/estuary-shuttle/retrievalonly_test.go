@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrievalOnly(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.PinMgr = pinner.NewPinManager(nil, nil, &pinner.PinManagerOpts{
+		MaxActivePerUser: 1,
+		QueueDataDir:     t.TempDir(),
+	})
+	s.splitsInProgress = make(map[uint]bool)
+	s.config().RetrievalOnly = true
+
+	c := blocks.NewBlock([]byte("retrieval only")).Cid()
+	a.NoError(s.handleRpcAddPin(ctx, &drpc.AddPin{DBID: 1, UserId: 1, Cid: c}))
+
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_PinRejected, msg.Op)
+	a.Equal(errRetrievalOnly.Error(), msg.Params.PinRejected.Reason)
+
+	var pins int64
+	a.NoError(s.DB.Model(Pin{}).Count(&pins).Error)
+	a.Zero(pins)
+
+	res, err := s.bulkAddPin(ctx, []drpc.AddPin{{DBID: 2, UserId: 1, Cid: c}})
+	a.NoError(err)
+	a.Zero(res.Accepted)
+	a.Equal([]drpc.PinRejected{{DBID: 2, Reason: errRetrievalOnly.Error()}}, res.Rejected)
+
+	err = s.handleRpcTakeContent(ctx, &drpc.TakeContent{Contents: []drpc.ContentFetch{{ID: 3, Cid: c}}})
+	a.True(errors.Is(err, errRetrievalOnly))
+
+	err = s.handleRpcSplitContent(ctx, &drpc.SplitContent{Content: 4, Size: 10})
+	a.True(errors.Is(err, errRetrievalOnly))
+
+	err = s.handleRpcAggregateStagedContent(ctx, &drpc.AggregateContent{DBID: 5, Contents: []uint{4}})
+	a.True(errors.Is(err, errRetrievalOnly))
+
+	var herr *util.HttpError
+	a.True(errors.As(s.errorIfRetrievalOnly(), &herr))
+	a.Equal(util.ERR_CONTENT_ADDING_DISABLED, herr.Reason)
+
+	s.config().RetrievalOnly = false
+	a.NoError(s.errorIfRetrievalOnly())
+}
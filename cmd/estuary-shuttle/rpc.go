@@ -1,26 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/application-research/estuary/config"
 	"github.com/application-research/estuary/drpc"
 	"github.com/application-research/estuary/pinner"
 	"github.com/application-research/estuary/pinner/types"
 	"github.com/application-research/estuary/util"
 	dagsplit "github.com/application-research/estuary/util/dagsplit"
 	"github.com/application-research/filclient"
+	cborutil "github.com/filecoin-project/go-cbor-util"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	marketv8 "github.com/filecoin-project/go-state-types/builtin/v8/market"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-merkledag"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 	"gorm.io/gorm"
 )
@@ -39,6 +52,8 @@ func (d *Shuttle) handleRpcCmd(cmd *drpc.Command) error {
 	switch cmd.Op {
 	case drpc.CMD_AddPin:
 		return d.handleRpcAddPin(ctx, cmd.Params.AddPin)
+	case drpc.CMD_BulkAddPin:
+		return d.handleRpcBulkAddPin(ctx, cmd.Params.BulkAddPin)
 	case drpc.CMD_ComputeCommP:
 		return d.handleRpcComputeCommP(ctx, cmd.Params.ComputeCommP)
 	case drpc.CMD_TakeContent:
@@ -55,12 +70,83 @@ func (d *Shuttle) handleRpcCmd(cmd *drpc.Command) error {
 		return d.handleRpcReqTxStatus(ctx, cmd.Params.ReqTxStatus)
 	case drpc.CMD_RetrieveContent:
 		return d.handleRpcRetrieveContent(ctx, cmd.Params.RetrieveContent)
+	case drpc.CMD_SetContentMetadata:
+		return d.handleRpcSetContentMetadata(ctx, cmd.Params.SetContentMetadata)
+	case drpc.CMD_GetContentMetadata:
+		return d.handleRpcGetContentMetadata(ctx, cmd.Params.GetContentMetadata)
+	case drpc.CMD_RehydrateContent:
+		return d.handleRpcRehydrateContent(ctx, cmd.Params.RehydrateContent)
 	case drpc.CMD_UnpinContent:
 		return d.handleRpcUnpinContent(ctx, cmd.Params.UnpinContent)
 	case drpc.CMD_SplitContent:
 		return d.handleRpcSplitContent(ctx, cmd.Params.SplitContent)
 	case drpc.CMD_RestartTransfer:
 		return d.handleRpcRestartTransfer(ctx, cmd.Params.RestartTransfer)
+	case drpc.CMD_QueueStats:
+		return d.handleRpcQueueStats(ctx, cmd.Params.QueueStats)
+	case drpc.CMD_RechunkContent:
+		return d.handleRpcRechunkContent(ctx, cmd.Params.RechunkContent)
+	case drpc.CMD_ListActiveTransfers:
+		return d.handleRpcListActiveTransfers(ctx, cmd.Params.ListActiveTransfers)
+	case drpc.CMD_GetTransferBytes:
+		return d.handleRpcGetTransferBytes(ctx, cmd.Params.GetTransferBytes)
+	case drpc.CMD_DumpGoroutines:
+		return d.handleRpcDumpGoroutines(ctx, cmd.Params.DumpGoroutines)
+	case drpc.CMD_TransferBandwidthLimit:
+		return d.handleRpcTransferBandwidthLimit(ctx, cmd.Params.TransferBandwidthLimit)
+	case drpc.CMD_SetLogLevel:
+		return d.handleRpcSetLogLevel(ctx, cmd.Params.SetLogLevel)
+	case drpc.CMD_HealthCheck:
+		return d.handleRpcHealthCheck(ctx, cmd.Params.HealthCheck)
+	case drpc.CMD_GetContentPeers:
+		return d.handleRpcGetContentPeers(ctx, cmd.Params.GetContentPeers)
+	case drpc.CMD_FindPinsByLabel:
+		return d.handleRpcFindPinsByLabel(ctx, cmd.Params.FindPinsByLabel)
+	case drpc.CMD_GetContentCID:
+		return d.handleRpcGetContentCID(ctx, cmd.Params.GetContentCID)
+	case drpc.CMD_ForceReconnect:
+		return d.handleRpcForceReconnect(ctx, cmd.Params.ForceReconnect)
+	case drpc.CMD_GetDiskUsage:
+		return d.handleRpcGetDiskUsage(ctx, cmd.Params.GetDiskUsage)
+	case drpc.CMD_WarmCache:
+		return d.handleRpcWarmCache(ctx, cmd.Params.WarmCache)
+	case drpc.CMD_ValidateContentRoot:
+		return d.handleRpcValidateContentRoot(ctx, cmd.Params.ValidateContentRoot)
+	case drpc.CMD_ReassignPin:
+		return d.handleRpcReassignPin(ctx, cmd.Params.ReassignPin)
+	case drpc.CMD_SetUserQuota:
+		return d.handleRpcSetUserQuota(ctx, cmd.Params.SetUserQuota)
+	case drpc.CMD_GetPinProgress:
+		return d.handleRpcGetPinProgress(ctx, cmd.Params.GetPinProgress)
+	case drpc.CMD_ConfigReload:
+		return d.handleRpcConfigReload(ctx, cmd.Params.ConfigReload)
+	case drpc.CMD_GetPieceInfo:
+		return d.handleRpcGetPieceInfo(ctx, cmd.Params.GetPieceInfo)
+	case drpc.CMD_RepairSplitLinkage:
+		return d.handleRpcRepairSplitLinkage(ctx, cmd.Params.RepairSplitLinkage)
+	case drpc.CMD_Benchmark:
+		return d.handleRpcBenchmark(ctx, cmd.Params.Benchmark)
+	case drpc.CMD_ReconcilePins:
+		return d.handleRpcReconcilePins(ctx, cmd.Params.ReconcilePins)
+	case drpc.CMD_PauseUser:
+		return d.handleRpcPauseUser(ctx, cmd.Params.PauseUser)
+	case drpc.CMD_ResumeUser:
+		return d.handleRpcResumeUser(ctx, cmd.Params.ResumeUser)
+	case drpc.CMD_SetReadOnly:
+		return d.handleRpcSetReadOnly(ctx, cmd.Params.SetReadOnly)
+	case drpc.CMD_SetReplicationPolicy:
+		return d.handleRpcSetReplicationPolicy(ctx, cmd.Params.SetReplicationPolicy)
+	case drpc.CMD_RelocatePin:
+		return d.handleRpcRelocatePin(ctx, cmd.Params.RelocatePin)
+	case drpc.CMD_Ack:
+		if cmd.Params.Ack == nil {
+			return fmt.Errorf("ack command is missing its params")
+		}
+
+		if err := d.outbox.ack(cmd.Params.Ack.IDs); err != nil {
+			return err
+		}
+		return d.dealExpiryAcked(cmd.Params.Ack.IDs)
 	default:
 		return fmt.Errorf("unrecognized command op: %q", cmd.Op)
 	}
@@ -71,6 +157,38 @@ func (d *Shuttle) sendRpcMessage(ctx context.Context, msg *drpc.Message) error {
 	// a noopspan context will be carried and ignored by the receiver.
 	msg.TraceCarrier = drpc.NewTraceCarrier(trace.SpanFromContext(ctx).SpanContext())
 	log.Debugf("sending rpc message: %s", msg.Op)
+
+	if durableOps[msg.Op] {
+		// if persisting fails still try to send it, just without the guarantee
+		if err := d.outbox.add(msg); err != nil {
+			log.Errorf("failed to persist outgoing %s message: %s", msg.Op, err)
+		}
+	}
+
+	// fail fast while estuary is failing, durable messages wait in the outbox
+	if d.breaker.isOpen(time.Now()) {
+		d.breaker.skip(msg)
+		return errCircuitOpen
+	}
+
+	// nothing takes messages off the queue while disconnected
+	action, err := d.rpcConn.checkSend(msg)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case sendOutbox:
+		return nil
+	case sendBuffer:
+		select {
+		case d.outgoing <- msg:
+			return nil
+		default:
+			return fmt.Errorf("outgoing queue full: %w", errNotConnected)
+		}
+	}
+
 	select {
 	case d.outgoing <- msg:
 		return nil
@@ -82,15 +200,42 @@ func (d *Shuttle) sendRpcMessage(ctx context.Context, msg *drpc.Message) error {
 func (d *Shuttle) handleRpcAddPin(ctx context.Context, apo *drpc.AddPin) error {
 	d.addPinLk.Lock()
 	defer d.addPinLk.Unlock()
-	return d.addPin(ctx, apo.DBID, apo.Cid, apo.UserId, apo.Peers, false)
+	return d.addPin(ctx, apo.DBID, apo.Cid, apo.UserId, addPinOptsOf(apo))
 }
 
-func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user uint, peers []*peer.AddrInfo, skipLimiter bool) error {
+// addPinOpts are the settings of a pin beyond what is pinned for whom
+type addPinOpts struct {
+	Peers  []*peer.AddrInfo
+	Labels []string
+	// SkipLimiter lets the pin skip the per user limit of the pin queue
+	SkipLimiter bool
+	RetryFailed bool
+	Timeout     time.Duration
+	ProvideTTL  time.Duration
+	Unannounced bool
+	// VerifyDag has the whole dag checked before the pin is reported complete
+	VerifyDag bool
+}
+
+// addPinOptsOf returns the settings of a pin request from estuary
+func addPinOptsOf(apo *drpc.AddPin) addPinOpts {
+	return addPinOpts{
+		Peers:       apo.Peers,
+		Labels:      apo.Labels,
+		RetryFailed: apo.RetryFailed,
+		Timeout:     apo.Timeout,
+		ProvideTTL:  apo.ProvideTTL,
+		Unannounced: apo.Unannounced,
+	}
+}
+
+func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user uint, opts addPinOpts) error {
 	ctx, span := d.Tracer.Start(ctx, "addPin", trace.WithAttributes(
 		attribute.Int64("contID", int64(contid)),
 		attribute.Int64("userID", int64(user)),
 		attribute.String("data", data.String()),
-		attribute.Bool("skipLimiter", skipLimiter),
+		attribute.Bool("skipLimiter", opts.SkipLimiter),
+		attribute.Bool("retryFailed", opts.RetryFailed),
 	))
 	defer span.End()
 
@@ -106,6 +251,63 @@ func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user ui
 		}
 		existing := search[0]
 
+		// sending the pin complete of a finished pin again only reads it,
+		// estuary still catches up with read-only pins that way
+		if existing.ReadOnly && !existing.Pinning && existing.Active {
+			go func() {
+				if err := d.resendPinComplete(ctx, existing); err != nil {
+					log.Error(err)
+				}
+			}()
+			return nil
+		}
+
+		if err := checkWritable(existing); err != nil {
+			return err
+		}
+
+		if len(opts.Labels) > 0 {
+			if err := setPinLabels(d.DB, existing.ID, opts.Labels); err != nil {
+				return err
+			}
+		}
+
+		// a new hint applies from the next time the content is announced
+		if opts.ProvideTTL > 0 && opts.ProvideTTL != existing.ProvideTTL {
+			if err := d.DB.Model(Pin{}).Where("id = ?", existing.ID).UpdateColumn("provide_ttl", opts.ProvideTTL).Error; err != nil {
+				return err
+			}
+		}
+
+		// content is only ever made private here, announcing it again would
+		// not take back what was kept out of the dht
+		if opts.Unannounced && !existing.Unannounced {
+			if err := d.DB.Model(Pin{}).Where("id = ?", existing.ID).UpdateColumns(map[string]interface{}{
+				"unannounced":  true,
+				"reprovide_at": nil,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		if opts.VerifyDag && !existing.VerifyDag {
+			if err := d.DB.Model(Pin{}).Where("id = ?", existing.ID).UpdateColumn("verify_dag", true).Error; err != nil {
+				return err
+			}
+		}
+
+		if existing.Failed && opts.RetryFailed {
+			log.Infof("retrying failed pin of content %d", contid)
+			if err := d.DB.Model(Pin{}).Where("id = ?", existing.ID).UpdateColumns(map[string]interface{}{
+				"failed":  false,
+				"pinning": true,
+			}).Error; err != nil {
+				return xerrors.Errorf("failed to reset failed pin: %w", err)
+			}
+			existing.Failed = false
+			existing.Pinning = true
+		}
+
 		if existing.Failed {
 			// being asked to pin a thing we have marked as failed means the
 			// primary node isnt aware that this pin failed, we need to resend
@@ -143,27 +345,122 @@ func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user ui
 			}
 		}
 	} else {
+		if d.retrievalOnly() {
+			return d.sendRpcMessage(ctx, &drpc.Message{
+				Op: drpc.OP_PinRejected,
+				Params: drpc.MsgParams{
+					PinRejected: &drpc.PinRejected{
+						DBID:   contid,
+						Reason: errRetrievalOnly.Error(),
+					},
+				},
+			})
+		}
+
+		if !shuttleContentFormats.Supports(data) {
+			// estuary pins it on a shuttle that can walk it instead
+			return d.sendRpcMessage(ctx, &drpc.Message{
+				Op: drpc.OP_PinRejected,
+				Params: drpc.MsgParams{
+					PinRejected: &drpc.PinRejected{
+						DBID:   contid,
+						Reason: fmt.Sprintf("content format of %s is not supported by the shuttle", data),
+					},
+				},
+			})
+		}
+
+		if opts.Unannounced && d.bitswapProvides() {
+			return d.sendRpcMessage(ctx, &drpc.Message{
+				Op: drpc.OP_PinRejected,
+				Params: drpc.MsgParams{
+					PinRejected: &drpc.PinRejected{
+						DBID:   contid,
+						Reason: errBitswapProvides.Error(),
+					},
+				},
+			})
+		}
+
+		if d.pinQueueSpace() == 0 {
+			return d.sendRpcMessage(ctx, &drpc.Message{
+				Op: drpc.OP_PinRejected,
+				Params: drpc.MsgParams{
+					PinRejected: &drpc.PinRejected{
+						DBID:   contid,
+						Reason: "shuttle pin queue is full",
+					},
+				},
+			})
+		}
+
+		if d.PinMgr.StorageFull() {
+			// don't take new pins we likely can't store, estuary will pin it elsewhere
+			return d.sendRpcMessage(ctx, &drpc.Message{
+				Op: drpc.OP_PinRejected,
+				Params: drpc.MsgParams{
+					PinRejected: &drpc.PinRejected{
+						DBID:   contid,
+						Reason: "shuttle storage is full",
+					},
+				},
+			})
+		}
+
+		// the size of the content is unknown until it is pinned, so only
+		// users that already used up their quota are turned away here
+		exceeded, err := d.userQuotaExceeded(user, 0)
+		if err != nil {
+			return err
+		}
+
+		if exceeded {
+			return d.sendRpcMessage(ctx, &drpc.Message{
+				Op: drpc.OP_PinRejected,
+				Params: drpc.MsgParams{
+					PinRejected: &drpc.PinRejected{
+						DBID:   contid,
+						Reason: "user storage quota exceeded",
+					},
+				},
+			})
+		}
+
 		// good, no pin found with this content id, lets create it
 		pin := &Pin{
-			Content: contid,
-			Cid:     util.DbCID{CID: data},
-			UserID:  user,
-			Active:  false,
-			Pinning: true,
+			Content:     contid,
+			Cid:         util.DbCID{CID: data},
+			UserID:      user,
+			Active:      false,
+			Pinning:     true,
+			ProvideTTL:  opts.ProvideTTL,
+			Unannounced: opts.Unannounced,
+			VerifyDag:   opts.VerifyDag,
 		}
 
-		if err := d.DB.Create(pin).Error; err != nil {
+		if err := d.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(pin).Error; err != nil {
+				return err
+			}
+			return setPinLabels(tx, pin.ID, opts.Labels)
+		}); err != nil {
 			return err
 		}
 	}
 
+	traceCarrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, traceCarrier)
+
 	op := &pinner.PinningOperation{
-		Obj:         data,
-		ContId:      contid,
-		UserId:      user,
-		Status:      types.PinningStatusQueued,
-		SkipLimiter: skipLimiter,
-		Peers:       peers,
+		Obj:          data,
+		ContId:       contid,
+		UserId:       user,
+		Status:       types.PinningStatusQueued,
+		SkipLimiter:  opts.SkipLimiter,
+		Peers:        opts.Peers,
+		Timeout:      opts.Timeout,
+		Unannounced:  opts.Unannounced,
+		TraceCarrier: traceCarrier,
 	}
 
 	d.PinMgr.Add(op)
@@ -207,6 +504,10 @@ func (d *Shuttle) handleRpcComputeCommP(ctx context.Context, cmd *drpc.ComputeCo
 	))
 	defer span.End()
 
+	if err := d.memGuard.checkCommp(); err != nil {
+		return xerrors.Errorf("failed to compute commP for %s: %w", cmd.Data, err)
+	}
+
 	res, err := d.commpMemo.Do(ctx, cmd.Data.String(), nil)
 	if err != nil {
 		return xerrors.Errorf("failed to compute commP for %s: %w", cmd.Data, err)
@@ -255,6 +556,29 @@ func (d *Shuttle) sendPinCompleteMessage(ctx context.Context, cont uint, size in
 		})
 	}
 
+	// a pin with too many objects would not fit in a single message, send all
+	// but the last chunk of its objects first, the pin complete marks the end
+	var chunks int
+	if chunkSize := d.config().RPCMessage.PinCompleteChunkSize; chunkSize > 0 {
+		for len(objs) > chunkSize {
+			if err := d.sendRpcMessage(ctx, &drpc.Message{
+				Op: drpc.OP_PinCompleteChunk,
+				Params: drpc.MsgParams{
+					PinCompleteChunk: &drpc.PinCompleteChunk{
+						DBID:    cont,
+						Index:   chunks,
+						Objects: objs[:chunkSize],
+					},
+				},
+			}); err != nil {
+				log.Errorf("failed to send pin complete chunk %d for content %d: %s", chunks, cont, err)
+				return
+			}
+			objs = objs[chunkSize:]
+			chunks++
+		}
+	}
+
 	if err := d.sendRpcMessage(ctx, &drpc.Message{
 		Op: drpc.OP_PinComplete,
 		Params: drpc.MsgParams{
@@ -262,6 +586,7 @@ func (d *Shuttle) sendPinCompleteMessage(ctx context.Context, cont uint, size in
 				DBID:    cont,
 				Size:    size,
 				Objects: objs,
+				Chunks:  chunks,
 			},
 		},
 	}); err != nil {
@@ -274,9 +599,14 @@ func (d *Shuttle) handleRpcTakeContent(ctx context.Context, cmd *drpc.TakeConten
 	ctx, span := d.Tracer.Start(ctx, "handleTakeContent")
 	defer span.End()
 
+	if d.retrievalOnly() {
+		return errRetrievalOnly
+	}
+
 	d.addPinLk.Lock()
 	defer d.addPinLk.Unlock()
 
+	var toPin []drpc.ContentFetch
 	for _, c := range cmd.Contents {
 		var count int64
 		err := d.DB.Model(Pin{}).Where("content = ?", c.ID).Limit(1).Count(&count).Error
@@ -288,17 +618,175 @@ func (d *Shuttle) handleRpcTakeContent(ctx context.Context, cmd *drpc.TakeConten
 		if count > 0 {
 			continue
 		}
+		toPin = append(toPin, c)
+	}
+
+	if len(toPin) > 0 {
+		go d.takeContents(ctx, toPin)
+	}
+	return nil
+}
+
+const takeContentProgressInterval = time.Minute
+
+// takeContents pins the given contents, at most TakeContentConcurrency of
+// them in progress at once, and reports the progress to estuary along the
+// way. A slot is held until the pin is done, the pins in progress are all
+// checked at once every takeContentPollInterval.
+func (d *Shuttle) takeContents(ctx context.Context, contents []drpc.ContentFetch) {
+	var lk sync.Mutex
+	progress := drpc.TakeContentProgress{
+		Total:   len(contents),
+		Pending: len(contents),
+	}
+
+	sendProgress := func() {
+		lk.Lock()
+		p := progress
+		lk.Unlock()
 
-		go func(c drpc.ContentFetch) {
-			if err := d.addPin(ctx, c.ID, c.Cid, c.UserID, c.Peers, true); err != nil {
-				log.Errorf("failed to pin takeContent: %d", c.ID)
+		if err := d.sendRpcMessage(ctx, &drpc.Message{
+			Op: drpc.OP_TakeContentProgress,
+			Params: drpc.MsgParams{
+				TakeContentProgress: &p,
+			},
+		}); err != nil {
+			log.Errorf("failed to send take content progress: %s", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(takeContentProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sendProgress()
+			case <-done:
+				return
 			}
-		}(c)
+		}
+	}()
+
+	finish := func(pinned bool) {
+		lk.Lock()
+		defer lk.Unlock()
+		progress.Pending--
+		if pinned {
+			progress.Pinned++
+		} else {
+			progress.Failed++
+		}
+	}
+
+	ticker := time.NewTicker(takeContentPollInterval)
+	defer ticker.Stop()
+
+	queue := contents
+	pending := make(map[uint]struct{})
+	for len(queue) > 0 || len(pending) > 0 {
+		// no slot is taken once everything is added
+		var slot chan struct{}
+		if len(queue) > 0 {
+			slot = d.takeContentSem
+		}
+
+		select {
+		case slot <- struct{}{}:
+			c := queue[0]
+			queue = queue[1:]
+
+			if err := d.addTakenPin(ctx, c); err != nil {
+				<-d.takeContentSem
+				finish(false)
+				continue
+			}
+			pending[c.ID] = struct{}{}
+		case <-ticker.C:
+			for id, pinned := range d.checkTakenPins(pending) {
+				delete(pending, id)
+				<-d.takeContentSem
+				finish(pinned)
+			}
+		case <-ctx.Done():
+			for id := range pending {
+				delete(pending, id)
+				<-d.takeContentSem
+				finish(false)
+			}
+			for range queue {
+				finish(false)
+			}
+			queue = nil
+		}
+	}
+	close(done)
+
+	sendProgress()
+}
+
+const takeContentPollInterval = time.Second * 5
+
+// addTakenPin queues the pin of a content taken from another shuttle
+func (d *Shuttle) addTakenPin(ctx context.Context, c drpc.ContentFetch) error {
+	d.addPinLk.Lock()
+	defer d.addPinLk.Unlock()
+
+	if err := d.addPin(ctx, c.ID, c.Cid, c.UserID, addPinOpts{
+		Peers:       c.Peers,
+		SkipLimiter: true,
+		VerifyDag:   d.config().VerifyTakenContent,
+	}); err != nil {
+		log.Errorf("failed to pin takeContent %d: %s", c.ID, err)
+		return err
 	}
 	return nil
 }
 
+// checkTakenPins looks up the pins of the taken contents in one go, it
+// returns whether the content got pinned for the ones that are done
+func (d *Shuttle) checkTakenPins(pending map[uint]struct{}) map[uint]bool {
+	ids := make([]uint, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+
+	done := make(map[uint]bool)
+
+	var pins []Pin
+	if err := d.DB.Find(&pins, "content in ?", ids).Error; err != nil {
+		log.Errorf("failed to check pins of takeContent: %s", err)
+		for _, id := range ids {
+			done[id] = false
+		}
+		return done
+	}
+
+	found := make(map[uint]bool, len(pins))
+	for _, p := range pins {
+		found[p.Content] = true
+		if p.Failed {
+			done[p.Content] = false
+		} else if p.Active && !p.Pinning {
+			done[p.Content] = true
+		}
+	}
+
+	// no pin means the shuttle rejected it
+	for _, id := range ids {
+		if !found[id] {
+			done[id] = false
+		}
+	}
+	return done
+}
+
 func (s *Shuttle) handleRpcAggregateStagedContent(ctx context.Context, cmd *drpc.AggregateContent) error {
+	if s.retrievalOnly() {
+		return errRetrievalOnly
+	}
+
 	// only progress if aggr is not allready in progress
 	if !s.markStartAggr(cmd.DBID) {
 		return nil
@@ -312,46 +800,72 @@ func (s *Shuttle) handleRpcAggregateStagedContent(ctx context.Context, cmd *drpc
 	))
 	defer span.End()
 
-	var p Pin
-	err := s.DB.First(&p, "content = ?", cmd.DBID).Error
+	if len(cmd.ObjData) == 0 {
+		data, err := s.fetchAggregateBlock(ctx, cmd)
+		if err != nil {
+			return fmt.Errorf("failed to fetch aggregate block of content %d: %w", cmd.DBID, err)
+		}
+		cmd.ObjData = data
+	}
+
+	// NewBlockWithCid does not check the data against the cid, make sure we
+	// are not about to store corrupted data under the aggregate root
+	if err := verifyBlockData(cmd.Root, cmd.ObjData); err != nil {
+		return fmt.Errorf("invalid aggregate data for content %d: %w", cmd.DBID, err)
+	}
+
+	// every step below checks for the state left behind by a previous
+	// attempt, so that a re-sent aggregate command for a partially created
+	// aggregate (i.e. we crashed midway) finishes the job instead of stalling
+	var pin Pin
+	err := s.DB.First(&pin, "content = ?", cmd.DBID).Error
 	switch err {
 	default:
 		return err
 	case nil:
-		// exists already
-		return nil
+		if !pin.Aggregate {
+			// exists already
+			return nil
+		}
+
+		if err := checkWritable(pin); err != nil {
+			return err
+		}
 	case gorm.ErrRecordNotFound:
 		// normal case
 	}
+	exists := err == nil
 
-	totalSize := int64(len(cmd.ObjData))
-	for _, c := range cmd.Contents {
-		var aggr Pin
-		if err := s.DB.First(&aggr, "content = ?", c).Error; err != nil {
-			// TODO: implies we dont have all the content locally we are being
-			// asked to aggregate, this is an important error to handle
+	members, err := s.aggregateMembers(cmd, exists)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if err := s.checkAggregateMembers(cmd); err != nil {
 			return err
 		}
 
-		if !aggr.Active || aggr.Failed {
-			return fmt.Errorf("content i am being asked to aggregate is not pinned: %d", c)
+		totalSize := int64(len(cmd.ObjData))
+		for _, m := range members {
+			totalSize += m.Size
 		}
-		totalSize += aggr.Size
-	}
 
-	pin := &Pin{
-		Content:   cmd.DBID,
-		Cid:       util.DbCID{CID: cmd.Root},
-		UserID:    cmd.UserID,
-		Size:      totalSize,
-		Active:    false,
-		Pinning:   true,
-		Aggregate: true,
-	}
-	if err := s.DB.Create(pin).Error; err != nil {
-		return err
+		pin = Pin{
+			Content:   cmd.DBID,
+			Cid:       util.DbCID{CID: cmd.Root},
+			UserID:    cmd.UserID,
+			Size:      totalSize,
+			Active:    false,
+			Pinning:   true,
+			Aggregate: true,
+		}
+		if err := s.DB.Create(&pin).Error; err != nil {
+			return err
+		}
 	}
 
+	// putting the block is idempotent, so no need to check if we got that far
 	blk, err := blocks.NewBlockWithCid(cmd.ObjData, cmd.Root)
 	if err != nil {
 		return err
@@ -361,40 +875,144 @@ func (s *Shuttle) handleRpcAggregateStagedContent(ctx context.Context, cmd *drpc
 		return err
 	}
 
+	obj, err := s.getOrCreateAggregateObject(ctx, pin.ID, blk)
+	if err != nil {
+		return err
+	}
+
 	// since aggregates only needs put the containing box in the blockstore (no need to pull blocks),
 	// mark it as active and change pinning status
-	if err := s.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
-		"active":  true,
-		"pinning": false,
-	}).Error; err != nil {
+	if !pin.Active || pin.Pinning {
+		if err := s.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
+			"active":  true,
+			"pinning": false,
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	// always (re)send the pin complete, if we are asked to aggregate content that
+	// is already done, estuary most likely never got the message the first time
+	s.sendPinCompleteMessage(ctx, cmd.DBID, pin.Size, []*Object{obj})
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_AggregateComplete,
+		Params: drpc.MsgParams{
+			AggregateComplete: &drpc.AggregateComplete{
+				DBID:    cmd.DBID,
+				Members: members,
+			},
+		},
+	})
+}
+
+// verifyBlockData checks that data hashes to the given cid
+func verifyBlockData(c cid.Cid, data []byte) error {
+	computed, err := c.Prefix().Sum(data)
+	if err != nil {
 		return err
 	}
 
-	obj := &Object{
-		Cid:  util.DbCID{CID: blk.Cid()},
-		Size: len(blk.RawData()),
+	if !computed.Equals(c) {
+		return fmt.Errorf("data hashes to %s, expected %s", computed, c)
 	}
-	if err := s.DB.Create(obj).Error; err != nil {
-		return err
+	return nil
+}
+
+// how long fetching an aggregate block that was too large to be sent inline
+// may take
+const aggregateFetchTimeout = time.Minute
+
+// fetchAggregateBlock gets the aggregate block estuary did not send inline,
+// from the blockstore if an earlier attempt got it already or else over
+// bitswap from the peers of the command
+func (s *Shuttle) fetchAggregateBlock(ctx context.Context, cmd *drpc.AggregateContent) ([]byte, error) {
+	blk, err := s.Node.Blockstore.Get(ctx, cmd.Root)
+	if err == nil {
+		return blk.RawData(), nil
 	}
 
-	ref := &ObjRef{
-		Pin:    pin.ID,
-		Object: obj.ID,
+	if !ipld.IsNotFound(err) {
+		return nil, err
 	}
-	if err := s.DB.Create(ref).Error; err != nil {
-		return err
+
+	if len(cmd.Peers) == 0 {
+		return nil, fmt.Errorf("command carries neither the block nor peers to fetch it from")
 	}
 
-	if err := s.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
-		"active":  true,
-		"pinning": false,
-	}).Error; err != nil {
-		return err
+	ctx, cancel := context.WithTimeout(ctx, aggregateFetchTimeout)
+	defer cancel()
+
+	if s.connectToOrigins(ctx, cmd.Peers) == 0 {
+		return nil, fmt.Errorf("failed to connect to all %d peers", len(cmd.Peers))
 	}
 
-	s.sendPinCompleteMessage(ctx, cmd.DBID, totalSize, []*Object{obj})
-	return nil
+	blk, err = s.Node.Bitswap.GetBlock(ctx, cmd.Root)
+	if err != nil {
+		return nil, err
+	}
+	return blk.RawData(), nil
+}
+
+// aggregateMembers returns the contents going into the aggregate with their
+// sizes, all of them must be pinned here. The members of an aggregate that
+// exists already are only looked up for their sizes.
+func (s *Shuttle) aggregateMembers(cmd *drpc.AggregateContent, exists bool) ([]drpc.AggregateMember, error) {
+	members := make([]drpc.AggregateMember, 0, len(cmd.Contents))
+	for _, c := range cmd.Contents {
+		var aggr Pin
+		if err := s.DB.First(&aggr, "content = ?", c).Error; err != nil {
+			// TODO: implies we dont have all the content locally we are being
+			// asked to aggregate, this is an important error to handle
+			return nil, err
+		}
+
+		if !exists {
+			if !aggr.Active || aggr.Failed {
+				return nil, fmt.Errorf("content i am being asked to aggregate is not pinned: %d", c)
+			}
+
+			if err := checkWritable(aggr); err != nil {
+				return nil, err
+			}
+		}
+		members = append(members, drpc.AggregateMember{
+			DBID: c,
+			Size: aggr.Size,
+		})
+	}
+	return members, nil
+}
+
+// getOrCreateAggregateObject returns the object referenced by the aggregate
+// pin, creating the object and its ref together if they don't exist yet
+func (s *Shuttle) getOrCreateAggregateObject(ctx context.Context, pinID uint, blk blocks.Block) (*Object, error) {
+	objs, err := s.objectsForPin(ctx, pinID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(objs) > 0 {
+		return objs[0], nil
+	}
+
+	obj := &Object{
+		Cid:  util.DbCID{CID: blk.Cid()},
+		Size: len(blk.RawData()),
+	}
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(obj).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&ObjRef{
+			Pin:    pinID,
+			Object: obj.ID,
+		}).Error
+	}); err != nil {
+		return nil, err
+	}
+	return obj, nil
 }
 
 func (s *Shuttle) trackTransfer(chanid *datatransfer.ChannelID, dealdbid uint, st *filclient.ChannelState) {
@@ -448,6 +1066,15 @@ func (s *Shuttle) handleRpcStartTransfer(ctx context.Context, cmd *drpc.StartTra
 	))
 	defer span.End()
 
+	if err := checkDealProposal(cmd); err != nil {
+		s.sendTransferStatusUpdate(ctx, &drpc.TransferStatus{
+			DealDBID: cmd.DealDBID,
+			Failed:   true,
+			Message:  fmt.Sprintf("refusing to start data transfer: %s", err),
+		})
+		return err
+	}
+
 	chanid, err := s.Filc.StartDataTransfer(ctx, cmd.Miner, cmd.PropCid, cmd.DataCid)
 	if err != nil {
 		s.sendTransferStatusUpdate(ctx, &drpc.TransferStatus{
@@ -461,6 +1088,40 @@ func (s *Shuttle) handleRpcStartTransfer(ctx context.Context, cmd *drpc.StartTra
 	return nil
 }
 
+// checkDealProposal makes sure the proposal of a transfer is priced within
+// the ceiling estuary sent along with it and lasts an allowed duration
+func checkDealProposal(cmd *drpc.StartTransfer) error {
+	if cmd.MaxPrice == nil {
+		return nil
+	}
+
+	var prop marketv8.ClientDealProposal
+	if err := prop.UnmarshalCBOR(bytes.NewReader(cmd.Proposal)); err != nil {
+		return fmt.Errorf("failed to decode deal proposal: %w", err)
+	}
+
+	nd, err := cborutil.AsIpld(&prop)
+	if err != nil {
+		return err
+	}
+
+	if nd.Cid() != cmd.PropCid {
+		return fmt.Errorf("deal proposal %s does not match proposal cid %s", nd.Cid(), cmd.PropCid)
+	}
+
+	if err := config.ValidateDealDuration(prop.Proposal.Duration()); err != nil {
+		return fmt.Errorf("deal proposal %s: %w", cmd.PropCid, err)
+	}
+
+	// the proposal price is per epoch for the whole piece
+	price := big.Mul(prop.Proposal.StoragePricePerEpoch, big.NewInt(1<<30))
+	ceiling := big.Mul(*cmd.MaxPrice, big.NewInt(int64(prop.Proposal.PieceSize)))
+	if price.GreaterThan(ceiling) {
+		return fmt.Errorf("deal price of %s per epoch for a %d bytes piece is over the ceiling of %s per GiB per epoch", prop.Proposal.StoragePricePerEpoch, prop.Proposal.PieceSize, cmd.MaxPrice)
+	}
+	return nil
+}
+
 func (d *Shuttle) sendTransferStatusUpdate(ctx context.Context, st *drpc.TransferStatus) {
 	ctx, span := d.Tracer.Start(ctx, "sendTransferStatusUpdate")
 	defer span.End()
@@ -497,7 +1158,7 @@ func (s *Shuttle) handleRpcReqTxStatus(ctx context.Context, req *drpc.ReqTxStatu
 		return nil
 	}
 
-	trsFailed, msg := util.TransferFailed(st)
+	trsFailed, msg := s.transferFailed(req.ChanID, st)
 	s.sendTransferStatusUpdate(ctx, &drpc.TransferStatus{
 		Chanid:   req.ChanID,
 		DealDBID: req.DealDBID,
@@ -508,6 +1169,60 @@ func (s *Shuttle) handleRpcReqTxStatus(ctx context.Context, req *drpc.ReqTxStatu
 	return nil
 }
 
+func (s *Shuttle) handleRpcListActiveTransfers(ctx context.Context, req *drpc.ListActiveTransfers) error {
+	ctx, span := s.Tracer.Start(ctx, "handleListActiveTransfers")
+	defer span.End()
+
+	s.tcLk.Lock()
+	transfers := make([]drpc.ActiveTransfer, 0, len(s.trackingChannels))
+	for chid, trk := range s.trackingChannels {
+		transfers = append(transfers, drpc.ActiveTransfer{
+			DealDBID: trk.Dbid,
+			Chanid:   chid,
+			State:    trk.Last,
+		})
+	}
+	s.tcLk.Unlock()
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].DealDBID < transfers[j].DealDBID
+	})
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ActiveTransfers,
+		Params: drpc.MsgParams{
+			ActiveTransfers: &drpc.ActiveTransfers{
+				Transfers: transfers,
+			},
+		},
+	})
+}
+
+func (s *Shuttle) handleRpcSetLogLevel(ctx context.Context, req *drpc.SetLogLevel) error {
+	if req == nil {
+		return fmt.Errorf("set log level command is missing its params")
+	}
+
+	res := &drpc.LogLevelSet{
+		Subsystem: req.Subsystem,
+		Level:     req.Level,
+	}
+
+	if err := logging.SetLogLevel(req.Subsystem, req.Level); err != nil {
+		log.Warnf("failed to set log level of %s to %s: %s", req.Subsystem, req.Level, err)
+		res.Error = err.Error()
+	} else {
+		log.Infof("log level of %s set to %s", req.Subsystem, req.Level)
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_LogLevelSet,
+		Params: drpc.MsgParams{
+			LogLevelSet: res,
+		},
+	})
+}
+
 func (s *Shuttle) handleRpcRetrieveContent(ctx context.Context, req *drpc.RetrieveContent) error {
 	return s.retrieveContent(ctx, req)
 }
@@ -578,6 +1293,10 @@ func (s *Shuttle) finishSplit(cont uint) {
 }
 
 func (s *Shuttle) handleRpcSplitContent(ctx context.Context, req *drpc.SplitContent) error {
+	if s.retrievalOnly() {
+		return errRetrievalOnly
+	}
+
 	// only progress if split is not allready in progress
 	if !s.markStartSplit(req.Content) {
 		return nil
@@ -612,27 +1331,116 @@ func (s *Shuttle) handleRpcSplitContent(ctx context.Context, req *drpc.SplitCont
 		return nil
 	}
 
+	if err := checkWritable(pin); err != nil {
+		return err
+	}
+
 	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
-	b := dagsplit.NewBuilder(dserv, uint64(req.Size), 0)
-	if err := b.Pack(ctx, pin.Cid.CID); err != nil {
+	b, err := s.packSplit(ctx, dserv, pin, uint64(req.Size))
+	if err != nil {
 		return err
 	}
 
 	cst := cbor.NewCborStore(s.Node.Blockstore)
 
 	var boxCids []cid.Cid
+	boxSet := cid.NewSet()
 	for _, box := range b.Boxes() {
 		cc, err := cst.Put(ctx, box)
 		if err != nil {
 			return err
 		}
 		boxCids = append(boxCids, cc)
+		boxSet.Add(cc)
+	}
+
+	// the boxes of a DAG are always the same for a given size, so the
+	// children left by a split that failed partway are found by their cid
+	var existing []Pin
+	if err := s.DB.Find(&existing, "split_from = ?", req.Content).Error; err != nil {
+		return err
+	}
+
+	children := make(map[cid.Cid]Pin, len(existing))
+	for _, c := range existing {
+		if !boxSet.Has(c.Cid.CID) {
+			return fmt.Errorf("content %d was partially split into pieces that do not match a split of size %d", req.Content, req.Size)
+		}
+		children[c.Cid.CID] = c
 	}
 
 	for i, c := range boxCids {
+		child, ok := children[c]
+		if ok && child.Active {
+			// created by a previous attempt, estuary may have missed its pin complete
+			if err := s.resendPinComplete(ctx, child); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := s.splitChild(ctx, pin, i, c, child.Content, dserv); err != nil {
+			return err
+		}
+	}
+
+	if err := s.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
+		"dag_split": true,
+		"size":      0,
+		"active":    false,
+		"pinning":   false,
+	}).Error; err != nil {
+		return err
+	}
+
+	if err := s.DB.Where("pin = ?", pin.ID).Delete(&ObjRef{}).Error; err != nil {
+		return err
+	}
+
+	s.sendSplitContentComplete(ctx, pin.Content)
+	return nil
+}
+
+// packSplit packs the dag of a pin into boxes of the given size, checkpointing
+// after every box. A failed pack is retried from its last checkpoint, a pack
+// interrupted by a restart resumes from it when the split is requested again.
+// The checkpoint of a pack that still fails after its retries is removed.
+func (s *Shuttle) packSplit(ctx context.Context, dserv ipld.DAGService, pin Pin, size uint64) (*dagsplit.Builder, error) {
+	cfg := s.config().Split
+
+	var b *dagsplit.Builder
+	var err error
+	for attempt := 0; attempt <= cfg.Retries; attempt++ {
+		if attempt > 0 {
+			log.Warnf("packing content %d for split failed, retrying from the last completed box (%d/%d): %s", pin.Content, attempt, cfg.Retries, err)
+		}
+
+		b = dagsplit.NewBuilder(dserv, size, 0)
+		b.SetCheckpointDir(cfg.CheckpointDir)
+		if err = b.Pack(ctx, pin.Cid.CID); err == nil {
+			return b, nil
+		}
+
+		if ctx.Err() != nil {
+			// interrupted, not given up on
+			return nil, err
+		}
+	}
+
+	if rerr := b.RemoveCheckpoint(pin.Cid.CID); rerr != nil {
+		log.Errorf("failed to remove the split checkpoint of content %d: %s", pin.Content, rerr)
+	}
+	return nil, err
+}
+
+// splitChild creates and tracks the content of the i-th box of a split, or
+// finishes tracking the content contid created for it by a previous attempt
+func (s *Shuttle) splitChild(ctx context.Context, pin Pin, i int, c cid.Cid, contid uint, dserv ipld.NodeGetter) error {
+	if contid == 0 {
 		fname := fmt.Sprintf("split-%09d", i)
 
-		contid, err := s.shuttleCreateContent(ctx, pin.UserID, c, fname, "", pin.Content)
+		var err error
+		contid, err = s.shuttleCreateContent(ctx, pin.UserID, c, fname, "", pin.Content)
 		if err != nil {
 			return err
 		}
@@ -650,28 +1458,13 @@ func (s *Shuttle) handleRpcSplitContent(ctx context.Context, req *drpc.SplitCont
 		if err := s.DB.Create(cpin).Error; err != nil {
 			return xerrors.Errorf("failed to track new content in database: %w", err)
 		}
-
-		totalSize, objects, err := s.addDatabaseTrackingToContent(ctx, contid, dserv, s.Node.Blockstore, c, func(int64) {})
-		if err != nil {
-			return err
-		}
-		s.sendPinCompleteMessage(ctx, contid, totalSize, objects)
 	}
 
-	if err := s.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
-		"dag_split": true,
-		"size":      0,
-		"active":    false,
-		"pinning":   false,
-	}).Error; err != nil {
-		return err
-	}
-
-	if err := s.DB.Where("pin = ?", pin.ID).Delete(&ObjRef{}).Error; err != nil {
+	totalSize, objects, err := s.addDatabaseTrackingToContent(ctx, contid, dserv, s.Node.Blockstore, c, func(int64) {})
+	if err != nil {
 		return err
 	}
-
-	s.sendSplitContentComplete(ctx, pin.Content)
+	s.sendPinCompleteMessage(ctx, contid, totalSize, objects)
 	return nil
 }
 
@@ -688,7 +1481,7 @@ func (s *Shuttle) handleRpcRestartTransfer(ctx context.Context, req *drpc.Restar
 
 	cannotRestart := !util.CanRestartTransfer(st)
 	if cannotRestart {
-		if trsFailed, msg := util.TransferFailed(st); trsFailed {
+		if trsFailed, msg := s.transferFailed(req.ChanID.String(), st); trsFailed {
 			s.sendTransferStatusUpdate(ctx, &drpc.TransferStatus{
 				DealDBID: req.DealDBID,
 				Chanid:   req.ChanID.String(),
@@ -714,3 +1507,191 @@ func (s *Shuttle) handleRpcRestartTransfer(ctx context.Context, req *drpc.Restar
 	s.trackTransfer(&req.ChanID, req.DealDBID, st)
 	return nil
 }
+
+func (s *Shuttle) handleRpcQueueStats(ctx context.Context, req *drpc.QueueStatsRequest) error {
+	ctx, span := s.Tracer.Start(ctx, "handleQueueStats")
+	defer span.End()
+
+	retrQueued, retrActive := s.retrievalLimit.stats()
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_QueueStats,
+		Params: drpc.MsgParams{
+			QueueStats: &drpc.QueueStats{
+				PinQueueSize:       s.PinMgr.PinQueueSize(),
+				ActivePins:         s.PinMgr.ActivePinCount(),
+				UserQueueSizes:     s.PinMgr.PinQueueSizeByUser(),
+				RetrievalQueueSize: retrQueued,
+				ActiveRetrievals:   retrActive,
+				PausedUsers:        s.PinMgr.PausedUsers(),
+			},
+		},
+	})
+}
+
+const healthCheckDBTimeout = time.Second * 2
+
+func (s *Shuttle) handleRpcHealthCheck(ctx context.Context, req *drpc.HealthCheck) error {
+	ctx, span := s.Tracer.Start(ctx, "handleHealthCheck")
+	defer span.End()
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_HealthReport,
+		Params: drpc.MsgParams{
+			HealthReport: s.healthReport(ctx),
+		},
+	})
+}
+
+// healthReport gathers the resource usage of the shuttle, only the database
+// check can take a while and it is bounded by healthCheckDBTimeout
+func (s *Shuttle) healthReport(ctx context.Context) *drpc.HealthReport {
+	rep := &drpc.HealthReport{
+		PinQueueSize: s.PinMgr.PinQueueSize(),
+		ActivePins:   s.PinMgr.ActivePinCount(),
+		Goroutines:   runtime.NumGoroutine(),
+		PausedUsers:  s.PinMgr.PausedUsers(),
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(s.Node.StorageDir, &st); err != nil {
+		log.Errorf("failed to get blockstore disk usage: %s", err)
+	} else {
+		rep.BlockstoreSize = st.Blocks * uint64(st.Bsize)
+		rep.BlockstoreFree = st.Bavail * uint64(st.Bsize)
+	}
+
+	s.tcLk.Lock()
+	rep.ActiveTransfers = len(s.trackingChannels)
+	s.tcLk.Unlock()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	rep.MemoryAlloc = ms.HeapAlloc
+	rep.MemorySys = ms.Sys
+
+	dbctx, cancel := context.WithTimeout(ctx, healthCheckDBTimeout)
+	defer cancel()
+
+	sqldb, err := s.DB.DB()
+	if err == nil {
+		err = sqldb.PingContext(dbctx)
+	}
+
+	if err != nil {
+		rep.DBError = err.Error()
+	} else {
+		rep.DBHealthy = true
+	}
+	return rep
+}
+
+func (s *Shuttle) handleRpcGetContentPeers(ctx context.Context, req *drpc.GetContentPeers) error {
+	ctx, span := s.Tracer.Start(ctx, "handleGetContentPeers", trace.WithAttributes(
+		attribute.Int64("contID", int64(req.DBID)),
+	))
+	defer span.End()
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", req.DBID).Error; err != nil {
+		return err
+	}
+
+	var pinPeers []PinPeer
+	if err := s.DB.Find(&pinPeers, "pin = ?", pin.ID).Error; err != nil {
+		return err
+	}
+
+	peers := make([]drpc.ContentPeer, 0, len(pinPeers))
+	for _, pp := range pinPeers {
+		p, err := peer.Decode(pp.Peer)
+		if err != nil {
+			log.Warnf("invalid peer id recorded for content %d: %s", req.DBID, err)
+			continue
+		}
+
+		peers = append(peers, drpc.ContentPeer{
+			ID:     p,
+			Origin: pp.Origin,
+		})
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ContentPeers,
+		Params: drpc.MsgParams{
+			ContentPeers: &drpc.ContentPeers{
+				DBID:  req.DBID,
+				Peers: peers,
+			},
+		},
+	})
+}
+
+func (s *Shuttle) handleRpcRelocatePin(ctx context.Context, req *drpc.RelocatePin) error {
+	_, span := s.Tracer.Start(ctx, "handleRelocatePin")
+	defer span.End()
+
+	if s.Node.Tiered == nil {
+		return fmt.Errorf("cannot relocate pins: no secondary blockstore configured")
+	}
+
+	// outlives the command, so it gets its own span
+	go func() {
+		ctx, span := s.Tracer.Start(context.Background(), "relocatePins")
+		defer span.End()
+
+		var relocated, failed []uint
+		for _, cont := range req.Contents {
+			if err := s.relocatePin(ctx, cont); err != nil {
+				log.Errorf("failed to relocate content %d: %s", cont, err)
+				failed = append(failed, cont)
+				continue
+			}
+			relocated = append(relocated, cont)
+		}
+
+		if err := s.sendRpcMessage(ctx, &drpc.Message{
+			Op: drpc.OP_RelocatePinDone,
+			Params: drpc.MsgParams{
+				RelocatePinDone: &drpc.RelocatePinDone{
+					Relocated: relocated,
+					Failed:    failed,
+				},
+			},
+		}); err != nil {
+			log.Errorf("failed to send relocate pin result: %s", err)
+		}
+	}()
+	return nil
+}
+
+// relocatePin moves all the blocks of a pin to the secondary blockstore, the
+// originals are only deleted once every copy is verified
+func (s *Shuttle) relocatePin(ctx context.Context, cont uint) error {
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", cont).Error; err != nil {
+		return err
+	}
+
+	if !pin.Active {
+		return fmt.Errorf("pin is not active")
+	}
+
+	objs, err := s.objectsForPin(ctx, pin.ID)
+	if err != nil {
+		return err
+	}
+
+	cids := make([]cid.Cid, 0, len(objs))
+	for _, o := range objs {
+		cids = append(cids, o.Cid.CID)
+	}
+
+	if pin.UntrackedLeaves > 0 {
+		leaves, err := s.pinUntrackedLeaves(ctx, pin.Cid.CID)
+		if err != nil {
+			return err
+		}
+		cids = append(cids, leaves.Keys()...)
+	}
+	return s.Node.Tiered.Relocate(ctx, cids)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/node"
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
+	marketv8 "github.com/filecoin-project/go-state-types/builtin/v8/market"
+	"github.com/filecoin-project/go-state-types/crypto"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-unixfs"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+)
+
+// newTestShuttle returns a shuttle backed by a fresh database and an in memory
+// blockstore, with no connection to estuary
+func newTestShuttle(t *testing.T) *Shuttle {
+	db, err := setupDatabase("sqlite=" + filepath.Join(t.TempDir(), "shuttle.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := node.NewBlockSources(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Shuttle{
+		Node: &node.Node{
+			Blockstore:   blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore())),
+			BlockSources: sources,
+		},
+		DB:            db,
+		Tracer:        otel.Tracer("shuttle_test"),
+		outgoing:      make(chan *drpc.Message, 16),
+		outbox:        &rpcOutbox{db: db},
+		dbWriter:      newDBWriter(1),
+		dagWalkSem:    make(chan struct{}, 1),
+		commpRuns:     newCommpRuns(),
+		shuttleConfig: config.NewShuttle("test"),
+	}
+}
+
+// newAggrTestShuttle returns a test shuttle that can aggregate content
+func newAggrTestShuttle(t *testing.T) *Shuttle {
+	s := newTestShuttle(t)
+	s.aggrInProgress = make(map[uint]bool)
+	return s
+}
+
+func newAggrTestCmd(t *testing.T, s *Shuttle) *drpc.AggregateContent {
+	childRoot := blocks.NewBlock([]byte("aggregate child")).Cid()
+	child := &Pin{Content: 1, Cid: util.DbCID{CID: childRoot}, UserID: 1, Size: 100, Active: true}
+	if err := s.DB.Create(child).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	box := unixfs.EmptyDirNode()
+	if err := box.AddRawLink("1-child", &ipld.Link{Size: 100, Cid: childRoot}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &drpc.AggregateContent{
+		DBID:     2,
+		UserID:   1,
+		Contents: []uint{1},
+		Root:     box.Cid(),
+		ObjData:  box.RawData(),
+	}
+}
+
+func checkAggregateComplete(t *testing.T, s *Shuttle, cmd *drpc.AggregateContent) {
+	a := assert.New(t)
+
+	var pins []Pin
+	a.NoError(s.DB.Find(&pins, "content = ?", cmd.DBID).Error)
+	if !a.Len(pins, 1) {
+		return
+	}
+	a.True(pins[0].Active)
+	a.False(pins[0].Pinning)
+	a.True(pins[0].Aggregate)
+	a.Equal(int64(100+len(cmd.ObjData)), pins[0].Size)
+
+	objs, err := s.objectsForPin(context.Background(), pins[0].ID)
+	a.NoError(err)
+	if a.Len(objs, 1) {
+		a.Equal(cmd.Root, objs[0].Cid.CID)
+	}
+
+	has, err := s.Node.Blockstore.Has(context.Background(), cmd.Root)
+	a.NoError(err)
+	a.True(has)
+
+	select {
+	case msg := <-s.outgoing:
+		a.Equal(drpc.OP_PinComplete, msg.Op)
+		a.Equal(cmd.DBID, msg.Params.PinComplete.DBID)
+		a.Len(msg.Params.PinComplete.Objects, 1)
+	default:
+		t.Fatal("expected a pin complete message to be sent")
+	}
+
+	select {
+	case msg := <-s.outgoing:
+		a.Equal(drpc.OP_AggregateComplete, msg.Op)
+		a.Equal(cmd.DBID, msg.Params.AggregateComplete.DBID)
+		a.Equal([]drpc.AggregateMember{{DBID: 1, Size: 100}}, msg.Params.AggregateComplete.Members)
+	default:
+		t.Fatal("expected an aggregate complete message to be sent")
+	}
+}
+
+func TestAggregateStagedContent(t *testing.T) {
+	s := newAggrTestShuttle(t)
+	cmd := newAggrTestCmd(t, s)
+
+	assert.NoError(t, s.handleRpcAggregateStagedContent(context.Background(), cmd))
+	checkAggregateComplete(t, s, cmd)
+
+	// asking again must resend the pin complete without duplicating anything,
+	// even once the members can't be aggregated anymore
+	assert.NoError(t, s.DB.Model(Pin{}).Where("content = ?", 1).UpdateColumn("read_only", true).Error)
+	assert.NoError(t, s.handleRpcAggregateStagedContent(context.Background(), cmd))
+	checkAggregateComplete(t, s, cmd)
+}
+
+func TestAggregateStagedContentNotInline(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newAggrTestShuttle(t)
+	cmd := newAggrTestCmd(t, s)
+
+	blk, err := blocks.NewBlockWithCid(cmd.ObjData, cmd.Root)
+	a.NoError(err)
+	cmd.ObjData = nil
+
+	// without the block nor anyone to fetch it from there is nothing to do
+	a.Error(s.handleRpcAggregateStagedContent(ctx, cmd))
+
+	// the block got here before, e.g. by an earlier attempt
+	a.NoError(s.Node.Blockstore.Put(ctx, blk))
+	a.NoError(s.handleRpcAggregateStagedContent(ctx, cmd))
+	a.Equal(blk.RawData(), cmd.ObjData)
+	checkAggregateComplete(t, s, cmd)
+}
+
+func TestAggregateStagedContentBadData(t *testing.T) {
+	s := newAggrTestShuttle(t)
+	cmd := newAggrTestCmd(t, s)
+	cmd.ObjData = []byte("corrupted aggregate box")
+
+	assert.Error(t, s.handleRpcAggregateStagedContent(context.Background(), cmd))
+
+	has, err := s.Node.Blockstore.Has(context.Background(), cmd.Root)
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	var count int64
+	assert.NoError(t, s.DB.Model(Pin{}).Where("content = ?", cmd.DBID).Count(&count).Error)
+	assert.Zero(t, count)
+	assert.Len(t, s.outgoing, 0)
+}
+
+func TestAggregateStagedContentRecovery(t *testing.T) {
+	// each case leaves behind the state of a crash at a different step
+	cases := map[string]func(t *testing.T, s *Shuttle, cmd *drpc.AggregateContent){
+		"after creating the pin": func(t *testing.T, s *Shuttle, cmd *drpc.AggregateContent) {
+			createAggrTestPin(t, s, cmd)
+		},
+		"after putting the block": func(t *testing.T, s *Shuttle, cmd *drpc.AggregateContent) {
+			createAggrTestPin(t, s, cmd)
+			putAggrTestBlock(t, s, cmd)
+		},
+		"after creating the object": func(t *testing.T, s *Shuttle, cmd *drpc.AggregateContent) {
+			pin := createAggrTestPin(t, s, cmd)
+			blk := putAggrTestBlock(t, s, cmd)
+			if _, err := s.getOrCreateAggregateObject(context.Background(), pin.ID, blk); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+
+	for name, crash := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := newAggrTestShuttle(t)
+			cmd := newAggrTestCmd(t, s)
+			crash(t, s, cmd)
+
+			assert.NoError(t, s.handleRpcAggregateStagedContent(context.Background(), cmd))
+			checkAggregateComplete(t, s, cmd)
+		})
+	}
+}
+
+func createAggrTestPin(t *testing.T, s *Shuttle, cmd *drpc.AggregateContent) *Pin {
+	pin := &Pin{
+		Content:   cmd.DBID,
+		Cid:       util.DbCID{CID: cmd.Root},
+		UserID:    cmd.UserID,
+		Size:      int64(100 + len(cmd.ObjData)),
+		Pinning:   true,
+		Aggregate: true,
+	}
+	if err := s.DB.Create(pin).Error; err != nil {
+		t.Fatal(err)
+	}
+	return pin
+}
+
+func putAggrTestBlock(t *testing.T, s *Shuttle, cmd *drpc.AggregateContent) blocks.Block {
+	blk, err := blocks.NewBlockWithCid(cmd.ObjData, cmd.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Node.Blockstore.Put(context.Background(), blk); err != nil {
+		t.Fatal(err)
+	}
+	return blk
+}
+
+func newTestStartTransfer(t *testing.T, duration abi.ChainEpoch, price int64) *drpc.StartTransfer {
+	client, _ := address.NewIDAddress(1001)
+	provider, _ := address.NewIDAddress(1002)
+	prop := &marketv8.ClientDealProposal{
+		Proposal: marketv8.DealProposal{
+			PieceCID:             blocks.NewBlock([]byte("piece")).Cid(),
+			PieceSize:            1 << 30,
+			Client:               client,
+			Provider:             provider,
+			StartEpoch:           100,
+			EndEpoch:             100 + duration,
+			StoragePricePerEpoch: abi.NewTokenAmount(price),
+			ProviderCollateral:   abi.NewTokenAmount(0),
+			ClientCollateral:     abi.NewTokenAmount(0),
+		},
+		ClientSignature: crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: []byte("signature")},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := prop.MarshalCBOR(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	nd, err := cborutil.AsIpld(prop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxPrice := abi.NewTokenAmount(10)
+	return &drpc.StartTransfer{
+		PropCid:  nd.Cid(),
+		Proposal: buf.Bytes(),
+		MaxPrice: &maxPrice,
+	}
+}
+
+func TestCheckDealProposal(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(checkDealProposal(newTestStartTransfer(t, constants.DealDuration, 10)))
+	a.NoError(checkDealProposal(newTestStartTransfer(t, constants.MinSafeDealLifetime, 1)))
+
+	// the proposal itself has to last an allowed duration
+	a.Error(checkDealProposal(newTestStartTransfer(t, constants.MinSafeDealLifetime-1, 10)))
+	a.Error(checkDealProposal(newTestStartTransfer(t, constants.MaxDealDuration+1, 10)))
+
+	a.Error(checkDealProposal(newTestStartTransfer(t, constants.DealDuration, 11)))
+
+	st := newTestStartTransfer(t, constants.DealDuration, 10)
+	st.PropCid = blocks.NewBlock([]byte("other proposal")).Cid()
+	a.Error(checkDealProposal(st))
+
+	// nothing to check against without a ceiling
+	st = newTestStartTransfer(t, constants.MinSafeDealLifetime-1, 11)
+	st.MaxPrice = nil
+	a.NoError(checkDealProposal(st))
+}
+
+func TestCheckTakenPins(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+
+	for _, p := range []*Pin{
+		{Content: 1, Active: true},
+		{Content: 2, Failed: true},
+		{Content: 3, Pinning: true},
+	} {
+		a.NoError(s.DB.Create(p).Error)
+	}
+
+	// the pin of content 4 was rejected, content 3 is still pinning
+	done := s.checkTakenPins(map[uint]struct{}{1: {}, 2: {}, 3: {}, 4: {}})
+	a.Equal(map[uint]bool{1: true, 2: false, 4: false}, done)
+}
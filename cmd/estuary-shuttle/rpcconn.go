@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+)
+
+// errNotConnected is returned when sending messages to estuary while the rpc
+// connection is down, durable messages are still kept in the outbox
+var errNotConnected = errors.New("not connected to estuary")
+
+// rpcConnState tracks whether the rpc connection to estuary is up, so that
+// senders don't pile up waiting on a queue nobody reads. A nil state is
+// always connected.
+type rpcConnState struct {
+	mode string
+
+	lk        sync.Mutex
+	connected bool
+	since     time.Time
+}
+
+func newRPCConnState(mode string) *rpcConnState {
+	return &rpcConnState{
+		mode:  mode,
+		since: time.Now(),
+	}
+}
+
+func (cs *rpcConnState) setConnected(connected bool) {
+	if cs == nil {
+		return
+	}
+
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+
+	if cs.connected == connected {
+		return
+	}
+	cs.connected = connected
+	cs.since = time.Now()
+}
+
+func (cs *rpcConnState) isConnected() bool {
+	if cs == nil {
+		return true
+	}
+
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+	return cs.connected
+}
+
+// sendAction is what becomes of a message sent to estuary
+type sendAction int
+
+const (
+	// sendQueue waits for room on the outgoing queue
+	sendQueue sendAction = iota
+	// sendBuffer puts the message on the outgoing queue if it has room, to
+	// go out once reconnected
+	sendBuffer
+	// sendOutbox leaves the message to the outbox, it is replayed once
+	// reconnected
+	sendOutbox
+)
+
+// checkSend reports what becomes of a message, or the error to fail it with
+// while disconnected
+func (cs *rpcConnState) checkSend(msg *drpc.Message) (sendAction, error) {
+	if cs.isConnected() {
+		return sendQueue, nil
+	}
+
+	switch cs.mode {
+	case config.DisconnectedSendBlock:
+		return sendQueue, nil
+	case config.DisconnectedSendBuffer:
+		if msg.ID != 0 {
+			return sendOutbox, nil
+		}
+		return sendBuffer, nil
+	default:
+		return sendQueue, errNotConnected
+	}
+}
+
+type rpcConnStatus struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+	Mode      string    `json:"disconnectedSend"`
+}
+
+func (cs *rpcConnState) status() rpcConnStatus {
+	if cs == nil {
+		return rpcConnStatus{Connected: true}
+	}
+
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+
+	return rpcConnStatus{
+		Connected: cs.connected,
+		Since:     cs.since,
+		Mode:      cs.mode,
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendWhileDisconnected(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.rpcConn = newRPCConnState(config.DisconnectedSendBuffer)
+
+	// durable messages wait in the outbox, the others on the outgoing queue
+	// until it is full
+	a.NoError(s.sendRpcMessage(ctx, &drpc.Message{Op: drpc.OP_PinComplete, Params: drpc.MsgParams{PinComplete: &drpc.PinComplete{DBID: 1}}}))
+	a.Empty(s.outgoing)
+	for i := 0; i < cap(s.outgoing); i++ {
+		a.NoError(s.sendRpcMessage(ctx, &drpc.Message{Op: drpc.OP_QueueStats}))
+	}
+	a.ErrorIs(s.sendRpcMessage(ctx, &drpc.Message{Op: drpc.OP_QueueStats}), errNotConnected)
+	a.Len(s.outgoing, cap(s.outgoing))
+
+	pending, err := s.outbox.pending()
+	a.NoError(err)
+	a.Len(pending, 1)
+
+	for len(s.outgoing) > 0 {
+		<-s.outgoing
+	}
+
+	s.rpcConn.mode = config.DisconnectedSendFail
+	a.ErrorIs(s.sendRpcMessage(ctx, &drpc.Message{Op: drpc.OP_PinComplete, Params: drpc.MsgParams{PinComplete: &drpc.PinComplete{DBID: 2}}}), errNotConnected)
+	a.ErrorIs(s.sendRpcMessage(ctx, &drpc.Message{Op: drpc.OP_QueueStats}), errNotConnected)
+	a.Empty(s.outgoing)
+
+	s.rpcConn.setConnected(true)
+	a.True(s.rpcConn.status().Connected)
+	a.NoError(s.sendRpcMessage(ctx, &drpc.Message{Op: drpc.OP_QueueStats}))
+	a.Len(s.outgoing, 1)
+}
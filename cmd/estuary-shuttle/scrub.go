@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// watchIntegrity periodically checks a sample of the blocks of a few active
+// pins, so bit rot is found before a retrieval fails on it
+func (s *Shuttle) watchIntegrity(cfg config.Scrub) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.scrubPins(context.TODO(), cfg); err != nil {
+			log.Errorf("failed to scrub pins: %s", err)
+		}
+	}
+}
+
+// scrubPins checks the active pins following a random id, wrapping around to
+// the first ones, so picking them walks the primary key index instead of
+// sorting the whole table
+func (s *Shuttle) scrubPins(ctx context.Context, cfg config.Scrub) error {
+	var bounds struct {
+		Lo uint
+		Hi uint
+	}
+	if err := s.DB.Model(Pin{}).Select("coalesce(min(id), 0) as lo, coalesce(max(id), 0) as hi").Scan(&bounds).Error; err != nil {
+		return err
+	}
+
+	if bounds.Hi == 0 {
+		return nil
+	}
+
+	start := bounds.Lo + uint(rand.Int63n(int64(bounds.Hi-bounds.Lo)+1))
+
+	var pins []Pin
+	if err := s.DB.Where("id >= ? and active and not pinning", start).Order("id asc").Limit(cfg.PinsPerRun).Find(&pins).Error; err != nil {
+		return err
+	}
+
+	if len(pins) < cfg.PinsPerRun {
+		var wrapped []Pin
+		if err := s.DB.Where("id < ? and active and not pinning", start).Order("id asc").Limit(cfg.PinsPerRun - len(pins)).Find(&wrapped).Error; err != nil {
+			return err
+		}
+		pins = append(pins, wrapped...)
+	}
+
+	for _, pin := range pins {
+		if err := s.scrubPin(ctx, pin, cfg.SampleFraction); err != nil {
+			log.Errorf("failed to scrub pin of content %d: %s", pin.Content, err)
+		}
+	}
+	return nil
+}
+
+// scrubPin checks a sample of the blocks of a pin against their cids. The pin
+// is marked inactive and lets go of its corrupted blocks before estuary is
+// told, so pinning the content again fetches the bad blocks back. A corrupted
+// block other pins still hold is kept until they are scrubbed too.
+func (s *Shuttle) scrubPin(ctx context.Context, pin Pin, fraction float64) error {
+	objs, err := s.objectsForPin(ctx, pin.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(objs) == 0 {
+		return nil
+	}
+
+	n := int(math.Ceil(float64(len(objs)) * fraction))
+	rand.Shuffle(len(objs), func(i, j int) {
+		objs[i], objs[j] = objs[j], objs[i]
+	})
+
+	var missing, corrupted []cid.Cid
+	var corruptedObjs []*Object
+	for _, o := range objs[:n] {
+		ok, found, err := s.checkBlock(ctx, o.Cid.CID)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			missing = append(missing, o.Cid.CID)
+		} else if !ok {
+			corrupted = append(corrupted, o.Cid.CID)
+			corruptedObjs = append(corruptedObjs, o)
+		}
+	}
+
+	if len(missing) == 0 && len(corrupted) == 0 {
+		return nil
+	}
+
+	log.Warnf("scrub of content %d found %d missing and %d corrupted blocks out of %d checked", pin.Content, len(missing), len(corrupted), n)
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
+			"active":  false,
+			"pinning": false,
+		}).Error; err != nil {
+			return err
+		}
+
+		if len(corruptedObjs) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(corruptedObjs))
+		for i, o := range corruptedObjs {
+			ids[i] = o.ID
+		}
+		return tx.Where("pin = ? and object in ?", pin.ID, ids).Delete(ObjRef{}).Error
+	}); err != nil {
+		return err
+	}
+
+	if err := s.clearUnreferencedObjects(ctx, corruptedObjs); err != nil {
+		return fmt.Errorf("failed to clear corrupted objects: %w", err)
+	}
+
+	for _, o := range corruptedObjs {
+		deleted, err := s.deleteIfNotPinned(ctx, o)
+		if err != nil {
+			return fmt.Errorf("failed to delete corrupted block %s: %w", o.Cid.CID, err)
+		}
+
+		if !deleted {
+			log.Warnf("kept corrupted block %s of content %d, other pins still hold it", o.Cid.CID, pin.Content)
+		}
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_IntegrityAlert,
+		Params: drpc.MsgParams{
+			IntegrityAlert: &drpc.IntegrityAlert{
+				DBID:      pin.Content,
+				Cid:       pin.Cid.CID,
+				Missing:   missing,
+				Corrupted: corrupted,
+			},
+		},
+	})
+}
+
+// checkBlock reads a block from the blockstore and hashes its data again,
+// ok is false if the data does not match the cid
+func (s *Shuttle) checkBlock(ctx context.Context, c cid.Cid) (ok bool, found bool, err error) {
+	// the data of inline cids is the cid itself
+	if util.IsInlineCid(c) {
+		return true, true, nil
+	}
+
+	blk, err := s.Node.Blockstore.Get(ctx, c)
+	if err != nil {
+		if ipld.IsNotFound(err) {
+			return false, false, nil
+		}
+
+		// blockstores hashing on read do the check themselves
+		if xerrors.Is(err, blockstore.ErrHashMismatch) {
+			return false, true, nil
+		}
+		return false, false, err
+	}
+
+	sum, err := c.Prefix().Sum(blk.RawData())
+	if err != nil {
+		return false, true, err
+	}
+	return sum.Equals(c), true, nil
+}
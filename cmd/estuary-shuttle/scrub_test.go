@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrubPin(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	good := blocks.NewBlock([]byte("good block"))
+	missing := blocks.NewBlock([]byte("missing block"))
+	// data stored under the cid of other data
+	bad, err := blocks.NewBlockWithCid([]byte("rotten block"), blocks.NewBlock([]byte("bad block")).Cid())
+	a.NoError(err)
+
+	a.NoError(s.Node.Blockstore.Put(ctx, good))
+	a.NoError(s.Node.Blockstore.Put(ctx, bad))
+
+	pin := &Pin{Content: 1, Cid: util.DbCID{CID: good.Cid()}, UserID: 1, Active: true}
+	a.NoError(s.DB.Create(pin).Error)
+	for _, c := range []blocks.Block{good, missing, bad} {
+		obj := &Object{Cid: util.DbCID{CID: c.Cid()}, Size: len(c.RawData())}
+		a.NoError(s.DB.Create(obj).Error)
+		a.NoError(s.DB.Create(&ObjRef{Pin: pin.ID, Object: obj.ID}).Error)
+	}
+
+	a.NoError(s.scrubPin(ctx, *pin, 1))
+
+	msg := <-s.outgoing
+	a.Equal(drpc.OP_IntegrityAlert, msg.Op)
+	a.Equal(uint(1), msg.Params.IntegrityAlert.DBID)
+	a.Equal(missing.Cid(), msg.Params.IntegrityAlert.Missing[0])
+	a.Equal(bad.Cid(), msg.Params.IntegrityAlert.Corrupted[0])
+
+	// the corrupted block is dropped so pinning again fetches it back
+	has, err := s.Node.Blockstore.Has(ctx, bad.Cid())
+	a.NoError(err)
+	a.False(has)
+
+	var after Pin
+	a.NoError(s.DB.First(&after, pin.ID).Error)
+	a.False(after.Active)
+	a.False(after.Pinning)
+
+	// a healthy pin is left alone
+	s.outgoing = make(chan *drpc.Message, 16)
+	healthy := &Pin{Content: 2, Cid: util.DbCID{CID: good.Cid()}, UserID: 1, Active: true}
+	a.NoError(s.DB.Create(healthy).Error)
+	obj := &Object{Cid: util.DbCID{CID: good.Cid()}, Size: len(good.RawData())}
+	a.NoError(s.DB.Create(obj).Error)
+	a.NoError(s.DB.Create(&ObjRef{Pin: healthy.ID, Object: obj.ID}).Error)
+
+	a.NoError(s.scrubPin(ctx, *healthy, 1))
+	a.Empty(s.outgoing)
+}
+
+func TestScrubSharedCorruptedBlock(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	bad, err := blocks.NewBlockWithCid([]byte("rotten block"), blocks.NewBlock([]byte("bad block")).Cid())
+	a.NoError(err)
+	a.NoError(s.Node.Blockstore.Put(ctx, bad))
+
+	var pins []*Pin
+	for _, content := range []uint{1, 2} {
+		pin := &Pin{Content: content, Cid: util.DbCID{CID: bad.Cid()}, UserID: 1, Active: true}
+		a.NoError(s.DB.Create(pin).Error)
+		obj := &Object{Cid: util.DbCID{CID: bad.Cid()}, Size: len(bad.RawData())}
+		a.NoError(s.DB.Create(obj).Error)
+		a.NoError(s.DB.Create(&ObjRef{Pin: pin.ID, Object: obj.ID}).Error)
+		pins = append(pins, pin)
+	}
+
+	// the other pin still holds the block
+	a.NoError(s.scrubPin(ctx, *pins[0], 1))
+	<-s.outgoing
+
+	has, err := s.Node.Blockstore.Has(ctx, bad.Cid())
+	a.NoError(err)
+	a.True(has)
+
+	objs, err := s.objectsForPin(ctx, pins[0].ID)
+	a.NoError(err)
+	a.Empty(objs)
+
+	a.NoError(s.scrubPin(ctx, *pins[1], 1))
+	<-s.outgoing
+
+	has, err = s.Node.Blockstore.Has(ctx, bad.Cid())
+	a.NoError(err)
+	a.False(has)
+}
+
+func TestScrubPinsWrapsAround(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	missing := blocks.NewBlock([]byte("missing block"))
+	for content := uint(1); content <= 5; content++ {
+		pin := &Pin{Content: content, Cid: util.DbCID{CID: missing.Cid()}, UserID: 1, Active: true}
+		a.NoError(s.DB.Create(pin).Error)
+		obj := &Object{Cid: util.DbCID{CID: missing.Cid()}, Size: len(missing.RawData())}
+		a.NoError(s.DB.Create(obj).Error)
+		a.NoError(s.DB.Create(&ObjRef{Pin: pin.ID, Object: obj.ID}).Error)
+	}
+	a.NoError(s.DB.Create(&Pin{Content: 6, Pinning: true}).Error)
+
+	// every active pin is checked whichever one the run starts from
+	a.NoError(s.scrubPins(ctx, config.Scrub{PinsPerRun: 5, SampleFraction: 1}))
+
+	alerted := make(map[uint]bool)
+	for i := 0; i < 5; i++ {
+		msg := <-s.outgoing
+		alerted[msg.Params.IntegrityAlert.DBID] = true
+	}
+	a.Len(alerted, 5)
+	a.Empty(s.outgoing)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// version of the snapshot format, bumped when the exported rows change in a
+// way older shuttles cannot restore
+const snapshotVersion = 1
+
+const (
+	snapshotHeader = "header"
+	snapshotEnd    = "end"
+
+	// rows flushed to the client or inserted at once
+	snapshotBatchSize = 500
+	// a line holds a single row, the largest are pins with a long pin meta
+	snapshotMaxLineSize = 4 << 20
+	// the largest snapshot a restore reads, a snapshot takes a few hundred
+	// bytes per object
+	snapshotMaxSize = 256 << 30
+)
+
+type snapshotTable struct {
+	name   string
+	newRow func() interface{}
+	// key is the primary key column rows are exported in the order of, only
+	// the sequence of an id key is moved past the restored rows
+	key string
+}
+
+// snapshotTables are the tables holding the pin metadata of the shuttle, in
+// the order they are exported and restored. The outbox is left out, its
+// messages belong to the connection of the shuttle the snapshot comes from.
+var snapshotTables = []snapshotTable{
+	{name: "pin", newRow: func() interface{} { return &Pin{} }, key: "id"},
+	{name: "object", newRow: func() interface{} { return &Object{} }, key: "id"},
+	{name: "obj_ref", newRow: func() interface{} { return &ObjRef{} }, key: "id"},
+	{name: "pin_peer", newRow: func() interface{} { return &PinPeer{} }, key: "id"},
+	{name: "pin_label", newRow: func() interface{} { return &PinLabel{} }, key: "id"},
+	{name: "content_metadata", newRow: func() interface{} { return &ContentMetadata{} }, key: "id"},
+	{name: "user_quota", newRow: func() interface{} { return &UserQuota{} }, key: "user_id"},
+	{name: "paused_user", newRow: func() interface{} { return &PausedUser{} }, key: "user_id"},
+	{name: "replication_policy", newRow: func() interface{} { return &ReplicationPolicy{} }, key: "id"},
+	{name: "tracked_deal", newRow: func() interface{} { return &TrackedDeal{} }, key: "id"},
+}
+
+// snapshotLine is a line of a snapshot. A snapshot starts with a header line
+// carrying the format version, has a line per row, and ends with an end line
+// carrying the number of rows so truncated snapshots are detected.
+type snapshotLine struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version,omitempty"`
+	Created *time.Time      `json:"created,omitempty"`
+	Rows    int64           `json:"rows,omitempty"`
+	Row     json.RawMessage `json:"row,omitempty"`
+}
+
+// handleExportSnapshot streams the pin metadata of the shuttle as NDJSON, the
+// blocks are not included. Every table is read in the same read only
+// transaction so the rows are consistent with each other.
+func (s *Shuttle) handleExportSnapshot(c echo.Context) error {
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	resp.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(resp)
+
+	now := time.Now()
+	if err := enc.Encode(snapshotLine{Type: snapshotHeader, Version: snapshotVersion, Created: &now}); err != nil {
+		return err
+	}
+
+	var total int64
+	if err := s.DB.WithContext(c.Request().Context()).Transaction(func(tx *gorm.DB) error {
+		for _, t := range snapshotTables {
+			n, err := exportSnapshotTable(c, tx, enc, t)
+			if err != nil {
+				return fmt.Errorf("failed to export %s rows: %w", t.name, err)
+			}
+			total += n
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}); err != nil {
+		// the status is already sent, the missing end line marks the
+		// snapshot as incomplete
+		log.Errorf("failed to export snapshot: %s", err)
+		return nil
+	}
+
+	if err := enc.Encode(snapshotLine{Type: snapshotEnd, Rows: total}); err != nil {
+		return err
+	}
+	resp.Flush()
+	return nil
+}
+
+func exportSnapshotTable(c echo.Context, tx *gorm.DB, enc *json.Encoder, t snapshotTable) (int64, error) {
+	rows, err := tx.Model(t.newRow()).Order(t.key + " asc").Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		row := t.newRow()
+		if err := tx.ScanRows(rows, row); err != nil {
+			return n, err
+		}
+
+		b, err := json.Marshal(row)
+		if err != nil {
+			return n, err
+		}
+
+		if err := enc.Encode(snapshotLine{Type: t.name, Row: b}); err != nil {
+			return n, err
+		}
+
+		n++
+		if n%snapshotBatchSize == 0 {
+			c.Response().Flush()
+		}
+	}
+	return n, rows.Err()
+}
+
+// handleRestoreSnapshot restores an exported snapshot into the database of a
+// shuttle that has no pins yet. The whole snapshot is restored in a single
+// transaction so a failed restore leaves the database empty.
+func (s *Shuttle) handleRestoreSnapshot(c echo.Context) error {
+	var pins int64
+	if err := s.DB.Model(Pin{}).Count(&pins).Error; err != nil {
+		return err
+	}
+
+	if pins > 0 {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("snapshots can only be restored on a shuttle without pins, this one has %d", pins),
+		}
+	}
+
+	var restored int64
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		n, err := restoreSnapshot(tx, http.MaxBytesReader(c.Response(), c.Request().Body, snapshotMaxSize))
+		if err != nil {
+			return err
+		}
+		restored = n
+		return resetSnapshotSequences(tx)
+	}); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("failed to restore snapshot: %s", err),
+		}
+	}
+
+	log.Infof("restored %d rows from snapshot", restored)
+	return c.JSON(http.StatusOK, map[string]int64{"rows": restored})
+}
+
+func restoreSnapshot(tx *gorm.DB, r io.Reader) (int64, error) {
+	tables := make(map[string]snapshotTable, len(snapshotTables))
+	for _, t := range snapshotTables {
+		tables[t.name] = t
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), snapshotMaxLineSize)
+
+	var (
+		header   bool
+		restored int64
+		cur      snapshotTable
+		batch    []json.RawMessage
+	)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := insertSnapshotRows(tx, cur, batch); err != nil {
+			return fmt.Errorf("failed to restore %s rows: %w", cur.name, err)
+		}
+		restored += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	for sc.Scan() {
+		var line snapshotLine
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			return 0, err
+		}
+
+		switch line.Type {
+		case snapshotHeader:
+			if header {
+				return 0, fmt.Errorf("snapshot has more than one header")
+			}
+
+			if line.Version < 1 || line.Version > snapshotVersion {
+				return 0, fmt.Errorf("unsupported snapshot version %d, this shuttle supports up to version %d", line.Version, snapshotVersion)
+			}
+			header = true
+		case snapshotEnd:
+			if err := flush(); err != nil {
+				return 0, err
+			}
+
+			if line.Rows != restored {
+				return 0, fmt.Errorf("snapshot ended after %d rows but %d were exported", restored, line.Rows)
+			}
+			return restored, nil
+		default:
+			if !header {
+				return 0, fmt.Errorf("snapshot does not start with a header")
+			}
+
+			t, ok := tables[line.Type]
+			if !ok {
+				return 0, fmt.Errorf("unknown snapshot row type %q", line.Type)
+			}
+
+			if t.name != cur.name {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+				cur = t
+			}
+
+			batch = append(batch, line.Row)
+			if len(batch) >= snapshotBatchSize {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("snapshot is truncated, it has no end line")
+}
+
+func insertSnapshotRows(tx *gorm.DB, t snapshotTable, batch []json.RawMessage) error {
+	rowType := reflect.TypeOf(t.newRow()).Elem()
+	rows := reflect.New(reflect.SliceOf(rowType)).Elem()
+	for _, raw := range batch {
+		row := t.newRow()
+		if err := json.Unmarshal(raw, row); err != nil {
+			return err
+		}
+		rows = reflect.Append(rows, reflect.ValueOf(row).Elem())
+	}
+
+	ptr := reflect.New(rows.Type())
+	ptr.Elem().Set(rows)
+	// estuary may have set quotas and policies since the shuttle started,
+	// the snapshot wins
+	return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(ptr.Interface()).Error
+}
+
+// resetSnapshotSequences moves the id sequences past the restored ids,
+// sqlite does that on its own
+func resetSnapshotSequences(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	for _, t := range snapshotTables {
+		if t.key != "id" {
+			continue
+		}
+
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(t.newRow()); err != nil {
+			return err
+		}
+
+		table := stmt.Schema.Table
+		if err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE((SELECT MAX(id) FROM %s), 0) + 1, false)", table, table)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotRoundtrip(t *testing.T) {
+	src := newTestShuttle(t)
+
+	c, err := cid.Decode("bafkqaaa")
+	require.NoError(t, err)
+
+	pin := &Pin{Content: 7, UserID: 2, Cid: util.DbCID{CID: c}, Size: 10, Active: true}
+	require.NoError(t, src.DB.Create(pin).Error)
+	obj := &Object{Cid: util.DbCID{CID: c}, Size: 10}
+	require.NoError(t, src.DB.Create(obj).Error)
+	require.NoError(t, src.DB.Create(&ObjRef{Pin: pin.ID, Object: obj.ID}).Error)
+	require.NoError(t, setPinLabels(src.DB, pin.ID, []string{"tenant:foo"}))
+	require.NoError(t, src.DB.Create(&UserQuota{UserID: 2, Quota: 100}).Error)
+	require.NoError(t, src.DB.Create(&ReplicationPolicy{Content: 7, MinActiveDeals: 2}).Error)
+	require.NoError(t, src.DB.Create(&TrackedDeal{Content: 7, Miner: "f01000", DealID: 3}).Error)
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	require.NoError(t, src.handleExportSnapshot(e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)))
+
+	snapshot := rec.Body.Bytes()
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(string(snapshot)), `{"type":"end","rows":7}`))
+
+	// estuary set a quota on the new shuttle before the restore
+	dst := newTestShuttle(t)
+	require.NoError(t, dst.DB.Create(&UserQuota{UserID: 2, Quota: 50}).Error)
+	rec = httptest.NewRecorder()
+	require.NoError(t, dst.handleRestoreSnapshot(e.NewContext(httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(snapshot)), rec)))
+
+	var restored Pin
+	require.NoError(t, dst.DB.First(&restored, "content = ?", 7).Error)
+	assert.Equal(t, pin.ID, restored.ID)
+	assert.Equal(t, c, restored.Cid.CID)
+
+	objects, err := dst.objectsForPin(context.Background(), restored.ID)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, obj.ID, objects[0].ID)
+
+	contents, err := dst.contentsByLabel("tenant:foo")
+	require.NoError(t, err)
+	assert.Equal(t, []uint{7}, contents)
+
+	var quota UserQuota
+	require.NoError(t, dst.DB.First(&quota, "user_id = ?", 2).Error)
+	assert.Equal(t, int64(100), quota.Quota)
+
+	var policy ReplicationPolicy
+	require.NoError(t, dst.DB.First(&policy, "content = ?", 7).Error)
+	assert.Equal(t, 2, policy.MinActiveDeals)
+
+	var deals []TrackedDeal
+	require.NoError(t, dst.DB.Find(&deals, "content = ?", 7).Error)
+	require.Len(t, deals, 1)
+	assert.Equal(t, int64(3), deals[0].DealID)
+
+	// a shuttle with pins does not take a snapshot
+	err = dst.handleRestoreSnapshot(e.NewContext(httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(snapshot)), httptest.NewRecorder()))
+	var herr *util.HttpError
+	require.ErrorAs(t, err, &herr)
+	assert.Equal(t, http.StatusConflict, herr.Code)
+}
+
+func TestSnapshotRestoreTruncated(t *testing.T) {
+	src := newTestShuttle(t)
+	require.NoError(t, src.DB.Create(&Pin{Content: 1}).Error)
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	require.NoError(t, src.handleExportSnapshot(e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)))
+
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	truncated := strings.Join(lines[:len(lines)-1], "\n")
+
+	dst := newTestShuttle(t)
+	err := dst.handleRestoreSnapshot(e.NewContext(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(truncated)), httptest.NewRecorder()))
+	require.Error(t, err)
+
+	var pins int64
+	require.NoError(t, dst.DB.Model(Pin{}).Count(&pins).Error)
+	assert.Zero(t, pins)
+}
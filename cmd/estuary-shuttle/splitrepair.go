@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	dagsplit "github.com/application-research/estuary/util/dagsplit"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+)
+
+func (s *Shuttle) handleRpcRepairSplitLinkage(ctx context.Context, req *drpc.RepairSplitLinkage) error {
+	if req == nil {
+		return fmt.Errorf("repair split linkage command is missing its params")
+	}
+
+	res, err := s.repairSplitLinkage(ctx, req.DryRun, req.Parents)
+	if err != nil {
+		res = &drpc.SplitLinkageRepaired{
+			DryRun: req.DryRun,
+			Error:  err.Error(),
+		}
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_SplitLinkageRepaired,
+		Params: drpc.MsgParams{
+			SplitLinkageRepaired: res,
+		},
+	})
+}
+
+// repairSplitLinkage restores the missing parent pins of split children. A
+// parent is rebuilt when all of its children are pinned and their boxes have a
+// single root that no box excludes, which is the root of the split dag. Only
+// the parents estuary confirmed are restored, it may have unpinned the others
+// on purpose. Any other children are reported as orphans.
+func (s *Shuttle) repairSplitLinkage(ctx context.Context, dryRun bool, confirmed []uint) (*drpc.SplitLinkageRepaired, error) {
+	isConfirmed := make(map[uint]bool, len(confirmed))
+	for _, p := range confirmed {
+		isConfirmed[p] = true
+	}
+
+	var children []Pin
+	if err := s.DB.Where("split_from <> 0 AND split_from NOT IN (?)", s.DB.Model(&Pin{}).Select("content")).
+		Order("content asc").Find(&children).Error; err != nil {
+		return nil, err
+	}
+
+	byParent := make(map[uint][]Pin)
+	for _, c := range children {
+		byParent[c.SplitFrom] = append(byParent[c.SplitFrom], c)
+	}
+
+	parents := make([]uint, 0, len(byParent))
+	for p := range byParent {
+		parents = append(parents, p)
+	}
+	sort.Slice(parents, func(i, j int) bool { return parents[i] < parents[j] })
+
+	res := &drpc.SplitLinkageRepaired{DryRun: dryRun}
+	for _, parent := range parents {
+		kids := byParent[parent]
+
+		ids := make([]uint, 0, len(kids))
+		for _, k := range kids {
+			ids = append(ids, k.Content)
+		}
+
+		root, err := s.splitRoot(ctx, kids)
+		if err != nil {
+			log.Warnf("split children %v of content %d lost their parent: %s", ids, parent, err)
+			res.Orphans = append(res.Orphans, drpc.SplitOrphan{
+				Parent:   parent,
+				Children: ids,
+				Reason:   err.Error(),
+			})
+			continue
+		}
+
+		if !dryRun && !isConfirmed[parent] {
+			res.Orphans = append(res.Orphans, drpc.SplitOrphan{
+				Parent:   parent,
+				Children: ids,
+				Reason:   "estuary did not confirm the parent",
+			})
+			continue
+		}
+
+		if !dryRun {
+			// the same pin a completed split leaves, its blocks belong to
+			// the children
+			if err := s.DB.Create(&Pin{
+				Content:  parent,
+				Cid:      util.DbCID{CID: root},
+				UserID:   kids[0].UserID,
+				DagSplit: true,
+			}).Error; err != nil {
+				return nil, fmt.Errorf("failed to restore the parent pin of split content %d: %w", parent, err)
+			}
+			log.Infof("restored the parent pin of split content %d with root %s", parent, root)
+		}
+
+		res.Restored = append(res.Restored, drpc.SplitParent{
+			Content:  parent,
+			Cid:      root,
+			Children: ids,
+		})
+	}
+	return res, nil
+}
+
+// splitRoot finds the root of the dag the children were split from. Every box
+// after the first starts at dags excluded from an earlier box, so the root is
+// the only root never excluded, and a box excluding a dag no child starts at
+// means a child is missing.
+func (s *Shuttle) splitRoot(ctx context.Context, kids []Pin) (cid.Cid, error) {
+	cst := cbor.NewCborStore(s.Node.Blockstore)
+
+	roots := cid.NewSet()
+	external := cid.NewSet()
+	for _, k := range kids {
+		if !k.Active {
+			return cid.Undef, fmt.Errorf("split child %d is not pinned", k.Content)
+		}
+
+		var box dagsplit.Box
+		if err := cst.Get(ctx, k.Cid.CID, &box); err != nil {
+			return cid.Undef, fmt.Errorf("failed to load the box of split child %d: %w", k.Content, err)
+		}
+
+		for _, r := range box.Roots {
+			roots.Add(r)
+		}
+		for _, e := range box.External {
+			external.Add(e)
+		}
+	}
+
+	var missing int
+	if err := external.ForEach(func(c cid.Cid) error {
+		if !roots.Has(c) {
+			missing++
+		}
+		return nil
+	}); err != nil {
+		return cid.Undef, err
+	}
+	if missing > 0 {
+		return cid.Undef, fmt.Errorf("%d dags excluded from the boxes are in no child, some children are missing", missing)
+	}
+
+	var candidates []cid.Cid
+	if err := roots.ForEach(func(c cid.Cid) error {
+		if !external.Has(c) {
+			candidates = append(candidates, c)
+		}
+		return nil
+	}); err != nil {
+		return cid.Undef, err
+	}
+	if len(candidates) != 1 {
+		return cid.Undef, fmt.Errorf("the boxes of the children have %d candidate roots", len(candidates))
+	}
+	return candidates[0], nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	dagsplit "github.com/application-research/estuary/util/dagsplit"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepairSplitLinkage(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	cst := cbor.NewCborStore(s.Node.Blockstore)
+
+	putBox := func(roots, external []cid.Cid) util.DbCID {
+		c, err := cst.Put(ctx, &dagsplit.Box{Roots: roots, External: external})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return util.DbCID{CID: c}
+	}
+
+	root := blocks.NewBlock([]byte("root")).Cid()
+	sub := blocks.NewBlock([]byte("sub")).Cid()
+	other := blocks.NewBlock([]byte("other")).Cid()
+
+	pins := []*Pin{
+		// a complete split of content 5
+		{Content: 11, Active: true, DagSplit: true, SplitFrom: 5, Cid: putBox([]cid.Cid{root}, []cid.Cid{sub})},
+		{Content: 12, Active: true, DagSplit: true, SplitFrom: 5, Cid: putBox([]cid.Cid{sub}, nil)},
+		// content 6 lost the child holding other
+		{Content: 13, Active: true, DagSplit: true, SplitFrom: 6, Cid: putBox([]cid.Cid{root}, []cid.Cid{other})},
+		// content 7 still has its parent
+		{Content: 7, DagSplit: true},
+		{Content: 14, Active: true, DagSplit: true, SplitFrom: 7, Cid: putBox([]cid.Cid{root}, nil)},
+	}
+	for _, p := range pins {
+		a.NoError(s.DB.Create(p).Error)
+	}
+
+	res, err := s.repairSplitLinkage(ctx, true, nil)
+	a.NoError(err)
+	a.Len(res.Restored, 1)
+	var count int64
+	a.NoError(s.DB.Model(&Pin{}).Where("content = ?", 5).Count(&count).Error)
+	a.Zero(count)
+
+	// a parent estuary did not confirm stays gone
+	res, err = s.repairSplitLinkage(ctx, false, nil)
+	a.NoError(err)
+	a.Empty(res.Restored)
+	a.Len(res.Orphans, 2)
+	a.NoError(s.DB.Model(&Pin{}).Where("content = ?", 5).Count(&count).Error)
+	a.Zero(count)
+
+	res, err = s.repairSplitLinkage(ctx, false, []uint{5})
+	a.NoError(err)
+	if a.Len(res.Restored, 1) {
+		a.Equal(uint(5), res.Restored[0].Content)
+		a.Equal(root, res.Restored[0].Cid)
+		a.Equal([]uint{11, 12}, res.Restored[0].Children)
+	}
+	if a.Len(res.Orphans, 1) {
+		a.Equal(uint(6), res.Orphans[0].Parent)
+		a.Equal([]uint{13}, res.Orphans[0].Children)
+	}
+
+	var parent Pin
+	a.NoError(s.DB.First(&parent, "content = ?", 5).Error)
+	a.Equal(root, parent.Cid.CID)
+	a.True(parent.DagSplit)
+	a.False(parent.Active)
+
+	res, err = s.repairSplitLinkage(ctx, false, []uint{5})
+	a.NoError(err)
+	a.Empty(res.Restored)
+	a.Len(res.Orphans, 1)
+}
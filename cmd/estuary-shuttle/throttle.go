@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+)
+
+// the sent bytes of a throttled transfer are measured over windows of this
+// length, so a transfer that stalled does not get to burst afterwards
+const transferThrottleWindow = 10 * time.Second
+
+type transferThrottle struct {
+	bytesPerSecond int64
+
+	windowStart time.Time
+	windowSent  uint64
+	paused      bool
+}
+
+// ahead returns how long the transfer has to wait for the bytes it sent to
+// fit in its rate cap
+func (t *transferThrottle) ahead(sent uint64, now time.Time) time.Duration {
+	if t.windowStart.IsZero() || sent < t.windowSent {
+		t.windowStart = now
+		t.windowSent = sent
+		return 0
+	}
+
+	elapsed := now.Sub(t.windowStart)
+	allowed := time.Duration(float64(sent-t.windowSent) / float64(t.bytesPerSecond) * float64(time.Second))
+	if allowed > elapsed {
+		return allowed - elapsed
+	}
+
+	if elapsed > transferThrottleWindow {
+		t.windowStart = now
+		t.windowSent = sent
+	}
+	return 0
+}
+
+func (s *Shuttle) handleRpcTransferBandwidthLimit(ctx context.Context, req *drpc.TransferBandwidthLimit) error {
+	if req == nil {
+		return fmt.Errorf("transfer bandwidth limit command is missing its params")
+	}
+
+	res := &drpc.TransferBandwidthLimitApplied{
+		ChanID:   req.ChanID,
+		DealDBID: req.DealDBID,
+	}
+
+	if err := s.setTransferBandwidthLimit(ctx, req.ChanID, req.BytesPerSecond); err != nil {
+		log.Errorf("failed to limit bandwidth of transfer %s: %s", req.ChanID, err)
+		res.Error = err.Error()
+		res.BytesPerSecond = s.transferBandwidthLimit(req.ChanID)
+	} else {
+		res.BytesPerSecond = req.BytesPerSecond
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_TransferBandwidthLimitApplied,
+		Params: drpc.MsgParams{
+			TransferBandwidthLimitApplied: res,
+		},
+	})
+}
+
+func (s *Shuttle) transferBandwidthLimit(chid datatransfer.ChannelID) int64 {
+	s.throttleLk.Lock()
+	defer s.throttleLk.Unlock()
+
+	if t, ok := s.throttledTransfers[chid]; ok {
+		return t.bytesPerSecond
+	}
+	return 0
+}
+
+// setTransferBandwidthLimit caps the send rate of an in progress legacy
+// (go-data-transfer) transfer, a limit of 0 removes the cap
+func (s *Shuttle) setTransferBandwidthLimit(ctx context.Context, chid datatransfer.ChannelID, bytesPerSecond int64) error {
+	if bytesPerSecond < 0 {
+		return fmt.Errorf("bandwidth limit must not be negative")
+	}
+
+	if bytesPerSecond > 0 {
+		if _, err := s.Filc.GetDtMgr().ChannelState(ctx, chid); err != nil {
+			return fmt.Errorf("no data transfer channel found: %w", err)
+		}
+	}
+
+	s.throttleLk.Lock()
+	defer s.throttleLk.Unlock()
+
+	t, ok := s.throttledTransfers[chid]
+	if bytesPerSecond == 0 {
+		delete(s.throttledTransfers, chid)
+		if ok && t.paused {
+			go s.resumeThrottledTransfer(chid)
+		}
+		return nil
+	}
+
+	if !ok {
+		s.throttledTransfers[chid] = &transferThrottle{bytesPerSecond: bytesPerSecond}
+		return nil
+	}
+
+	// restart the measuring window so the new cap does not pay for the old one
+	t.bytesPerSecond = bytesPerSecond
+	t.windowStart = time.Time{}
+	return nil
+}
+
+// throttleTransfer is subscribed to the data transfer events, it pauses the
+// throttled transfers that sent more than their cap allows until they are
+// back under it
+func (s *Shuttle) throttleTransfer(event datatransfer.Event, st datatransfer.ChannelState) {
+	chid := st.ChannelID()
+
+	switch event.Code {
+	case datatransfer.DataSent:
+	case datatransfer.Complete, datatransfer.CleanupComplete, datatransfer.Cancel, datatransfer.Error:
+		s.throttleLk.Lock()
+		delete(s.throttledTransfers, chid)
+		s.throttleLk.Unlock()
+		return
+	default:
+		return
+	}
+
+	s.throttleLk.Lock()
+	defer s.throttleLk.Unlock()
+
+	t, ok := s.throttledTransfers[chid]
+	if !ok || t.paused {
+		return
+	}
+
+	wait := t.ahead(st.Sent(), time.Now())
+	if wait <= 0 {
+		return
+	}
+	t.paused = true
+
+	// the data transfer manager cannot be called back from its subscribers
+	go func() {
+		if err := s.Filc.GetDtMgr().PauseDataTransferChannel(context.TODO(), chid); err != nil {
+			log.Warnf("failed to pause throttled transfer %s: %s", chid, err)
+			s.throttleLk.Lock()
+			t.paused = false
+			s.throttleLk.Unlock()
+			return
+		}
+
+		time.Sleep(wait)
+
+		s.throttleLk.Lock()
+		t.paused = false
+		_, stillThrottled := s.throttledTransfers[chid]
+		s.throttleLk.Unlock()
+
+		// a removed limit already resumed the transfer
+		if stillThrottled {
+			s.resumeThrottledTransfer(chid)
+		}
+	}()
+}
+
+func (s *Shuttle) resumeThrottledTransfer(chid datatransfer.ChannelID) {
+	if err := s.Filc.GetDtMgr().ResumeDataTransferChannel(context.TODO(), chid); err != nil {
+		log.Warnf("failed to resume throttled transfer %s: %s", chid, err)
+	}
+}
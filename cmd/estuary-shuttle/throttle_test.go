@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferThrottleAhead(t *testing.T) {
+	start := time.Now()
+	th := &transferThrottle{bytesPerSecond: 1000}
+
+	// the first event opens the window
+	assert.Equal(t, time.Duration(0), th.ahead(500, start))
+
+	// 2000 bytes after one second is one second over a 1000 bytes/s cap
+	assert.Equal(t, time.Second, th.ahead(2500, start.Add(time.Second)))
+
+	// under the cap
+	assert.Equal(t, time.Duration(0), th.ahead(3000, start.Add(3*time.Second)))
+
+	// a stalled transfer gets a new window instead of a burst allowance
+	assert.Equal(t, time.Duration(0), th.ahead(3500, start.Add(time.Minute)))
+	assert.Equal(t, time.Second, th.ahead(5500, start.Add(time.Minute+time.Second)))
+}
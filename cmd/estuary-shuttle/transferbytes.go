@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/filclient"
+)
+
+const (
+	// the rate of a transfer is what it sent over this window
+	transferRateWindow = time.Minute
+	// how often the bytes sent by the transfers in progress are sampled
+	transferSampleInterval = time.Second * 5
+)
+
+type transferSample struct {
+	sent uint64
+	at   time.Time
+}
+
+func (s *Shuttle) handleRpcGetTransferBytes(ctx context.Context, req *drpc.GetTransferBytes) error {
+	if req == nil {
+		return fmt.Errorf("get transfer bytes command is missing its params")
+	}
+
+	res, err := s.transferBytes(ctx, req.Chanid)
+	if err != nil {
+		res = &drpc.TransferBytes{
+			Chanid: req.Chanid,
+			Error:  err.Error(),
+		}
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_TransferBytes,
+		Params: drpc.MsgParams{
+			TransferBytes: res,
+		},
+	})
+}
+
+// transferBytes reads the byte counts of a transfer from the live state of its
+// channel. Only graphsync channels know what is queued and the total size,
+// libp2p transfers only count what they sent.
+func (s *Shuttle) transferBytes(ctx context.Context, chanid string) (*drpc.TransferBytes, error) {
+	res := &drpc.TransferBytes{Chanid: chanid}
+
+	if chid, err := filclient.ChannelIDFromString(chanid); err == nil {
+		st, err := s.Filc.GetDtMgr().ChannelState(ctx, *chid)
+		if err != nil {
+			return nil, err
+		}
+		res.Sent = st.Sent()
+		res.Queued = st.Queued()
+		res.Total = st.TotalSize()
+	} else {
+		st, err := s.Filc.TransferStatusByID(ctx, chanid)
+		if err != nil {
+			return nil, err
+		}
+		res.Sent = st.Sent
+	}
+
+	res.Rate = s.transferRate(chanid, res.Sent, time.Now())
+	return res, nil
+}
+
+// watchTransferRates samples the bytes sent by the transfers in progress, so
+// that their rate does not depend on how often it is asked for
+func (s *Shuttle) watchTransferRates() {
+	for range time.Tick(transferSampleInterval) {
+		txs, err := s.Filc.TransfersInProgress(context.TODO())
+		if err != nil {
+			log.Errorf("failed to sample transfers in progress: %s", err)
+			continue
+		}
+
+		sent := make(map[string]uint64, len(txs))
+		for id, st := range txs {
+			sent[id] = st.Sent
+		}
+		s.recordTransferSamples(sent, time.Now())
+	}
+}
+
+// recordTransferSamples adds a sample of the bytes sent by each transfer in
+// progress, samples that left the rate window and transfers no longer in
+// progress are dropped
+func (s *Shuttle) recordTransferSamples(sent map[string]uint64, now time.Time) {
+	s.transferSamplesLk.Lock()
+	defer s.transferSamplesLk.Unlock()
+
+	for id := range s.transferSamples {
+		if _, ok := sent[id]; !ok {
+			delete(s.transferSamples, id)
+		}
+	}
+
+	for id, n := range sent {
+		smps := append(s.transferSamples[id], transferSample{sent: n, at: now})
+		for len(smps) > 0 && now.Sub(smps[0].at) > transferRateWindow {
+			smps = smps[1:]
+		}
+		s.transferSamples[id] = smps
+	}
+}
+
+// transferRate returns the bytes per second a transfer sent since its oldest
+// sample in the rate window, 0 until it was sampled
+func (s *Shuttle) transferRate(chanid string, sent uint64, now time.Time) float64 {
+	s.transferSamplesLk.Lock()
+	defer s.transferSamplesLk.Unlock()
+
+	for _, smp := range s.transferSamples[chanid] {
+		if now.Sub(smp.at) > transferRateWindow {
+			continue
+		}
+
+		elapsed := now.Sub(smp.at).Seconds()
+		if elapsed <= 0 || sent < smp.sent {
+			return 0
+		}
+		return float64(sent-smp.sent) / elapsed
+	}
+	return 0
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferRate(t *testing.T) {
+	a := assert.New(t)
+	s := &Shuttle{transferSamples: make(map[string][]transferSample)}
+	now := time.Now()
+
+	a.Zero(s.transferRate("chan", 100, now))
+
+	s.recordTransferSamples(map[string]uint64{"chan": 100, "other": 0}, now)
+	s.recordTransferSamples(map[string]uint64{"chan": 200, "other": 0}, now.Add(time.Second*2))
+
+	// asking does not move the window
+	a.Equal(float64(50), s.transferRate("chan", 300, now.Add(time.Second*4)))
+	a.Equal(float64(50), s.transferRate("chan", 300, now.Add(time.Second*4)))
+
+	// a restarted transfer counts from zero again
+	a.Zero(s.transferRate("chan", 10, now.Add(time.Second*3)))
+
+	// samples that left the window are not used
+	later := now.Add(transferRateWindow + time.Second)
+	a.Equal(float64(100), s.transferRate("chan", 200+100*59, later))
+
+	// transfers no longer in progress are dropped
+	s.recordTransferSamples(map[string]uint64{"chan": 400}, later)
+	a.NotContains(s.transferSamples, "other")
+	a.Len(s.transferSamples["chan"], 2)
+}
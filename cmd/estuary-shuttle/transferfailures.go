@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+)
+
+// how long a transfer seen failed is remembered without being checked again,
+// or the grace period if that is longer
+const transferFailuresTTL = time.Hour
+
+// transferFailure is when a transfer was first and last seen failed
+type transferFailure struct {
+	since time.Time
+	seen  time.Time
+}
+
+// transferFailed is util.TransferFailed with the configured grace period: a
+// transfer is only reported failed once it stayed in a failed state for the
+// whole period, as some stalls recover on their own
+func (s *Shuttle) transferFailed(chanid string, st *filclient.ChannelState) (bool, string) {
+	failed, msg := util.TransferFailed(st)
+
+	s.tfLk.Lock()
+	defer s.tfLk.Unlock()
+
+	if !failed {
+		delete(s.transferFailures, chanid)
+		return false, msg
+	}
+
+	grace := s.config().TransferFailureGracePeriod
+	if grace <= 0 {
+		return true, msg
+	}
+
+	now := time.Now()
+	tf, ok := s.transferFailures[chanid]
+	if !ok {
+		tf = &transferFailure{since: now}
+		s.transferFailures[chanid] = tf
+	}
+	tf.seen = now
+
+	if failing := now.Sub(tf.since); failing < grace {
+		return false, fmt.Sprintf("%s for %s, within failure grace period of %s", msg, failing.Round(time.Second), grace)
+	}
+
+	delete(s.transferFailures, chanid)
+	return true, msg
+}
+
+// watchTransferFailures forgets the failed transfers that are no longer
+// checked, e.g. because their deal was given up on
+func (s *Shuttle) watchTransferFailures() {
+	for range time.Tick(transferFailuresTTL / 4) {
+		if n := s.expireTransferFailures(time.Now()); n > 0 {
+			log.Debugf("forgot %d failed transfers that were no longer checked", n)
+		}
+	}
+}
+
+func (s *Shuttle) expireTransferFailures(now time.Time) int {
+	ttl := transferFailuresTTL
+	if grace := s.config().TransferFailureGracePeriod; grace > ttl {
+		ttl = grace
+	}
+
+	s.tfLk.Lock()
+	defer s.tfLk.Unlock()
+
+	var n int
+	for chanid, tf := range s.transferFailures {
+		if now.Sub(tf.seen) > ttl {
+			delete(s.transferFailures, chanid)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/filclient"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferFailedGracePeriod(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+	s.transferFailures = make(map[string]*transferFailure)
+
+	failed := &filclient.ChannelState{Status: datatransfer.Failed}
+	ongoing := &filclient.ChannelState{Status: datatransfer.Ongoing}
+
+	// without a grace period failures are reported right away
+	ok, _ := s.transferFailed("chan", failed)
+	a.True(ok)
+
+	s.config().TransferFailureGracePeriod = time.Hour
+	ok, _ = s.transferFailed("chan", failed)
+	a.False(ok)
+
+	// a recovered transfer starts over
+	ok, _ = s.transferFailed("chan", ongoing)
+	a.False(ok)
+	a.NotContains(s.transferFailures, "chan")
+
+	ok, _ = s.transferFailed("chan", failed)
+	a.False(ok)
+	s.transferFailures["chan"].since = time.Now().Add(-2 * time.Hour)
+	ok, _ = s.transferFailed("chan", failed)
+	a.True(ok)
+	a.NotContains(s.transferFailures, "chan")
+}
+
+func TestExpireTransferFailures(t *testing.T) {
+	a := assert.New(t)
+	s := newTestShuttle(t)
+	s.transferFailures = make(map[string]*transferFailure)
+	s.config().TransferFailureGracePeriod = time.Minute
+
+	failed := &filclient.ChannelState{Status: datatransfer.Failed}
+	for _, chanid := range []string{"gone", "checked"} {
+		ok, _ := s.transferFailed(chanid, failed)
+		a.False(ok)
+	}
+
+	// only the transfer that is still checked is remembered
+	s.transferFailures["gone"].seen = time.Now().Add(-2 * transferFailuresTTL)
+	a.Equal(1, s.expireTransferFailures(time.Now()))
+	a.NotContains(s.transferFailures, "gone")
+	a.Contains(s.transferFailures, "checked")
+
+	// a grace period longer than the ttl keeps them around for as long
+	s.config().TransferFailureGracePeriod = 3 * transferFailuresTTL
+	s.transferFailures["checked"].seen = time.Now().Add(-2 * transferFailuresTTL)
+	a.Zero(s.expireTransferFailures(time.Now()))
+	a.Equal(1, s.expireTransferFailures(time.Now().Add(2*transferFailuresTTL)))
+	a.Empty(s.transferFailures)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/application-research/estuary/util"
+)
+
+// uploadStager stages the files of in-progress adds in a temp directory. The
+// space reserved by the uploads is bounded so abandoned or slow uploads
+// cannot slowly fill up the disk.
+type uploadStager struct {
+	dir      string
+	maxSpace uint64
+
+	lk       sync.Mutex
+	reserved uint64
+}
+
+// the names of the files staged in the temp directory, nothing else in it is
+// ever touched
+const uploadFilePattern = "upload-*"
+
+// newUploadStager creates the temp directory, removing the staged files left
+// in it by a previous run that did not get to clean up after its uploads. The
+// directory may not hold the data directory, it may be shared with other
+// files though.
+func newUploadStager(dir, dataDir string, maxSpace uint64) (*uploadStager, error) {
+	if err := checkUploadTempDir(dir, dataDir); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed int
+	for _, e := range entries {
+		if ok, _ := filepath.Match(uploadFilePattern, e.Name()); !ok {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return nil, fmt.Errorf("failed to remove orphaned upload temp file: %w", err)
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		log.Infof("removed %d orphaned upload temp files from %s", removed, dir)
+	}
+
+	return &uploadStager{
+		dir:      dir,
+		maxSpace: maxSpace,
+	}, nil
+}
+
+// checkUploadTempDir rejects a temp directory that is, or holds, the data
+// directory
+func checkUploadTempDir(dir, dataDir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	absData, err := filepath.Abs(dataDir)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(absDir, absData)
+	if err != nil {
+		return err
+	}
+
+	if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+		return fmt.Errorf("upload temp dir %s may not be or contain the data dir %s", dir, dataDir)
+	}
+	return nil
+}
+
+// reserve claims size bytes of the temp area for an upload, it must be given
+// back with release once the upload is done. Uploads of unknown size reserve
+// nothing up front, they reserve the space as they are staged.
+func (us *uploadStager) reserve(size int64) error {
+	if size < 0 {
+		size = 0
+	}
+
+	us.lk.Lock()
+	defer us.lk.Unlock()
+
+	if us.maxSpace > 0 && us.reserved+uint64(size) > us.maxSpace {
+		return &util.HttpError{
+			Code:    http.StatusInsufficientStorage,
+			Reason:  util.ERR_INSUFFICIENT_STORAGE,
+			Details: "this node has too many uploads in progress and is not accepting new content at the moment",
+		}
+	}
+
+	us.reserved += uint64(size)
+	return nil
+}
+
+func (us *uploadStager) release(size int64) {
+	if size < 0 {
+		size = 0
+	}
+
+	us.lk.Lock()
+	defer us.lk.Unlock()
+
+	us.reserved -= uint64(size)
+}
+
+type stagedFile struct {
+	*os.File
+	Filename string
+	Size     int64
+	// SHA256 is the digest of the file contents, hashed while staging it
+	SHA256 []byte
+
+	us *uploadStager
+	// space reserved while staging an upload of unknown size
+	reserved int64
+}
+
+// Close closes the staged file and removes it from the temp directory
+func (sf *stagedFile) Close() error {
+	defer sf.us.release(sf.reserved)
+
+	cerr := sf.File.Close()
+	if err := os.Remove(sf.File.Name()); err != nil {
+		return err
+	}
+	return cerr
+}
+
+// Write reserves the space of an upload of unknown size as it is staged
+func (sf *stagedFile) Write(p []byte) (int, error) {
+	if err := sf.us.reserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+	sf.reserved += int64(len(p))
+	return sf.File.Write(p)
+}
+
+// stageFormFile writes the file in the given field of a multipart request
+// into the temp directory, the file is removed when it is closed. A request
+// without a Content-Length reserves the space of the file as it is written.
+func (us *uploadStager) stageFormFile(r *http.Request, field string) (*stagedFile, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("missing form file %q", field),
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() != field || part.FileName() == "" {
+			continue
+		}
+
+		fi, err := os.CreateTemp(us.dir, uploadFilePattern)
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha256.New()
+		sf := &stagedFile{File: fi, Filename: part.FileName(), us: us}
+
+		var w io.Writer = fi
+		if r.ContentLength < 0 {
+			w = sf
+		}
+		sf.Size, err = io.Copy(io.MultiWriter(w, h), part)
+		if err != nil {
+			_ = sf.Close()
+			return nil, err
+		}
+
+		if _, err := fi.Seek(0, io.SeekStart); err != nil {
+			_ = sf.Close()
+			return nil, err
+		}
+		sf.SHA256 = h.Sum(nil)
+		return sf, nil
+	}
+}
+
+// clients can send the sha256 of an upload body in this header, or in a
+// trailer of the same name, to have the upload rejected if it got corrupted
+// or truncated on the way
+const contentSHA256Header = "X-Content-SHA256"
+
+// bodyChecksum hashes a request body as it is read
+type bodyChecksum struct {
+	io.Reader
+	req  *http.Request
+	want string
+	h    hash.Hash
+}
+
+// newBodyChecksum returns nil if the request has no checksum header or
+// trailer
+func newBodyChecksum(r *http.Request) (*bodyChecksum, error) {
+	want := r.Header.Get(contentSHA256Header)
+	if want == "" {
+		if _, ok := r.Trailer[http.CanonicalHeaderKey(contentSHA256Header)]; !ok {
+			return nil, nil
+		}
+	} else if err := validSHA256(want); err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	return &bodyChecksum{
+		Reader: io.TeeReader(r.Body, h),
+		req:    r,
+		want:   want,
+		h:      h,
+	}, nil
+}
+
+func validSHA256(s string) error {
+	if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("%s must be a hex encoded sha256", contentSHA256Header),
+		}
+	}
+	return nil
+}
+
+// verify reads the rest of the body and checks its checksum
+func (bc *bodyChecksum) verify() error {
+	if _, err := io.Copy(io.Discard, bc.Reader); err != nil {
+		return err
+	}
+
+	want := bc.want
+	if want == "" {
+		// trailers are only set once the body is read to the end
+		want = bc.req.Trailer.Get(contentSHA256Header)
+		if err := validSHA256(want); err != nil {
+			return err
+		}
+	}
+
+	wantb, _ := hex.DecodeString(want)
+	if got := bc.h.Sum(nil); !bytes.Equal(got, wantb) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CHECKSUM_MISMATCH,
+			Details: fmt.Sprintf("upload sha256 is %x but %s is %s", got, contentSHA256Header, want),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadStager(t *testing.T) {
+	a := assert.New(t)
+	dir := t.TempDir()
+
+	// left over by a crashed run
+	a.NoError(os.WriteFile(filepath.Join(dir, "upload-1"), []byte("orphan"), 0644))
+	a.NoError(os.Mkdir(filepath.Join(dir, "upload-2"), 0750))
+	// not ours
+	a.NoError(os.WriteFile(filepath.Join(dir, "unrelated"), []byte("keep"), 0644))
+
+	_, err := newUploadStager(dir, dir, 100)
+	a.Error(err)
+	_, err = newUploadStager(dir, filepath.Join(dir, "data"), 100)
+	a.Error(err)
+
+	us, err := newUploadStager(dir, filepath.Join(dir, "..", "data"), 100)
+	a.NoError(err)
+
+	entries, err := os.ReadDir(dir)
+	a.NoError(err)
+	if a.Len(entries, 1) {
+		a.Equal("unrelated", entries[0].Name())
+	}
+	a.NoError(os.Remove(filepath.Join(dir, "unrelated")))
+
+	a.NoError(us.reserve(60))
+	a.Error(us.reserve(41))
+	us.release(60)
+	a.NoError(us.reserve(100))
+	us.release(100)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	a.NoError(mw.WriteField("other", "value"))
+	fw, err := mw.CreateFormFile("data", "hello.txt")
+	a.NoError(err)
+	_, err = fw.Write([]byte("hello world"))
+	a.NoError(err)
+	a.NoError(mw.Close())
+
+	req := httptest.NewRequest("POST", "/content/add", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	sf, err := us.stageFormFile(req, "data")
+	if !a.NoError(err) {
+		return
+	}
+	a.Equal("hello.txt", sf.Filename)
+	a.Equal(int64(11), sf.Size)
+
+	data, err := io.ReadAll(sf)
+	a.NoError(err)
+	a.Equal("hello world", string(data))
+
+	a.NoError(sf.Close())
+	entries, err = os.ReadDir(dir)
+	a.NoError(err)
+	a.Len(entries, 0)
+
+	// a chunked upload reserves its space as it is staged
+	req = httptest.NewRequest("POST", "/content/add", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.ContentLength = -1
+
+	sf, err = us.stageFormFile(req, "data")
+	if !a.NoError(err) {
+		return
+	}
+	a.Equal(int64(11), sf.Size)
+	a.Error(us.reserve(90))
+	a.NoError(sf.Close())
+	a.NoError(us.reserve(100))
+	us.release(100)
+
+	req = httptest.NewRequest("POST", "/content/add", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.ContentLength = -1
+	a.NoError(us.reserve(95))
+	_, err = us.stageFormFile(req, "data")
+	a.Error(err)
+	us.release(95)
+
+	entries, err = os.ReadDir(dir)
+	a.NoError(err)
+	a.Len(entries, 0)
+}
+
+func TestBodyChecksum(t *testing.T) {
+	a := assert.New(t)
+	body := []byte("car bytes")
+	sum := sha256.Sum256(body)
+
+	req := httptest.NewRequest("POST", "/content/add-car", bytes.NewReader(body))
+	bc, err := newBodyChecksum(req)
+	a.NoError(err)
+	a.Nil(bc)
+
+	req.Header.Set(contentSHA256Header, hex.EncodeToString(sum[:]))
+	bc, err = newBodyChecksum(req)
+	a.NoError(err)
+
+	// a reader that stops early still has the whole body checked
+	_, err = io.ReadFull(bc, make([]byte, 3))
+	a.NoError(err)
+	a.NoError(bc.verify())
+
+	req = httptest.NewRequest("POST", "/content/add-car", bytes.NewReader(body[:4]))
+	req.Header.Set(contentSHA256Header, hex.EncodeToString(sum[:]))
+	bc, err = newBodyChecksum(req)
+	a.NoError(err)
+	a.Error(bc.verify())
+
+	req.Header.Set(contentSHA256Header, "nothex")
+	_, err = newBodyChecksum(req)
+	a.Error(err)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// how long fetching a content root may take when estuary sets no timeout
+const defaultRootValidationTimeout = time.Second * 30
+
+func (s *Shuttle) handleRpcValidateContentRoot(ctx context.Context, req *drpc.ValidateContentRoot) error {
+	if req == nil {
+		return fmt.Errorf("validate content root command is missing its params")
+	}
+
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = defaultRootValidationTimeout
+	}
+
+	res := s.validateContentRoot(ctx, req.Cid, req.Peers, timeout)
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ContentRootValidation,
+		Params: drpc.MsgParams{
+			ContentRootValidation: res,
+		},
+	})
+}
+
+// validateContentRoot fetches the root block of a content over bitswap from
+// its origin peers. A block fetched only for this is removed again so that
+// unpinned data does not pile up in the blockstore.
+func (s *Shuttle) validateContentRoot(ctx context.Context, root cid.Cid, peers []*peer.AddrInfo, timeout time.Duration) *drpc.ContentRootValidation {
+	res := &drpc.ContentRootValidation{Cid: root}
+
+	if util.IsInlineCid(root) {
+		res.Reachable = true
+		res.Local = true
+		return res
+	}
+
+	has, err := s.Node.Blockstore.Has(ctx, root)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	if has {
+		res.Reachable = true
+		res.Local = true
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res.Connected = s.connectToOrigins(ctx, peers)
+	if res.Connected == 0 && len(peers) > 0 {
+		res.Error = fmt.Sprintf("failed to connect to all %d origin peers", len(peers))
+		return res
+	}
+
+	if _, err := s.Node.Bitswap.GetBlock(ctx, root); err != nil {
+		res.Error = fmt.Sprintf("failed to fetch root block: %s", err)
+		return res
+	}
+	res.Reachable = true
+
+	if err := s.discardValidatedRoot(context.Background(), root); err != nil {
+		log.Warnf("failed to remove validated root %s from the blockstore: %s", root, err)
+	}
+	return res
+}
+
+// discardValidatedRoot removes a fetched root block unless a pin started
+// using it meanwhile. Pins in flight are checked under the same lock as the
+// deletion, the walk of a pin that needs the block may not have tracked it
+// yet.
+func (s *Shuttle) discardValidatedRoot(ctx context.Context, root cid.Cid) error {
+	s.inflightCidsLk.Lock()
+	defer s.inflightCidsLk.Unlock()
+
+	if s.isInflight(root) {
+		return nil
+	}
+
+	var pins int64
+	if err := s.DB.Model(Pin{}).Where("cid = ?", util.DbCID{CID: root}).Count(&pins).Error; err != nil {
+		return err
+	}
+
+	var objects int64
+	if err := s.DB.Model(Object{}).Where("cid = ?", util.DbCID{CID: root}).Count(&objects).Error; err != nil {
+		return err
+	}
+
+	if pins > 0 || objects > 0 {
+		return nil
+	}
+	return s.Node.Blockstore.DeleteBlock(ctx, root)
+}
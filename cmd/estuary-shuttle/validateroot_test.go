@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLocalContentRoot(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	blk := blocks.NewBlock([]byte("validated root"))
+	a.NoError(s.Node.Blockstore.Put(ctx, blk))
+
+	res := s.validateContentRoot(ctx, blk.Cid(), nil, time.Second)
+	a.True(res.Reachable)
+	a.True(res.Local)
+	a.Empty(res.Error)
+}
+
+func TestDiscardValidatedRoot(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.inflightCids = make(map[cid.Cid]uint)
+
+	pinned := blocks.NewBlock([]byte("pinned root"))
+	fetched := blocks.NewBlock([]byte("fetched root"))
+	a.NoError(s.Node.Blockstore.PutMany(ctx, []blocks.Block{pinned, fetched}))
+	a.NoError(s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: pinned.Cid()}, Pinning: true}).Error)
+
+	// a pin started on the root meanwhile keeps it
+	a.NoError(s.discardValidatedRoot(ctx, pinned.Cid()))
+	has, err := s.Node.Blockstore.Has(ctx, pinned.Cid())
+	a.NoError(err)
+	a.True(has)
+
+	// so does a pin whose walk fetches it but did not track it yet
+	s.inflightCids[fetched.Cid()] = 1
+	a.NoError(s.discardValidatedRoot(ctx, fetched.Cid()))
+	has, err = s.Node.Blockstore.Has(ctx, fetched.Cid())
+	a.NoError(err)
+	a.True(has)
+	delete(s.inflightCids, fetched.Cid())
+
+	a.NoError(s.discardValidatedRoot(ctx, fetched.Cid()))
+	has, err = s.Node.Blockstore.Has(ctx, fetched.Cid())
+	a.NoError(err)
+	a.False(has)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/pkg/errors"
+)
+
+// verifyPinDag checks that every block of the dag of a pin marked for
+// verification is in the local blockstore and intact. Pins not marked for it
+// are left alone, their dag was just walked while fetching them.
+func (d *Shuttle) verifyPinDag(ctx context.Context, contid uint, root cid.Cid) error {
+	var pin Pin
+	if err := d.DB.First(&pin, "content = ?", contid).Error; err != nil {
+		return err
+	}
+
+	if !pin.VerifyDag {
+		return nil
+	}
+	return d.verifyDagComplete(ctx, root)
+}
+
+// verifyDagComplete walks the dag under root from the local blockstore only,
+// failing on the first block that is missing or does not match its cid
+func (d *Shuttle) verifyDagComplete(ctx context.Context, root cid.Cid) error {
+	release, err := d.acquireDagWalk(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	dserv := merkledag.NewDAGService(blockservice.New(d.Node.Blockstore, offline.Exchange(d.Node.Blockstore)))
+
+	if err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		ok, found, err := d.checkBlock(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if !found {
+			return nil, fmt.Errorf("block %s is missing", c)
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("block %s is corrupted", c)
+		}
+
+		if c.Type() == cid.Raw {
+			return nil, nil
+		}
+
+		node, err := dserv.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return util.FilterUnwalkableLinks(node.Links()), nil
+	}, root, cid.NewSet().Visit, merkledag.Concurrency(d.config().DagWalkConcurrency)); err != nil {
+		return errors.Wrapf(err, "dag of %s is incomplete", root)
+	}
+	return nil
+}
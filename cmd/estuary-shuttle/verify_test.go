@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyPinDag(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	leaf := merkledag.NewRawNode([]byte("leaf"))
+	missing := merkledag.NewRawNode([]byte("missing"))
+	root := merkledag.NodeWithData([]byte("root"))
+	a.NoError(root.AddRawLink("leaf", leaf))
+	a.NoError(root.AddRawLink("missing", missing))
+
+	a.NoError(s.Node.Blockstore.Put(ctx, root))
+	a.NoError(s.Node.Blockstore.Put(ctx, leaf))
+
+	a.NoError(s.DB.Create(&Pin{Content: 1}).Error)
+	a.NoError(s.DB.Create(&Pin{Content: 2, VerifyDag: true}).Error)
+
+	// only pins marked for it are verified
+	a.NoError(s.verifyPinDag(ctx, 1, root.Cid()))
+	a.Error(s.verifyPinDag(ctx, 2, root.Cid()))
+
+	a.NoError(s.Node.Blockstore.Put(ctx, missing))
+	a.NoError(s.verifyPinDag(ctx, 2, root.Cid()))
+}
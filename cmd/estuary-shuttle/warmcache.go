@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+// warming the cache with a content loads at most this fraction of the read
+// cache size, so the other hot blocks are not all evicted
+const warmCacheMaxFraction = 0.5
+
+var errWarmCacheFull = errors.New("warm cache block budget used up")
+
+func (s *Shuttle) handleRpcWarmCache(ctx context.Context, req *drpc.WarmCache) error {
+	if req == nil {
+		return fmt.Errorf("warm cache command is missing its params")
+	}
+
+	res := &drpc.CacheWarmed{DBID: req.DBID}
+
+	blocks, size, err := s.warmCache(ctx, req.DBID, req.MaxBlocks)
+	res.Blocks = blocks
+	res.Bytes = size
+	if err != nil {
+		log.Errorf("failed to warm the read cache with content %d: %s", req.DBID, err)
+		res.Error = err.Error()
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_CacheWarmed,
+		Params: drpc.MsgParams{
+			CacheWarmed: res,
+		},
+	})
+}
+
+// warmCacheBudget returns how many blocks a content may load into the read
+// cache, 0 if the blockstore has no read cache
+func (s *Shuttle) warmCacheBudget(maxBlocks int) int {
+	node := s.config().Node
+	if node.NoBlockstoreCache || node.BlockstoreCache.ReadCacheSize <= 0 {
+		return 0
+	}
+
+	budget := int(float64(node.BlockstoreCache.ReadCacheSize) * warmCacheMaxFraction)
+	if budget < 1 {
+		budget = 1
+	}
+
+	if maxBlocks > 0 && maxBlocks < budget {
+		return maxBlocks
+	}
+	return budget
+}
+
+// warmCache reads the blocks of a content from the blockstore, through its
+// read cache, until the block budget is used up
+func (s *Shuttle) warmCache(ctx context.Context, contid uint, maxBlocks int) (int, int64, error) {
+	budget := s.warmCacheBudget(maxBlocks)
+	if budget == 0 {
+		return 0, 0, nil
+	}
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", contid).Error; err != nil {
+		return 0, 0, err
+	}
+
+	if !pin.Active {
+		return 0, 0, fmt.Errorf("content %d is not pinned", contid)
+	}
+
+	release, err := s.acquireDagWalk(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore)))
+
+	var blocks int
+	var size int64
+	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		if blocks >= budget {
+			return nil, errWarmCacheFull
+		}
+
+		node, err := dserv.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		blocks++
+		size += int64(len(node.RawData()))
+
+		if c.Type() == cid.Raw {
+			return nil, nil
+		}
+		return util.FilterUnwalkableLinks(node.Links()), nil
+	}, pin.Cid.CID, cid.NewSet().Visit)
+	if err != nil && !errors.Is(err, errWarmCacheFull) {
+		return blocks, size, err
+	}
+	return blocks, size, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmCacheBudget(t *testing.T) {
+	s := &Shuttle{shuttleConfig: &config.Shuttle{}}
+
+	// no read cache, nothing to warm
+	assert.Equal(t, 0, s.warmCacheBudget(10))
+
+	s.config().Node.BlockstoreCache.ReadCacheSize = 1000
+	assert.Equal(t, 500, s.warmCacheBudget(0))
+	assert.Equal(t, 10, s.warmCacheBudget(10))
+	assert.Equal(t, 500, s.warmCacheBudget(5000))
+
+	s.config().Node.NoBlockstoreCache = true
+	assert.Equal(t, 0, s.warmCacheBudget(10))
+}
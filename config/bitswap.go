@@ -3,4 +3,8 @@ package config
 type Bitswap struct {
 	MaxOutstandingBytesPerPeer int64 `json:"max_outstanding_bytes_per_peer"`
 	TargetMessageSize          int   `json:"target_message_size"`
+	// NoProvide stops bitswap from announcing every block it fetches, only
+	// the roots of pins are announced then. Unannounced pins are only taken
+	// with it set, bitswap would announce their blocks otherwise.
+	NoProvide bool `json:"no_provide"`
 }
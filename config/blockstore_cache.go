@@ -0,0 +1,16 @@
+package config
+
+const (
+	ReadCachePolicyLRU = "lru"
+	ReadCachePolicy2Q  = "2q"
+	ReadCachePolicyARC = "arc"
+)
+
+// HasCacheSize - size (in entries) of the ARC cache for blockstore Has calls
+// ReadCacheSize - number of blocks kept in the read cache, 0 disables it
+// ReadCachePolicy - eviction policy of the read cache, one of lru, 2q or arc
+type BlockstoreCache struct {
+	HasCacheSize    int    `json:"has_cache_size"`
+	ReadCacheSize   int    `json:"read_cache_size"`
+	ReadCachePolicy string `json:"read_cache_policy"`
+}
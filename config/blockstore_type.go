@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	flatfs "github.com/ipfs/go-ds-flatfs"
+)
+
+// Blockstore backends, an empty type leaves the backend to the legacy
+// :type:path spec of Node.Blockstore, lmdb when it is a plain path
+const (
+	BlockstoreTypeLmdb   = "lmdb"
+	BlockstoreTypeFlatfs = "flatfs"
+	BlockstoreTypeBadger = "badger"
+)
+
+// Lmdb - options of the lmdb backend
+// Flatfs - options of the flatfs backend
+// Badger - options of the badger backend
+// the write log set by WriteLogDir sits in front of any of them
+type BlockstoreOptions struct {
+	Lmdb   LmdbOptions   `json:"lmdb"`
+	Flatfs FlatfsOptions `json:"flatfs"`
+	Badger BadgerOptions `json:"badger"`
+}
+
+// NoSync - skip the fsync after each transaction
+type LmdbOptions struct {
+	NoSync bool `json:"no_sync"`
+}
+
+// ShardFunc - how blocks are spread over directories, e.g. /repo/flatfs/shard/v1/next-to-last/3
+// Sync - fsync every block written
+type FlatfsOptions struct {
+	ShardFunc string `json:"shard_func"`
+	Sync      bool   `json:"sync"`
+}
+
+// SyncWrites - fsync every write
+// ValueLogFileSize - size in bytes of each value log file, 0 keeps the badger default
+type BadgerOptions struct {
+	SyncWrites       bool  `json:"sync_writes"`
+	ValueLogFileSize int64 `json:"value_log_file_size"`
+}
+
+func (cfg *Node) validateBlockstoreType() error {
+	switch cfg.BlockstoreType {
+	case "":
+		return nil
+	case BlockstoreTypeLmdb, BlockstoreTypeBadger:
+	case BlockstoreTypeFlatfs:
+		if _, err := flatfs.ParseShardFunc(cfg.BlockstoreOptions.Flatfs.ShardFunc); err != nil {
+			return fmt.Errorf("invalid flatfs shard func: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown blockstore type %q, must be one of %s, %s or %s", cfg.BlockstoreType, BlockstoreTypeLmdb, BlockstoreTypeFlatfs, BlockstoreTypeBadger)
+	}
+
+	if strings.HasPrefix(cfg.Blockstore, ":") {
+		return fmt.Errorf("blockstore type %q needs a plain blockstore path, not the spec %q", cfg.BlockstoreType, cfg.Blockstore)
+	}
+
+	if cfg.BlockstoreOptions.Badger.ValueLogFileSize < 0 {
+		return fmt.Errorf("badger value log file size must not be negative")
+	}
+	return nil
+}
@@ -1,11 +1,16 @@
 package config
 
 import (
+	"encoding/json"
 	"github.com/libp2p/go-libp2p"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/application-research/estuary/constants"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/libp2p/go-libp2p/core/network"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"github.com/stretchr/testify/assert"
@@ -65,6 +70,7 @@ func TestShuttleDefaultSanity(t *testing.T) {
 
 	assert.NotEmpty(config.DataDir)
 	assert.NotEmpty(config.StagingDataDir)
+	assert.NotEmpty(config.UploadTempDir)
 	assert.NotEmpty(config.DatabaseConnString)
 	assert.NotEmpty(config.ApiListen)
 	assert.NotEmpty(config.EstuaryRemote.Api)
@@ -119,3 +125,301 @@ func TestShuttleJSONRoundtrip(t *testing.T) {
 	load(&config2, path)
 	assert.Equal(config, &config2)
 }
+
+func TestDealPriceConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewEstuary("test-version")
+	assert.NoError(config.Validate())
+
+	b, err := json.Marshal(&config.Deal)
+	assert.NoError(err)
+	assert.Contains(string(b), `"max_price":"0.00000003"`)
+
+	var deal Deal
+	assert.NoError(json.Unmarshal(b, &deal))
+	assert.True(deal.MaxPrice.Equals(config.Deal.MaxPrice.TokenAmount))
+	assert.True(deal.MaxVerifiedPrice.IsZero())
+
+	assert.Error(json.Unmarshal([]byte(`{"max_price":"-1"}`), &deal))
+	assert.Error(json.Unmarshal([]byte(`{"max_price":"cheap"}`), &deal))
+
+	// configs written before the ceilings were FIL values hold attoFIL
+	assert.NoError(json.Unmarshal([]byte(`{"max_price":"30000000000","max_verified_price":0}`), &deal))
+	assert.True(deal.MaxPrice.Equals(config.Deal.MaxPrice.TokenAmount))
+	assert.True(deal.MaxVerifiedPrice.IsZero())
+
+	// an attoFIL amount written where a FIL value is expected
+	config.Deal.MaxPrice = DealPrice(MustParseFIL("30000000000"))
+	assert.Error(config.Validate())
+}
+
+func TestDealCollateralConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewEstuary("test-version")
+	assert.True(config.Deal.MaxProviderCollateral.IsZero())
+	assert.True(config.Deal.ClientCollateral.IsZero())
+
+	var deal Deal
+	assert.NoError(json.Unmarshal([]byte(`{"max_provider_collateral":"0.5","client_collateral":"0.01"}`), &deal))
+	assert.True(deal.MaxProviderCollateral.Equals(MustParseFIL("0.5").TokenAmount))
+	assert.True(deal.ClientCollateral.Equals(MustParseFIL("0.01").TokenAmount))
+
+	assert.Error(json.Unmarshal([]byte(`{"client_collateral":"-1"}`), &deal))
+}
+
+func TestDealMinWalletBalanceConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewEstuary("test-version")
+	assert.True(config.Deal.MinWalletBalance.IsZero())
+
+	var deal Deal
+	assert.NoError(json.Unmarshal([]byte(`{"min_wallet_balance":"1.5"}`), &deal))
+	assert.True(deal.MinWalletBalance.Equals(MustParseFIL("1.5").TokenAmount))
+
+	assert.Error(json.Unmarshal([]byte(`{"min_wallet_balance":"-1"}`), &deal))
+}
+
+func TestStagingZoneTiers(t *testing.T) {
+	assert := assert.New(t)
+	config := NewEstuary("test-version")
+
+	config.StagingBucket.Tiers = map[string]StagingZoneSize{
+		"premium": {MinSize: 30 << 30, MaxSize: 31 << 30},
+	}
+	assert.NoError(config.Validate())
+
+	config.StagingBucket.Tiers["free"] = StagingZoneSize{MinSize: 2 << 30, MaxSize: 1 << 30}
+	assert.Error(config.Validate())
+
+	// larger than a 64GiB piece can hold
+	config.StagingBucket.Tiers["free"] = StagingZoneSize{MinSize: 1 << 30, MaxSize: 64 << 30}
+	assert.Error(config.Validate())
+}
+
+func TestStagingBucketConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewEstuary("test-version")
+	assert.NoError(config.Validate())
+
+	config.StagingBucket.MaxItems = 0
+	assert.Error(config.Validate())
+
+	// contents staged for aggregation have to fit in a zone
+	config.StagingBucket.MaxItems = 100
+	config.StagingBucket.MinSize = 1 << 30
+	config.StagingBucket.MaxSize = 2 << 30
+	assert.Error(config.Validate())
+
+	config.StagingBucket.IndividualDealThreshold = 1 << 30
+	assert.NoError(config.Validate())
+}
+
+func TestBlockstoreTypeConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewShuttle("test-version")
+	config.Node.Blockstore = "/data/blocks"
+	assert.NoError(config.Node.Validate())
+
+	for _, bstype := range []string{BlockstoreTypeLmdb, BlockstoreTypeFlatfs, BlockstoreTypeBadger} {
+		config.Node.BlockstoreType = bstype
+		assert.NoError(config.Node.Validate())
+	}
+
+	config.Node.BlockstoreType = "leveldb"
+	assert.Error(config.Node.Validate())
+
+	// the type and a legacy spec would disagree on the backend
+	config.Node.BlockstoreType = BlockstoreTypeBadger
+	config.Node.Blockstore = ":flatfs:/data/blocks"
+	assert.Error(config.Node.Validate())
+
+	config.Node.Blockstore = "/data/blocks"
+	config.Node.BlockstoreType = BlockstoreTypeFlatfs
+	config.Node.BlockstoreOptions.Flatfs.ShardFunc = "next-to-last/3"
+	assert.Error(config.Node.Validate())
+}
+
+func TestDealDurationConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewEstuary("test-version")
+	assert.Equal(abi.ChainEpoch(constants.DealDuration), config.Deal.Duration)
+	assert.NoError(config.Validate())
+
+	assert.NoError(ValidateDealDuration(constants.MinSafeDealLifetime))
+	assert.NoError(ValidateDealDuration(constants.MaxDealDuration))
+	assert.Error(ValidateDealDuration(constants.MinSafeDealLifetime - 1))
+	assert.Error(ValidateDealDuration(constants.MaxDealDuration + 1))
+
+	config.Deal.Duration = 0
+	assert.Error(config.Validate())
+}
+
+func TestServerConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewEstuary("test-version")
+	assert.NoError(config.Validate())
+
+	// uploads are not bounded
+	config.Server.MaxAddBodySize = 0
+	assert.NoError(config.Validate())
+
+	config.Server.MaxAddBodySize = config.Server.MaxBodySize - 1
+	assert.Error(config.Validate())
+
+	config.Server.MaxAddBodySize = 0
+	config.Server.ReadHeaderTimeout = 0
+	assert.Error(config.Validate())
+}
+
+func TestResilienceConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewShuttle("test-version").Resilience
+	assert.NoError(config.Validate())
+
+	// an idle connection would be dropped between heartbeats
+	config.HeartbeatTimeout = config.HeartbeatInterval
+	assert.Error(config.Validate())
+
+	config.HeartbeatInterval = 0
+	assert.NoError(config.Validate())
+
+	config.ReconnectMaxBackoff = config.ReconnectInitialBackoff - 1
+	assert.Error(config.Validate())
+}
+
+func TestDealExpiryWindowConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewShuttle("test-version")
+	config.SetRequiredOptions()
+	config.EstuaryRemote.AuthToken = "token"
+	config.EstuaryRemote.Handle = "shuttle"
+	assert.NoError(config.Validate())
+
+	// every deal would be reported as expiring right after it was made
+	config.DealExpiryWindow = time.Hour * 24 * 21
+	assert.Error(config.Validate())
+
+	config.DealExpiryWindow = -1
+	assert.Error(config.Validate())
+}
+
+func TestReloadShuttle(t *testing.T) {
+	assert := assert.New(t)
+	cur := NewShuttle("test-version")
+
+	next := NewShuttle("test-version")
+	next.Retrieval.Concurrency = 2
+	next.OriginConnect.FailFast = true
+	next.Logging.Levels = map[string]string{"shuttle": "debug"}
+	next.TakeContentConcurrency = 1
+	next.Node.BlockstoreCache.HasCacheSize = 0
+
+	updated, applied, restart := ReloadShuttle(cur, next)
+	assert.ElementsMatch([]string{"retrieval.concurrency", "origin_connect.fail_fast", "logging.levels"}, applied)
+	assert.ElementsMatch([]string{"take_content_concurrency", "node.blockstore_cache.has_cache_size"}, restart)
+
+	assert.Equal(2, updated.Retrieval.Concurrency)
+	assert.True(updated.OriginConnect.FailFast)
+	assert.Equal("debug", updated.Logging.Levels["shuttle"])
+	assert.Equal(100, updated.TakeContentConcurrency)
+
+	// the running config is not changed in place
+	assert.Equal(8, cur.Retrieval.Concurrency)
+
+	_, applied, restart = ReloadShuttle(updated, updated)
+	assert.Empty(applied)
+	assert.Empty(restart)
+}
+
+func TestDealWalletsConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewEstuary("test-version")
+	assert.NoError(config.Validate())
+
+	w, err := ParseDealWallet("f01234:3")
+	assert.NoError(err)
+	assert.Equal(DealWallet{Address: "f01234", Weight: 3}, w)
+
+	w, err = ParseDealWallet("f01235")
+	assert.NoError(err)
+	assert.Equal(1, w.Weight)
+
+	_, err = ParseDealWallet("f01234:0")
+	assert.Error(err)
+
+	_, err = ParseDealWallet("not-an-address:2")
+	assert.Error(err)
+
+	config.Deal.Wallets = []DealWallet{{Address: "f01234", Weight: 3}, {Address: "f01235", Weight: 1}}
+	assert.NoError(config.Validate())
+
+	config.Deal.Wallets = append(config.Deal.Wallets, DealWallet{Address: "f01234", Weight: 1})
+	assert.Error(config.Validate())
+}
+
+func TestCarSizeConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := NewEstuary("test-version")
+	assert.NoError(config.Validate())
+
+	m1, _ := address.NewFromString("f01234")
+	m2, _ := address.NewFromString("f01235")
+	config.Deal.MinerCarSizes = map[string]CarSize{
+		"f01234": {Min: 1 << 30, Max: int64(abi.PaddedPieceSize(32 << 30).Unpadded())},
+	}
+	assert.NoError(config.Validate())
+
+	assert.NoError(config.Deal.CheckCarSize(m1, 20<<30))
+	assert.Error(config.Deal.CheckCarSize(m1, 40<<30))
+	assert.Error(config.Deal.CheckCarSize(m1, 1<<20))
+	assert.NoError(config.Deal.CheckCarSize(m2, 40<<30))
+	assert.Error(config.Deal.CheckCarSize(m2, 100))
+
+	config.Deal.MinerCarSizes["f01235"] = CarSize{Min: 2 << 30, Max: 1 << 30}
+	assert.Error(config.Validate())
+
+	config.Deal.MinerCarSizes = nil
+	config.Deal.CarSize.Max = 65 << 30
+	assert.Error(config.Validate())
+
+	// full staging zones would not fit a deal
+	config.Deal.CarSize.Max = 8 << 30
+	assert.Error(config.Validate())
+
+	config.Deal.CarSize.Max = constants.MaxDealCarSize
+	config.Deal.CarSize.Min = 8 << 30
+	assert.Error(config.Validate())
+}
+
+func TestResourceLimits(t *testing.T) {
+	assert := assert.New(t)
+	config := NewShuttle("test-version").Node
+	assert.False(config.ResourceLimits.IsSet())
+	assert.Equal(config.Limits, config.ScalingLimits())
+
+	config.ResourceLimits.MaxConns = 4000
+	config.ResourceLimits.MaxMemory = 2 << 30
+	config.Limits.SystemLimitIncrease.Conns = 64
+	assert.NoError(config.Validate())
+
+	limits := config.ScalingLimits()
+	assert.Equal(4000, limits.SystemBaseLimit.Conns)
+	assert.Zero(limits.SystemLimitIncrease.Conns)
+	assert.Equal(int64(2<<30), limits.SystemBaseLimit.Memory)
+	assert.Equal(config.Limits.SystemBaseLimit.Streams, limits.SystemBaseLimit.Streams)
+
+	// without a limiter only the caps are enforced
+	capped := config.CappedLimits()
+	assert.Equal(4000, capped.System.Conns)
+	assert.Equal(int64(2<<30), capped.System.Memory)
+	assert.Equal(rcmgr.InfiniteLimits.System.Streams, capped.System.Streams)
+	assert.Equal(rcmgr.InfiniteLimits.PeerDefault, capped.PeerDefault)
+	assert.Equal(rcmgr.InfiniteLimits.ServiceDefault, capped.ServiceDefault)
+
+	// the connection manager would never trim before hitting the limit
+	config.ResourceLimits.MaxConns = config.ConnectionManager.HighWater
+	assert.Error(config.Validate())
+
+	config.ResourceLimits.MaxConns = -1
+	assert.Error(config.Validate())
+}
@@ -1,6 +1,16 @@
 package config
 
+import "time"
+
+// PinRootValidationTimeout - time a shuttle is given to fetch the root block of
+// a pin from its origins before the pin is accepted, 0 disables the check
 type Content struct {
-	DisableLocalAdding  bool `json:"disable_local_adding"`
-	DisableGlobalAdding bool `json:"disable_global_adding"` // not valid for shuttle
+	DisableLocalAdding       bool          `json:"disable_local_adding"`
+	DisableGlobalAdding      bool          `json:"disable_global_adding"`       // not valid for shuttle
+	PinRootValidationTimeout time.Duration `json:"pin_root_validation_timeout"` // not valid for shuttle
+	// PinTimeout is how long a pin may take in total before it fails
+	PinTimeout time.Duration `json:"pin_timeout"`
+	// PinQueueDir holds the on-disk pin queue and its duplicate guard,
+	// relative to the data dir unless absolute
+	PinQueueDir string `json:"pin_queue_dir"`
 }
@@ -1,9 +1,17 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/application-research/estuary/constants"
 	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
@@ -23,6 +31,256 @@ type Deal struct {
 	IsVerified                   bool                 `json:"verified"`
 	Duration                     abi.ChainEpoch       `json:"duration"`
 	EnabledDealProtocolsVersions map[protocol.ID]bool `json:"enabled_deal_protocol_versions"`
-	MaxVerifiedPrice             big.Int              `json:"max_verified_price"`
-	MaxPrice                     big.Int              `json:"max_price"`
+	MaxVerifiedPrice             DealPrice            `json:"max_verified_price"`
+	MaxPrice                     DealPrice            `json:"max_price"`
+	// MaxProviderCollateral is the highest provider collateral deals are
+	// proposed with, in FIL, 0 leaves it to the chain minimum plus a margin
+	MaxProviderCollateral FIL `json:"max_provider_collateral"`
+	// ClientCollateral is the collateral, in FIL, offered in deal proposals
+	ClientCollateral FIL `json:"client_collateral"`
+	// MinWalletBalance is the wallet balance, in FIL, under which no deals
+	// are made as they would fail on chain after the transfer, 0 disables
+	// the check
+	MinWalletBalance FIL `json:"min_wallet_balance"`
+	// LazyCommP defers computing the piece commitment of a content until a
+	// deal is about to be proposed for it
+	LazyCommP bool `json:"lazy_commp"`
+	// AutoOffloadSealedDeals is the number of sealed deals after which the
+	// hot copy of the contents that opted in is offloaded, 0 disables it
+	AutoOffloadSealedDeals int `json:"auto_offload_sealed_deals"`
+	// Wallets spreads the deals over several wallets of the node, each
+	// needing its own market escrow and datacap. The wallets under
+	// MinWalletBalance are skipped. Empty makes every deal from the default
+	// wallet.
+	Wallets []DealWallet `json:"wallets,omitempty"`
+	// CarSize bounds the size of the CAR of a content deals are made for,
+	// MinerCarSizes bounds it further for the miners listed, e.g. to the
+	// sector size they seal. Staging zones are aggregated before their
+	// miners are picked, so only CarSize shapes aggregates, the miners whose
+	// range a CAR is out of are left out of its deals.
+	CarSize       CarSize            `json:"car_size"`
+	MinerCarSizes map[string]CarSize `json:"miner_car_sizes,omitempty"`
+}
+
+// CarSize is the range of CAR sizes, in bytes, deals are made for
+type CarSize struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+// Validate checks that the range is not empty and that a CAR of the max size
+// still fits in the piece of the largest sector
+func (cs CarSize) Validate() error {
+	if cs.Min < 0 {
+		return fmt.Errorf("min car size must not be negative")
+	}
+
+	if cs.Max <= 0 {
+		return fmt.Errorf("max car size must be positive")
+	}
+
+	if cs.Min > cs.Max {
+		return fmt.Errorf("min car size %d is larger than the max car size %d", cs.Min, cs.Max)
+	}
+
+	if cs.Max > constants.MaxDealCarSize {
+		return fmt.Errorf("max car size %d is larger than the largest piece can hold (%d)", cs.Max, constants.MaxDealCarSize)
+	}
+	return nil
+}
+
+// Check returns an error if a CAR of the size is out of the range
+func (cs CarSize) Check(size int64) error {
+	if size < cs.Min {
+		return fmt.Errorf("car of %d bytes is under the min car size of %d", size, cs.Min)
+	}
+
+	if size > cs.Max {
+		return fmt.Errorf("car of %d bytes is over the max car size of %d", size, cs.Max)
+	}
+	return nil
+}
+
+// CheckCarSize returns an error if no deal for a CAR of the size can be made
+// with the miner
+func (cfg *Deal) CheckCarSize(miner address.Address, size int64) error {
+	if err := cfg.CarSize.Check(size); err != nil {
+		return err
+	}
+
+	if cs, ok := cfg.MinerCarSizes[miner.String()]; ok {
+		if err := cs.Check(size); err != nil {
+			return fmt.Errorf("miner %s: %w", miner, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *Deal) validateCarSizes() error {
+	if err := cfg.CarSize.Validate(); err != nil {
+		return err
+	}
+
+	for m, cs := range cfg.MinerCarSizes {
+		if _, err := address.NewFromString(m); err != nil {
+			return fmt.Errorf("invalid miner address %q in miner car sizes: %w", m, err)
+		}
+
+		if err := cs.Validate(); err != nil {
+			return fmt.Errorf("car size of miner %s: %w", m, err)
+		}
+	}
+	return nil
+}
+
+// DealWallet is a wallet deals are made from, the wallets take turns in
+// proportion to their weight
+type DealWallet struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+}
+
+// ParseDealWallet parses a deal wallet given as address:weight, the weight
+// defaults to 1
+func ParseDealWallet(s string) (DealWallet, error) {
+	addr, weight, found := strings.Cut(s, ":")
+	w := DealWallet{Address: addr, Weight: 1}
+	if found {
+		n, err := strconv.Atoi(weight)
+		if err != nil {
+			return DealWallet{}, fmt.Errorf("invalid weight of deal wallet %s: %w", addr, err)
+		}
+		w.Weight = n
+	}
+	return w, w.Validate()
+}
+
+func (w DealWallet) Validate() error {
+	if _, err := address.NewFromString(w.Address); err != nil {
+		return fmt.Errorf("invalid deal wallet address %q: %w", w.Address, err)
+	}
+
+	if w.Weight < 1 {
+		return fmt.Errorf("weight of deal wallet %s must be at least 1", w.Address)
+	}
+	return nil
+}
+
+func validateDealWallets(wallets []DealWallet) error {
+	seen := make(map[string]bool)
+	for _, w := range wallets {
+		if err := w.Validate(); err != nil {
+			return err
+		}
+
+		if seen[w.Address] {
+			return fmt.Errorf("deal wallet %s is listed more than once", w.Address)
+		}
+		seen[w.Address] = true
+	}
+	return nil
+}
+
+// ValidateDealDuration checks that deals of the duration, in epochs, outlive
+// the minimum safe deal lifetime and are accepted by the chain
+func ValidateDealDuration(d abi.ChainEpoch) error {
+	if d < constants.MinSafeDealLifetime {
+		return fmt.Errorf("deal duration of %d epochs is under the minimum of %d", d, constants.MinSafeDealLifetime)
+	}
+
+	if d > constants.MaxDealDuration {
+		return fmt.Errorf("deal duration of %d epochs is over the maximum of %d", d, constants.MaxDealDuration)
+	}
+	return nil
+}
+
+// FIL is a token amount that config files hold as a FIL value string, e.g.
+// "0.00000003", rather than as an attoFIL integer
+type FIL struct {
+	abi.TokenAmount
+}
+
+// ParseFIL parses a non negative FIL value, a value with an attofil suffix
+// is taken as attoFIL
+func ParseFIL(s string) (FIL, error) {
+	f, err := types.ParseFIL(s)
+	if err != nil {
+		return FIL{}, err
+	}
+
+	if f.Sign() < 0 {
+		return FIL{}, fmt.Errorf("FIL value %s is negative", s)
+	}
+	return FIL{abi.TokenAmount(f)}, nil
+}
+
+func MustParseFIL(s string) FIL {
+	f, err := ParseFIL(s)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (f FIL) String() string {
+	return types.FIL(f.TokenAmount).Unitless()
+}
+
+func (f FIL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.String())
+}
+
+func (f *FIL) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	p, err := ParseFIL(s)
+	if err != nil {
+		return err
+	}
+	*f = p
+	return nil
+}
+
+// DealPrice is a deal price ceiling in FIL per GiB per epoch. Configs written
+// before the ceilings were FIL values hold them as attoFIL integers, which are
+// still read as attoFIL. A valid ceiling is under 1 FIL, so a FIL value other
+// than 0 always has a decimal point.
+type DealPrice FIL
+
+func (p DealPrice) String() string {
+	return FIL(p).String()
+}
+
+func (p DealPrice) MarshalJSON() ([]byte, error) {
+	return FIL(p).MarshalJSON()
+}
+
+func (p *DealPrice) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n json.Number
+		if json.Unmarshal(b, &n) != nil {
+			return err
+		}
+		s = n.String()
+	}
+
+	if s != "" && strings.Trim(s, "0123456789") == "" {
+		atto, err := big.FromString(s)
+		if err != nil {
+			return err
+		}
+		*p = DealPrice{atto}
+		return nil
+	}
+
+	f, err := ParseFIL(s)
+	if err != nil {
+		return err
+	}
+	*p = DealPrice(f)
+	return nil
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"path/filepath"
 	"time"
 
@@ -21,6 +22,7 @@ type Estuary struct {
 	ServerCacheDir         string        `json:"server_cache_dir"`
 	DataDir                string        `json:"data_dir"`
 	ApiListen              string        `json:"api_listen"`
+	InternalListen         string        `json:"internal_listen"`
 	LightstepToken         string        `json:"lightstep_token"`
 	Hostname               string        `json:"hostname"`
 	DisableAutoRetrieve    bool          `json:"enable_autoretrieve"`
@@ -35,6 +37,7 @@ type Estuary struct {
 	StagingBucket          StagingBucket `json:"staging_bucket"`
 	Replication            int           `json:"replication"`
 	RPCMessage             RPCMessage    `json:"rpc_message"`
+	Server                 Server        `json:"server"`
 }
 
 func (cfg *Estuary) Load(filename string) error {
@@ -46,6 +49,76 @@ func (cfg *Estuary) Save(filename string) error {
 	return save(cfg, filename)
 }
 
+// maxDealPriceCeiling bounds the deal price ceilings, which are FIL values per
+// GiB per epoch. Anything close to it is almost certainly an attoFIL amount
+// written where a FIL value was expected.
+var maxDealPriceCeiling = MustParseFIL("1")
+
+func (cfg *Estuary) Validate() error {
+	if cfg.Deal.MaxPrice.GreaterThanEqual(maxDealPriceCeiling.TokenAmount) {
+		return fmt.Errorf("deal max price %s is not a FIL value per GiB per epoch", cfg.Deal.MaxPrice)
+	}
+
+	if cfg.Deal.MaxVerifiedPrice.GreaterThanEqual(maxDealPriceCeiling.TokenAmount) {
+		return fmt.Errorf("deal max verified price %s is not a FIL value per GiB per epoch", cfg.Deal.MaxVerifiedPrice)
+	}
+
+	if err := ValidateDealDuration(cfg.Deal.Duration); err != nil {
+		return err
+	}
+
+	if cfg.Content.PinRootValidationTimeout < 0 {
+		return fmt.Errorf("pin root validation timeout must not be negative")
+	}
+
+	if cfg.Content.PinTimeout <= 0 {
+		return fmt.Errorf("pin timeout must be positive")
+	}
+
+	if cfg.Deal.AutoOffloadSealedDeals < 0 {
+		return fmt.Errorf("auto offload sealed deals must not be negative")
+	}
+
+	if err := validateDealWallets(cfg.Deal.Wallets); err != nil {
+		return err
+	}
+
+	if err := cfg.Deal.validateCarSizes(); err != nil {
+		return err
+	}
+
+	if err := cfg.StagingBucket.Validate(); err != nil {
+		return err
+	}
+
+	// aggregates of a full staging zone must fit a deal, and the contents too
+	// large to be staged must not be too small for one
+	if cfg.StagingBucket.Enabled {
+		if cfg.StagingBucket.MaxSize > cfg.Deal.CarSize.Max {
+			return fmt.Errorf("staging zone max size %d is larger than the max car size %d", cfg.StagingBucket.MaxSize, cfg.Deal.CarSize.Max)
+		}
+
+		for name, tier := range cfg.StagingBucket.Tiers {
+			if tier.MaxSize > cfg.Deal.CarSize.Max {
+				return fmt.Errorf("staging zone tier %q max size %d is larger than the max car size %d", name, tier.MaxSize, cfg.Deal.CarSize.Max)
+			}
+		}
+
+		if cfg.StagingBucket.IndividualDealThreshold < cfg.Deal.CarSize.Min {
+			return fmt.Errorf("individual deal threshold %d is under the min car size %d", cfg.StagingBucket.IndividualDealThreshold, cfg.Deal.CarSize.Min)
+		}
+	}
+
+	if err := cfg.Server.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Node.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (cfg *Estuary) SetRequiredOptions() error {
 	//TODO validate required options values - check empty strings etc
 
@@ -55,6 +128,12 @@ func (cfg *Estuary) SetRequiredOptions() error {
 	cfg.Node.DatastoreDir = filepath.Join(cfg.DataDir, "estuary-leveldb")
 	cfg.Node.Libp2pKeyFile = filepath.Join(cfg.DataDir, "estuary-peer.key")
 
+	if cfg.Content.PinQueueDir == "" {
+		cfg.Content.PinQueueDir = cfg.DataDir
+	} else if !filepath.IsAbs(cfg.Content.PinQueueDir) {
+		cfg.Content.PinQueueDir = filepath.Join(cfg.DataDir, cfg.Content.PinQueueDir)
+	}
+
 	if cfg.Node.Blockstore == "" {
 		cfg.Node.Blockstore = filepath.Join(cfg.DataDir, "estuary-blocks")
 	}
@@ -67,6 +146,7 @@ func NewEstuary(appVersion string) *Estuary {
 		DataDir:                ".",
 		DatabaseConnString:     build.DefaultDatabaseValue,
 		ApiListen:              ":3004",
+		InternalListen:         "127.0.0.1:3104",
 		LightstepToken:         "",
 		Hostname:               "http://localhost:3004",
 		Replication:            6,
@@ -79,18 +159,28 @@ func NewEstuary(appVersion string) *Estuary {
 			IsDisabled:            false,
 			FailOnTransferFailure: false,
 			IsVerified:            true,
-			Duration:              abi.ChainEpoch(1555200 - (2880 * 21)), // Making default deal duration be three weeks less than the maximum to ensure miners who start their deals early dont run into issues
+			Duration:              constants.DealDuration,
 			EnabledDealProtocolsVersions: map[protocol.ID]bool{
 				filclient.DealProtocolv110: true,
 				filclient.DealProtocolv120: true,
 			},
-			MaxVerifiedPrice: constants.VerifiedDealMaxPrice,
-			MaxPrice:         constants.DealMaxPrice,
+			MaxVerifiedPrice: DealPrice(MustParseFIL(constants.DefaultVerifiedDealMaxPrice)),
+			MaxPrice:         DealPrice(MustParseFIL(constants.DefaultDealMaxPrice)),
+
+			MaxProviderCollateral: MustParseFIL("0"),
+			ClientCollateral:      MustParseFIL("0"),
+			MinWalletBalance:      MustParseFIL("0"),
+
+			CarSize: CarSize{
+				Min: constants.MinDealCarSize,
+				Max: constants.MaxDealCarSize,
+			},
 		},
 
 		Content: Content{
 			DisableLocalAdding:  false,
 			DisableGlobalAdding: false,
+			PinTimeout:          time.Hour * 24,
 		},
 
 		StagingBucket: StagingBucket{
@@ -106,6 +196,17 @@ func NewEstuary(appVersion string) *Estuary {
 			AggregateInterval:       time.Minute * 5,                                         // aggregate staging buckets every 5 minutes
 		},
 
+		// reads and writes are not bounded by default, uploads and gateway
+		// downloads can legitimately take hours
+		Server: Server{
+			ReadHeaderTimeout: time.Second * 10,
+			ReadTimeout:       0,
+			WriteTimeout:      0,
+			IdleTimeout:       time.Minute * 2,
+			MaxBodySize:       8 << 20,
+			MaxAddBodySize:    64 << 30,
+		},
+
 		Jaeger: Jaeger{
 			EnableTracing: false,
 			ProviderUrl:   "http://localhost:14268/api/traces",
@@ -127,6 +228,22 @@ func NewEstuary(appVersion string) *Estuary {
 			WriteLogTruncate:  false,
 			NoBlockstoreCache: false,
 
+			WriteLogMaxSize:       0,
+			WriteLogCheckInterval: time.Minute * 5,
+
+			BlockstoreCache: BlockstoreCache{
+				HasCacheSize:    8 << 20,
+				ReadCacheSize:   0,
+				ReadCachePolicy: ReadCachePolicyLRU,
+			},
+
+			BlockstoreType: "",
+			BlockstoreOptions: BlockstoreOptions{
+				Flatfs: FlatfsOptions{
+					ShardFunc: "/repo/flatfs/shard/v1/next-to-last/3",
+				},
+			},
+
 			IndexerURL:          "https://cid.contact",
 			IndexerTickInterval: 720,
 
@@ -179,9 +296,11 @@ func NewEstuary(appVersion string) *Estuary {
 			},
 		},
 		RPCMessage: RPCMessage{
-			IncomingQueueSize: 100000,
-			OutgoingQueueSize: 100000,
-			QueueHandlers:     30,
+			IncomingQueueSize:      100000,
+			OutgoingQueueSize:      100000,
+			QueueHandlers:          30,
+			GracefulClose:          true,
+			InlineAggregateMaxSize: 1 << 20,
 		},
 	}
 }
@@ -2,4 +2,10 @@ package config
 
 type Logging struct {
 	ApiEndpointLogging bool `json:"api_endpoint_logging"`
+	// BufferSize is the number of recent log lines kept in memory for remote
+	// reading, 0 disables the buffer
+	BufferSize int `json:"buffer_size"`
+	// Levels are the log levels of logging subsystems set over the defaults,
+	// e.g. {"shuttle": "debug"}
+	Levels map[string]string `json:"levels,omitempty"`
 }
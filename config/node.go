@@ -1,6 +1,9 @@
 package config
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/application-research/estuary/node/modules/peering"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 )
@@ -13,16 +16,135 @@ type Node struct {
 	EnableWebsocketListenAddr bool                     `json:"enable_websocket_listen_addr"`
 	HardFlushWriteLog         bool                     `json:"hard_flush_write_log"`
 	WriteLogTruncate          bool                     `json:"write_log_truncate"`
+	WriteLogMaxSize           int64                    `json:"write_log_max_size"`
+	WriteLogCheckInterval     time.Duration            `json:"write_log_check_interval"`
 	NoBlockstoreCache         bool                     `json:"no_blockstore_cache"`
+	BlockstoreCache           BlockstoreCache          `json:"blockstore_cache"`
 	NoLimiter                 bool                     `json:"no_limiter"`
 	IndexerURL                string                   `json:"indexer_url"`
 	Blockstore                string                   `json:"blockstore"`
+	BlockstoreType            string                   `json:"blockstore_type"`
+	BlockstoreOptions         BlockstoreOptions        `json:"blockstore_options"`
+	SecondaryBlockstore       string                   `json:"secondary_blockstore"`
 	WriteLogDir               string                   `json:"write_log_dir"`
 	Libp2pKeyFile             string                   `json:"libp2p_key_file"`
+	EphemeralIdentity         bool                     `json:"ephemeral_identity"`
 	DatastoreDir              string                   `json:"datastore_dir"`
 	WalletDir                 string                   `json:"wallet_dir"`
 	ApiURL                    string                   `json:"api_url"`
+	FallbackApiURLs           []string                 `json:"fallback_api_urls"`
 	Bitswap                   Bitswap                  `json:"bitswap"`
 	Limits                    rcmgr.ScalingLimitConfig `json:"limits"`
+	ResourceLimits            ResourceLimits           `json:"resource_limits"`
 	ConnectionManager         ConnectionManager        `json:"connection_manager"`
 }
+
+// ResourceLimits are simple caps on what libp2p may use, each replacing the
+// matching system limit of Limits, 0 keeps the one in Limits. Setting any of
+// them starts the resource manager even with NoLimiter set, it then enforces
+// only these caps.
+type ResourceLimits struct {
+	MaxConns   int `json:"max_conns"`
+	MaxStreams int `json:"max_streams"`
+	// MaxMemory is in bytes
+	MaxMemory int64 `json:"max_memory"`
+	MaxFD     int   `json:"max_fd"`
+}
+
+func (l ResourceLimits) IsSet() bool {
+	return l != ResourceLimits{}
+}
+
+// ScalingLimits returns Limits with the system limits capped by
+// ResourceLimits, a capped limit no longer scales with the machine
+func (cfg *Node) ScalingLimits() rcmgr.ScalingLimitConfig {
+	limits := cfg.Limits
+	rl := cfg.ResourceLimits
+
+	if rl.MaxConns > 0 {
+		limits.SystemBaseLimit.Conns = rl.MaxConns
+		limits.SystemLimitIncrease.Conns = 0
+	}
+
+	if rl.MaxStreams > 0 {
+		limits.SystemBaseLimit.Streams = rl.MaxStreams
+		limits.SystemLimitIncrease.Streams = 0
+	}
+
+	if rl.MaxMemory > 0 {
+		limits.SystemBaseLimit.Memory = rl.MaxMemory
+		limits.SystemLimitIncrease.Memory = 0
+	}
+
+	if rl.MaxFD > 0 {
+		limits.SystemBaseLimit.FD = rl.MaxFD
+		limits.SystemLimitIncrease.FDFraction = 0
+	}
+	return limits
+}
+
+// CappedLimits returns unlimited limits with only the system limits capped by
+// ResourceLimits, the ones enforced when NoLimiter is set
+func (cfg *Node) CappedLimits() rcmgr.LimitConfig {
+	limits := rcmgr.InfiniteLimits
+	rl := cfg.ResourceLimits
+
+	if rl.MaxConns > 0 {
+		limits.System.Conns = rl.MaxConns
+	}
+
+	if rl.MaxStreams > 0 {
+		limits.System.Streams = rl.MaxStreams
+	}
+
+	if rl.MaxMemory > 0 {
+		limits.System.Memory = rl.MaxMemory
+	}
+
+	if rl.MaxFD > 0 {
+		limits.System.FD = rl.MaxFD
+	}
+	return limits
+}
+
+// ChainEndpoints returns the chain api endpoints in the order they are tried,
+// ApiURL first and then the fallbacks
+func (cfg *Node) ChainEndpoints() []string {
+	var endpoints []string
+	for _, u := range append([]string{cfg.ApiURL}, cfg.FallbackApiURLs...) {
+		if u != "" {
+			endpoints = append(endpoints, u)
+		}
+	}
+	return endpoints
+}
+
+// Validate checks the write log rotation settings, WriteLogMaxSize is the
+// size in bytes over which the write log is flushed and compacted, 0
+// disables it, and WriteLogCheckInterval is how often its size is checked.
+// It also checks the blockstore backend and its options.
+func (cfg *Node) Validate() error {
+	if cfg.WriteLogMaxSize < 0 {
+		return fmt.Errorf("write log max size must not be negative")
+	}
+
+	if cfg.WriteLogCheckInterval <= 0 {
+		return fmt.Errorf("write log check interval must be positive")
+	}
+
+	if len(cfg.ChainEndpoints()) == 0 {
+		return fmt.Errorf("at least one chain api url must be set")
+	}
+
+	rl := cfg.ResourceLimits
+	if rl.MaxConns < 0 || rl.MaxStreams < 0 || rl.MaxMemory < 0 || rl.MaxFD < 0 {
+		return fmt.Errorf("resource limits must not be negative")
+	}
+
+	// the connection manager would never trim connections before the
+	// resource manager starts refusing new ones
+	if rl.MaxConns > 0 && rl.MaxConns <= cfg.ConnectionManager.HighWater {
+		return fmt.Errorf("max conns of %d must be over the connection manager high water of %d", rl.MaxConns, cfg.ConnectionManager.HighWater)
+	}
+	return cfg.validateBlockstoreType()
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// ShuttleHotReloadable are the json paths of the shuttle settings a config
+// reload applies to a running shuttle, a path covers all the settings under
+// it. Every other setting is only read at startup and needs a restart. The
+// heartbeat interval of the rpc connection applies from the next connection.
+var ShuttleHotReloadable = map[string]bool{
+	"dag_walk_concurrency":                 true,
+	"deal_expiry_window":                   true,
+	"transfer_failure_grace_period":        true,
+	"untracked_leaf_size":                  true,
+	"max_pin_queue_size":                   true,
+	"no_unpin_cleanup":                     true,
+	"verify_taken_content":                 true,
+	"logging.levels":                       true,
+	"estuary_remote.auth_retries":          true,
+	"estuary_remote.auth_retry_backoff":    true,
+	"rpc_message.pin_complete_chunk_size":  true,
+	"resilience.reconnect_initial_backoff": true,
+	"resilience.reconnect_max_backoff":     true,
+	"resilience.reconnect_multiplier":      true,
+	"resilience.reconnect_alert_after":     true,
+	"resilience.heartbeat_interval":        true,
+	"resilience.heartbeat_timeout":         true,
+	"resilience.write_timeout":             true,
+	"origin_connect":                       true,
+	"provide.default_ttl":                  true,
+	"split.retries":                        true,
+	"retrieval.concurrency":                true,
+	"aggregation":                          true,
+	"benchmark":                            true,
+}
+
+// ReloadShuttle returns a copy of cur holding the hot reloadable settings of
+// next, along with the paths of the settings that changed and were applied
+// and of the ones that changed but need a restart
+func ReloadShuttle(cur, next *Shuttle) (*Shuttle, []string, []string) {
+	updated := *cur
+
+	var applied, restart []string
+	diffSettings(reflect.ValueOf(&updated).Elem(), reflect.ValueOf(next).Elem(), "", func(path string, dst, src reflect.Value) {
+		if !isHotReloadable(path) {
+			restart = append(restart, path)
+			return
+		}
+		dst.Set(src)
+		applied = append(applied, path)
+	})
+	return &updated, applied, restart
+}
+
+// diffSettings calls changed for every setting that differs between dst and
+// src, going into the nested settings structs of this package
+func diffSettings(dst, src reflect.Value, prefix string, changed func(path string, dst, src reflect.Value)) {
+	pkg := reflect.TypeOf(Shuttle{}).PkgPath()
+
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		if field.Type.Kind() == reflect.Struct && field.Type.PkgPath() == pkg {
+			diffSettings(dst.Field(i), src.Field(i), path, changed)
+			continue
+		}
+
+		if !reflect.DeepEqual(dst.Field(i).Interface(), src.Field(i).Interface()) {
+			changed(path, dst.Field(i), src.Field(i))
+		}
+	}
+}
+
+func isHotReloadable(path string) bool {
+	for {
+		if ShuttleHotReloadable[path] {
+			return true
+		}
+
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			return false
+		}
+		path = path[:i]
+	}
+}
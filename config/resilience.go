@@ -0,0 +1,84 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+// Resilience groups the knobs of how a shuttle keeps its rpc connection to
+// estuary going: reconnecting, noticing a dead connection, resending the
+// messages estuary missed and backing off while estuary is failing
+type Resilience struct {
+	// reconnects are retried with an exponential backoff between these
+	ReconnectInitialBackoff time.Duration `json:"reconnect_initial_backoff"`
+	ReconnectMaxBackoff     time.Duration `json:"reconnect_max_backoff"`
+	ReconnectMultiplier     float64       `json:"reconnect_multiplier"`
+	// ReconnectAlertAfter is the number of failed reconnects in a row after
+	// which an error is raised, 0 never raises one
+	ReconnectAlertAfter int `json:"reconnect_alert_after"`
+
+	// a heartbeat is sent when nothing was written to estuary for
+	// HeartbeatInterval, and the connection is dropped when nothing could
+	// be written for HeartbeatTimeout. 0 disables heartbeats.
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+	HeartbeatTimeout  time.Duration `json:"heartbeat_timeout"`
+
+	// WriteTimeout bounds how long writing a single message may take
+	WriteTimeout time.Duration `json:"write_timeout"`
+
+	// MaxResends is the number of times an unacked durable message is sent
+	// again before it is dropped, 0 resends it until it expires
+	MaxResends int `json:"max_resends"`
+
+	// BreakerThreshold is the number of failed sends in a row after which a
+	// shuttle stops sending messages to estuary for BreakerCooldown, 0
+	// disables it. Messages that are not durable are dropped while it is
+	// open.
+	BreakerThreshold int           `json:"breaker_threshold"`
+	BreakerCooldown  time.Duration `json:"breaker_cooldown"`
+}
+
+func (cfg *Resilience) Validate() error {
+	if cfg.ReconnectInitialBackoff <= 0 {
+		return errors.New("rpc reconnect initial backoff must be positive")
+	}
+
+	if cfg.ReconnectMaxBackoff < cfg.ReconnectInitialBackoff {
+		return errors.New("rpc reconnect max backoff must not be less than the initial backoff")
+	}
+
+	if cfg.ReconnectMultiplier < 1 {
+		return errors.New("rpc reconnect multiplier must be at least 1")
+	}
+
+	if cfg.ReconnectAlertAfter < 0 {
+		return errors.New("rpc reconnect alert after must not be negative")
+	}
+
+	if cfg.WriteTimeout <= 0 {
+		return errors.New("rpc write timeout must be positive")
+	}
+
+	if cfg.HeartbeatInterval < 0 {
+		return errors.New("rpc heartbeat interval must not be negative")
+	}
+
+	// an idle connection would be dropped before its next heartbeat
+	if cfg.HeartbeatInterval > 0 && cfg.HeartbeatTimeout <= cfg.HeartbeatInterval {
+		return errors.New("rpc heartbeat timeout must be longer than the heartbeat interval")
+	}
+
+	// a heartbeat that is still being written is not a dead connection yet
+	if cfg.HeartbeatInterval > 0 && cfg.HeartbeatTimeout <= cfg.WriteTimeout {
+		return errors.New("rpc heartbeat timeout must be longer than the write timeout")
+	}
+
+	if cfg.MaxResends < 0 {
+		return errors.New("rpc max resends must not be negative")
+	}
+
+	if cfg.BreakerThreshold > 0 && cfg.BreakerCooldown <= 0 {
+		return errors.New("rpc breaker cooldown must be positive")
+	}
+	return nil
+}
@@ -1,7 +1,33 @@
 package config
 
 type RPCMessage struct {
-	IncomingQueueSize int `json:"incoming_queue_size"`
-	OutgoingQueueSize int `json:"outgoing_queue_size"`
-	QueueHandlers     int `json:"queue_handlers"`
+	IncomingQueueSize int  `json:"incoming_queue_size"`
+	OutgoingQueueSize int  `json:"outgoing_queue_size"`
+	QueueHandlers     int  `json:"queue_handlers"`
+	GracefulClose     bool `json:"graceful_close"`
+
+	// PinCompleteChunkSize is the maximum number of objects reported in a
+	// single pin complete message, larger pins are reported in chunks
+	PinCompleteChunkSize int `json:"pin_complete_chunk_size"`
+
+	// DisconnectedSend is what a shuttle does with a message sent while its
+	// connection to estuary is down, one of the DisconnectedSend* modes
+	DisconnectedSend string `json:"disconnected_send"` // not valid for estuary
+
+	// InlineAggregateMaxSize is the largest aggregate block sent inline with
+	// an aggregate command, larger ones are fetched by the shuttle over
+	// bitswap instead. 0 always sends it inline.
+	InlineAggregateMaxSize int `json:"inline_aggregate_max_size"` // not valid for shuttle
 }
+
+const (
+	// DisconnectedSendBlock waits for the connection to come back or for
+	// the sender to give up
+	DisconnectedSendBlock = "block"
+	// DisconnectedSendFail fails every message right away
+	DisconnectedSendFail = "fail"
+	// DisconnectedSendBuffer leaves durable messages in the outbox to be
+	// replayed once reconnected and queues the others up to the size of the
+	// outgoing queue, failing them once it is full
+	DisconnectedSendBuffer = "buffer"
+)
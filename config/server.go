@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// ReadHeaderTimeout - time allowed to read the headers of a request
+// ReadTimeout - time allowed to read a whole request, body included, 0 disables it
+// WriteTimeout - time allowed to write a response, 0 disables it
+// IdleTimeout - time a keep-alive connection is kept open waiting for the next request
+// MaxBodySize - max size in bytes of a request body, except for the add endpoints
+// MaxAddBodySize - max size in bytes of the body of an upload to the add endpoints, 0 disables it
+type Server struct {
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout"`
+	ReadTimeout       time.Duration `json:"read_timeout"`
+	WriteTimeout      time.Duration `json:"write_timeout"`
+	IdleTimeout       time.Duration `json:"idle_timeout"`
+	MaxBodySize       int64         `json:"max_body_size"`
+	MaxAddBodySize    int64         `json:"max_add_body_size"`
+}
+
+func (cfg *Server) Validate() error {
+	if cfg.ReadHeaderTimeout <= 0 {
+		return fmt.Errorf("server read header timeout must be positive")
+	}
+
+	if cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.IdleTimeout < 0 {
+		return fmt.Errorf("server timeouts must not be negative")
+	}
+
+	if cfg.MaxBodySize <= 0 {
+		return fmt.Errorf("server max body size must be positive")
+	}
+
+	if cfg.MaxAddBodySize < 0 {
+		return fmt.Errorf("server max add body size must not be negative")
+	}
+
+	if cfg.MaxAddBodySize > 0 && cfg.MaxAddBodySize < cfg.MaxBodySize {
+		return fmt.Errorf("server max add body size %d is smaller than the max body size %d", cfg.MaxAddBodySize, cfg.MaxBodySize)
+	}
+	return nil
+}
@@ -2,10 +2,15 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"path/filepath"
+	"runtime"
+	"time"
 
+	"github.com/application-research/estuary/constants"
 	"github.com/application-research/estuary/node/modules/peering"
+	"github.com/filecoin-project/go-state-types/builtin"
 )
 
 const DefaultWebsocketAddr = "/ip4/0.0.0.0/tcp/6747/ws"
@@ -14,24 +19,149 @@ type EstuaryRemote struct {
 	Api       string `json:"api"`
 	Handle    string `json:"handle"`
 	AuthToken string `json:"auth_token"`
+	// AuthRetries is how many more times a user auth check is tried when
+	// estuary fails with a server or network error
+	AuthRetries      int           `json:"auth_retries"`
+	AuthRetryBackoff time.Duration `json:"auth_retry_backoff"`
+}
+
+// OriginConnect controls how a shuttle connects to the origin peers of the
+// content it is asked to pin
+type OriginConnect struct {
+	// Retries is how many more times connecting to an origin peer is tried
+	Retries int           `json:"retries"`
+	Backoff time.Duration `json:"backoff"`
+	// FailFast fails a pin right away when none of its origin peers could be
+	// connected to, instead of hoping bitswap finds another provider
+	FailFast bool `json:"fail_fast"`
+}
+
+// Provide controls how the content pinned by a shuttle is announced to the
+// dht, the cids are announced in batches
+type Provide struct {
+	BatchSize     int           `json:"batch_size"`
+	FlushInterval time.Duration `json:"flush_interval"`
+	// Concurrency is how many batches are announced at once
+	Concurrency int `json:"concurrency"`
+	// DefaultTTL is how long the provider records of a pin without a ttl
+	// hint last before they are announced again, 0 leaves them to the
+	// periodic reprovide of all the content
+	DefaultTTL time.Duration `json:"default_ttl"`
+}
+
+// Scrub controls the background check of the blocks of active pins against
+// their cids
+type Scrub struct {
+	// Interval between two scrub runs, 0 disables scrubbing
+	Interval time.Duration `json:"interval"`
+	// PinsPerRun is how many active pins are checked on every run, following
+	// a random one
+	PinsPerRun int `json:"pins_per_run"`
+	// SampleFraction is the fraction of the blocks of a pin that are checked
+	SampleFraction float64 `json:"sample_fraction"`
+}
+
+// Split controls how a shuttle packs large content into boxes when asked to
+// split it
+type Split struct {
+	// CheckpointDir is where the packing state of a split is saved after every
+	// box, so an interrupted split resumes from the last completed box
+	CheckpointDir string `json:"checkpoint_dir"`
+	// Retries is how many more times packing is tried after it failed, each
+	// time resuming from the last checkpoint
+	Retries int `json:"retries"`
+}
+
+// Retrieval controls how many retrievals from miners a shuttle runs at once
+type Retrieval struct {
+	// Concurrency is how many retrievals run at once, the others wait in a
+	// queue for their turn
+	Concurrency int `json:"concurrency"`
+	// FairPerUser serves the queued retrievals of each user in turn instead of
+	// in arrival order, so a burst from one user does not starve the others
+	FairPerUser bool `json:"fair_per_user"`
+}
+
+// Aggregation controls the checks a shuttle runs on the members of an
+// aggregate before building it
+type Aggregation struct {
+	// MemberCodecs are the codecs the root of a member may have, an aggregate
+	// is a unixfs directory and only dag-pb and raw links resolve through it
+	MemberCodecs []string `json:"member_codecs"`
+	// MatchCidVersion requires the roots of the members to have the cid
+	// version of the aggregate root
+	MatchCidVersion bool `json:"match_cid_version"`
+	// WarnOnMismatch only logs the members failing the checks above instead
+	// of refusing the aggregate
+	WarnOnMismatch bool `json:"warn_on_mismatch"`
+}
+
+// Offload controls when a shuttle asks estuary to move some of its content
+// to other shuttles as its disk fills up
+type Offload struct {
+	// HighWatermark is the fraction of the blockstore disk in use over which
+	// the shuttle asks for an offload, 0 disables it
+	HighWatermark float64 `json:"high_watermark"`
+	// Size is how many bytes of content an offload request names, the least
+	// recently retrieved content going first
+	Size int64 `json:"size"`
+	// Cooldown is the minimum time between two offload requests, giving
+	// estuary the time to move the content of the previous one
+	Cooldown time.Duration `json:"cooldown"`
+}
+
+// Benchmark sizes the synthetic content a shuttle benchmark runs on
+type Benchmark struct {
+	// Size is the size of the content of a benchmark that does not ask for
+	// one, MaxSize the largest a benchmark may ask for
+	Size    int64 `json:"size"`
+	MaxSize int64 `json:"max_size"`
 }
 
 type Shuttle struct {
-	AppVersion         string        `json:"app_version"`
-	DatabaseConnString string        `json:"database_conn_string"`
-	StagingDataDir     string        `json:"staging_data_dir"`
-	DataDir            string        `json:"data_dir"`
-	ApiListen          string        `json:"api_listen"`
-	Hostname           string        `json:"hostname"`
-	Private            bool          `json:"private"`
-	Dev                bool          `json:"dev"`
-	NoReloadPinQueue   bool          `json:"no_reload_pin_queue"`
-	Node               Node          `json:"node"`
-	Jaeger             Jaeger        `json:"jaeger"`
-	Content            Content       `json:"content"`
-	Logging            Logging       `json:"logging"`
-	EstuaryRemote      EstuaryRemote `json:"estuary_remote"`
-	RPCMessage         RPCMessage    `json:"rpc_message"`
+	AppVersion                 string        `json:"app_version"`
+	DatabaseConnString         string        `json:"database_conn_string"`
+	StagingDataDir             string        `json:"staging_data_dir"`
+	DataDir                    string        `json:"data_dir"`
+	ApiListen                  string        `json:"api_listen"`
+	InternalListen             string        `json:"internal_listen"`
+	Hostname                   string        `json:"hostname"`
+	Private                    bool          `json:"private"`
+	Dev                        bool          `json:"dev"`
+	NoReloadPinQueue           bool          `json:"no_reload_pin_queue"`
+	NoUnpinCleanup             bool          `json:"no_unpin_cleanup"`
+	ReconcileOnStartup         bool          `json:"reconcile_on_startup"`
+	MaxPinQueueSize            int           `json:"max_pin_queue_size"`
+	RetrievalOnly              bool          `json:"retrieval_only"`
+	MinFreeSpace               uint64        `json:"min_free_space"`
+	MinFreeMemory              uint64        `json:"min_free_memory"`
+	UploadTempDir              string        `json:"upload_temp_dir"`
+	MaxUploadTempSpace         uint64        `json:"max_upload_temp_space"`
+	TakeContentConcurrency     int           `json:"take_content_concurrency"`
+	VerifyTakenContent         bool          `json:"verify_taken_content"`
+	DagWalkConcurrency         int           `json:"dag_walk_concurrency"`
+	MaxDagWalks                int           `json:"max_dag_walks"`
+	MaxCarImports              int           `json:"max_car_imports"`
+	CommpConcurrency           int           `json:"commp_concurrency"`
+	DBWriters                  int           `json:"db_writers"`
+	TransferFailureGracePeriod time.Duration `json:"transfer_failure_grace_period"`
+	DealExpiryWindow           time.Duration `json:"deal_expiry_window"`
+	UntrackedLeafSize          int           `json:"untracked_leaf_size"`
+	Node                       Node          `json:"node"`
+	Jaeger                     Jaeger        `json:"jaeger"`
+	Content                    Content       `json:"content"`
+	Logging                    Logging       `json:"logging"`
+	EstuaryRemote              EstuaryRemote `json:"estuary_remote"`
+	RPCMessage                 RPCMessage    `json:"rpc_message"`
+	Resilience                 Resilience    `json:"resilience"`
+	OriginConnect              OriginConnect `json:"origin_connect"`
+	Scrub                      Scrub         `json:"scrub"`
+	Provide                    Provide       `json:"provide"`
+	Split                      Split         `json:"split"`
+	Retrieval                  Retrieval     `json:"retrieval"`
+	Aggregation                Aggregation   `json:"aggregation"`
+	Offload                    Offload       `json:"offload"`
+	Benchmark                  Benchmark     `json:"benchmark"`
 }
 
 func (cfg *Shuttle) Load(filename string) error {
@@ -51,6 +181,123 @@ func (cfg *Shuttle) Validate() error {
 	if cfg.EstuaryRemote.Handle == "" {
 		return errors.New("no handle configured or specified on command line")
 	}
+
+	if cfg.TakeContentConcurrency < 1 {
+		return errors.New("take content concurrency must be at least 1")
+	}
+
+	if cfg.DBWriters < 1 {
+		return errors.New("db writers must be at least 1")
+	}
+
+	if cfg.DagWalkConcurrency < 1 {
+		return errors.New("dag walk concurrency must be at least 1")
+	}
+
+	if cfg.MaxDagWalks < 1 {
+		return errors.New("max dag walks must be at least 1")
+	}
+
+	if cfg.MaxCarImports < 1 {
+		return errors.New("max car imports must be at least 1")
+	}
+
+	if cfg.Content.PinTimeout <= 0 {
+		return errors.New("pin timeout must be positive")
+	}
+
+	if cfg.MaxPinQueueSize < 0 {
+		return errors.New("max pin queue size must not be negative")
+	}
+
+	if cfg.CommpConcurrency < 1 {
+		return errors.New("commp concurrency must be at least 1")
+	}
+
+	if cfg.OriginConnect.Retries < 0 {
+		return errors.New("origin connect retries must not be negative")
+	}
+
+	if cfg.DealExpiryWindow < 0 {
+		return errors.New("deal expiry window must not be negative")
+	}
+
+	// a longer window would report deals as expiring as soon as they are made
+	if lifetime := time.Duration(constants.MinSafeDealLifetime) * builtin.EpochDurationSeconds * time.Second; cfg.DealExpiryWindow >= lifetime {
+		return fmt.Errorf("deal expiry window of %s must be shorter than the minimum deal lifetime of %s", cfg.DealExpiryWindow, lifetime)
+	}
+
+	if err := cfg.Node.Validate(); err != nil {
+		return err
+	}
+
+	if cfg.UntrackedLeafSize < 0 {
+		return errors.New("untracked leaf size must not be negative")
+	}
+
+	if err := cfg.Resilience.Validate(); err != nil {
+		return err
+	}
+
+	switch cfg.RPCMessage.DisconnectedSend {
+	case DisconnectedSendBlock, DisconnectedSendFail, DisconnectedSendBuffer:
+	default:
+		return fmt.Errorf("rpc disconnected send must be one of %s, %s or %s", DisconnectedSendBlock, DisconnectedSendFail, DisconnectedSendBuffer)
+	}
+
+	if cfg.Provide.BatchSize < 1 {
+		return errors.New("provide batch size must be at least 1")
+	}
+
+	if cfg.Provide.FlushInterval <= 0 {
+		return errors.New("provide flush interval must be positive")
+	}
+
+	if cfg.Provide.Concurrency < 1 {
+		return errors.New("provide concurrency must be at least 1")
+	}
+
+	if cfg.Provide.DefaultTTL < 0 {
+		return errors.New("provide default ttl must not be negative")
+	}
+
+	if cfg.Split.Retries < 0 {
+		return errors.New("split retries must not be negative")
+	}
+
+	if cfg.Retrieval.Concurrency < 1 {
+		return errors.New("retrieval concurrency must be at least 1")
+	}
+
+	if len(cfg.Aggregation.MemberCodecs) == 0 {
+		return errors.New("at least one aggregation member codec must be allowed")
+	}
+
+	if cfg.Offload.HighWatermark < 0 || cfg.Offload.HighWatermark >= 1 {
+		return errors.New("offload high watermark must be at least 0 and under 1")
+	}
+
+	if cfg.Offload.HighWatermark > 0 && cfg.Offload.Size < 1 {
+		return errors.New("offload size must be at least 1 byte")
+	}
+
+	if cfg.Benchmark.Size < 1 {
+		return errors.New("benchmark size must be at least 1 byte")
+	}
+
+	if cfg.Benchmark.MaxSize < cfg.Benchmark.Size {
+		return errors.New("benchmark max size must not be less than the benchmark size")
+	}
+
+	if cfg.Scrub.Interval > 0 {
+		if cfg.Scrub.PinsPerRun < 1 {
+			return errors.New("scrub pins per run must be at least 1")
+		}
+
+		if cfg.Scrub.SampleFraction <= 0 || cfg.Scrub.SampleFraction > 1 {
+			return errors.New("scrub sample fraction must be over 0 and at most 1")
+		}
+	}
 	return nil
 }
 
@@ -62,6 +309,24 @@ func (cfg *Shuttle) SetRequiredOptions() error {
 	cfg.Node.DatastoreDir = filepath.Join(cfg.DataDir, "leveldb")
 	cfg.Node.Libp2pKeyFile = filepath.Join(cfg.DataDir, "peer.key")
 
+	if cfg.UploadTempDir == "" {
+		cfg.UploadTempDir = filepath.Join(cfg.DataDir, "uploads")
+	} else if !filepath.IsAbs(cfg.UploadTempDir) {
+		cfg.UploadTempDir = filepath.Join(cfg.DataDir, cfg.UploadTempDir)
+	}
+
+	if cfg.Split.CheckpointDir == "" {
+		cfg.Split.CheckpointDir = filepath.Join(cfg.DataDir, "split-checkpoints")
+	} else if !filepath.IsAbs(cfg.Split.CheckpointDir) {
+		cfg.Split.CheckpointDir = filepath.Join(cfg.DataDir, cfg.Split.CheckpointDir)
+	}
+
+	if cfg.Content.PinQueueDir == "" {
+		cfg.Content.PinQueueDir = cfg.DataDir
+	} else if !filepath.IsAbs(cfg.Content.PinQueueDir) {
+		cfg.Content.PinQueueDir = filepath.Join(cfg.DataDir, cfg.Content.PinQueueDir)
+	}
+
 	if cfg.Node.Blockstore == "" {
 		cfg.Node.Blockstore = filepath.Join(cfg.DataDir, "blocks")
 	} else if cfg.Node.Blockstore[0] != '/' && cfg.Node.Blockstore[0] != ':' {
@@ -72,17 +337,32 @@ func (cfg *Shuttle) SetRequiredOptions() error {
 
 func NewShuttle(appVersion string) *Shuttle {
 	return &Shuttle{
-		AppVersion:         appVersion,
-		DataDir:            ".",
-		DatabaseConnString: "sqlite=estuary-shuttle.db",
-		ApiListen:          ":3005",
-		Hostname:           "",
-		Private:            false,
-		Dev:                false,
-		NoReloadPinQueue:   false,
+		AppVersion:             appVersion,
+		DataDir:                ".",
+		DatabaseConnString:     "sqlite=estuary-shuttle.db",
+		ApiListen:              ":3005",
+		InternalListen:         "127.0.0.1:3105",
+		MaxUploadTempSpace:     100 << 30,
+		TakeContentConcurrency: 100,
+		VerifyTakenContent:     true,
+		DagWalkConcurrency:     32,
+		MaxDagWalks:            16,
+		MaxCarImports:          4,
+		CommpConcurrency:       defaultCommpConcurrency(),
+		DealExpiryWindow:       time.Hour * 24 * 14,
+		DBWriters:              1,
+		Hostname:               "",
+		Private:                false,
+		Dev:                    false,
+		NoReloadPinQueue:       false,
+		NoUnpinCleanup:         false,
+		ReconcileOnStartup:     false,
+		MaxPinQueueSize:        0,
+		RetrievalOnly:          false,
 
 		Content: Content{
 			DisableLocalAdding: false,
+			PinTimeout:         time.Hour * 24,
 		},
 
 		Jaeger: Jaeger{
@@ -93,6 +373,7 @@ func NewShuttle(appVersion string) *Shuttle {
 
 		Logging: Logging{
 			ApiEndpointLogging: false,
+			BufferSize:         10000,
 		},
 
 		Node: Node{
@@ -109,6 +390,22 @@ func NewShuttle(appVersion string) *Shuttle {
 			WriteLogTruncate:  false,
 			NoBlockstoreCache: false,
 
+			WriteLogMaxSize:       0,
+			WriteLogCheckInterval: time.Minute * 5,
+
+			BlockstoreCache: BlockstoreCache{
+				HasCacheSize:    8 << 20,
+				ReadCacheSize:   0,
+				ReadCachePolicy: ReadCachePolicyLRU,
+			},
+
+			BlockstoreType: "",
+			BlockstoreOptions: BlockstoreOptions{
+				Flatfs: FlatfsOptions{
+					ShardFunc: "/repo/flatfs/shard/v1/next-to-last/3",
+				},
+			},
+
 			ApiURL: "wss://api.chain.love",
 
 			Bitswap: Bitswap{
@@ -159,13 +456,84 @@ func NewShuttle(appVersion string) *Shuttle {
 		},
 
 		EstuaryRemote: EstuaryRemote{
-			Api:       "api.estuary.tech",
-			Handle:    "",
-			AuthToken: "",
+			Api:              "api.estuary.tech",
+			Handle:           "",
+			AuthToken:        "",
+			AuthRetries:      3,
+			AuthRetryBackoff: time.Millisecond * 200,
 		},
 		RPCMessage: RPCMessage{
-			OutgoingQueueSize: 100000,
-			IncomingQueueSize: 100000,
+			OutgoingQueueSize:    100000,
+			IncomingQueueSize:    100000,
+			GracefulClose:        true,
+			PinCompleteChunkSize: 100000,
+			DisconnectedSend:     DisconnectedSendBuffer,
+		},
+		Resilience: Resilience{
+			ReconnectInitialBackoff: time.Second * 5,
+			ReconnectMaxBackoff:     time.Second * 10,
+			ReconnectMultiplier:     1.5,
+			ReconnectAlertAfter:     20,
+			HeartbeatInterval:       time.Second * 30,
+			HeartbeatTimeout:        time.Minute * 2,
+			WriteTimeout:            time.Second * 30,
+			MaxResends:              0,
+			BreakerThreshold:        0,
+			BreakerCooldown:         time.Second * 30,
 		},
+		OriginConnect: OriginConnect{
+			Retries:  2,
+			Backoff:  time.Second * 2,
+			FailFast: false,
+		},
+
+		Provide: Provide{
+			BatchSize:     256,
+			FlushInterval: time.Second * 2,
+			Concurrency:   8,
+		},
+
+		Scrub: Scrub{
+			// opt in, every run reads blocks off the disk
+			Interval:       0,
+			PinsPerRun:     10,
+			SampleFraction: 0.01,
+		},
+
+		Split: Split{
+			Retries: 2,
+		},
+
+		Retrieval: Retrieval{
+			Concurrency: 8,
+			FairPerUser: false,
+		},
+
+		Aggregation: Aggregation{
+			MemberCodecs:    []string{"dag-pb", "raw"},
+			MatchCidVersion: false,
+			WarnOnMismatch:  false,
+		},
+
+		Offload: Offload{
+			HighWatermark: 0,
+			Size:          100 << 30,
+			Cooldown:      time.Hour,
+		},
+
+		Benchmark: Benchmark{
+			Size:    256 << 20,
+			MaxSize: 8 << 30,
+		},
+	}
+}
+
+// defaultCommpConcurrency leaves half the cores to pinning and serving
+// content while piece commitments are computed
+func defaultCommpConcurrency() int {
+	n := runtime.GOMAXPROCS(0) / 2
+	if n < 1 {
+		return 1
 	}
+	return n
 }
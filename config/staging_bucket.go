@@ -1,6 +1,11 @@
 package config
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+)
 
 // MaxLifeTime - amount of time a staging zone will remain open before we aggregate it into a piece of content
 // MaxContentAge - maximum amount of time a piece of content will go without either being aggregated or having a deal made for it
@@ -10,15 +15,61 @@ import "time"
 // MaxItems - max number of items a bucket can hold before it is aggregated
 // MinDealSize - minimum deal size that bucket must meet before it is ever considered for aggregation
 // AggregateInterval - interval to aggregate staging contents
+// Tiers - named staging zone size limits that users can be assigned to instead of MinSize and MaxSize
 type StagingBucket struct {
-	Enabled                 bool          `json:"enabled"`
-	MinSize                 int64         `json:"min_size"`
-	MaxSize                 int64         `json:"max_size"`
-	MinDealSize             int64         `json:"min_deal_size"`
-	IndividualDealThreshold int64         `json:"individual_deal_threshold"`
-	MaxItems                int           `json:"max_items"`
-	MaxContentAge           time.Duration `json:"max_content_age"`
-	KeepAlive               time.Duration `json:"keep_alive"`
-	MaxLifeTime             time.Duration `json:"max_life_time"`
-	AggregateInterval       time.Duration `json:"aggregate_interval"`
+	Enabled                 bool                       `json:"enabled"`
+	MinSize                 int64                      `json:"min_size"`
+	MaxSize                 int64                      `json:"max_size"`
+	MinDealSize             int64                      `json:"min_deal_size"`
+	IndividualDealThreshold int64                      `json:"individual_deal_threshold"`
+	MaxItems                int                        `json:"max_items"`
+	MaxContentAge           time.Duration              `json:"max_content_age"`
+	KeepAlive               time.Duration              `json:"keep_alive"`
+	MaxLifeTime             time.Duration              `json:"max_life_time"`
+	AggregateInterval       time.Duration              `json:"aggregate_interval"`
+	Tiers                   map[string]StagingZoneSize `json:"tiers"`
+}
+
+// StagingZoneSize are the size limits of a staging zone, see MinSize and
+// MaxSize of StagingBucket
+type StagingZoneSize struct {
+	MinSize int64 `json:"min_size"`
+	MaxSize int64 `json:"max_size"`
+}
+
+func (zs StagingZoneSize) Validate() error {
+	if zs.MinSize <= 0 || zs.MaxSize <= 0 {
+		return fmt.Errorf("staging zone sizes must be positive")
+	}
+
+	if zs.MinSize > zs.MaxSize {
+		return fmt.Errorf("staging zone min size %d is larger than its max size %d", zs.MinSize, zs.MaxSize)
+	}
+
+	if zs.MaxSize > constants.MaxStagingZoneSize {
+		return fmt.Errorf("staging zone max size %d is larger than the largest piece can hold (%d)", zs.MaxSize, constants.MaxStagingZoneSize)
+	}
+	return nil
+}
+
+func (cfg *StagingBucket) Validate() error {
+	if err := (StagingZoneSize{MinSize: cfg.MinSize, MaxSize: cfg.MaxSize}).Validate(); err != nil {
+		return err
+	}
+
+	if cfg.MaxItems < 1 {
+		return fmt.Errorf("staging bucket max items must be at least 1")
+	}
+
+	// contents under the threshold are staged, they have to fit in a zone
+	if cfg.IndividualDealThreshold > cfg.MaxSize {
+		return fmt.Errorf("individual deal threshold %d is larger than the staging zone max size %d", cfg.IndividualDealThreshold, cfg.MaxSize)
+	}
+
+	for name, tier := range cfg.Tiers {
+		if err := tier.Validate(); err != nil {
+			return fmt.Errorf("staging zone tier %q: %w", name, err)
+		}
+	}
+	return nil
 }
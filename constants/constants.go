@@ -4,13 +4,11 @@ import (
 	"time"
 
 	"github.com/filecoin-project/go-state-types/abi"
-	"github.com/filecoin-project/lotus/chain/types"
 )
 
 const DefaultContentSizeLimit = 34_000_000_000
 const ContentLocationLocal = "local"
 const TopMinerSel = 15
-const BucketingEnabled = true
 const MinSafeDealLifetime = 2880 * 21 // three weeks
 
 // amount of time a staging zone will remain open before we aggregate it into a piece of content
@@ -24,11 +22,12 @@ const StagingZoneKeepAlive = time.Minute * 40
 
 const MinDealSize = 256 << 20
 
-const MaxBucketItems = 10000
+// MaxDealDuration is the longest deal duration the chain accepts, 540 days
+const MaxDealDuration = 1555200
 
 // Making default deal duration be three weeks less than the maximum to ensure
 // miners who start their deals early dont run into issues
-const DealDuration = 1555200 - (2880 * 21)
+const DealDuration = MaxDealDuration - MinSafeDealLifetime
 
 // 90% of the unpadded data size for a 4GB piece
 // the 10% gap is to accommodate car file packing overhead, can probably do this better
@@ -40,19 +39,23 @@ var MaxStagingZoneSizeLimit = int64((abi.PaddedPieceSize(16<<30).Unpadded() * 9)
 // 13.29 GiB
 var MinStagingZoneSizeLimit = int64(MaxStagingZoneSizeLimit - (1 << 30))
 
+// 90% of the unpadded data size for a 64GB piece, the largest sector size,
+// no staging zone size can be configured above it
+var MaxStagingZoneSize = int64((abi.PaddedPieceSize(64<<30).Unpadded() * 9) / 10)
+
+// smallest CAR deals are made for by default
+const MinDealCarSize = 256 << 10
+
+// the unpadded data size of a 64GB piece, the largest sector size, no deal
+// CAR can be larger
+var MaxDealCarSize = int64(abi.PaddedPieceSize(64 << 30).Unpadded())
+
 const TokenExpiryDurationAdmin = time.Hour * 24 * 365           // 1 year
 const TokenExpiryDurationRegister = time.Hour * 24 * 7          // 1 week
 const TokenExpiryDurationLogin = time.Hour * 24 * 30            // 30 days
 const TokenExpiryDurationDefault = time.Hour * 24 * 30          // 30 days
 const TokenExpiryDurationPermanent = time.Hour * 24 * 365 * 100 // 100 years
 
-var DealMaxPrice abi.TokenAmount
-var VerifiedDealMaxPrice = abi.NewTokenAmount(0)
-
-func init() {
-	max, err := types.ParseFIL("0.00000003")
-	if err != nil {
-		panic(err)
-	}
-	DealMaxPrice = abi.TokenAmount(max)
-}
+// default deal price ceilings, in FIL per GiB per epoch
+const DefaultDealMaxPrice = "0.00000003"
+const DefaultVerifiedDealMaxPrice = "0"
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-metrics-interface"
+)
+
+// dealWallet is a wallet deals are made from, current is its standing in
+// the smooth weighted round-robin between the wallets
+type dealWallet struct {
+	addr    address.Address
+	weight  int
+	current int
+
+	balance   types.BigInt
+	checkedAt time.Time
+
+	dealsMetr   metrics.Counter
+	balanceMetr metrics.Gauge
+}
+
+// dealWallets picks the wallet each deal is made from, the wallets take
+// turns in proportion to their weight and the ones under the minimum balance
+// sit out until they are topped up
+type dealWallets struct {
+	lk      sync.Mutex
+	wallets []*dealWallet
+}
+
+func newDealWallets(cfg []config.DealWallet, defaddr address.Address) (*dealWallets, error) {
+	if len(cfg) == 0 {
+		cfg = []config.DealWallet{{Address: defaddr.String(), Weight: 1}}
+	}
+
+	metCtx := metrics.CtxScope(context.Background(), "content_manager")
+
+	dw := &dealWallets{}
+	for _, w := range cfg {
+		addr, err := address.NewFromString(w.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		wctx := metrics.CtxScope(metCtx, "deal_wallet_"+addr.String())
+		dw.wallets = append(dw.wallets, &dealWallet{
+			addr:        addr,
+			weight:      w.Weight,
+			dealsMetr:   metrics.NewCtx(wctx, "deals", "number of deals proposed from the wallet").Counter(),
+			balanceMetr: metrics.NewCtx(wctx, "balance", "balance of the wallet in FIL").Gauge(),
+		})
+	}
+	return dw, nil
+}
+
+// pick returns the wallet the next deal is made from, it fails with
+// ErrInsufficientWalletBalance when all the wallets are under min
+func (dw *dealWallets) pick(ctx context.Context, balanceOf func(context.Context, address.Address) (types.BigInt, error), min abi.TokenAmount) (address.Address, error) {
+	dw.lk.Lock()
+	defer dw.lk.Unlock()
+
+	// balances are only looked up when there is a minimum to check
+	checkBalance := min.Int != nil && !min.IsZero()
+
+	var best *dealWallet
+	total := 0
+	for _, w := range dw.wallets {
+		if checkBalance {
+			if time.Since(w.checkedAt) >= walletBalanceCheckInterval {
+				bal, err := balanceOf(ctx, w.addr)
+				if err != nil {
+					// not cached, the next deal tries again
+					return address.Undef, fmt.Errorf("failed to get balance of wallet %s: %w", w.addr, err)
+				}
+				w.balance = bal
+				w.checkedAt = time.Now()
+				w.balanceMetr.Set(filFloat(bal))
+			}
+
+			if w.balance.LessThan(min) {
+				continue
+			}
+		}
+
+		w.current += w.weight
+		total += w.weight
+		if best == nil || w.current > best.current {
+			best = w
+		}
+	}
+
+	if best == nil {
+		return address.Undef, fmt.Errorf("%w: no deal wallet holds the minimum of %s FIL", ErrInsufficientWalletBalance, types.FIL(min).Unitless())
+	}
+
+	best.current -= total
+	return best.addr, nil
+}
+
+// dealMade counts a deal proposed from the wallet
+func (dw *dealWallets) dealMade(addr address.Address) {
+	dw.lk.Lock()
+	defer dw.lk.Unlock()
+
+	for _, w := range dw.wallets {
+		if w.addr == addr {
+			w.dealsMetr.Inc()
+			return
+		}
+	}
+}
+
+func filFloat(bal types.BigInt) float64 {
+	f, _ := new(big.Float).SetInt(bal.Int).Float64()
+	return f / 1e18
+}
+
+// dealStatus asks the provider for the state of a deal. Providers only
+// answer the client of a deal, so the deals made from the other wallets are
+// asked for by a filclient signing with their wallet.
+func (cm *ContentManager) dealStatus(ctx context.Context, d *contentDeal, maddr address.Address, dealUUID *uuid.UUID) (*storagemarket.ProviderDealState, error) {
+	if d.ClientAddr == "" || d.ClientAddr == cm.FilClient.ClientAddr.String() {
+		return cm.FilClient.DealStatus(ctx, maddr, d.PropCid.CID, dealUUID)
+	}
+
+	client, err := address.NewFromString(d.ClientAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client address of deal %d: %w", d.ID, err)
+	}
+	return cm.walletFilClient(client).DealStatus(ctx, maddr, d.PropCid.CID, dealUUID)
+}
+
+// walletFilClient returns a filclient that signs its requests with a deal
+// wallet instead of the default one. It shares everything else with the
+// filclient of the content manager, the node wallet holds the keys of all the
+// deal wallets.
+func (cm *ContentManager) walletFilClient(client address.Address) *filclient.FilClient {
+	fc := *cm.FilClient
+	fc.ClientAddr = client
+	return &fc
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDealWalletsPick(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, _ := address.NewIDAddress(1001)
+	b, _ := address.NewIDAddress(1002)
+	dw, err := newDealWallets([]config.DealWallet{
+		{Address: a.String(), Weight: 2},
+		{Address: b.String(), Weight: 1},
+	}, address.Undef)
+	assert.NoError(err)
+
+	balances := map[address.Address]types.BigInt{
+		a: types.NewInt(100),
+		b: types.NewInt(100),
+	}
+	var lookups int
+	balanceOf := func(ctx context.Context, addr address.Address) (types.BigInt, error) {
+		lookups++
+		return balances[addr], nil
+	}
+
+	// the wallets take turns in proportion to their weight
+	picked := make(map[address.Address]int)
+	for i := 0; i < 6; i++ {
+		addr, err := dw.pick(ctx, balanceOf, abi.NewTokenAmount(10))
+		assert.NoError(err)
+		picked[addr]++
+	}
+	assert.Equal(4, picked[a])
+	assert.Equal(2, picked[b])
+
+	// balances are cached between deals
+	assert.Equal(2, lookups)
+
+	// underfunded wallets sit out
+	for _, w := range dw.wallets {
+		w.checkedAt = w.checkedAt.Add(-walletBalanceCheckInterval)
+	}
+	balances[a] = types.NewInt(1)
+	for i := 0; i < 3; i++ {
+		addr, err := dw.pick(ctx, balanceOf, abi.NewTokenAmount(10))
+		assert.NoError(err)
+		assert.Equal(b, addr)
+	}
+
+	for _, w := range dw.wallets {
+		w.checkedAt = w.checkedAt.Add(-walletBalanceCheckInterval)
+	}
+	balances[b] = types.NewInt(1)
+	_, err = dw.pick(ctx, balanceOf, abi.NewTokenAmount(10))
+	assert.True(errors.Is(err, ErrInsufficientWalletBalance))
+
+	// no balance is looked up without a minimum
+	lookups = 0
+	addr, err := dw.pick(ctx, func(context.Context, address.Address) (types.BigInt, error) {
+		lookups++
+		return types.EmptyInt, errors.New("no chain")
+	}, abi.NewTokenAmount(0))
+	assert.NoError(err)
+	assert.Equal(a, addr)
+	assert.Zero(lookups)
+}
@@ -1,6 +1,9 @@
 package drpc
 
 import (
+	"errors"
+	"time"
+
 	"github.com/application-research/estuary/pinner/types"
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/go-address"
@@ -20,6 +23,53 @@ type Hello struct {
 	AddrInfo              peer.AddrInfo
 	Private               bool
 	ContentAddingDisabled bool
+
+	// a retrieval-only shuttle serves the content it has but takes no new
+	// pins, uploads, splits or aggregates
+	RetrievalOnly bool
+
+	// Formats are the content formats the shuttle can process, nil for
+	// shuttles that predate reporting them
+	Formats *ContentFormats `json:",omitempty"`
+
+	// Reconcile asks estuary for the contents it expects the shuttle to have,
+	// see ReconcilePins
+	Reconcile bool `json:",omitempty"`
+
+	// FetchesAggregateBlocks is set by shuttles that fetch an aggregate block
+	// not sent inline from the Peers of AggregateContent
+	FetchesAggregateBlocks bool `json:",omitempty"`
+}
+
+// ContentFormats are the ipld codecs and multihash functions a shuttle can
+// fully process, i.e. walk, split and aggregate
+type ContentFormats struct {
+	Codecs         []uint64
+	MultihashFuncs []uint64
+}
+
+// Supports returns true if content with the given root can be processed,
+// formats that were not reported are assumed to be supported
+func (cf *ContentFormats) Supports(root cid.Cid) bool {
+	if cf == nil {
+		return true
+	}
+
+	pref := root.Prefix()
+	return hasCode(cf.Codecs, pref.Codec) && hasCode(cf.MultihashFuncs, pref.MhType)
+}
+
+func hasCode(codes []uint64, code uint64) bool {
+	if len(codes) == 0 {
+		return true
+	}
+
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
 }
 
 type Command struct {
@@ -46,6 +96,40 @@ type CmdParams struct {
 	RetrieveContent        *RetrieveContent        `json:",omitempty"`
 	UnpinContent           *UnpinContent           `json:",omitempty"`
 	RestartTransfer        *RestartTransfer        `json:",omitempty"`
+	QueueStats             *QueueStatsRequest      `json:",omitempty"`
+	Goodbye                *Goodbye                `json:",omitempty"`
+	GetContentPeers        *GetContentPeers        `json:",omitempty"`
+	Ack                    *Ack                    `json:",omitempty"`
+	RelocatePin            *RelocatePin            `json:",omitempty"`
+	SetUserQuota           *SetUserQuota           `json:",omitempty"`
+	SetReplicationPolicy   *SetReplicationPolicy   `json:",omitempty"`
+	FindPinsByLabel        *FindPinsByLabel        `json:",omitempty"`
+	HealthCheck            *HealthCheck            `json:",omitempty"`
+	RechunkContent         *RechunkContent         `json:",omitempty"`
+	TransferBandwidthLimit *TransferBandwidthLimit `json:",omitempty"`
+	ListActiveTransfers    *ListActiveTransfers    `json:",omitempty"`
+	SetLogLevel            *SetLogLevel            `json:",omitempty"`
+	ReassignPin            *ReassignPin            `json:",omitempty"`
+	WarmCache              *WarmCache              `json:",omitempty"`
+	GetDiskUsage           *GetDiskUsage           `json:",omitempty"`
+	ForceReconnect         *ForceReconnect         `json:",omitempty"`
+	ValidateContentRoot    *ValidateContentRoot    `json:",omitempty"`
+	SetReadOnly            *SetReadOnly            `json:",omitempty"`
+	GetContentCID          *GetContentCID          `json:",omitempty"`
+	BulkAddPin             *BulkAddPin             `json:",omitempty"`
+	GetTransferBytes       *GetTransferBytes       `json:",omitempty"`
+	DumpGoroutines         *DumpGoroutines         `json:",omitempty"`
+	RehydrateContent       *RehydrateContent       `json:",omitempty"`
+	SetContentMetadata     *SetContentMetadata     `json:",omitempty"`
+	GetContentMetadata     *GetContentMetadata     `json:",omitempty"`
+	PauseUser              *PauseUser              `json:",omitempty"`
+	ResumeUser             *ResumeUser             `json:",omitempty"`
+	GetPinProgress         *GetPinProgress         `json:",omitempty"`
+	ConfigReload           *ConfigReload           `json:",omitempty"`
+	GetPieceInfo           *GetPieceInfo           `json:",omitempty"`
+	RepairSplitLinkage     *RepairSplitLinkage     `json:",omitempty"`
+	Benchmark              *Benchmark              `json:",omitempty"`
+	ReconcilePins          *ReconcilePins          `json:",omitempty"`
 }
 
 const CMD_ComputeCommP = "ComputeCommP"
@@ -61,6 +145,33 @@ type AddPin struct {
 	UserId uint
 	Cid    cid.Cid
 	Peers  []*peer.AddrInfo
+	// Labels are operator defined labels stored on the pin, e.g. tenant:foo
+	Labels []string
+	// RetryFailed pins the content again if the shuttle has its pin marked
+	// failed, instead of only reporting the failure again
+	RetryFailed bool `json:",omitempty"`
+	// Timeout overrides the pin timeout of the shuttle for this pin, e.g. for
+	// content known to be large
+	Timeout time.Duration `json:",omitempty"`
+	// ProvideTTL is how long the provider records of the content should last
+	// before they are announced again, shorter for transient content. It is
+	// capped at the lifetime of dht provider records, 0 uses the default of
+	// the shuttle.
+	ProvideTTL time.Duration `json:",omitempty"`
+	// Unannounced content is stored and served to peers asking for it, but
+	// never announced to the dht or indexers, e.g. private content. Shuttles
+	// whose bitswap announces the blocks it fetches reject it.
+	Unannounced bool `json:",omitempty"`
+	// Size is the size of the content if known, bulk adds count it against
+	// the quota of the user as the pins are accepted
+	Size int64 `json:",omitempty"`
+}
+
+const CMD_BulkAddPin = "BulkAddPin"
+
+// BulkAddPin pins many contents in one command, e.g. to seed a new shuttle
+type BulkAddPin struct {
+	Pins []AddPin
 }
 
 const CMD_TakeContent = "TakeContent"
@@ -77,6 +188,9 @@ type AggregateContent struct {
 	Contents []uint
 	Root     cid.Cid
 	ObjData  []byte
+	// Peers are asked for the block of Root over bitswap when it is too
+	// large to be sent inline in ObjData
+	Peers []*peer.AddrInfo `json:",omitempty"`
 }
 
 const CMD_StartTransfer = "StartTransfer"
@@ -87,6 +201,12 @@ type StartTransfer struct {
 	Miner     address.Address
 	PropCid   cid.Cid
 	DataCid   cid.Cid
+	// Proposal is the cbor encoded signed proposal of the deal, it is sent
+	// along with MaxPrice for the shuttle to check the deal price and duration
+	Proposal []byte `json:",omitempty"`
+	// MaxPrice is the highest accepted deal price in attoFIL per GiB per
+	// epoch, the transfer is not started for a proposal priced above it
+	MaxPrice *abi.TokenAmount `json:",omitempty"`
 }
 
 const CMD_PrepareForDataRequest = "PrepareForDataRequest"
@@ -134,6 +254,19 @@ type RetrieveContent struct {
 	Deals   []StorageDeal
 }
 
+const CMD_RehydrateContent = "RehydrateContent"
+
+// RehydrateContent asks the shuttle to get back the blocks of a pinned content
+// it no longer fully holds, by retrieving them from one of the deals of the
+// content, and to activate its pin again. The shuttle reports with
+// RehydrateProgress messages.
+type RehydrateContent struct {
+	UserID  uint
+	Content uint
+	Cid     cid.Cid
+	Deals   []StorageDeal
+}
+
 const CMD_UnpinContent = "UnpinContent"
 
 type UnpinContent struct {
@@ -148,6 +281,294 @@ type RestartTransfer struct {
 	ContentID uint
 }
 
+const CMD_TransferBandwidthLimit = "TransferBandwidthLimit"
+
+// TransferBandwidthLimit caps the rate at which the shuttle sends the data of
+// a deal transfer, a BytesPerSecond of 0 removes the cap. The shuttle answers
+// with a TransferBandwidthLimitApplied message.
+type TransferBandwidthLimit struct {
+	ChanID         datatransfer.ChannelID
+	DealDBID       uint
+	BytesPerSecond int64
+}
+
+const CMD_ListActiveTransfers = "ListActiveTransfers"
+
+// ListActiveTransfers asks the shuttle for all the transfers it tracks, the
+// shuttle answers with an ActiveTransfers message
+type ListActiveTransfers struct {
+}
+
+const CMD_GetTransferBytes = "GetTransferBytes"
+
+// GetTransferBytes asks the shuttle for the byte counts of a transfer, read
+// from the live state of its channel. The shuttle answers with a
+// TransferBytes message.
+type GetTransferBytes struct {
+	Chanid string
+}
+
+const CMD_DumpGoroutines = "DumpGoroutines"
+
+// DumpGoroutines asks the shuttle for the stack traces of all its goroutines,
+// the shuttle answers with GoroutineDump messages tagged with DumpID
+type DumpGoroutines struct {
+	DumpID string
+}
+
+const CMD_SetLogLevel = "SetLogLevel"
+
+// SetLogLevel changes the log level of a logging subsystem of the shuttle at
+// runtime, the shuttle answers with a LogLevelSet message
+type SetLogLevel struct {
+	Subsystem string
+	Level     string
+}
+
+const CMD_QueueStats = "QueueStats"
+
+type QueueStatsRequest struct {
+}
+
+const CMD_Ack = "Ack"
+
+// Ack confirms that the messages with the given IDs were processed
+type Ack struct {
+	IDs []uint64
+}
+
+const CMD_RechunkContent = "RechunkContent"
+
+// RechunkContent re-encodes the file data of a pinned content into a new DAG
+// that is pinned as a new content named Name
+type RechunkContent struct {
+	DBID uint
+	Name string
+	// Chunker is a chunker spec, e.g. size-1048576 or rabin
+	Chunker   string
+	RawLeaves bool
+	// UnpinOld unpins the original content once the new one is pinned
+	UnpinOld bool
+}
+
+const CMD_HealthCheck = "HealthCheck"
+
+// HealthCheck asks the shuttle for a HealthReport
+type HealthCheck struct {
+}
+
+const CMD_GetContentPeers = "GetContentPeers"
+
+type GetContentPeers struct {
+	DBID uint
+}
+
+const CMD_GetContentCID = "GetContentCID"
+
+// GetContentCID asks the shuttle for the root cids of the pins of the
+// contents, the shuttle answers with a ContentCIDs message
+type GetContentCID struct {
+	Contents []uint
+}
+
+const CMD_FindPinsByLabel = "FindPinsByLabel"
+
+// FindPinsByLabel asks the shuttle for the contents whose pin has the label,
+// the shuttle answers with a PinsByLabel message
+type FindPinsByLabel struct {
+	Label string
+}
+
+const CMD_SetUserQuota = "SetUserQuota"
+
+// SetUserQuota limits the total size of the content a user can pin on the
+// shuttle, a zero Quota removes the limit
+type SetUserQuota struct {
+	UserID uint
+	Quota  int64
+}
+
+const CMD_SetReadOnly = "SetReadOnly"
+
+// SetReadOnly marks the pin of a content read-only, or writable again. The
+// shuttle refuses to pin, split, aggregate or rechunk read-only content.
+type SetReadOnly struct {
+	DBID     uint
+	ReadOnly bool
+}
+
+const CMD_ForceReconnect = "ForceReconnect"
+
+// ForceReconnect asks a shuttle to close its rpc connection with a goodbye
+// and dial estuary again after Delay, once its queued messages are sent.
+type ForceReconnect struct {
+	Delay  time.Duration `json:",omitempty"`
+	Reason string        `json:",omitempty"`
+}
+
+const CMD_ValidateContentRoot = "ValidateContentRoot"
+
+// ValidateContentRoot asks a shuttle to fetch only the root block of a
+// content from the given peers, within Timeout, before it is pinned. The
+// fetched block is not kept. The shuttle answers with a ContentRootValidation
+// message.
+type ValidateContentRoot struct {
+	Cid     cid.Cid
+	Peers   []*peer.AddrInfo
+	Timeout time.Duration `json:",omitempty"`
+}
+
+const CMD_GetDiskUsage = "GetDiskUsage"
+
+// GetDiskUsage asks for the blockstore space used by each user of a shuttle,
+// the shuttle answers with a DiskUsage message. Refresh skips the cached
+// figures.
+type GetDiskUsage struct {
+	Refresh bool `json:",omitempty"`
+}
+
+const CMD_WarmCache = "WarmCache"
+
+// WarmCache loads the blocks of a pinned content into the read cache of the
+// shuttle blockstore, at most MaxBlocks of them if it is set. The shuttle
+// answers with a CacheWarmed message.
+type WarmCache struct {
+	DBID      uint
+	MaxBlocks int `json:",omitempty"`
+}
+
+const CMD_SetContentMetadata = "SetContentMetadata"
+
+// SetContentMetadata sets key-value metadata on the pin of a content, e.g. its
+// original filename or mime type. An empty value removes its key, Replace
+// removes the keys missing from Metadata. The shuttle answers with a
+// ContentMetadata message.
+type SetContentMetadata struct {
+	DBID     uint
+	Metadata map[string]string
+	Replace  bool `json:",omitempty"`
+}
+
+const CMD_GetContentMetadata = "GetContentMetadata"
+
+// GetContentMetadata asks for the metadata of the pin of a content, the
+// shuttle answers with a ContentMetadata message
+type GetContentMetadata struct {
+	DBID uint
+}
+
+const CMD_GetPinProgress = "GetPinProgress"
+
+// GetPinProgress asks for the progress of the pin of a content being worked
+// on, the shuttle answers with a PinProgress message
+type GetPinProgress struct {
+	DBID uint
+}
+
+const CMD_ConfigReload = "ConfigReload"
+
+// ConfigReload makes the shuttle read its config file again and apply the
+// settings that can change while it runs, the shuttle answers with a
+// ConfigReloaded message
+type ConfigReload struct {
+}
+
+const CMD_RepairSplitLinkage = "RepairSplitLinkage"
+
+// RepairSplitLinkage looks for split children whose parent pin is gone and
+// restores the parents that can be rebuilt from the boxes of their children,
+// the shuttle answers with a SplitLinkageRepaired message. DryRun only reports
+// what would be restored. Parents are the contents estuary still has as split
+// parents on the shuttle, the others are left orphaned.
+type RepairSplitLinkage struct {
+	DryRun  bool   `json:",omitempty"`
+	Parents []uint `json:",omitempty"`
+}
+
+const CMD_Benchmark = "Benchmark"
+
+// Benchmark measures the throughput of a shuttle on synthetic content of Size
+// bytes, 0 uses the benchmark size of the shuttle. Provide also announces the
+// blocks of the content to the dht, the provider records outlive the content
+// and point other nodes at blocks the shuttle no longer has until they
+// expire. The content is removed afterwards, the shuttle answers with a
+// BenchmarkResult message.
+type Benchmark struct {
+	Size    int64 `json:",omitempty"`
+	Provide bool  `json:",omitempty"`
+}
+
+const CMD_ReconcilePins = "ReconcilePins"
+
+// ReconcilePins lists the contents with ids in (After, Upto] that estuary
+// expects the shuttle to have, the Last batch covers every id after After.
+// The shuttle compares them to its pins in the same range and answers with a
+// ReconcileReport message, so the batches can be handled in any order.
+type ReconcilePins struct {
+	After    uint
+	Upto     uint   `json:",omitempty"`
+	Last     bool   `json:",omitempty"`
+	Contents []uint `json:",omitempty"`
+}
+
+const CMD_GetPieceInfo = "GetPieceInfo"
+
+// GetPieceInfo asks which miners hold a piece among the deals the shuttle
+// tracks, the shuttle answers with a PieceInfo message. Query makes it ask
+// each of the miners for a retrieval quote instead of reporting the last one
+// it got.
+type GetPieceInfo struct {
+	PieceCid cid.Cid
+	Query    bool `json:",omitempty"`
+}
+
+const CMD_PauseUser = "PauseUser"
+
+// PauseUser stops the shuttle from starting the queued pins of a user and
+// from accepting its uploads, the pins already running finish. The pause
+// lasts until a ResumeUser for the user.
+type PauseUser struct {
+	UserID uint
+	Reason string `json:",omitempty"`
+}
+
+const CMD_ResumeUser = "ResumeUser"
+
+type ResumeUser struct {
+	UserID uint
+}
+
+const CMD_ReassignPin = "ReassignPin"
+
+// ReassignPin moves the pin of a content, along with the pins split from it,
+// to another user. The shuttle answers with a PinReassigned message.
+type ReassignPin struct {
+	DBID   uint
+	UserID uint
+}
+
+const CMD_SetReplicationPolicy = "SetReplicationPolicy"
+
+// SetReplicationPolicy sets when the shuttle notifies estuary that a content
+// needs more deals: when it has fewer than MinActiveDeals active deals, or
+// when one of its deals ends within ExpiryWindow. A Content of 0 sets the
+// default policy, otherwise Deals replaces the tracked deals of the content.
+// A policy with neither condition set is removed.
+type SetReplicationPolicy struct {
+	Content        uint
+	MinActiveDeals int
+	ExpiryWindow   time.Duration
+	Deals          []StorageDeal
+}
+
+const CMD_RelocatePin = "RelocatePin"
+
+// RelocatePin moves the blocks of the given contents to the shuttle's
+// secondary blockstore
+type RelocatePin struct {
+	Contents []uint
+}
+
 type ContentFetch struct {
 	ID     uint
 	Cid    cid.Cid
@@ -160,6 +581,10 @@ type Message struct {
 	Params       MsgParams
 	TraceCarrier *TraceCarrier `json:",omitempty"`
 	Handle       string
+
+	// ID is set on messages the sender wants acked, they are resent until
+	// the receiver acks them after processing
+	ID uint64 `json:",omitempty"`
 }
 
 // HasTraceCarrier returns true iff Message `m` contains a trace.
@@ -168,15 +593,49 @@ func (m *Message) HasTraceCarrier() bool {
 }
 
 type MsgParams struct {
-	UpdatePinStatus  *UpdatePinStatus           `json:",omitempty"`
-	PinComplete      *PinComplete               `json:",omitempty"`
-	CommPComplete    *CommPComplete             `json:",omitempty"`
-	TransferStatus   *TransferStatus            `json:",omitempty"`
-	TransferStarted  *TransferStartedOrFinished `json:",omitempty"`
-	TransferFinished *TransferStartedOrFinished `json:",omitempty"`
-	ShuttleUpdate    *ShuttleUpdate             `json:",omitempty"`
-	GarbageCheck     *GarbageCheck              `json:",omitempty"`
-	SplitComplete    *SplitComplete             `json:",omitempty"`
+	UpdatePinStatus               *UpdatePinStatus               `json:",omitempty"`
+	PinComplete                   *PinComplete                   `json:",omitempty"`
+	CommPComplete                 *CommPComplete                 `json:",omitempty"`
+	TransferStatus                *TransferStatus                `json:",omitempty"`
+	TransferStarted               *TransferStartedOrFinished     `json:",omitempty"`
+	TransferFinished              *TransferStartedOrFinished     `json:",omitempty"`
+	ShuttleUpdate                 *ShuttleUpdate                 `json:",omitempty"`
+	GarbageCheck                  *GarbageCheck                  `json:",omitempty"`
+	SplitComplete                 *SplitComplete                 `json:",omitempty"`
+	QueueStats                    *QueueStats                    `json:",omitempty"`
+	Goodbye                       *Goodbye                       `json:",omitempty"`
+	ContentPeers                  *ContentPeers                  `json:",omitempty"`
+	PinCompleteChunk              *PinCompleteChunk              `json:",omitempty"`
+	PinRejected                   *PinRejected                   `json:",omitempty"`
+	RelocatePinDone               *RelocatePinDone               `json:",omitempty"`
+	AggregateComplete             *AggregateComplete             `json:",omitempty"`
+	TakeContentProgress           *TakeContentProgress           `json:",omitempty"`
+	ReplicationNeeded             *ReplicationNeeded             `json:",omitempty"`
+	DealExpiring                  *DealExpiring                  `json:",omitempty"`
+	PinsByLabel                   *PinsByLabel                   `json:",omitempty"`
+	ContentCIDs                   *ContentCIDs                   `json:",omitempty"`
+	HealthReport                  *HealthReport                  `json:",omitempty"`
+	RechunkComplete               *RechunkComplete               `json:",omitempty"`
+	TransferBandwidthLimitApplied *TransferBandwidthLimitApplied `json:",omitempty"`
+	ActiveTransfers               *ActiveTransfers               `json:",omitempty"`
+	LogLevelSet                   *LogLevelSet                   `json:",omitempty"`
+	IntegrityAlert                *IntegrityAlert                `json:",omitempty"`
+	PinReassigned                 *PinReassigned                 `json:",omitempty"`
+	CacheWarmed                   *CacheWarmed                   `json:",omitempty"`
+	ContentRootValidation         *ContentRootValidation         `json:",omitempty"`
+	DiskUsage                     *DiskUsage                     `json:",omitempty"`
+	BulkAddPinResult              *BulkAddPinResult              `json:",omitempty"`
+	TransferBytes                 *TransferBytes                 `json:",omitempty"`
+	GoroutineDump                 *GoroutineDump                 `json:",omitempty"`
+	RehydrateProgress             *RehydrateProgress             `json:",omitempty"`
+	ContentMetadata               *ContentMetadata               `json:",omitempty"`
+	OffloadRequest                *OffloadRequest                `json:",omitempty"`
+	PinProgress                   *PinProgress                   `json:",omitempty"`
+	ConfigReloaded                *ConfigReloaded                `json:",omitempty"`
+	PieceInfo                     *PieceInfo                     `json:",omitempty"`
+	SplitLinkageRepaired          *SplitLinkageRepaired          `json:",omitempty"`
+	BenchmarkResult               *BenchmarkResult               `json:",omitempty"`
+	ReconcileReport               *ReconcileReport               `json:",omitempty"`
 }
 
 const OP_UpdatePinStatus = "UpdatePinStatus"
@@ -198,6 +657,34 @@ type PinComplete struct {
 	Size int64
 
 	Objects []PinObj
+
+	// Chunks is the number of PinCompleteChunk messages carrying the rest of
+	// the objects of this pin, the PinComplete itself marks the end of them
+	Chunks int `json:",omitempty"`
+}
+
+const OP_AggregateComplete = "AggregateComplete"
+
+// AggregateComplete lists the contents that went into an aggregate, it is
+// sent along with the PinComplete of the aggregate
+type AggregateComplete struct {
+	DBID    uint
+	Members []AggregateMember
+}
+
+type AggregateMember struct {
+	DBID uint
+	Size int64
+}
+
+const OP_PinCompleteChunk = "PinCompleteChunk"
+
+// PinCompleteChunk carries part of the objects of a pin that has too many
+// objects to be reported in a single PinComplete message
+type PinCompleteChunk struct {
+	DBID    uint
+	Index   int
+	Objects []PinObj
 }
 
 const OP_CommPComplete = "CommPComplete"
@@ -228,6 +715,323 @@ type TransferStatus struct {
 	Failed   bool
 }
 
+const OP_RechunkComplete = "RechunkComplete"
+
+// RechunkComplete reports the content created by a RechunkContent, Error is
+// set if the content could not be rechunked. UnpinOld is set if the original
+// content got unpinned.
+type RechunkComplete struct {
+	DBID     uint
+	NewDBID  uint
+	NewCid   cid.Cid
+	UnpinOld bool
+	Error    string `json:",omitempty"`
+}
+
+const OP_TransferBandwidthLimitApplied = "TransferBandwidthLimitApplied"
+
+// TransferBandwidthLimitApplied reports the rate cap now applied to a deal
+// transfer, Error is set if the cap could not be applied
+type TransferBandwidthLimitApplied struct {
+	ChanID         datatransfer.ChannelID
+	DealDBID       uint
+	BytesPerSecond int64
+	Error          string `json:",omitempty"`
+}
+
+const OP_TransferBytes = "TransferBytes"
+
+// TransferBytes are the byte counts of a transfer. Total is 0 when the size
+// of the transfer is not known, Rate is the bytes sent per second over about
+// the last minute and 0 until the shuttle sampled the transfer. Error is set
+// if the transfer could not be read.
+type TransferBytes struct {
+	Chanid string
+	Sent   uint64
+	Queued uint64
+	Total  uint64
+	Rate   float64
+	Error  string `json:",omitempty"`
+}
+
+const OP_GoroutineDump = "GoroutineDump"
+
+// GoroutineDump is the Index-th part of a goroutine dump, a dump does not fit
+// in a single message. Last is set on the final part, Error is set instead of
+// Data if the dump failed.
+type GoroutineDump struct {
+	DumpID string
+	Index  int
+	Data   string `json:",omitempty"`
+	Last   bool
+	Error  string `json:",omitempty"`
+}
+
+const OP_DiskUsage = "DiskUsage"
+
+// DiskUsage is the blockstore space used by the pins of each user. Logical
+// counts every block of every pin of a user, Physical splits the size of the
+// blocks shared by several users between them so the physical sizes of all
+// users add up to TotalPhysical.
+type DiskUsage struct {
+	Users         []UserDiskUsage
+	TotalLogical  int64
+	TotalPhysical int64
+	ComputedAt    time.Time
+	Error         string `json:",omitempty"`
+}
+
+type UserDiskUsage struct {
+	UserID   uint
+	Logical  int64
+	Physical int64
+}
+
+const OP_CacheWarmed = "CacheWarmed"
+
+// CacheWarmed reports the blocks of a content loaded into the read cache,
+// none are if the shuttle has no read cache
+type CacheWarmed struct {
+	DBID   uint
+	Blocks int
+	Bytes  int64
+	Error  string `json:",omitempty"`
+}
+
+const OP_ContentMetadata = "ContentMetadata"
+
+// ContentMetadata carries the metadata of the pin of a content
+type ContentMetadata struct {
+	DBID     uint
+	Metadata map[string]string
+	Error    string `json:",omitempty"`
+}
+
+const OP_RehydrateProgress = "RehydrateProgress"
+
+const (
+	RehydrateVerifying  = "verifying"
+	RehydrateRetrieving = "retrieving"
+	RehydrateImporting  = "importing"
+	RehydrateComplete   = "complete"
+	RehydrateFailed     = "failed"
+)
+
+// RehydrateProgress is sent as a RehydrateContent moves from one phase to the
+// next, Miner is set while retrieving and Error once it failed
+type RehydrateProgress struct {
+	Content uint
+	Phase   string
+	Miner   string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+const OP_ConfigReloaded = "ConfigReloaded"
+
+// ConfigReloaded reports the outcome of a config reload, Applied are the
+// settings that changed and now apply, RestartRequired the ones that changed
+// but only apply once the shuttle restarts. Error is set if the config could
+// not be read or is invalid, nothing changes then.
+type ConfigReloaded struct {
+	Applied         []string `json:",omitempty"`
+	RestartRequired []string `json:",omitempty"`
+	Error           string   `json:",omitempty"`
+}
+
+const OP_PieceInfo = "PieceInfo"
+
+// PieceInfo lists the active deals of a piece, the deals with a miner ready
+// to serve the piece come first and the cheapest of them first. HotCopy is
+// set when the shuttle still has the content pinned and can serve it itself.
+type PieceInfo struct {
+	PieceCid cid.Cid
+	Content  uint `json:",omitempty"`
+	HotCopy  bool
+	Deals    []PieceDeal `json:",omitempty"`
+	Error    string      `json:",omitempty"`
+}
+
+type PieceDeal struct {
+	Miner    address.Address
+	DealID   int64
+	EndEpoch abi.ChainEpoch
+	// Ask is the last retrieval quote of the miner, nil if it was never asked
+	Ask *RetrievalAsk `json:",omitempty"`
+}
+
+type RetrievalAsk struct {
+	Available    bool
+	PricePerByte abi.TokenAmount
+	UnsealPrice  abi.TokenAmount
+	Message      string `json:",omitempty"`
+	QueriedAt    time.Time
+}
+
+const OP_SplitLinkageRepaired = "SplitLinkageRepaired"
+
+// SplitLinkageRepaired lists the split parents restored from their children
+// and the children left orphaned because their parent could not be rebuilt,
+// for estuary to decide on
+type SplitLinkageRepaired struct {
+	DryRun   bool          `json:",omitempty"`
+	Restored []SplitParent `json:",omitempty"`
+	Orphans  []SplitOrphan `json:",omitempty"`
+	Error    string        `json:",omitempty"`
+}
+
+// SplitParent is a parent pin rebuilt with the root found in the boxes of its
+// children
+type SplitParent struct {
+	Content  uint
+	Cid      cid.Cid
+	Children []uint
+}
+
+type SplitOrphan struct {
+	Parent   uint
+	Children []uint
+	Reason   string
+}
+
+const OP_BenchmarkResult = "BenchmarkResult"
+
+// BenchmarkResult lists the stages of a benchmark in the order they ran, if
+// one failed Error is set and the stages before it are still listed
+type BenchmarkResult struct {
+	Size   int64
+	Stages []BenchmarkStage `json:",omitempty"`
+	Error  string           `json:",omitempty"`
+}
+
+type BenchmarkStage struct {
+	Name        string
+	Bytes       int64
+	Blocks      int
+	Duration    time.Duration
+	BytesPerSec float64
+}
+
+const OP_ReconcileReport = "ReconcileReport"
+
+// ReconcileReport lists the contents of a ReconcilePins batch estuary expects
+// but the shuttle has no pin for, and the pins of the shuttle in the range of
+// the batch estuary does not expect
+type ReconcileReport struct {
+	After   uint
+	Upto    uint   `json:",omitempty"`
+	Last    bool   `json:",omitempty"`
+	Missing []uint `json:",omitempty"`
+	Orphans []uint `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+const OP_PinProgress = "PinProgress"
+
+// PinProgress is the progress of the pin of a content, Running is false when
+// it is not being worked on. EstimatedSize is the size of the whole dag as
+// recorded in the links of its root, 0 until the root is fetched or if it has
+// no links to size it by.
+type PinProgress struct {
+	DBID          uint
+	Running       bool
+	Started       time.Time `json:",omitempty"`
+	BlocksFetched int
+	BytesFetched  int64
+	EstimatedSize int64 `json:",omitempty"`
+}
+
+const OP_OffloadRequest = "OffloadRequest"
+
+// OffloadRequest asks estuary to move contents to other shuttles as the disk
+// of the shuttle is over its high watermark. Contents are listed least
+// recently retrieved first and Size is their total size.
+type OffloadRequest struct {
+	DiskUsage float64
+	Contents  []uint
+	Size      int64
+}
+
+const OP_ContentRootValidation = "ContentRootValidation"
+
+// ContentRootValidation reports whether the root block of a content could be
+// fetched, Local is set if the shuttle already had it. Connected is the number
+// of the given peers the shuttle could connect to.
+type ContentRootValidation struct {
+	Cid       cid.Cid
+	Reachable bool
+	Local     bool `json:",omitempty"`
+	Connected int
+	Error     string `json:",omitempty"`
+}
+
+const OP_PinReassigned = "PinReassigned"
+
+// PinReassigned reports the outcome of a ReassignPin command, Error is set if
+// the pin still belongs to its previous user
+type PinReassigned struct {
+	DBID   uint
+	UserID uint
+	Error  string `json:",omitempty"`
+}
+
+const OP_IntegrityAlert = "IntegrityAlert"
+
+// IntegrityAlert reports blocks of a pin that are missing or whose data does
+// not hash to their cid. The shuttle drops the corrupted blocks and marks the
+// pin inactive, pinning the content again fetches them back.
+type IntegrityAlert struct {
+	DBID      uint
+	Cid       cid.Cid
+	Missing   []cid.Cid `json:",omitempty"`
+	Corrupted []cid.Cid `json:",omitempty"`
+}
+
+const OP_LogLevelSet = "LogLevelSet"
+
+// LogLevelSet reports the outcome of a SetLogLevel command, Error is set if
+// the level could not be changed
+type LogLevelSet struct {
+	Subsystem string
+	Level     string
+	Error     string `json:",omitempty"`
+}
+
+const OP_ActiveTransfers = "ActiveTransfers"
+
+// ActiveTransfer is a transfer tracked by a shuttle, State is its last known
+// state and is not set if the shuttle has not seen any yet
+type ActiveTransfer struct {
+	DealDBID uint
+	Chanid   string
+	State    *filclient.ChannelState `json:",omitempty"`
+}
+
+type ActiveTransfers struct {
+	Transfers []ActiveTransfer
+}
+
+const OP_HealthReport = "HealthReport"
+
+// HealthReport describes the resource usage of a shuttle when it answered a
+// HealthCheck
+type HealthReport struct {
+	BlockstoreSize  uint64
+	BlockstoreFree  uint64
+	PinQueueSize    int
+	ActivePins      int
+	ActiveTransfers int
+	Goroutines      int
+	// MemoryAlloc is the heap memory in use, MemorySys the memory obtained
+	// from the OS
+	MemoryAlloc uint64
+	MemorySys   uint64
+
+	DBHealthy bool
+	DBError   string `json:",omitempty"`
+
+	PausedUsers []uint `json:",omitempty"`
+}
+
 const OP_ShuttleUpdate = "ShuttleUpdate"
 
 type ShuttleUpdate struct {
@@ -235,6 +1039,62 @@ type ShuttleUpdate struct {
 	BlockstoreFree uint64
 	NumPins        int64
 	PinQueueSize   int
+	ActivePins     int
+
+	// StorageFull is set while the shuttle's free blockstore space is below
+	// its configured threshold, it does not accept new pins meanwhile
+	StorageFull bool
+}
+
+const OP_PinRejected = "PinRejected"
+
+// PinRejected is sent back for pins a shuttle refused to take, the content
+// should be pinned somewhere else
+type PinRejected struct {
+	DBID   uint
+	Reason string
+}
+
+const OP_BulkAddPinResult = "BulkAddPinResult"
+
+// BulkAddPinResult summarizes a BulkAddPin, the rejected pins should be
+// pinned somewhere else
+type BulkAddPinResult struct {
+	Accepted int
+	Rejected []PinRejected
+}
+
+const OP_TakeContentProgress = "TakeContentProgress"
+
+// TakeContentProgress is sent periodically while the shuttle pins the
+// contents of a TakeContent command, and once more when all of them are done
+type TakeContentProgress struct {
+	Total   int
+	Pinned  int
+	Failed  int
+	Pending int
+}
+
+const OP_ReplicationNeeded = "ReplicationNeeded"
+
+type ReplicationNeeded struct {
+	Content       uint
+	ActiveDeals   int
+	ExpiringDeals int
+	Reason        string
+}
+
+const OP_DealExpiring = "DealExpiring"
+
+// DealExpiring is sent once for each tracked deal when its end epoch comes
+// within the shuttle's deal expiry window
+type DealExpiring struct {
+	Content  uint
+	Miner    address.Address
+	DealID   int64
+	EndEpoch abi.ChainEpoch
+	// Head is the chain height the deal was checked at
+	Head abi.ChainEpoch
 }
 
 const OP_GarbageCheck = "GarbageCheck"
@@ -248,3 +1108,81 @@ const OP_SplitComplete = "SplitComplete"
 type SplitComplete struct {
 	ID uint
 }
+
+const OP_QueueStats = "QueueStats"
+
+type QueueStats struct {
+	PinQueueSize       int
+	ActivePins         int
+	UserQueueSizes     map[uint]int
+	RetrievalQueueSize int    `json:",omitempty"`
+	ActiveRetrievals   int    `json:",omitempty"`
+	PausedUsers        []uint `json:",omitempty"`
+}
+
+const OP_ContentPeers = "ContentPeers"
+
+// ContentPeers lists the peers that served blocks of a content to the shuttle
+// when it was pinned
+type ContentPeers struct {
+	DBID  uint
+	Peers []ContentPeer
+}
+
+type ContentPeer struct {
+	ID peer.ID
+	// Origin is set if the peer was passed in as an origin of the pin
+	Origin bool
+}
+
+const OP_PinsByLabel = "PinsByLabel"
+
+type PinsByLabel struct {
+	Label    string
+	Contents []uint
+}
+
+const OP_ContentCIDs = "ContentCIDs"
+
+// ContentCIDs maps content ids to the root cids of their pins, Missing lists
+// the requested contents the shuttle has no pin for
+type ContentCIDs struct {
+	CIDs    map[uint]cid.Cid
+	Missing []uint `json:",omitempty"`
+}
+
+const OP_RelocatePinDone = "RelocatePinDone"
+
+type RelocatePinDone struct {
+	Relocated []uint
+	Failed    []uint
+}
+
+// Goodbye is sent by either side of the connection right before it closes the
+// connection on purpose (shutdown, deploy, ...), so that the other side does
+// not treat the disconnect as an error.
+const CMD_Goodbye = "Goodbye"
+const OP_Goodbye = "Goodbye"
+
+type Goodbye struct {
+	Reason string
+
+	// StayDown asks the receiver not to reconnect
+	StayDown bool
+}
+
+// ErrGoodbye is matched (via errors.Is) by errors resulting from the remote
+// side closing the connection with a Goodbye.
+var ErrGoodbye = errors.New("remote closed the connection gracefully")
+
+type GoodbyeError struct {
+	Goodbye
+}
+
+func (e *GoodbyeError) Error() string {
+	return ErrGoodbye.Error() + ": " + e.Reason
+}
+
+func (e *GoodbyeError) Is(target error) bool {
+	return target == ErrGoodbye
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+)
+
+// goroutineDump receives the parts of a goroutine dump requested from a
+// shuttle, done is closed once nobody reads them anymore
+type goroutineDump struct {
+	handle string
+	parts  chan *drpc.GoroutineDump
+	done   chan struct{}
+}
+
+// watchGoroutineDump registers a dump before it is requested, the returned
+// func must be called once the dump is read
+func (cm *ContentManager) watchGoroutineDump(handle, id string) (<-chan *drpc.GoroutineDump, func()) {
+	gd := &goroutineDump{
+		handle: handle,
+		parts:  make(chan *drpc.GoroutineDump, 16),
+		done:   make(chan struct{}),
+	}
+
+	cm.goroutineDumpsLk.Lock()
+	cm.goroutineDumps[id] = gd
+	cm.goroutineDumpsLk.Unlock()
+
+	return gd.parts, func() {
+		cm.goroutineDumpsLk.Lock()
+		delete(cm.goroutineDumps, id)
+		cm.goroutineDumpsLk.Unlock()
+		close(gd.done)
+	}
+}
+
+func (cm *ContentManager) handleRpcGoroutineDump(ctx context.Context, handle string, param *drpc.GoroutineDump) error {
+	cm.goroutineDumpsLk.Lock()
+	gd, ok := cm.goroutineDumps[param.DumpID]
+	cm.goroutineDumpsLk.Unlock()
+
+	if !ok || gd.handle != handle {
+		return fmt.Errorf("shuttle %s sent part %d of goroutine dump %s nobody waits for", handle, param.Index, param.DumpID)
+	}
+
+	select {
+	case gd.parts <- param:
+		return nil
+	case <-gd.done:
+		return nil
+	case <-time.After(time.Second * 30):
+		return fmt.Errorf("dropped part %d of goroutine dump %s from shuttle %s, its reader is stuck", param.Index, param.DumpID, handle)
+	}
+}
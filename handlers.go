@@ -24,6 +24,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/application-research/estuary/collections"
+	"github.com/application-research/estuary/config"
 	"github.com/application-research/estuary/constants"
 	"github.com/application-research/estuary/node/modules/peering"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -96,7 +97,7 @@ import (
 // @securityDefinitions.Bearer.type apiKey
 // @securityDefinitions.Bearer.in header
 // @securityDefinitions.Bearer.name Authorization
-func (s *Server) ServeAPI() error {
+func (s *Server) ServeAPI(ctx context.Context) error {
 	e := echo.New()
 	e.Binder = new(util.Binder)
 	e.Pre(middleware.RemoveTrailingSlash())
@@ -109,20 +110,24 @@ func (s *Server) ServeAPI() error {
 	e.Use(util.AppVersionMiddleware(s.cfg.AppVersion))
 	e.HTTPErrorHandler = util.ErrorHandler
 
-	e.GET("/debug/pprof/:prof", serveProfile)
-	e.GET("/debug/cpuprofile", serveCpuProfile)
+	e.Server.ReadHeaderTimeout = s.cfg.Server.ReadHeaderTimeout
+	e.Server.ReadTimeout = s.cfg.Server.ReadTimeout
+	e.Server.WriteTimeout = s.cfg.Server.WriteTimeout
+	e.Server.IdleTimeout = s.cfg.Server.IdleTimeout
 
-	phandle := promhttp.Handler()
-	e.GET("/debug/metrics/prometheus", func(e echo.Context) error {
-		phandle.ServeHTTP(e.Response().Writer, e.Request())
-		return nil
-	})
+	// uploads are bounded by their own limit, set on the add routes
+	e.Use(middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+		Skipper: func(c echo.Context) bool {
+			return isAddRoute(c.Path())
+		},
+		Limit: strconv.FormatInt(s.cfg.Server.MaxBodySize, 10),
+	}))
+	addBodyLimit := s.addBodyLimit()
 
-	exporter := esmetrics.Exporter()
-	e.GET("/debug/metrics/opencensus", func(e echo.Context) error {
-		exporter.ServeHTTP(e.Response().Writer, e.Request())
-		return nil
-	})
+	// when the internal server is enabled the debug endpoints are only served there
+	if s.cfg.InternalListen == "" {
+		addDebugRoutes(e)
+	}
 
 	e.Use(middleware.CORS())
 
@@ -152,14 +157,18 @@ func (s *Server) ServeAPI() error {
 
 	contmeta := e.Group("/content")
 	uploads := contmeta.Group("", s.AuthRequired(util.PermLevelUpload))
-	uploads.POST("/add", withUser(s.handleAdd))
+	uploads.POST("/add", withUser(s.handleAdd), addBodyLimit)
 	uploads.POST("/add-ipfs", withUser(s.handleAddIpfs))
-	uploads.POST("/add-car", util.WithContentLengthCheck(withUser(s.handleAddCar)))
+	uploads.POST("/add-car", util.WithContentLengthCheck(withUser(s.handleAddCar)), addBodyLimit)
 	uploads.POST("/create", withUser(s.handleCreateContent))
 
 	content := contmeta.Group("", s.AuthRequired(util.PermLevelUser))
 	content.GET("/by-cid/:cid", s.handleGetContentByCid)
 	content.GET("/:cont_id", withUser(s.handleGetContent))
+	content.PUT("/:cont_id/auto-offload", withUser(s.handleSetContentAutoOffload))
+	content.GET("/:cont_id/metadata", withUser(s.handleGetContentMetadata))
+	content.GET("/:cont_id/progress", withUser(s.handleGetContentPinProgress))
+	content.PUT("/:cont_id/metadata", withUser(s.handleSetContentMetadata))
 	content.GET("/stats", withUser(s.handleStats))
 	content.GET("/ensure-replication/:datacid", s.handleEnsureReplication)
 	content.GET("/status/:id", withUser(s.handleContentStatus))
@@ -263,6 +272,11 @@ func (s *Server) ServeAPI() error {
 	admin.GET("/cm/progress", s.handleAdminGetProgress)
 	admin.GET("/cm/all-deals", s.handleDebugGetAllDeals)
 	admin.GET("/cm/read/:content", s.handleReadLocalContent)
+	admin.GET("/cm/peers/:content", s.handleGetContentPeers)
+	admin.GET("/cm/pins-by-label/:shuttle", s.handleGetPinsByLabel)
+	admin.GET("/cm/content-cids/:shuttle", s.handleGetContentCids)
+	admin.GET("/cm/transfers/:shuttle", s.handleGetShuttleTransfers)
+	admin.GET("/cm/transfers/:shuttle/:chanid/bytes", s.handleGetTransferBytes)
 	admin.GET("/cm/staging/all", s.handleAdminGetStagingZones)
 	admin.GET("/cm/offload/candidates", s.handleGetOffloadingCandidates)
 	admin.POST("/cm/offload/:content", s.handleOffloadContent)
@@ -270,13 +284,36 @@ func (s *Server) ServeAPI() error {
 	admin.GET("/cm/refresh/:content", s.handleRefreshContent)
 	admin.POST("/cm/gc", s.handleRunGc)
 	admin.POST("/cm/move", s.handleMoveContent)
+	admin.POST("/cm/relocate/:shuttle", s.handleRelocateContent)
+	admin.POST("/cm/rechunk/:content", s.handleRechunkContent)
+	admin.PUT("/cm/quota/:shuttle", s.handleSetUserQuota)
+	admin.POST("/cm/pause-user/:shuttle", s.handlePauseUser)
+	admin.POST("/cm/resume-user/:shuttle", s.handleResumeUser)
+	admin.PUT("/cm/replication-policy/:shuttle", s.handleSetReplicationPolicy)
 	admin.GET("/cm/buckets", s.handleGetBucketDiag)
 	admin.GET("/cm/health/:id", s.handleContentHealthCheck)
 	admin.GET("/cm/health-by-cid/:cid", s.handleContentHealthCheckByCid)
 	admin.POST("/cm/dealmaking", s.handleSetDealMaking)
 	admin.POST("/cm/break-aggregate/:content", s.handleAdminBreakAggregate)
 	admin.POST("/cm/transfer/restart/:chanid", s.handleTransferRestart)
+	admin.PUT("/cm/transfer/bandwidth-limit/:deal", s.handleSetTransferBandwidthLimit)
 	admin.POST("/cm/repinall/:shuttle", s.handleShuttleRepinAll)
+	admin.POST("/cm/loglevel/:shuttle", s.handleShuttleLogLevel)
+	admin.POST("/cm/config/reload/:shuttle", s.handleShuttleConfigReload)
+	admin.GET("/cm/piece/:shuttle/:piece", s.handleShuttlePieceInfo)
+	admin.POST("/cm/repair-split/:shuttle", s.handleShuttleRepairSplit)
+	admin.POST("/cm/benchmark/:shuttle", s.handleShuttleBenchmark)
+	admin.POST("/cm/reconcile/:shuttle", s.handleShuttleReconcile)
+	admin.GET("/cm/reconcile/:shuttle", s.handleGetShuttleReconcile)
+	admin.GET("/cm/goroutines/:shuttle", s.handleShuttleGoroutines)
+	admin.PUT("/cm/reassign/:content", s.handleReassignContent)
+	admin.POST("/cm/warm-cache/:content", s.handleWarmCache)
+	admin.POST("/cm/rehydrate/:content", s.handleRehydrateContent)
+	admin.GET("/cm/rehydrate/:content", s.handleGetRehydrateProgress)
+	admin.PUT("/cm/read-only/:content", s.handleSetContentReadOnly)
+	admin.GET("/cm/disk-usage/:shuttle", s.handleShuttleDiskUsage)
+	admin.POST("/cm/reconnect", s.handleReconnectShuttles)
+	admin.POST("/cm/reconnect/:shuttle", s.handleReconnectShuttles)
 
 	//	peering
 	adminPeering := admin.Group("/peering")
@@ -301,6 +338,7 @@ func (s *Server) ServeAPI() error {
 
 	users := admin.Group("/users")
 	users.GET("", s.handleAdminGetUsers)
+	users.PUT("/:id/staging-zone-size", s.handleSetUserStagingZoneSize)
 
 	shuttle := admin.Group("/shuttle")
 	shuttle.POST("/init", s.handleShuttleInit)
@@ -318,7 +356,58 @@ func (s *Server) ServeAPI() error {
 	if !s.cfg.DisableSwaggerEndpoint {
 		e.GET("/swagger/*", echoSwagger.WrapHandler)
 	}
-	return e.Start(s.cfg.ApiListen)
+	return util.StartUntilDone(ctx, e, s.cfg.ApiListen)
+}
+
+// isAddRoute reports whether a route takes content uploads, which are larger
+// than the other request bodies
+func isAddRoute(path string) bool {
+	return path == "/content/add" || path == "/content/add-car"
+}
+
+func (s *Server) addBodyLimit() echo.MiddlewareFunc {
+	if s.cfg.Server.MaxAddBodySize == 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+	return middleware.BodyLimit(strconv.FormatInt(s.cfg.Server.MaxAddBodySize, 10))
+}
+
+// ServeInternal serves metrics, profiling and health endpoints on the internal
+// listen address, away from the public api
+func (s *Server) ServeInternal() error {
+	e := echo.New()
+	e.HideBanner = true
+	e.HTTPErrorHandler = util.ErrorHandler
+
+	addDebugRoutes(e)
+
+	exporter := esmetrics.Exporter()
+	e.GET("/metrics", func(e echo.Context) error {
+		exporter.ServeHTTP(e.Response().Writer, e.Request())
+		return nil
+	})
+	e.GET("/health", s.handleHealth)
+
+	return e.Start(s.cfg.InternalListen)
+}
+
+func addDebugRoutes(e *echo.Echo) {
+	e.GET("/debug/pprof/:prof", serveProfile)
+	e.GET("/debug/cpuprofile", serveCpuProfile)
+
+	phandle := promhttp.Handler()
+	e.GET("/debug/metrics/prometheus", func(e echo.Context) error {
+		phandle.ServeHTTP(e.Response().Writer, e.Request())
+		return nil
+	})
+
+	exporter := esmetrics.Exporter()
+	e.GET("/debug/metrics/opencensus", func(e echo.Context) error {
+		exporter.ServeHTTP(e.Response().Writer, e.Request())
+		return nil
+	})
 }
 
 func serveCpuProfile(c echo.Context) error {
@@ -692,6 +781,18 @@ func (s *Server) handleAddIpfs(c echo.Context, u *util.User) error {
 		return err
 	}
 
+	if params.RemotePinningService != nil {
+		remoteOrigins, err := remotePinOrigins(ctx, params.RemotePinningService, rcid)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		origins = append(origins, remoteOrigins...)
+	}
+
 	if c.QueryParam("ignore-dupes") == "true" {
 		var count int64
 		if err := s.DB.Model(util.Content{}).Where("cid = ? and user_id = ?", rcid.Bytes(), u.ID).Count(&count).Error; err != nil {
@@ -1350,6 +1451,251 @@ func (s *Server) handleGetContent(c echo.Context, u *util.User) error {
 	return c.JSON(http.StatusOK, content)
 }
 
+type autoOffloadBody struct {
+	AutoOffload bool `json:"autoOffload"`
+}
+
+// handleSetContentAutoOffload godoc
+// @Summary      Set content auto offload
+// @Description  This endpoint opts a content in or out of being offloaded once enough of its deals are sealed
+// @Tags         content
+// @Produce      json
+// @Success      200    {object}  string
+// @Failure      400      {object}  util.HttpError
+// @Failure      500      {object}  util.HttpError
+// @Param        id   path      int  true  "Content ID"
+// @Param        body  body      autoOffloadBody  true  "Auto offload setting"
+// @Router       /content/{id}/auto-offload [put]
+func (s *Server) handleSetContentAutoOffload(c echo.Context, u *util.User) error {
+	contID, err := strconv.Atoi(c.Param("cont_id"))
+	if err != nil {
+		return err
+	}
+
+	var body autoOffloadBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	var content util.Content
+	if err := s.DB.First(&content, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content: %d was not found", contID),
+			}
+		}
+		return err
+	}
+
+	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+		return err
+	}
+
+	if err := s.DB.Model(util.Content{}).Where("id = ?", content.ID).UpdateColumn("auto_offload", body.AutoOffload).Error; err != nil {
+		return err
+	}
+
+	content.AutoOffload = body.AutoOffload
+	return c.JSON(http.StatusOK, content)
+}
+
+// handleGetContentPinProgress godoc
+// @Summary      Get pin progress
+// @Description  This endpoint returns the blocks and bytes fetched so far by the pin of a content being worked on, along with an estimate of its total size once its root is fetched
+// @Tags         content
+// @Produce      json
+// @Success      200  {object}  drpc.PinProgress
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Param        id   path      int  true  "Content ID"
+// @Router       /content/{id}/progress [get]
+func (s *Server) handleGetContentPinProgress(c echo.Context, u *util.User) error {
+	cont, err := s.ownedContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	if !cont.Pinning {
+		return c.JSON(http.StatusOK, &drpc.PinProgress{DBID: cont.ID})
+	}
+
+	if cont.Location == constants.ContentLocationLocal {
+		return c.JSON(http.StatusOK, s.CM.localPinProgress(c.Request().Context(), cont))
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*10)
+	defer cancel()
+
+	s.CM.pinProgress.Remove(cont.ID)
+	if err := s.CM.sendGetPinProgressCmd(ctx, cont.Location, cont.ID); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	for {
+		if v, ok := s.CM.pinProgress.Get(cont.ID); ok {
+			return c.JSON(http.StatusOK, v)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to report pin progress of content %d", cont.Location, cont.ID)
+		}
+	}
+}
+
+// handleGetContentMetadata godoc
+// @Summary      Get content metadata
+// @Description  This endpoint returns the key-value metadata attached to a content
+// @Tags         content
+// @Produce      json
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Param        id   path      int  true  "Content ID"
+// @Router       /content/{id}/metadata [get]
+func (s *Server) handleGetContentMetadata(c echo.Context, u *util.User) error {
+	cont, err := s.ownedShuttleContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	md, err := s.shuttleContentMetadata(c.Request().Context(), cont, func(ctx context.Context) error {
+		return s.CM.sendGetContentMetadataCmd(ctx, cont.Location, cont.ID)
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, md)
+}
+
+type contentMetadataBody struct {
+	Metadata map[string]string `json:"metadata"`
+	Replace  bool              `json:"replace"`
+}
+
+// handleSetContentMetadata godoc
+// @Summary      Set content metadata
+// @Description  This endpoint sets key-value metadata on a content, an empty value removes its key and replace removes the keys not given
+// @Tags         content
+// @Produce      json
+// @Success      200   {object}  map[string]string
+// @Failure      400   {object}  util.HttpError
+// @Failure      500   {object}  util.HttpError
+// @Param        id    path      int                  true  "Content ID"
+// @Param        body  body      contentMetadataBody  true  "Metadata to set"
+// @Router       /content/{id}/metadata [put]
+func (s *Server) handleSetContentMetadata(c echo.Context, u *util.User) error {
+	var body contentMetadataBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if err := util.ValidateContentMetadata(body.Metadata); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	cont, err := s.ownedShuttleContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	md, err := s.shuttleContentMetadata(c.Request().Context(), cont, func(ctx context.Context) error {
+		return s.CM.sendSetContentMetadataCmd(ctx, cont.Location, cont.ID, body.Metadata, body.Replace)
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, md)
+}
+
+// ownedShuttleContent loads the content of the request, it must belong to the
+// user and be held by a shuttle, which keeps its metadata
+func (s *Server) ownedShuttleContent(c echo.Context, u *util.User) (util.Content, error) {
+	cont, err := s.ownedContent(c, u)
+	if err != nil {
+		return util.Content{}, err
+	}
+
+	if cont.Location == constants.ContentLocationLocal {
+		return util.Content{}, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content metadata is only kept by shuttles",
+		}
+	}
+	return cont, nil
+}
+
+// ownedContent loads the content of the request, it must belong to the user
+func (s *Server) ownedContent(c echo.Context, u *util.User) (util.Content, error) {
+	contID, err := strconv.Atoi(c.Param("cont_id"))
+	if err != nil {
+		return util.Content{}, err
+	}
+
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return util.Content{}, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content: %d was not found", contID),
+			}
+		}
+		return util.Content{}, err
+	}
+
+	if err := util.IsContentOwner(u.ID, cont.UserID); err != nil {
+		return util.Content{}, err
+	}
+	return cont, nil
+}
+
+// shuttleContentMetadata sends a metadata command to the shuttle holding a
+// content and waits for the metadata it answers with
+func (s *Server) shuttleContentMetadata(ctx context.Context, cont util.Content, send func(context.Context) error) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	s.CM.contentMetadata.Remove(cont.ID)
+	if err := send(ctx); err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	for {
+		if v, ok := s.CM.contentMetadata.Get(cont.ID); ok {
+			res := v.(*drpc.ContentMetadata)
+			if res.Error != "" {
+				return nil, &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("shuttle %s failed to handle metadata of content %d: %s", cont.Location, cont.ID, res.Error),
+				}
+			}
+			return res.Metadata, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for shuttle %s to report metadata of content %d", cont.Location, cont.ID)
+		}
+	}
+}
+
 // handleContentStatus godoc
 // @Summary      Content Status
 // @Description  This endpoint returns the status of a content
@@ -1691,6 +2037,8 @@ func (s *Server) handleQueryAsk(c echo.Context) error {
 
 type dealRequest struct {
 	ContentID uint `json:"content_id"`
+	// Duration overrides the configured deal duration, in epochs
+	Duration abi.ChainEpoch `json:"duration"`
 }
 
 // handleMakeDeal godoc
@@ -1745,7 +2093,17 @@ func (s *Server) handleMakeDeal(c echo.Context, u *util.User) error {
 		return err
 	}
 
-	id, err := s.CM.makeDealWithMiner(ctx, cont, addr)
+	if req.Duration != 0 {
+		if err := config.ValidateDealDuration(req.Duration); err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+	}
+
+	id, err := s.CM.makeDealWithMiner(ctx, cont, addr, req.Duration)
 	if err != nil {
 		return err
 	}
@@ -1913,54 +2271,125 @@ func (s *Server) handleTransferRestart(c echo.Context) error {
 	return nil
 }
 
-// handleDealStatus godoc
-// @Summary      Deal Status
-// @Description  This endpoint returns the status of a deal
-// @Tags         deals
-// @Produce      json
-// @Success      200       {object}  string
-// @Failure      400   {object}  util.HttpError
-// @Failure      500   {object}  util.HttpError
-// @Param        miner    path      string  true  "Miner"
-// @Param        propcid  path      string  true  "Proposal CID"
-// @Router       /deal/status/{miner}/{propcid} [get]
-func (s *Server) handleDealStatus(c echo.Context) error {
-	ctx := c.Request().Context()
+type transferBandwidthLimitBody struct {
+	BytesPerSecond int64 `json:"bytesPerSecond"`
+}
 
-	addr, err := address.NewFromString(c.Param("miner"))
+// handleSetTransferBandwidthLimit caps the rate at which the shuttle sends the
+// data of a deal, a limit of 0 removes the cap. The shuttle reports the
+// applied limit asynchronously.
+func (s *Server) handleSetTransferBandwidthLimit(c echo.Context) error {
+	dealid, err := strconv.Atoi(c.Param("deal"))
 	if err != nil {
 		return err
 	}
 
-	propCid, err := cid.Decode(c.Param("propcid"))
-	if err != nil {
+	var body transferBandwidthLimitBody
+	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
-	var d contentDeal
-	if err := s.DB.First(&d, "prop_cid = ?", propCid.Bytes()).Error; err != nil {
+	if body.BytesPerSecond < 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "bytesPerSecond must not be negative",
+		}
+	}
+
+	var deal contentDeal
+	if err := s.DB.First(&deal, "id = ?", dealid).Error; err != nil {
 		if xerrors.Is(err, gorm.ErrRecordNotFound) {
 			return &util.HttpError{
 				Code:    http.StatusNotFound,
 				Reason:  util.ERR_RECORD_NOT_FOUND,
-				Details: fmt.Sprintf("deal was not found for prop_cid: %s", propCid),
+				Details: fmt.Sprintf("deal: %d was not found", dealid),
 			}
 		}
 		return err
 	}
 
-	// Get deal UUID, if there is one for the deal.
-	// (There should be a UUID for deals made with deal protocol v1.2.0)
-	var dealUUID *uuid.UUID
-	if d.DealUUID != "" {
-		parsed, err := uuid.Parse(d.DealUUID)
-		if err != nil {
-			return fmt.Errorf("parsing deal uuid %s: %w", d.DealUUID, err)
-		}
+	if deal.DTChan == "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("deal %d has no data transfer channel", deal.ID),
+		}
+	}
+
+	chanid, err := deal.ChannelID()
+	if err != nil {
+		return err
+	}
+
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ?", deal.Content).Error; err != nil {
+		return err
+	}
+
+	if cont.Location == constants.ContentLocationLocal {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "only transfers from shuttles can be limited",
+		}
+	}
+
+	if err := s.CM.sendTransferBandwidthLimitCmd(c.Request().Context(), cont.Location, chanid, deal, body.BytesPerSecond); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{})
+}
+
+// handleDealStatus godoc
+// @Summary      Deal Status
+// @Description  This endpoint returns the status of a deal
+// @Tags         deals
+// @Produce      json
+// @Success      200       {object}  string
+// @Failure      400   {object}  util.HttpError
+// @Failure      500   {object}  util.HttpError
+// @Param        miner    path      string  true  "Miner"
+// @Param        propcid  path      string  true  "Proposal CID"
+// @Router       /deal/status/{miner}/{propcid} [get]
+func (s *Server) handleDealStatus(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	addr, err := address.NewFromString(c.Param("miner"))
+	if err != nil {
+		return err
+	}
+
+	propCid, err := cid.Decode(c.Param("propcid"))
+	if err != nil {
+		return err
+	}
+
+	var d contentDeal
+	if err := s.DB.First(&d, "prop_cid = ?", propCid.Bytes()).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("deal was not found for prop_cid: %s", propCid),
+			}
+		}
+		return err
+	}
+
+	// Get deal UUID, if there is one for the deal.
+	// (There should be a UUID for deals made with deal protocol v1.2.0)
+	var dealUUID *uuid.UUID
+	if d.DealUUID != "" {
+		parsed, err := uuid.Parse(d.DealUUID)
+		if err != nil {
+			return fmt.Errorf("parsing deal uuid %s: %w", d.DealUUID, err)
+		}
 		dealUUID = &parsed
 	}
 
-	status, err := s.FilClient.DealStatus(ctx, addr, propCid, dealUUID)
+	status, err := s.CM.dealStatus(ctx, &d, addr, dealUUID)
 	if err != nil {
 		return xerrors.Errorf("getting deal status: %w", err)
 	}
@@ -2438,7 +2867,7 @@ func (s *Server) handleDealStats(c echo.Context) error {
 			}
 			dealUUID = &parsed
 		}
-		st, err := s.FilClient.DealStatus(ctx, maddr, d.PropCid.CID, dealUUID)
+		st, err := s.CM.dealStatus(ctx, &d, maddr, dealUUID)
 		if err != nil {
 			log.Errorf("checking deal status failed (%s): %s", maddr, err)
 			continue
@@ -2970,2116 +3399,3433 @@ func (s *Server) handleMoveContent(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{})
 }
 
-func (s *Server) handleRefreshContent(c echo.Context) error {
-	cont, err := strconv.Atoi(c.Param("content"))
-	if err != nil {
-		return err
-	}
-
-	if err := s.CM.RefreshContent(c.Request().Context(), uint(cont)); err != nil {
-		return c.JSON(500, map[string]string{"error": err.Error()})
-	}
-
-	return c.JSON(http.StatusOK, map[string]string{})
+type setUserQuotaBody struct {
+	UserID uint  `json:"userId"`
+	Quota  int64 `json:"quota"`
 }
 
-func (s *Server) handleReadLocalContent(c echo.Context) error {
-	cont, err := strconv.Atoi(c.Param("content"))
-	if err != nil {
-		return err
-	}
+func (s *Server) handleSetUserQuota(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-	var content util.Content
-	if err := s.DB.First(&content, "id = ?", cont).Error; err != nil {
-		if xerrors.Is(err, gorm.ErrRecordNotFound) {
-			return &util.HttpError{
-				Code:    http.StatusNotFound,
-				Reason:  util.ERR_RECORD_NOT_FOUND,
-				Details: fmt.Sprintf("content: %d was not found", cont),
-			}
-		}
+	var body setUserQuotaBody
+	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
-	bserv := blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore))
-	dserv := merkledag.NewDAGService(bserv)
-
-	ctx := context.Background()
-	nd, err := dserv.Get(ctx, content.Cid.CID)
-	if err != nil {
-		return c.JSON(400, map[string]string{
-			"error": err.Error(),
-		})
-	}
-	r, err := uio.NewDagReader(ctx, nd, dserv)
-	if err != nil {
-		return c.JSON(400, map[string]string{
-			"error": err.Error(),
-		})
+	if body.Quota < 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "quota must not be negative, use 0 to remove the quota",
+		}
 	}
 
-	_, err = io.Copy(c.Response(), r)
-	if err != nil {
+	if err := s.CM.sendSetUserQuotaCmd(c.Request().Context(), handle, body.UserID, body.Quota); err != nil {
 		return err
 	}
-	return nil
+
+	return c.JSON(http.StatusOK, map[string]string{})
 }
 
-func (s *Server) checkTokenAuth(token string) (*util.User, error) {
-	var authToken util.AuthToken
-	tokenHash := util.GetTokenHash(token)
-	if err := s.DB.First(&authToken, "token = ? OR token_hash = ?", token, tokenHash).Error; err != nil {
-		if xerrors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, &util.HttpError{
-				Code:    http.StatusUnauthorized,
-				Reason:  util.ERR_INVALID_TOKEN,
-				Details: "api key does not exist",
-			}
-		}
-		return nil, err
+type pauseUserBody struct {
+	UserID uint   `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+// handlePauseUser holds the queued pins of a user on a shuttle and makes it
+// refuse the user's uploads, pins already running finish
+func (s *Server) handlePauseUser(c echo.Context) error {
+	handle := c.Param("shuttle")
+
+	var body pauseUserBody
+	if err := c.Bind(&body); err != nil {
+		return err
 	}
 
-	if authToken.Expiry.Before(time.Now()) {
-		return nil, &util.HttpError{
-			Code:    http.StatusUnauthorized,
-			Reason:  util.ERR_TOKEN_EXPIRED,
-			Details: fmt.Sprintf("token for user %d expired %s", authToken.User, authToken.Expiry),
+	if body.UserID == 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "a user to pause must be given",
 		}
 	}
 
-	var user util.User
-	if err := s.DB.First(&user, "id = ?", authToken.User).Error; err != nil {
-		if xerrors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, &util.HttpError{
-				Code:    http.StatusUnauthorized,
-				Reason:  util.ERR_INVALID_TOKEN,
-				Details: "no user exists for the spicified api key",
-			}
-		}
-		return nil, err
+	if err := s.CM.sendPauseUserCmd(c.Request().Context(), handle, body.UserID, body.Reason); err != nil {
+		return err
 	}
 
-	user.AuthToken = authToken
-	return &user, nil
+	return c.JSON(http.StatusOK, map[string]string{})
 }
 
-func (s *Server) AuthRequired(level int) echo.MiddlewareFunc {
-	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
+func (s *Server) handleResumeUser(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-			//	Check first if the Token is available. We should not continue if the
-			//	token isn't even available.
-			auth, err := util.ExtractAuth(c)
-			if err != nil {
-				return err
-			}
+	var body pauseUserBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
 
-			ctx, span := s.tracer.Start(c.Request().Context(), "authCheck")
-			defer span.End()
-			c.SetRequest(c.Request().WithContext(ctx))
+	if err := s.CM.sendResumeUserCmd(c.Request().Context(), handle, body.UserID); err != nil {
+		return err
+	}
 
-			u, err := s.checkTokenAuth(auth)
-			if err != nil {
-				return err
-			}
+	return c.JSON(http.StatusOK, map[string]string{})
+}
 
-			span.SetAttributes(attribute.Int("user", int(u.ID)))
+type setReplicationPolicyBody struct {
+	Content        uint   `json:"content"`
+	MinActiveDeals int    `json:"minActiveDeals"`
+	ExpiryWindow   string `json:"expiryWindow"`
+}
 
-			if u.AuthToken.UploadOnly && level >= util.PermLevelUser {
-				log.Warnw("api key is upload only", "user", u.ID, "perm", u.Perm, "required", level)
+func (s *Server) handleSetReplicationPolicy(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-				return &util.HttpError{
-					Code:    http.StatusForbidden,
-					Reason:  util.ERR_NOT_AUTHORIZED,
-					Details: "api key is upload only",
-				}
-			}
+	var body setReplicationPolicyBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
 
-			if u.Perm >= level {
-				c.Set("user", u)
-				return next(c)
+	var expiryWindow time.Duration
+	if body.ExpiryWindow != "" {
+		d, err := time.ParseDuration(body.ExpiryWindow)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid expiry window: %s", err),
 			}
+		}
+		expiryWindow = d
+	}
 
-			log.Warnw("user not authorized", "user", u.ID, "perm", u.Perm, "required", level)
+	if body.Content != 0 {
+		var cont util.Content
+		if err := s.DB.First(&cont, "id = ?", body.Content).Error; err != nil {
+			return err
+		}
 
+		if cont.Location != handle {
 			return &util.HttpError{
-				Code:    http.StatusForbidden,
-				Reason:  util.ERR_NOT_AUTHORIZED,
-				Details: "user not authorized",
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("content %d is not on shuttle %s", cont.ID, handle),
 			}
 		}
 	}
+
+	if err := s.CM.sendSetReplicationPolicyCmd(c.Request().Context(), handle, body.Content, body.MinActiveDeals, expiryWindow); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{})
 }
 
-type registerBody struct {
-	Username   string `json:"username"`
-	Password   string `json:"passwordHash"`
-	InviteCode string `json:"inviteCode"`
+type rechunkContentBody struct {
+	Chunker   string `json:"chunker"`
+	RawLeaves bool   `json:"rawLeaves"`
+	UnpinOld  bool   `json:"unpinOld"`
 }
 
-const TOKEN_LABEL_ON_REGISTER = "on-register"
+// handleRechunkContent has the shuttle holding a content re-encode it with
+// the given chunker into a new content, the result is reported
+// asynchronously
+func (s *Server) handleRechunkContent(c echo.Context) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
 
-func (s *Server) handleRegisterUser(c echo.Context) error {
-	var reg registerBody
-	if err := c.Bind(&reg); err != nil {
+	body := rechunkContentBody{
+		Chunker:   util.DefaultChunker,
+		RawLeaves: true,
+	}
+	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
-	var invite util.InviteCode
-	if err := s.DB.First(&invite, "code = ?", reg.InviteCode).Error; err != nil {
+	if err := util.ValidateChunker(body.Chunker); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid chunker: %s", err),
+		}
+	}
+
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ?", contID).Error; err != nil {
 		if xerrors.Is(err, gorm.ErrRecordNotFound) {
 			return &util.HttpError{
 				Code:    http.StatusNotFound,
-				Reason:  util.ERR_INVALID_INVITE,
-				Details: "no such invite code was found",
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", contID),
 			}
 		}
 		return err
 	}
 
-	if invite.ClaimedBy != 0 {
+	if cont.Location == constants.ContentLocationLocal {
 		return &util.HttpError{
 			Code:    http.StatusBadRequest,
-			Reason:  util.ERR_INVITE_ALREADY_USED,
-			Details: "the invite code as already been claimed",
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "only content on shuttles can be rechunked",
 		}
 	}
 
-	username := strings.ToLower(reg.Username)
-
-	var exist *util.User
-	if err := s.DB.First(&exist, "username = ?", username).Error; err != nil {
-		if !xerrors.Is(err, gorm.ErrRecordNotFound) {
-			return err
+	if !cont.Active || cont.Aggregate || cont.DagSplit {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is not an active file content", cont.ID),
 		}
-		exist = nil
 	}
 
-	if exist != nil {
+	if err := s.CM.sendRechunkContentCmd(c.Request().Context(), cont.Location, cont, body.Chunker, body.RawLeaves, body.UnpinOld); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{})
+}
+
+type warmCacheBody struct {
+	MaxBlocks int `json:"maxBlocks"`
+}
+
+// handleWarmCache has the shuttle holding a content load its blocks into its
+// read cache ahead of retrievals, the result is reported asynchronously
+func (s *Server) handleWarmCache(c echo.Context) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	var body warmCacheBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if body.MaxBlocks < 0 {
 		return &util.HttpError{
 			Code:    http.StatusBadRequest,
-			Reason:  util.ERR_USERNAME_TAKEN,
-			Details: "username already exist",
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "maxBlocks must not be negative",
 		}
 	}
 
-	salt := uuid.New().String()
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", contID),
+			}
+		}
+		return err
+	}
 
-	newUser := &util.User{
-		Username: username,
-		UUID:     uuid.New().String(),
-		Salt:     salt,
-		PassHash: util.GetPasswordHash(reg.Password, salt, s.DB.Config.Dialector.Name()),
-		Perm:     util.PermLevelUser,
+	if cont.Location == constants.ContentLocationLocal {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "only the read cache of shuttles can be warmed",
+		}
 	}
 
-	if err := s.DB.Create(newUser).Error; err != nil {
+	if !cont.Active {
 		return &util.HttpError{
-			Code:   http.StatusInternalServerError,
-			Reason: util.ERR_USER_CREATION_FAILED,
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is not active", cont.ID),
 		}
 	}
 
-	authToken, err := s.newAuthTokenForUser(newUser, time.Now().Add(constants.TokenExpiryDurationRegister), nil, TOKEN_LABEL_ON_REGISTER)
+	if err := s.CM.sendWarmCacheCmd(c.Request().Context(), cont.Location, cont.ID, body.MaxBlocks); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{})
+}
+
+// handleRehydrateContent has the shuttle holding a content retrieve the blocks
+// it no longer has from the deals of the content, progress is reported
+// asynchronously
+func (s *Server) handleRehydrateContent(c echo.Context) error {
+	contID, err := strconv.Atoi(c.Param("content"))
 	if err != nil {
 		return err
 	}
 
-	invite.ClaimedBy = newUser.ID
-	if err := s.DB.Save(&invite).Error; err != nil {
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", contID),
+			}
+		}
 		return err
 	}
 
-	return c.JSON(http.StatusOK, &loginResponse{
-		Token:  authToken.Token,
-		Expiry: authToken.Expiry,
-	})
+	if cont.Location == constants.ContentLocationLocal {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "only content held by a shuttle can be rehydrated",
+		}
+	}
+
+	s.CM.rehydrations.Remove(cont.ID)
+	if err := s.CM.sendRehydrateContentCmd(c.Request().Context(), cont.Location, cont); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{})
 }
 
-type loginBody struct {
-	Username string `json:"username"`
-	Password string `json:"passwordHash"`
+// handleGetRehydrateProgress returns the last rehydration progress reported
+// for a content
+func (s *Server) handleGetRehydrateProgress(c echo.Context) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	v, ok := s.CM.rehydrations.Get(uint(contID))
+	if !ok {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_RECORD_NOT_FOUND,
+			Details: fmt.Sprintf("no rehydration of content %d was reported", contID),
+		}
+	}
+
+	return c.JSON(http.StatusOK, v)
 }
 
-type loginResponse struct {
-	Token  string    `json:"token"`
-	Expiry time.Time `json:"expiry"`
+type setReadOnlyBody struct {
+	ReadOnly bool `json:"readOnly"`
 }
 
-const TOKEN_LABEL_ON_LOGIN = "on-login"
+// handleSetContentReadOnly has the shuttle holding a content refuse any
+// operation that would change its pin, e.g. for content under legal hold
+func (s *Server) handleSetContentReadOnly(c echo.Context) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
 
-func (s *Server) handleLoginUser(c echo.Context) error {
-	var body loginBody
+	var body setReadOnlyBody
 	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
-	var user util.User
-	if err := s.DB.First(&user, "username = ?", strings.ToLower(body.Username)).Error; err != nil {
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ?", contID).Error; err != nil {
 		if xerrors.Is(err, gorm.ErrRecordNotFound) {
 			return &util.HttpError{
-				Code:    http.StatusForbidden,
-				Reason:  util.ERR_USER_NOT_FOUND,
-				Details: "no such user exist",
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", contID),
 			}
 		}
 		return err
 	}
 
-	//	validate password
-	//	SQLlite and Postgres has incompatibility in hashing and even though we are dropping support for sqlite later,
-	//	we still need to accommodate those who chooses to use SQLite for experimentation purposes.
-	var valid = true
-	var dbDialect = s.DB.Config.Dialector.Name()
-
-	//	check password hash (this is the way).
-	if (user.Salt != "" && (user.PassHash != util.GetPasswordHash(body.Password, user.Salt, dbDialect))) || (user.Salt == "" && user.PassHash != body.Password) {
-		valid = false                                                                           //	assume it's not valid.
-		if bcrypt.CompareHashAndPassword([]byte(user.PassHash), []byte(body.Password)) == nil { //	we are using bcrypt, so we need to rehash it.
-			valid = true
-		}
-	}
-
-	if !valid {
+	if cont.Location == constants.ContentLocationLocal {
 		return &util.HttpError{
-			Code:   http.StatusForbidden,
-			Reason: util.ERR_INVALID_PASSWORD,
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "read-only content is only enforced by shuttles",
 		}
 	}
 
-	authToken, err := s.newAuthTokenForUser(&user, time.Now().Add(constants.TokenExpiryDurationLogin), nil, TOKEN_LABEL_ON_LOGIN)
-	if err != nil {
+	if err := s.CM.sendSetReadOnlyCmd(c.Request().Context(), cont.Location, cont.ID, body.ReadOnly); err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, &loginResponse{
-		Token:  authToken.Token,
-		Expiry: authToken.Expiry,
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"content":  cont.ID,
+		"readOnly": body.ReadOnly,
 	})
 }
 
-type changePasswordParams struct {
-	NewPassword string `json:"newPasswordHash"`
+type reassignContentBody struct {
+	UserID uint `json:"userId"`
 }
 
-func (s *Server) handleUserChangePassword(c echo.Context, u *util.User) error {
-	var params changePasswordParams
-	if err := c.Bind(&params); err != nil {
+// handleReassignContent moves a content, and the contents split from it, to
+// another user. The shuttle holding it moves its pins first so the owner
+// known to estuary and to the shuttle stay the same.
+func (s *Server) handleReassignContent(c echo.Context) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
 		return err
 	}
 
-	salt := uuid.New().String()
+	var body reassignContentBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
 
-	updatedUserColumns := &util.User{
-		Salt:     salt,
-		PassHash: util.GetPasswordHash(params.NewPassword, salt, s.DB.Config.Dialector.Name()),
+	var user util.User
+	if err := s.DB.First(&user, "id = ?", body.UserID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_USER_NOT_FOUND,
+				Details: fmt.Sprintf("user with ID(%d) was not found", body.UserID),
+			}
+		}
+		return err
 	}
 
-	if err := s.DB.Model(util.User{}).Where("id = ?", u.ID).Updates(updatedUserColumns).Error; err != nil {
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", contID),
+			}
+		}
 		return err
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{})
-}
+	if cont.Location != constants.ContentLocationLocal {
+		if err := s.reassignShuttlePin(c.Request().Context(), cont, user.ID); err != nil {
+			return err
+		}
+	}
 
-type changeAddressParams struct {
-	Address string `json:"address"`
+	if err := s.DB.Model(util.Content{}).Where("id = ? or split_from = ?", cont.ID, cont.ID).UpdateColumn("user_id", user.ID).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"content": cont.ID,
+		"userId":  user.ID,
+	})
 }
 
-func (s *Server) handleUserChangeAddress(c echo.Context, u *util.User) error {
-	var params changeAddressParams
-	if err := c.Bind(&params); err != nil {
+// reassignShuttlePin has the shuttle holding a content move its pins to
+// another user and waits for its answer
+func (s *Server) reassignShuttlePin(ctx context.Context, cont util.Content, user uint) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	s.CM.pinReassignments.Remove(cont.ID)
+	if err := s.CM.sendReassignPinCmd(ctx, cont.Location, cont.ID, user); err != nil {
 		return err
 	}
 
-	addr, err := address.NewFromString(params.Address)
-	if err != nil {
-		log.Warnf("invalid filecoin address in change address request body: %w", err)
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-		return &util.HttpError{
-			Code:   http.StatusUnauthorized,
-			Reason: "invalid address in request body",
+	for {
+		// answers to an earlier reassignment of the content are skipped
+		if v, ok := s.CM.pinReassignments.Get(cont.ID); ok && v.(*drpc.PinReassigned).UserID == user {
+			res := v.(*drpc.PinReassigned)
+			if res.Error != "" {
+				return &util.HttpError{
+					Code:    http.StatusConflict,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("shuttle %s failed to reassign content %d: %s", cont.Location, cont.ID, res.Error),
+				}
+			}
+			return nil
 		}
-	}
 
-	if err := s.DB.Model(util.User{}).Where("id = ?", u.ID).Update("address", addr.String()).Error; err != nil {
-		return err
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to reassign content %d", cont.Location, cont.ID)
+		}
 	}
-
-	return c.JSON(http.StatusOK, map[string]string{})
 }
 
-type userStatsResponse struct {
-	TotalSize int64 `json:"totalSize"`
-	NumPins   int64 `json:"numPins"`
+type relocateContentBody struct {
+	Contents []uint `json:"contents"`
 }
 
-// handleGetUserStats godoc
-// @Summary      Create API keys for a user
-// @Description  This endpoint is used to create API keys for a user.
-// @Tags         User
-// @Produce      json
-// @Success      200  {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /user/stats [get]
-func (s *Server) handleGetUserStats(c echo.Context, u *util.User) error {
-	var stats userStatsResponse
-	if err := s.DB.Raw(` SELECT
-						(SELECT SUM(size) FROM contents where user_id = ? AND aggregated_in = 0 AND active) as total_size,
-						(SELECT COUNT(1) FROM contents where user_id = ? AND active) as num_pins`,
-		u.ID, u.ID).Scan(&stats).Error; err != nil {
+func (s *Server) handleRelocateContent(c echo.Context) error {
+	handle := c.Param("shuttle")
+
+	var body relocateContentBody
+	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, stats)
-}
-
-func (s *Server) newAuthTokenForUser(user *util.User, expiry time.Time, perms []string, label string) (*util.AuthToken, error) {
-	if len(perms) > 1 {
-		return nil, fmt.Errorf("invalid perms")
+	var contents []uint
+	if err := s.DB.Model(util.Content{}).Where("id in ? and location = ? and active", body.Contents, handle).Pluck("id", &contents).Error; err != nil {
+		return err
 	}
 
-	var uploadOnly bool
-	if len(perms) == 1 {
-		switch perms[0] {
-		case "all":
-			uploadOnly = false
-		case "upload":
-			uploadOnly = true
-		default:
-			return nil, fmt.Errorf("invalid perm: %q", perms[0])
+	if len(contents) == 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("none of the contents are active on shuttle %s", handle),
 		}
 	}
 
-	token := "EST" + uuid.New().String() + "ARY"
-	authToken := &util.AuthToken{
-		Token:      token,
-		TokenHash:  util.GetTokenHash(token),
-		Label:      label,
-		User:       user.ID,
-		Expiry:     expiry,
-		UploadOnly: uploadOnly,
-	}
-	if err := s.DB.Create(authToken).Error; err != nil {
-		return nil, err
+	if err := s.CM.sendRelocatePinCmd(c.Request().Context(), handle, contents); err != nil {
+		return err
 	}
 
-	return authToken, nil
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"relocating": contents,
+	})
 }
 
-func (s *Server) handleGetViewer(c echo.Context, u *util.User) error {
-	uep, err := s.getPreferredUploadEndpoints(u)
+func (s *Server) handleRefreshContent(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
 	if err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, &util.ViewerResponse{
-		ID:       u.ID,
-		Username: u.Username,
-		Perms:    u.Perm,
-		Address:  u.Address.Addr.String(),
-		Miners:   s.getMinersOwnedByUser(u),
-		Settings: util.UserSettings{
-			Replication:           s.CM.Replication,
-			Verified:              s.cfg.Deal.IsVerified,
-			DealDuration:          s.cfg.Deal.Duration,
-			MaxStagingWait:        s.cfg.StagingBucket.MaxLifeTime,
-			FileStagingThreshold:  s.cfg.StagingBucket.IndividualDealThreshold,
-			ContentAddingDisabled: s.isContentAddingDisabled(u),
-			DealMakingDisabled:    s.CM.dealMakingDisabled(),
-			UploadEndpoints:       uep,
-			Flags:                 u.Flags,
-		},
-		AuthExpiry: u.AuthToken.Expiry,
-	})
+	if err := s.CM.RefreshContent(c.Request().Context(), uint(cont)); err != nil {
+		return c.JSON(500, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{})
 }
 
-func (s *Server) getMinersOwnedByUser(u *util.User) []string {
-	var miners []storageMiner
-	if err := s.DB.Find(&miners, "owner = ?", u.ID).Error; err != nil {
-		log.Errorf("failed to query miners for user %d: %s", u.ID, err)
-		return nil
+func (s *Server) handleGetContentPeers(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
 	}
 
-	var out []string
-	for _, m := range miners {
-		out = append(out, m.Address.Addr.String())
+	var content util.Content
+	if err := s.DB.First(&content, "id = ?", cont).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("content: %d was not found", cont),
+			}
+		}
+		return err
 	}
 
-	return out
-}
+	if content.Location == constants.ContentLocationLocal {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content peers are only tracked by shuttles",
+		}
+	}
 
-func (s *Server) getPreferredUploadEndpoints(u *util.User) ([]string, error) {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*10)
+	defer cancel()
 
-	// TODO: this should be a lotttttt smarter
-	s.CM.shuttlesLk.Lock()
-	defer s.CM.shuttlesLk.Unlock()
-	var shuttles []Shuttle
-	for hnd, sh := range s.CM.shuttles {
-		if sh.ContentAddingDisabled {
-			log.Debugf("shuttle %+v content adding is disabled", sh)
-			continue
-		}
+	s.CM.contentPeers.Remove(content.ID)
+	if err := s.CM.sendGetContentPeersCmd(ctx, content.Location, content.ID); err != nil {
+		return err
+	}
 
-		if sh.hostname == "" {
-			log.Debugf("shuttle %+v has empty hostname", sh)
-			continue
-		}
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-		var shuttle Shuttle
-		if err := s.DB.First(&shuttle, "handle = ?", hnd).Error; err != nil {
-			log.Errorf("failed to look up shuttle by handle: %s", err)
-			continue
+	for {
+		if v, ok := s.CM.contentPeers.Get(content.ID); ok {
+			return c.JSON(http.StatusOK, v)
 		}
 
-		if !shuttle.Open {
-			log.Debugf("shuttle %+v is not open, skipping", shuttle)
-			continue
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to report peers of content %d", content.Location, content.ID)
 		}
-
-		shuttles = append(shuttles, shuttle)
 	}
+}
 
-	sort.Slice(shuttles, func(i, j int) bool {
-		return shuttles[i].Priority > shuttles[j].Priority
-	})
-
-	var out []string
-	for _, sh := range shuttles {
-		host := "https://" + sh.Host
-		if strings.HasPrefix(sh.Host, "http://") || strings.HasPrefix(sh.Host, "https://") {
-			host = sh.Host
+// handleGetPinsByLabel lists the ids of the contents a shuttle pinned with the
+// label given in the label query param
+func (s *Server) handleGetPinsByLabel(c echo.Context) error {
+	handle := c.Param("shuttle")
+	label := c.QueryParam("label")
+	if label == "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+			Details: "a label is required",
 		}
-		out = append(out, host+"/content/add")
 	}
-	if !s.CM.localContentAddingDisabled {
-		out = append(out, s.CM.hostname+"/content/add")
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*10)
+	defer cancel()
+
+	key := pinLabelKey{handle: handle, label: label}
+	s.CM.pinsByLabel.Remove(key)
+	if err := s.CM.sendFindPinsByLabelCmd(ctx, handle, label); err != nil {
+		return err
 	}
 
-	return out, nil
-}
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-func (s *Server) handleHealth(c echo.Context) error {
-	return c.JSON(http.StatusOK, map[string]string{
-		"status": "ok",
-	})
-}
+	for {
+		if v, ok := s.CM.pinsByLabel.Get(key); ok {
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"label":    label,
+				"contents": v,
+			})
+		}
 
-type getApiKeysResp struct {
-	Token     string    `json:"token"`
-	TokenHash string    `json:"tokenHash"`
-	Label     string    `json:"label"`
-	Expiry    time.Time `json:"expiry"`
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to report pins labeled %s", handle, label)
+		}
+	}
 }
 
-// handleUserRevokeApiKey godoc
-// @Summary      Revoke a User API Key.
-// @Description  This endpoint is used to revoke a user API key. In estuary, every user is assigned with an API key, this API key is generated and issued for each user and is primarily used to access all estuary features. This endpoint can be used to revoke the API key that's assigned to the user. Revoked API keys are completely deleted and are not recoverable.
-// @Tags         User
-// @Produce      json
-// @Success      200  {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Param        key_or_hash path string true "Key or Hash"
-// @Router       /user/api-keys/{key_or_hash} [delete]
-func (s *Server) handleUserRevokeApiKey(c echo.Context, u *util.User) error {
-	kval := c.Param("key_or_hash")
-	if err := s.DB.Delete(&util.AuthToken{}, "\"user\" = ? AND (token = ? OR token_hash = ?)", u.ID, kval, kval).Error; err != nil {
-		return err
-	}
+// contents whose cids can be asked for at once
+const maxContentCidsQuery = 1000
 
-	return c.NoContent(200)
-}
+// handleGetContentCids returns the root cids of the contents given as a
+// comma separated list of ids in the contents query param
+func (s *Server) handleGetContentCids(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-// handleUserCreateApiKey godoc
-// @Summary      Create API keys for a user
-// @Description  This endpoint is used to create API keys for a user. In estuary, each user is given an API key to access all features.
-// @Tags         User
-// @Produce      json
-// @Param        expiry  query     string  false  "Expiration - Expiration - Valid time units are ns, us (or µs),  ms,  s,  m,  h.  for  example  300h"
-// @Param        perms   query     string  false  "Permissions -- currently unused"
-// @Success      200     {object}  getApiKeysResp
-// @Failure      400  {object}  util.HttpError
-// @Failure      404     {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /user/api-keys [post]
-func (s *Server) handleUserCreateApiKey(c echo.Context, u *util.User) error {
-	expiry := time.Now().Add(constants.TokenExpiryDurationDefault)
-	if exp := c.QueryParam("expiry"); exp != "" {
-		if exp == "false" {
-			expiry = time.Now().Add(constants.TokenExpiryDurationPermanent)
-		} else {
-			dur, err := time.ParseDuration(exp)
-			if err != nil {
-				return err
+	var contents []uint
+	for _, v := range strings.Split(c.QueryParam("contents"), ",") {
+		if v == "" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: fmt.Sprintf("invalid content id %q", v),
 			}
-			expiry = time.Now().Add(dur)
 		}
+		contents = append(contents, uint(id))
 	}
 
-	var perms []string
-	if p := c.QueryParam("perms"); p != "" {
-		perms = strings.Split(p, ",")
+	if len(contents) == 0 || len(contents) > maxContentCidsQuery {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+			Details: fmt.Sprintf("between 1 and %d content ids are required", maxContentCidsQuery),
+		}
 	}
 
-	label := c.QueryParam("label")
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*10)
+	defer cancel()
 
-	authToken, err := s.newAuthTokenForUser(u, expiry, perms, label)
+	cids, err := s.CM.lookupContentCids(ctx, handle, contents)
 	if err != nil {
 		return err
 	}
+	return c.JSON(http.StatusOK, cids)
+}
 
-	return c.JSON(http.StatusOK, &getApiKeysResp{
-		Token:     authToken.Token,
-		TokenHash: authToken.TokenHash,
-		Label:     authToken.Label,
-		Expiry:    authToken.Expiry,
-	})
+type shuttleTransfer struct {
+	drpc.ActiveTransfer
+	// Untracked is set for the transfers of deals estuary does not expect to
+	// be transferring on this channel
+	Untracked bool `json:"untracked"`
 }
 
-// handleUserGetApiKeys godoc
-// @Summary      Get API keys for a user
-// @Description  This endpoint is used to get API keys for a user. In estuary, each user can be given multiple API keys (tokens). This endpoint can be used to retrieve all available API keys for a given user.
-// @Tags         User
-// @Produce      json
-// @Success      200  {array}   []getApiKeysResp
-// @Failure      400  {object}  util.HttpError
-// @Failure      404   {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /user/api-keys [get]
-func (s *Server) handleUserGetApiKeys(c echo.Context, u *util.User) error {
-	var keys []util.AuthToken
-	if err := s.DB.Find(&keys, "auth_tokens.user = ?", u.ID).Error; err != nil {
-		return err
-	}
+// handleGetShuttleTransfers lists all the transfers a shuttle tracks
+func (s *Server) handleGetShuttleTransfers(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-	out := []getApiKeysResp{}
-	for _, k := range keys {
-		out = append(out, getApiKeysResp{
-			Token:     k.Token,
-			TokenHash: k.TokenHash,
-			Label:     k.Label,
-			Expiry:    k.Expiry,
-		})
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*10)
+	defer cancel()
+
+	s.CM.activeTransfers.Remove(handle)
+	if err := s.CM.sendListActiveTransfersCmd(ctx, handle); err != nil {
+		return err
 	}
 
-	return c.JSON(http.StatusOK, out)
-}
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-type createCollectionBody struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-}
+	var transfers []drpc.ActiveTransfer
+	for {
+		if v, ok := s.CM.activeTransfers.Get(handle); ok {
+			transfers = v.([]drpc.ActiveTransfer)
+			break
+		}
 
-// handleCreateCollection godoc
-// @Summary      Create a new collection
-// @Description  This endpoint is used to create a new collection. A collection is a representaion of a group of objects added on the estuary. This endpoint can be used to create a new collection.
-// @Tags         collections
-// @Produce      json
-// @Param        body  body      createCollectionBody  true  "Collection name and description"
-// @Success      200   {object}  collections.Collection
-// @Failure      400  {object}  util.HttpError
-// @Failure      404  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /collections/ [post]
-func (s *Server) handleCreateCollection(c echo.Context, u *util.User) error {
-	var body createCollectionBody
-	if err := c.Bind(&body); err != nil {
-		return err
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to report its transfers", handle)
+		}
 	}
 
-	col := &collections.Collection{
-		UUID:        uuid.New().String(),
-		Name:        body.Name,
-		Description: body.Description,
-		UserID:      u.ID,
+	dealIDs := make([]uint, 0, len(transfers))
+	for _, t := range transfers {
+		dealIDs = append(dealIDs, t.DealDBID)
 	}
 
-	if err := s.DB.Create(col).Error; err != nil {
+	var deals []contentDeal
+	if err := s.DB.Find(&deals, "id in ?", dealIDs).Error; err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, col)
-}
-
-// handleListCollections godoc
-// @Summary      List all collections
-// @Description  This endpoint is used to list all collections. Whenever a user logs on estuary, it will list all collections that the user has access to. This endpoint provides a way to list all collections to the user.
-// @Tags         collections
-// @Produce      json
-// @Success      200  {array}   []collections.Collection
-// @Failure      400  {object}  util.HttpError
-// @Failure      404  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /collections/ [get]
-func (s *Server) handleListCollections(c echo.Context, u *util.User) error {
-	var cols []collections.Collection
-	if err := s.DB.Find(&cols, "user_id = ?", u.ID).Error; err != nil {
-		return err
+	dealChans := make(map[uint]string, len(deals))
+	for _, d := range deals {
+		if !d.Failed {
+			dealChans[d.ID] = d.DTChan
+		}
 	}
 
-	return c.JSON(http.StatusOK, cols)
-}
+	out := make([]shuttleTransfer, 0, len(transfers))
+	for _, t := range transfers {
+		// deals record the transfer id, which differs from the channel id
+		// for boost transfers
+		transferID := t.Chanid
+		if t.State != nil && t.State.TransferID != "" {
+			transferID = t.State.TransferID
+		}
 
-type addContentsToCollectionBody struct {
-	ContentIDs []uint `json:"contentids"`
+		ch, ok := dealChans[t.DealDBID]
+		out = append(out, shuttleTransfer{
+			ActiveTransfer: t,
+			Untracked:      !ok || ch != transferID,
+		})
+	}
+	return c.JSON(http.StatusOK, out)
 }
 
-// handleAddContentsToCollection godoc
-// @Summary      Add contents to a collection
-// @Description  This endpoint adds already-pinned contents (that have ContentIDs) to a collection.
-// @Tags         collections
-// @Accept       json
-// @Produce      json
-// @Param        coluuid     path      string  true  "Collection UUID"
-// @Param        contentIDs  body      []uint  true  "Content IDs to add to collection"
-// @Success      200         {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /collections/{coluuid} [post]
-func (s *Server) handleAddContentsToCollection(c echo.Context, u *util.User) error {
-	coluuid := c.Param("coluuid")
+// handleGetTransferBytes returns the bytes sent, queued and expected in total
+// by a transfer of a shuttle, and the rate it sends at
+func (s *Server) handleGetTransferBytes(c echo.Context) error {
+	handle := c.Param("shuttle")
+	chanid := c.Param("chanid")
 
-	// we accept both {"contentids": [1, 2]} and [1, 2] as json payloads
-	var body addContentsToCollectionBody // {"contentids": [1, 2]}
-	var contentIDs []uint                // [1, 2]
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*10)
+	defer cancel()
 
-	// Save the body of the request so that we can try to unmarshal it twice (if first bind fails)
-	// We can't simply c.Bind() because that reads directly from the socket
-	// And so if we try c.Bind()ing twice, the second call will just return EOF
-	bodyBytes, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
+	key := transferBytesKey{handle: handle, chanid: chanid}
+	s.CM.transferBytes.Remove(key)
+	if err := s.CM.sendGetTransferBytesCmd(ctx, handle, chanid); err != nil {
 		return err
 	}
 
-	if err = json.Unmarshal([]byte(bodyBytes), &contentIDs); err != nil {
-		// Failed to bind to [1, 10] payload, try {"contentids": [1, 10]}
-		if err = json.Unmarshal([]byte(bodyBytes), &body); err != nil {
-			return err
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	for {
+		if v, ok := s.CM.transferBytes.Get(key); ok {
+			res := v.(*drpc.TransferBytes)
+			if res.Error != "" {
+				return &util.HttpError{
+					Code:    http.StatusNotFound,
+					Reason:  util.ERR_RECORD_NOT_FOUND,
+					Details: fmt.Sprintf("shuttle %s failed to read transfer %s: %s", handle, chanid, res.Error),
+				}
+			}
+			return c.JSON(http.StatusOK, res)
 		}
-		contentIDs = body.ContentIDs
-	}
 
-	// no contents
-	if len(contentIDs) == 0 {
-		return &util.HttpError{
-			Code:    http.StatusBadRequest,
-			Reason:  util.ERR_INVALID_INPUT,
-			Details: fmt.Sprintf("no contents specified, need at least one"),
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to report the bytes of transfer %s", handle, chanid)
 		}
 	}
+}
 
-	if len(contentIDs) > 128 {
-		return &util.HttpError{
-			Code:    http.StatusBadRequest,
-			Reason:  util.ERR_INVALID_INPUT,
-			Details: fmt.Sprintf("too many contents specified: %d (max 128)", len(contentIDs)),
-		}
+func (s *Server) handleReadLocalContent(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
 	}
 
-	var col collections.Collection
-	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
+	var content util.Content
+	if err := s.DB.First(&content, "id = ?", cont).Error; err != nil {
 		if xerrors.Is(err, gorm.ErrRecordNotFound) {
 			return &util.HttpError{
 				Code:    http.StatusNotFound,
 				Reason:  util.ERR_RECORD_NOT_FOUND,
-				Details: fmt.Sprintf("collection: %s was not found", coluuid),
+				Details: fmt.Sprintf("content: %d was not found", cont),
 			}
 		}
 		return err
 	}
 
-	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
-		return err
+	bserv := blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore))
+	dserv := merkledag.NewDAGService(bserv)
+
+	ctx := context.Background()
+	nd, err := dserv.Get(ctx, content.Cid.CID)
+	if err != nil {
+		return c.JSON(400, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	r, err := uio.NewDagReader(ctx, nd, dserv)
+	if err != nil {
+		return c.JSON(400, map[string]string{
+			"error": err.Error(),
+		})
 	}
 
-	var contents []util.Content
-	if err := s.DB.Find(&contents, "id in ? and user_id = ?", contentIDs, u.ID).Error; err != nil {
+	_, err = io.Copy(c.Response(), r)
+	if err != nil {
 		return err
 	}
+	return nil
+}
 
-	if len(contents) != len(contentIDs) {
-		return fmt.Errorf("%d specified content(s) were not found or user missing permissions", len(contentIDs)-len(contents))
+func (s *Server) checkTokenAuth(token string) (*util.User, error) {
+	var authToken util.AuthToken
+	tokenHash := util.GetTokenHash(token)
+	if err := s.DB.First(&authToken, "token = ? OR token_hash = ?", token, tokenHash).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusUnauthorized,
+				Reason:  util.ERR_INVALID_TOKEN,
+				Details: "api key does not exist",
+			}
+		}
+		return nil, err
 	}
 
-	defaultPath := "/"
-	var colrefs []collections.CollectionRef
-	for _, cont := range contents {
-		colrefs = append(colrefs, collections.CollectionRef{
-			Collection: col.ID,
-			Content:    cont.ID,
-			Path:       &defaultPath,
-		})
+	if authToken.Expiry.Before(time.Now()) {
+		return nil, &util.HttpError{
+			Code:    http.StatusUnauthorized,
+			Reason:  util.ERR_TOKEN_EXPIRED,
+			Details: fmt.Sprintf("token for user %d expired %s", authToken.User, authToken.Expiry),
+		}
 	}
 
-	if err := s.DB.Create(colrefs).Error; err != nil {
-		return err
+	var user util.User
+	if err := s.DB.First(&user, "id = ?", authToken.User).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusUnauthorized,
+				Reason:  util.ERR_INVALID_TOKEN,
+				Details: "no user exists for the spicified api key",
+			}
+		}
+		return nil, err
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{})
+	user.AuthToken = authToken
+	return &user, nil
 }
 
-// handleCommitCollection godoc
-// @Summary      Produce a CID of the collection contents
-// @Description  This endpoint is used to save the contents in a collection, producing a top-level CID that references all the current CIDs in the collection.
-// @Param        coluuid  path  string  true  "coluuid"
-// @Tags         collections
-// @Produce      json
-// @Success      200  {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /collections/{coluuid}/commit [post]
-func (s *Server) handleCommitCollection(c echo.Context, u *util.User) error {
-	colid := c.Param("coluuid")
+func (s *Server) AuthRequired(level int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+
+			//	Check first if the Token is available. We should not continue if the
+			//	token isn't even available.
+			auth, err := util.ExtractAuth(c)
+			if err != nil {
+				return err
+			}
+
+			ctx, span := s.tracer.Start(c.Request().Context(), "authCheck")
+			defer span.End()
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			u, err := s.checkTokenAuth(auth)
+			if err != nil {
+				return err
+			}
+
+			span.SetAttributes(attribute.Int("user", int(u.ID)))
+
+			if u.AuthToken.UploadOnly && level >= util.PermLevelUser {
+				log.Warnw("api key is upload only", "user", u.ID, "perm", u.Perm, "required", level)
+
+				return &util.HttpError{
+					Code:    http.StatusForbidden,
+					Reason:  util.ERR_NOT_AUTHORIZED,
+					Details: "api key is upload only",
+				}
+			}
+
+			if u.Perm >= level {
+				c.Set("user", u)
+				return next(c)
+			}
+
+			log.Warnw("user not authorized", "user", u.ID, "perm", u.Perm, "required", level)
 
-	var col collections.Collection
-	if err := s.DB.First(&col, "uuid = ?", colid).Error; err != nil {
-		if xerrors.Is(err, gorm.ErrRecordNotFound) {
 			return &util.HttpError{
-				Code:    http.StatusNotFound,
-				Reason:  util.ERR_RECORD_NOT_FOUND,
-				Details: fmt.Sprintf("collection: %s was not found", colid),
+				Code:    http.StatusForbidden,
+				Reason:  util.ERR_NOT_AUTHORIZED,
+				Details: "user not authorized",
 			}
 		}
-		return err
 	}
+}
 
-	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+type registerBody struct {
+	Username   string `json:"username"`
+	Password   string `json:"passwordHash"`
+	InviteCode string `json:"inviteCode"`
+}
+
+const TOKEN_LABEL_ON_REGISTER = "on-register"
+
+func (s *Server) handleRegisterUser(c echo.Context) error {
+	var reg registerBody
+	if err := c.Bind(&reg); err != nil {
 		return err
 	}
 
-	contents := []util.ContentWithPath{}
-	if err := s.DB.Model(collections.CollectionRef{}).
-		Where("collection = ?", col.ID).
-		Joins("left join contents on contents.id = collection_refs.content").
-		Select("contents.*, collection_refs.path").
-		Scan(&contents).Error; err != nil {
+	var invite util.InviteCode
+	if err := s.DB.First(&invite, "code = ?", reg.InviteCode).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_INVALID_INVITE,
+				Details: "no such invite code was found",
+			}
+		}
 		return err
 	}
 
-	// transform listen addresses (/ip/1.2.3.4/tcp/80) into full p2p multiaddresses
-	// e.g. /ip/1.2.3.4/tcp/80/p2p/12D3KooWCVTKbuvrZ9ton6zma5LNhCEeZyuFtxcDzDTmWh2qPtWM
-	fullP2pMultiAddrs := []multiaddr.Multiaddr{}
-	for _, listenAddr := range s.Node.Host.Addrs() {
-		fullP2pAddr := fmt.Sprintf("%s/p2p/%s", listenAddr, s.Node.Host.ID())
-		fullP2pMultiAddr, err := multiaddr.NewMultiaddr(fullP2pAddr)
-		if err != nil {
-			return err
+	if invite.ClaimedBy != 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVITE_ALREADY_USED,
+			Details: "the invite code as already been claimed",
 		}
-		fullP2pMultiAddrs = append(fullP2pMultiAddrs, fullP2pMultiAddr)
 	}
 
-	// transform multiaddresses into AddrInfo objects
-	var origins []*peer.AddrInfo
-	for _, p := range fullP2pMultiAddrs {
-		ai, err := peer.AddrInfoFromP2pAddr(p)
-		if err != nil {
+	username := strings.ToLower(reg.Username)
+
+	var exist *util.User
+	if err := s.DB.First(&exist, "username = ?", username).Error; err != nil {
+		if !xerrors.Is(err, gorm.ErrRecordNotFound) {
 			return err
 		}
-		origins = append(origins, ai)
+		exist = nil
 	}
 
-	bserv := blockservice.New(s.Node.Blockstore, nil)
-	dserv := merkledag.NewDAGService(bserv)
-
-	// create DAG respecting directory structure
-	collectionNode := unixfs.EmptyDirNode()
-	for _, c := range contents {
-		dirs, err := util.DirsFromPath(c.Path, c.Name)
-		if err != nil {
-			return err
+	if exist != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_USERNAME_TAKEN,
+			Details: "username already exist",
 		}
+	}
 
-		lastDirNode, err := util.EnsurePathIsLinked(dirs, collectionNode, dserv)
-		if err != nil {
-			return err
-		}
-		err = lastDirNode.AddRawLink(c.Name, &ipld.Link{
-			Size: uint64(c.Size),
-			Cid:  c.Cid.CID,
-		})
-		if err != nil {
-			return err
+	salt := uuid.New().String()
+
+	newUser := &util.User{
+		Username: username,
+		UUID:     uuid.New().String(),
+		Salt:     salt,
+		PassHash: util.GetPasswordHash(reg.Password, salt, s.DB.Config.Dialector.Name()),
+		Perm:     util.PermLevelUser,
+	}
+
+	if err := s.DB.Create(newUser).Error; err != nil {
+		return &util.HttpError{
+			Code:   http.StatusInternalServerError,
+			Reason: util.ERR_USER_CREATION_FAILED,
 		}
 	}
 
-	if err := dserv.Add(context.Background(), collectionNode); err != nil {
+	authToken, err := s.newAuthTokenForUser(newUser, time.Now().Add(constants.TokenExpiryDurationRegister), nil, TOKEN_LABEL_ON_REGISTER)
+	if err != nil {
 		return err
-	} // add new CID to local blockstore
+	}
 
-	// update DB with new collection CID
-	col.CID = collectionNode.Cid().String()
-	if err := s.DB.Model(collections.Collection{}).Where("id = ?", col.ID).UpdateColumn("c_id", collectionNode.Cid().String()).Error; err != nil {
+	invite.ClaimedBy = newUser.ID
+	if err := s.DB.Save(&invite).Error; err != nil {
 		return err
 	}
 
-	ctx := c.Request().Context()
-	makeDeal := false
+	return c.JSON(http.StatusOK, &loginResponse{
+		Token:  authToken.Token,
+		Expiry: authToken.Expiry,
+	})
+}
 
-	pinstatus, err := s.CM.pinContent(ctx, u.ID, collectionNode.Cid(), collectionNode.Cid().String(), nil, origins, 0, nil, makeDeal)
-	if err != nil {
-		return err
-	}
-	return c.JSON(http.StatusOK, pinstatus)
+type loginBody struct {
+	Username string `json:"username"`
+	Password string `json:"passwordHash"`
 }
 
-// handleGetCollectionContents godoc
-// @Summary      Get contents in a collection
-// @Description  This endpoint is used to get contents in a collection. If no colpath query param is passed
-// @Tags         collections
-// @Produce      json
-// @Success      200  {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Param        coluuid  path      string  true   "coluuid"
-// @Param        dir      query     string  false  "Directory"
-// @Router       /collections/{coluuid} [get]
-func (s *Server) handleGetCollectionContents(c echo.Context, u *util.User) error {
-	coluuid := c.Param("coluuid")
+type loginResponse struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
 
-	var col collections.Collection
-	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
+const TOKEN_LABEL_ON_LOGIN = "on-login"
+
+func (s *Server) handleLoginUser(c echo.Context) error {
+	var body loginBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	var user util.User
+	if err := s.DB.First(&user, "username = ?", strings.ToLower(body.Username)).Error; err != nil {
 		if xerrors.Is(err, gorm.ErrRecordNotFound) {
 			return &util.HttpError{
-				Code:    http.StatusNotFound,
-				Reason:  util.ERR_RECORD_NOT_FOUND,
-				Details: fmt.Sprintf("collection: %s was not found", coluuid),
+				Code:    http.StatusForbidden,
+				Reason:  util.ERR_USER_NOT_FOUND,
+				Details: "no such user exist",
 			}
 		}
 		return err
 	}
 
-	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
-		return err
-	}
-
-	// TODO: optimize this a good deal
-	var refs []util.ContentWithPath
-	if err := s.DB.Model(collections.CollectionRef{}).
-		Where("collection = ?", col.ID).
-		Joins("left join contents on contents.id = collection_refs.content").
-		Select("contents.*, collection_refs.path as path").
-		Scan(&refs).Error; err != nil {
-		return err
-	}
+	//	validate password
+	//	SQLlite and Postgres has incompatibility in hashing and even though we are dropping support for sqlite later,
+	//	we still need to accommodate those who chooses to use SQLite for experimentation purposes.
+	var valid = true
+	var dbDialect = s.DB.Config.Dialector.Name()
 
-	queryDir := c.QueryParam(ColDir)
-	if queryDir == "" {
-		return c.JSON(http.StatusOK, refs)
+	//	check password hash (this is the way).
+	if (user.Salt != "" && (user.PassHash != util.GetPasswordHash(body.Password, user.Salt, dbDialect))) || (user.Salt == "" && user.PassHash != body.Password) {
+		valid = false                                                                           //	assume it's not valid.
+		if bcrypt.CompareHashAndPassword([]byte(user.PassHash), []byte(body.Password)) == nil { //	we are using bcrypt, so we need to rehash it.
+			valid = true
+		}
 	}
 
-	// if queryDir is set, do the content listing
-	queryDir = filepath.Clean(queryDir)
-
-	dirs := make(map[string]bool)
-	var out []collectionListResponse
-	for _, r := range refs {
-		if r.Path == "" || r.Name == "" {
-			continue
+	if !valid {
+		return &util.HttpError{
+			Code:   http.StatusForbidden,
+			Reason: util.ERR_INVALID_PASSWORD,
 		}
+	}
 
-		relp, err := getRelativePath(r, queryDir)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, fmt.Errorf("errored while calculating relative contentPath queryDir=%s, contentPath=%s", queryDir, r.Path))
-		}
+	authToken, err := s.newAuthTokenForUser(&user, time.Now().Add(constants.TokenExpiryDurationLogin), nil, TOKEN_LABEL_ON_LOGIN)
+	if err != nil {
+		return err
+	}
 
-		// if the relative contentPath requires pathing up, its definitely not in this queryDir
-		if strings.HasPrefix(relp, "..") {
-			continue
-		}
+	return c.JSON(http.StatusOK, &loginResponse{
+		Token:  authToken.Token,
+		Expiry: authToken.Expiry,
+	})
+}
 
-		if relp == "." { // Query directory is the complete path containing the content.
-			// trying to list a CID queryDir, not allowed
-			if r.Type == util.Directory {
-				return c.JSON(http.StatusBadRequest, fmt.Errorf("listing CID directories is not allowed"))
-			}
+type changePasswordParams struct {
+	NewPassword string `json:"newPasswordHash"`
+}
 
-			out = append(out, collectionListResponse{
-				Name:      r.Name,
-				Size:      r.Size,
-				ContID:    r.ID,
-				Cid:       &util.DbCID{CID: r.Cid.CID},
-				Dir:       queryDir,
-				ColUuid:   coluuid,
-				UpdatedAt: r.UpdatedAt,
-			})
-		} else { // Query directory has a subdirectory, which contains the actual content.
+func (s *Server) handleUserChangePassword(c echo.Context, u *util.User) error {
+	var params changePasswordParams
+	if err := c.Bind(&params); err != nil {
+		return err
+	}
 
-			// if CID is a queryDir, set type as Dir and mark Dir as listed so we don't list it again
-			//if r.Type == util.Directory {
-			//	if !dirs[relp] {
-			//		dirs[relp] = true
-			//		out = append(out, collectionListResponse{
-			//			Name:    relp,
-			//			Type:    Dir,
-			//			Size:    r.Size,
-			//			ContID:  r.ID,
-			//			Cid:     &r.Cid,
-			//			Dir:     queryDir,
-			//			ColUuid: coluuid,
-			//		})
-			//	}
-			//	continue
-			//}
+	salt := uuid.New().String()
 
-			// if relative contentPath has a /, the file is in a subdirectory
-			// print the directory the file is in if we haven't already
-			var subDir string
-			if strings.Contains(relp, "/") {
-				parts := strings.Split(relp, "/")
-				subDir = parts[0]
-			} else {
-				subDir = relp
-			}
-			if !dirs[subDir] {
-				dirs[subDir] = true
-				out = append(out, collectionListResponse{
-					Name:    subDir,
-					Type:    Dir,
-					Dir:     queryDir,
-					ColUuid: coluuid,
-				})
-				continue
-			}
-		}
+	updatedUserColumns := &util.User{
+		Salt:     salt,
+		PassHash: util.GetPasswordHash(params.NewPassword, salt, s.DB.Config.Dialector.Name()),
+	}
 
-		//var contentType CidType
-		//contentType = File
-		//if r.Type == util.Directory {
-		//	contentType = Dir
-		//}
-		//out = append(out, collectionListResponse{
-		//	Name:    r.Name,
-		//	Type:    contentType,
-		//	Size:    r.Size,
-		//	ContID:  r.ID,
-		//	Cid:     &util.DbCID{CID: r.Cid.CID},
-		//	Dir:     queryDir,
-		//	ColUuid: coluuid,
-		//})
+	if err := s.DB.Model(util.User{}).Where("id = ?", u.ID).Updates(updatedUserColumns).Error; err != nil {
+		return err
 	}
-	return c.JSON(http.StatusOK, out)
+
+	return c.JSON(http.StatusOK, map[string]string{})
 }
 
-func getRelativePath(r util.ContentWithPath, queryDir string) (string, error) {
-	contentPath := r.Path
-	relp, err := filepath.Rel(queryDir, contentPath)
-	return relp, err
+type changeAddressParams struct {
+	Address string `json:"address"`
 }
 
-// handleDeleteCollection godoc
-// @Summary      Deletes a collection
-// @Description  This endpoint is used to delete an existing collection.
-// @Tags         collections
-// @Param        coluuid  path  string  true  "Collection ID"
-// @Router       /collections/{coluuid} [delete]
-// @Success      200  {string}  string  ""
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-func (s *Server) handleDeleteCollection(c echo.Context, u *util.User) error {
-	coluuid := c.Param("coluuid")
-
-	var col collections.Collection
-	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
-		if xerrors.Is(err, gorm.ErrRecordNotFound) {
-			return &util.HttpError{
-				Code:    http.StatusNotFound,
-				Reason:  util.ERR_RECORD_NOT_FOUND,
-				Details: fmt.Sprintf("collection with ID(%s) was not found", coluuid),
-			}
-		}
+func (s *Server) handleUserChangeAddress(c echo.Context, u *util.User) error {
+	var params changeAddressParams
+	if err := c.Bind(&params); err != nil {
 		return err
 	}
 
-	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
-		return err
+	addr, err := address.NewFromString(params.Address)
+	if err != nil {
+		log.Warnf("invalid filecoin address in change address request body: %w", err)
+
+		return &util.HttpError{
+			Code:   http.StatusUnauthorized,
+			Reason: "invalid address in request body",
+		}
 	}
 
-	if err := s.DB.Delete(&col).Error; err != nil {
+	if err := s.DB.Model(util.User{}).Where("id = ?", u.ID).Update("address", addr.String()).Error; err != nil {
 		return err
 	}
-	return c.NoContent(http.StatusOK)
+
+	return c.JSON(http.StatusOK, map[string]string{})
 }
 
-type deleteContentFromCollectionBody struct {
-	By    string `json:"by"`
-	Value string `json:"value"`
+type userStatsResponse struct {
+	TotalSize int64 `json:"totalSize"`
+	NumPins   int64 `json:"numPins"`
 }
 
-// handleDeleteContentFromCollection godoc
-// @Summary      Deletes a content from a collection
-// @Description  This endpoint is used to delete an existing content from an existing collection. If two or more files with the same contentid exist in the collection, delete the one in the specified path
-// @Tags         collections
-// @Param        coluuid    path  string                           true  "Collection ID"
-// @Param        contentid  path  string                           true  "Content ID"
-// @Param        body       body  deleteContentFromCollectionBody  true  "Variable to use when filtering for files (must be either 'path' or 'content_id')"
+// handleGetUserStats godoc
+// @Summary      Create API keys for a user
+// @Description  This endpoint is used to create API keys for a user.
+// @Tags         User
 // @Produce      json
 // @Success      200  {object}  string
 // @Failure      400  {object}  util.HttpError
 // @Failure      500  {object}  util.HttpError
-// @Router       /collections/{coluuid}/contents [delete]
-func (s *Server) handleDeleteContentFromCollection(c echo.Context, u *util.User) error {
-	var body deleteContentFromCollectionBody
-	if err := c.Bind(&body); err != nil {
+// @Router       /user/stats [get]
+func (s *Server) handleGetUserStats(c echo.Context, u *util.User) error {
+	var stats userStatsResponse
+	if err := s.DB.Raw(` SELECT
+						(SELECT SUM(size) FROM contents where user_id = ? AND aggregated_in = 0 AND active) as total_size,
+						(SELECT COUNT(1) FROM contents where user_id = ? AND active) as num_pins`,
+		u.ID, u.ID).Scan(&stats).Error; err != nil {
 		return err
 	}
-	coluuid := c.Param("coluuid")
 
-	// check if 'by' is either 'path' or 'content_id'
-	if body.By != "path" && body.By != "content_id" {
-		return &util.HttpError{
-			Code:    http.StatusNotFound,
-			Reason:  util.ERR_INVALID_FILTER,
-			Details: fmt.Sprintf("invalid 'by' value, must be either 'content_id' or 'path', got %s", body.By),
-		}
+	return c.JSON(http.StatusOK, stats)
+}
+
+func (s *Server) newAuthTokenForUser(user *util.User, expiry time.Time, perms []string, label string) (*util.AuthToken, error) {
+	if len(perms) > 1 {
+		return nil, fmt.Errorf("invalid perms")
 	}
 
-	if len(body.Value) == 0 {
-		return &util.HttpError{
-			Code:    http.StatusNotFound,
-			Reason:  util.ERR_VALUE_REQUIRED,
-			Details: fmt.Sprintf("invalid 'value' field, must not be empty"),
+	var uploadOnly bool
+	if len(perms) == 1 {
+		switch perms[0] {
+		case "all":
+			uploadOnly = false
+		case "upload":
+			uploadOnly = true
+		default:
+			return nil, fmt.Errorf("invalid perm: %q", perms[0])
 		}
 	}
 
-	col, err := collections.GetCollection(coluuid, s.DB, u)
+	token := "EST" + uuid.New().String() + "ARY"
+	authToken := &util.AuthToken{
+		Token:      token,
+		TokenHash:  util.GetTokenHash(token),
+		Label:      label,
+		User:       user.ID,
+		Expiry:     expiry,
+		UploadOnly: uploadOnly,
+	}
+	if err := s.DB.Create(authToken).Error; err != nil {
+		return nil, err
+	}
+
+	return authToken, nil
+}
+
+func (s *Server) handleGetViewer(c echo.Context, u *util.User) error {
+	uep, err := s.getPreferredUploadEndpoints(u)
 	if err != nil {
 		return err
 	}
 
-	refs := []collections.CollectionRef{}
-	if body.By == "path" {
-		path := body.Value
-		refs, err = collections.GetContentsInPath(coluuid, path, s.DB, u)
-		if err != nil {
-			return err
-		}
-	} else if body.By == "content_id" {
-		contentid := body.Value
-		content, err := util.GetContent(contentid, s.DB, u)
-		if err != nil {
-			return err
-		}
-		if err := s.DB.Model(collections.CollectionRef{}).
-			Where("collection = ?", col.ID).
-			Where("content = ?", content.ID).
-			Scan(&refs).Error; err != nil {
-			return err
-		}
+	return c.JSON(http.StatusOK, &util.ViewerResponse{
+		ID:       u.ID,
+		Username: u.Username,
+		Perms:    u.Perm,
+		Address:  u.Address.Addr.String(),
+		Miners:   s.getMinersOwnedByUser(u),
+		Settings: util.UserSettings{
+			Replication:           s.CM.Replication,
+			Verified:              s.cfg.Deal.IsVerified,
+			DealDuration:          s.cfg.Deal.Duration,
+			MaxStagingWait:        s.cfg.StagingBucket.MaxLifeTime,
+			FileStagingThreshold:  s.cfg.StagingBucket.IndividualDealThreshold,
+			ContentAddingDisabled: s.isContentAddingDisabled(u),
+			DealMakingDisabled:    s.CM.dealMakingDisabled(),
+			UploadEndpoints:       uep,
+			Flags:                 u.Flags,
+		},
+		AuthExpiry: u.AuthToken.Expiry,
+	})
+}
+
+func (s *Server) getMinersOwnedByUser(u *util.User) []string {
+	var miners []storageMiner
+	if err := s.DB.Find(&miners, "owner = ?", u.ID).Error; err != nil {
+		log.Errorf("failed to query miners for user %d: %s", u.ID, err)
+		return nil
 	}
 
-	// delete found refs
-	if err := s.DB.Delete(&refs).Error; err != nil {
-		return err
+	var out []string
+	for _, m := range miners {
+		out = append(out, m.Address.Addr.String())
 	}
-	return c.NoContent(http.StatusOK)
-}
 
-func (s *Server) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
+	return out
+}
 
-		r := c.Request()
+func (s *Server) getPreferredUploadEndpoints(u *util.User) ([]string, error) {
 
-		attrs := []attribute.KeyValue{
-			semconv.HTTPMethodKey.String(r.Method),
-			semconv.HTTPRouteKey.String(r.URL.Path),
-			semconv.HTTPClientIPKey.String(r.RemoteAddr),
-			semconv.HTTPRequestContentLengthKey.Int64(c.Request().ContentLength),
+	// TODO: this should be a lotttttt smarter
+	s.CM.shuttlesLk.Lock()
+	defer s.CM.shuttlesLk.Unlock()
+	var shuttles []Shuttle
+	for hnd, sh := range s.CM.shuttles {
+		if sh.ContentAddingDisabled {
+			log.Debugf("shuttle %+v content adding is disabled", sh)
+			continue
 		}
 
-		if reqid := r.Header.Get("EstClientReqID"); reqid != "" {
-			if len(reqid) > 64 {
-				reqid = reqid[:64]
-			}
-			attrs = append(attrs, attribute.String("ClientReqID", reqid))
+		if sh.retrievalOnly {
+			log.Debugf("shuttle %+v is retrieval only", sh)
+			continue
 		}
 
-		tctx, span := s.tracer.Start(context.Background(),
-			"HTTP "+r.Method+" "+c.Path(),
-			trace.WithAttributes(attrs...),
-		)
-		defer span.End()
+		if sh.hostname == "" {
+			log.Debugf("shuttle %+v has empty hostname", sh)
+			continue
+		}
 
-		r = r.WithContext(tctx)
-		c.SetRequest(r)
+		var shuttle Shuttle
+		if err := s.DB.First(&shuttle, "handle = ?", hnd).Error; err != nil {
+			log.Errorf("failed to look up shuttle by handle: %s", err)
+			continue
+		}
 
-		err := next(c)
-		if err != nil {
-			span.SetStatus(codes.Error, err.Error())
-			span.RecordError(err)
-		} else {
-			span.SetStatus(codes.Ok, "")
+		if !shuttle.Open {
+			log.Debugf("shuttle %+v is not open, skipping", shuttle)
+			continue
 		}
 
-		span.SetAttributes(
-			semconv.HTTPStatusCodeKey.Int(c.Response().Status),
-			semconv.HTTPResponseContentLengthKey.Int64(c.Response().Size),
-		)
+		shuttles = append(shuttles, shuttle)
+	}
 
-		return err
+	sort.Slice(shuttles, func(i, j int) bool {
+		return shuttles[i].Priority > shuttles[j].Priority
+	})
+
+	var out []string
+	for _, sh := range shuttles {
+		host := "https://" + sh.Host
+		if strings.HasPrefix(sh.Host, "http://") || strings.HasPrefix(sh.Host, "https://") {
+			host = sh.Host
+		}
+		out = append(out, host+"/content/add")
 	}
+	if !s.CM.localContentAddingDisabled {
+		out = append(out, s.CM.hostname+"/content/add")
+	}
+
+	return out, nil
 }
 
-type adminUserResponse struct {
-	Id       uint   `json:"id"`
-	Username string `json:"username"`
+func (s *Server) handleHealth(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{
+		"status": "ok",
+	})
+}
 
-	SpaceUsed int `json:"spaceUsed"`
-	NumFiles  int `json:"numFiles"`
+type getApiKeysResp struct {
+	Token     string    `json:"token"`
+	TokenHash string    `json:"tokenHash"`
+	Label     string    `json:"label"`
+	Expiry    time.Time `json:"expiry"`
 }
 
-// handleAdminGetUsers godoc
-// @Summary      Get all users
-// @Description  This endpoint is used to get all users.
-// @Tags         admin
+// handleUserRevokeApiKey godoc
+// @Summary      Revoke a User API Key.
+// @Description  This endpoint is used to revoke a user API key. In estuary, every user is assigned with an API key, this API key is generated and issued for each user and is primarily used to access all estuary features. This endpoint can be used to revoke the API key that's assigned to the user. Revoked API keys are completely deleted and are not recoverable.
+// @Tags         User
 // @Produce      json
 // @Success      200  {object}  string
 // @Failure      400  {object}  util.HttpError
 // @Failure      500  {object}  util.HttpError
-// @Router       /admin/users [get]
-func (s *Server) handleAdminGetUsers(c echo.Context) error {
-	var resp []adminUserResponse
-	if err := s.DB.Model(util.Content{}).
-		Select("user_id as id,(?) as username,SUM(size) as space_used,count(*) as num_files", s.DB.Model(&util.User{}).Select("username").Where("id = user_id")).
-		Group("user_id").Scan(&resp).Error; err != nil {
+// @Param        key_or_hash path string true "Key or Hash"
+// @Router       /user/api-keys/{key_or_hash} [delete]
+func (s *Server) handleUserRevokeApiKey(c echo.Context, u *util.User) error {
+	kval := c.Param("key_or_hash")
+	if err := s.DB.Delete(&util.AuthToken{}, "\"user\" = ? AND (token = ? OR token_hash = ?)", u.ID, kval, kval).Error; err != nil {
 		return err
 	}
 
-	sort.Slice(resp, func(i, j int) bool {
-		return resp[i].Id < resp[j].Id
-	})
-
-	return c.JSON(http.StatusOK, resp)
-}
-
-type publicStatsResponse struct {
-	TotalStorage       sql.NullInt64 `json:"totalStorage"`
-	TotalFilesStored   sql.NullInt64 `json:"totalFiles"`
-	DealsOnChain       sql.NullInt64 `json:"dealsOnChain"`
-	TotalObjectsRef    sql.NullInt64 `json:"totalObjectsRef"`
-	TotalBytesUploaded sql.NullInt64 `json:"totalBytesUploaded"`
-	TotalUsers         sql.NullInt64 `json:"totalUsers"`
-	TotalStorageMiner  sql.NullInt64 `json:"totalStorageMiners"`
+	return c.NoContent(200)
 }
 
-// handlePublicStats godoc
-// @Summary      Public stats
-// @Description  This endpoint is used to get public stats.
-// @Tags         public
+// handleUserCreateApiKey godoc
+// @Summary      Create API keys for a user
+// @Description  This endpoint is used to create API keys for a user. In estuary, each user is given an API key to access all features.
+// @Tags         User
 // @Produce      json
-// @Success      200  {object}  string
+// @Param        expiry  query     string  false  "Expiration - Expiration - Valid time units are ns, us (or µs),  ms,  s,  m,  h.  for  example  300h"
+// @Param        perms   query     string  false  "Permissions -- currently unused"
+// @Success      200     {object}  getApiKeysResp
 // @Failure      400  {object}  util.HttpError
+// @Failure      404     {object}  util.HttpError
 // @Failure      500  {object}  util.HttpError
-// @Router       /public/stats [get]
-func (s *Server) handlePublicStats(c echo.Context) error {
-	val, err := s.cacher.Get("public/stats", time.Minute*2, func() (interface{}, error) {
-		return s.computePublicStats()
-	})
-	if err != nil {
-		return err
+// @Router       /user/api-keys [post]
+func (s *Server) handleUserCreateApiKey(c echo.Context, u *util.User) error {
+	expiry := time.Now().Add(constants.TokenExpiryDurationDefault)
+	if exp := c.QueryParam("expiry"); exp != "" {
+		if exp == "false" {
+			expiry = time.Now().Add(constants.TokenExpiryDurationPermanent)
+		} else {
+			dur, err := time.ParseDuration(exp)
+			if err != nil {
+				return err
+			}
+			expiry = time.Now().Add(dur)
+		}
 	}
 
-	//	handle the extensive looks up differently. Cache them for 1 hour.
-	valExt, err := s.cacher.Get("public/stats/ext", time.Minute*60, func() (interface{}, error) {
-		return s.computePublicStatsWithExtensiveLookups()
-	})
+	var perms []string
+	if p := c.QueryParam("perms"); p != "" {
+		perms = strings.Split(p, ",")
+	}
 
-	// reuse the original stats and add the ones from the extensive lookup function.
-	val.(*publicStatsResponse).TotalObjectsRef = valExt.(*publicStatsResponse).TotalObjectsRef
-	val.(*publicStatsResponse).TotalBytesUploaded = valExt.(*publicStatsResponse).TotalBytesUploaded
-	val.(*publicStatsResponse).TotalUsers = valExt.(*publicStatsResponse).TotalUsers
-	val.(*publicStatsResponse).TotalStorageMiner = valExt.(*publicStatsResponse).TotalStorageMiner
+	label := c.QueryParam("label")
 
+	authToken, err := s.newAuthTokenForUser(u, expiry, perms, label)
 	if err != nil {
 		return err
 	}
 
-	jsonResponse := map[string]interface{}{
-		"totalStorage":       val.(*publicStatsResponse).TotalStorage.Int64,
-		"totalFilesStored":   val.(*publicStatsResponse).TotalFilesStored.Int64,
-		"dealsOnChain":       val.(*publicStatsResponse).DealsOnChain.Int64,
-		"totalObjectsRef":    val.(*publicStatsResponse).TotalObjectsRef.Int64,
-		"totalBytesUploaded": val.(*publicStatsResponse).TotalBytesUploaded.Int64,
-		"totalUsers":         val.(*publicStatsResponse).TotalUsers.Int64,
-		"totalStorageMiner":  val.(*publicStatsResponse).TotalStorageMiner.Int64,
-	}
-
-	return c.JSON(http.StatusOK, jsonResponse)
+	return c.JSON(http.StatusOK, &getApiKeysResp{
+		Token:     authToken.Token,
+		TokenHash: authToken.TokenHash,
+		Label:     authToken.Label,
+		Expiry:    authToken.Expiry,
+	})
 }
 
-func (s *Server) computePublicStats() (*publicStatsResponse, error) {
-	var stats publicStatsResponse
-	if err := s.DB.Model(util.Content{}).Where("active and not aggregated_in > 0").Select("SUM(size) as total_storage").Scan(&stats).Error; err != nil {
-		return nil, err
-	}
-
-	if err := s.DB.Model(util.Content{}).Where("active and not aggregate").Count(&stats.TotalFilesStored.Int64).Error; err != nil {
-		return nil, err
+// handleUserGetApiKeys godoc
+// @Summary      Get API keys for a user
+// @Description  This endpoint is used to get API keys for a user. In estuary, each user can be given multiple API keys (tokens). This endpoint can be used to retrieve all available API keys for a given user.
+// @Tags         User
+// @Produce      json
+// @Success      200  {array}   []getApiKeysResp
+// @Failure      400  {object}  util.HttpError
+// @Failure      404   {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /user/api-keys [get]
+func (s *Server) handleUserGetApiKeys(c echo.Context, u *util.User) error {
+	var keys []util.AuthToken
+	if err := s.DB.Find(&keys, "auth_tokens.user = ?", u.ID).Error; err != nil {
+		return err
 	}
 
-	if err := s.DB.Model(contentDeal{}).Where("not failed and deal_id > 0").Count(&stats.DealsOnChain.Int64).Error; err != nil {
-		return nil, err
+	out := []getApiKeysResp{}
+	for _, k := range keys {
+		out = append(out, getApiKeysResp{
+			Token:     k.Token,
+			TokenHash: k.TokenHash,
+			Label:     k.Label,
+			Expiry:    k.Expiry,
+		})
 	}
 
-	return &stats, nil
+	return c.JSON(http.StatusOK, out)
 }
 
-func (s *Server) computePublicStatsWithExtensiveLookups() (*publicStatsResponse, error) {
-	var stats publicStatsResponse
-
-	//	this can be resource expensive but we are already caching it.
-	if err := s.DB.Table("obj_refs").Count(&stats.TotalObjectsRef.Int64).Error; err != nil {
-		return nil, err
-	}
+type createCollectionBody struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
 
-	if err := s.DB.Table("objects").Select("SUM(size)").Find(&stats.TotalBytesUploaded.Int64).Error; err != nil {
-		return nil, err
+// handleCreateCollection godoc
+// @Summary      Create a new collection
+// @Description  This endpoint is used to create a new collection. A collection is a representaion of a group of objects added on the estuary. This endpoint can be used to create a new collection.
+// @Tags         collections
+// @Produce      json
+// @Param        body  body      createCollectionBody  true  "Collection name and description"
+// @Success      200   {object}  collections.Collection
+// @Failure      400  {object}  util.HttpError
+// @Failure      404  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /collections/ [post]
+func (s *Server) handleCreateCollection(c echo.Context, u *util.User) error {
+	var body createCollectionBody
+	if err := c.Bind(&body); err != nil {
+		return err
 	}
 
-	if err := s.DB.Model(util.User{}).Count(&stats.TotalUsers.Int64).Error; err != nil {
-		return nil, err
+	col := &collections.Collection{
+		UUID:        uuid.New().String(),
+		Name:        body.Name,
+		Description: body.Description,
+		UserID:      u.ID,
 	}
 
-	if err := s.DB.Table("storage_miners").Count(&stats.TotalStorageMiner.Int64).Error; err != nil {
-		return nil, err
+	if err := s.DB.Create(col).Error; err != nil {
+		return err
 	}
 
-	return &stats, nil
-}
-
-func (s *Server) handleGetBucketDiag(c echo.Context) error {
-	return c.JSON(http.StatusOK, s.CM.getStagingZoneSnapshot(c.Request().Context()))
-}
-
-// handleGetStagingZoneForUser godoc
-// @Summary      Get staging zone for user
-// @Description  This endpoint is used to get staging zone for user.
-// @Tags         content
-// @Produce      json
-// @Success      200  {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /content/staging-zones [get]
-func (s *Server) handleGetStagingZoneForUser(c echo.Context, u *util.User) error {
-	return c.JSON(http.StatusOK, s.CM.getStagingZonesForUser(c.Request().Context(), u.ID))
+	return c.JSON(http.StatusOK, col)
 }
 
-// handleUserExportData godoc
-// @Summary      Export user data
-// @Description  This endpoint is used to get API keys for a user.
-// @Tags         User
+// handleListCollections godoc
+// @Summary      List all collections
+// @Description  This endpoint is used to list all collections. Whenever a user logs on estuary, it will list all collections that the user has access to. This endpoint provides a way to list all collections to the user.
+// @Tags         collections
 // @Produce      json
-// @Success      200  {object}  string
+// @Success      200  {array}   []collections.Collection
 // @Failure      400  {object}  util.HttpError
+// @Failure      404  {object}  util.HttpError
 // @Failure      500  {object}  util.HttpError
-// @Router       /user/export [get]
-func (s *Server) handleUserExportData(c echo.Context, u *util.User) error {
-	export, err := s.exportUserData(u.ID)
-	if err != nil {
+// @Router       /collections/ [get]
+func (s *Server) handleListCollections(c echo.Context, u *util.User) error {
+	var cols []collections.Collection
+	if err := s.DB.Find(&cols, "user_id = ?", u.ID).Error; err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, export)
+	return c.JSON(http.StatusOK, cols)
 }
 
-// handleNetPeers godoc
-// @Summary      Net Peers
-// @Description  This endpoint is used to get net peers
-// @Tags         public,net
-// @Produce      json
-// @Success      200  {array}   string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /public/net/peers [get]
-func (s *Server) handleNetPeers(c echo.Context) error {
-	return c.JSON(http.StatusOK, s.Node.Host.Network().Peers())
+type addContentsToCollectionBody struct {
+	ContentIDs []uint `json:"contentids"`
 }
 
-// handleNetAddrs godoc
-// @Summary      Net Addrs
-// @Description  This endpoint is used to get net addrs
-// @Tags         public,net
+// handleAddContentsToCollection godoc
+// @Summary      Add contents to a collection
+// @Description  This endpoint adds already-pinned contents (that have ContentIDs) to a collection.
+// @Tags         collections
+// @Accept       json
 // @Produce      json
-// @Success      200  {array}  string
-// @Router       /public/net/addrs [get]
-func (s *Server) handleNetAddrs(c echo.Context) error {
-	id := s.Node.Host.ID()
-	addrs := s.Node.Host.Addrs()
+// @Param        coluuid     path      string  true  "Collection UUID"
+// @Param        contentIDs  body      []uint  true  "Content IDs to add to collection"
+// @Success      200         {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /collections/{coluuid} [post]
+func (s *Server) handleAddContentsToCollection(c echo.Context, u *util.User) error {
+	coluuid := c.Param("coluuid")
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"id":        id,
-		"addresses": addrs,
-	})
-}
+	// we accept both {"contentids": [1, 2]} and [1, 2] as json payloads
+	var body addContentsToCollectionBody // {"contentids": [1, 2]}
+	var contentIDs []uint                // [1, 2]
 
-type dealMetricsInfo struct {
-	Time              time.Time `json:"time"`
-	DealsOnChain      int       `json:"dealsOnChain"`
-	DealsOnChainBytes int64     `json:"dealsOnChainBytes"`
+	// Save the body of the request so that we can try to unmarshal it twice (if first bind fails)
+	// We can't simply c.Bind() because that reads directly from the socket
+	// And so if we try c.Bind()ing twice, the second call will just return EOF
+	bodyBytes, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal([]byte(bodyBytes), &contentIDs); err != nil {
+		// Failed to bind to [1, 10] payload, try {"contentids": [1, 10]}
+		if err = json.Unmarshal([]byte(bodyBytes), &body); err != nil {
+			return err
+		}
+		contentIDs = body.ContentIDs
+	}
+
+	// no contents
+	if len(contentIDs) == 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("no contents specified, need at least one"),
+		}
+	}
+
+	if len(contentIDs) > 128 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("too many contents specified: %d (max 128)", len(contentIDs)),
+		}
+	}
+
+	var col collections.Collection
+	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("collection: %s was not found", coluuid),
+			}
+		}
+		return err
+	}
+
+	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+		return err
+	}
+
+	var contents []util.Content
+	if err := s.DB.Find(&contents, "id in ? and user_id = ?", contentIDs, u.ID).Error; err != nil {
+		return err
+	}
+
+	if len(contents) != len(contentIDs) {
+		return fmt.Errorf("%d specified content(s) were not found or user missing permissions", len(contentIDs)-len(contents))
+	}
+
+	defaultPath := "/"
+	var colrefs []collections.CollectionRef
+	for _, cont := range contents {
+		colrefs = append(colrefs, collections.CollectionRef{
+			Collection: col.ID,
+			Content:    cont.ID,
+			Path:       &defaultPath,
+		})
+	}
+
+	if err := s.DB.Create(colrefs).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
+// handleCommitCollection godoc
+// @Summary      Produce a CID of the collection contents
+// @Description  This endpoint is used to save the contents in a collection, producing a top-level CID that references all the current CIDs in the collection.
+// @Param        coluuid  path  string  true  "coluuid"
+// @Tags         collections
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /collections/{coluuid}/commit [post]
+func (s *Server) handleCommitCollection(c echo.Context, u *util.User) error {
+	colid := c.Param("coluuid")
+
+	var col collections.Collection
+	if err := s.DB.First(&col, "uuid = ?", colid).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("collection: %s was not found", colid),
+			}
+		}
+		return err
+	}
+
+	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+		return err
+	}
+
+	contents := []util.ContentWithPath{}
+	if err := s.DB.Model(collections.CollectionRef{}).
+		Where("collection = ?", col.ID).
+		Joins("left join contents on contents.id = collection_refs.content").
+		Select("contents.*, collection_refs.path").
+		Scan(&contents).Error; err != nil {
+		return err
+	}
+
+	// transform listen addresses (/ip/1.2.3.4/tcp/80) into full p2p multiaddresses
+	// e.g. /ip/1.2.3.4/tcp/80/p2p/12D3KooWCVTKbuvrZ9ton6zma5LNhCEeZyuFtxcDzDTmWh2qPtWM
+	fullP2pMultiAddrs := []multiaddr.Multiaddr{}
+	for _, listenAddr := range s.Node.Host.Addrs() {
+		fullP2pAddr := fmt.Sprintf("%s/p2p/%s", listenAddr, s.Node.Host.ID())
+		fullP2pMultiAddr, err := multiaddr.NewMultiaddr(fullP2pAddr)
+		if err != nil {
+			return err
+		}
+		fullP2pMultiAddrs = append(fullP2pMultiAddrs, fullP2pMultiAddr)
+	}
+
+	// transform multiaddresses into AddrInfo objects
+	var origins []*peer.AddrInfo
+	for _, p := range fullP2pMultiAddrs {
+		ai, err := peer.AddrInfoFromP2pAddr(p)
+		if err != nil {
+			return err
+		}
+		origins = append(origins, ai)
+	}
+
+	bserv := blockservice.New(s.Node.Blockstore, nil)
+	dserv := merkledag.NewDAGService(bserv)
+
+	// create DAG respecting directory structure
+	collectionNode := unixfs.EmptyDirNode()
+	for _, c := range contents {
+		dirs, err := util.DirsFromPath(c.Path, c.Name)
+		if err != nil {
+			return err
+		}
+
+		lastDirNode, err := util.EnsurePathIsLinked(dirs, collectionNode, dserv)
+		if err != nil {
+			return err
+		}
+		err = lastDirNode.AddRawLink(c.Name, &ipld.Link{
+			Size: uint64(c.Size),
+			Cid:  c.Cid.CID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := dserv.Add(context.Background(), collectionNode); err != nil {
+		return err
+	} // add new CID to local blockstore
+
+	// update DB with new collection CID
+	col.CID = collectionNode.Cid().String()
+	if err := s.DB.Model(collections.Collection{}).Where("id = ?", col.ID).UpdateColumn("c_id", collectionNode.Cid().String()).Error; err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	makeDeal := false
+
+	pinstatus, err := s.CM.pinContent(ctx, u.ID, collectionNode.Cid(), collectionNode.Cid().String(), nil, origins, 0, nil, makeDeal)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, pinstatus)
+}
+
+// handleGetCollectionContents godoc
+// @Summary      Get contents in a collection
+// @Description  This endpoint is used to get contents in a collection. If no colpath query param is passed
+// @Tags         collections
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Param        coluuid  path      string  true   "coluuid"
+// @Param        dir      query     string  false  "Directory"
+// @Router       /collections/{coluuid} [get]
+func (s *Server) handleGetCollectionContents(c echo.Context, u *util.User) error {
+	coluuid := c.Param("coluuid")
+
+	var col collections.Collection
+	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("collection: %s was not found", coluuid),
+			}
+		}
+		return err
+	}
+
+	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+		return err
+	}
+
+	// TODO: optimize this a good deal
+	var refs []util.ContentWithPath
+	if err := s.DB.Model(collections.CollectionRef{}).
+		Where("collection = ?", col.ID).
+		Joins("left join contents on contents.id = collection_refs.content").
+		Select("contents.*, collection_refs.path as path").
+		Scan(&refs).Error; err != nil {
+		return err
+	}
+
+	queryDir := c.QueryParam(ColDir)
+	if queryDir == "" {
+		return c.JSON(http.StatusOK, refs)
+	}
+
+	// if queryDir is set, do the content listing
+	queryDir = filepath.Clean(queryDir)
+
+	dirs := make(map[string]bool)
+	var out []collectionListResponse
+	for _, r := range refs {
+		if r.Path == "" || r.Name == "" {
+			continue
+		}
+
+		relp, err := getRelativePath(r, queryDir)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, fmt.Errorf("errored while calculating relative contentPath queryDir=%s, contentPath=%s", queryDir, r.Path))
+		}
+
+		// if the relative contentPath requires pathing up, its definitely not in this queryDir
+		if strings.HasPrefix(relp, "..") {
+			continue
+		}
+
+		if relp == "." { // Query directory is the complete path containing the content.
+			// trying to list a CID queryDir, not allowed
+			if r.Type == util.Directory {
+				return c.JSON(http.StatusBadRequest, fmt.Errorf("listing CID directories is not allowed"))
+			}
+
+			out = append(out, collectionListResponse{
+				Name:      r.Name,
+				Size:      r.Size,
+				ContID:    r.ID,
+				Cid:       &util.DbCID{CID: r.Cid.CID},
+				Dir:       queryDir,
+				ColUuid:   coluuid,
+				UpdatedAt: r.UpdatedAt,
+			})
+		} else { // Query directory has a subdirectory, which contains the actual content.
+
+			// if CID is a queryDir, set type as Dir and mark Dir as listed so we don't list it again
+			//if r.Type == util.Directory {
+			//	if !dirs[relp] {
+			//		dirs[relp] = true
+			//		out = append(out, collectionListResponse{
+			//			Name:    relp,
+			//			Type:    Dir,
+			//			Size:    r.Size,
+			//			ContID:  r.ID,
+			//			Cid:     &r.Cid,
+			//			Dir:     queryDir,
+			//			ColUuid: coluuid,
+			//		})
+			//	}
+			//	continue
+			//}
+
+			// if relative contentPath has a /, the file is in a subdirectory
+			// print the directory the file is in if we haven't already
+			var subDir string
+			if strings.Contains(relp, "/") {
+				parts := strings.Split(relp, "/")
+				subDir = parts[0]
+			} else {
+				subDir = relp
+			}
+			if !dirs[subDir] {
+				dirs[subDir] = true
+				out = append(out, collectionListResponse{
+					Name:    subDir,
+					Type:    Dir,
+					Dir:     queryDir,
+					ColUuid: coluuid,
+				})
+				continue
+			}
+		}
+
+		//var contentType CidType
+		//contentType = File
+		//if r.Type == util.Directory {
+		//	contentType = Dir
+		//}
+		//out = append(out, collectionListResponse{
+		//	Name:    r.Name,
+		//	Type:    contentType,
+		//	Size:    r.Size,
+		//	ContID:  r.ID,
+		//	Cid:     &util.DbCID{CID: r.Cid.CID},
+		//	Dir:     queryDir,
+		//	ColUuid: coluuid,
+		//})
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func getRelativePath(r util.ContentWithPath, queryDir string) (string, error) {
+	contentPath := r.Path
+	relp, err := filepath.Rel(queryDir, contentPath)
+	return relp, err
+}
+
+// handleDeleteCollection godoc
+// @Summary      Deletes a collection
+// @Description  This endpoint is used to delete an existing collection.
+// @Tags         collections
+// @Param        coluuid  path  string  true  "Collection ID"
+// @Router       /collections/{coluuid} [delete]
+// @Success      200  {string}  string  ""
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+func (s *Server) handleDeleteCollection(c echo.Context, u *util.User) error {
+	coluuid := c.Param("coluuid")
+
+	var col collections.Collection
+	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("collection with ID(%s) was not found", coluuid),
+			}
+		}
+		return err
+	}
+
+	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+		return err
+	}
+
+	if err := s.DB.Delete(&col).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+type deleteContentFromCollectionBody struct {
+	By    string `json:"by"`
+	Value string `json:"value"`
+}
+
+// handleDeleteContentFromCollection godoc
+// @Summary      Deletes a content from a collection
+// @Description  This endpoint is used to delete an existing content from an existing collection. If two or more files with the same contentid exist in the collection, delete the one in the specified path
+// @Tags         collections
+// @Param        coluuid    path  string                           true  "Collection ID"
+// @Param        contentid  path  string                           true  "Content ID"
+// @Param        body       body  deleteContentFromCollectionBody  true  "Variable to use when filtering for files (must be either 'path' or 'content_id')"
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /collections/{coluuid}/contents [delete]
+func (s *Server) handleDeleteContentFromCollection(c echo.Context, u *util.User) error {
+	var body deleteContentFromCollectionBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	coluuid := c.Param("coluuid")
+
+	// check if 'by' is either 'path' or 'content_id'
+	if body.By != "path" && body.By != "content_id" {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_FILTER,
+			Details: fmt.Sprintf("invalid 'by' value, must be either 'content_id' or 'path', got %s", body.By),
+		}
+	}
+
+	if len(body.Value) == 0 {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_VALUE_REQUIRED,
+			Details: fmt.Sprintf("invalid 'value' field, must not be empty"),
+		}
+	}
+
+	col, err := collections.GetCollection(coluuid, s.DB, u)
+	if err != nil {
+		return err
+	}
+
+	refs := []collections.CollectionRef{}
+	if body.By == "path" {
+		path := body.Value
+		refs, err = collections.GetContentsInPath(coluuid, path, s.DB, u)
+		if err != nil {
+			return err
+		}
+	} else if body.By == "content_id" {
+		contentid := body.Value
+		content, err := util.GetContent(contentid, s.DB, u)
+		if err != nil {
+			return err
+		}
+		if err := s.DB.Model(collections.CollectionRef{}).
+			Where("collection = ?", col.ID).
+			Where("content = ?", content.ID).
+			Scan(&refs).Error; err != nil {
+			return err
+		}
+	}
+
+	// delete found refs
+	if err := s.DB.Delete(&refs).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		r := c.Request()
+
+		attrs := []attribute.KeyValue{
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPRouteKey.String(r.URL.Path),
+			semconv.HTTPClientIPKey.String(r.RemoteAddr),
+			semconv.HTTPRequestContentLengthKey.Int64(c.Request().ContentLength),
+		}
+
+		if reqid := r.Header.Get("EstClientReqID"); reqid != "" {
+			if len(reqid) > 64 {
+				reqid = reqid[:64]
+			}
+			attrs = append(attrs, attribute.String("ClientReqID", reqid))
+		}
+
+		tctx, span := s.tracer.Start(context.Background(),
+			"HTTP "+r.Method+" "+c.Path(),
+			trace.WithAttributes(attrs...),
+		)
+		defer span.End()
+
+		r = r.WithContext(tctx)
+		c.SetRequest(r)
+
+		err := next(c)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			span.RecordError(err)
+		} else {
+			span.SetStatus(codes.Ok, "")
+		}
+
+		span.SetAttributes(
+			semconv.HTTPStatusCodeKey.Int(c.Response().Status),
+			semconv.HTTPResponseContentLengthKey.Int64(c.Response().Size),
+		)
+
+		return err
+	}
+}
+
+type adminUserResponse struct {
+	Id       uint   `json:"id"`
+	Username string `json:"username"`
+
+	SpaceUsed int `json:"spaceUsed"`
+	NumFiles  int `json:"numFiles"`
+}
+
+// handleAdminGetUsers godoc
+// @Summary      Get all users
+// @Description  This endpoint is used to get all users.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/users [get]
+func (s *Server) handleAdminGetUsers(c echo.Context) error {
+	var resp []adminUserResponse
+	if err := s.DB.Model(util.Content{}).
+		Select("user_id as id,(?) as username,SUM(size) as space_used,count(*) as num_files", s.DB.Model(&util.User{}).Select("username").Where("id = user_id")).
+		Group("user_id").Scan(&resp).Error; err != nil {
+		return err
+	}
+
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].Id < resp[j].Id
+	})
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+type userStagingZoneSizeBody struct {
+	Tier    string `json:"tier"`
+	MinSize int64  `json:"minSize"`
+	MaxSize int64  `json:"maxSize"`
+}
+
+// handleSetUserStagingZoneSize assigns a user to a staging zone tier or gives
+// it its own staging zone sizes, an empty body removes the override. Only the
+// staging zones opened afterwards use the new sizes.
+func (s *Server) handleSetUserStagingZoneSize(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	var body userStagingZoneSizeBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	var user util.User
+	if err := s.DB.First(&user, "id = ?", userID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("user %d was not found", userID),
+			}
+		}
+		return err
+	}
+
+	if body.Tier == "" && body.MinSize == 0 && body.MaxSize == 0 {
+		if err := s.DB.Delete(&userStagingZoneSize{}, "user_id = ?", user.ID).Error; err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]string{})
+	}
+
+	if body.Tier != "" {
+		if body.MinSize != 0 || body.MaxSize != 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "either a tier or sizes can be set, not both",
+			}
+		}
+
+		if _, ok := s.cfg.StagingBucket.Tiers[body.Tier]; !ok {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("unknown staging zone tier %q", body.Tier),
+			}
+		}
+	} else {
+		if err := (config.StagingZoneSize{MinSize: body.MinSize, MaxSize: body.MaxSize}).Validate(); err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+	}
+
+	if err := s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"tier", "min_size", "max_size"}),
+	}).Create(&userStagingZoneSize{
+		UserID:  user.ID,
+		Tier:    body.Tier,
+		MinSize: body.MinSize,
+		MaxSize: body.MaxSize,
+	}).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
+type publicStatsResponse struct {
+	TotalStorage       sql.NullInt64 `json:"totalStorage"`
+	TotalFilesStored   sql.NullInt64 `json:"totalFiles"`
+	DealsOnChain       sql.NullInt64 `json:"dealsOnChain"`
+	TotalObjectsRef    sql.NullInt64 `json:"totalObjectsRef"`
+	TotalBytesUploaded sql.NullInt64 `json:"totalBytesUploaded"`
+	TotalUsers         sql.NullInt64 `json:"totalUsers"`
+	TotalStorageMiner  sql.NullInt64 `json:"totalStorageMiners"`
+}
+
+// handlePublicStats godoc
+// @Summary      Public stats
+// @Description  This endpoint is used to get public stats.
+// @Tags         public
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /public/stats [get]
+func (s *Server) handlePublicStats(c echo.Context) error {
+	val, err := s.cacher.Get("public/stats", time.Minute*2, func() (interface{}, error) {
+		return s.computePublicStats()
+	})
+	if err != nil {
+		return err
+	}
+
+	//	handle the extensive looks up differently. Cache them for 1 hour.
+	valExt, err := s.cacher.Get("public/stats/ext", time.Minute*60, func() (interface{}, error) {
+		return s.computePublicStatsWithExtensiveLookups()
+	})
+
+	// reuse the original stats and add the ones from the extensive lookup function.
+	val.(*publicStatsResponse).TotalObjectsRef = valExt.(*publicStatsResponse).TotalObjectsRef
+	val.(*publicStatsResponse).TotalBytesUploaded = valExt.(*publicStatsResponse).TotalBytesUploaded
+	val.(*publicStatsResponse).TotalUsers = valExt.(*publicStatsResponse).TotalUsers
+	val.(*publicStatsResponse).TotalStorageMiner = valExt.(*publicStatsResponse).TotalStorageMiner
+
+	if err != nil {
+		return err
+	}
+
+	jsonResponse := map[string]interface{}{
+		"totalStorage":       val.(*publicStatsResponse).TotalStorage.Int64,
+		"totalFilesStored":   val.(*publicStatsResponse).TotalFilesStored.Int64,
+		"dealsOnChain":       val.(*publicStatsResponse).DealsOnChain.Int64,
+		"totalObjectsRef":    val.(*publicStatsResponse).TotalObjectsRef.Int64,
+		"totalBytesUploaded": val.(*publicStatsResponse).TotalBytesUploaded.Int64,
+		"totalUsers":         val.(*publicStatsResponse).TotalUsers.Int64,
+		"totalStorageMiner":  val.(*publicStatsResponse).TotalStorageMiner.Int64,
+	}
+
+	return c.JSON(http.StatusOK, jsonResponse)
+}
+
+func (s *Server) computePublicStats() (*publicStatsResponse, error) {
+	var stats publicStatsResponse
+	if err := s.DB.Model(util.Content{}).Where("active and not aggregated_in > 0").Select("SUM(size) as total_storage").Scan(&stats).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.DB.Model(util.Content{}).Where("active and not aggregate").Count(&stats.TotalFilesStored.Int64).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.DB.Model(contentDeal{}).Where("not failed and deal_id > 0").Count(&stats.DealsOnChain.Int64).Error; err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func (s *Server) computePublicStatsWithExtensiveLookups() (*publicStatsResponse, error) {
+	var stats publicStatsResponse
+
+	//	this can be resource expensive but we are already caching it.
+	if err := s.DB.Table("obj_refs").Count(&stats.TotalObjectsRef.Int64).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.DB.Table("objects").Select("SUM(size)").Find(&stats.TotalBytesUploaded.Int64).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.DB.Model(util.User{}).Count(&stats.TotalUsers.Int64).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.DB.Table("storage_miners").Count(&stats.TotalStorageMiner.Int64).Error; err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func (s *Server) handleGetBucketDiag(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.CM.getStagingZoneSnapshot(c.Request().Context()))
+}
+
+// handleGetStagingZoneForUser godoc
+// @Summary      Get staging zone for user
+// @Description  This endpoint is used to get staging zone for user.
+// @Tags         content
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /content/staging-zones [get]
+func (s *Server) handleGetStagingZoneForUser(c echo.Context, u *util.User) error {
+	return c.JSON(http.StatusOK, s.CM.getStagingZonesForUser(c.Request().Context(), u.ID))
+}
+
+// handleUserExportData godoc
+// @Summary      Export user data
+// @Description  This endpoint is used to get API keys for a user.
+// @Tags         User
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /user/export [get]
+func (s *Server) handleUserExportData(c echo.Context, u *util.User) error {
+	export, err := s.exportUserData(u.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, export)
+}
+
+// handleNetPeers godoc
+// @Summary      Net Peers
+// @Description  This endpoint is used to get net peers
+// @Tags         public,net
+// @Produce      json
+// @Success      200  {array}   string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /public/net/peers [get]
+func (s *Server) handleNetPeers(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.Node.Host.Network().Peers())
+}
+
+// handleNetAddrs godoc
+// @Summary      Net Addrs
+// @Description  This endpoint is used to get net addrs
+// @Tags         public,net
+// @Produce      json
+// @Success      200  {array}  string
+// @Router       /public/net/addrs [get]
+func (s *Server) handleNetAddrs(c echo.Context) error {
+	id := s.Node.Host.ID()
+	addrs := s.Node.Host.Addrs()
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"id":        id,
+		"addresses": addrs,
+	})
+}
+
+type dealMetricsInfo struct {
+	Time              time.Time `json:"time"`
+	DealsOnChain      int       `json:"dealsOnChain"`
+	DealsOnChainBytes int64     `json:"dealsOnChainBytes"`
 	DealsAttempted    int       `json:"dealsAttempted"`
 	DealsSealed       int       `json:"dealsSealed"`
 	DealsSealedBytes  int64     `json:"dealsSealedBytes"`
 	DealsFailed       int       `json:"dealsFailed"`
 }
 
-type metricsDealJoin struct {
-	CreatedAt        time.Time `json:"created_at"`
-	Failed           bool      `json:"failed"`
-	FailedAt         time.Time `json:"failed_at"`
-	DealID           int64     `json:"deal_id"`
-	Size             int64     `json:"size"`
-	TransferStarted  time.Time `json:"transferStarted"`
-	TransferFinished time.Time `json:"transferFinished"`
-	OnChainAt        time.Time `json:"onChainAt"`
-	SealedAt         time.Time `json:"sealedAt"`
-}
+type metricsDealJoin struct {
+	CreatedAt        time.Time `json:"created_at"`
+	Failed           bool      `json:"failed"`
+	FailedAt         time.Time `json:"failed_at"`
+	DealID           int64     `json:"deal_id"`
+	Size             int64     `json:"size"`
+	TransferStarted  time.Time `json:"transferStarted"`
+	TransferFinished time.Time `json:"transferFinished"`
+	OnChainAt        time.Time `json:"onChainAt"`
+	SealedAt         time.Time `json:"sealedAt"`
+}
+
+// handleMetricsDealOnChain godoc
+// @Summary      Get deal metrics
+// @Description  This endpoint is used to get deal metrics
+// @Tags         public,metrics
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /public/metrics/deals-on-chain [get]
+func (s *Server) handleMetricsDealOnChain(c echo.Context) error {
+	val, err := s.cacher.Get("public/metrics", time.Minute*2, func() (interface{}, error) {
+		return s.computeDealMetrics()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	//	Make sure we don't return a nil val.
+	dealMetrics := val.([]*dealMetricsInfo)
+	if len(dealMetrics) < 1 {
+		return c.JSON(http.StatusOK, []*dealMetricsInfo{})
+	}
+
+	return c.JSON(http.StatusOK, val)
+}
+
+func (s *Server) computeDealMetrics() ([]*dealMetricsInfo, error) {
+	var deals []*metricsDealJoin
+	if err := s.DB.Model(contentDeal{}).
+		Joins("left join contents on content_deals.content = contents.id").
+		Select("content_deals.failed as failed, failed_at, deal_id, size, transfer_started, transfer_finished, on_chain_at, sealed_at").
+		Scan(&deals).Error; err != nil {
+		return nil, err
+	}
+
+	coll := make(map[time.Time]*dealMetricsInfo)
+	onchainbuckets := make(map[time.Time][]*metricsDealJoin)
+	attempts := make(map[time.Time][]*metricsDealJoin)
+	sealed := make(map[time.Time][]*metricsDealJoin)
+	beginning := time.Now().Add(time.Hour * -100000)
+	failed := make(map[time.Time][]*metricsDealJoin)
+
+	for _, d := range deals {
+		created := d.CreatedAt.Round(time.Hour * 24)
+		attempts[created] = append(attempts[created], d)
+
+		if !(d.DealID == 0 || d.Failed) {
+			if d.OnChainAt.Before(beginning) {
+				d.OnChainAt = time.Time{}
+			}
+
+			btime := d.OnChainAt.Round(time.Hour * 24)
+			onchainbuckets[btime] = append(onchainbuckets[btime], d)
+		}
+
+		if d.SealedAt.After(beginning) {
+			sbuck := d.SealedAt.Round(time.Hour * 24)
+			sealed[sbuck] = append(sealed[sbuck], d)
+		}
+
+		if d.Failed {
+			fbuck := d.FailedAt.Round(time.Hour * 24)
+			failed[fbuck] = append(failed[fbuck], d)
+		}
+	}
+
+	for bt, deals := range onchainbuckets {
+		dmi := &dealMetricsInfo{
+			Time:         bt,
+			DealsOnChain: len(deals),
+		}
+		for _, d := range deals {
+			dmi.DealsOnChainBytes += d.Size
+		}
+
+		coll[bt] = dmi
+	}
+
+	for bt, deals := range attempts {
+		dmi, ok := coll[bt]
+		if !ok {
+			dmi = &dealMetricsInfo{
+				Time: bt,
+			}
+			coll[bt] = dmi
+		}
+
+		dmi.DealsAttempted = len(deals)
+	}
+
+	for bt, deals := range sealed {
+		dmi, ok := coll[bt]
+		if !ok {
+			dmi = &dealMetricsInfo{
+				Time: bt,
+			}
+			coll[bt] = dmi
+		}
+
+		dmi.DealsSealed = len(deals)
+		for _, d := range deals {
+			dmi.DealsSealedBytes += d.Size
+		}
+	}
+
+	for bt, deals := range failed {
+		dmi, ok := coll[bt]
+		if !ok {
+			dmi = &dealMetricsInfo{
+				Time: bt,
+			}
+			coll[bt] = dmi
+		}
+
+		dmi.DealsFailed = len(deals)
+	}
+
+	var out []*dealMetricsInfo
+	for _, dmi := range coll {
+		out = append(out, dmi)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Time.Before(out[j].Time)
+	})
+
+	return out, nil
+}
+
+type dealQuery struct {
+	DealID    int64
+	Contentid uint
+	Cid       util.DbCID
+	Aggregate bool
+}
+
+type dealPairs struct {
+	Deals []int64   `json:"deals"`
+	Cids  []cid.Cid `json:"cids"`
+}
+
+// handleGetAllDealsForUser godoc
+// @Summary      Get all deals for a user
+// @Description  This endpoint is used to get all deals for a user
+// @Tags         content
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Param        begin     query     string  true  "Begin"
+// @Param        duration  query     string  true  "Duration"
+// @Param        all       query     string  true  "All"
+// @Router       /content/all-deals [get]
+func (s *Server) handleGetAllDealsForUser(c echo.Context, u *util.User) error {
+
+	begin := time.Now().Add(time.Hour * 24)
+	duration := time.Hour * 24
+
+	if beg := c.QueryParam("begin"); beg != "" {
+		ts, err := time.Parse("2006-01-02T15:04", beg)
+		if err != nil {
+			return err
+		}
+		begin = ts
+	}
+
+	if dur := c.QueryParam("duration"); dur != "" {
+		dur, err := time.ParseDuration(dur)
+		if err != nil {
+			return err
+		}
+
+		duration = dur
+	}
+
+	all := c.QueryParam("all") != ""
+
+	var deals []dealQuery
+	if err := s.DB.Model(contentDeal{}).
+		Where("deal_id > 0 AND (? OR (on_chain_at >= ? AND on_chain_at <= ?)) AND user_id = ?", all, begin, begin.Add(duration), u.ID).
+		Joins("left join contents on content_deals.content = contents.id").
+		Select("deal_id, contents.id as contentid, cid, aggregate").
+		Scan(&deals).Error; err != nil {
+		return err
+	}
+
+	contmap := make(map[uint][]dealQuery)
+	for _, d := range deals {
+		contmap[d.Contentid] = append(contmap[d.Contentid], d)
+	}
+
+	var out []dealPairs
+	for cont, deals := range contmap {
+		var dp dealPairs
+		if deals[0].Aggregate {
+			var conts []util.Content
+			if err := s.DB.Model(util.Content{}).Where("aggregated_in = ?", cont).Select("cid").Scan(&conts).Error; err != nil {
+				return err
+			}
+
+			for _, c := range conts {
+				dp.Cids = append(dp.Cids, c.Cid.CID)
+			}
+		} else {
+			dp.Cids = []cid.Cid{deals[0].Cid.CID}
+		}
+
+		for _, d := range deals {
+			dp.Deals = append(dp.Deals, d.DealID)
+		}
+		out = append(out, dp)
+	}
+
+	return c.JSON(http.StatusOK, out)
+}
+
+type setDealMakingBody struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (s *Server) handleSetDealMaking(c echo.Context) error {
+	var body setDealMakingBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	s.CM.setDealMakingEnabled(body.Enabled)
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
+func (s *Server) handleContentHealthCheck(c echo.Context) error {
+	ctx := c.Request().Context()
+	val, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ?", val).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("content: %d was not found", val),
+			}
+		}
+		return err
+	}
+
+	var u util.User
+	if err := s.DB.First(&u, "id = ?", cont.UserID).Error; err != nil {
+		return err
+	}
+
+	var deals []contentDeal
+	if err := s.DB.Find(&deals, "content = ? and not failed", cont.ID).Error; err != nil {
+		return err
+	}
+
+	var fixedAggregateSize bool
+	if cont.Aggregate && cont.Size == 0 {
+		// if this is an aggregate and its size is zero, then that means we
+		// failed at some point while updating the aggregate, we can fix that
+		var children []util.Content
+		if err := s.DB.Find(&children, "aggregated_in = ?", cont.ID).Error; err != nil {
+			return err
+		}
+
+		nd, err := s.CM.createAggregate(ctx, children)
+		if err != nil {
+			return fmt.Errorf("failed to create aggregate: %w", err)
+		}
+
+		// just to be safe, put it into the blockstore again
+		if err := s.Node.Blockstore.Put(ctx, nd); err != nil {
+			return err
+		}
+
+		size, err := nd.Size()
+		if err != nil {
+			return err
+		}
+
+		// now, update size and cid
+		if err := s.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
+			"cid":  util.DbCID{CID: nd.Cid()},
+			"size": size,
+		}).Error; err != nil {
+			return err
+		}
+		fixedAggregateSize = true
+	}
+
+	if cont.Location != constants.ContentLocationLocal {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"deals":              deals,
+			"content":            cont,
+			"error":              "requested content was not local to this instance, cannot check health right now",
+			"fixedAggregateSize": fixedAggregateSize,
+		})
+	}
+
+	_, rootFetchErr := s.Node.Blockstore.Get(ctx, cont.Cid.CID)
+	if rootFetchErr != nil {
+		log.Errorf("failed to fetch root: %s", rootFetchErr)
+	}
+
+	if cont.Aggregate && rootFetchErr != nil {
+		// if this is an aggregate and we dont have the root, thats funky, but we can regenerate the root
+		var children []util.Content
+		if err := s.DB.Find(&children, "aggregated_in = ?", cont.ID).Error; err != nil {
+			return err
+		}
+
+		nd, err := s.CM.createAggregate(ctx, children)
+		if err != nil {
+			return fmt.Errorf("failed to create aggregate: %w", err)
+		}
+
+		if nd.Cid() != cont.Cid.CID {
+			return fmt.Errorf("recreated aggregate cid does not match one recorded in db: %s != %s", nd.Cid(), cont.Cid.CID)
+		}
+
+		if err := s.Node.Blockstore.Put(ctx, nd); err != nil {
+			return err
+		}
+	}
+
+	var aggrLocs map[string]int
+	var fixedAggregateLocation bool
+	if c.QueryParam("check-locations") != "" && cont.Aggregate {
+		// TODO: check if the contents of the aggregate are somewhere other than where the aggregate root is
+		var aggr []util.Content
+		if err := s.DB.Find(&aggr, "aggregated_in = ?", cont.ID).Error; err != nil {
+			return err
+		}
+
+		aggrLocs = make(map[string]int)
+		for _, child := range aggr {
+			aggrLocs[child.Location]++
+		}
+
+		switch len(aggrLocs) {
+		case 0:
+			log.Warnf("content %d has nothing aggregated in it", cont.ID)
+		case 1:
+			loc := aggr[0].Location
+
+			if loc != cont.Location {
+				// should be safe to send a re-aggregate command to the shuttle in question
+				var ids []uint
+				for _, c := range aggr {
+					ids = append(ids, c.ID)
+				}
+
+				dir, err := s.CM.createAggregate(ctx, aggr)
+				if err != nil {
+					return err
+				}
+
+				if err := s.CM.sendAggregateCmd(ctx, loc, cont, ids, dir.RawData()); err != nil {
+					return err
+				}
+
+				fixedAggregateLocation = true
+			}
+		default:
+			// well that sucks
+			log.Warnf("content %d has messed up aggregation", cont.ID)
+		}
+	}
+
+	var exch exchange.Interface
+	if c.QueryParam("fetch") != "" {
+		exch = s.Node.Bitswap
+	}
+
+	bserv := blockservice.New(s.Node.Blockstore, exch)
+	dserv := merkledag.NewDAGService(bserv)
+
+	cset := cid.NewSet()
+	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		node, err := dserv.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.Type() == cid.Raw {
+			return nil, nil
+		}
 
-// handleMetricsDealOnChain godoc
-// @Summary      Get deal metrics
-// @Description  This endpoint is used to get deal metrics
-// @Tags         public,metrics
-// @Produce      json
-// @Success      200  {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /public/metrics/deals-on-chain [get]
-func (s *Server) handleMetricsDealOnChain(c echo.Context) error {
-	val, err := s.cacher.Get("public/metrics", time.Minute*2, func() (interface{}, error) {
-		return s.computeDealMetrics()
-	})
+		return util.FilterUnwalkableLinks(node.Links()), nil
+	}, cont.Cid.CID, cset.Visit, merkledag.Concurrent())
+
+	errstr := ""
+	if err != nil {
+		errstr = err.Error()
+	}
+
+	out := map[string]interface{}{
+		"user":               u.Username,
+		"content":            cont,
+		"deals":              deals,
+		"traverseError":      errstr,
+		"foundBlocks":        cset.Len(),
+		"fixedAggregateSize": fixedAggregateSize,
+	}
+	if aggrLocs != nil {
+		out["aggregatedContentLocations"] = aggrLocs
+		out["fixedAggregateLocation"] = fixedAggregateLocation
+	}
+	return c.JSON(http.StatusOK, out)
+}
 
+func (s *Server) handleContentHealthCheckByCid(c echo.Context) error {
+	ctx := c.Request().Context()
+	cc, err := cid.Decode(c.Param("cid"))
 	if err != nil {
 		return err
 	}
 
-	//	Make sure we don't return a nil val.
-	dealMetrics := val.([]*dealMetricsInfo)
-	if len(dealMetrics) < 1 {
-		return c.JSON(http.StatusOK, []*dealMetricsInfo{})
+	var roots []util.Content
+	if err := s.DB.Find(&roots, "cid = ?", cc.Bytes()).Error; err != nil {
+		return err
 	}
 
-	return c.JSON(http.StatusOK, val)
-}
+	var obj util.Object
+	if err := s.DB.First(&obj, "cid = ?", cc.Bytes()).Error; err != nil {
+		return c.JSON(404, map[string]interface{}{
+			"error":                "object not found in database",
+			"cid":                  cc.String(),
+			"matchingRootContents": roots,
+		})
+	}
 
-func (s *Server) computeDealMetrics() ([]*dealMetricsInfo, error) {
-	var deals []*metricsDealJoin
-	if err := s.DB.Model(contentDeal{}).
-		Joins("left join contents on content_deals.content = contents.id").
-		Select("content_deals.failed as failed, failed_at, deal_id, size, transfer_started, transfer_finished, on_chain_at, sealed_at").
-		Scan(&deals).Error; err != nil {
-		return nil, err
+	var contents []util.Content
+	if err := s.DB.Model(util.ObjRef{}).Joins("left join contents on obj_refs.content = contents.id").Where("object = ?", obj.ID).Select("contents.*").Scan(&contents).Error; err != nil {
+		log.Errorf("failed to find contents for cid: %s", err)
 	}
 
-	coll := make(map[time.Time]*dealMetricsInfo)
-	onchainbuckets := make(map[time.Time][]*metricsDealJoin)
-	attempts := make(map[time.Time][]*metricsDealJoin)
-	sealed := make(map[time.Time][]*metricsDealJoin)
-	beginning := time.Now().Add(time.Hour * -100000)
-	failed := make(map[time.Time][]*metricsDealJoin)
+	_, rootFetchErr := s.Node.Blockstore.Get(ctx, cc)
+	if rootFetchErr != nil {
+		log.Errorf("failed to fetch root: %s", rootFetchErr)
+	}
 
-	for _, d := range deals {
-		created := d.CreatedAt.Round(time.Hour * 24)
-		attempts[created] = append(attempts[created], d)
+	var exch exchange.Interface
+	if c.QueryParam("fetch") != "" {
+		exch = s.Node.Bitswap
+	}
 
-		if !(d.DealID == 0 || d.Failed) {
-			if d.OnChainAt.Before(beginning) {
-				d.OnChainAt = time.Time{}
-			}
+	bserv := blockservice.New(s.Node.Blockstore, exch)
+	dserv := merkledag.NewDAGService(bserv)
 
-			btime := d.OnChainAt.Round(time.Hour * 24)
-			onchainbuckets[btime] = append(onchainbuckets[btime], d)
+	cset := cid.NewSet()
+	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		node, err := dserv.Get(ctx, c)
+		if err != nil {
+			return nil, err
 		}
 
-		if d.SealedAt.After(beginning) {
-			sbuck := d.SealedAt.Round(time.Hour * 24)
-			sealed[sbuck] = append(sealed[sbuck], d)
+		if c.Type() == cid.Raw {
+			return nil, nil
 		}
 
-		if d.Failed {
-			fbuck := d.FailedAt.Round(time.Hour * 24)
-			failed[fbuck] = append(failed[fbuck], d)
-		}
+		return util.FilterUnwalkableLinks(node.Links()), nil
+	}, cc, cset.Visit, merkledag.Concurrent())
+
+	errstr := ""
+	if err != nil {
+		errstr = err.Error()
 	}
 
-	for bt, deals := range onchainbuckets {
-		dmi := &dealMetricsInfo{
-			Time:         bt,
-			DealsOnChain: len(deals),
-		}
-		for _, d := range deals {
-			dmi.DealsOnChainBytes += d.Size
-		}
+	rferrstr := ""
+	if rootFetchErr != nil {
+		rferrstr = rootFetchErr.Error()
+	}
 
-		coll[bt] = dmi
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"contents":             contents,
+		"cid":                  cc,
+		"traverseError":        errstr,
+		"foundBlocks":          cset.Len(),
+		"rootFetchErr":         rferrstr,
+		"matchingRootContents": roots,
+	})
+}
+
+func (s *Server) handleShuttleInit(c echo.Context) error {
+	shuttle := &Shuttle{
+		Handle: "SHUTTLE" + uuid.New().String() + "HANDLE",
+		Token:  "SECRET" + uuid.New().String() + "SECRET",
+		Open:   false,
+	}
+	if err := s.DB.Create(shuttle).Error; err != nil {
+		return err
 	}
 
-	for bt, deals := range attempts {
-		dmi, ok := coll[bt]
-		if !ok {
-			dmi = &dealMetricsInfo{
-				Time: bt,
-			}
-			coll[bt] = dmi
-		}
+	return c.JSON(http.StatusOK, &util.InitShuttleResponse{
+		Handle: shuttle.Handle,
+		Token:  shuttle.Token,
+	})
+}
 
-		dmi.DealsAttempted = len(deals)
+func (s *Server) handleShuttleList(c echo.Context) error {
+	var shuttles []Shuttle
+	if err := s.DB.Find(&shuttles).Error; err != nil {
+		return err
 	}
 
-	for bt, deals := range sealed {
-		dmi, ok := coll[bt]
-		if !ok {
-			dmi = &dealMetricsInfo{
-				Time: bt,
-			}
-			coll[bt] = dmi
+	var out []util.ShuttleListResponse
+	for _, d := range shuttles {
+		out = append(out, util.ShuttleListResponse{
+			Handle:         d.Handle,
+			Token:          d.Token,
+			LastConnection: d.LastConnection,
+			Online:         s.CM.shuttleIsOnline(d.Handle),
+			AddrInfo:       s.CM.shuttleAddrInfo(d.Handle),
+			Hostname:       s.CM.shuttleHostName(d.Handle),
+			StorageStats:   s.CM.shuttleStorageStats(d.Handle),
+			Health:         s.CM.shuttleHealth(d.Handle),
+		})
+	}
+
+	return c.JSON(http.StatusOK, out)
+}
+
+func (s *Server) handleShuttleConnection(c echo.Context) error {
+	auth, err := util.ExtractAuth(c)
+	if err != nil {
+		return err
+	}
+
+	var shuttle Shuttle
+	if err := s.DB.First(&shuttle, "token = ?", auth).Error; err != nil {
+		return err
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		ws.MaxPayloadBytes = 128 << 20
+
+		done := make(chan struct{})
+		defer close(done)
+		defer ws.Close()
+		var hello drpc.Hello
+		if err := websocket.JSON.Receive(ws, &hello); err != nil {
+			log.Errorf("failed to read hello message from client: %s", err)
+			return
 		}
 
-		dmi.DealsSealed = len(deals)
-		for _, d := range deals {
-			dmi.DealsSealedBytes += d.Size
+		outgoingRpcQueue, unreg, err := s.CM.registerShuttleConnection(shuttle.Handle, &hello)
+		if err != nil {
+			log.Errorf("failed to register shuttle: %s", err)
+			return
 		}
-	}
+		defer unreg()
 
-	for bt, deals := range failed {
-		dmi, ok := coll[bt]
-		if !ok {
-			dmi = &dealMetricsInfo{
-				Time: bt,
+		saidGoodbye := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case rpcMessage := <-outgoingRpcQueue:
+					// Write
+					err := websocket.JSON.Send(ws, rpcMessage)
+					if err != nil {
+						log.Errorf("failed to write command to shuttle: %s", err)
+						return
+					}
+
+					if rpcMessage.Op == drpc.CMD_Goodbye {
+						// we said goodbye, close the connection so the read loop exits
+						close(saidGoodbye)
+						if err := ws.Close(); err != nil {
+							log.Errorf("failed to close connection to shuttle %s after goodbye: %s", shuttle.Handle, err)
+						}
+						return
+					}
+				case <-done:
+					return
+				}
 			}
-			coll[bt] = dmi
-		}
+		}()
 
-		dmi.DealsFailed = len(deals)
-	}
+		go s.RestartAllTransfersForLocation(context.TODO(), shuttle.Handle)
 
-	var out []*dealMetricsInfo
-	for _, dmi := range coll {
-		out = append(out, dmi)
-	}
+		go func() {
+			if err := s.CM.sendQueueStatsCmd(context.TODO(), shuttle.Handle); err != nil {
+				log.Errorf("failed to request queue stats from shuttle %s: %s", shuttle.Handle, err)
+			}
+		}()
 
-	sort.Slice(out, func(i, j int) bool {
-		return out[i].Time.Before(out[j].Time)
-	})
+		if hello.Reconcile {
+			go func() {
+				if err := s.CM.reconcileShuttle(context.TODO(), shuttle.Handle); err != nil {
+					log.Errorf("failed to reconcile the pins of shuttle %s: %s", shuttle.Handle, err)
+				}
+			}()
+		}
 
-	return out, nil
-}
+		for {
+			var msg drpc.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				select {
+				case <-saidGoodbye:
+					log.Infof("closed connection to shuttle %s after goodbye", shuttle.Handle)
+					return
+				default:
+				}
+				log.Errorf("failed to read message from shuttle: %s, %s", shuttle.Handle, err)
+				return
+			}
 
-type dealQuery struct {
-	DealID    int64
-	Contentid uint
-	Cid       util.DbCID
-	Aggregate bool
-}
+			if msg.Op == drpc.OP_Goodbye {
+				reason := ""
+				if msg.Params.Goodbye != nil {
+					reason = msg.Params.Goodbye.Reason
+				}
+				log.Infof("shuttle %s closed its connection: %s", shuttle.Handle, reason)
+				return
+			}
 
-type dealPairs struct {
-	Deals []int64   `json:"deals"`
-	Cids  []cid.Cid `json:"cids"`
+			go func(msg *drpc.Message) {
+				msg.Handle = shuttle.Handle
+				s.CM.IncomingRPCMessages <- msg
+			}(&msg)
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
 }
 
-// handleGetAllDealsForUser godoc
-// @Summary      Get all deals for a user
-// @Description  This endpoint is used to get all deals for a user
-// @Tags         content
+// handleAutoretrieveInit godoc
+// @Summary      Register autoretrieve server
+// @Description  This endpoint registers a new autoretrieve server
+// @Tags         autoretrieve
+// @Param        addresses  formData  string  true  "Autoretrieve's comma-separated list of addresses"
+// @Param        pubKey     formData  string  true  "Autoretrieve's public key"
 // @Produce      json
 // @Success      200  {object}  string
 // @Failure      400  {object}  util.HttpError
 // @Failure      500  {object}  util.HttpError
-// @Param        begin     query     string  true  "Begin"
-// @Param        duration  query     string  true  "Duration"
-// @Param        all       query     string  true  "All"
-// @Router       /content/all-deals [get]
-func (s *Server) handleGetAllDealsForUser(c echo.Context, u *util.User) error {
-
-	begin := time.Now().Add(time.Hour * 24)
-	duration := time.Hour * 24
-
-	if beg := c.QueryParam("begin"); beg != "" {
-		ts, err := time.Parse("2006-01-02T15:04", beg)
-		if err != nil {
-			return err
-		}
-		begin = ts
+// @Router       /admin/autoretrieve/init [post]
+func (s *Server) handleAutoretrieveInit(c echo.Context) error {
+	// validate peerid and peer multi addresses
+	addresses := strings.Split(c.FormValue("addresses"), ",")
+	addrInfo, err := autoretrieve.ValidatePeerInfo(c.FormValue("pubKey"), addresses)
+	if err != nil {
+		return err
 	}
 
-	if dur := c.QueryParam("duration"); dur != "" {
-		dur, err := time.ParseDuration(dur)
-		if err != nil {
-			return err
-		}
-
-		duration = dur
+	ar := &autoretrieve.Autoretrieve{
+		Handle:            "AUTORETRIEVE" + uuid.New().String() + "HANDLE",
+		Token:             "SECRET" + uuid.New().String() + "SECRET",
+		LastConnection:    time.Now(),
+		LastAdvertisement: time.Time{},
+		PubKey:            c.FormValue("pubKey"),
+		Addresses:         c.FormValue("addresses"), // cant store []string in gorm
 	}
-
-	all := c.QueryParam("all") != ""
-
-	var deals []dealQuery
-	if err := s.DB.Model(contentDeal{}).
-		Where("deal_id > 0 AND (? OR (on_chain_at >= ? AND on_chain_at <= ?)) AND user_id = ?", all, begin, begin.Add(duration), u.ID).
-		Joins("left join contents on content_deals.content = contents.id").
-		Select("deal_id, contents.id as contentid, cid, aggregate").
-		Scan(&deals).Error; err != nil {
+	if err := s.DB.Create(ar).Error; err != nil {
 		return err
 	}
 
-	contmap := make(map[uint][]dealQuery)
-	for _, d := range deals {
-		contmap[d.Contentid] = append(contmap[d.Contentid], d)
+	return c.JSON(200, &autoretrieve.AutoretrieveInitResponse{
+		Handle:            ar.Handle,
+		Token:             ar.Token,
+		LastConnection:    ar.LastConnection,
+		AddrInfo:          addrInfo,
+		AdvertiseInterval: s.Node.ArEngine.TickInterval.String(),
+	})
+}
+
+// handleAutoretrieveList godoc
+// @Summary      List autoretrieve servers
+// @Description  This endpoint lists all registered autoretrieve servers
+// @Tags         autoretrieve
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/list [get]
+func (s *Server) handleAutoretrieveList(c echo.Context) error {
+	var autoretrieves []autoretrieve.Autoretrieve
+	if err := s.DB.Find(&autoretrieves).Error; err != nil {
+		return err
 	}
 
-	var out []dealPairs
-	for cont, deals := range contmap {
-		var dp dealPairs
-		if deals[0].Aggregate {
-			var conts []util.Content
-			if err := s.DB.Model(util.Content{}).Where("aggregated_in = ?", cont).Select("cid").Scan(&conts).Error; err != nil {
-				return err
-			}
+	var out []autoretrieve.AutoretrieveListResponse
 
-			for _, c := range conts {
-				dp.Cids = append(dp.Cids, c.Cid.CID)
-			}
-		} else {
-			dp.Cids = []cid.Cid{deals[0].Cid.CID}
+	for _, ar := range autoretrieves {
+		// any of the multiaddresses of the peer should work to get addrInfo
+		// we get the first one
+		addresses := strings.Split(ar.Addresses, ",")
+		addrInfo, err := peer.AddrInfoFromString(addresses[0])
+		if err != nil {
+			return err
 		}
 
-		for _, d := range deals {
-			dp.Deals = append(dp.Deals, d.DealID)
-		}
-		out = append(out, dp)
+		out = append(out, autoretrieve.AutoretrieveListResponse{
+			Handle:            ar.Handle,
+			LastConnection:    ar.LastConnection,
+			LastAdvertisement: ar.LastAdvertisement,
+			AddrInfo:          addrInfo,
+		})
 	}
 
 	return c.JSON(http.StatusOK, out)
 }
 
-type setDealMakingBody struct {
-	Enabled bool `json:"enabled"`
-}
-
-func (s *Server) handleSetDealMaking(c echo.Context) error {
-	var body setDealMakingBody
-	if err := c.Bind(&body); err != nil {
-		return err
-	}
-
-	s.CM.setDealMakingEnabled(body.Enabled)
-	return c.JSON(http.StatusOK, map[string]string{})
-}
-
-func (s *Server) handleContentHealthCheck(c echo.Context) error {
-	ctx := c.Request().Context()
-	val, err := strconv.Atoi(c.Param("id"))
+// handleAutoretrieveHeartbeat godoc
+// @Summary      Marks autoretrieve server as up
+// @Description  This endpoint updates the lastConnection field for autoretrieve
+// @Tags         autoretrieve
+// @Param        token  header  string  true  "Autoretrieve's auth token"
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /autoretrieve/heartbeat [post]
+func (s *Server) handleAutoretrieveHeartbeat(c echo.Context) error {
+	auth, err := util.ExtractAuth(c)
 	if err != nil {
 		return err
 	}
 
-	var cont util.Content
-	if err := s.DB.First(&cont, "id = ?", val).Error; err != nil {
-		if xerrors.Is(err, gorm.ErrRecordNotFound) {
-			return &util.HttpError{
-				Code:    http.StatusNotFound,
-				Reason:  util.ERR_RECORD_NOT_FOUND,
-				Details: fmt.Sprintf("content: %d was not found", val),
-			}
-		}
+	var ar autoretrieve.Autoretrieve
+	if err := s.DB.First(&ar, "token = ?", auth).Error; err != nil {
 		return err
 	}
 
-	var u util.User
-	if err := s.DB.First(&u, "id = ?", cont.UserID).Error; err != nil {
+	ar.LastConnection = time.Now()
+	if err := s.DB.Save(&ar).Error; err != nil {
 		return err
 	}
 
-	var deals []contentDeal
-	if err := s.DB.Find(&deals, "content = ? and not failed", cont.ID).Error; err != nil {
+	// any of the multiaddresses of the peer should work to get addrInfo
+	// we get the first one
+	addresses := strings.Split(ar.Addresses, ",")
+	addrInfo, err := peer.AddrInfoFromString(addresses[0])
+	if err != nil {
 		return err
 	}
 
-	var fixedAggregateSize bool
-	if cont.Aggregate && cont.Size == 0 {
-		// if this is an aggregate and its size is zero, then that means we
-		// failed at some point while updating the aggregate, we can fix that
-		var children []util.Content
-		if err := s.DB.Find(&children, "aggregated_in = ?", cont.ID).Error; err != nil {
-			return err
-		}
-
-		nd, err := s.CM.createAggregate(ctx, children)
-		if err != nil {
-			return fmt.Errorf("failed to create aggregate: %w", err)
-		}
+	out := autoretrieve.HeartbeatAutoretrieveResponse{
+		Handle:            ar.Handle,
+		LastConnection:    ar.LastConnection,
+		LastAdvertisement: ar.LastAdvertisement,
+		AddrInfo:          addrInfo,
+		AdvertiseInterval: s.Node.ArEngine.TickInterval.String(),
+	}
 
-		// just to be safe, put it into the blockstore again
-		if err := s.Node.Blockstore.Put(ctx, nd); err != nil {
-			return err
-		}
+	return c.JSON(http.StatusOK, out)
+}
 
-		size, err := nd.Size()
-		if err != nil {
-			return err
-		}
+type allDealsQuery struct {
+	Miner  string
+	Cid    util.DbCID
+	DealID int64
+}
 
-		// now, update size and cid
-		if err := s.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
-			"cid":  util.DbCID{CID: nd.Cid()},
-			"size": size,
-		}).Error; err != nil {
-			return err
-		}
-		fixedAggregateSize = true
+func (s *Server) handleDebugGetAllDeals(c echo.Context) error {
+	var out []allDealsQuery
+	if err := s.DB.Model(contentDeal{}).Where("deal_id > 0 and not content_deals.failed").
+		Joins("left join contents on content_deals.content = contents.id").
+		Select("miner, contents.cid as cid, deal_id").
+		Scan(&out).
+		Error; err != nil {
+		return err
 	}
+	return c.JSON(http.StatusOK, out)
+}
 
-	if cont.Location != constants.ContentLocationLocal {
-		return c.JSON(http.StatusOK, map[string]interface{}{
-			"deals":              deals,
-			"content":            cont,
-			"error":              "requested content was not local to this instance, cannot check health right now",
-			"fixedAggregateSize": fixedAggregateSize,
-		})
-	}
+type logLevelBody struct {
+	System string `json:"system"`
+	Level  string `json:"level"`
+}
 
-	_, rootFetchErr := s.Node.Blockstore.Get(ctx, cont.Cid.CID)
-	if rootFetchErr != nil {
-		log.Errorf("failed to fetch root: %s", rootFetchErr)
+func (s *Server) handleLogLevel(c echo.Context) error {
+	var body logLevelBody
+	if err := c.Bind(&body); err != nil {
+		return err
 	}
 
-	if cont.Aggregate && rootFetchErr != nil {
-		// if this is an aggregate and we dont have the root, thats funky, but we can regenerate the root
-		var children []util.Content
-		if err := s.DB.Find(&children, "aggregated_in = ?", cont.ID).Error; err != nil {
-			return err
-		}
+	//#nosec G104 - it's not common to treat SetLogLevel error return
+	logging.SetLogLevel(body.System, body.Level)
 
-		nd, err := s.CM.createAggregate(ctx, children)
-		if err != nil {
-			return fmt.Errorf("failed to create aggregate: %w", err)
-		}
+	return c.JSON(http.StatusOK, map[string]interface{}{})
+}
 
-		if nd.Cid() != cont.Cid.CID {
-			return fmt.Errorf("recreated aggregate cid does not match one recorded in db: %s != %s", nd.Cid(), cont.Cid.CID)
-		}
+// handleShuttleLogLevel changes the log level of a subsystem on a shuttle
+// without restarting it
+func (s *Server) handleShuttleLogLevel(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-		if err := s.Node.Blockstore.Put(ctx, nd); err != nil {
-			return err
-		}
+	var body logLevelBody
+	if err := c.Bind(&body); err != nil {
+		return err
 	}
 
-	var aggrLocs map[string]int
-	var fixedAggregateLocation bool
-	if c.QueryParam("check-locations") != "" && cont.Aggregate {
-		// TODO: check if the contents of the aggregate are somewhere other than where the aggregate root is
-		var aggr []util.Content
-		if err := s.DB.Find(&aggr, "aggregated_in = ?", cont.ID).Error; err != nil {
-			return err
-		}
-
-		aggrLocs = make(map[string]int)
-		for _, child := range aggr {
-			aggrLocs[child.Location]++
+	if body.System == "" || body.Level == "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "a system and a level are required",
 		}
+	}
 
-		switch len(aggrLocs) {
-		case 0:
-			log.Warnf("content %d has nothing aggregated in it", cont.ID)
-		case 1:
-			loc := aggr[0].Location
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*10)
+	defer cancel()
 
-			if loc != cont.Location {
-				// should be safe to send a re-aggregate command to the shuttle in question
-				var ids []uint
-				for _, c := range aggr {
-					ids = append(ids, c.ID)
-				}
+	key := logLevelKey{handle: handle, subsystem: body.System}
+	s.CM.logLevelResults.Remove(key)
+	if err := s.CM.sendSetLogLevelCmd(ctx, handle, body.System, body.Level); err != nil {
+		return err
+	}
 
-				dir, err := s.CM.createAggregate(ctx, aggr)
-				if err != nil {
-					return err
-				}
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-				if err := s.CM.sendAggregateCmd(ctx, loc, cont, ids, dir.RawData()); err != nil {
-					return err
+	for {
+		if v, ok := s.CM.logLevelResults.Get(key); ok {
+			res := v.(*drpc.LogLevelSet)
+			if res.Error != "" {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("shuttle %s failed to set log level: %s", handle, res.Error),
 				}
-
-				fixedAggregateLocation = true
 			}
-		default:
-			// well that sucks
-			log.Warnf("content %d has messed up aggregation", cont.ID)
+			return c.JSON(http.StatusOK, res)
 		}
-	}
 
-	var exch exchange.Interface
-	if c.QueryParam("fetch") != "" {
-		exch = s.Node.Bitswap
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to set the log level of %s", handle, body.System)
+		}
 	}
+}
 
-	bserv := blockservice.New(s.Node.Blockstore, exch)
-	dserv := merkledag.NewDAGService(bserv)
+// handleShuttleConfigReload makes a shuttle read its config file again, the
+// response lists the settings that changed and whether they need a restart
+func (s *Server) handleShuttleConfigReload(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-	cset := cid.NewSet()
-	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, err
-		}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*10)
+	defer cancel()
 
-		if c.Type() == cid.Raw {
-			return nil, nil
-		}
+	s.CM.configReloads.Remove(handle)
+	if err := s.CM.sendConfigReloadCmd(ctx, handle); err != nil {
+		return err
+	}
 
-		return util.FilterUnwalkableLinks(node.Links()), nil
-	}, cont.Cid.CID, cset.Visit, merkledag.Concurrent())
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-	errstr := ""
-	if err != nil {
-		errstr = err.Error()
-	}
+	for {
+		if v, ok := s.CM.configReloads.Get(handle); ok {
+			res := v.(*drpc.ConfigReloaded)
+			if res.Error != "" {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("shuttle %s failed to reload its config: %s", handle, res.Error),
+				}
+			}
+			return c.JSON(http.StatusOK, res)
+		}
 
-	out := map[string]interface{}{
-		"user":               u.Username,
-		"content":            cont,
-		"deals":              deals,
-		"traverseError":      errstr,
-		"foundBlocks":        cset.Len(),
-		"fixedAggregateSize": fixedAggregateSize,
-	}
-	if aggrLocs != nil {
-		out["aggregatedContentLocations"] = aggrLocs
-		out["fixedAggregateLocation"] = fixedAggregateLocation
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to reload its config", handle)
+		}
 	}
-	return c.JSON(http.StatusOK, out)
 }
 
-func (s *Server) handleContentHealthCheckByCid(c echo.Context) error {
-	ctx := c.Request().Context()
-	cc, err := cid.Decode(c.Param("cid"))
-	if err != nil {
-		return err
-	}
+// handleShuttlePieceInfo lists the miners of the active deals of a piece
+// tracked by a shuttle, best retrieval candidates first, and whether the
+// shuttle can still serve it itself. With query=true the miners are asked for
+// a fresh retrieval quote.
+func (s *Server) handleShuttlePieceInfo(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-	var roots []util.Content
-	if err := s.DB.Find(&roots, "cid = ?", cc.Bytes()).Error; err != nil {
-		return err
+	piece, err := cid.Decode(c.Param("piece"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid piece cid: %s", err),
+		}
 	}
 
-	var obj util.Object
-	if err := s.DB.First(&obj, "cid = ?", cc.Bytes()).Error; err != nil {
-		return c.JSON(404, map[string]interface{}{
-			"error":                "object not found in database",
-			"cid":                  cc.String(),
-			"matchingRootContents": roots,
-		})
-	}
+	query := c.QueryParam("query") == "true"
 
-	var contents []util.Content
-	if err := s.DB.Model(util.ObjRef{}).Joins("left join contents on obj_refs.content = contents.id").Where("object = ?", obj.ID).Select("contents.*").Scan(&contents).Error; err != nil {
-		log.Errorf("failed to find contents for cid: %s", err)
+	// querying miners takes a while
+	timeout := time.Second * 10
+	if query {
+		timeout = time.Minute * 2
 	}
 
-	_, rootFetchErr := s.Node.Blockstore.Get(ctx, cc)
-	if rootFetchErr != nil {
-		log.Errorf("failed to fetch root: %s", rootFetchErr)
-	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+	defer cancel()
 
-	var exch exchange.Interface
-	if c.QueryParam("fetch") != "" {
-		exch = s.Node.Bitswap
+	key := pieceInfoKey{handle: handle, piece: piece}
+	s.CM.pieceInfos.Remove(key)
+	if err := s.CM.sendGetPieceInfoCmd(ctx, handle, piece, query); err != nil {
+		return err
 	}
 
-	bserv := blockservice.New(s.Node.Blockstore, exch)
-	dserv := merkledag.NewDAGService(bserv)
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-	cset := cid.NewSet()
-	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, err
+	for {
+		if v, ok := s.CM.pieceInfos.Get(key); ok {
+			res := v.(*drpc.PieceInfo)
+			if res.Error != "" {
+				return fmt.Errorf("shuttle %s failed to get piece info of %s: %s", handle, piece, res.Error)
+			}
+			return c.JSON(http.StatusOK, res)
 		}
 
-		if c.Type() == cid.Raw {
-			return nil, nil
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to report piece %s", handle, piece)
 		}
+	}
+}
 
-		return util.FilterUnwalkableLinks(node.Links()), nil
-	}, cc, cset.Visit, merkledag.Concurrent())
+// handleShuttleRepairSplit makes a shuttle restore the missing parents of its
+// split children, the response lists the restored parents and the orphaned
+// children left for an admin to decide on. The shuttle first reports the
+// parents it can rebuild, only the ones we still have as split contents on it
+// are then restored. With dry-run=true nothing changes.
+func (s *Server) handleShuttleRepairSplit(c echo.Context) error {
+	handle := c.Param("shuttle")
+	dryRun := c.QueryParam("dry-run") == "true"
 
-	errstr := ""
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*30)
+	defer cancel()
+
+	res, err := s.repairSplitLinkage(ctx, handle, true, nil)
 	if err != nil {
-		errstr = err.Error()
+		return err
 	}
 
-	rferrstr := ""
-	if rootFetchErr != nil {
-		rferrstr = rootFetchErr.Error()
+	if dryRun || len(res.Restored) == 0 {
+		return c.JSON(http.StatusOK, res)
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"contents":             contents,
-		"cid":                  cc,
-		"traverseError":        errstr,
-		"foundBlocks":          cset.Len(),
-		"rootFetchErr":         rferrstr,
-		"matchingRootContents": roots,
-	})
-}
-
-func (s *Server) handleShuttleInit(c echo.Context) error {
-	shuttle := &Shuttle{
-		Handle: "SHUTTLE" + uuid.New().String() + "HANDLE",
-		Token:  "SECRET" + uuid.New().String() + "SECRET",
-		Open:   false,
+	parents := make([]uint, 0, len(res.Restored))
+	for _, p := range res.Restored {
+		parents = append(parents, p.Content)
 	}
-	if err := s.DB.Create(shuttle).Error; err != nil {
+
+	res, err = s.repairSplitLinkage(ctx, handle, false, parents)
+	if err != nil {
 		return err
 	}
-
-	return c.JSON(http.StatusOK, &util.InitShuttleResponse{
-		Handle: shuttle.Handle,
-		Token:  shuttle.Token,
-	})
+	return c.JSON(http.StatusOK, res)
 }
 
-func (s *Server) handleShuttleList(c echo.Context) error {
-	var shuttles []Shuttle
-	if err := s.DB.Find(&shuttles).Error; err != nil {
-		return err
+func (s *Server) repairSplitLinkage(ctx context.Context, handle string, dryRun bool, parents []uint) (*drpc.SplitLinkageRepaired, error) {
+	s.CM.splitRepairs.Remove(handle)
+	if err := s.CM.sendRepairSplitLinkageCmd(ctx, handle, dryRun, parents); err != nil {
+		return nil, err
 	}
 
-	var out []util.ShuttleListResponse
-	for _, d := range shuttles {
-		out = append(out, util.ShuttleListResponse{
-			Handle:         d.Handle,
-			Token:          d.Token,
-			LastConnection: d.LastConnection,
-			Online:         s.CM.shuttleIsOnline(d.Handle),
-			AddrInfo:       s.CM.shuttleAddrInfo(d.Handle),
-			Hostname:       s.CM.shuttleHostName(d.Handle),
-			StorageStats:   s.CM.shuttleStorageStats(d.Handle),
-		})
-	}
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-	return c.JSON(http.StatusOK, out)
+	for {
+		if v, ok := s.CM.splitRepairs.Get(handle); ok {
+			res := v.(*drpc.SplitLinkageRepaired)
+			if res.Error != "" {
+				return nil, fmt.Errorf("shuttle %s failed to repair split linkage: %s", handle, res.Error)
+			}
+			return res, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for shuttle %s to repair split linkage", handle)
+		}
+	}
 }
 
-func (s *Server) handleShuttleConnection(c echo.Context) error {
-	auth, err := util.ExtractAuth(c)
-	if err != nil {
-		return err
+// handleShuttleBenchmark runs a throughput benchmark on a shuttle and responds
+// with the throughput of each stage. The size query param is the size of the
+// synthetic content in bytes, provide=true also announces it to the dht.
+func (s *Server) handleShuttleBenchmark(c echo.Context) error {
+	handle := c.Param("shuttle")
+
+	var size int64
+	if sizestr := c.QueryParam("size"); sizestr != "" {
+		v, err := strconv.ParseInt(sizestr, 10, 64)
+		if err != nil || v < 1 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid benchmark size %q", sizestr),
+			}
+		}
+		size = v
 	}
+	provide := c.QueryParam("provide") == "true"
 
-	var shuttle Shuttle
-	if err := s.DB.First(&shuttle, "token = ?", auth).Error; err != nil {
+	// a large benchmark on slow hardware takes a while, which is the point
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Minute*30)
+	defer cancel()
+
+	s.CM.benchmarkResults.Remove(handle)
+	if err := s.CM.sendBenchmarkCmd(ctx, handle, size, provide); err != nil {
 		return err
 	}
 
-	websocket.Handler(func(ws *websocket.Conn) {
-		ws.MaxPayloadBytes = 128 << 20
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-		done := make(chan struct{})
-		defer close(done)
-		defer ws.Close()
-		var hello drpc.Hello
-		if err := websocket.JSON.Receive(ws, &hello); err != nil {
-			log.Errorf("failed to read hello message from client: %s", err)
-			return
+	for {
+		if v, ok := s.CM.benchmarkResults.Get(handle); ok {
+			res := v.(*drpc.BenchmarkResult)
+			if res.Error != "" && len(res.Stages) == 0 {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("shuttle %s failed to run the benchmark: %s", handle, res.Error),
+				}
+			}
+			return c.JSON(http.StatusOK, res)
 		}
 
-		outgoingRpcQueue, unreg, err := s.CM.registerShuttleConnection(shuttle.Handle, &hello)
-		if err != nil {
-			log.Errorf("failed to register shuttle: %s", err)
-			return
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to finish the benchmark", handle)
 		}
-		defer unreg()
+	}
+}
 
-		go func() {
-			for {
-				select {
-				case rpcMessage := <-outgoingRpcQueue:
-					// Write
-					err := websocket.JSON.Send(ws, rpcMessage)
-					if err != nil {
-						log.Errorf("failed to write command to shuttle: %s", err)
-						return
-					}
-				case <-done:
-					return
-				}
-			}
-		}()
+// handleShuttleReconcile starts a reconciliation of the pins of a shuttle with
+// the contents we expect it to have, its outcome is read with
+// handleGetShuttleReconcile
+func (s *Server) handleShuttleReconcile(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-		go s.RestartAllTransfersForLocation(context.TODO(), shuttle.Handle)
+	if !s.CM.shuttleIsOnline(handle) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("shuttle %s is not online", handle),
+		}
+	}
 
-		for {
-			var msg drpc.Message
-			if err := websocket.JSON.Receive(ws, &msg); err != nil {
-				log.Errorf("failed to read message from shuttle: %s, %s", shuttle.Handle, err)
-				return
+	// a reconciliation that failed along the way can be started over
+	if v, ok := s.CM.reconciliations.Get(handle); ok {
+		if st := v.(*shuttleReconciliation).status(); !st.Done && len(st.Errors) == 0 {
+			return &util.HttpError{
+				Code:    http.StatusConflict,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("a reconciliation of shuttle %s is already running", handle),
 			}
+		}
+	}
 
-			go func(msg *drpc.Message) {
-				msg.Handle = shuttle.Handle
-				s.CM.IncomingRPCMessages <- msg
-			}(&msg)
+	go func() {
+		if err := s.CM.reconcileShuttle(context.Background(), handle); err != nil {
+			log.Errorf("failed to reconcile the pins of shuttle %s: %s", handle, err)
 		}
-	}).ServeHTTP(c.Response(), c.Request())
-	return nil
+	}()
+	return c.NoContent(http.StatusAccepted)
 }
 
-// handleAutoretrieveInit godoc
-// @Summary      Register autoretrieve server
-// @Description  This endpoint registers a new autoretrieve server
-// @Tags         autoretrieve
-// @Param        addresses  formData  string  true  "Autoretrieve's comma-separated list of addresses"
-// @Param        pubKey     formData  string  true  "Autoretrieve's public key"
-// @Produce      json
-// @Success      200  {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /admin/autoretrieve/init [post]
-func (s *Server) handleAutoretrieveInit(c echo.Context) error {
-	// validate peerid and peer multi addresses
-	addresses := strings.Split(c.FormValue("addresses"), ",")
-	addrInfo, err := autoretrieve.ValidatePeerInfo(c.FormValue("pubKey"), addresses)
-	if err != nil {
-		return err
-	}
+// handleGetShuttleReconcile responds with the contents the last reconciliation
+// of a shuttle found missing from it or orphaned on it
+func (s *Server) handleGetShuttleReconcile(c echo.Context) error {
+	handle := c.Param("shuttle")
 
-	ar := &autoretrieve.Autoretrieve{
-		Handle:            "AUTORETRIEVE" + uuid.New().String() + "HANDLE",
-		Token:             "SECRET" + uuid.New().String() + "SECRET",
-		LastConnection:    time.Now(),
-		LastAdvertisement: time.Time{},
-		PubKey:            c.FormValue("pubKey"),
-		Addresses:         c.FormValue("addresses"), // cant store []string in gorm
-	}
-	if err := s.DB.Create(ar).Error; err != nil {
-		return err
+	v, ok := s.CM.reconciliations.Get(handle)
+	if !ok {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_RECORD_NOT_FOUND,
+			Details: fmt.Sprintf("shuttle %s was not reconciled yet", handle),
+		}
 	}
-
-	return c.JSON(200, &autoretrieve.AutoretrieveInitResponse{
-		Handle:            ar.Handle,
-		Token:             ar.Token,
-		LastConnection:    ar.LastConnection,
-		AddrInfo:          addrInfo,
-		AdvertiseInterval: s.Node.ArEngine.TickInterval.String(),
-	})
+	return c.JSON(http.StatusOK, v.(*shuttleReconciliation).status())
 }
 
-// handleAutoretrieveList godoc
-// @Summary      List autoretrieve servers
-// @Description  This endpoint lists all registered autoretrieve servers
-// @Tags         autoretrieve
-// @Produce      json
-// @Success      200  {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /admin/autoretrieve/list [get]
-func (s *Server) handleAutoretrieveList(c echo.Context) error {
-	var autoretrieves []autoretrieve.Autoretrieve
-	if err := s.DB.Find(&autoretrieves).Error; err != nil {
+// handleShuttleGoroutines streams the stack traces of all the goroutines of a
+// shuttle, to diagnose a shuttle that hangs without access to its host
+func (s *Server) handleShuttleGoroutines(c echo.Context) error {
+	handle := c.Param("shuttle")
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Minute)
+	defer cancel()
+
+	id := uuid.New().String()
+	parts, done := s.CM.watchGoroutineDump(handle, id)
+	defer done()
+
+	if err := s.CM.sendDumpGoroutinesCmd(ctx, handle, id); err != nil {
 		return err
 	}
 
-	var out []autoretrieve.AutoretrieveListResponse
-
-	for _, ar := range autoretrieves {
-		// any of the multiaddresses of the peer should work to get addrInfo
-		// we get the first one
-		addresses := strings.Split(ar.Addresses, ",")
-		addrInfo, err := peer.AddrInfoFromString(addresses[0])
-		if err != nil {
-			return err
+	// messages are handled concurrently, the parts can arrive in any order
+	pending := make(map[int]*drpc.GoroutineDump)
+	next := 0
+	resp := c.Response()
+	for {
+		select {
+		case p := <-parts:
+			pending[p.Index] = p
+		case <-ctx.Done():
+			if next == 0 {
+				return fmt.Errorf("timed out waiting for shuttle %s to dump its goroutines", handle)
+			}
+			// the status is already sent, all that can be done is cut it short
+			return nil
 		}
 
-		out = append(out, autoretrieve.AutoretrieveListResponse{
-			Handle:            ar.Handle,
-			LastConnection:    ar.LastConnection,
-			LastAdvertisement: ar.LastAdvertisement,
-			AddrInfo:          addrInfo,
-		})
+		for p, ok := pending[next]; ok; p, ok = pending[next] {
+			delete(pending, next)
+
+			if p.Error != "" {
+				if next == 0 {
+					return fmt.Errorf("shuttle %s failed to dump its goroutines: %s", handle, p.Error)
+				}
+				return nil
+			}
+
+			if next == 0 {
+				resp.Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+				resp.WriteHeader(http.StatusOK)
+			}
+
+			if _, err := io.WriteString(resp, p.Data); err != nil {
+				return err
+			}
+			resp.Flush()
+
+			if p.Last {
+				return nil
+			}
+			next++
+		}
 	}
+}
 
-	return c.JSON(http.StatusOK, out)
+type reconnectShuttlesBody struct {
+	// Delay before the first shuttle reconnects
+	Delay string `json:"delay"`
+	// Stagger is added to the delay of every next shuttle, so they do not
+	// all reconnect at once
+	Stagger string `json:"stagger"`
+	Reason  string `json:"reason"`
 }
 
-// handleAutoretrieveHeartbeat godoc
-// @Summary      Marks autoretrieve server as up
-// @Description  This endpoint updates the lastConnection field for autoretrieve
-// @Tags         autoretrieve
-// @Param        token  header  string  true  "Autoretrieve's auth token"
-// @Produce      json
-// @Success      200  {object}  string
-// @Failure      400  {object}  util.HttpError
-// @Failure      500  {object}  util.HttpError
-// @Router       /autoretrieve/heartbeat [post]
-func (s *Server) handleAutoretrieveHeartbeat(c echo.Context) error {
-	auth, err := util.ExtractAuth(c)
-	if err != nil {
+// handleReconnectShuttles has a shuttle, or all the connected ones, close
+// their rpc connection and connect again
+func (s *Server) handleReconnectShuttles(c echo.Context) error {
+	var body reconnectShuttlesBody
+	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
-	var ar autoretrieve.Autoretrieve
-	if err := s.DB.First(&ar, "token = ?", auth).Error; err != nil {
-		return err
+	parse := func(name, v string) (time.Duration, error) {
+		if v == "" {
+			return 0, nil
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return 0, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid %s %q", name, v),
+			}
+		}
+		return d, nil
 	}
 
-	ar.LastConnection = time.Now()
-	if err := s.DB.Save(&ar).Error; err != nil {
+	delay, err := parse("delay", body.Delay)
+	if err != nil {
 		return err
 	}
 
-	// any of the multiaddresses of the peer should work to get addrInfo
-	// we get the first one
-	addresses := strings.Split(ar.Addresses, ",")
-	addrInfo, err := peer.AddrInfoFromString(addresses[0])
+	stagger, err := parse("stagger", body.Stagger)
 	if err != nil {
 		return err
 	}
 
-	out := autoretrieve.HeartbeatAutoretrieveResponse{
-		Handle:            ar.Handle,
-		LastConnection:    ar.LastConnection,
-		LastAdvertisement: ar.LastAdvertisement,
-		AddrInfo:          addrInfo,
-		AdvertiseInterval: s.Node.ArEngine.TickInterval.String(),
+	handles := []string{c.Param("shuttle")}
+	if handles[0] == "" {
+		handles = nil
+		s.CM.shuttlesLk.Lock()
+		for hnd := range s.CM.shuttles {
+			handles = append(handles, hnd)
+		}
+		s.CM.shuttlesLk.Unlock()
+		sort.Strings(handles)
 	}
 
-	return c.JSON(http.StatusOK, out)
-}
+	reconnecting := make(map[string]string)
+	for _, hnd := range handles {
+		if err := s.CM.sendForceReconnectCmd(c.Request().Context(), hnd, delay, body.Reason); err != nil {
+			if len(handles) == 1 {
+				return err
+			}
+			log.Errorf("failed to ask shuttle %s to reconnect: %s", hnd, err)
+			continue
+		}
+		reconnecting[hnd] = delay.String()
+		delay += stagger
+	}
 
-type allDealsQuery struct {
-	Miner  string
-	Cid    util.DbCID
-	DealID int64
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"reconnecting": reconnecting,
+	})
 }
 
-func (s *Server) handleDebugGetAllDeals(c echo.Context) error {
-	var out []allDealsQuery
-	if err := s.DB.Model(contentDeal{}).Where("deal_id > 0 and not content_deals.failed").
-		Joins("left join contents on content_deals.content = contents.id").
-		Select("miner, contents.cid as cid, deal_id").
-		Scan(&out).
-		Error; err != nil {
-		return err
-	}
-	return c.JSON(http.StatusOK, out)
-}
+// handleShuttleDiskUsage returns the blockstore space used by each user of a
+// shuttle, the shuttle caches it for a few minutes unless refresh is set
+func (s *Server) handleShuttleDiskUsage(c echo.Context) error {
+	handle := c.Param("shuttle")
+	refresh := c.QueryParam("refresh") == "true"
 
-type logLevelBody struct {
-	System string `json:"system"`
-	Level  string `json:"level"`
-}
+	// summing the objects of every pin can take a while on large shuttles
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Minute)
+	defer cancel()
 
-func (s *Server) handleLogLevel(c echo.Context) error {
-	var body logLevelBody
-	if err := c.Bind(&body); err != nil {
+	s.CM.diskUsageResults.Remove(handle)
+	if err := s.CM.sendGetDiskUsageCmd(ctx, handle, refresh); err != nil {
 		return err
 	}
 
-	//#nosec G104 - it's not common to treat SetLogLevel error return
-	logging.SetLogLevel(body.System, body.Level)
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
 
-	return c.JSON(http.StatusOK, map[string]interface{}{})
+	for {
+		if v, ok := s.CM.diskUsageResults.Get(handle); ok {
+			res := v.(*drpc.DiskUsage)
+			if res.Error != "" {
+				return fmt.Errorf("shuttle %s failed to compute its disk usage: %s", handle, res.Error)
+			}
+			return c.JSON(http.StatusOK, res)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shuttle %s to report its disk usage", handle)
+		}
+	}
 }
 
 // handlePublicStorageFailures godoc
@@ -5641,8 +7387,14 @@ func (s *Server) withShuttleAuth() echo.MiddlewareFunc {
 	}
 }
 
+// how many pins a repin of all the content of a shuttle sends per command
+const repinAllBatchSize = 1000
+
 func (s *Server) handleShuttleRepinAll(c echo.Context) error {
 	handle := c.Param("shuttle")
+	// pins the shuttle has marked failed are pinned again instead of only
+	// having their failure reported again
+	retryFailed := c.QueryParam("retry-failed") == "true"
 
 	rows, err := s.DB.Model(util.Content{}).Where("location = ? and not offloaded", handle).Rows()
 	if err != nil {
@@ -5650,6 +7402,8 @@ func (s *Server) handleShuttleRepinAll(c echo.Context) error {
 	}
 
 	defer rows.Close()
+
+	var pins []drpc.AddPin
 	for rows.Next() {
 		var cont util.Content
 		if err := s.DB.ScanRows(rows, &cont); err != nil {
@@ -5662,19 +7416,38 @@ func (s *Server) handleShuttleRepinAll(c echo.Context) error {
 			_ = json.Unmarshal([]byte(cont.Origins), &origins) // no need to handle or log err, its just a nice to have
 		}
 
-		if err := s.CM.sendShuttleCommand(c.Request().Context(), handle, &drpc.Command{
-			Op: drpc.CMD_AddPin,
-			Params: drpc.CmdParams{
-				AddPin: &drpc.AddPin{
-					DBID:   cont.ID,
-					UserId: cont.UserID,
-					Cid:    cont.Cid.CID,
-					Peers:  origins,
-				},
-			},
-		}); err != nil {
-			return err
+		if retryFailed && cont.Failed {
+			if err := s.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
+				"failed":  false,
+				"pinning": true,
+			}).Error; err != nil {
+				return err
+			}
 		}
+
+		hints := pinHintsForContent(cont)
+		pins = append(pins, drpc.AddPin{
+			DBID:        cont.ID,
+			UserId:      cont.UserID,
+			Cid:         cont.Cid.CID,
+			Peers:       origins,
+			RetryFailed: retryFailed,
+			Timeout:     hints.Timeout,
+			ProvideTTL:  hints.ProvideTTL,
+			Unannounced: hints.Unannounced,
+			Size:        cont.Size,
+		})
+
+		if len(pins) >= repinAllBatchSize {
+			if err := s.CM.sendBulkAddPinCmd(c.Request().Context(), handle, pins); err != nil {
+				return err
+			}
+			pins = nil
+		}
+	}
+
+	if len(pins) > 0 {
+		return s.CM.sendBulkAddPinCmd(c.Request().Context(), handle, pins)
 	}
 	return nil
 }
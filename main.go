@@ -4,12 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -48,8 +49,6 @@ import (
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lotus/api"
-	"github.com/filecoin-project/lotus/chain/types"
-	lcli "github.com/filecoin-project/lotus/cli"
 	"github.com/urfave/cli/v2"
 
 	"gorm.io/gorm"
@@ -104,16 +103,30 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 		switch name {
 		case "node-api-url":
 			cfg.Node.ApiURL = cctx.String("node-api-url")
+		case "node-api-fallback-url":
+			cfg.Node.FallbackApiURLs = cctx.StringSlice("node-api-fallback-url")
 		case "datadir":
 			cfg.DataDir = cctx.String("datadir")
 		case "blockstore":
 			cfg.Node.Blockstore = cctx.String("blockstore")
+		case "blockstore-type":
+			cfg.Node.BlockstoreType = cctx.String("blockstore-type")
 		case "no-blockstore-cache":
 			cfg.Node.NoBlockstoreCache = cctx.Bool("no-blockstore-cache")
+		case "blockstore-read-cache-size":
+			cfg.Node.BlockstoreCache.ReadCacheSize = cctx.Int("blockstore-read-cache-size")
+		case "blockstore-read-cache-policy":
+			cfg.Node.BlockstoreCache.ReadCachePolicy = cctx.String("blockstore-read-cache-policy")
 		case "write-log-truncate":
 			cfg.Node.WriteLogTruncate = cctx.Bool("write-log-truncate")
 		case "write-log-flush":
 			cfg.Node.HardFlushWriteLog = cctx.Bool("write-log-flush")
+		case "write-log-max-size":
+			cfg.Node.WriteLogMaxSize = cctx.Int64("write-log-max-size")
+		case "write-log-check-interval":
+			cfg.Node.WriteLogCheckInterval = cctx.Duration("write-log-check-interval")
+		case "ephemeral-identity":
+			cfg.Node.EphemeralIdentity = cctx.Bool("ephemeral-identity")
 		case "write-log":
 			if wl := cctx.String("write-log"); wl != "" {
 				if wl[0] == '/' {
@@ -126,6 +139,20 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.DatabaseConnString = cctx.String("database")
 		case "apilisten":
 			cfg.ApiListen = cctx.String("apilisten")
+		case "internal-listen":
+			cfg.InternalListen = cctx.String("internal-listen")
+		case "server-read-header-timeout":
+			cfg.Server.ReadHeaderTimeout = cctx.Duration("server-read-header-timeout")
+		case "server-read-timeout":
+			cfg.Server.ReadTimeout = cctx.Duration("server-read-timeout")
+		case "server-write-timeout":
+			cfg.Server.WriteTimeout = cctx.Duration("server-write-timeout")
+		case "server-idle-timeout":
+			cfg.Server.IdleTimeout = cctx.Duration("server-idle-timeout")
+		case "max-body-size":
+			cfg.Server.MaxBodySize = cctx.Int64("max-body-size")
+		case "max-add-body-size":
+			cfg.Server.MaxAddBodySize = cctx.Int64("max-add-body-size")
 		case "announce":
 			_, err := multiaddr.NewMultiaddr(cctx.String("announce"))
 			if err != nil {
@@ -160,10 +187,22 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.Deal.IsVerified = cctx.Bool("verified-deal")
 		case "fail-deals-on-transfer-failure":
 			cfg.Deal.FailOnTransferFailure = cctx.Bool("fail-deals-on-transfer-failure")
+		case "deal-duration":
+			cfg.Deal.Duration = abi.ChainEpoch(cctx.Int64("deal-duration"))
+		case "lazy-commp":
+			cfg.Deal.LazyCommP = cctx.Bool("lazy-commp")
+		case "auto-offload-sealed-deals":
+			cfg.Deal.AutoOffloadSealedDeals = cctx.Int("auto-offload-sealed-deals")
 		case "disable-local-content-adding":
 			cfg.Content.DisableLocalAdding = cctx.Bool("disable-local-content-adding")
 		case "disable-content-adding":
 			cfg.Content.DisableGlobalAdding = cctx.Bool("disable-content-adding")
+		case "pin-root-validation-timeout":
+			cfg.Content.PinRootValidationTimeout = cctx.Duration("pin-root-validation-timeout")
+		case "pin-timeout":
+			cfg.Content.PinTimeout = cctx.Duration("pin-timeout")
+		case "pin-queue-dir":
+			cfg.Content.PinQueueDir = cctx.String("pin-queue-dir")
 		case "jaeger-tracing":
 			cfg.Jaeger.EnableTracing = cctx.Bool("jaeger-tracing")
 		case "jaeger-provider-url":
@@ -176,16 +215,36 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.DisableAutoRetrieve = cctx.Bool("disable-auto-retrieve")
 		case "bitswap-max-work-per-peer":
 			cfg.Node.Bitswap.MaxOutstandingBytesPerPeer = cctx.Int64("bitswap-max-work-per-peer")
+		case "libp2p-max-conns":
+			cfg.Node.ResourceLimits.MaxConns = cctx.Int("libp2p-max-conns")
+		case "libp2p-max-streams":
+			cfg.Node.ResourceLimits.MaxStreams = cctx.Int("libp2p-max-streams")
+		case "libp2p-max-memory":
+			cfg.Node.ResourceLimits.MaxMemory = cctx.Int64("libp2p-max-memory")
+		case "libp2p-max-fd":
+			cfg.Node.ResourceLimits.MaxFD = cctx.Int("libp2p-max-fd")
 		case "bitswap-target-message-size":
 			cfg.Node.Bitswap.TargetMessageSize = cctx.Int("bitswap-target-message-size")
+		case "bitswap-no-provide":
+			cfg.Node.Bitswap.NoProvide = cctx.Bool("bitswap-no-provide")
 		case "rpc-incoming-queue-size":
 			cfg.RPCMessage.IncomingQueueSize = cctx.Int("rpc-incoming-queue-size")
 		case "rpc-outgoing-queue-size":
 			cfg.RPCMessage.OutgoingQueueSize = cctx.Int("rpc-outgoing-queue-size")
 		case "rpc-queue-handlers":
 			cfg.RPCMessage.QueueHandlers = cctx.Int("rpc-queue-handlers")
+		case "rpc-graceful-close":
+			cfg.RPCMessage.GracefulClose = cctx.Bool("rpc-graceful-close")
+		case "rpc-inline-aggregate-max-size":
+			cfg.RPCMessage.InlineAggregateMaxSize = cctx.Int("rpc-inline-aggregate-max-size")
 		case "staging-bucket":
 			cfg.StagingBucket.Enabled = cctx.Bool("staging-bucket")
+		case "staging-bucket-max-items":
+			cfg.StagingBucket.MaxItems = cctx.Int("staging-bucket-max-items")
+		case "staging-bucket-min-size":
+			cfg.StagingBucket.MinSize = cctx.Int64("staging-bucket-min-size")
+		case "staging-bucket-max-size":
+			cfg.StagingBucket.MaxSize = cctx.Int64("staging-bucket-max-size")
 		case "indexer-url":
 			cfg.Node.IndexerURL = cctx.String("indexer-url")
 		case "indexer-tick-interval":
@@ -205,18 +264,53 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			}
 
 		case "max-price":
-			maxPrice, err := types.ParseFIL(cctx.String("max-price"))
+			maxPrice, err := config.ParseFIL(cctx.String("max-price"))
 			if err != nil {
 				return fmt.Errorf("failed to parse max-price %s: %w", cctx.String("max-price"), err)
 			}
-			cfg.Deal.MaxPrice = abi.TokenAmount(maxPrice)
+			cfg.Deal.MaxPrice = config.DealPrice(maxPrice)
 
 		case "max-verified-price":
-			maxVerifiedPrice, err := types.ParseFIL(cctx.String("max-verified-price"))
+			maxVerifiedPrice, err := config.ParseFIL(cctx.String("max-verified-price"))
 			if err != nil {
 				return fmt.Errorf("failed to parse max-verified-price %s: %w", cctx.String("max-verified-price"), err)
 			}
-			cfg.Deal.MaxVerifiedPrice = abi.TokenAmount(maxVerifiedPrice)
+			cfg.Deal.MaxVerifiedPrice = config.DealPrice(maxVerifiedPrice)
+
+		case "max-provider-collateral":
+			maxProviderCollateral, err := config.ParseFIL(cctx.String("max-provider-collateral"))
+			if err != nil {
+				return fmt.Errorf("failed to parse max-provider-collateral %s: %w", cctx.String("max-provider-collateral"), err)
+			}
+			cfg.Deal.MaxProviderCollateral = maxProviderCollateral
+
+		case "client-collateral":
+			clientCollateral, err := config.ParseFIL(cctx.String("client-collateral"))
+			if err != nil {
+				return fmt.Errorf("failed to parse client-collateral %s: %w", cctx.String("client-collateral"), err)
+			}
+			cfg.Deal.ClientCollateral = clientCollateral
+
+		case "min-wallet-balance":
+			minWalletBalance, err := config.ParseFIL(cctx.String("min-wallet-balance"))
+			if err != nil {
+				return fmt.Errorf("failed to parse min-wallet-balance %s: %w", cctx.String("min-wallet-balance"), err)
+			}
+			cfg.Deal.MinWalletBalance = minWalletBalance
+		case "deal-wallets":
+			var wallets []config.DealWallet
+			for _, s := range cctx.StringSlice("deal-wallets") {
+				w, err := config.ParseDealWallet(s)
+				if err != nil {
+					return err
+				}
+				wallets = append(wallets, w)
+			}
+			cfg.Deal.Wallets = wallets
+		case "deal-min-car-size":
+			cfg.Deal.CarSize.Min = cctx.Int64("deal-min-car-size")
+		case "deal-max-car-size":
+			cfg.Deal.CarSize.Max = cctx.Int64("deal-max-car-size")
 
 		default:
 		}
@@ -257,6 +351,11 @@ func main() {
 			Usage:   "lotus api gateway url",
 			EnvVars: []string{"FULLNODE_API_INFO"},
 		},
+		&cli.StringSliceFlag{
+			Name:  "node-api-fallback-url",
+			Usage: "lotus api gateway urls tried in order when node-api-url is unreachable",
+			Value: cli.NewStringSlice(cfg.Node.FallbackApiURLs...),
+		},
 		&cli.StringFlag{
 			Name:  "config",
 			Usage: "specify configuration file location",
@@ -274,6 +373,42 @@ func main() {
 			Value:   cfg.ApiListen,
 			EnvVars: []string{"ESTUARY_API_LISTEN"},
 		},
+		&cli.StringFlag{
+			Name:    "internal-listen",
+			Usage:   "address for the internal metrics/pprof server to listen on, keep it off the public network (empty disables it)",
+			Value:   cfg.InternalListen,
+			EnvVars: []string{"ESTUARY_INTERNAL_LISTEN"},
+		},
+		&cli.DurationFlag{
+			Name:  "server-read-header-timeout",
+			Usage: "time allowed to read the headers of an api request",
+			Value: cfg.Server.ReadHeaderTimeout,
+		},
+		&cli.DurationFlag{
+			Name:  "server-read-timeout",
+			Usage: "time allowed to read a whole api request, body included (0 disables it)",
+			Value: cfg.Server.ReadTimeout,
+		},
+		&cli.DurationFlag{
+			Name:  "server-write-timeout",
+			Usage: "time allowed to write an api response (0 disables it)",
+			Value: cfg.Server.WriteTimeout,
+		},
+		&cli.DurationFlag{
+			Name:  "server-idle-timeout",
+			Usage: "time an idle keep-alive api connection is kept open",
+			Value: cfg.Server.IdleTimeout,
+		},
+		&cli.Int64Flag{
+			Name:  "max-body-size",
+			Usage: "max size in bytes of an api request body, the add endpoints have their own limit",
+			Value: cfg.Server.MaxBodySize,
+		},
+		&cli.Int64Flag{
+			Name:  "max-add-body-size",
+			Usage: "max size in bytes of an upload to the add endpoints (0 disables it)",
+			Value: cfg.Server.MaxAddBodySize,
+		},
 		&cli.StringFlag{
 			Name:    "announce",
 			Usage:   "announce address for the libp2p server to listen on",
@@ -326,6 +461,21 @@ func main() {
 			Usage: "consider deals failed when the transfer to the miner fails",
 			Value: cfg.Deal.FailOnTransferFailure,
 		},
+		&cli.Int64Flag{
+			Name:  "deal-duration",
+			Usage: "duration of the deals made, in epochs",
+			Value: int64(cfg.Deal.Duration),
+		},
+		&cli.BoolFlag{
+			Name:  "lazy-commp",
+			Usage: "only compute the piece commitment of content once a deal is about to be made for it",
+			Value: cfg.Deal.LazyCommP,
+		},
+		&cli.IntFlag{
+			Name:  "auto-offload-sealed-deals",
+			Usage: "offload the hot copy of contents that opted in once this many of their deals are sealed (0 disables it)",
+			Value: cfg.Deal.AutoOffloadSealedDeals,
+		},
 		&cli.BoolFlag{
 			Name:  "disable-new-deals",
 			Usage: "prevents the worker from making any new deals, but existing deals will still be updated/checked",
@@ -351,11 +501,31 @@ func main() {
 			Usage: "disallow new content ingestion on this node (shuttles are unaffected)",
 			Value: cfg.Content.DisableLocalAdding,
 		},
+		&cli.DurationFlag{
+			Name:  "pin-root-validation-timeout",
+			Usage: "reject pins whose root block the shuttle cannot fetch from their origins within this long (0 disables the check)",
+			Value: cfg.Content.PinRootValidationTimeout,
+		},
+		&cli.DurationFlag{
+			Name:  "pin-timeout",
+			Usage: "how long a pin may take in total before it fails, whatever progress it makes",
+			Value: cfg.Content.PinTimeout,
+		},
+		&cli.StringFlag{
+			Name:  "pin-queue-dir",
+			Usage: "directory the pin queue and its duplicate guard are kept in, relative to the data dir unless absolute (defaults to the data dir)",
+			Value: cfg.Content.PinQueueDir,
+		},
 		&cli.StringFlag{
 			Name:  "blockstore",
 			Usage: "specify blockstore parameters",
 			Value: cfg.Node.Blockstore,
 		},
+		&cli.StringFlag{
+			Name:  "blockstore-type",
+			Usage: "blockstore backend, one of lmdb, flatfs or badger, the blockstore is then a plain path",
+			Value: cfg.Node.BlockstoreType,
+		},
 		&cli.BoolFlag{
 			Name:  "write-log-truncate",
 			Usage: "enables log truncating",
@@ -366,11 +536,36 @@ func main() {
 			Usage: "enable hard flushing blockstore",
 			Value: cfg.Node.HardFlushWriteLog,
 		},
+		&cli.Int64Flag{
+			Name:  "write-log-max-size",
+			Usage: "flush and compact the write log into the blockstore once it grows over this many bytes (0 disables it)",
+			Value: cfg.Node.WriteLogMaxSize,
+		},
+		&cli.DurationFlag{
+			Name:  "write-log-check-interval",
+			Usage: "how often the size of the write log is checked",
+			Value: cfg.Node.WriteLogCheckInterval,
+		},
+		&cli.BoolFlag{
+			Name:  "ephemeral-identity",
+			Usage: "run with a new libp2p identity that is not persisted, for test deployments",
+			Value: cfg.Node.EphemeralIdentity,
+		},
 		&cli.BoolFlag{
 			Name:  "no-blockstore-cache",
 			Usage: "disable blockstore caching",
 			Value: cfg.Node.NoBlockstoreCache,
 		},
+		&cli.IntFlag{
+			Name:  "blockstore-read-cache-size",
+			Usage: "number of blocks to keep in the blockstore read cache, 0 disables it",
+			Value: cfg.Node.BlockstoreCache.ReadCacheSize,
+		},
+		&cli.StringFlag{
+			Name:  "blockstore-read-cache-policy",
+			Usage: "eviction policy for the blockstore read cache (lru, 2q or arc)",
+			Value: cfg.Node.BlockstoreCache.ReadCachePolicy,
+		},
 		&cli.IntFlag{
 			Name:  "replication",
 			Usage: "sets replication factor",
@@ -401,11 +596,36 @@ func main() {
 			Usage: "sets the bitswap max work per peer",
 			Value: cfg.Node.Bitswap.MaxOutstandingBytesPerPeer,
 		},
+		&cli.IntFlag{
+			Name:  "libp2p-max-conns",
+			Usage: "caps the libp2p connections, starting the resource manager even with no limiter (0 keeps the configured limits)",
+			Value: cfg.Node.ResourceLimits.MaxConns,
+		},
+		&cli.IntFlag{
+			Name:  "libp2p-max-streams",
+			Usage: "caps the libp2p streams, starting the resource manager even with no limiter (0 keeps the configured limits)",
+			Value: cfg.Node.ResourceLimits.MaxStreams,
+		},
+		&cli.Int64Flag{
+			Name:  "libp2p-max-memory",
+			Usage: "caps the memory libp2p may reserve in bytes, starting the resource manager even with no limiter (0 keeps the configured limits)",
+			Value: cfg.Node.ResourceLimits.MaxMemory,
+		},
+		&cli.IntFlag{
+			Name:  "libp2p-max-fd",
+			Usage: "caps the file descriptors libp2p may use, starting the resource manager even with no limiter (0 keeps the configured limits)",
+			Value: cfg.Node.ResourceLimits.MaxFD,
+		},
 		&cli.IntFlag{
 			Name:  "bitswap-target-message-size",
 			Usage: "sets the bitswap target message size",
 			Value: cfg.Node.Bitswap.TargetMessageSize,
 		},
+		&cli.BoolFlag{
+			Name:  "bitswap-no-provide",
+			Usage: "do not announce the blocks fetched over bitswap, only the roots of pins, required for unannounced pins",
+			Value: cfg.Node.Bitswap.NoProvide,
+		},
 		&cli.IntFlag{
 			Name:  "rpc-incoming-queue-size",
 			Usage: "sets incoming rpc message queue size",
@@ -421,11 +641,36 @@ func main() {
 			Usage: "sets rpc message handler count",
 			Value: cfg.RPCMessage.QueueHandlers,
 		},
+		&cli.BoolFlag{
+			Name:  "rpc-graceful-close",
+			Usage: "send a goodbye message to connected shuttles before closing their rpc connections on shutdown",
+			Value: cfg.RPCMessage.GracefulClose,
+		},
+		&cli.IntFlag{
+			Name:  "rpc-inline-aggregate-max-size",
+			Usage: "largest aggregate block sent inline to shuttles, larger ones are fetched by the shuttle over bitswap (0 always sends it inline)",
+			Value: cfg.RPCMessage.InlineAggregateMaxSize,
+		},
 		&cli.BoolFlag{
 			Name:  "staging-bucket",
 			Usage: "enable staging bucket",
 			Value: cfg.StagingBucket.Enabled,
 		},
+		&cli.IntFlag{
+			Name:  "staging-bucket-max-items",
+			Usage: "number of contents a staging bucket holds before it is aggregated",
+			Value: cfg.StagingBucket.MaxItems,
+		},
+		&cli.Int64Flag{
+			Name:  "staging-bucket-min-size",
+			Usage: "size in bytes a staging bucket must reach before it is aggregated",
+			Value: cfg.StagingBucket.MinSize,
+		},
+		&cli.Int64Flag{
+			Name:  "staging-bucket-max-size",
+			Usage: "size in bytes a staging bucket can hold at most, larger contents get deals of their own",
+			Value: cfg.StagingBucket.MaxSize,
+		},
 		&cli.StringSliceFlag{
 			Name:  "deal-protocol-version",
 			Usage: "sets the deal protocol version. defaults to v110 (go-fil-markets) and v120 (boost)",
@@ -442,14 +687,43 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:  "max-price",
-			Usage: "sets the max price for non-verified deals",
+			Usage: "sets the max price for non-verified deals, in FIL per GiB per epoch",
 			Value: cfg.Deal.MaxPrice.String(),
 		},
 		&cli.StringFlag{
 			Name:  "max-verified-price",
-			Usage: "sets the max price for verified deals",
+			Usage: "sets the max price for verified deals, in FIL per GiB per epoch",
 			Value: cfg.Deal.MaxVerifiedPrice.String(),
 		},
+		&cli.StringFlag{
+			Name:  "max-provider-collateral",
+			Usage: "sets the max provider collateral deals are proposed with, in FIL (0 leaves it unbounded)",
+			Value: cfg.Deal.MaxProviderCollateral.String(),
+		},
+		&cli.StringFlag{
+			Name:  "client-collateral",
+			Usage: "sets the client collateral offered in deal proposals, in FIL",
+			Value: cfg.Deal.ClientCollateral.String(),
+		},
+		&cli.StringFlag{
+			Name:  "min-wallet-balance",
+			Usage: "sets the wallet balance, in FIL, under which deal making is deferred (0 disables the check)",
+			Value: cfg.Deal.MinWalletBalance.String(),
+		},
+		&cli.StringSliceFlag{
+			Name:  "deal-wallets",
+			Usage: "spreads deals over these wallets of the node, given as address:weight, instead of making them all from the default wallet",
+		},
+		&cli.Int64Flag{
+			Name:  "deal-min-car-size",
+			Usage: "size in bytes of the smallest CAR deals are made for",
+			Value: cfg.Deal.CarSize.Min,
+		},
+		&cli.Int64Flag{
+			Name:  "deal-max-car-size",
+			Usage: "size in bytes of the largest CAR deals are made for, at most what a 64GiB piece holds",
+			Value: cfg.Deal.CarSize.Max,
+		},
 	}
 	app.Commands = []*cli.Command{
 		{
@@ -566,6 +840,31 @@ func main() {
 				return cfg.Save(configFile)
 			},
 		},
+		{
+			Name:  "rotate-key",
+			Usage: "Replaces the libp2p identity of the node with a new one, content is reprovided under it on the next start",
+			Action: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized { // still want to report parsing errors
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				if cfg.Node.EphemeralIdentity {
+					return errors.New("the node runs with an ephemeral identity, there is no key to rotate")
+				}
+
+				oldID, newID, err := node.RotatePeerKey(cfg.Node.Libp2pKeyFile)
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("rotated peer identity from %s to %s, restart the node to use it\n", oldID, newID)
+				return nil
+			},
+		},
 	}
 	app.Action = func(cctx *cli.Context) error {
 		log.Infof("estuary version: %s", appVersion)
@@ -578,16 +877,32 @@ func main() {
 			return err
 		}
 
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
 		db, err := setupDatabase(cfg.DatabaseConnString)
 		if err != nil {
 			return err
 		}
+		defer func() {
+			if sqldb, err := db.DB(); err == nil {
+				if err := sqldb.Close(); err != nil {
+					log.Errorf("failed to close the database: %s", err)
+				}
+			}
+		}()
 
 		init := Initializer{&cfg.Node, db, nil}
 		nd, err := node.Setup(cctx.Context, &init)
 		if err != nil {
 			return err
 		}
+		defer func() {
+			if err := nd.Datastore.Close(); err != nil {
+				log.Errorf("failed to close the datastore: %s", err)
+			}
+		}()
 
 		if err = view.Register(metrics.DefaultViews...); err != nil {
 			log.Fatalf("Cannot register the OpenCensus view: %v", err)
@@ -604,21 +919,11 @@ func main() {
 			return err
 		}
 
-		// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
-		// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
-		flset := flag.NewFlagSet("lotus", flag.ExitOnError)
-		flset.String("api-url", "", "node api url")
-		err = flset.Set("api-url", cfg.Node.ApiURL)
-		if err != nil {
-			return err
-		}
-
-		ncctx := cli.NewContext(cli.NewApp(), flset, nil)
-		api, closer, err := lcli.GetGatewayAPI(ncctx)
+		api, err := util.NewChainAPI(cfg.Node.ChainEndpoints())
 		if err != nil {
 			return err
 		}
-		defer closer()
+		defer api.Close()
 
 		// setup tracing to jaeger if enabled
 		if cfg.Jaeger.EnableTracing {
@@ -645,7 +950,8 @@ func main() {
 		// TODO: this is an ugly self referential hack... should fix
 		pinmgr := pinner.NewPinManager(s.doPinning, s.PinStatusFunc, &pinner.PinManagerOpts{
 			MaxActivePerUser: 20,
-			QueueDataDir:     cfg.DataDir,
+			QueueDataDir:     cfg.Content.PinQueueDir,
+			PinTimeout:       cfg.Content.PinTimeout,
 		})
 		go pinmgr.Run(50)
 
@@ -744,6 +1050,8 @@ func main() {
 
 		go cm.Run(cctx.Context)                                                 // deal making and deal reconciliation
 		go cm.handleShuttleMessages(cctx.Context, cfg.RPCMessage.QueueHandlers) // register workers/handlers to process shuttle rpc messages from a channel(queue)
+		go cm.watchShuttleHealth(cctx.Context)
+		go cm.watchPinCompleteChunks(cctx.Context)
 
 		// Start autoretrieve if not disabled
 		if !cfg.DisableAutoRetrieve {
@@ -764,7 +1072,36 @@ func main() {
 			}
 		}()
 
-		return s.ServeAPI()
+		// cancelled to shut down, the api stops serving and the deferred
+		// cleanups run as this returns
+		runCtx, shutdown := context.WithCancel(cctx.Context)
+		defer shutdown()
+
+		if cfg.RPCMessage.GracefulClose {
+			go func() {
+				sigCh := make(chan os.Signal, 1)
+				signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+				sig := <-sigCh
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+				cm.sayGoodbyeToShuttles(ctx, fmt.Sprintf("estuary shutting down (%s)", sig))
+				cancel()
+
+				// give the connection writers a moment to flush the goodbyes
+				time.Sleep(time.Second)
+				shutdown()
+			}()
+		}
+
+		if cfg.InternalListen != "" {
+			go func() {
+				if err := s.ServeInternal(); err != nil {
+					log.Errorf("internal server failed: %s", err)
+				}
+			}()
+		}
+
+		return s.ServeAPI(runCtx)
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -821,6 +1158,7 @@ func migrateSchemas(db *gorm.DB) error {
 		&util.AuthToken{},
 		&util.InviteCode{},
 		&Shuttle{},
+		&userStagingZoneSize{},
 		&autoretrieve.Autoretrieve{}); err != nil {
 		return err
 	}
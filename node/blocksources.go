@@ -0,0 +1,43 @@
+package node
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// number of recently received blocks to remember the sending peer for
+const blockSourcesCacheSize = 100000
+
+// BlockSources is a bitswap tracer that remembers which peer sent us each
+// recently received block, so that callers walking a freshly fetched dag can
+// tell which providers actually served it
+type BlockSources struct {
+	cache *lru.ARCCache
+}
+
+func NewBlockSources(size int) (*BlockSources, error) {
+	cache, err := lru.NewARC(size)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockSources{cache: cache}, nil
+}
+
+func (bs *BlockSources) MessageReceived(p peer.ID, msg bsmsg.BitSwapMessage) {
+	for _, blk := range msg.Blocks() {
+		bs.cache.Add(blk.Cid(), p)
+	}
+}
+
+func (bs *BlockSources) MessageSent(peer.ID, bsmsg.BitSwapMessage) {}
+
+// SourceOf returns the peer we last received the given block from, if known
+func (bs *BlockSources) SourceOf(c cid.Cid) (peer.ID, bool) {
+	v, ok := bs.cache.Get(c)
+	if !ok {
+		return "", false
+	}
+	return v.(peer.ID), true
+}
@@ -0,0 +1,138 @@
+package node
+
+import (
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// the peer id the node last ran with, to notice when its identity changed
+var lastPeerIDKey = datastore.NewKey("/estuary/node/peer-id")
+
+// loadPeerKey returns the identity of the node, a throwaway one when the
+// node runs with an ephemeral identity
+func loadPeerKey(cfg *config.Node) (crypto.PrivKey, error) {
+	if !cfg.EphemeralIdentity {
+		return loadOrInitPeerKey(cfg.Libp2pKeyFile)
+	}
+
+	k, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	log.Warnf("running with an ephemeral identity, it is lost when the node stops")
+	return k, nil
+}
+
+// checkPeerKeyFileMode refuses key files other users can read or write. The
+// group may read them, as it does on secret volumes mounted by kubernetes.
+func checkPeerKeyFileMode(kf string) error {
+	fi, err := os.Stat(kf)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode().Perm()&0037 != 0 {
+		return fmt.Errorf("peer key file %s is accessible by other users (mode %o), restrict it to its owner with chmod 600", kf, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// RotatePeerKey replaces the key in the key file with a new one. The old key
+// is kept next to it, suffixed with the time of the rotation, so the rotation
+// can be undone.
+func RotatePeerKey(kf string) (peer.ID, peer.ID, error) {
+	kf = filepath.Clean(kf)
+
+	oldKey, err := loadOrInitPeerKey(kf)
+	if err != nil {
+		return "", "", err
+	}
+
+	oldID, err := peer.IDFromPrivateKey(oldKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	newKey, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	newID, err := peer.IDFromPrivateKey(newKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	data, err := crypto.MarshalPrivateKey(newKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	backup := fmt.Sprintf("%s.%s", kf, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.Link(kf, backup); err != nil {
+		return "", "", fmt.Errorf("failed to back up the old peer key: %w", err)
+	}
+
+	// write the new key next to the file and swap it in so the key file is
+	// never left half written
+	tmp := kf + ".new"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return "", "", err
+	}
+
+	if err := os.Rename(tmp, kf); err != nil {
+		return "", "", err
+	}
+
+	return oldID, newID, nil
+}
+
+type reprovider interface {
+	Reprovide(context.Context) error
+}
+
+// reprovideOnIdentityChange announces all the content of the node again when
+// it runs with another identity than last time. The provider records of the
+// old peer id point to an address nobody answers on anymore and only expire
+// after a day, until the new records are out the content is hard to find.
+func reprovideOnIdentityChange(ctx context.Context, ds datastore.Datastore, id peer.ID, prov reprovider) error {
+	last, err := ds.Get(ctx, lastPeerIDKey)
+	if err != nil && err != datastore.ErrNotFound {
+		return err
+	}
+
+	if string(last) == string(id) {
+		return nil
+	}
+
+	if err := ds.Put(ctx, lastPeerIDKey, []byte(id)); err != nil {
+		return err
+	}
+
+	// a new node has nothing to announce yet
+	if last == nil {
+		return nil
+	}
+
+	lastID := peer.ID(last)
+	log.Warnf("node identity changed from %s to %s, reproviding all content", lastID, id)
+
+	go func() {
+		start := time.Now()
+		if err := prov.Reprovide(context.Background()); err != nil {
+			log.Errorf("failed to reprovide content after the identity change: %s", err)
+			return
+		}
+		log.Infof("reprovided all content after the identity change in %s", time.Since(start))
+	}()
+	return nil
+}
@@ -0,0 +1,100 @@
+package node
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestRotatePeerKey(t *testing.T) {
+	kf := filepath.Join(t.TempDir(), "peer.key")
+
+	k, err := loadOrInitPeerKey(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := peer.IDFromPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldID, newID, err := RotatePeerKey(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldID != id || newID == id {
+		t.Fatalf("expected rotation away from %s, got %s -> %s", id, oldID, newID)
+	}
+
+	k, err = loadOrInitPeerKey(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := peer.IDFromPrivateKey(k); got != newID {
+		t.Fatalf("key file has identity %s, expected %s", got, newID)
+	}
+
+	backups, err := filepath.Glob(kf + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected the old key to be backed up, found %v", backups)
+	}
+
+	if err := os.Chmod(kf, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOrInitPeerKey(kf); err != nil {
+		t.Fatalf("a key file readable by its group should be accepted: %s", err)
+	}
+
+	if err := os.Chmod(kf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOrInitPeerKey(kf); err == nil {
+		t.Fatal("a key file readable by other users should be refused")
+	}
+}
+
+type testReprovider chan struct{}
+
+func (r testReprovider) Reprovide(context.Context) error {
+	r <- struct{}{}
+	return nil
+}
+
+func TestReprovideOnIdentityChange(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+	prov := make(testReprovider, 1)
+
+	// first start and restarts with the same identity
+	for i := 0; i < 2; i++ {
+		if err := reprovideOnIdentityChange(ctx, ds, peer.ID("first"), prov); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := reprovideOnIdentityChange(ctx, ds, peer.ID("second"), prov); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-prov:
+	case <-time.After(time.Second):
+		t.Fatal("expected a reprovide after the identity changed")
+	}
+
+	select {
+	case <-prov:
+		t.Fatal("expected a single reprovide")
+	default:
+	}
+}
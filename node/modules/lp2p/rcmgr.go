@@ -24,7 +24,9 @@ func NewResourceManager(limits *rcmgr.ScalingLimitConfig) (network.ResourceManag
 	opts = append(opts, rcmgr.WithMetrics(rcmgrMetrics{}))
 	libp2p.SetDefaultServiceLimits(limits)
 	limitConfig := limits.AutoScale()
-	limitConfig.Apply(rcmgr.DefaultLimits.AutoScale())
+	defaults := rcmgr.DefaultLimits.AutoScale()
+	limitConfig.Apply(defaults)
+	warnHighLimits(limitConfig.System, defaults.System)
 	log.Infof("establishing limits: %v", limitConfig)
 	mgr, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limitConfig), opts...)
 	if err != nil {
@@ -33,6 +35,36 @@ func NewResourceManager(limits *rcmgr.ScalingLimitConfig) (network.ResourceManag
 	return mgr, nil
 }
 
+// NewCappedResourceManager starts a resource manager enforcing the limits as
+// they are, without the scaled defaults of libp2p
+func NewCappedResourceManager(limits rcmgr.LimitConfig) (network.ResourceManager, error) {
+	log.Infof("establishing limits: %v", limits)
+	mgr, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits), rcmgr.WithMetrics(rcmgrMetrics{}))
+	if err != nil {
+		return nil, fmt.Errorf("error creating resource manager: %w", err)
+	}
+	return mgr, nil
+}
+
+// highLimitFactor is how far over the libp2p defaults for this machine a
+// system limit may go before it risks running out of memory or fds
+const highLimitFactor = 4
+
+// warnHighLimits warns about the system limits set far over the libp2p
+// defaults, which scale with the memory and fds of the machine
+func warnHighLimits(limits rcmgr.BaseLimit, defaults rcmgr.BaseLimit) {
+	check := func(name string, limit, def int64) {
+		if def > 0 && limit > def*highLimitFactor {
+			log.Warnf("system %s limit of %d is over %d times the default of %d for this machine, the node may run out of resources", name, limit, highLimitFactor, def)
+		}
+	}
+
+	check("conns", int64(limits.Conns), int64(defaults.Conns))
+	check("streams", int64(limits.Streams), int64(defaults.Streams))
+	check("memory", limits.Memory, defaults.Memory)
+	check("fd", int64(limits.FD), int64(defaults.FD))
+}
+
 type rcmgrMetrics struct{}
 
 func (r rcmgrMetrics) Conn(dir network.Direction, usefd bool, op string) {
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/application-research/estuary/node/modules/peering"
 
@@ -109,6 +110,9 @@ type Node struct {
 	Blockstore      blockstore.Blockstore
 	Bitswap         *bitswap.Bitswap
 	NotifBlockstore *NotifyBlockstore
+	BlockSources    *BlockSources
+	// Set when a secondary blockstore is configured
+	Tiered *TieredBlockstore
 
 	Wallet *wallet.LocalWallet
 
@@ -121,7 +125,7 @@ type Node struct {
 func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 	cfg := init.Config()
 
-	peerkey, err := loadOrInitPeerKey(cfg.Libp2pKeyFile)
+	peerkey, err := loadPeerKey(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -132,12 +136,19 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 	}
 
 	var rcm network.ResourceManager
-	if cfg.NoLimiter {
+	if cfg.NoLimiter && !cfg.ResourceLimits.IsSet() {
 		rcm = network.NullResourceManager
 		log.Warnf("starting node with no resource limits")
+	} else if cfg.NoLimiter {
+		log.Warnf("no limiter is set along with resource limits, starting the resource manager to enforce only them")
+		rcm, err = rcmgr.NewCappedResourceManager(cfg.CappedLimits())
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		log.Infof("initializing new resource manager with resource limits")
-		rcm, err = rcmgr.NewResourceManager(&cfg.Limits)
+		limits := cfg.ScalingLimits()
+		rcm, err = rcmgr.NewResourceManager(&limits)
 		if err != nil {
 			return nil, err
 		}
@@ -232,7 +243,7 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		return nil, err
 	}
 
-	mbs, stordir, err := loadBlockstore(cfg.Blockstore, cfg.WriteLogDir, cfg.HardFlushWriteLog, cfg.WriteLogTruncate, cfg.NoBlockstoreCache)
+	mbs, tiered, stordir, err := loadBlockstore(cfg.BlockstoreType, cfg.BlockstoreOptions, cfg.Blockstore, cfg.SecondaryBlockstore, cfg.WriteLogDir, cfg.HardFlushWriteLog, cfg.WriteLogTruncate, cfg.WriteLogMaxSize, cfg.WriteLogCheckInterval, cfg.NoBlockstoreCache, cfg.BlockstoreCache)
 	if err != nil {
 		return nil, err
 	}
@@ -261,6 +272,16 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		bsopts = append(bsopts, bitswap.WithTargetMessageSize(tms))
 	}
 
+	if cfg.Bitswap.NoProvide {
+		bsopts = append(bsopts, bitswap.ProvideEnabled(false))
+	}
+
+	blkSources, err := NewBlockSources(blockSourcesCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	bsopts = append(bsopts, bitswap.WithTracer(blkSources))
+
 	bsctx := metri.CtxScope(ctx, "estuary.exch")
 	bswap := bitswap.New(bsctx, bsnet, blkst, bsopts...)
 
@@ -284,6 +305,10 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 
 	prov.Run() // TODO: call close at some point
 
+	if err := reprovideOnIdentityChange(ctx, ds, h.ID(), prov); err != nil {
+		return nil, xerrors.Errorf("checking for a node identity change: %w", err)
+	}
+
 	return &Node{
 		Dht:        ipfsdht,
 		FilDht:     fildht,
@@ -292,13 +317,15 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		Host:       h,
 		Blockstore: mbs,
 		//Lmdb:       lmdbs,
-		Datastore:  ds,
-		Bitswap:    bswap,
-		Wallet:     wallet,
-		Bwc:        bwc,
-		Config:     cfg,
-		StorageDir: stordir,
-		Peering:    peerServ,
+		Datastore:    ds,
+		Bitswap:      bswap,
+		BlockSources: blkSources,
+		Tiered:       tiered,
+		Wallet:       wallet,
+		Bwc:          bwc,
+		Config:       cfg,
+		StorageDir:   stordir,
+		Peering:      peerServ,
 	}, nil
 }
 
@@ -434,10 +461,64 @@ func constructBlockstore(bscfg string) (EstuaryBlockstore, string, error) {
 	}
 }
 
-func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool) (blockstore.Blockstore, string, error) {
-	bstore, dir, err := constructBlockstore(bscfg)
+// openBlockstore opens the primary blockstore at path with the backend of the
+// given type, an empty type leaves it to the legacy spec constructBlockstore
+// parses
+func openBlockstore(bstype string, opts config.BlockstoreOptions, path string) (EstuaryBlockstore, string, error) {
+	switch bstype {
+	case "":
+		return constructBlockstore(path)
+	case config.BlockstoreTypeLmdb:
+		lmdbs, err := lmdb.Open(&lmdb.Options{
+			Path:   path,
+			NoSync: opts.Lmdb.NoSync,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		return lmdbs, path, nil
+	case config.BlockstoreTypeFlatfs:
+		sf, err := flatfs.ParseShardFunc(opts.Flatfs.ShardFunc)
+		if err != nil {
+			return nil, "", err
+		}
+
+		ds, err := flatfs.CreateOrOpen(path, sf, opts.Flatfs.Sync)
+		if err != nil {
+			return nil, "", err
+		}
+		return &deleteManyWrap{blockstore.NewBlockstoreNoPrefix(ds)}, path, nil
+	case config.BlockstoreTypeBadger:
+		bopts := badgerbs.DefaultOptions(path)
+		bopts.SyncWrites = opts.Badger.SyncWrites
+		if opts.Badger.ValueLogFileSize > 0 {
+			bopts.ValueLogFileSize = opts.Badger.ValueLogFileSize
+		}
+
+		bbs, err := badgerbs.Open(bopts)
+		if err != nil {
+			return nil, "", err
+		}
+		return bbs, path, nil
+	default:
+		return nil, "", fmt.Errorf("unrecognized blockstore type: %q", bstype)
+	}
+}
+
+func loadBlockstore(bstype string, bsopts config.BlockstoreOptions, bscfg string, secondary string, wal string, flush, walTruncate bool, walMaxSize int64, walCheckInterval time.Duration, nocache bool, cachecfg config.BlockstoreCache) (blockstore.Blockstore, *TieredBlockstore, string, error) {
+	bstore, dir, err := openBlockstore(bstype, bsopts, bscfg)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, "", err
+	}
+
+	var tiered *TieredBlockstore
+	if secondary != "" {
+		sbstore, _, err := constructBlockstore(secondary)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("failed to construct secondary blockstore: %w", err)
+		}
+		tiered = NewTieredBlockstore(bstore, sbstore)
+		bstore = tiered
 	}
 	bstore = newIdBlockstore(bstore)
 
@@ -447,24 +528,33 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 
 		writelog, err := badgerbs.Open(opts)
 		if err != nil {
-			return nil, "", err
+			return nil, nil, "", err
 		}
 
 		ab, err := autobatch.NewBlockstore(bstore, writelog, 200, 200, flush)
 		if err != nil {
-			return nil, "", err
+			return nil, nil, "", err
+		}
+
+		if tiered != nil {
+			tiered.flushWriteLog = ab.Flush
 		}
 
 		if flush {
 			if err := ab.Flush(context.Background()); err != nil {
-				return nil, "", err
+				return nil, nil, "", err
 			}
 		}
 
 		if walTruncate {
-			return nil, "", fmt.Errorf("truncation and full flush complete, halting execution")
+			return nil, nil, "", fmt.Errorf("truncation and full flush complete, halting execution")
 		}
 
+		rotator := newWriteLogRotator(metri.CtxScope(context.TODO(), "estuary.bstore"), walMaxSize, writelog.Size, ab.Flush, func() error {
+			return writelog.CollectGarbage()
+		})
+		go rotator.run(context.TODO(), walCheckInterval)
+
 		bstore = ab
 	}
 
@@ -473,15 +563,28 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 	bstore = bsm.New("estuary.blks.base", bstore)
 
 	if !nocache {
+		hasCacheSize := cachecfg.HasCacheSize
+		if hasCacheSize == 0 {
+			hasCacheSize = 8 << 20
+		}
+
 		cbstore, err := blockstore.CachedBlockstore(ctx, bstore, blockstore.CacheOpts{
 			//HasBloomFilterSize:   512 << 20,
 			//HasBloomFilterHashes: 7,
-			HasARCCacheSize: 8 << 20,
+			HasARCCacheSize: hasCacheSize,
 		})
 		if err != nil {
-			return nil, "", err
+			return nil, nil, "", err
 		}
 		bstore = &deleteManyWrap{cbstore}
+
+		if cachecfg.ReadCacheSize > 0 {
+			rcbstore, err := newReadCacheBlockstore(ctx, bstore, cachecfg.ReadCachePolicy, cachecfg.ReadCacheSize)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			bstore = rcbstore
+		}
 	}
 
 	notifbs := NewNotifBs(bstore)
@@ -489,7 +592,7 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 
 	var blkst blockstore.Blockstore = mbs
 
-	return blkst, dir, nil
+	return blkst, tiered, dir, nil
 }
 
 func loadOrInitPeerKey(kf string) (crypto.PrivKey, error) {
@@ -515,6 +618,10 @@ func loadOrInitPeerKey(kf string) (crypto.PrivKey, error) {
 
 		return k, nil
 	}
+
+	if err := checkPeerKeyFileMode(kf); err != nil {
+		return nil, err
+	}
 	return crypto.UnmarshalPrivateKey(data)
 }
 
@@ -0,0 +1,124 @@
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/config"
+	lru "github.com/hashicorp/golang-lru"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	metri "github.com/ipfs/go-metrics-interface"
+)
+
+type blockCache interface {
+	Get(key interface{}) (interface{}, bool)
+	Add(key, value interface{})
+	Remove(key interface{})
+}
+
+// lruCache adapts lru.Cache to the blockCache interface
+type lruCache struct {
+	*lru.Cache
+}
+
+func (c lruCache) Add(key, value interface{}) {
+	c.Cache.Add(key, value)
+}
+
+func (c lruCache) Remove(key interface{}) {
+	c.Cache.Remove(key)
+}
+
+func newBlockCache(policy string, size int) (blockCache, error) {
+	switch policy {
+	case config.ReadCachePolicyLRU, "":
+		c, err := lru.New(size)
+		if err != nil {
+			return nil, err
+		}
+		return lruCache{c}, nil
+	case config.ReadCachePolicy2Q:
+		return lru.New2Q(size)
+	case config.ReadCachePolicyARC:
+		return lru.NewARC(size)
+	default:
+		return nil, fmt.Errorf("unrecognized blockstore read cache policy: %q", policy)
+	}
+}
+
+// readCacheBlockstore keeps recently read blocks in memory so that repeatedly
+// read blocks (e.g. the same roots being read for commP and data transfers)
+// don't go to disk every time. Blocks are cached by multihash, like they are
+// stored, so the cids of either version share an entry.
+type readCacheBlockstore struct {
+	EstuaryBlockstore
+
+	cache blockCache
+
+	hits  metri.Counter
+	total metri.Counter
+}
+
+func newReadCacheBlockstore(ctx context.Context, bstore EstuaryBlockstore, policy string, size int) (*readCacheBlockstore, error) {
+	cache, err := newBlockCache(policy, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &readCacheBlockstore{
+		EstuaryBlockstore: bstore,
+		cache:             cache,
+		hits:              metri.NewCtx(ctx, "readcache.hits_total", "number of blockstore reads served from the read cache").Counter(),
+		total:             metri.NewCtx(ctx, "readcache.total", "total number of blockstore reads that went through the read cache").Counter(),
+	}, nil
+}
+
+func readCacheKey(c cid.Cid) string {
+	return string(c.Hash())
+}
+
+// cached returns the data of the block of c if it is in the cache
+func (rc *readCacheBlockstore) cached(c cid.Cid) ([]byte, bool) {
+	v, ok := rc.cache.Get(readCacheKey(c))
+	if !ok {
+		return nil, false
+	}
+	data, ok := v.([]byte)
+	return data, ok
+}
+
+func (rc *readCacheBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	rc.total.Inc()
+	if data, ok := rc.cached(c); ok {
+		rc.hits.Inc()
+		return blocks.NewBlockWithCid(data, c)
+	}
+
+	blk, err := rc.EstuaryBlockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.cache.Add(readCacheKey(c), blk.RawData())
+	return blk, nil
+}
+
+func (rc *readCacheBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if data, ok := rc.cached(c); ok {
+		return len(data), nil
+	}
+	return rc.EstuaryBlockstore.GetSize(ctx, c)
+}
+
+func (rc *readCacheBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	rc.cache.Remove(readCacheKey(c))
+	return rc.EstuaryBlockstore.DeleteBlock(ctx, c)
+}
+
+func (rc *readCacheBlockstore) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		rc.cache.Remove(readCacheKey(c))
+	}
+	return rc.EstuaryBlockstore.DeleteMany(ctx, cids)
+}
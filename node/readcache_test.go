@@ -0,0 +1,37 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCacheSharesCidVersions(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	rc, err := newReadCacheBlockstore(ctx, newTestBlockstore(), config.ReadCachePolicyLRU, 16)
+	a.NoError(err)
+
+	blk := blocks.NewBlock([]byte("beep"))
+	a.NoError(rc.Put(ctx, blk))
+	v0 := blk.Cid()
+	v1 := cid.NewCidV1(cid.DagProtobuf, v0.Hash())
+
+	// a block read by one version is served by the other with its own cid
+	_, err = rc.Get(ctx, v0)
+	a.NoError(err)
+	got, err := rc.Get(ctx, v1)
+	a.NoError(err)
+	a.Equal(v1, got.Cid())
+	a.Equal(blk.RawData(), got.RawData())
+
+	// and deleting either version drops it from the cache
+	a.NoError(rc.DeleteBlock(ctx, v1))
+	_, err = rc.Get(ctx, v0)
+	a.Error(err)
+}
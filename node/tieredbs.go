@@ -0,0 +1,169 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// TieredBlockstore reads blocks from a primary and a secondary blockstore,
+// new blocks are always written to the primary. Blocks are moved to the
+// secondary with Relocate, which lets operators migrate pins to a new disk
+// while the node keeps serving them.
+type TieredBlockstore struct {
+	primary   EstuaryBlockstore
+	secondary EstuaryBlockstore
+
+	// flushes the write log in front of the blockstore, if any, so that
+	// the blocks it still holds are in the primary before relocating
+	flushWriteLog func(context.Context) error
+}
+
+func NewTieredBlockstore(primary, secondary EstuaryBlockstore) *TieredBlockstore {
+	return &TieredBlockstore{
+		primary:   primary,
+		secondary: secondary,
+	}
+}
+
+func (tbs *TieredBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	if err := tbs.primary.DeleteBlock(ctx, c); err != nil && !ipld.IsNotFound(err) {
+		return err
+	}
+	if err := tbs.secondary.DeleteBlock(ctx, c); err != nil && !ipld.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (tbs *TieredBlockstore) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	if err := tbs.primary.DeleteMany(ctx, cids); err != nil {
+		return err
+	}
+	return tbs.secondary.DeleteMany(ctx, cids)
+}
+
+func (tbs *TieredBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	has, err := tbs.primary.Has(ctx, c)
+	if err != nil || has {
+		return has, err
+	}
+	return tbs.secondary.Has(ctx, c)
+}
+
+func (tbs *TieredBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := tbs.primary.Get(ctx, c)
+	if err == nil || !ipld.IsNotFound(err) {
+		return blk, err
+	}
+	return tbs.secondary.Get(ctx, c)
+}
+
+func (tbs *TieredBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	size, err := tbs.primary.GetSize(ctx, c)
+	if err == nil || !ipld.IsNotFound(err) {
+		return size, err
+	}
+	return tbs.secondary.GetSize(ctx, c)
+}
+
+func (tbs *TieredBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	return tbs.primary.Put(ctx, blk)
+}
+
+func (tbs *TieredBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	return tbs.primary.PutMany(ctx, blks)
+}
+
+func (tbs *TieredBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	pch, err := tbs.primary.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sch, err := tbs.secondary.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		for _, ch := range []<-chan cid.Cid{pch, sch} {
+			for c := range ch {
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (tbs *TieredBlockstore) HashOnRead(enabled bool) {
+	tbs.primary.HashOnRead(enabled)
+	tbs.secondary.HashOnRead(enabled)
+}
+
+// Relocate copies the given blocks from the primary to the secondary
+// blockstore, verifying every copy before the originals are removed. The
+// write log is flushed first, blocks that still are not in the primary, in
+// the secondary already or missing, are skipped.
+func (tbs *TieredBlockstore) Relocate(ctx context.Context, cids []cid.Cid) error {
+	if tbs.flushWriteLog != nil {
+		if err := tbs.flushWriteLog(ctx); err != nil {
+			return fmt.Errorf("failed to flush the write log: %w", err)
+		}
+	}
+
+	var moved []cid.Cid
+	for _, c := range cids {
+		blk, err := tbs.primary.Get(ctx, c)
+		if err != nil {
+			if ipld.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		if err := verifyBlock(blk); err != nil {
+			return fmt.Errorf("refusing to relocate corrupted block: %w", err)
+		}
+
+		if err := tbs.secondary.Put(ctx, blk); err != nil {
+			return fmt.Errorf("failed to copy block %s: %w", c, err)
+		}
+
+		copied, err := tbs.secondary.Get(ctx, c)
+		if err != nil {
+			return fmt.Errorf("failed to read back copied block %s: %w", c, err)
+		}
+
+		if !bytes.Equal(copied.RawData(), blk.RawData()) {
+			return fmt.Errorf("copied block %s does not match the original", c)
+		}
+		moved = append(moved, c)
+	}
+
+	// only remove the originals once every block made it to the secondary
+	return tbs.primary.DeleteMany(ctx, moved)
+}
+
+// verifyBlock checks that the data of a block hashes to its cid
+func verifyBlock(blk blocks.Block) error {
+	computed, err := blk.Cid().Prefix().Sum(blk.RawData())
+	if err != nil {
+		return err
+	}
+
+	if !computed.Equals(blk.Cid()) {
+		return fmt.Errorf("block %s data hashes to %s", blk.Cid(), computed)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBlockstore() EstuaryBlockstore {
+	return &deleteManyWrap{blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))}
+}
+
+func TestTieredBlockstoreRelocate(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	primary := newTestBlockstore()
+	secondary := newTestBlockstore()
+	tbs := NewTieredBlockstore(primary, secondary)
+
+	var cids []cid.Cid
+	for _, data := range []string{"beep", "boop", "bop"} {
+		blk := blocks.NewBlock([]byte(data))
+		a.NoError(tbs.Put(ctx, blk))
+		cids = append(cids, blk.Cid())
+	}
+
+	a.NoError(tbs.Relocate(ctx, cids[:2]))
+
+	for i, c := range cids {
+		inPrimary, err := primary.Has(ctx, c)
+		a.NoError(err)
+		inSecondary, err := secondary.Has(ctx, c)
+		a.NoError(err)
+
+		relocated := i < 2
+		a.Equal(!relocated, inPrimary)
+		a.Equal(relocated, inSecondary)
+
+		// relocated or not, blocks are still served
+		blk, err := tbs.Get(ctx, c)
+		a.NoError(err)
+		a.Equal(c, blk.Cid())
+	}
+}
+
+func TestTieredBlockstoreRelocateCorrupted(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	primary := newTestBlockstore()
+	secondary := newTestBlockstore()
+	tbs := NewTieredBlockstore(primary, secondary)
+
+	good := blocks.NewBlock([]byte("beep"))
+	bad, err := blocks.NewBlockWithCid([]byte("corrupted"), blocks.NewBlock([]byte("boop")).Cid())
+	a.NoError(err)
+	a.NoError(primary.PutMany(ctx, []blocks.Block{good, bad}))
+
+	a.Error(tbs.Relocate(ctx, []cid.Cid{good.Cid(), bad.Cid()}))
+
+	// nothing is removed from the primary when the relocation fails
+	for _, c := range []cid.Cid{good.Cid(), bad.Cid()} {
+		has, err := primary.Has(ctx, c)
+		a.NoError(err)
+		a.True(has)
+	}
+}
+
+func TestTieredBlockstoreRelocateFlushesWriteLog(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	primary := newTestBlockstore()
+	secondary := newTestBlockstore()
+	tbs := NewTieredBlockstore(primary, secondary)
+
+	// a block still in the write log reaches the primary with the flush
+	blk := blocks.NewBlock([]byte("beep"))
+	var flushes int
+	tbs.flushWriteLog = func(ctx context.Context) error {
+		flushes++
+		return primary.Put(ctx, blk)
+	}
+
+	a.NoError(tbs.Relocate(ctx, []cid.Cid{blk.Cid()}))
+	a.Equal(1, flushes)
+
+	has, err := secondary.Has(ctx, blk.Cid())
+	a.NoError(err)
+	a.True(has)
+	has, err = primary.Has(ctx, blk.Cid())
+	a.NoError(err)
+	a.False(has)
+}
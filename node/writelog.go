@@ -0,0 +1,87 @@
+package node
+
+import (
+	"context"
+	"time"
+
+	metri "github.com/ipfs/go-metrics-interface"
+)
+
+// writeLogRotator keeps the write log from growing unbounded between
+// restarts: once it is over its max size every buffered block is flushed to
+// the blockstore and the write log is compacted
+type writeLogRotator struct {
+	maxSize int64
+
+	// size returns the size on disk of the write log, flush writes its blocks
+	// to the blockstore and compact reclaims the space they used
+	size    func() (int64, error)
+	flush   func(context.Context) error
+	compact func() error
+
+	sizeGauge metri.Gauge
+	rotations metri.Counter
+}
+
+func newWriteLogRotator(ctx context.Context, maxSize int64, size func() (int64, error), flush func(context.Context) error, compact func() error) *writeLogRotator {
+	return &writeLogRotator{
+		maxSize:   maxSize,
+		size:      size,
+		flush:     flush,
+		compact:   compact,
+		sizeGauge: metri.NewCtx(ctx, "writelog.size", "size in bytes of the blockstore write log").Gauge(),
+		rotations: metri.NewCtx(ctx, "writelog.rotations", "number of times the write log was flushed for going over its max size").Counter(),
+	}
+}
+
+func (wr *writeLogRotator) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := wr.check(ctx); err != nil {
+			log.Errorf("failed to rotate the write log: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check reports the size of the write log and rotates it if it is over its
+// max size
+func (wr *writeLogRotator) check(ctx context.Context) error {
+	size, err := wr.size()
+	if err != nil {
+		return err
+	}
+	wr.sizeGauge.Set(float64(size))
+
+	if wr.maxSize <= 0 || size <= wr.maxSize {
+		return nil
+	}
+
+	log.Warnf("write log is %d bytes, over its max size of %d, flushing it to the blockstore", size, wr.maxSize)
+	start := time.Now()
+
+	if err := wr.flush(ctx); err != nil {
+		return err
+	}
+
+	if err := wr.compact(); err != nil {
+		return err
+	}
+	wr.rotations.Inc()
+
+	size, err = wr.size()
+	if err != nil {
+		return err
+	}
+	wr.sizeGauge.Set(float64(size))
+
+	log.Infof("write log rotated in %s, %d bytes left", time.Since(start), size)
+	return nil
+}
@@ -0,0 +1,47 @@
+package node
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWriteLogRotation(t *testing.T) {
+	ctx := context.Background()
+
+	size := int64(100)
+	var flushed, compacted int
+	wr := newWriteLogRotator(ctx, 150, func() (int64, error) {
+		return size, nil
+	}, func(context.Context) error {
+		flushed++
+		return nil
+	}, func() error {
+		compacted++
+		size = 10
+		return nil
+	})
+
+	if err := wr.check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if flushed != 0 || compacted != 0 {
+		t.Fatal("write log under its max size should not be rotated")
+	}
+
+	size = 200
+	if err := wr.check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if flushed != 1 || compacted != 1 || size != 10 {
+		t.Fatalf("write log over its max size should be rotated once, got %d flushes and %d compactions", flushed, compacted)
+	}
+
+	wr.maxSize = 0
+	size = 1 << 40
+	if err := wr.check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if flushed != 1 {
+		t.Fatal("write log should not be rotated without a max size")
+	}
+}
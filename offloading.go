@@ -212,6 +212,81 @@ func (cm *ContentManager) OffloadContents(ctx context.Context, conts []uint) (in
 	return deleteCount, nil
 }
 
+// shouldAutoOffload reports whether a content has enough sealed deals to be
+// offloaded and opted in to it. A content still missing deals keeps its hot
+// copy, offloading it would only have it retrieved again to make them. The
+// pieces of a split dag follow the content they were split from, aggregates
+// are only offloaded if all of the contents in them opted in.
+func (cm *ContentManager) shouldAutoOffload(content util.Content, sealed int, dealsToBeMade int) (bool, error) {
+	threshold := cm.cfg.Deal.AutoOffloadSealedDeals
+	if threshold <= 0 || sealed < threshold || dealsToBeMade > 0 {
+		return false, nil
+	}
+
+	if content.SplitFrom > 0 {
+		var parent util.Content
+		if err := cm.DB.First(&parent, "id = ?", content.SplitFrom).Error; err != nil {
+			return false, err
+		}
+		return parent.AutoOffload, nil
+	}
+
+	if content.Aggregate {
+		var optedOut int64
+		if err := cm.DB.Model(util.Content{}).Where("aggregated_in = ? and not auto_offload", content.ID).Count(&optedOut).Error; err != nil {
+			return false, err
+		}
+		return optedOut == 0, nil
+	}
+	return content.AutoOffload, nil
+}
+
+// autoOffload offloads a content, and the content it was split from once all
+// of its pieces are offloaded. The blocks of a split dag stay pinned by its
+// root until then.
+func (cm *ContentManager) autoOffload(ctx context.Context, content util.Content, sealed int) error {
+	removed, err := cm.OffloadContents(ctx, []uint{content.ID})
+	if err != nil {
+		return fmt.Errorf("failed to auto offload content %d: %w", content.ID, err)
+	}
+	log.Infof("auto offloaded content %d with %d sealed deals, %d blocks removed", content.ID, sealed, removed)
+
+	if content.SplitFrom == 0 {
+		return nil
+	}
+
+	done, err := cm.splitPiecesOffloaded(content.SplitFrom)
+	if err != nil || !done {
+		return err
+	}
+
+	removed, err = cm.OffloadContents(ctx, []uint{content.SplitFrom})
+	if err != nil {
+		return fmt.Errorf("failed to auto offload split content %d: %w", content.SplitFrom, err)
+	}
+	log.Infof("auto offloaded split content %d after all of its pieces, %d blocks removed", content.SplitFrom, removed)
+	return nil
+}
+
+// splitPiecesOffloaded reports whether the content a dag was split from is
+// still hot while all of its pieces are offloaded
+func (cm *ContentManager) splitPiecesOffloaded(root uint) (bool, error) {
+	var parent util.Content
+	if err := cm.DB.First(&parent, "id = ?", root).Error; err != nil {
+		return false, err
+	}
+
+	if parent.Offloaded {
+		return false, nil
+	}
+
+	var hot int64
+	if err := cm.DB.Model(util.Content{}).Where("split_from = ? and not offloaded", root).Count(&hot).Error; err != nil {
+		return false, err
+	}
+	return hot == 0, nil
+}
+
 type removalCandidateInfo struct {
 	util.Content
 	TotalDeals      int `json:"totalDeals"`
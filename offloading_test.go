@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOffloadTestContentManager(t *testing.T) *ContentManager {
+	db, err := util.SetupDatabase("sqlite=" + filepath.Join(t.TempDir(), "estuary.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.AutoMigrate(&util.Content{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.NewEstuary("test")
+	cfg.Deal.AutoOffloadSealedDeals = 2
+	return &ContentManager{DB: db, cfg: cfg}
+}
+
+func TestShouldAutoOffload(t *testing.T) {
+	assert := assert.New(t)
+	cm := newOffloadTestContentManager(t)
+
+	cont := util.Content{ID: 1, AutoOffload: true}
+	for _, tc := range []struct {
+		sealed        int
+		dealsToBeMade int
+		offload       bool
+	}{
+		{sealed: 1, dealsToBeMade: 0, offload: false},
+		{sealed: 2, dealsToBeMade: 0, offload: true},
+		// offloading would only have it retrieved again to make more deals
+		{sealed: 2, dealsToBeMade: 1, offload: false},
+	} {
+		offload, err := cm.shouldAutoOffload(cont, tc.sealed, tc.dealsToBeMade)
+		assert.NoError(err)
+		assert.Equal(tc.offload, offload, "%d sealed, %d deals to be made", tc.sealed, tc.dealsToBeMade)
+	}
+
+	offload, err := cm.shouldAutoOffload(util.Content{ID: 2}, 2, 0)
+	assert.NoError(err)
+	assert.False(offload)
+
+	cm.cfg.Deal.AutoOffloadSealedDeals = 0
+	offload, err = cm.shouldAutoOffload(cont, 2, 0)
+	assert.NoError(err)
+	assert.False(offload)
+}
+
+func TestSplitPiecesOffloaded(t *testing.T) {
+	assert := assert.New(t)
+	cm := newOffloadTestContentManager(t)
+
+	for _, c := range []*util.Content{
+		{ID: 1, DagSplit: true, AutoOffload: true, Active: true},
+		{ID: 2, DagSplit: true, SplitFrom: 1, Active: true, Offloaded: true},
+		{ID: 3, DagSplit: true, SplitFrom: 1, Active: true},
+	} {
+		assert.NoError(cm.DB.Create(c).Error)
+	}
+
+	// the pieces follow the opt in of the content they were split from
+	offload, err := cm.shouldAutoOffload(util.Content{ID: 3, SplitFrom: 1}, 2, 0)
+	assert.NoError(err)
+	assert.True(offload)
+
+	done, err := cm.splitPiecesOffloaded(1)
+	assert.NoError(err)
+	assert.False(done)
+
+	assert.NoError(cm.DB.Model(util.Content{}).Where("id = ?", 3).Update("offloaded", true).Error)
+	done, err = cm.splitPiecesOffloaded(1)
+	assert.NoError(err)
+	assert.True(done)
+
+	assert.NoError(cm.DB.Model(util.Content{}).Where("id = ?", 1).Update("offloaded", true).Error)
+	done, err = cm.splitPiecesOffloaded(1)
+	assert.NoError(err)
+	assert.False(done)
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -18,6 +20,8 @@ import (
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/pkg/errors"
 	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 var log = logging.Logger("pinner")
@@ -40,11 +44,7 @@ func NewPinManager(pinfunc PinFunc, scf PinStatusFunc, opts *PinManagerOpts) *Pi
 		log.Fatal("Deque needs queue data dir")
 	}
 
-	pinQueue := createDQue(opts.QueueDataDir)
-	//we need to have a variable pinQueueCount which keeps track in memory count in the queue
-	//Since the disk dequeue is durable
-	//we initialize pinQueueCount on boot by iterating through the queue
-	pinQueueCount := buildPinQueueCount(pinQueue)
+	pinQueue, duplicateGuard, pinQueueCount, rebuilt := openQueueDataStructures(opts.QueueDataDir)
 
 	return &PinManager{
 		pinQueue:         pinQueue,
@@ -53,10 +53,15 @@ func NewPinManager(pinfunc PinFunc, scf PinStatusFunc, opts *PinManagerOpts) *Pi
 		pinQueueIn:       make(chan *PinningOperation, 64),
 		pinQueueOut:      make(chan *PinningOperation),
 		pinComplete:      make(chan *PinningOperation, 64),
-		duplicateGuard:   createLevelDB(opts.QueueDataDir),
+		wake:             make(chan struct{}, 1),
+		pausedUsers:      make(map[uint]bool),
+		running:          make(map[uint]*PinningOperation),
+		duplicateGuard:   duplicateGuard,
+		queueRebuilt:     rebuilt,
 		RunPinFunc:       pinfunc,
 		StatusChangeFunc: scf,
 		maxActivePerUser: opts.MaxActivePerUser,
+		pinTimeout:       opts.PinTimeout,
 		QueueDataDir:     opts.QueueDataDir,
 	}
 }
@@ -69,6 +74,9 @@ var DefaultOpts = &PinManagerOpts{
 type PinManagerOpts struct {
 	MaxActivePerUser int
 	QueueDataDir     string
+	// PinTimeout is how long a pinning operation may run in total before it
+	// fails, whatever progress it is making. Operations can set their own.
+	PinTimeout time.Duration
 }
 
 type PinManager struct {
@@ -83,7 +91,30 @@ type PinManager struct {
 	RunPinFunc       PinFunc
 	StatusChangeFunc PinStatusFunc
 	maxActivePerUser int
+	pinTimeout       time.Duration
 	QueueDataDir     string
+
+	// while storage is full no new pinning operations are started, they stay queued
+	storageFull bool
+	wake        chan struct{}
+
+	// the queued operations of paused users are not started, the running ones
+	// are left to finish
+	pausedUsers map[uint]bool
+
+	// operations being worked on by content, to report their progress
+	runningLk sync.Mutex
+	running   map[uint]*PinningOperation
+
+	// the on-disk queue was corrupt and started over empty
+	queueRebuilt bool
+}
+
+// QueueRebuilt returns true if the on-disk pin queue and duplicate guard
+// were found corrupt and recreated empty, the operations they held must be
+// added again from the database of the caller
+func (pm *PinManager) QueueRebuilt() bool {
+	return pm.queueRebuilt
 }
 
 // TODO: some of these fields are overkill for the generalized pin manager
@@ -116,6 +147,20 @@ type PinningOperation struct {
 	lk sync.Mutex
 
 	MakeDeal bool
+
+	// Timeout overrides the pin timeout of the manager for this operation
+	Timeout time.Duration
+
+	// Unannounced operations pin the content without providing it
+	Unannounced bool
+
+	// TraceCarrier holds the trace context of the request that queued this
+	// operation, so the trace can be continued once a worker picks it up
+	TraceCarrier propagation.MapCarrier
+
+	// direct is set for an operation handed to a worker without going
+	// through the queue, it never entered the duplicate guard
+	direct bool
 }
 
 type PinningOperationData struct {
@@ -143,12 +188,7 @@ func (pm *PinManager) complete(po *PinningOperation) {
 	defer pm.pinQueueLk.Unlock()
 	defer po.lk.Unlock()
 
-	opdata := getPinningData(po)
-	err := pm.duplicateGuard.Delete(createLevelDBKey(opdata), nil)
-	if err != nil {
-		//Delete will not returns error if key doesn't exist
-		log.Errorf("Error deleting item from duplicate guard ", err)
-	}
+	pm.releaseGuard(po)
 
 	pm.activePins[po.UserId]--
 	if pm.activePins[po.UserId] == 0 {
@@ -160,6 +200,24 @@ func (pm *PinManager) complete(po *PinningOperation) {
 	po.Status = types.PinningStatusPinned
 }
 
+// deferOp frees the slot of a deferred operation and queues it again once
+// DeferDelay is over
+func (pm *PinManager) deferOp(po *PinningOperation) {
+	pm.pinQueueLk.Lock()
+	pm.releaseGuard(po)
+
+	pm.activePins[po.UserId]--
+	if pm.activePins[po.UserId] == 0 {
+		delete(pm.activePins, po.UserId)
+	}
+	pm.pinQueueLk.Unlock()
+
+	po.SetStatus(types.PinningStatusQueued)
+	time.AfterFunc(DeferDelay, func() {
+		pm.Add(po)
+	})
+}
+
 func (po *PinningOperation) SetStatus(st types.PinningStatus) {
 	po.lk.Lock()
 	defer po.lk.Unlock()
@@ -168,12 +226,177 @@ func (po *PinningOperation) SetStatus(st types.PinningStatus) {
 	po.LastUpdate = time.Now()
 }
 
+// PinProgress is a snapshot of the progress of a running pinning operation
+type PinProgress struct {
+	Started     time.Time
+	NumFetched  int
+	SizeFetched int64
+	LastUpdate  time.Time
+}
+
+// PinProgress returns the progress of the operation pinning a content, false
+// if the content is not being pinned right now
+func (pm *PinManager) PinProgress(contID uint) (PinProgress, bool) {
+	pm.runningLk.Lock()
+	op, ok := pm.running[contID]
+	pm.runningLk.Unlock()
+	if !ok {
+		return PinProgress{}, false
+	}
+
+	op.lk.Lock()
+	defer op.lk.Unlock()
+	return PinProgress{
+		Started:     op.Started,
+		NumFetched:  op.NumFetched,
+		SizeFetched: op.SizeFetched,
+		LastUpdate:  op.LastUpdate,
+	}, true
+}
+
+func (pm *PinManager) setRunning(op *PinningOperation) {
+	pm.runningLk.Lock()
+	defer pm.runningLk.Unlock()
+	pm.running[op.ContId] = op
+}
+
+func (pm *PinManager) clearRunning(op *PinningOperation) {
+	pm.runningLk.Lock()
+	defer pm.runningLk.Unlock()
+	if pm.running[op.ContId] == op {
+		delete(pm.running, op.ContId)
+	}
+}
+
 func (pm *PinManager) PinQueueSize() int {
 	pm.pinQueueLk.Lock()
 	defer pm.pinQueueLk.Unlock()
 	return int(pm.pinQueue.Length())
 }
 
+// ActivePinCount returns the number of pinning operations currently being
+// worked on across all users.
+func (pm *PinManager) ActivePinCount() int {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	var total int
+	for _, n := range pm.activePins {
+		total += n
+	}
+	return total
+}
+
+// PinQueueSizeByUser returns a snapshot of the number of queued pinning
+// operations for each user.
+func (pm *PinManager) PinQueueSizeByUser() map[uint]int {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	out := make(map[uint]int, len(pm.pinQueueCount))
+	for u, n := range pm.pinQueueCount {
+		out[u] = n
+	}
+	return out
+}
+
+// SetStorageFull pauses (or resumes) starting queued pinning operations, pins
+// that are already running are left to finish
+func (pm *PinManager) SetStorageFull(full bool) {
+	pm.pinQueueLk.Lock()
+	pm.storageFull = full
+	pm.pinQueueLk.Unlock()
+
+	pm.wakeUp()
+}
+
+func (pm *PinManager) StorageFull() bool {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	return pm.storageFull
+}
+
+// PauseUser stops starting the queued pinning operations of a user, they stay
+// queued until the user is resumed. Operations skipping the per user limiter
+// are not paused.
+func (pm *PinManager) PauseUser(user uint) {
+	pm.pinQueueLk.Lock()
+	pm.pausedUsers[user] = true
+	pm.pinQueueLk.Unlock()
+
+	pm.wakeUp()
+}
+
+// ResumeUser starts the queued pinning operations of a paused user again
+func (pm *PinManager) ResumeUser(user uint) {
+	pm.pinQueueLk.Lock()
+	delete(pm.pausedUsers, user)
+	pm.pinQueueLk.Unlock()
+
+	pm.wakeUp()
+}
+
+func (pm *PinManager) UserPaused(user uint) bool {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	return pm.pausedUsers[user]
+}
+
+// PausedUsers returns the paused users in ascending order
+func (pm *PinManager) PausedUsers() []uint {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	users := make([]uint, 0, len(pm.pausedUsers))
+	for u := range pm.pausedUsers {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i] < users[j]
+	})
+	return users
+}
+
+func (pm *PinManager) wakeUp() {
+	select {
+	case pm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pausedOp returns true if the operation belongs to a paused user
+func (pm *PinManager) pausedOp(po *PinningOperation) bool {
+	return !po.SkipLimiter && pm.pausedUsers[po.UserId]
+}
+
+// requeue puts an operation picked for a user paused since back at the end
+// of the user queue, freeing the slot it was given
+func (pm *PinManager) requeue(po *PinningOperation) {
+	pm.releaseGuard(po)
+
+	pm.activePins[po.UserId]--
+	if pm.activePins[po.UserId] == 0 {
+		delete(pm.activePins, po.UserId)
+	}
+
+	pm.enqueuePinOp(po)
+}
+
+// releaseGuard lets a duplicate of a finished operation be queued again. An
+// operation that skipped the queue leaves the guard alone, the key there is
+// held by a duplicate of it that is still queued.
+func (pm *PinManager) releaseGuard(po *PinningOperation) {
+	if po.direct {
+		po.direct = false
+		return
+	}
+
+	//Delete will not returns error if key doesn't exist
+	if err := pm.duplicateGuard.Delete(createLevelDBKey(getPinningData(po)), nil); err != nil {
+		log.Errorf("Error deleting item from duplicate guard ", err)
+	}
+}
+
 func (pm *PinManager) Add(op *PinningOperation) {
 	go func() {
 		pm.pinQueueIn <- op
@@ -182,18 +405,61 @@ func (pm *PinManager) Add(op *PinningOperation) {
 
 var maxTimeout = 24 * time.Hour
 
+// timeout returns how long an operation may run in total
+func (pm *PinManager) timeout(op *PinningOperation) time.Duration {
+	if op.Timeout > 0 {
+		return op.Timeout
+	}
+	if pm.pinTimeout > 0 {
+		return pm.pinTimeout
+	}
+	return maxTimeout
+}
+
+// ErrDeferred is returned, wrapped, by a PinFunc that cannot start the pin
+// for now, e.g. while short on memory. The operation is queued again after
+// DeferDelay instead of failing.
+var ErrDeferred = errors.New("pinning operation deferred")
+
+var DeferDelay = time.Minute
+
 func (pm *PinManager) doPinning(op *PinningOperation) error {
-	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
+	timeout := pm.timeout(op)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
+	// continue the trace of the request that queued this operation
+	if op.TraceCarrier != nil {
+		ctx = propagation.TraceContext{}.Extract(ctx, op.TraceCarrier)
+	}
+
+	op.lk.Lock()
+	op.Started = time.Now()
+	op.NumFetched = 0
+	op.SizeFetched = 0
+	op.lk.Unlock()
 	op.SetStatus(types.PinningStatusPinning)
 
+	pm.setRunning(op)
+	defer pm.clearRunning(op)
+
 	if err := pm.RunPinFunc(ctx, op, func(size int64) {
 		op.lk.Lock()
 		defer op.lk.Unlock()
 		op.NumFetched++
 		op.SizeFetched += size
+		op.LastUpdate = time.Now()
 	}); err != nil {
+		if errors.Is(err, ErrDeferred) {
+			log.Infof("pinning of content %d deferred: %s", op.ContId, err)
+			pm.deferOp(op)
+			return nil
+		}
+
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errors.Wrapf(err, "pin did not complete within %s", timeout)
+		}
+
 		op.fail(err)
 		if err2 := pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusFailed); err2 != nil {
 			return err2
@@ -213,12 +479,16 @@ func (pm *PinManager) popNextPinOp() *PinningOperation {
 	var user uint
 	success := false
 	//if user id = 0 has any pins to work on, use that
-	if pm.pinQueueCount[0] > 0 {
+	if pm.pinQueueCount[0] > 0 && !pm.pausedUsers[0] {
 		user = 0
 		success = true
 	} else {
 		//if not find user with least number of active workers and use that
 		for u := range pm.pinQueueCount {
+			if pm.pausedUsers[u] {
+				continue
+			}
+
 			active := pm.activePins[u]
 			if active < minCount {
 				minCount = active
@@ -285,7 +555,64 @@ func createLevelDBKey(value PinningOperationData) []byte {
 	return buffer.Bytes()
 }
 
-func createLevelDB(QueueDataDir string) *leveldb.DB {
+// errQueueDataCorrupt marks on-disk queue data that cannot be used as is
+var errQueueDataCorrupt = errors.New("pin queue data is corrupt")
+
+// openQueueDataStructures opens the on-disk pin queue, its per user counts
+// and the duplicate guard. If any of them is corrupt, e.g. after an unclean
+// shutdown, both directories are moved aside and recreated empty, and true is
+// returned so the caller queues its pins again.
+func openQueueDataStructures(QueueDataDir string) (*goque.PrefixQueue, *leveldb.DB, map[uint]int, bool) {
+	q, guard, counts, err := tryOpenQueueDataStructures(QueueDataDir)
+	if err == nil {
+		return q, guard, counts, false
+	}
+
+	if !errors.Is(err, errQueueDataCorrupt) {
+		log.Fatalf("Unable to open pin queue data in %s. Out of disk? Too many open files? try ulimit -n 50000: %s", QueueDataDir, err)
+	}
+
+	log.Errorf("rebuilding pin queue data in %s: %s", QueueDataDir, err)
+	suffix := fmt.Sprintf(".corrupt-%d", time.Now().Unix())
+	for _, name := range []string{"pinQueue", "duplicateGuard"} {
+		dname := filepath.Join(QueueDataDir, name)
+		if err := os.Rename(dname, dname+suffix); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Unable to move corrupt %s aside: %s", dname, err)
+		}
+		log.Warnf("moved %s to %s, it can be deleted once the pins are queued again", dname, dname+suffix)
+	}
+
+	q, guard, counts, err = tryOpenQueueDataStructures(QueueDataDir)
+	if err != nil {
+		log.Fatalf("Unable to recreate pin queue data in %s: %s", QueueDataDir, err)
+	}
+	return q, guard, counts, true
+}
+
+func tryOpenQueueDataStructures(QueueDataDir string) (*goque.PrefixQueue, *leveldb.DB, map[uint]int, error) {
+	q, err := createDQue(QueueDataDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	//we need to have a variable pinQueueCount which keeps track in memory count in the queue
+	//Since the disk dequeue is durable
+	//we initialize pinQueueCount on boot by iterating through the queue
+	counts, err := buildPinQueueCount(q)
+	if err != nil {
+		_ = q.Close()
+		return nil, nil, nil, errors.Wrapf(errQueueDataCorrupt, "failed to count queued pins: %s", err)
+	}
+
+	guard, err := createLevelDB(QueueDataDir)
+	if err != nil {
+		_ = q.Close()
+		return nil, nil, nil, err
+	}
+	return q, guard, counts, nil
+}
+
+func createLevelDB(QueueDataDir string) (*leveldb.DB, error) {
 
 	dname := filepath.Join(QueueDataDir, "duplicateGuard")
 	err := os.MkdirAll(dname, os.ModePerm)
@@ -293,10 +620,18 @@ func createLevelDB(QueueDataDir string) *leveldb.DB {
 		log.Fatal("Unable to create directory for LevelDB. Out of disk? Too many open files? try ulimit -n 50000")
 	}
 	db, err := leveldb.OpenFile(dname, nil)
+	if lerrors.IsCorrupted(err) {
+		// the guard only holds keys, whatever can be salvaged of it will do
+		log.Warnf("duplicate guard in %s is corrupt, recovering it: %s", dname, err)
+		db, err = leveldb.RecoverFile(dname, nil)
+	}
 	if err != nil {
-		log.Fatal("Unable to create LevelDB. Out of disk? Too many open files? try ulimit -n 50000")
+		if lerrors.IsCorrupted(err) {
+			return nil, errors.Wrapf(errQueueDataCorrupt, "duplicate guard: %s", err)
+		}
+		return nil, err
 	}
-	return db
+	return db, nil
 }
 
 // queue defines the unique queue for a prefix.
@@ -305,25 +640,25 @@ type queue struct {
 	Tail uint64
 }
 
-func buildPinQueueCount(q *goque.PrefixQueue) map[uint]int {
+func buildPinQueueCount(q *goque.PrefixQueue) (map[uint]int, error) {
 	mapString, err := q.PrefixQueueCount()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	mapUint := make(map[uint]int)
 	for key, element := range mapString {
 		keyU, err := strconv.ParseUint(key, 10, 32)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		mapUint[uint(keyU)] = int(element)
 	}
-	return mapUint
+	return mapUint, nil
 
 }
 
-func createDQue(QueueDataDir string) *goque.PrefixQueue {
+func createDQue(QueueDataDir string) (*goque.PrefixQueue, error) {
 
 	dname := filepath.Join(QueueDataDir, "pinQueue")
 	err := os.MkdirAll(dname, os.ModePerm)
@@ -332,9 +667,12 @@ func createDQue(QueueDataDir string) *goque.PrefixQueue {
 	}
 	q, err := goque.OpenPrefixQueue(dname)
 	if err != nil {
-		log.Fatal("Unable to create Queue. Out of disk? Too many open files? try ulimit -n 50000")
+		if lerrors.IsCorrupted(err) {
+			return nil, errors.Wrapf(errQueueDataCorrupt, "pin queue: %s", err)
+		}
+		return nil, err
 	}
-	return q
+	return q, nil
 }
 
 func getUserForQueue(UserId uint) []byte {
@@ -382,16 +720,35 @@ func (pm *PinManager) Run(workers int) {
 	pm.pinQueueLk.Unlock()
 
 	for {
+		out := pm.pinQueueOut
+		if pm.StorageFull() {
+			out = nil
+		}
+
 		select {
-		case op := <-pm.pinQueueIn:
+		case <-pm.wake:
+			pm.pinQueueLk.Lock()
+			if next != nil && pm.pausedOp(next) {
+				pm.requeue(next)
+				next = nil
+			}
 			if next == nil {
+				next = pm.popNextPinOp()
+			}
+			pm.pinQueueLk.Unlock()
+		case op := <-pm.pinQueueIn:
+			pm.pinQueueLk.Lock()
+			if next == nil && !pm.pausedOp(op) {
+				// counted like the operations popped off the queue, so
+				// that requeuing or completing it frees the right slot
+				pm.activePins[op.UserId]++
+				op.direct = true
 				next = op
 			} else {
-				pm.pinQueueLk.Lock()
 				pm.enqueuePinOp(op)
-				pm.pinQueueLk.Unlock()
 			}
-		case pm.pinQueueOut <- next:
+			pm.pinQueueLk.Unlock()
+		case out <- next:
 			pm.pinQueueLk.Lock()
 			next = pm.popNextPinOp()
 			pm.pinQueueLk.Unlock()
@@ -6,6 +6,7 @@ import (
 	"github.com/application-research/estuary/pinner/types"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -77,6 +78,230 @@ func TestSend1Pin1worker(t *testing.T) {
 	mgr.closeQueueDataStructures()
 }
 
+func TestStorageFullPausesPinning(t *testing.T) {
+	i := 1
+	var count = 0
+	mgr := newManager(&count)
+	mgr.SetStorageFull(true)
+	go mgr.Run(1)
+	pin := newPinData("name"+fmt.Sprint(i), i, i)
+	go mgr.Add(&pin)
+
+	time.Sleep(sleeptime * 5 * time.Millisecond)
+	countLock.Lock()
+	assert.Equal(t, 0, count, "no pin started while storage is full")
+	countLock.Unlock()
+
+	mgr.SetStorageFull(false)
+	sleepWhileWork(mgr, 0)
+	countLock.Lock()
+	assert.Equal(t, 1, count, "DoPin called once storage is available again")
+	countLock.Unlock()
+	mgr.closeQueueDataStructures()
+}
+
+func TestPausedUserPinsStayQueued(t *testing.T) {
+	var count = 0
+	mgr := newManager(&count)
+	mgr.PauseUser(1)
+	go mgr.Run(1)
+	paused := newPinData("name1", 1, 1)
+	go mgr.Add(&paused)
+	other := newPinData("name2", 2, 2)
+	go mgr.Add(&other)
+
+	time.Sleep(sleeptime * 5 * time.Millisecond)
+	countLock.Lock()
+	assert.Equal(t, 1, count, "only the pin of the other user started")
+	countLock.Unlock()
+	assert.Equal(t, 1, int(mgr.pinQueue.Length()), "pin of the paused user stays queued")
+	assert.Equal(t, []uint{1}, mgr.PausedUsers())
+
+	mgr.ResumeUser(1)
+	sleepWhileWork(mgr, 0)
+	countLock.Lock()
+	assert.Equal(t, 2, count, "DoPin called once the user is resumed")
+	countLock.Unlock()
+	assert.False(t, mgr.UserPaused(1))
+	mgr.closeQueueDataStructures()
+}
+
+func TestPinProgress(t *testing.T) {
+	_ = os.RemoveAll("/tmp/duplicateGuard")
+	_ = os.RemoveAll("/tmp/pinQueue")
+
+	fetched := make(chan struct{})
+	release := make(chan struct{})
+	mgr := NewPinManager(
+		func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+			cb(100)
+			cb(50)
+			close(fetched)
+			<-release
+			return nil
+		}, onPinStatusUpdate, &PinManagerOpts{
+			MaxActivePerUser: 30,
+			QueueDataDir:     "/tmp/",
+		})
+	go mgr.Run(1)
+
+	_, ok := mgr.PinProgress(1)
+	assert.False(t, ok, "no progress before the pin starts")
+
+	pin := newPinData("name1", 1, 1)
+	go mgr.Add(&pin)
+	<-fetched
+
+	prog, ok := mgr.PinProgress(1)
+	assert.True(t, ok)
+	assert.Equal(t, 2, prog.NumFetched)
+	assert.Equal(t, int64(150), prog.SizeFetched)
+	assert.False(t, prog.Started.IsZero())
+
+	close(release)
+	sleepWhileWork(mgr, 0)
+	time.Sleep(sleeptime * time.Millisecond)
+	_, ok = mgr.PinProgress(1)
+	assert.False(t, ok, "no progress once the pin is done")
+	mgr.closeQueueDataStructures()
+}
+
+func TestRequeueKeepsActivePins(t *testing.T) {
+	var count = 0
+	mgr := newManager(&count)
+	go mgr.Run(0)
+
+	activePins := func() int {
+		mgr.pinQueueLk.Lock()
+		defer mgr.pinQueueLk.Unlock()
+		return mgr.activePins[1]
+	}
+
+	// the operation waiting to be handed to a worker holds a slot
+	pin := newPinData("name1", 1, 1)
+	mgr.Add(&pin)
+	assert.Eventually(t, func() bool { return activePins() == 1 }, time.Second, 10*time.Millisecond)
+
+	// and gives it back once requeued for its paused user
+	mgr.PauseUser(1)
+	assert.Eventually(t, func() bool { return mgr.PinQueueSize() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, activePins())
+
+	mgr.ResumeUser(1)
+	assert.Eventually(t, func() bool { return mgr.PinQueueSize() == 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, activePins())
+	mgr.closeQueueDataStructures()
+}
+
+func TestPinQueueSizeByUser(t *testing.T) {
+	var count = 0
+	mgr := newManager(&count)
+
+	mgr.pinQueueLk.Lock()
+	for i := 0; i < 5; i++ {
+		pin := newPinData("name"+fmt.Sprint(i), 1+i%2, i)
+		mgr.enqueuePinOp(&pin)
+	}
+	mgr.pinQueueLk.Unlock()
+
+	assert.Equal(t, map[uint]int{1: 3, 2: 2}, mgr.PinQueueSizeByUser())
+	assert.Equal(t, 5, mgr.PinQueueSize())
+	mgr.closeQueueDataStructures()
+}
+
+func TestHeldPinKeepsDuplicateGuard(t *testing.T) {
+	var count = 0
+	mgr := newManager(&count)
+	go mgr.Run(0)
+
+	// the first operation is held for a worker without being queued, a
+	// duplicate of it is queued
+	pin := newPinData("name1", 1, 1)
+	mgr.Add(&pin)
+	assert.Eventually(t, func() bool { return mgr.ActivePinCount() == 1 }, time.Second, 10*time.Millisecond)
+	dup := newPinData("name1", 1, 1)
+	mgr.Add(&dup)
+	assert.Eventually(t, func() bool { return mgr.PinQueueSize() == 1 }, time.Second, 10*time.Millisecond)
+
+	// finishing the held operation leaves the queued duplicate guarded
+	mgr.complete(&pin)
+	again := newPinData("name1", 1, 1)
+	mgr.Add(&again)
+	time.Sleep(sleeptime * time.Millisecond)
+	assert.Equal(t, 1, mgr.PinQueueSize(), "queue should still have 1 pin in it")
+	mgr.closeQueueDataStructures()
+}
+
+func TestDeferredPinIsRetried(t *testing.T) {
+	defer func(d time.Duration) { DeferDelay = d }(DeferDelay)
+	DeferDelay = sleeptime * time.Millisecond
+
+	_ = os.RemoveAll("/tmp/duplicateGuard")
+	_ = os.RemoveAll("/tmp/pinQueue")
+
+	var count = 0
+	mgr := NewPinManager(
+		func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+			countLock.Lock()
+			defer countLock.Unlock()
+			count++
+			if count == 1 {
+				return fmt.Errorf("low on memory: %w", ErrDeferred)
+			}
+			return nil
+		}, onPinStatusUpdate, &PinManagerOpts{
+			MaxActivePerUser: 30,
+			QueueDataDir:     "/tmp/",
+		})
+	go mgr.Run(1)
+
+	pin := newPinData("name1", 1, 1)
+	go mgr.Add(&pin)
+
+	time.Sleep(sleeptime * 5 * time.Millisecond)
+	sleepWhileWork(mgr, 0)
+	countLock.Lock()
+	assert.Equal(t, 2, count, "deferred pin run again")
+	countLock.Unlock()
+	pin.lk.Lock()
+	assert.Equal(t, types.PinningStatusPinned, pin.Status)
+	pin.lk.Unlock()
+	assert.Equal(t, 0, mgr.ActivePinCount())
+	mgr.closeQueueDataStructures()
+}
+
+func TestPinTimeout(t *testing.T) {
+	mgr := NewPinManager(
+		func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+			// slow but steady progress never finishes
+			for {
+				select {
+				case <-time.After(time.Millisecond):
+					cb(1)
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}, onPinStatusUpdate, &PinManagerOpts{
+			MaxActivePerUser: 30,
+			QueueDataDir:     t.TempDir(),
+			PinTimeout:       time.Hour,
+		})
+	defer mgr.closeQueueDataStructures()
+
+	pin := newPinData("name1", 1, 1)
+	assert.Equal(t, time.Hour, mgr.timeout(&pin), "manager timeout is the default")
+
+	pin.Timeout = sleeptime * time.Millisecond
+	err := mgr.doPinning(&pin)
+	assert.ErrorContains(t, err, "pin did not complete within")
+
+	pin.lk.Lock()
+	assert.Equal(t, types.PinningStatusFailed, pin.Status)
+	assert.Greater(t, pin.NumFetched, 0)
+	pin.lk.Unlock()
+}
+
 func TestSend1Pin0workers(t *testing.T) {
 
 	//run 0 workers
@@ -317,6 +542,70 @@ func TestResumeQueue(t *testing.T) {
 
 }
 
+func TestCorruptQueueIsRebuilt(t *testing.T) {
+	dir := t.TempDir()
+	var count = 0
+	newMgr := func() *PinManager {
+		return NewPinManager(
+			func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+				countLock.Lock()
+				count += 1
+				countLock.Unlock()
+				return nil
+			}, onPinStatusUpdate, &PinManagerOpts{
+				MaxActivePerUser: 30,
+				QueueDataDir:     dir,
+			})
+	}
+
+	mgr := newMgr()
+	assert.False(t, mgr.QueueRebuilt())
+	go mgr.Run(0)
+	for i := 0; i < N; i++ {
+		pin := newPinData("name"+fmt.Sprint(i), 1, i)
+		mgr.Add(&pin)
+	}
+	sleepWhileWork(mgr, N-1)
+	assert.Equal(t, N-1, mgr.PinQueueSize(), "queue should have N-1 pins in it")
+	mgr.closeQueueDataStructures()
+	time.Sleep(time.Second)
+
+	// without its CURRENT files leveldb reports the queue as corrupt
+	current, err := filepath.Glob(filepath.Join(dir, "pinQueue", "CURRENT*"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, current)
+	for _, f := range current {
+		assert.NoError(t, os.Remove(f))
+	}
+
+	mgr2 := newMgr()
+	assert.True(t, mgr2.QueueRebuilt())
+	assert.Equal(t, 0, mgr2.PinQueueSize(), "the rebuilt queue starts empty")
+
+	moved, err := filepath.Glob(filepath.Join(dir, "pinQueue.corrupt-*"))
+	assert.NoError(t, err)
+	assert.Len(t, moved, 1)
+	moved, err = filepath.Glob(filepath.Join(dir, "duplicateGuard.corrupt-*"))
+	assert.NoError(t, err)
+	assert.Len(t, moved, 1)
+
+	// the pins queued again, as the shuttle does from its database, are not
+	// taken for duplicates by the new guard
+	go mgr2.Run(N)
+	for i := 0; i < N; i++ {
+		pin := newPinData("name"+fmt.Sprint(i), 1, i)
+		mgr2.Add(&pin)
+	}
+	sleepWhileWork(mgr2, 0)
+	assert.Equal(t, 0, mgr2.PinQueueSize(), "queue should have no pins in it")
+	assert.Eventually(t, func() bool {
+		countLock.Lock()
+		defer countLock.Unlock()
+		return count == N
+	}, 10*time.Second, 100*time.Millisecond, "all pins should be done")
+	mgr2.closeQueueDataStructures()
+}
+
 /*
 
 test run that iterates above and makes the above code redundant.
@@ -138,6 +138,10 @@ func (s *Server) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 		s.CM.toCheck(op.ContId)
 	}
 
+	if op.Unannounced {
+		return nil
+	}
+
 	// this provide call goes out immediately
 	if err := s.Node.FullRT.Provide(ctx, op.Obj, true); err != nil {
 		log.Warnf("provider broadcast failed: %s", err)
@@ -188,12 +192,117 @@ func (cm *ContentManager) refreshPinQueue(ctx context.Context, contentLoc string
 	return nil
 }
 
+// the pin meta keys the hints for the node pinning a content are read from,
+// e.g. {"provide_ttl": "6h", "unannounced": true, "pin_timeout": "12h"}
+const (
+	pinMetaProvideTTL  = "provide_ttl"
+	pinMetaUnannounced = "unannounced"
+	pinMetaTimeout     = "pin_timeout"
+)
+
+// the longest pin timeout a pin request can ask for, the longest a pin
+// manager lets a pin run
+const maxPinTimeoutHint = time.Hour * 24
+
+// pinHints are the settings a pin request passes the node in its meta
+type pinHints struct {
+	ProvideTTL  time.Duration
+	Unannounced bool
+	// Timeout overrides the pin timeout of the node, e.g. for content known
+	// to be large
+	Timeout time.Duration
+}
+
+func parsePinHints(meta map[string]interface{}) (pinHints, error) {
+	var h pinHints
+	var err error
+	if h.ProvideTTL, err = pinMetaDuration(meta, pinMetaProvideTTL); err != nil {
+		return h, err
+	}
+
+	if h.Timeout, err = pinMetaDuration(meta, pinMetaTimeout); err != nil {
+		return h, err
+	}
+	if h.Timeout > maxPinTimeoutHint {
+		return h, fmt.Errorf("pin meta %s can be at most %s", pinMetaTimeout, maxPinTimeoutHint)
+	}
+
+	if v, ok := meta[pinMetaUnannounced]; ok {
+		if h.Unannounced, ok = v.(bool); !ok {
+			return h, fmt.Errorf("pin meta %s must be a boolean", pinMetaUnannounced)
+		}
+	}
+	return h, nil
+}
+
+func pinMetaDuration(meta map[string]interface{}, key string) (time.Duration, error) {
+	v, ok := meta[key]
+	if !ok {
+		return 0, nil
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("pin meta %s must be a duration string, e.g. \"6h\"", key)
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("pin meta %s is not a valid duration: %q", key, s)
+	}
+	return d, nil
+}
+
+// pinHintsForContent reads the hints of a content from its pin meta, it was
+// checked when the content was pinned
+func pinHintsForContent(cont util.Content) pinHints {
+	if cont.PinMeta == "" {
+		return pinHints{}
+	}
+
+	var meta map[string]interface{}
+	if err := json.Unmarshal([]byte(cont.PinMeta), &meta); err != nil {
+		log.Warnf("content %d has invalid pinmeta: %s", cont.ID, err)
+		return pinHints{}
+	}
+
+	h, err := parsePinHints(meta)
+	if err != nil {
+		log.Warnf("content %d has invalid pin hints: %s", cont.ID, err)
+	}
+	return h
+}
+
 func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid, filename string, cols []*collections.CollectionRef, origins []*peer.AddrInfo, replaceID uint, meta map[string]interface{}, makeDeal bool) (*types.IpfsPinStatusResponse, error) {
+	hints, err := parsePinHints(meta)
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
 	loc, err := cm.selectLocationForContent(ctx, obj, user)
 	if err != nil {
 		return nil, xerrors.Errorf("selecting location for content failed: %w", err)
 	}
 
+	// bitswap would announce all the blocks fetched for the pin
+	if hints.Unannounced && loc == constants.ContentLocationLocal && !cm.Node.Config.Bitswap.NoProvide {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "unannounced pins need bitswap provides to be disabled",
+		}
+	}
+
+	if timeout := cm.cfg.Content.PinRootValidationTimeout; timeout > 0 && loc != constants.ContentLocationLocal && len(origins) > 0 {
+		if err := cm.checkContentRoot(ctx, loc, obj, origins, timeout); err != nil {
+			return nil, err
+		}
+	}
+
 	if replaceID > 0 {
 		// mark as replace since it will removed and so it should not be fetched anymore
 		if err := cm.DB.Model(&util.Content{}).Where("id = ?", replaceID).Update("replace", true).Error; err != nil {
@@ -262,6 +371,7 @@ func (cm *ContentManager) addPinToQueue(cont util.Content, peers []*peer.AddrInf
 		log.Errorf("calling addPinToQueue on non-local content")
 	}
 
+	hints := pinHintsForContent(cont)
 	op := &pinner.PinningOperation{
 		ContId:   cont.ID,
 		UserId:   cont.UserID,
@@ -274,6 +384,9 @@ func (cm *ContentManager) addPinToQueue(cont util.Content, peers []*peer.AddrInf
 		Location: cont.Location,
 		MakeDeal: makeDeal,
 		Meta:     cont.PinMeta,
+		Timeout:  hints.Timeout,
+
+		Unannounced: hints.Unannounced,
 	}
 	cm.pinMgr.Add(op)
 }
@@ -285,30 +398,99 @@ func (cm *ContentManager) pinContentOnShuttle(ctx context.Context, cont util.Con
 	))
 	defer span.End()
 
+	hints := pinHintsForContent(cont)
 	return cm.sendShuttleCommand(ctx, handle, &drpc.Command{
 		Op: drpc.CMD_AddPin,
 		Params: drpc.CmdParams{
 			AddPin: &drpc.AddPin{
-				DBID:   cont.ID,
-				UserId: cont.UserID,
-				Cid:    cont.Cid.CID,
-				Peers:  peers,
+				DBID:        cont.ID,
+				UserId:      cont.UserID,
+				Cid:         cont.Cid.CID,
+				Peers:       peers,
+				Timeout:     hints.Timeout,
+				ProvideTTL:  hints.ProvideTTL,
+				Unannounced: hints.Unannounced,
 			},
 		},
 	})
 }
 
+// checkContentRoot has the shuttle a pin goes to fetch the root block from
+// its origins, so that pins of unreachable content fail right away instead of
+// timing out in the pin queue. Pins are let through when the shuttle does not
+// answer in time.
+func (cm *ContentManager) checkContentRoot(ctx context.Context, loc string, root cid.Cid, origins []*peer.AddrInfo, timeout time.Duration) error {
+	key := rootValidationKey{handle: loc, root: root}
+	cm.rootValidations.Remove(key)
+
+	if err := cm.sendValidateContentRootCmd(ctx, loc, root, origins, timeout); err != nil {
+		return err
+	}
+
+	// leave the shuttle some time to connect and answer on top of the fetch
+	ctx, cancel := context.WithTimeout(ctx, timeout+time.Second*10)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	for {
+		if v, ok := cm.rootValidations.Get(key); ok {
+			res := v.(*drpc.ContentRootValidation)
+			if res.Reachable {
+				return nil
+			}
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_CONTENT_ROOT_UNREACHABLE,
+				Details: fmt.Sprintf("root %s could not be fetched from its %d origins: %s", root, len(origins), res.Error),
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Warnf("shuttle %s did not validate the root of %s in time, pinning it anyway", loc, root)
+			return nil
+		}
+	}
+}
+
+// sortShuttlesForContent orders shuttles by preference for new content: the
+// ones not low on blockstore space first, then the ones of highest priority,
+// then the ones with the least pin load
+func sortShuttlesForContent(shuttles []Shuttle, lowSpace map[string]bool, queueLoad map[string]int64) {
+	sort.SliceStable(shuttles, func(i, j int) bool {
+		hI, hJ := shuttles[i].Handle, shuttles[j].Handle
+		if lowSpace[hI] != lowSpace[hJ] {
+			return lowSpace[hJ]
+		}
+		if shuttles[i].Priority != shuttles[j].Priority {
+			return shuttles[i].Priority > shuttles[j].Priority
+		}
+		return queueLoad[hI] < queueLoad[hJ]
+	})
+}
+
 func (cm *ContentManager) selectLocationForContent(ctx context.Context, obj cid.Cid, uid uint) (string, error) {
 	ctx, span := cm.tracer.Start(ctx, "selectLocation")
 	defer span.End()
 
 	allShuttlesLowSpace := true
 	lowSpace := make(map[string]bool)
+	queueLoad := make(map[string]int64)
 	var activeShuttles []string
 	cm.shuttlesLk.Lock()
 	for d, sh := range cm.shuttles {
-		if !sh.private && !sh.ContentAddingDisabled {
+		if sh.storageFull {
+			// not taking any new pins until it frees up some space
+			continue
+		}
+
+		// shuttles that can't walk the content would fail its pin
+		if !sh.private && !sh.ContentAddingDisabled && !sh.retrievalOnly && sh.formats.Supports(obj) {
 			lowSpace[d] = sh.spaceLow
+			queueLoad[d] = sh.pinQueueLength + sh.activePins
 			activeShuttles = append(activeShuttles, d)
 		} else {
 			allShuttlesLowSpace = false
@@ -321,17 +503,7 @@ func (cm *ContentManager) selectLocationForContent(ctx context.Context, obj cid.
 		return "", err
 	}
 
-	// prefer shuttles that are not low on blockstore space
-	sort.SliceStable(shuttles, func(i, j int) bool {
-		lsI := lowSpace[shuttles[i].Handle]
-		lsJ := lowSpace[shuttles[j].Handle]
-
-		if lsI == lsJ {
-			return false
-		}
-
-		return lsJ
-	})
+	sortShuttlesForContent(shuttles, lowSpace, queueLoad)
 
 	if len(shuttles) == 0 {
 		if cm.localContentAddingDisabled {
@@ -895,6 +1067,15 @@ func (cm *ContentManager) handlePinningComplete(ctx context.Context, handle stri
 		}).Error; err != nil {
 			return err
 		}
+
+		// content offloaded on request is only dropped from its previous
+		// shuttle now that the new one has it
+		if from, ok := cm.offloadMigrations.Get(cont.ID); ok && from.(string) != handle {
+			cm.offloadMigrations.Remove(cont.ID)
+			if err := cm.sendUnpinCmd(ctx, from.(string), []uint{cont.ID}); err != nil {
+				log.Errorf("failed to unpin offloaded content %d from shuttle %s: %s", cont.ID, from, err)
+			}
+		}
 		return nil
 	}
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -66,3 +67,50 @@ func TestStatusFilterQuery(t *testing.T) {
 	assert.Equal("SELECT * FROM `conts` WHERE pinning and not active and not failed",
 		resp.Find([]Conts{}).Statement.SQL.String())
 }
+
+func TestPinHints(t *testing.T) {
+	assert := assert.New(t)
+
+	h, err := parsePinHints(nil)
+	assert.NoError(err)
+	assert.Zero(h.ProvideTTL)
+	assert.Zero(h.Timeout)
+
+	assert.False(h.Unannounced)
+
+	h, err = parsePinHints(map[string]interface{}{"provide_ttl": "6h", "unannounced": true, "pin_timeout": "12h"})
+	assert.NoError(err)
+	assert.Equal(time.Hour*6, h.ProvideTTL)
+	assert.True(h.Unannounced)
+	assert.Equal(time.Hour*12, h.Timeout)
+
+	_, err = parsePinHints(map[string]interface{}{"provide_ttl": 6})
+	assert.Error(err)
+	_, err = parsePinHints(map[string]interface{}{"provide_ttl": "-1h"})
+	assert.Error(err)
+	_, err = parsePinHints(map[string]interface{}{"unannounced": "yes"})
+	assert.Error(err)
+	_, err = parsePinHints(map[string]interface{}{"pin_timeout": "48h"})
+	assert.Error(err)
+}
+
+func TestSortShuttlesForContent(t *testing.T) {
+	assert := assert.New(t)
+
+	shuttles := []Shuttle{
+		{Handle: "low-space", Priority: 9},
+		{Handle: "busy", Priority: 1},
+		{Handle: "idle", Priority: 1},
+		{Handle: "preferred", Priority: 5},
+	}
+	lowSpace := map[string]bool{"low-space": true}
+	queueLoad := map[string]int64{"busy": 100, "idle": 1, "preferred": 1000}
+
+	sortShuttlesForContent(shuttles, lowSpace, queueLoad)
+
+	var handles []string
+	for _, sh := range shuttles {
+		handles = append(handles, sh.Handle)
+	}
+	assert.Equal([]string{"preferred", "idle", "busy", "low-space"}, handles)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+)
+
+// how many contents a batch of a reconciliation lists
+const reconcileBatchSize = 10000
+
+// shuttleReconciliation gathers the reports of the batches of a reconciliation
+// of the pins of a shuttle with the contents we expect it to have
+type shuttleReconciliation struct {
+	lk sync.Mutex
+
+	started  time.Time
+	sending  bool
+	batches  int
+	reported int
+	missing  []uint
+	orphans  []uint
+	errors   []string
+}
+
+// reconciliationStatus is the state of a reconciliation, Done once all of its
+// batches are reported
+type reconciliationStatus struct {
+	Started  time.Time `json:"started"`
+	Done     bool      `json:"done"`
+	Batches  int       `json:"batches"`
+	Reported int       `json:"reported"`
+	Missing  []uint    `json:"missing"`
+	Orphans  []uint    `json:"orphans"`
+	Errors   []string  `json:"errors,omitempty"`
+}
+
+// must be called with lk held
+func (sr *shuttleReconciliation) done() bool {
+	return !sr.sending && sr.reported >= sr.batches
+}
+
+// must be called with lk held
+func (sr *shuttleReconciliation) logIfDone(handle string) {
+	if sr.done() {
+		log.Infof("reconciled the pins of shuttle %s: %d missing, %d orphaned", handle, len(sr.missing), len(sr.orphans))
+	}
+}
+
+func (sr *shuttleReconciliation) status() *reconciliationStatus {
+	sr.lk.Lock()
+	defer sr.lk.Unlock()
+
+	st := &reconciliationStatus{
+		Started:  sr.started,
+		Done:     sr.done(),
+		Batches:  sr.batches,
+		Reported: sr.reported,
+		Missing:  append([]uint{}, sr.missing...),
+		Orphans:  append([]uint{}, sr.orphans...),
+		Errors:   append([]string(nil), sr.errors...),
+	}
+	sort.Slice(st.Missing, func(i, j int) bool { return st.Missing[i] < st.Missing[j] })
+	sort.Slice(st.Orphans, func(i, j int) bool { return st.Orphans[i] < st.Orphans[j] })
+	return st
+}
+
+// reconcileShuttle sends a shuttle the contents we expect it to have in
+// batches, the shuttle reports the ones that diverged from its pins. Nothing
+// is repinned or unpinned, the outcome is logged and kept for the admin api.
+func (cm *ContentManager) reconcileShuttle(ctx context.Context, handle string) error {
+	sr := &shuttleReconciliation{
+		started: time.Now(),
+		sending: true,
+	}
+	cm.reconciliations.Add(handle, sr)
+
+	defer func() {
+		sr.lk.Lock()
+		defer sr.lk.Unlock()
+		sr.sending = false
+		sr.logIfDone(handle)
+	}()
+
+	fail := func(err error) error {
+		sr.lk.Lock()
+		sr.errors = append(sr.errors, err.Error())
+		sr.lk.Unlock()
+		return err
+	}
+
+	log.Infof("reconciling the pins of shuttle %s", handle)
+
+	var after uint
+	for {
+		var ids []uint
+		if err := cm.DB.Model(util.Content{}).
+			Where("location = ? and id > ? and not offloaded", handle, after).
+			Order("id asc").
+			Limit(reconcileBatchSize).
+			Pluck("id", &ids).Error; err != nil {
+			return fail(fmt.Errorf("failed to list the contents of shuttle %s: %w", handle, err))
+		}
+
+		batch := &drpc.ReconcilePins{
+			After:    after,
+			Contents: ids,
+		}
+		if len(ids) < reconcileBatchSize {
+			batch.Last = true
+		} else {
+			batch.Upto = ids[len(ids)-1]
+		}
+
+		// counted first, the report may come back before the send returns
+		sr.lk.Lock()
+		sr.batches++
+		sr.lk.Unlock()
+
+		if err := cm.sendReconcilePinsCmd(ctx, handle, batch); err != nil {
+			sr.lk.Lock()
+			sr.batches--
+			sr.lk.Unlock()
+			return fail(fmt.Errorf("failed to send contents after %d to shuttle %s: %w", after, handle, err))
+		}
+
+		if batch.Last {
+			return nil
+		}
+		after = batch.Upto
+	}
+}
+
+func (cm *ContentManager) handleRpcReconcileReport(ctx context.Context, handle string, param *drpc.ReconcileReport) error {
+	v, ok := cm.reconciliations.Get(handle)
+	if !ok {
+		return fmt.Errorf("shuttle %s reported a reconciliation batch nobody waits for", handle)
+	}
+	sr := v.(*shuttleReconciliation)
+
+	sr.lk.Lock()
+	defer sr.lk.Unlock()
+
+	sr.reported++
+	sr.missing = append(sr.missing, param.Missing...)
+	sr.orphans = append(sr.orphans, param.Orphans...)
+	if param.Error != "" {
+		sr.errors = append(sr.errors, fmt.Sprintf("contents after %d: %s", param.After, param.Error))
+	}
+
+	if len(param.Missing) > 0 || len(param.Orphans) > 0 {
+		log.Warnw("shuttle pins diverged", "shuttle", handle, "after", param.After, "upto", param.Upto, "last", param.Last,
+			"missing", len(param.Missing), "orphans", len(param.Orphans))
+	}
+
+	sr.logIfDone(handle)
+	return nil
+}
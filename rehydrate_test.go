@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRehydrateProgressClearsOffloaded(t *testing.T) {
+	assert := assert.New(t)
+	cm := newOffloadTestContentManager(t)
+	assert.NoError(cm.DB.AutoMigrate(&util.ObjRef{}))
+
+	rehydrations, err := lru.NewARC(10)
+	assert.NoError(err)
+	cm.rehydrations = rehydrations
+
+	assert.NoError(cm.DB.Create(&util.Content{ID: 1, Active: true, Offloaded: true, Location: "old"}).Error)
+	for _, obj := range []uint{1, 2} {
+		assert.NoError(cm.DB.Create(&util.ObjRef{Content: 1, Object: obj, Offloaded: 1}).Error)
+	}
+
+	cm.handleRpcRehydrateProgress(context.Background(), "shuttle", &drpc.RehydrateProgress{Content: 1, Phase: drpc.RehydrateComplete})
+
+	var cont util.Content
+	assert.NoError(cm.DB.First(&cont, 1).Error)
+	assert.False(cont.Offloaded)
+	assert.Equal("shuttle", cont.Location)
+
+	// the objects of the content are back too
+	var offloaded int64
+	assert.NoError(cm.DB.Model(util.ObjRef{}).Where("content = ? and offloaded = 1", 1).Count(&offloaded).Error)
+	assert.Equal(int64(0), offloaded)
+}
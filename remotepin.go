@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const remotePinLookupTimeout = 30 * time.Second
+
+// remotePinStatus is the subset of a pin status of the IPFS pinning service
+// API needed to find the providers of a pin
+type remotePinStatus struct {
+	RequestID string   `json:"requestid"`
+	Status    string   `json:"status"`
+	Delegates []string `json:"delegates"`
+	Pin       struct {
+		Cid     string   `json:"cid"`
+		Origins []string `json:"origins"`
+	} `json:"pin"`
+}
+
+type remotePinResults struct {
+	Count   int               `json:"count"`
+	Results []remotePinStatus `json:"results"`
+}
+
+// remotePinOrigins looks up a cid on a remote IPFS pinning service and returns
+// the peers it can be pulled from: the delegates of the service holding the
+// pin, then the origins the pin was added with
+func remotePinOrigins(ctx context.Context, rps *util.RemotePinningService, c cid.Cid) ([]*peer.AddrInfo, error) {
+	if rps.Endpoint == "" {
+		return nil, fmt.Errorf("remote pinning service endpoint is required")
+	}
+
+	ep, err := url.Parse(strings.TrimSuffix(rps.Endpoint, "/"))
+	if err != nil || (ep.Scheme != "http" && ep.Scheme != "https") {
+		return nil, fmt.Errorf("invalid remote pinning service endpoint: %s", rps.Endpoint)
+	}
+
+	q := url.Values{}
+	q.Set("cid", c.String())
+	q.Set("status", "pinned")
+
+	ctx, cancel := context.WithTimeout(ctx, remotePinLookupTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ep.String()+"/pins?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if rps.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+rps.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query remote pinning service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote pinning service returned status %d", resp.StatusCode)
+	}
+
+	var res remotePinResults
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("failed to decode remote pinning service response: %w", err)
+	}
+
+	var addrs []multiaddr.Multiaddr
+	for _, st := range res.Results {
+		for _, a := range append(st.Delegates, st.Pin.Origins...) {
+			ma, err := multiaddr.NewMultiaddr(a)
+			if err != nil {
+				log.Warnf("ignoring invalid multiaddr %q from remote pinning service: %s", a, err)
+				continue
+			}
+			addrs = append(addrs, ma)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("remote pinning service has no pinned providers for %s", c)
+	}
+
+	ais, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		return nil, fmt.Errorf("remote pinning service returned providers without a peer id: %w", err)
+	}
+
+	origins := make([]*peer.AddrInfo, 0, len(ais))
+	for i := range ais {
+		origins = append(origins, &ais[i])
+	}
+	return origins, nil
+}
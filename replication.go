@@ -112,6 +112,11 @@ type ContentManager struct {
 	dealDisabledLk       sync.Mutex
 	isDealMakingDisabled bool
 
+	// wallets deals are made from, their balances are kept for
+	// walletBalanceCheckInterval so deal making for many contents does not
+	// query the chain for each of them
+	dealWallets *dealWallets
+
 	globalContentAddingDisabled bool
 	localContentAddingDisabled  bool
 
@@ -126,6 +131,68 @@ type ContentManager struct {
 
 	remoteTransferStatus *lru.ARCCache
 
+	// last peer sets reported by shuttles for their contents
+	contentPeers *lru.ARCCache
+
+	// last contents reported by shuttles for a pin label
+	pinsByLabel *lru.ARCCache
+
+	// root cids reported by shuttles for their contents
+	contentCids *lru.ARCCache
+
+	// last transfers reported by each shuttle
+	activeTransfers *lru.ARCCache
+
+	// last byte counts reported by shuttles for a transfer
+	transferBytes *lru.ARCCache
+
+	// last log level changes reported by shuttles for a subsystem
+	logLevelResults *lru.ARCCache
+
+	// last pin reassignments reported by shuttles for a content
+	pinReassignments *lru.ARCCache
+
+	// last disk usage reported by each shuttle
+	diskUsageResults *lru.ARCCache
+
+	// last content root validations reported by shuttles
+	rootValidations *lru.ARCCache
+
+	// last rehydration progress reported by shuttles for a content
+	rehydrations *lru.ARCCache
+
+	// last metadata reported by shuttles for a content
+	contentMetadata *lru.ARCCache
+
+	// last pin progress reported by shuttles for a content
+	pinProgress *lru.ARCCache
+
+	// outcome of the last config reload of each shuttle
+	configReloads *lru.ARCCache
+
+	// last piece info reported by shuttles, keyed by shuttle and piece
+	pieceInfos *lru.ARCCache
+
+	// outcome of the last split linkage repair of each shuttle
+	splitRepairs *lru.ARCCache
+
+	// result of the last benchmark of each shuttle
+	benchmarkResults *lru.ARCCache
+
+	// last reconciliation of the pins of each shuttle with its contents
+	reconciliations *lru.ARCCache
+
+	// shuttle each content offloaded on request is moving away from, it is
+	// unpinned there once the destination has it
+	offloadMigrations *lru.ARCCache
+
+	// goroutine dumps being read from shuttles, by dump id
+	goroutineDumpsLk sync.Mutex
+	goroutineDumps   map[string]*goroutineDump
+
+	pinCompleteChunksLk sync.Mutex
+	pinCompleteChunks   map[pinCompleteKey]*pinCompleteChunks
+
 	inflightCids   map[cid.Cid]uint
 	inflightCidsLk sync.Mutex
 
@@ -202,7 +269,53 @@ func (cb *contentStagingZone) DeepCopy() *contentStagingZone {
 	return cb2
 }
 
+// userStagingZoneSize overrides the staging zone size limits of a user, with
+// the sizes of a configured tier if Tier is set or else with MinSize and
+// MaxSize
+type userStagingZoneSize struct {
+	ID      uint `gorm:"primarykey"`
+	UserID  uint `gorm:"uniqueIndex"`
+	Tier    string
+	MinSize int64
+	MaxSize int64
+}
+
+// stagingZoneSize returns the size limits of the staging zones of a user,
+// zones only pick them up when they are opened
+func (cm *ContentManager) stagingZoneSize(user uint) (config.StagingZoneSize, error) {
+	def := config.StagingZoneSize{
+		MinSize: cm.cfg.StagingBucket.MinSize,
+		MaxSize: cm.cfg.StagingBucket.MaxSize,
+	}
+
+	var overrides []userStagingZoneSize
+	if err := cm.DB.Find(&overrides, "user_id = ?", user).Error; err != nil {
+		return def, err
+	}
+
+	if len(overrides) == 0 {
+		return def, nil
+	}
+
+	o := overrides[0]
+	if o.Tier == "" {
+		return config.StagingZoneSize{MinSize: o.MinSize, MaxSize: o.MaxSize}, nil
+	}
+
+	tier, ok := cm.cfg.StagingBucket.Tiers[o.Tier]
+	if !ok {
+		log.Warnf("user %d is assigned to unknown staging zone tier %q, using the default sizes", user, o.Tier)
+		return def, nil
+	}
+	return tier, nil
+}
+
 func (cm *ContentManager) newContentStagingZone(user uint, loc string) (*contentStagingZone, error) {
+	size, err := cm.stagingZoneSize(user)
+	if err != nil {
+		return nil, err
+	}
+
 	content := &util.Content{
 		Size:        0,
 		Name:        "aggregate",
@@ -223,8 +336,8 @@ func (cm *ContentManager) newContentStagingZone(user uint, loc string) (*content
 		MaxContentAge: cm.cfg.StagingBucket.MaxContentAge,
 		ZoneOpened:    time.Now(),
 		CloseTime:     time.Now().Add(cm.cfg.StagingBucket.MaxLifeTime),
-		MinSize:       cm.cfg.StagingBucket.MinSize,
-		MaxSize:       cm.cfg.StagingBucket.MaxSize,
+		MinSize:       size.MinSize,
+		MaxSize:       size.MaxSize,
 		MaxItems:      cm.cfg.StagingBucket.MaxItems,
 		User:          user,
 		ContID:        content.ID,
@@ -341,6 +454,117 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		return nil, err
 	}
 
+	peersCache, err := lru.NewARC(1000)
+	if err != nil {
+		return nil, err
+	}
+
+	labelsCache, err := lru.NewARC(1000)
+	if err != nil {
+		return nil, err
+	}
+
+	contentCidsCache, err := lru.NewARC(50000)
+	if err != nil {
+		return nil, err
+	}
+
+	transfersCache, err := lru.NewARC(100)
+	if err != nil {
+		return nil, err
+	}
+
+	transferBytesCache, err := lru.NewARC(1000)
+	if err != nil {
+		return nil, err
+	}
+
+	logLevelsCache, err := lru.NewARC(100)
+	if err != nil {
+		return nil, err
+	}
+
+	reassignmentsCache, err := lru.NewARC(100)
+	if err != nil {
+		return nil, err
+	}
+
+	diskUsageCache, err := lru.NewARC(100)
+	if err != nil {
+		return nil, err
+	}
+
+	rootValidationsCache, err := lru.NewARC(1000)
+	if err != nil {
+		return nil, err
+	}
+
+	rehydrationsCache, err := lru.NewARC(1000)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataCache, err := lru.NewARC(1000)
+	if err != nil {
+		return nil, err
+	}
+
+	offloadMigrationsCache, err := lru.NewARC(10000)
+	if err != nil {
+		return nil, err
+	}
+
+	pinProgressCache, err := lru.NewARC(1000)
+	if err != nil {
+		return nil, err
+	}
+
+	configReloadsCache, err := lru.NewARC(100)
+	if err != nil {
+		return nil, err
+	}
+
+	pieceInfosCache, err := lru.NewARC(1000)
+	if err != nil {
+		return nil, err
+	}
+
+	splitRepairsCache, err := lru.NewARC(100)
+	if err != nil {
+		return nil, err
+	}
+
+	benchmarkResultsCache, err := lru.NewARC(100)
+	if err != nil {
+		return nil, err
+	}
+
+	reconciliationsCache, err := lru.NewARC(100)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, w := range cfg.Deal.Wallets {
+		addr, err := address.NewFromString(w.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		has, err := nd.Wallet.WalletHas(context.TODO(), addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if !has {
+			return nil, fmt.Errorf("deal wallet %s is not in the wallet of the node", addr)
+		}
+	}
+
+	wallets, err := newDealWallets(cfg.Deal.Wallets, fc.ClientAddr)
+	if err != nil {
+		return nil, err
+	}
+
 	cm := &ContentManager{
 		cfg:                          cfg,
 		Provider:                     prov,
@@ -357,6 +581,27 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		buckets:                      make(map[uint][]*contentStagingZone),
 		pinMgr:                       pinmgr,
 		remoteTransferStatus:         cache,
+		contentPeers:                 peersCache,
+		pinsByLabel:                  labelsCache,
+		contentCids:                  contentCidsCache,
+		activeTransfers:              transfersCache,
+		transferBytes:                transferBytesCache,
+		logLevelResults:              logLevelsCache,
+		pinReassignments:             reassignmentsCache,
+		diskUsageResults:             diskUsageCache,
+		rootValidations:              rootValidationsCache,
+		rehydrations:                 rehydrationsCache,
+		contentMetadata:              metadataCache,
+		offloadMigrations:            offloadMigrationsCache,
+		pinProgress:                  pinProgressCache,
+		configReloads:                configReloadsCache,
+		pieceInfos:                   pieceInfosCache,
+		splitRepairs:                 splitRepairsCache,
+		benchmarkResults:             benchmarkResultsCache,
+		reconciliations:              reconciliationsCache,
+		dealWallets:                  wallets,
+		pinCompleteChunks:            make(map[pinCompleteKey]*pinCompleteChunks),
+		goroutineDumps:               make(map[string]*goroutineDump),
 		shuttles:                     make(map[string]*ShuttleConnection),
 		contentSizeLimit:             constants.DefaultContentSizeLimit,
 		hostname:                     cfg.Hostname,
@@ -774,13 +1019,18 @@ func (cm *ContentManager) rebuildStagingBuckets() error {
 
 	zones := make(map[uint][]*contentStagingZone)
 	for _, c := range stages {
+		size, err := cm.stagingZoneSize(c.UserID)
+		if err != nil {
+			return err
+		}
+
 		z := &contentStagingZone{
 			MinDealSize:   cm.cfg.StagingBucket.MinDealSize,
 			MaxContentAge: cm.cfg.StagingBucket.MaxContentAge,
 			ZoneOpened:    c.CreatedAt,
 			CloseTime:     c.CreatedAt.Add(cm.cfg.StagingBucket.MaxLifeTime),
-			MinSize:       cm.cfg.StagingBucket.MinSize,
-			MaxSize:       cm.cfg.StagingBucket.MaxSize,
+			MinSize:       size.MinSize,
+			MaxSize:       size.MaxSize,
 			MaxItems:      cm.cfg.StagingBucket.MaxItems,
 			User:          c.UserID,
 			ContID:        c.ID,
@@ -1110,6 +1360,29 @@ func (cm *ContentManager) updateMinerVersion(ctx context.Context, m address.Addr
 	return vers, nil
 }
 
+// excludeMinersByCarSize adds the miners whose car sizes do not cover a CAR
+// of the size to the miners excluded from a deal. The CAR is already built by
+// then, content is not aggregated to fit the range of a miner.
+func (cm *ContentManager) excludeMinersByCarSize(exclude map[address.Address]bool, size int64) map[address.Address]bool {
+	if exclude == nil {
+		exclude = make(map[address.Address]bool)
+	}
+
+	for m, cs := range cm.cfg.Deal.MinerCarSizes {
+		if cs.Check(size) == nil {
+			continue
+		}
+
+		maddr, err := address.NewFromString(m)
+		if err != nil {
+			log.Errorf("invalid miner address %q in miner car sizes: %s", m, err)
+			continue
+		}
+		exclude[maddr] = true
+	}
+	return exclude
+}
+
 func (cm *ContentManager) sizeIsCloseEnough(pieceSize, askMinPieceSize, askMaxPieceSize abi.PaddedPieceSize) bool {
 	if pieceSize > askMinPieceSize && pieceSize < askMaxPieceSize {
 		return true
@@ -1149,6 +1422,10 @@ type contentDeal struct {
 	SealedAt            time.Time   `json:"sealedAt"`
 	DealProtocolVersion protocol.ID `json:"deal_protocol_version"`
 	MinerVersion        string      `json:"miner_version"`
+
+	// ClientAddr is the wallet the deal was made from, empty for the deals
+	// made before deals were spread over several wallets
+	ClientAddr string `json:"clientAddr"`
 }
 
 func (cd contentDeal) MinerAddr() (address.Address, error) {
@@ -1325,6 +1602,12 @@ func (cm *ContentManager) popReadyStagingZone() []*contentStagingZone {
 				keep = append(keep, b)
 			}
 		}
+
+		// a user without open staging zones gets a new one when staging again
+		if len(keep) == 0 {
+			delete(cm.buckets, uid)
+			continue
+		}
 		cm.buckets[uid] = keep
 	}
 	return out
@@ -1454,6 +1737,20 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 
 	goodDeals := numSealed + numPublished + numProgress
 	dealsToBeMade := replicationFactor - goodDeals
+
+	if !content.Offloaded {
+		offload, err := cm.shouldAutoOffload(content, numSealed, dealsToBeMade)
+		if err != nil {
+			return err
+		}
+
+		if offload {
+			if err := cm.autoOffload(ctx, content, numSealed); err != nil {
+				return err
+			}
+		}
+	}
+
 	if dealsToBeMade <= 0 {
 		if numSealed >= replicationFactor {
 			done(time.Hour * 24)
@@ -1470,7 +1767,7 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 		return err
 	}
 
-	if pc == nil {
+	if pc == nil && !cm.cfg.Deal.LazyCommP {
 		// pre-compute piece commitment in a goroutine and dont block the checker loop while doing so
 		go func() {
 			_, _, _, err := cm.getPieceCommitment(context.Background(), content.Cid.CID, cm.Blockstore)
@@ -1536,6 +1833,17 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 		// make some more deals!
 		log.Debugw("making more deals for content", "content", content.ID, "curDealCount", len(deals), "newDeals", dealsToBeMade)
 		if err := cm.makeDealsForContent(ctx, content, dealsToBeMade, excludedMiners); err != nil {
+			// with lazy commP the shuttle only starts computing it now
+			if xerrors.Is(err, ErrWaitForRemoteCompute) {
+				log.Debugw("waiting for piece commitment to make deals", "content", content.ID)
+				done(time.Minute * 5)
+				return
+			}
+			if xerrors.Is(err, ErrInsufficientWalletBalance) {
+				log.Warnw("deferring deals until the wallet is topped up", "content", content.ID, "error", err)
+				done(time.Minute * 30)
+				return
+			}
 			log.Errorf("failed to make more deals: %s", err)
 		}
 		done(time.Minute * 10)
@@ -1595,10 +1903,10 @@ const (
 // first check deal protocol version 2, then check version 1
 func (cm *ContentManager) getProviderDealStatus(ctx context.Context, d *contentDeal, maddr address.Address, dealUUID *uuid.UUID) (*storagemarket.ProviderDealState, bool, error) {
 	isPushTransfer := false
-	providerDealState, err := cm.FilClient.DealStatus(ctx, maddr, d.PropCid.CID, dealUUID)
+	providerDealState, err := cm.dealStatus(ctx, d, maddr, dealUUID)
 	if err != nil && providerDealState == nil {
 		isPushTransfer = true
-		providerDealState, err = cm.FilClient.DealStatus(ctx, maddr, d.PropCid.CID, nil)
+		providerDealState, err = cm.dealStatus(ctx, d, maddr, nil)
 	}
 	return providerDealState, isPushTransfer, err
 }
@@ -2061,11 +2369,76 @@ func (cm *ContentManager) repairDeal(d *contentDeal) error {
 	return nil
 }
 
+// dealPriceCeiling is the highest accepted deal price per GiB per epoch
+func (cm *ContentManager) dealPriceCeiling(verified bool) abi.TokenAmount {
+	if verified {
+		return cm.cfg.Deal.MaxVerifiedPrice.TokenAmount
+	}
+	return cm.cfg.Deal.MaxPrice.TokenAmount
+}
+
 func (cm *ContentManager) priceIsTooHigh(price abi.TokenAmount) bool {
-	if cm.cfg.Deal.IsVerified {
-		return types.BigCmp(price, cm.cfg.Deal.MaxVerifiedPrice) > 0
+	return types.BigCmp(price, cm.dealPriceCeiling(cm.cfg.Deal.IsVerified)) > 0
+}
+
+// applyCollateralBounds caps the provider collateral of a deal proposal and
+// sets the client collateral we offer and the wallet the deal is made from,
+// the proposal is signed again if it changed. It fails if the chain requires
+// more provider collateral than the configured max.
+func (cm *ContentManager) applyCollateralBounds(ctx context.Context, prop *network.Proposal, client address.Address) error {
+	maxProv := cm.cfg.Deal.MaxProviderCollateral.TokenAmount
+	clientCol := cm.cfg.Deal.ClientCollateral.TokenAmount
+	if clientCol.Int == nil {
+		clientCol = big.Zero()
+	}
+
+	p := &prop.DealProposal.Proposal
+	changed := !p.ClientCollateral.Equals(clientCol) || p.Client != client
+	p.ClientCollateral = clientCol
+	p.Client = client
+
+	if maxProv.Int != nil && !maxProv.IsZero() && p.ProviderCollateral.GreaterThan(maxProv) {
+		bounds, err := cm.Api.StateDealProviderCollateralBounds(ctx, p.PieceSize, p.VerifiedDeal, types.EmptyTSK)
+		if err != nil {
+			return fmt.Errorf("failed to get provider collateral bounds: %w", err)
+		}
+
+		if bounds.Min.GreaterThan(maxProv) {
+			return fmt.Errorf("chain requires a provider collateral of at least %s FIL, over the max of %s FIL", types.FIL(bounds.Min).Unitless(), cm.cfg.Deal.MaxProviderCollateral)
+		}
+		p.ProviderCollateral = maxProv
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	raw, err := cborutil.Dump(p)
+	if err != nil {
+		return err
+	}
+
+	sig, err := cm.Node.Wallet.WalletSign(ctx, p.Client, raw, api.MsgMeta{Type: api.MTDealProposal})
+	if err != nil {
+		return fmt.Errorf("failed to sign deal proposal: %w", err)
 	}
-	return types.BigCmp(price, cm.cfg.Deal.MaxPrice) > 0
+	prop.DealProposal.ClientSignature = *sig
+	return nil
+}
+
+// ErrInsufficientWalletBalance is returned when the wallet balance is under
+// the configured minimum, deals made anyway would fail on chain once their
+// data is transferred
+var ErrInsufficientWalletBalance = fmt.Errorf("insufficient wallet balance")
+
+const walletBalanceCheckInterval = time.Minute
+
+// pickDealWallet returns the wallet the next deal is made from, it fails with
+// ErrInsufficientWalletBalance when all of them are under the configured
+// minimum
+func (cm *ContentManager) pickDealWallet(ctx context.Context) (address.Address, error) {
+	return cm.dealWallets.pick(ctx, cm.Api.WalletBalance, cm.cfg.Deal.MinWalletBalance.TokenAmount)
 }
 
 type proposalRecord struct {
@@ -2080,7 +2453,7 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content util.
 	))
 	defer span.End()
 
-	if content.Size < (256 << 10) {
+	if content.Size < cm.cfg.Deal.CarSize.Min {
 		return fmt.Errorf("content %d too small to make deals for. (size: %d)", content.ID, content.Size)
 	}
 
@@ -2088,11 +2461,16 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content util.
 		return fmt.Errorf("cannot make more deals for offloaded content, must retrieve first")
 	}
 
-	_, _, pieceSize, err := cm.getPieceCommitment(ctx, content.Cid.CID, cm.Blockstore)
+	_, carSize, pieceSize, err := cm.getPieceCommitment(ctx, content.Cid.CID, cm.Blockstore)
 	if err != nil {
 		return xerrors.Errorf("failed to compute piece commitment while making deals %d: %w", content.ID, err)
 	}
 
+	if err := cm.cfg.Deal.CarSize.Check(int64(carSize)); err != nil {
+		return fmt.Errorf("cannot make deals for content %d: %w", content.ID, err)
+	}
+	exclude = cm.excludeMinersByCarSize(exclude, int64(carSize))
+
 	filterByPrice := true // only select miners that falls within accepted price range
 	miners, err := cm.pickMiners(ctx, count*2, pieceSize.Padded(), exclude, filterByPrice)
 	if err != nil {
@@ -2101,12 +2479,32 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content util.
 
 	var readyDeals []deal
 	for _, m := range miners {
+		client, err := cm.pickDealWallet(ctx)
+		if err != nil {
+			return err
+		}
+
 		price := m.ask.GetPrice(cm.cfg.Deal.IsVerified)
 		prop, err := cm.FilClient.MakeDeal(ctx, m.address, content.Cid.CID, price, m.ask.MinPieceSize, cm.cfg.Deal.Duration, cm.cfg.Deal.IsVerified)
 		if err != nil {
 			return xerrors.Errorf("failed to construct a deal proposal: %w", err)
 		}
 
+		if err := cm.applyCollateralBounds(ctx, prop, client); err != nil {
+			if err := cm.recordDealFailure(&DealFailureError{
+				Miner:               m.address,
+				Phase:               "collateral",
+				Message:             err.Error(),
+				Content:             content.ID,
+				UserID:              content.UserID,
+				DealProtocolVersion: m.dealProtocolVersion,
+				MinerVersion:        m.ask.MinerVersion,
+			}); err != nil {
+				log.Errorw("failed to record deal failure", "error", err)
+			}
+			continue
+		}
+
 		dp, err := cm.putProposalRecord(prop.DealProposal)
 		if err != nil {
 			return err
@@ -2123,6 +2521,7 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content util.
 			PropCid:             util.DbCID{CID: propnd.Cid()},
 			DealUUID:            dealUUID.String(),
 			Miner:               m.address.String(),
+			ClientAddr:          client.String(),
 			Verified:            cm.cfg.Deal.IsVerified,
 			UserID:              content.UserID,
 			DealProtocolVersion: m.dealProtocolVersion,
@@ -2132,6 +2531,7 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content util.
 		if err := cm.DB.Create(cd).Error; err != nil {
 			return xerrors.Errorf("failed to create database entry for deal: %w", err)
 		}
+		cm.dealWallets.dealMade(client)
 
 		// Send the deal proposal to the storage provider
 		var cleanupDealPrep func() error
@@ -2283,7 +2683,9 @@ func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc strin
 	return cleanup, propPhase, err
 }
 
-func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content util.Content, miner address.Address) (uint, error) {
+// makeDealWithMiner makes a deal lasting duration epochs, or the configured
+// deal duration if it is 0
+func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content util.Content, miner address.Address, duration abi.ChainEpoch) (uint, error) {
 	ctx, span := cm.tracer.Start(ctx, "makeDealWithMiner", trace.WithAttributes(
 		attribute.Int64("content", int64(content.ID)),
 		attribute.Stringer("miner", miner),
@@ -2294,6 +2696,14 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content util.Co
 		return 0, fmt.Errorf("cannot make more deals for offloaded content, must retrieve first")
 	}
 
+	if duration == 0 {
+		duration = cm.cfg.Deal.Duration
+	}
+
+	if err := config.ValidateDealDuration(duration); err != nil {
+		return 0, err
+	}
+
 	// if it's a shuttle content and the shuttle is not online, do not proceed
 	if content.Location != constants.ContentLocationLocal && !cm.shuttleIsOnline(content.Location) {
 		return 0, fmt.Errorf("content shuttle: %s, is not online", content.Location)
@@ -2322,6 +2732,18 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content util.Co
 		})
 	}
 
+	// the car size is only known once the piece commitment was computed
+	pcr, err := cm.lookupPieceCommRecord(content.Cid.CID)
+	if err != nil {
+		return 0, err
+	}
+
+	if pcr != nil && pcr.CarSize > 0 {
+		if err := cm.cfg.Deal.CheckCarSize(miner, int64(pcr.CarSize)); err != nil {
+			return 0, fmt.Errorf("cannot make a deal for content %d: %w", content.ID, err)
+		}
+	}
+
 	ask, err := cm.getAsk(ctx, miner, 0)
 	if err != nil {
 		var clientErr *filclient.Error
@@ -2349,11 +2771,31 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content util.Co
 		return 0, fmt.Errorf("miners price is too high: %s %s", miner, price)
 	}
 
-	prop, err := cm.FilClient.MakeDeal(ctx, miner, content.Cid.CID, price, ask.MinPieceSize, cm.cfg.Deal.Duration, cm.cfg.Deal.IsVerified)
+	client, err := cm.pickDealWallet(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	prop, err := cm.FilClient.MakeDeal(ctx, miner, content.Cid.CID, price, ask.MinPieceSize, duration, cm.cfg.Deal.IsVerified)
 	if err != nil {
 		return 0, xerrors.Errorf("failed to construct a deal proposal: %w", err)
 	}
 
+	if err := cm.applyCollateralBounds(ctx, prop, client); err != nil {
+		if err := cm.recordDealFailure(&DealFailureError{
+			Miner:               miner,
+			Phase:               "collateral",
+			Message:             err.Error(),
+			Content:             content.ID,
+			UserID:              content.UserID,
+			DealProtocolVersion: proto,
+			MinerVersion:        ask.MinerVersion,
+		}); err != nil {
+			return 0, xerrors.Errorf("failed to record deal failure: %w", err)
+		}
+		return 0, err
+	}
+
 	dp, err := cm.putProposalRecord(prop.DealProposal)
 	if err != nil {
 		return 0, err
@@ -2370,6 +2812,7 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content util.Co
 		PropCid:             util.DbCID{CID: propnd.Cid()},
 		DealUUID:            dealUUID.String(),
 		Miner:               miner.String(),
+		ClientAddr:          client.String(),
 		Verified:            cm.cfg.Deal.IsVerified,
 		UserID:              content.UserID,
 		DealProtocolVersion: proto,
@@ -2379,6 +2822,7 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content util.Co
 	if err := cm.DB.Create(deal).Error; err != nil {
 		return 0, xerrors.Errorf("failed to create database entry for deal: %w", err)
 	}
+	cm.dealWallets.dealMade(client)
 
 	// Send the deal proposal to the storage provider
 	var cleanupDealPrep func() error
@@ -3200,31 +3644,67 @@ func (cm *ContentManager) sendStartTransferCommand(ctx context.Context, loc stri
 		return err
 	}
 
+	st := &drpc.StartTransfer{
+		DealDBID:  cd.ID,
+		ContentID: cd.Content,
+		Miner:     miner,
+		PropCid:   cd.PropCid.CID,
+		DataCid:   datacid,
+	}
+
+	// send the proposal along with the price ceiling so the shuttle does not
+	// spend bandwidth on a deal we would not pay for
+	var proprec proposalRecord
+	if err := cm.DB.First(&proprec, "prop_cid = ?", cd.PropCid.CID.Bytes()).Error; err != nil {
+		log.Warnf("no proposal record for deal %d, starting its transfer without a price check: %s", cd.ID, err)
+	} else {
+		maxPrice := cm.dealPriceCeiling(cd.Verified)
+		st.Proposal = proprec.Data
+		st.MaxPrice = &maxPrice
+	}
+
 	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
 		Op: drpc.CMD_StartTransfer,
 		Params: drpc.CmdParams{
-			StartTransfer: &drpc.StartTransfer{
-				DealDBID:  cd.ID,
-				ContentID: cd.Content,
-				Miner:     miner,
-				PropCid:   cd.PropCid.CID,
-				DataCid:   datacid,
-			},
+			StartTransfer: st,
 		},
 	})
 }
 
 func (cm *ContentManager) sendAggregateCmd(ctx context.Context, loc string, cont util.Content, aggr []uint, blob []byte) error {
+	cmd := &drpc.AggregateContent{
+		DBID:     cont.ID,
+		UserID:   cont.UserID,
+		Contents: aggr,
+		Root:     cont.Cid.CID,
+	}
+
+	// shuttles that predate fetching the block only take it inline
+	if max := cm.cfg.RPCMessage.InlineAggregateMaxSize; max > 0 && len(blob) > max && cm.shuttleFetchesAggregateBlocks(loc) {
+		// keep the command small, the shuttle fetches the block from us,
+		// it is dropped once the shuttle reports the aggregate complete
+		blk, err := blocks.NewBlockWithCid(blob, cont.Cid.CID)
+		if err != nil {
+			return err
+		}
+
+		if err := cm.Blockstore.Put(ctx, blk); err != nil {
+			return err
+		}
+
+		ai, err := cm.addrInfoForShuttle(constants.ContentLocationLocal)
+		if err != nil {
+			return err
+		}
+		cmd.Peers = []*peer.AddrInfo{ai}
+	} else {
+		cmd.ObjData = blob
+	}
+
 	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
 		Op: drpc.CMD_AggregateContent,
 		Params: drpc.CmdParams{
-			AggregateContent: &drpc.AggregateContent{
-				DBID:     cont.ID,
-				UserID:   cont.UserID,
-				Contents: aggr,
-				Root:     cont.Cid.CID,
-				ObjData:  blob,
-			},
+			AggregateContent: cmd,
 		},
 	})
 }
@@ -3298,6 +3778,444 @@ func (cm *ContentManager) sendUnpinCmd(ctx context.Context, loc string, conts []
 	})
 }
 
+func (cm *ContentManager) sendQueueStatsCmd(ctx context.Context, loc string) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_QueueStats,
+		Params: drpc.CmdParams{
+			QueueStats: &drpc.QueueStatsRequest{},
+		},
+	})
+}
+
+func (cm *ContentManager) sendAckCmd(ctx context.Context, loc string, ids ...uint64) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_Ack,
+		Params: drpc.CmdParams{
+			Ack: &drpc.Ack{
+				IDs: ids,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendGetContentPeersCmd(ctx context.Context, loc string, contID uint) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_GetContentPeers,
+		Params: drpc.CmdParams{
+			GetContentPeers: &drpc.GetContentPeers{
+				DBID: contID,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendRechunkContentCmd(ctx context.Context, loc string, cont util.Content, chunkerSpec string, rawLeaves bool, unpinOld bool) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_RechunkContent,
+		Params: drpc.CmdParams{
+			RechunkContent: &drpc.RechunkContent{
+				DBID:      cont.ID,
+				Name:      cont.Name,
+				Chunker:   chunkerSpec,
+				RawLeaves: rawLeaves,
+				UnpinOld:  unpinOld,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendTransferBandwidthLimitCmd(ctx context.Context, loc string, chanid datatransfer.ChannelID, d contentDeal, bytesPerSecond int64) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_TransferBandwidthLimit,
+		Params: drpc.CmdParams{
+			TransferBandwidthLimit: &drpc.TransferBandwidthLimit{
+				ChanID:         chanid,
+				DealDBID:       d.ID,
+				BytesPerSecond: bytesPerSecond,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendForceReconnectCmd(ctx context.Context, loc string, delay time.Duration, reason string) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_ForceReconnect,
+		Params: drpc.CmdParams{
+			ForceReconnect: &drpc.ForceReconnect{
+				Delay:  delay,
+				Reason: reason,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendGetDiskUsageCmd(ctx context.Context, loc string, refresh bool) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_GetDiskUsage,
+		Params: drpc.CmdParams{
+			GetDiskUsage: &drpc.GetDiskUsage{
+				Refresh: refresh,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendWarmCacheCmd(ctx context.Context, loc string, cont uint, maxBlocks int) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_WarmCache,
+		Params: drpc.CmdParams{
+			WarmCache: &drpc.WarmCache{
+				DBID:      cont,
+				MaxBlocks: maxBlocks,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendSetContentMetadataCmd(ctx context.Context, loc string, cont uint, md map[string]string, replace bool) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_SetContentMetadata,
+		Params: drpc.CmdParams{
+			SetContentMetadata: &drpc.SetContentMetadata{
+				DBID:     cont,
+				Metadata: md,
+				Replace:  replace,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendGetContentMetadataCmd(ctx context.Context, loc string, cont uint) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_GetContentMetadata,
+		Params: drpc.CmdParams{
+			GetContentMetadata: &drpc.GetContentMetadata{
+				DBID: cont,
+			},
+		},
+	})
+}
+
+// sendRehydrateContentCmd has the shuttle holding a content retrieve it back
+// from its active deals
+func (cm *ContentManager) sendRehydrateContentCmd(ctx context.Context, loc string, cont util.Content) error {
+	var activeDeals []contentDeal
+	if err := cm.DB.Find(&activeDeals, "content = ? and not failed and deal_id > 0", cont.ID).Error; err != nil {
+		return err
+	}
+
+	var deals []drpc.StorageDeal
+	for _, d := range activeDeals {
+		ma, err := d.MinerAddr()
+		if err != nil {
+			log.Errorf("failed to parse miner address for deal %d: %s", d.ID, err)
+			continue
+		}
+
+		deals = append(deals, drpc.StorageDeal{
+			Miner:  ma,
+			DealID: d.DealID,
+		})
+	}
+
+	if len(deals) == 0 {
+		return fmt.Errorf("no active deals for content %d, cannot rehydrate", cont.ID)
+	}
+
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_RehydrateContent,
+		Params: drpc.CmdParams{
+			RehydrateContent: &drpc.RehydrateContent{
+				UserID:  cont.UserID,
+				Content: cont.ID,
+				Cid:     cont.Cid.CID,
+				Deals:   deals,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendValidateContentRootCmd(ctx context.Context, loc string, root cid.Cid, peers []*peer.AddrInfo, timeout time.Duration) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_ValidateContentRoot,
+		Params: drpc.CmdParams{
+			ValidateContentRoot: &drpc.ValidateContentRoot{
+				Cid:     root,
+				Peers:   peers,
+				Timeout: timeout,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendSetReadOnlyCmd(ctx context.Context, loc string, cont uint, readOnly bool) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_SetReadOnly,
+		Params: drpc.CmdParams{
+			SetReadOnly: &drpc.SetReadOnly{
+				DBID:     cont,
+				ReadOnly: readOnly,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendReassignPinCmd(ctx context.Context, loc string, cont uint, user uint) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_ReassignPin,
+		Params: drpc.CmdParams{
+			ReassignPin: &drpc.ReassignPin{
+				DBID:   cont,
+				UserID: user,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendSetLogLevelCmd(ctx context.Context, loc string, subsystem string, level string) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_SetLogLevel,
+		Params: drpc.CmdParams{
+			SetLogLevel: &drpc.SetLogLevel{
+				Subsystem: subsystem,
+				Level:     level,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendConfigReloadCmd(ctx context.Context, loc string) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_ConfigReload,
+		Params: drpc.CmdParams{
+			ConfigReload: &drpc.ConfigReload{},
+		},
+	})
+}
+
+func (cm *ContentManager) sendGetPieceInfoCmd(ctx context.Context, loc string, piece cid.Cid, query bool) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_GetPieceInfo,
+		Params: drpc.CmdParams{
+			GetPieceInfo: &drpc.GetPieceInfo{
+				PieceCid: piece,
+				Query:    query,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendRepairSplitLinkageCmd(ctx context.Context, loc string, dryRun bool, parents []uint) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_RepairSplitLinkage,
+		Params: drpc.CmdParams{
+			RepairSplitLinkage: &drpc.RepairSplitLinkage{
+				DryRun:  dryRun,
+				Parents: parents,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendBenchmarkCmd(ctx context.Context, loc string, size int64, provide bool) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_Benchmark,
+		Params: drpc.CmdParams{
+			Benchmark: &drpc.Benchmark{
+				Size:    size,
+				Provide: provide,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendReconcilePinsCmd(ctx context.Context, loc string, batch *drpc.ReconcilePins) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_ReconcilePins,
+		Params: drpc.CmdParams{
+			ReconcilePins: batch,
+		},
+	})
+}
+
+func (cm *ContentManager) sendListActiveTransfersCmd(ctx context.Context, loc string) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_ListActiveTransfers,
+		Params: drpc.CmdParams{
+			ListActiveTransfers: &drpc.ListActiveTransfers{},
+		},
+	})
+}
+
+func (cm *ContentManager) sendGetTransferBytesCmd(ctx context.Context, loc string, chanid string) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_GetTransferBytes,
+		Params: drpc.CmdParams{
+			GetTransferBytes: &drpc.GetTransferBytes{
+				Chanid: chanid,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendDumpGoroutinesCmd(ctx context.Context, loc string, id string) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_DumpGoroutines,
+		Params: drpc.CmdParams{
+			DumpGoroutines: &drpc.DumpGoroutines{
+				DumpID: id,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendGetContentCIDCmd(ctx context.Context, loc string, contents []uint) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_GetContentCID,
+		Params: drpc.CmdParams{
+			GetContentCID: &drpc.GetContentCID{
+				Contents: contents,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendBulkAddPinCmd(ctx context.Context, loc string, pins []drpc.AddPin) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_BulkAddPin,
+		Params: drpc.CmdParams{
+			BulkAddPin: &drpc.BulkAddPin{
+				Pins: pins,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendFindPinsByLabelCmd(ctx context.Context, loc string, label string) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_FindPinsByLabel,
+		Params: drpc.CmdParams{
+			FindPinsByLabel: &drpc.FindPinsByLabel{
+				Label: label,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendSetUserQuotaCmd(ctx context.Context, loc string, user uint, quota int64) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_SetUserQuota,
+		Params: drpc.CmdParams{
+			SetUserQuota: &drpc.SetUserQuota{
+				UserID: user,
+				Quota:  quota,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendGetPinProgressCmd(ctx context.Context, loc string, contID uint) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_GetPinProgress,
+		Params: drpc.CmdParams{
+			GetPinProgress: &drpc.GetPinProgress{
+				DBID: contID,
+			},
+		},
+	})
+}
+
+// localPinProgress returns the progress of the pin of a content being worked
+// on by this node
+func (cm *ContentManager) localPinProgress(ctx context.Context, cont util.Content) *drpc.PinProgress {
+	res := &drpc.PinProgress{
+		DBID: cont.ID,
+	}
+
+	prog, ok := cm.pinMgr.PinProgress(cont.ID)
+	if !ok {
+		return res
+	}
+
+	res.Running = true
+	res.Started = prog.Started
+	res.BlocksFetched = prog.NumFetched
+	res.BytesFetched = prog.SizeFetched
+	res.EstimatedSize = util.EstimateDagSize(ctx, cm.Blockstore, cont.Cid.CID)
+	return res
+}
+
+func (cm *ContentManager) sendPauseUserCmd(ctx context.Context, loc string, user uint, reason string) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_PauseUser,
+		Params: drpc.CmdParams{
+			PauseUser: &drpc.PauseUser{
+				UserID: user,
+				Reason: reason,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendResumeUserCmd(ctx context.Context, loc string, user uint) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_ResumeUser,
+		Params: drpc.CmdParams{
+			ResumeUser: &drpc.ResumeUser{
+				UserID: user,
+			},
+		},
+	})
+}
+
+// sendSetReplicationPolicyCmd sets the replication policy of a content on the
+// shuttle holding it, along with the deals the policy is checked against. A
+// content of 0 sets the default policy of the shuttle.
+func (cm *ContentManager) sendSetReplicationPolicyCmd(ctx context.Context, loc string, contID uint, minActiveDeals int, expiryWindow time.Duration) error {
+	var deals []drpc.StorageDeal
+	if contID != 0 {
+		var cdeals []contentDeal
+		if err := cm.DB.Find(&cdeals, "content = ? and deal_id > 0 and not failed and not slashed", contID).Error; err != nil {
+			return err
+		}
+
+		for _, d := range cdeals {
+			maddr, err := d.MinerAddr()
+			if err != nil {
+				return err
+			}
+
+			deals = append(deals, drpc.StorageDeal{
+				Miner:  maddr,
+				DealID: d.DealID,
+			})
+		}
+	}
+
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_SetReplicationPolicy,
+		Params: drpc.CmdParams{
+			SetReplicationPolicy: &drpc.SetReplicationPolicy{
+				Content:        contID,
+				MinActiveDeals: minActiveDeals,
+				ExpiryWindow:   expiryWindow,
+				Deals:          deals,
+			},
+		},
+	})
+}
+
+func (cm *ContentManager) sendRelocatePinCmd(ctx context.Context, loc string, contents []uint) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_RelocatePin,
+		Params: drpc.CmdParams{
+			RelocatePin: &drpc.RelocatePin{
+				Contents: contents,
+			},
+		},
+	})
+}
+
 func (cm *ContentManager) dealMakingDisabled() bool {
 	cm.dealDisabledLk.Lock()
 	defer cm.dealDisabledLk.Unlock()
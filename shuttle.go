@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
+	"sort"
 	"time"
 
 	"go.opentelemetry.io/otel/trace"
@@ -17,6 +20,7 @@ import (
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
@@ -43,12 +47,29 @@ type ShuttleConnection struct {
 
 	private               bool
 	ContentAddingDisabled bool
+	retrievalOnly         bool
+
+	// content formats the shuttle can process, nil if it did not say
+	formats *drpc.ContentFormats
+
+	// whether the shuttle fetches aggregate blocks not sent inline
+	fetchesAggregateBlocks bool
 
 	spaceLow       bool
+	storageFull    bool
 	blockstoreSize uint64
 	blockstoreFree uint64
 	pinCount       int64
 	pinQueueLength int64
+	activePins     int64
+	userQueueSizes map[uint]int
+
+	retrievalQueueLength int64
+	activeRetrievals     int64
+	pausedUsers          []uint
+
+	// last health report of the shuttle
+	health *util.ShuttleHealth
 }
 
 func (sc *ShuttleConnection) sendMessage(ctx context.Context, cmd *drpc.Command) error {
@@ -89,14 +110,17 @@ func (cm *ContentManager) registerShuttleConnection(handle string, hello *drpc.H
 	ctx, cancel := context.WithCancel(context.Background())
 
 	sc := &ShuttleConnection{
-		handle:                handle,
-		address:               hello.Address,
-		addrInfo:              hello.AddrInfo,
-		hostname:              hello.Host,
-		cmds:                  make(chan *drpc.Command, cm.cfg.RPCMessage.OutgoingQueueSize),
-		ctx:                   ctx,
-		private:               hello.Private,
-		ContentAddingDisabled: hello.ContentAddingDisabled,
+		handle:                 handle,
+		address:                hello.Address,
+		addrInfo:               hello.AddrInfo,
+		hostname:               hello.Host,
+		cmds:                   make(chan *drpc.Command, cm.cfg.RPCMessage.OutgoingQueueSize),
+		ctx:                    ctx,
+		private:                hello.Private,
+		ContentAddingDisabled:  hello.ContentAddingDisabled,
+		retrievalOnly:          hello.RetrievalOnly,
+		formats:                hello.Formats,
+		fetchesAggregateBlocks: hello.FetchesAggregateBlocks,
 	}
 
 	cm.shuttles[handle] = sc
@@ -111,9 +135,131 @@ func (cm *ContentManager) registerShuttleConnection(handle string, hello *drpc.H
 			}
 		}
 		cm.shuttlesLk.Unlock()
+
+		// chunks of a pin complete that did not make it before the connection
+		// dropped can't be completed anymore
+		cm.dropPinCompleteChunks(handle)
 	}, nil
 }
 
+// how long the parts of a chunked pin complete wait for the others, the
+// shuttle sends the whole pin complete again when the pin is asked for again
+const pinCompleteChunksTTL = time.Hour
+
+// pinCompleteChunks gathers the parts of a chunked pin complete, since
+// messages are handled concurrently they can be processed in any order
+type pinCompleteChunks struct {
+	chunks  map[int][]drpc.PinObj
+	final   *drpc.PinComplete
+	updated time.Time
+}
+
+type pinCompleteKey struct {
+	handle string
+	dbid   uint
+}
+
+func (cm *ContentManager) addPinCompleteChunk(handle string, chunk *drpc.PinCompleteChunk) *drpc.PinComplete {
+	cm.pinCompleteChunksLk.Lock()
+	defer cm.pinCompleteChunksLk.Unlock()
+
+	pcc := cm.getPinCompleteChunks(handle, chunk.DBID)
+	pcc.chunks[chunk.Index] = chunk.Objects
+	return cm.assemblePinComplete(handle, chunk.DBID)
+}
+
+func (cm *ContentManager) addPinCompleteFinal(handle string, pincomp *drpc.PinComplete) *drpc.PinComplete {
+	cm.pinCompleteChunksLk.Lock()
+	defer cm.pinCompleteChunksLk.Unlock()
+
+	pcc := cm.getPinCompleteChunks(handle, pincomp.DBID)
+	pcc.final = pincomp
+	return cm.assemblePinComplete(handle, pincomp.DBID)
+}
+
+// must be called with pinCompleteChunksLk held
+func (cm *ContentManager) getPinCompleteChunks(handle string, dbid uint) *pinCompleteChunks {
+	key := pinCompleteKey{handle: handle, dbid: dbid}
+	pcc, ok := cm.pinCompleteChunks[key]
+	if !ok {
+		pcc = &pinCompleteChunks{chunks: make(map[int][]drpc.PinObj)}
+		cm.pinCompleteChunks[key] = pcc
+	}
+	pcc.updated = time.Now()
+	return pcc
+}
+
+// assemblePinComplete returns the full pin complete once the final message
+// and all its chunks arrived, must be called with pinCompleteChunksLk held
+func (cm *ContentManager) assemblePinComplete(handle string, dbid uint) *drpc.PinComplete {
+	key := pinCompleteKey{handle: handle, dbid: dbid}
+	pcc := cm.pinCompleteChunks[key]
+	if pcc.final == nil || len(pcc.chunks) < pcc.final.Chunks {
+		return nil
+	}
+
+	var objects []drpc.PinObj
+	for i := 0; i < pcc.final.Chunks; i++ {
+		objs, ok := pcc.chunks[i]
+		if !ok {
+			return nil
+		}
+		objects = append(objects, objs...)
+	}
+	objects = append(objects, pcc.final.Objects...)
+
+	delete(cm.pinCompleteChunks, key)
+	return &drpc.PinComplete{
+		DBID:    pcc.final.DBID,
+		Size:    pcc.final.Size,
+		Objects: objects,
+	}
+}
+
+// watchPinCompleteChunks drops the chunked pin completes that stopped
+// receiving parts, e.g. because the shuttle restarted midway
+func (cm *ContentManager) watchPinCompleteChunks(ctx context.Context) {
+	ticker := time.NewTicker(pinCompleteChunksTTL / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if n := cm.expirePinCompleteChunks(time.Now()); n > 0 {
+			log.Warnf("dropped %d chunked pin completes that were not completed within %s", n, pinCompleteChunksTTL)
+		}
+	}
+}
+
+func (cm *ContentManager) expirePinCompleteChunks(now time.Time) int {
+	cm.pinCompleteChunksLk.Lock()
+	defer cm.pinCompleteChunksLk.Unlock()
+
+	var n int
+	for key, pcc := range cm.pinCompleteChunks {
+		if now.Sub(pcc.updated) > pinCompleteChunksTTL {
+			delete(cm.pinCompleteChunks, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (cm *ContentManager) dropPinCompleteChunks(handle string) {
+	cm.pinCompleteChunksLk.Lock()
+	defer cm.pinCompleteChunksLk.Unlock()
+
+	for key := range cm.pinCompleteChunks {
+		if key.handle == handle {
+			delete(cm.pinCompleteChunks, key)
+		}
+	}
+}
+
 var ErrNilParams = fmt.Errorf("shuttle message had nil params")
 
 func (cm *ContentManager) handleShuttleMessages(ctx context.Context, numHandlers int) {
@@ -124,9 +270,19 @@ func (cm *ContentManager) handleShuttleMessages(ctx context.Context, numHandlers
 				case <-ctx.Done():
 					return
 				case msg := <-cm.IncomingRPCMessages:
-					if err := cm.processShuttleMessage(msg.Handle, msg); err != nil {
+					err := cm.processShuttleMessage(msg.Handle, msg)
+					if err != nil {
 						log.Errorf("failed to process message from shuttle: %s", err)
 					}
+
+					// the shuttle keeps resending messages with an ID until they are
+					// acked, those that failed are left to be resent unless they are
+					// malformed and never will be processed
+					if msg.ID != 0 && (err == nil || errors.Is(err, ErrNilParams)) {
+						if err := cm.sendAckCmd(ctx, msg.Handle, msg.ID); err != nil {
+							log.Errorf("failed to ack message %d from shuttle %s: %s", msg.ID, msg.Handle, err)
+						}
+					}
 				}
 			}
 		}()
@@ -160,8 +316,45 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 			return ErrNilParams
 		}
 
+		if param.Chunks > 0 {
+			// wait for the remaining chunks if they were not all processed yet
+			if param = cm.addPinCompleteFinal(handle, param); param == nil {
+				return nil
+			}
+		}
+
 		if err := cm.handlePinningComplete(ctx, handle, param); err != nil {
-			log.Errorw("handling pin complete message failed", "shuttle", handle, "err", err)
+			return fmt.Errorf("handling pin complete message from shuttle %s: %w", handle, err)
+		}
+		return nil
+	case drpc.OP_BulkAddPinResult:
+		param := msg.Params.BulkAddPinResult
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcBulkAddPinResult(ctx, handle, param)
+		return nil
+	case drpc.OP_PinRejected:
+		param := msg.Params.PinRejected
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcPinRejected(ctx, handle, param); err != nil {
+			log.Errorf("handling pin rejected message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_PinCompleteChunk:
+		param := msg.Params.PinCompleteChunk
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if pincomp := cm.addPinCompleteChunk(handle, param); pincomp != nil {
+			if err := cm.handlePinningComplete(ctx, handle, pincomp); err != nil {
+				return fmt.Errorf("handling pin complete message from shuttle %s: %w", handle, err)
+			}
 		}
 		return nil
 	case drpc.OP_CommPComplete:
@@ -171,7 +364,7 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 		}
 
 		if err := cm.handleRpcCommPComplete(ctx, handle, param); err != nil {
-			log.Errorf("handling commp complete message from shuttle %s: %s", handle, err)
+			return fmt.Errorf("handling commp complete message from shuttle %s: %w", handle, err)
 		}
 		return nil
 	case drpc.OP_TransferStarted:
@@ -181,7 +374,7 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 		}
 
 		if err := cm.handleRpcTransferStarted(ctx, handle, param); err != nil {
-			log.Errorf("handling transfer started message from shuttle %s: %s", handle, err)
+			return fmt.Errorf("handling transfer started message from shuttle %s: %w", handle, err)
 		}
 		return nil
 	case drpc.OP_TransferFinished:
@@ -191,7 +384,7 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 		}
 
 		if err := cm.handleRpcTransferFinished(ctx, handle, param); err != nil {
-			log.Errorf("handling transfer finished message from shuttle %s: %s", handle, err)
+			return fmt.Errorf("handling transfer finished message from shuttle %s: %w", handle, err)
 		}
 		return nil
 	case drpc.OP_TransferStatus:
@@ -201,7 +394,7 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 		}
 
 		if err := cm.handleRpcTransferStatus(ctx, handle, param); err != nil {
-			log.Errorf("handling transfer status message from shuttle %s: %s", handle, err)
+			return fmt.Errorf("handling transfer status message from shuttle %s: %w", handle, err)
 		}
 		return nil
 	case drpc.OP_ShuttleUpdate:
@@ -214,6 +407,26 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 			log.Errorf("handling shuttle update message from shuttle %s: %s", handle, err)
 		}
 		return nil
+	case drpc.OP_RechunkComplete:
+		param := msg.Params.RechunkComplete
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcRechunkComplete(ctx, handle, param); err != nil {
+			log.Errorf("handling rechunk complete message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_HealthReport:
+		param := msg.Params.HealthReport
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcHealthReport(ctx, handle, param); err != nil {
+			log.Errorf("handling health report message from shuttle %s: %s", handle, err)
+		}
+		return nil
 	case drpc.OP_GarbageCheck:
 		param := msg.Params.GarbageCheck
 		if param == nil {
@@ -231,9 +444,240 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 		}
 
 		if err := cm.handleRpcSplitComplete(ctx, handle, param); err != nil {
-			log.Errorf("handling split complete message from shuttle %s: %s", handle, err)
+			return fmt.Errorf("handling split complete message from shuttle %s: %w", handle, err)
+		}
+		return nil
+	case drpc.OP_AggregateComplete:
+		param := msg.Params.AggregateComplete
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcAggregateComplete(ctx, handle, param); err != nil {
+			return fmt.Errorf("handling aggregate complete message from shuttle %s: %w", handle, err)
+		}
+		return nil
+	case drpc.OP_QueueStats:
+		param := msg.Params.QueueStats
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcQueueStats(ctx, handle, param); err != nil {
+			log.Errorf("handling queue stats message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_ContentPeers:
+		param := msg.Params.ContentPeers
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcContentPeers(ctx, handle, param)
+		return nil
+	case drpc.OP_ContentCIDs:
+		param := msg.Params.ContentCIDs
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcContentCIDs(ctx, handle, param)
+		return nil
+	case drpc.OP_PinsByLabel:
+		param := msg.Params.PinsByLabel
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcPinsByLabel(ctx, handle, param)
+		return nil
+	case drpc.OP_ActiveTransfers:
+		param := msg.Params.ActiveTransfers
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcActiveTransfers(ctx, handle, param)
+		return nil
+	case drpc.OP_TransferBytes:
+		param := msg.Params.TransferBytes
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcTransferBytes(ctx, handle, param)
+		return nil
+	case drpc.OP_GoroutineDump:
+		param := msg.Params.GoroutineDump
+		if param == nil {
+			return ErrNilParams
+		}
+
+		return cm.handleRpcGoroutineDump(ctx, handle, param)
+	case drpc.OP_ReplicationNeeded:
+		param := msg.Params.ReplicationNeeded
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcReplicationNeeded(ctx, handle, param); err != nil {
+			log.Errorf("handling replication needed message from shuttle %s: %s", handle, err)
 		}
 		return nil
+	case drpc.OP_DealExpiring:
+		param := msg.Params.DealExpiring
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcDealExpiring(ctx, handle, param); err != nil {
+			return fmt.Errorf("handling deal expiring message from shuttle %s: %w", handle, err)
+		}
+		return nil
+	case drpc.OP_DiskUsage:
+		param := msg.Params.DiskUsage
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcDiskUsage(ctx, handle, param)
+		return nil
+	case drpc.OP_ContentRootValidation:
+		param := msg.Params.ContentRootValidation
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcContentRootValidation(ctx, handle, param)
+		return nil
+	case drpc.OP_ContentMetadata:
+		param := msg.Params.ContentMetadata
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.contentMetadata.Add(param.DBID, param)
+		return nil
+	case drpc.OP_RehydrateProgress:
+		param := msg.Params.RehydrateProgress
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcRehydrateProgress(ctx, handle, param)
+		return nil
+	case drpc.OP_PinProgress:
+		param := msg.Params.PinProgress
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.pinProgress.Add(param.DBID, param)
+		return nil
+	case drpc.OP_ConfigReloaded:
+		param := msg.Params.ConfigReloaded
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.configReloads.Add(handle, param)
+		return nil
+	case drpc.OP_PieceInfo:
+		param := msg.Params.PieceInfo
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.pieceInfos.Add(pieceInfoKey{handle: handle, piece: param.PieceCid}, param)
+		return nil
+	case drpc.OP_SplitLinkageRepaired:
+		param := msg.Params.SplitLinkageRepaired
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcSplitLinkageRepaired(ctx, handle, param)
+		return nil
+	case drpc.OP_BenchmarkResult:
+		param := msg.Params.BenchmarkResult
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.benchmarkResults.Add(handle, param)
+		return nil
+	case drpc.OP_ReconcileReport:
+		param := msg.Params.ReconcileReport
+		if param == nil {
+			return ErrNilParams
+		}
+
+		return cm.handleRpcReconcileReport(ctx, handle, param)
+	case drpc.OP_OffloadRequest:
+		param := msg.Params.OffloadRequest
+		if param == nil {
+			return ErrNilParams
+		}
+
+		return cm.handleRpcOffloadRequest(ctx, handle, param)
+	case drpc.OP_CacheWarmed:
+		param := msg.Params.CacheWarmed
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcCacheWarmed(ctx, handle, param)
+		return nil
+	case drpc.OP_PinReassigned:
+		param := msg.Params.PinReassigned
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcPinReassigned(ctx, handle, param)
+		return nil
+	case drpc.OP_IntegrityAlert:
+		param := msg.Params.IntegrityAlert
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcIntegrityAlert(ctx, handle, param); err != nil {
+			log.Errorf("handling integrity alert from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_LogLevelSet:
+		param := msg.Params.LogLevelSet
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcLogLevelSet(ctx, handle, param)
+		return nil
+	case drpc.OP_TransferBandwidthLimitApplied:
+		param := msg.Params.TransferBandwidthLimitApplied
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcTransferBandwidthLimitApplied(ctx, handle, param)
+		return nil
+	case drpc.OP_TakeContentProgress:
+		param := msg.Params.TakeContentProgress
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcTakeContentProgress(ctx, handle, param)
+		return nil
+	case drpc.OP_RelocatePinDone:
+		param := msg.Params.RelocatePinDone
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcRelocatePinDone(ctx, handle, param)
+		return nil
 	default:
 		return fmt.Errorf("unrecognized message op: %q", msg.Op)
 	}
@@ -241,6 +685,30 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 
 var ErrNoShuttleConnection = fmt.Errorf("no connection to requested shuttle")
 
+// sayGoodbyeToShuttles tells every connected shuttle that we are closing the
+// connection on purpose, so they can reconnect without treating it as an error
+func (cm *ContentManager) sayGoodbyeToShuttles(ctx context.Context, reason string) {
+	cm.shuttlesLk.Lock()
+	var handles []string
+	for h := range cm.shuttles {
+		handles = append(handles, h)
+	}
+	cm.shuttlesLk.Unlock()
+
+	for _, h := range handles {
+		if err := cm.sendShuttleCommand(ctx, h, &drpc.Command{
+			Op: drpc.CMD_Goodbye,
+			Params: drpc.CmdParams{
+				Goodbye: &drpc.Goodbye{
+					Reason: reason,
+				},
+			},
+		}); err != nil {
+			log.Warnf("failed to send goodbye to shuttle %s: %s", h, err)
+		}
+	}
+}
+
 func (cm *ContentManager) sendShuttleCommand(ctx context.Context, handle string, cmd *drpc.Command) error {
 	if handle == "" {
 		return fmt.Errorf("attempted to send command to empty shuttle handle")
@@ -276,11 +744,21 @@ func (cm *ContentManager) shuttleCanAddContent(handle string) bool {
 	defer cm.shuttlesLk.Unlock()
 	d, ok := cm.shuttles[handle]
 	if ok {
-		return d.ContentAddingDisabled
+		return !d.ContentAddingDisabled && !d.retrievalOnly
 	}
 	return true
 }
 
+func (cm *ContentManager) shuttleFetchesAggregateBlocks(handle string) bool {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if ok {
+		return d.fetchesAggregateBlocks
+	}
+	return false
+}
+
 func (cm *ContentManager) shuttleAddrInfo(handle string) *peer.AddrInfo {
 	cm.shuttlesLk.Lock()
 	defer cm.shuttlesLk.Unlock()
@@ -310,29 +788,79 @@ func (cm *ContentManager) shuttleStorageStats(handle string) *util.ShuttleStorag
 	}
 
 	return &util.ShuttleStorageStats{
-		BlockstoreSize: d.blockstoreSize,
-		BlockstoreFree: d.blockstoreFree,
-		PinCount:       d.pinCount,
-		PinQueueLength: d.pinQueueLength,
+		BlockstoreSize:       d.blockstoreSize,
+		BlockstoreFree:       d.blockstoreFree,
+		PinCount:             d.pinCount,
+		PinQueueLength:       d.pinQueueLength,
+		ActivePins:           d.activePins,
+		UserQueueSizes:       d.userQueueSizes,
+		RetrievalQueueLength: d.retrievalQueueLength,
+		ActiveRetrievals:     d.activeRetrievals,
+		PausedUsers:          d.pausedUsers,
 	}
 }
 
-func (cm *ContentManager) handleRpcCommPComplete(ctx context.Context, handle string, resp *drpc.CommPComplete) error {
-	_, span := cm.tracer.Start(ctx, "handleRpcCommPComplete")
-	defer span.End()
-
-	opcr := PieceCommRecord{
-		Data:    util.DbCID{CID: resp.Data},
-		Piece:   util.DbCID{CID: resp.CommP},
-		Size:    resp.Size,
-		CarSize: resp.CarSize,
+func (cm *ContentManager) shuttleHealth(handle string) *util.ShuttleHealth {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if !ok {
+		return nil
 	}
-
-	return cm.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&opcr).Error
+	return d.health
 }
 
-func (cm *ContentManager) handleRpcTransferStarted(ctx context.Context, handle string, param *drpc.TransferStartedOrFinished) error {
-	if err := cm.SetDataTransferStartedOrFinished(ctx, param.DealDBID, param.Chanid, param.State, true); err != nil {
+const shuttleHealthCheckInterval = time.Minute
+
+// watchShuttleHealth periodically asks the connected shuttles for a health
+// report, the last reports are listed along with the shuttles
+func (cm *ContentManager) watchShuttleHealth(ctx context.Context) {
+	ticker := time.NewTicker(shuttleHealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		cm.shuttlesLk.Lock()
+		var handles []string
+		for h := range cm.shuttles {
+			handles = append(handles, h)
+		}
+		cm.shuttlesLk.Unlock()
+
+		for _, h := range handles {
+			if err := cm.sendShuttleCommand(ctx, h, &drpc.Command{
+				Op: drpc.CMD_HealthCheck,
+				Params: drpc.CmdParams{
+					HealthCheck: &drpc.HealthCheck{},
+				},
+			}); err != nil {
+				log.Warnf("failed to send health check to shuttle %s: %s", h, err)
+			}
+		}
+	}
+}
+
+func (cm *ContentManager) handleRpcCommPComplete(ctx context.Context, handle string, resp *drpc.CommPComplete) error {
+	_, span := cm.tracer.Start(ctx, "handleRpcCommPComplete")
+	defer span.End()
+
+	opcr := PieceCommRecord{
+		Data:    util.DbCID{CID: resp.Data},
+		Piece:   util.DbCID{CID: resp.CommP},
+		Size:    resp.Size,
+		CarSize: resp.CarSize,
+	}
+
+	return cm.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&opcr).Error
+}
+
+func (cm *ContentManager) handleRpcTransferStarted(ctx context.Context, handle string, param *drpc.TransferStartedOrFinished) error {
+	if err := cm.SetDataTransferStartedOrFinished(ctx, param.DealDBID, param.Chanid, param.State, true); err != nil {
 		return err
 	}
 	log.Debugw("Started data transfer on shuttle", "chanid", param.Chanid, "shuttle", handle)
@@ -420,14 +948,528 @@ func (cm *ContentManager) handleRpcShuttleUpdate(ctx context.Context, handle str
 	}
 
 	d.spaceLow = param.BlockstoreFree < (param.BlockstoreSize / 10)
+	d.storageFull = param.StorageFull
 	d.blockstoreFree = param.BlockstoreFree
 	d.blockstoreSize = param.BlockstoreSize
 	d.pinCount = param.NumPins
 	d.pinQueueLength = int64(param.PinQueueSize)
+	d.activePins = int64(param.ActivePins)
+
+	return nil
+}
+
+func (cm *ContentManager) handleRpcRechunkComplete(ctx context.Context, handle string, param *drpc.RechunkComplete) error {
+	if param.Error != "" {
+		log.Errorf("shuttle %s failed to rechunk content %d: %s", handle, param.DBID, param.Error)
+		return nil
+	}
+
+	log.Infof("shuttle %s rechunked content %d into content %d (%s)", handle, param.DBID, param.NewDBID, param.NewCid)
+
+	if !param.UnpinOld {
+		return nil
+	}
+
+	// the shuttle already unpinned the original content
+	if err := cm.DB.Model(&util.Content{}).Where("id = ?", param.DBID).Update("replace", true).Error; err != nil {
+		return err
+	}
+	return cm.unpinContent(ctx, param.DBID)
+}
+
+func (cm *ContentManager) handleRpcTransferBandwidthLimitApplied(ctx context.Context, handle string, param *drpc.TransferBandwidthLimitApplied) {
+	if param.Error != "" {
+		log.Errorf("shuttle %s failed to limit bandwidth of transfer %s (deal %d), current limit is %d bytes/s: %s", handle, param.ChanID, param.DealDBID, param.BytesPerSecond, param.Error)
+		return
+	}
+
+	if param.BytesPerSecond == 0 {
+		log.Infof("shuttle %s removed the bandwidth limit of transfer %s (deal %d)", handle, param.ChanID, param.DealDBID)
+		return
+	}
+	log.Infof("shuttle %s limited transfer %s (deal %d) to %d bytes/s", handle, param.ChanID, param.DealDBID, param.BytesPerSecond)
+}
+
+func (cm *ContentManager) handleRpcHealthReport(ctx context.Context, handle string, param *drpc.HealthReport) error {
+	if !param.DBHealthy {
+		log.Warnf("shuttle %s reports an unhealthy database: %s", handle, param.DBError)
+	}
+
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if !ok {
+		return fmt.Errorf("shuttle connection not found while handling health report for %q", handle)
+	}
+
+	d.health = &util.ShuttleHealth{
+		ReportedAt:      time.Now(),
+		BlockstoreSize:  param.BlockstoreSize,
+		BlockstoreFree:  param.BlockstoreFree,
+		PinQueueLength:  param.PinQueueSize,
+		ActivePins:      param.ActivePins,
+		ActiveTransfers: param.ActiveTransfers,
+		Goroutines:      param.Goroutines,
+		MemoryAlloc:     param.MemoryAlloc,
+		MemorySys:       param.MemorySys,
+		DBHealthy:       param.DBHealthy,
+		DBError:         param.DBError,
+		PausedUsers:     param.PausedUsers,
+	}
+	return nil
+}
+
+func (cm *ContentManager) handleRpcPinRejected(ctx context.Context, handle string, param *drpc.PinRejected) error {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", param.DBID).Error; err != nil {
+		return err
+	}
+
+	if cont.Active || cont.Location != handle {
+		// the content lives somewhere else already (e.g. a rejected consolidation), leave it there
+		log.Warnf("shuttle %s rejected content %d located at %s: %s", handle, cont.ID, cont.Location, param.Reason)
+		return nil
+	}
+
+	log.Warnf("shuttle %s rejected pin for content %d, pinning it elsewhere: %s", handle, cont.ID, param.Reason)
+
+	loc, err := cm.selectLocationForContent(ctx, cont.Cid.CID, cont.UserID)
+	if err != nil {
+		return xerrors.Errorf("selecting location for content failed: %w", err)
+	}
+
+	if loc == handle {
+		// the pin queue refresh will try again once the shuttle has space
+		return fmt.Errorf("no other location available for content %d rejected by shuttle %s", cont.ID, handle)
+	}
+
+	if err := cm.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumn("location", loc).Error; err != nil {
+		return err
+	}
+	cont.Location = loc
+
+	var origins []*peer.AddrInfo
+	if cont.Origins != "" {
+		_ = json.Unmarshal([]byte(cont.Origins), &origins) // no need to handle or log err, its just a nice to have
+	}
+
+	if loc == constants.ContentLocationLocal {
+		cm.addPinToQueue(cont, origins, 0, true)
+		return nil
+	}
+	return cm.pinContentOnShuttle(ctx, cont, origins, 0, loc, true)
+}
+
+// handleRpcBulkAddPinResult pins the contents a shuttle rejected somewhere
+// else, like for single pins
+func (cm *ContentManager) handleRpcBulkAddPinResult(ctx context.Context, handle string, param *drpc.BulkAddPinResult) {
+	log.Infof("shuttle %s accepted %d pins and rejected %d of a bulk add", handle, param.Accepted, len(param.Rejected))
+
+	for i := range param.Rejected {
+		if err := cm.handleRpcPinRejected(ctx, handle, &param.Rejected[i]); err != nil {
+			log.Errorf("handling pin rejected by shuttle %s in a bulk add: %s", handle, err)
+		}
+	}
+}
+
+func (cm *ContentManager) handleRpcQueueStats(ctx context.Context, handle string, param *drpc.QueueStats) error {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if !ok {
+		return fmt.Errorf("shuttle connection not found while handling queue stats for %q", handle)
+	}
+
+	d.pinQueueLength = int64(param.PinQueueSize)
+	d.activePins = int64(param.ActivePins)
+	d.userQueueSizes = param.UserQueueSizes
+	d.retrievalQueueLength = int64(param.RetrievalQueueSize)
+	d.activeRetrievals = int64(param.ActiveRetrievals)
+	d.pausedUsers = param.PausedUsers
+
+	return nil
+}
+
+func (cm *ContentManager) handleRpcContentPeers(ctx context.Context, handle string, param *drpc.ContentPeers) {
+	var origins int
+	for _, p := range param.Peers {
+		if p.Origin {
+			origins++
+		}
+	}
+	log.Debugf("shuttle %s fetched content %d from %d peers (%d origin)", handle, param.DBID, len(param.Peers), origins)
+
+	cm.contentPeers.Add(param.DBID, param)
+}
+
+type pinLabelKey struct {
+	handle string
+	label  string
+}
+
+func (cm *ContentManager) handleRpcPinsByLabel(ctx context.Context, handle string, param *drpc.PinsByLabel) {
+	cm.pinsByLabel.Add(pinLabelKey{handle: handle, label: param.Label}, param.Contents)
+}
+
+type contentCidKey struct {
+	handle  string
+	content uint
+}
+
+// handleRpcContentCIDs caches the root cids a shuttle reported, contents it
+// has no pin for are cached with an undefined cid
+func (cm *ContentManager) handleRpcContentCIDs(ctx context.Context, handle string, param *drpc.ContentCIDs) {
+	for cont, c := range param.CIDs {
+		cm.contentCids.Add(contentCidKey{handle: handle, content: cont}, c)
+	}
+
+	for _, cont := range param.Missing {
+		cm.contentCids.Add(contentCidKey{handle: handle, content: cont}, cid.Undef)
+	}
+}
+
+// lookupContentCids returns the root cids of contents pinned on a shuttle,
+// asking it for those not cached yet. The contents the shuttle has no pin for
+// are left out.
+func (cm *ContentManager) lookupContentCids(ctx context.Context, handle string, contents []uint) (map[uint]cid.Cid, error) {
+	cids := make(map[uint]cid.Cid, len(contents))
+
+	var missing []uint
+	for _, cont := range contents {
+		if v, ok := cm.contentCids.Get(contentCidKey{handle: handle, content: cont}); ok && v.(cid.Cid).Defined() {
+			cids[cont] = v.(cid.Cid)
+			continue
+		}
+		cm.contentCids.Remove(contentCidKey{handle: handle, content: cont})
+		missing = append(missing, cont)
+	}
+
+	if len(missing) == 0 {
+		return cids, nil
+	}
+
+	if err := cm.sendGetContentCIDCmd(ctx, handle, missing); err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	for {
+		pending := missing[:0]
+		for _, cont := range missing {
+			v, ok := cm.contentCids.Get(contentCidKey{handle: handle, content: cont})
+			if !ok {
+				pending = append(pending, cont)
+				continue
+			}
+
+			if c := v.(cid.Cid); c.Defined() {
+				cids[cont] = c
+			}
+		}
+
+		missing = pending
+		if len(missing) == 0 {
+			return cids, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for shuttle %s to report the cids of %d contents", handle, len(missing))
+		}
+	}
+}
+
+// handleRpcIntegrityAlert pins the content again on the shuttle that found
+// some of its blocks missing or corrupted, the shuttle fetches them back
+func (cm *ContentManager) handleRpcIntegrityAlert(ctx context.Context, handle string, param *drpc.IntegrityAlert) error {
+	log.Warnf("shuttle %s found %d missing and %d corrupted blocks in content %d (%s)", handle, len(param.Missing), len(param.Corrupted), param.DBID, param.Cid)
+
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", param.DBID).Error; err != nil {
+		return err
+	}
+
+	if cont.Location != handle {
+		return fmt.Errorf("content %d is not on shuttle %s but on %s", cont.ID, handle, cont.Location)
+	}
+
+	var origins []*peer.AddrInfo
+	if cont.Origins != "" {
+		_ = json.Unmarshal([]byte(cont.Origins), &origins) // origins only help finding the blocks
+	}
+
+	if err := cm.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumn("pinning", true).Error; err != nil {
+		return err
+	}
+	return cm.pinContentOnShuttle(ctx, cont, origins, 0, handle, false)
+}
+
+func (cm *ContentManager) handleRpcDiskUsage(ctx context.Context, handle string, param *drpc.DiskUsage) {
+	cm.diskUsageResults.Add(handle, param)
+}
+
+func (cm *ContentManager) handleRpcCacheWarmed(ctx context.Context, handle string, param *drpc.CacheWarmed) {
+	if param.Error != "" {
+		log.Errorf("shuttle %s failed to warm the read cache with content %d after %d blocks: %s", handle, param.DBID, param.Blocks, param.Error)
+		return
+	}
+	log.Infof("shuttle %s warmed its read cache with %d blocks (%d bytes) of content %d", handle, param.Blocks, param.Bytes, param.DBID)
+}
+
+func (cm *ContentManager) handleRpcRehydrateProgress(ctx context.Context, handle string, param *drpc.RehydrateProgress) {
+	cm.rehydrations.Add(param.Content, param)
+
+	switch param.Phase {
+	case drpc.RehydrateFailed:
+		log.Errorf("shuttle %s failed to rehydrate content %d: %s", handle, param.Content, param.Error)
+	case drpc.RehydrateComplete:
+		log.Infof("shuttle %s rehydrated content %d", handle, param.Content)
+		if err := cm.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(util.Content{}).Where("id = ?", param.Content).UpdateColumns(map[string]interface{}{
+				"offloaded": false,
+				"location":  handle,
+			}).Error; err != nil {
+				return err
+			}
+			return tx.Model(util.ObjRef{}).Where("content = ?", param.Content).Update("offloaded", 0).Error
+		}); err != nil {
+			log.Errorf("failed to mark rehydrated content %d as no longer offloaded: %s", param.Content, err)
+		}
+	case drpc.RehydrateRetrieving:
+		log.Infof("shuttle %s retrieving content %d from %s", handle, param.Content, param.Miner)
+	default:
+		log.Debugf("shuttle %s rehydrating content %d: %s", handle, param.Content, param.Phase)
+	}
+}
+
+// handleRpcOffloadRequest moves the contents a shuttle over its disk high
+// watermark asks to get rid of to the shuttle with the most free space. They
+// are unpinned from the requesting shuttle once the destination pinned them.
+func (cm *ContentManager) handleRpcOffloadRequest(ctx context.Context, handle string, param *drpc.OffloadRequest) error {
+	log.Warnf("shuttle %s is %.0f%% full and asks to offload %d contents (%d bytes)", handle, param.DiskUsage*100, len(param.Contents), param.Size)
+
+	dest, err := cm.offloadDestination(handle, param.Size)
+	if err != nil {
+		return fmt.Errorf("failed to pick a shuttle to offload %s to: %w", handle, err)
+	}
+
+	var contents []util.Content
+	if err := cm.DB.Find(&contents, "id in ? and location = ? and active", param.Contents, handle).Error; err != nil {
+		return err
+	}
+
+	var moving []util.Content
+	for _, c := range contents {
+		if _, ok := cm.offloadMigrations.Get(c.ID); ok {
+			continue
+		}
+		cm.offloadMigrations.Add(c.ID, handle)
+		moving = append(moving, c)
+	}
+
+	if len(moving) == 0 {
+		return nil
+	}
+
+	log.Infof("offloading %d contents from shuttle %s to %s", len(moving), handle, dest)
+	if err := cm.sendConsolidateContentCmd(ctx, dest, moving); err != nil {
+		for _, c := range moving {
+			cm.offloadMigrations.Remove(c.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// offloadDestination returns the online shuttle, other than the one being
+// offloaded, with the most free blockstore space as long as it can hold size
+// more bytes without running low on space
+func (cm *ContentManager) offloadDestination(from string, size int64) (string, error) {
+	free := make(map[string]uint64)
+	var handles []string
+	cm.shuttlesLk.Lock()
+	for h, sh := range cm.shuttles {
+		if h == from || sh.storageFull || sh.spaceLow || sh.private || sh.ContentAddingDisabled || sh.retrievalOnly {
+			continue
+		}
+
+		if sh.blockstoreFree < uint64(size)+sh.blockstoreSize/10 {
+			continue
+		}
+		free[h] = sh.blockstoreFree
+		handles = append(handles, h)
+	}
+	cm.shuttlesLk.Unlock()
+
+	var shuttles []Shuttle
+	if err := cm.DB.Find(&shuttles, "handle in ? and open", handles).Error; err != nil {
+		return "", err
+	}
+
+	if len(shuttles) == 0 {
+		return "", fmt.Errorf("no shuttle has %d bytes of free space to spare", size)
+	}
+
+	sort.Slice(shuttles, func(i, j int) bool {
+		return free[shuttles[i].Handle] > free[shuttles[j].Handle]
+	})
+	return shuttles[0].Handle, nil
+}
+
+func (cm *ContentManager) handleRpcPinReassigned(ctx context.Context, handle string, param *drpc.PinReassigned) {
+	cm.pinReassignments.Add(param.DBID, param)
+}
+
+type rootValidationKey struct {
+	handle string
+	root   cid.Cid
+}
+
+func (cm *ContentManager) handleRpcContentRootValidation(ctx context.Context, handle string, param *drpc.ContentRootValidation) {
+	cm.rootValidations.Add(rootValidationKey{handle: handle, root: param.Cid}, param)
+}
+
+// handleRpcSplitLinkageRepaired checks the parents a shuttle rebuilt against
+// the contents they were split from. A parent that is no longer a split
+// content on the shuttle, or was rebuilt with another root, is reported as an
+// orphan instead.
+func (cm *ContentManager) handleRpcSplitLinkageRepaired(ctx context.Context, handle string, param *drpc.SplitLinkageRepaired) {
+	restored := param.Restored[:0:0]
+	for _, p := range param.Restored {
+		orphan := func(reason string) {
+			log.Errorf("shuttle %s rebuilt split parent %d: %s", handle, p.Content, reason)
+			param.Orphans = append(param.Orphans, drpc.SplitOrphan{
+				Parent:   p.Content,
+				Children: p.Children,
+				Reason:   reason,
+			})
+		}
+
+		var cont util.Content
+		err := cm.DB.First(&cont, "id = ?", p.Content).Error
+		switch {
+		case xerrors.Is(err, gorm.ErrRecordNotFound):
+			orphan("the content no longer exists")
+			continue
+		case err != nil:
+			log.Errorf("failed to get content %d restored as a split parent by shuttle %s: %s", p.Content, handle, err)
+			orphan(fmt.Sprintf("failed to get the content: %s", err))
+			continue
+		}
+
+		switch {
+		case cont.Location != handle:
+			orphan(fmt.Sprintf("the content is on %s", cont.Location))
+		case !cont.DagSplit:
+			orphan("the content is not split")
+		case cont.Cid.CID != p.Cid:
+			orphan(fmt.Sprintf("restored with root %s, the content is %s", p.Cid, cont.Cid.CID))
+		default:
+			restored = append(restored, p)
+			if !param.DryRun {
+				log.Infof("shuttle %s restored split parent %d (%s) of children %v", handle, p.Content, p.Cid, p.Children)
+			}
+		}
+	}
+	param.Restored = restored
+
+	for _, o := range param.Orphans {
+		log.Warnf("shuttle %s has split children %v of content %d without their parent: %s", handle, o.Children, o.Parent, o.Reason)
+	}
+	cm.splitRepairs.Add(handle, param)
+}
+
+type pieceInfoKey struct {
+	handle string
+	piece  cid.Cid
+}
+
+type logLevelKey struct {
+	handle    string
+	subsystem string
+}
 
+func (cm *ContentManager) handleRpcLogLevelSet(ctx context.Context, handle string, param *drpc.LogLevelSet) {
+	cm.logLevelResults.Add(logLevelKey{handle: handle, subsystem: param.Subsystem}, param)
+}
+
+func (cm *ContentManager) handleRpcActiveTransfers(ctx context.Context, handle string, param *drpc.ActiveTransfers) {
+	cm.activeTransfers.Add(handle, param.Transfers)
+}
+
+type transferBytesKey struct {
+	handle string
+	chanid string
+}
+
+func (cm *ContentManager) handleRpcTransferBytes(ctx context.Context, handle string, param *drpc.TransferBytes) {
+	cm.transferBytes.Add(transferBytesKey{handle: handle, chanid: param.Chanid}, param)
+}
+
+func (cm *ContentManager) handleRpcReplicationNeeded(ctx context.Context, handle string, param *drpc.ReplicationNeeded) error {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", param.Content).Error; err != nil {
+		return err
+	}
+
+	if !cont.Active || cont.Offloaded {
+		return nil
+	}
+
+	log.Infof("shuttle %s reports content %d needs more deals: %s", handle, cont.ID, param.Reason)
+	cm.toCheck(cont.ID)
+	return nil
+}
+
+// handleRpcDealExpiring queues the content of an expiring deal for a check,
+// the deal check repairs deals that are nearly expired so a new one is made
+func (cm *ContentManager) handleRpcDealExpiring(ctx context.Context, handle string, param *drpc.DealExpiring) error {
+	var deal contentDeal
+	if err := cm.DB.First(&deal, "content = ? and deal_id = ?", param.Content, param.DealID).Error; err != nil {
+		return err
+	}
+
+	if deal.Failed || deal.Slashed {
+		return nil
+	}
+
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", deal.Content).Error; err != nil {
+		return err
+	}
+
+	if !cont.Active {
+		return nil
+	}
+
+	log.Infof("shuttle %s reports deal %d of content %d with %s ends at epoch %d (%d epochs left)", handle, param.DealID, cont.ID, param.Miner, param.EndEpoch, param.EndEpoch-param.Head)
+	cm.toCheck(cont.ID)
 	return nil
 }
 
+func (cm *ContentManager) handleRpcTakeContentProgress(ctx context.Context, handle string, param *drpc.TakeContentProgress) {
+	if param.Pending > 0 {
+		log.Infof("shuttle %s consolidation progress: %d/%d pinned, %d failed", handle, param.Pinned, param.Total, param.Failed)
+		return
+	}
+
+	if param.Failed > 0 {
+		log.Warnf("shuttle %s finished consolidation: %d/%d pinned, %d failed", handle, param.Pinned, param.Total, param.Failed)
+		return
+	}
+	log.Infof("shuttle %s finished consolidation of %d contents", handle, param.Total)
+}
+
+func (cm *ContentManager) handleRpcRelocatePinDone(ctx context.Context, handle string, param *drpc.RelocatePinDone) {
+	log.Infof("shuttle %s relocated %d contents to its secondary blockstore", handle, len(param.Relocated))
+	if len(param.Failed) > 0 {
+		log.Warnf("shuttle %s failed to relocate contents: %v", handle, param.Failed)
+	}
+}
+
 func (cm *ContentManager) handleRpcGarbageCheck(ctx context.Context, handle string, param *drpc.GarbageCheck) error {
 	var tounpin []uint
 	for _, c := range param.Contents {
@@ -448,6 +1490,80 @@ func (cm *ContentManager) handleRpcGarbageCheck(ctx context.Context, handle stri
 	return cm.sendUnpinCmd(ctx, handle, tounpin)
 }
 
+// handleRpcAggregateComplete reconciles the contents we think are in an
+// aggregate with the ones the shuttle actually put in it. Contents staged
+// into the aggregate but missing from it are released so they get staged
+// again instead of never making it into a deal.
+func (cm *ContentManager) handleRpcAggregateComplete(ctx context.Context, handle string, param *drpc.AggregateComplete) error {
+	if err := cm.releaseAggregateBlock(ctx, param.DBID); err != nil {
+		log.Warnf("failed to release block of aggregate %d: %s", param.DBID, err)
+	}
+
+	var children []util.Content
+	if err := cm.DB.Find(&children, "aggregated_in = ?", param.DBID).Error; err != nil {
+		return err
+	}
+
+	members := make(map[uint]int64, len(param.Members))
+	for _, m := range param.Members {
+		members[m.DBID] = m.Size
+	}
+
+	var dropped []uint
+	for _, c := range children {
+		size, ok := members[c.ID]
+		if !ok {
+			dropped = append(dropped, c.ID)
+			continue
+		}
+		delete(members, c.ID)
+
+		if size != c.Size {
+			log.Warnf("content %d in aggregate %d has size %d on shuttle %s, expected %d", c.ID, param.DBID, size, handle, c.Size)
+		}
+	}
+
+	for c := range members {
+		log.Warnf("shuttle %s reported content %d in aggregate %d, but it is not staged in it", handle, c, param.DBID)
+	}
+
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	log.Warnf("contents %v did not make it into aggregate %d on shuttle %s, releasing them", dropped, param.DBID, handle)
+	return cm.DB.Model(util.Content{}).Where("id in ? and aggregated_in = ?", dropped, param.DBID).UpdateColumns(map[string]interface{}{
+		"aggregated_in": 0,
+	}).Error
+}
+
+// releaseAggregateBlock drops the block of an aggregate put in our blockstore
+// for its shuttle to fetch, unless we hold that cid for a local content
+func (cm *ContentManager) releaseAggregateBlock(ctx context.Context, dbid uint) error {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", dbid).Error; err != nil {
+		return err
+	}
+
+	cm.contentLk.Lock()
+	defer cm.contentLk.Unlock()
+
+	var local int64
+	if err := cm.DB.Model(util.Content{}).Where("cid = ? and location = ?", cont.Cid, constants.ContentLocationLocal).Count(&local).Error; err != nil {
+		return err
+	}
+
+	if local > 0 {
+		return nil
+	}
+
+	has, err := cm.Blockstore.Has(ctx, cont.Cid.CID)
+	if err != nil || !has {
+		return err
+	}
+	return cm.Blockstore.DeleteBlock(ctx, cont.Cid.CID)
+}
+
 func (cm *ContentManager) handleRpcSplitComplete(ctx context.Context, handle string, param *drpc.SplitComplete) error {
 	if param.ID == 0 {
 		return fmt.Errorf("split complete send with ID = 0")
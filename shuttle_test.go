@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpirePinCompleteChunks(t *testing.T) {
+	assert := assert.New(t)
+	cm := &ContentManager{pinCompleteChunks: make(map[pinCompleteKey]*pinCompleteChunks)}
+
+	assert.Nil(cm.addPinCompleteChunk("shuttle", &drpc.PinCompleteChunk{DBID: 1, Index: 0}))
+	assert.Nil(cm.addPinCompleteChunk("shuttle", &drpc.PinCompleteChunk{DBID: 2, Index: 0}))
+
+	// parts keep a pin complete from expiring as they come in
+	for _, pcc := range cm.pinCompleteChunks {
+		pcc.updated = time.Now().Add(-pinCompleteChunksTTL / 2)
+	}
+	assert.Nil(cm.addPinCompleteChunk("shuttle", &drpc.PinCompleteChunk{DBID: 1, Index: 1}))
+
+	assert.Equal(1, cm.expirePinCompleteChunks(time.Now().Add(pinCompleteChunksTTL/2+time.Minute)))
+	assert.Len(cm.pinCompleteChunks, 1)
+	assert.Equal(1, cm.expirePinCompleteChunks(time.Now().Add(pinCompleteChunksTTL+time.Minute)))
+	assert.Empty(cm.pinCompleteChunks)
+}
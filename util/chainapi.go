@@ -0,0 +1,283 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/lotus/api"
+	lcli "github.com/filecoin-project/lotus/cli/util"
+)
+
+// ErrChainUnavailable is returned by the chain api while none of its
+// endpoints can be reached
+var ErrChainUnavailable = errors.New("chain unavailable")
+
+// how long an endpoint has to answer its first request, and the bounds of
+// the backoff between rounds of reconnection attempts
+const (
+	chainProbeTimeout     = time.Second * 15
+	chainRetryMinInterval = time.Second * 5
+	chainRetryMaxInterval = time.Minute * 5
+)
+
+// ChainAPI is a lotus gateway api backed by the first of a list of full node
+// or gateway endpoints that can be reached. A call that fails to reach the
+// current endpoint is retried once against the next endpoint that answers.
+// While none can, every call fails with ErrChainUnavailable and the endpoints
+// are retried in the background, so the node keeps serving everything that
+// does not need the chain.
+type ChainAPI struct {
+	api.GatewayStruct
+
+	endpoints []string
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	// serializes failovers, so that calls failing together switch once
+	failoverLk sync.Mutex
+
+	lk        sync.RWMutex
+	internals []reflect.Value
+	closer    jsonrpc.ClientCloser
+	current   int
+	// bumped on every switch of connection
+	gen uint64
+}
+
+// NewChainAPI connects to the first reachable endpoint, endpoints use the
+// FULLNODE_API_INFO format. It only fails if no endpoint is given.
+func NewChainAPI(endpoints []string) (*ChainAPI, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no chain api endpoints configured")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ca := &ChainAPI{
+		endpoints: endpoints,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	ca.proxy()
+
+	if err := ca.connect(ctx, 0); err != nil {
+		log.Errorf("chain api unavailable, retrying in the background: %s", err)
+		go ca.reconnect(ctx)
+	}
+	return ca, nil
+}
+
+// Close stops reconnecting and closes the current connection
+func (ca *ChainAPI) Close() {
+	ca.cancel()
+
+	ca.lk.Lock()
+	defer ca.lk.Unlock()
+	if ca.closer != nil {
+		ca.closer()
+	}
+	ca.internals = nil
+	ca.closer = nil
+}
+
+// proxy points every method of the embedded gateway struct at the same
+// method of the current connection
+func (ca *ChainAPI) proxy() {
+	for si, s := range api.GetInternalStructs(&ca.GatewayStruct) {
+		rs := reflect.ValueOf(s).Elem()
+		for fi := 0; fi < rs.NumField(); fi++ {
+			si, fi := si, fi
+			ft := rs.Field(fi).Type()
+			rs.Field(fi).Set(reflect.MakeFunc(ft, func(args []reflect.Value) []reflect.Value {
+				ca.lk.RLock()
+				internals, gen := ca.internals, ca.gen
+				ca.lk.RUnlock()
+
+				if internals == nil {
+					return chainUnavailableResults(ft)
+				}
+
+				out := internals[si].Field(fi).Call(args)
+				if !isChainConnectionError(out, args) {
+					return out
+				}
+
+				internals = ca.failover(gen)
+				if internals == nil {
+					return out
+				}
+				return internals[si].Field(fi).Call(args)
+			}))
+		}
+	}
+}
+
+// isChainConnectionError tells whether the results of a call carry an error
+// of the client reaching the endpoint, rather than one returned by the
+// endpoint or the cancellation of the call
+func isChainConnectionError(out []reflect.Value, args []reflect.Value) bool {
+	if len(out) == 0 {
+		return false
+	}
+	err, ok := out[len(out)-1].Interface().(error)
+	if !ok || err == nil {
+		return false
+	}
+
+	if len(args) > 0 {
+		if ctx, ok := args[0].Interface().(context.Context); ok && ctx.Err() != nil {
+			return false
+		}
+	}
+
+	var cerr *jsonrpc.ErrClient
+	return errors.As(err, &cerr)
+}
+
+// failover switches from the connection of generation gen to the next
+// endpoint that answers and returns its methods. If another call switched
+// already, its connection is returned. If no endpoint answers, nil is
+// returned and the endpoints are retried in the background.
+func (ca *ChainAPI) failover(gen uint64) []reflect.Value {
+	ca.failoverLk.Lock()
+	defer ca.failoverLk.Unlock()
+
+	ca.lk.RLock()
+	internals, current, switched := ca.internals, ca.current, ca.gen != gen
+	ca.lk.RUnlock()
+	if switched {
+		return internals
+	}
+	if ca.ctx.Err() != nil {
+		return nil
+	}
+
+	log.Warnf("lost chain api endpoint %s, failing over", lcli.ParseApiInfo(ca.endpoints[current]).Addr)
+
+	// the endpoint that failed is tried last
+	if err := ca.connect(ca.ctx, current+1); err != nil {
+		log.Errorf("chain api unavailable, retrying in the background: %s", err)
+
+		ca.lk.Lock()
+		if ca.closer != nil {
+			ca.closer()
+		}
+		ca.internals = nil
+		ca.closer = nil
+		ca.gen++
+		ca.lk.Unlock()
+
+		go ca.reconnect(ca.ctx)
+		return nil
+	}
+
+	ca.lk.RLock()
+	defer ca.lk.RUnlock()
+	return ca.internals
+}
+
+// chainUnavailableResults returns zero values and ErrChainUnavailable as the
+// results of a call to a gateway method
+func chainUnavailableResults(ft reflect.Type) []reflect.Value {
+	out := make([]reflect.Value, ft.NumOut())
+	for i := range out {
+		out[i] = reflect.Zero(ft.Out(i))
+	}
+	if len(out) > 0 {
+		out[len(out)-1] = reflect.ValueOf(&ErrChainUnavailable).Elem()
+	}
+	return out
+}
+
+// connect tries every endpoint in order, starting from the one at index
+// start, and switches to the first one that answers
+func (ca *ChainAPI) connect(ctx context.Context, start int) error {
+	var errs []string
+	for i := range ca.endpoints {
+		idx := (start + i) % len(ca.endpoints)
+		ainfo := lcli.ParseApiInfo(ca.endpoints[idx])
+
+		conn, closer, err := dialChainEndpoint(ctx, ainfo)
+		if err != nil {
+			log.Warnf("failed to connect to chain api endpoint %s: %s", ainfo.Addr, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", ainfo.Addr, err))
+			continue
+		}
+
+		var internals []reflect.Value
+		for _, s := range api.GetInternalStructs(conn) {
+			internals = append(internals, reflect.ValueOf(s).Elem())
+		}
+
+		ca.lk.Lock()
+		if ctx.Err() != nil {
+			// closed while dialing
+			ca.lk.Unlock()
+			closer()
+			return ctx.Err()
+		}
+		if ca.closer != nil {
+			ca.closer()
+		}
+		ca.internals = internals
+		ca.closer = closer
+		ca.current = idx
+		ca.gen++
+		ca.lk.Unlock()
+
+		log.Infof("connected to chain api endpoint %s", ainfo.Addr)
+		return nil
+	}
+	return fmt.Errorf("all %d chain api endpoints failed: %s", len(ca.endpoints), strings.Join(errs, "; "))
+}
+
+// reconnect retries the endpoints with an exponential backoff until one of
+// them answers
+func (ca *ChainAPI) reconnect(ctx context.Context) {
+	interval := chainRetryMinInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		err := ca.connect(ctx, 0)
+		if err == nil {
+			return
+		}
+
+		interval *= 2
+		if interval > chainRetryMaxInterval {
+			interval = chainRetryMaxInterval
+		}
+		log.Warnf("chain api still unavailable, retrying in %s: %s", interval, err)
+	}
+}
+
+func dialChainEndpoint(ctx context.Context, ainfo lcli.APIInfo) (*api.GatewayStruct, jsonrpc.ClientCloser, error) {
+	addr, err := ainfo.DialArgs("v1")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conn api.GatewayStruct
+	closer, err := jsonrpc.NewMergeClient(ctx, addr, "Filecoin", api.GetInternalStructs(&conn), ainfo.AuthHeader())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// http clients do not connect until the first request
+	pctx, cancel := context.WithTimeout(ctx, chainProbeTimeout)
+	defer cancel()
+	if _, err := conn.ChainHead(pctx); err != nil {
+		closer()
+		return nil, nil, err
+	}
+	return &conn, closer, nil
+}
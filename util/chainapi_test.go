@@ -0,0 +1,73 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainAPIUnavailable(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := NewChainAPI(nil)
+	a.Error(err)
+
+	// nothing listens on the discard port, the api starts without a chain
+	ca, err := NewChainAPI([]string{"ws://127.0.0.1:9", "http://127.0.0.1:9"})
+	a.NoError(err)
+	defer ca.Close()
+
+	head, err := ca.ChainHead(context.Background())
+	a.ErrorIs(err, ErrChainUnavailable)
+	a.Nil(head)
+}
+
+type testChainHead struct{}
+
+func (h *testChainHead) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	return mock.TipSet(mock.MkBlock(nil, 0, 0)), nil
+}
+
+func TestChainAPIFailover(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	startEndpoint := func() *httptest.Server {
+		rpc := jsonrpc.NewServer()
+		rpc.Register("Filecoin", &testChainHead{})
+		mux := http.NewServeMux()
+		mux.Handle("/rpc/v1", rpc)
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	primary := startEndpoint()
+	secondary := startEndpoint()
+
+	ca, err := NewChainAPI([]string{primary.URL, secondary.URL})
+	a.NoError(err)
+	defer ca.Close()
+
+	_, err = ca.ChainHead(ctx)
+	a.NoError(err)
+	a.Equal(0, ca.current)
+
+	// the call that finds the primary gone is served by the secondary
+	primary.Close()
+	_, err = ca.ChainHead(ctx)
+	a.NoError(err)
+	a.Equal(1, ca.current)
+
+	// with every endpoint gone the call fails and the api waits for one
+	secondary.Close()
+	_, err = ca.ChainHead(ctx)
+	a.Error(err)
+	_, err = ca.ChainHead(ctx)
+	a.ErrorIs(err, ErrChainUnavailable)
+}
@@ -35,6 +35,17 @@ type ContentAddIpfsBody struct {
 	Root  string   `json:"root"`
 	Name  string   `json:"filename"`
 	Peers []string `json:"peers"`
+
+	// RemotePinningService pulls the content from the providers of a remote
+	// IPFS pinning service holding it, in addition to Peers
+	RemotePinningService *RemotePinningService `json:"remotePinningService,omitempty"`
+}
+
+// RemotePinningService is an IPFS pinning service API endpoint and the access
+// token for it
+type RemotePinningService struct {
+	Endpoint string `json:"endpoint"`
+	Token    string `json:"token"`
 }
 
 type ContentAddResponse struct {
@@ -98,6 +109,10 @@ type Content struct {
 	// them (unlike with aggregates)
 	DagSplit  bool `json:"dagSplit"`
 	SplitFrom uint `json:"splitFrom"`
+
+	// AutoOffload opts the content in to being offloaded once enough of its
+	// deals are sealed, it is then only retrievable from its deals
+	AutoOffload bool `json:"autoOffload"`
 }
 
 type ContentWithPath struct {
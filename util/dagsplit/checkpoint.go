@@ -0,0 +1,139 @@
+package dagspliter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// packCheckpoint is a line of the checkpoint file of a pack, appended every
+// time a box is completed. It only holds what changed since the previous
+// line: the completed box, the nodes packed into it and the stack packing
+// continues with.
+type packCheckpoint struct {
+	Root       cid.Cid
+	BoxMaxSize uint64
+	Box        *Box
+	Packed     []cid.Cid
+	Stack      []cid.Cid
+}
+
+// packState is the packing state rebuilt from the lines of a checkpoint file
+type packState struct {
+	boxes  []*Box
+	packed []cid.Cid
+	stack  []cid.Cid
+}
+
+// SetCheckpointDir makes Pack save its state to dir every time it completes
+// a box, so that packing a large DAG can resume after an interruption instead
+// of starting over.
+func (b *Builder) SetCheckpointDir(dir string) {
+	b.checkpointDir = dir
+}
+
+// the checkpoint file of a DAG, boxes are only the same for the same size
+func (b *Builder) checkpointPath(root cid.Cid) string {
+	return filepath.Join(b.checkpointDir, fmt.Sprintf("%s-%d.ndjson", root, b.boxMaxSize))
+}
+
+// loadCheckpoint returns the saved state of an earlier Pack of root, or nil
+// if there is none. A last line left half written by an interruption is cut
+// off the file so that the next lines are appended after complete ones.
+func (b *Builder) loadCheckpoint(root cid.Cid) (*packState, error) {
+	path := b.checkpointPath(root)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var st packState
+	var valid int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				if err := f.Truncate(valid); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var cp packCheckpoint
+		if err := json.Unmarshal(line, &cp); err != nil {
+			return nil, xerrors.Errorf("loading pack checkpoint of %s: %w", root, err)
+		}
+
+		if !cp.Root.Equals(root) || cp.BoxMaxSize != b.boxMaxSize || cp.Box == nil {
+			return nil, xerrors.Errorf("pack checkpoint %s does not match a pack of %s into boxes of %d bytes", path, root, b.boxMaxSize)
+		}
+
+		st.boxes = append(st.boxes, cp.Box)
+		st.packed = append(st.packed, cp.Packed...)
+		st.stack = cp.Stack
+		valid += int64(len(line))
+	}
+
+	if len(st.boxes) == 0 {
+		return nil, nil
+	}
+	return &st, nil
+}
+
+// saveCheckpoint appends the box just completed to the checkpoint file, with
+// the nodes packed since the previous box and the stack left to pack
+func (b *Builder) saveCheckpoint(root cid.Cid, box *Box, packed []cid.Cid, stack []cid.Cid) error {
+	data, err := json.Marshal(packCheckpoint{
+		Root:       root,
+		BoxMaxSize: b.boxMaxSize,
+		Box:        box,
+		Packed:     packed,
+		Stack:      stack,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(b.checkpointDir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(b.checkpointPath(root), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RemoveCheckpoint deletes the saved state of a Pack of root, e.g. once
+// packing it is given up on
+func (b *Builder) RemoveCheckpoint(root cid.Cid) error {
+	if b.checkpointDir == "" {
+		return nil
+	}
+
+	if err := os.Remove(b.checkpointPath(root)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -48,6 +48,10 @@ type Builder struct {
 	// we only pack one box at a time and don't come back to a box once we're
 	// done with it we just track a single value here and not in each box.
 	boxUsedSize uint64
+
+	// Directory the packing state is saved to every time a box is completed,
+	// empty if packing is not checkpointed.
+	checkpointDir string
 }
 
 func NewBuilder(dserv ipld.DAGService, chunksize uint64, minSubgraphSize uint64) *Builder {
@@ -72,6 +76,9 @@ func getSingleNodeSize(node ipld.Node) uint64 {
 	return uint64(len(node.RawData()))
 }
 
+// Boxes returns the packed boxes in packing order. Packing is deterministic:
+// packing the same DAG with the same box size always gives the same boxes in
+// the same order.
 func (b *Builder) Boxes() []*Box {
 	return b.boxes
 }
@@ -115,10 +122,40 @@ func (b *Builder) getTreeSize(nd ipld.Node) (uint64, error) {
 	}
 }
 
+// Pack packs the DAG under root into boxes. When checkpointing is enabled and
+// the builder has not packed anything yet, packing resumes from the last box
+// completed by an earlier, interrupted Pack of the same DAG into boxes of the
+// same size.
 func (b *Builder) Pack(ctx context.Context, root cid.Cid) error {
 	stack := []cid.Cid{root}
-
 	packed := cid.NewSet()
+
+	checkpoint := b.checkpointDir != "" && len(b.boxes) == 1 && b.used() == 0
+	if checkpoint {
+		st, err := b.loadCheckpoint(root)
+		if err != nil {
+			return err
+		}
+
+		if st != nil {
+			b.boxes = st.boxes
+			b.newBox()
+			stack = st.stack
+			for _, c := range st.packed {
+				packed.Add(c)
+			}
+		}
+	}
+
+	// the nodes packed into the current box, checkpointed along with it
+	var boxPacked []cid.Cid
+	pack := func(c cid.Cid) {
+		packed.Add(c)
+		if checkpoint {
+			boxPacked = append(boxPacked, c)
+		}
+	}
+
 	for len(stack) > 0 {
 		cur := stack[len(stack)-1]
 		stack = stack[:len(stack)-1]
@@ -139,14 +176,14 @@ func (b *Builder) Pack(ctx context.Context, root cid.Cid) error {
 		}
 
 		if b.fits(uint64(size)) {
-			packed.Add(cur)
+			pack(cur)
 			b.packRoot(cur)
 			b.addSize(uint64(size))
 			continue
 		} else if b.fits(uint64(len(nd.RawData()))) {
 			// this tree doesnt fit in the box, so lets add the node as 'raw' and recurse
 			// TODO: check if its a good candidate for going into its own new box
-			packed.Add(cur)
+			pack(cur)
 			pref := cur.Prefix()
 			pref.Codec = cid.Raw
 			pref.Version = 1
@@ -164,12 +201,26 @@ func (b *Builder) Pack(ctx context.Context, root cid.Cid) error {
 				stack = append(stack, l.Cid)
 			}
 		} else {
+			if b.used() == 0 {
+				return xerrors.Errorf("node %s of %d bytes does not fit in an empty box of %d bytes", cur, len(nd.RawData()), b.boxMaxSize)
+			}
+
 			// need a new box, throw this one back on the stack and move on
 			stack = append(stack, cur)
 			b.newBox()
+
+			if checkpoint {
+				if err := b.saveCheckpoint(root, b.boxes[len(b.boxes)-2], boxPacked, stack); err != nil {
+					return err
+				}
+				boxPacked = nil
+			}
 		}
 	}
 
+	if checkpoint {
+		return b.RemoveCheckpoint(root)
+	}
 	return nil
 }
 
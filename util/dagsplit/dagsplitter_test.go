@@ -0,0 +1,104 @@
+package dagspliter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackIsDeterministic(t *testing.T) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	nd, err := util.ImportFile(dserv, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	pack := func() []*Box {
+		b := NewBuilder(dserv, 1<<20, 0)
+		require.NoError(t, b.Pack(ctx, nd.Cid()))
+		return b.Boxes()
+	}
+
+	first := pack()
+	assert.Greater(t, len(first), 1)
+	assert.Equal(t, first, pack())
+}
+
+func TestPackNodeLargerThanBox(t *testing.T) {
+	dserv := mdtest.Mock()
+
+	nd, err := util.ImportFile(dserv, bytes.NewReader(make([]byte, 4096)))
+	require.NoError(t, err)
+
+	b := NewBuilder(dserv, 16, 0)
+	assert.Error(t, b.Pack(context.Background(), nd.Cid()))
+}
+
+// failingDAG fails every Get after the first n
+type failingDAG struct {
+	ipld.DAGService
+	n    int
+	gets int
+}
+
+func (d *failingDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	d.gets++
+	if d.n >= 0 && d.gets > d.n {
+		return nil, errors.New("interrupted")
+	}
+	return d.DAGService.Get(ctx, c)
+}
+
+func TestPackResumesFromCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+	dir := t.TempDir()
+
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	nd, err := util.ImportFile(dserv, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	full := &failingDAG{DAGService: dserv, n: -1}
+	b := NewBuilder(full, 1<<20, 0)
+	require.NoError(t, b.Pack(ctx, nd.Cid()))
+	want := b.Boxes()
+
+	interrupted := &failingDAG{DAGService: dserv, n: full.gets / 2}
+	b = NewBuilder(interrupted, 1<<20, 0)
+	b.SetCheckpointDir(dir)
+	require.Error(t, b.Pack(ctx, nd.Cid()))
+
+	// a checkpoint line left half written is cut off
+	cp, err := os.OpenFile(b.checkpointPath(nd.Cid()), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = cp.Write([]byte(`{"Root":`))
+	require.NoError(t, err)
+	require.NoError(t, cp.Close())
+
+	resumed := &failingDAG{DAGService: dserv, n: -1}
+	b = NewBuilder(resumed, 1<<20, 0)
+	b.SetCheckpointDir(dir)
+	require.NoError(t, b.Pack(ctx, nd.Cid()))
+	assert.Equal(t, want, b.Boxes())
+	assert.Less(t, resumed.gets, full.gets)
+
+	// the checkpoint is gone once packing completed
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
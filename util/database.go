@@ -37,6 +37,11 @@ type DbCID struct {
 }
 
 func (dbc *DbCID) Scan(v interface{}) error {
+	// columns added to a table with rows are null in them
+	if v == nil {
+		return nil
+	}
+
 	b, ok := v.([]byte)
 	if !ok {
 		return fmt.Errorf("dbcids must get bytes!")
@@ -69,6 +74,12 @@ func (dbc *DbCID) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	// undefined cids are marshaled too, as an empty multibase string
+	if s == cid.Undef.String() {
+		dbc.CID = cid.Undef
+		return nil
+	}
+
 	c, err := cid.Decode(s)
 	if err != nil {
 		return err
@@ -118,10 +118,24 @@ func (gw *GatewayHandler) serveUnixfs(ctx context.Context, cc cid.Cid, w http.Re
 		return err
 	}
 
+	setImmutableHeaders(w, cc)
+
+	// the dag reader seeks by the sizes recorded in the dag, so ServeContent
+	// only loads the blocks of the requested ranges. It answers range
+	// requests with a 206, multiple ranges as multipart/byteranges, and
+	// unsatisfiable ones with a 416.
 	http.ServeContent(w, req, cc.String(), time.Time{}, dr)
 	return nil
 }
 
+// setImmutableHeaders marks a response as never changing, the etag lets
+// clients resume a download with If-Range
+func setImmutableHeaders(w http.ResponseWriter, cc cid.Cid) {
+	w.Header().Set("Etag", `"`+cc.String()+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
 func (gw *GatewayHandler) sniffMimeType(w http.ResponseWriter, dr uio.DagReader) error {
 	// see kubo https://github.com/ipfs/kubo/blob/df222053856d3967ff0b4d6bc513bdb66ceedd6f/core/corehttp/gateway_handler_unixfs_file.go
 	// see http ServeContent https://cs.opensource.google/go/go/+/refs/tags/go1.19.2:src/net/http/fs.go;l=221;drc=1f068f0dc7bc997446a7aac44cfc70746ad918e0
@@ -171,6 +185,7 @@ func (gw *GatewayHandler) serveUnixfsDir(ctx context.Context, n mdagipld.Node, w
 			return err
 		}
 
+		setImmutableHeaders(w, nd.Cid())
 		http.ServeContent(w, req, "index.html", time.Time{}, dr)
 		return nil
 	default:
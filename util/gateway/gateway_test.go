@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRangeTestGateway(t *testing.T, data []byte) (*GatewayHandler, cid.Cid) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	// small chunks so ranges span several leaves
+	nd, err := util.ImportFileWithChunker(dserv, bytes.NewReader(data), "size-1024", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGatewayHandler(bs), nd.Cid()
+}
+
+func serveRange(gw *GatewayHandler, c cid.Cid, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/ipfs/"+c.String(), nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGatewayRange(t *testing.T) {
+	a := assert.New(t)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	gw, c := newRangeTestGateway(t, data)
+
+	rec := serveRange(gw, c, nil)
+	a.Equal(http.StatusOK, rec.Code)
+	a.Equal("bytes", rec.Header().Get("Accept-Ranges"))
+	a.Equal(data, rec.Body.Bytes())
+
+	rec = serveRange(gw, c, http.Header{"Range": {"bytes=3000-5999"}})
+	a.Equal(http.StatusPartialContent, rec.Code)
+	a.Equal("bytes 3000-5999/10000", rec.Header().Get("Content-Range"))
+	a.Equal(data[3000:6000], rec.Body.Bytes())
+
+	rec = serveRange(gw, c, http.Header{"Range": {"bytes=-100"}})
+	a.Equal(http.StatusPartialContent, rec.Code)
+	a.Equal(data[9900:], rec.Body.Bytes())
+
+	rec = serveRange(gw, c, http.Header{"Range": {"bytes=0-9,5000-5009"}})
+	a.Equal(http.StatusPartialContent, rec.Code)
+	mt, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	a.NoError(err)
+	a.Equal("multipart/byteranges", mt)
+
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	for _, want := range [][]byte{data[0:10], data[5000:5010]} {
+		part, err := mr.NextPart()
+		if !a.NoError(err) {
+			return
+		}
+		got, err := io.ReadAll(part)
+		a.NoError(err)
+		a.Equal(want, got)
+	}
+
+	rec = serveRange(gw, c, http.Header{"Range": {"bytes=20000-"}})
+	a.Equal(http.StatusRequestedRangeNotSatisfiable, rec.Code)
+	a.Equal("bytes */10000", rec.Header().Get("Content-Range"))
+
+	// a resumed download only gets the range while the content is the same
+	etag := `"` + c.String() + `"`
+	rec = serveRange(gw, c, http.Header{"Range": {"bytes=9000-"}, "If-Range": {etag}})
+	a.Equal(http.StatusPartialContent, rec.Code)
+	a.Equal(data[9000:], rec.Body.Bytes())
+
+	rec = serveRange(gw, c, http.Header{"Range": {"bytes=9000-"}, "If-Range": {`"other"`}})
+	a.Equal(http.StatusOK, rec.Code)
+	a.Equal(data, rec.Body.Bytes())
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"regexp"
 	"strings"
@@ -47,6 +49,11 @@ const (
 	ERR_CONTENT_LENGTH_REQUIRED    = "ERR_CONTENT_LENGTH_REQUIRED"
 	ERR_UNSUPPORTED_CONTENT_TYPE   = "ERR_UNSUPPORTED_CONTENT_TYPE"
 	ERR_VALUE_REQUIRED             = "ERR_VALUE_REQUIRED"
+	ERR_INSUFFICIENT_STORAGE       = "ERR_INSUFFICIENT_STORAGE"
+	ERR_USER_QUOTA_EXCEEDED        = "ERR_USER_QUOTA_EXCEEDED"
+	ERR_USER_PAUSED                = "ERR_USER_PAUSED"
+	ERR_CHECKSUM_MISMATCH          = "ERR_CHECKSUM_MISMATCH"
+	ERR_CONTENT_ROOT_UNREACHABLE   = "ERR_CONTENT_ROOT_UNREACHABLE"
 )
 
 const (
@@ -192,3 +199,33 @@ func ErrorHandler(err error, ctx echo.Context) {
 		return
 	}
 }
+
+// how long the requests in flight are left to complete when an api server
+// shuts down
+const apiShutdownTimeout = time.Second * 10
+
+// StartUntilDone serves e on addr until ctx is done, then shuts it down
+func StartUntilDone(ctx context.Context, e *echo.Echo, addr string) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- e.Start(addr)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("shutting down the api server on %s", addr)
+	sctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(sctx); err != nil {
+		return err
+	}
+
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	MaxContentMetadataKeys        = 32
+	MaxContentMetadataKeyLength   = 64
+	MaxContentMetadataValueLength = 1024
+)
+
+var contentMetadataKeyRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ValidateContentMetadata checks the keys and value sizes of the metadata of
+// a content, an empty value is allowed as it removes its key
+func ValidateContentMetadata(md map[string]string) error {
+	if len(md) > MaxContentMetadataKeys {
+		return fmt.Errorf("content metadata has %d keys, at most %d are allowed", len(md), MaxContentMetadataKeys)
+	}
+
+	for k, v := range md {
+		if len(k) > MaxContentMetadataKeyLength {
+			return fmt.Errorf("content metadata key %q is longer than %d characters", k, MaxContentMetadataKeyLength)
+		}
+
+		if !contentMetadataKeyRe.MatchString(k) {
+			return fmt.Errorf("content metadata key %q must only contain letters, digits, '_', '.' and '-'", k)
+		}
+
+		if len(v) > MaxContentMetadataValueLength {
+			return fmt.Errorf("value of content metadata key %q is longer than %d bytes", k, MaxContentMetadataValueLength)
+		}
+	}
+	return nil
+}
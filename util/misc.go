@@ -51,6 +51,30 @@ func FilterUnwalkableLinks(links []*ipld.Link) []*ipld.Link {
 	return out
 }
 
+// SupportedCodecs are the ipld codecs of the dags this build can fully walk,
+// split and aggregate. Only the codec of the root is known before a dag is
+// fetched, so every block under it has to have one of these too.
+var SupportedCodecs = []uint64{cid.DagProtobuf, cid.Raw}
+
+// SupportedMultihashes are the hash functions of the blocks this build can
+// fetch and verify
+var SupportedMultihashes = []uint64{
+	multihash.IDENTITY,
+	multihash.SHA2_256,
+	multihash.SHA2_512,
+	multihash.SHA3_256,
+	multihash.SHA3_512,
+	multihash.DBL_SHA2_256,
+	multihash.KECCAK_256,
+	multihash.BLAKE2B_MIN + 31, // blake2b-256
+}
+
+// IsInlineCid returns true if the data of the block is inlined in the cid
+// itself (identity multihash), such blocks never need to be fetched
+func IsInlineCid(c cid.Cid) bool {
+	return c.Prefix().MhType == multihash.IDENTITY
+}
+
 func CidIsUnwalkable(c cid.Cid) bool {
 	pref := c.Prefix()
 	if pref.MhType == multihash.IDENTITY {
@@ -75,6 +99,39 @@ func ErrorIfContentAddingDisabled(isContentAddingDisabled bool) error {
 	return nil
 }
 
+func ErrorIfStorageFull(isStorageFull bool) error {
+	if isStorageFull {
+		return &HttpError{
+			Code:    http.StatusInsufficientStorage,
+			Reason:  ERR_INSUFFICIENT_STORAGE,
+			Details: "this node is running out of storage space and is not accepting new content at the moment",
+		}
+	}
+	return nil
+}
+
+func ErrorIfUserQuotaExceeded(isQuotaExceeded bool) error {
+	if isQuotaExceeded {
+		return &HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  ERR_USER_QUOTA_EXCEEDED,
+			Details: "this content would exceed your storage quota on this node",
+		}
+	}
+	return nil
+}
+
+func ErrorIfUserPaused(isPaused bool) error {
+	if isPaused {
+		return &HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  ERR_USER_PAUSED,
+			Details: "uploading content to this node is paused for your account",
+		}
+	}
+	return nil
+}
+
 // required for car uploads
 func WithContentLengthCheck(f func(echo.Context) error) func(echo.Context) error {
 	return func(c echo.Context) error {
@@ -18,6 +18,29 @@ type ShuttleStorageStats struct {
 	BlockstoreFree uint64 `json:"blockstoreFree"`
 	PinCount       int64  `json:"pinCount"`
 	PinQueueLength int64  `json:"pinQueueLength"`
+	ActivePins     int64  `json:"activePins"`
+
+	UserQueueSizes map[uint]int `json:"userQueueSizes,omitempty"`
+
+	RetrievalQueueLength int64 `json:"retrievalQueueLength"`
+	ActiveRetrievals     int64 `json:"activeRetrievals"`
+
+	PausedUsers []uint `json:"pausedUsers,omitempty"`
+}
+
+type ShuttleHealth struct {
+	ReportedAt      time.Time `json:"reportedAt"`
+	BlockstoreSize  uint64    `json:"blockstoreSize"`
+	BlockstoreFree  uint64    `json:"blockstoreFree"`
+	PinQueueLength  int       `json:"pinQueueLength"`
+	ActivePins      int       `json:"activePins"`
+	ActiveTransfers int       `json:"activeTransfers"`
+	Goroutines      int       `json:"goroutines"`
+	MemoryAlloc     uint64    `json:"memoryAlloc"`
+	MemorySys       uint64    `json:"memorySys"`
+	DBHealthy       bool      `json:"dbHealthy"`
+	DBError         string    `json:"dbError,omitempty"`
+	PausedUsers     []uint    `json:"pausedUsers,omitempty"`
 }
 
 type ShuttleListResponse struct {
@@ -30,6 +53,7 @@ type ShuttleListResponse struct {
 	Hostname       string          `json:"hostname"`
 
 	StorageStats *ShuttleStorageStats `json:"storageStats"`
+	Health       *ShuttleHealth       `json:"health,omitempty"`
 }
 
 type ShuttleCreateContentBody struct {
@@ -1,11 +1,15 @@
 package util
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-cidutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	chunker "github.com/ipfs/go-ipfs-chunker"
 	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
@@ -17,17 +21,35 @@ import (
 
 var DefaultHashFunction = uint64(mh.SHA2_256)
 
+const DefaultChunker = "size-1048576"
+
 func ImportFile(dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
+	return ImportFileWithChunker(dserv, fi, DefaultChunker, true)
+}
+
+// ValidateChunker checks that a chunker spec can be used to import files
+func ValidateChunker(chunkerSpec string) error {
+	_, err := chunker.FromString(bytes.NewReader(nil), chunkerSpec)
+	return err
+}
+
+// ImportFileWithChunker imports the file split with the given chunker spec,
+// e.g. size-262144 or rabin, see chunker.FromString
+func ImportFileWithChunker(dserv ipld.DAGService, fi io.Reader, chunkerSpec string, rawLeaves bool) (ipld.Node, error) {
 	prefix, err := merkledag.PrefixForCidVersion(1)
 	if err != nil {
 		return nil, err
 	}
 	prefix.MhType = DefaultHashFunction
 
-	spl := chunker.NewSizeSplitter(fi, 1024*1024)
+	spl, err := chunker.FromString(fi, chunkerSpec)
+	if err != nil {
+		return nil, err
+	}
+
 	dbp := ihelper.DagBuilderParams{
 		Maxlinks:  1024,
-		RawLeaves: true,
+		RawLeaves: rawLeaves,
 
 		CidBuilder: cidutil.InlineBuilder{
 			Builder: prefix,
@@ -62,3 +84,31 @@ func TryExtractFSNode(nd ipld.Node) (*unixfs.FSNode, error) {
 	}
 	return nil, errors.New("unknown node type")
 }
+
+// EstimateDagSize returns the size of a dag from the sizes its root records
+// for its links, without walking it. It returns 0 when the root is not in the
+// blockstore yet or cannot tell.
+func EstimateDagSize(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) int64 {
+	blk, err := bs.Get(ctx, root)
+	if err != nil {
+		return 0
+	}
+
+	switch root.Prefix().Codec {
+	case cid.Raw:
+		return int64(len(blk.RawData()))
+	case cid.DagProtobuf:
+		nd, err := merkledag.DecodeProtobuf(blk.RawData())
+		if err != nil {
+			return 0
+		}
+
+		size := int64(len(blk.RawData()))
+		for _, l := range nd.Links() {
+			size += int64(l.Size)
+		}
+		return size
+	default:
+		return 0
+	}
+}